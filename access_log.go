@@ -0,0 +1,297 @@
+package main
+
+import (
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "github.com/gorilla/mux"
+    "student-api/reqctx"
+)
+
+// Access logging modes accepted in ACCESS_LOG
+const (
+    AccessLogAll       = "all"
+    AccessLogSensitive = "sensitive"
+    AccessLogOff       = "off"
+)
+
+// defaultAccessReportLimit and maxAccessReportLimit bound GET /students/{id}/access
+const (
+    defaultAccessReportLimit = 100
+    maxAccessReportLimit     = 1000
+)
+
+// Student data a read can expose, as named in ACCESS_LOG_FIELDS
+var (
+    fieldsStudent = []string{"name", "age", "email"}
+    fieldsSummary = []string{"name", "age", "summary"}
+    fieldsNotes   = []string{"notes"}
+)
+
+// accessFields are the field names ACCESS_LOG_FIELDS may list
+var accessFields = map[string]bool{"name": true, "age": true, "email": true, "summary": true, "notes": true}
+
+// StudentAccess records that someone read a student's data
+type StudentAccess struct {
+    StudentID int       `json:"student_id"`
+    Tenant    string    `json:"-"`
+    Actor     string    `json:"actor"`
+    RequestID string    `json:"request_id"`
+    Route     string    `json:"route"`
+    Fields    []string  `json:"fields"`
+    At        time.Time `json:"at"`
+}
+
+// AccessLogRepository persists student access records
+type AccessLogRepository interface {
+    Record(entries []StudentAccess) error
+    // ForStudent returns a tenant's student's accesses, newest first
+    ForStudent(tenant string, studentID, limit int) ([]StudentAccess, error)
+}
+
+// MemoryAccessLogRepository keeps access records in memory, for
+// STORE_BACKEND=memory
+type MemoryAccessLogRepository struct {
+    sync.RWMutex
+    entries map[studentKey][]StudentAccess // oldest first
+}
+
+// NewMemoryAccessLogRepository initializes a new MemoryAccessLogRepository
+func NewMemoryAccessLogRepository() *MemoryAccessLogRepository {
+    return &MemoryAccessLogRepository{entries: make(map[studentKey][]StudentAccess)}
+}
+
+func (m *MemoryAccessLogRepository) Record(entries []StudentAccess) error {
+    m.Lock()
+    defer m.Unlock()
+    for _, e := range entries {
+        key := studentKey{e.Tenant, e.StudentID}
+        m.entries[key] = append(m.entries[key], e)
+    }
+    return nil
+}
+
+func (m *MemoryAccessLogRepository) ForStudent(tenant string, studentID, limit int) ([]StudentAccess, error) {
+    m.RLock()
+    defer m.RUnlock()
+    entries := m.entries[studentKey{tenant, studentID}]
+    out := make([]StudentAccess, 0, limit)
+    for i := len(entries) - 1; i >= 0 && len(out) < limit; i-- {
+        out = append(out, entries[i])
+    }
+    return out, nil
+}
+
+// SQLAccessLogRepository keeps access records in the access_log table
+type SQLAccessLogRepository struct {
+    db     *sql.DB
+    rebind func(string) string
+}
+
+// NewSQLAccessLogRepository creates a repository; rebind may be nil
+func NewSQLAccessLogRepository(db *sql.DB, rebind func(string) string) *SQLAccessLogRepository {
+    if rebind == nil {
+        rebind = func(q string) string { return q }
+    }
+    return &SQLAccessLogRepository{db: db, rebind: rebind}
+}
+
+// Record inserts the entries in one transaction
+func (s *SQLAccessLogRepository) Record(entries []StudentAccess) error {
+    tx, err := s.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    stmt, err := tx.Prepare(s.rebind(`INSERT INTO access_log (at, tenant, student_id, actor, request_id, route, fields)
+        VALUES (?, ?, ?, ?, ?, ?, ?)`))
+    if err != nil {
+        return err
+    }
+    defer stmt.Close()
+    for _, e := range entries {
+        if _, err := stmt.Exec(e.At.Format(time.RFC3339Nano), e.Tenant, e.StudentID, e.Actor, e.RequestID,
+            e.Route, strings.Join(e.Fields, ",")); err != nil {
+            return err
+        }
+    }
+    return tx.Commit()
+}
+
+func (s *SQLAccessLogRepository) ForStudent(tenant string, studentID, limit int) ([]StudentAccess, error) {
+    rows, err := s.db.Query(s.rebind(`SELECT at, actor, request_id, route, fields FROM access_log
+        WHERE tenant = ? AND student_id = ? ORDER BY id DESC LIMIT ?`), tenant, studentID, limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    entries := []StudentAccess{}
+    for rows.Next() {
+        e := StudentAccess{StudentID: studentID, Tenant: tenant}
+        var at, fields string
+        if err := rows.Scan(&at, &e.Actor, &e.RequestID, &e.Route, &fields); err != nil {
+            return nil, err
+        }
+        if e.At, err = time.Parse(time.RFC3339Nano, at); err != nil {
+            return nil, err
+        }
+        e.Fields = strings.Split(fields, ",")
+        entries = append(entries, e)
+    }
+    return entries, rows.Err()
+}
+
+// AccessLog decides which reads are recorded: every read of student data,
+// or in sensitive mode only reads exposing one of the sensitive fields
+type AccessLog struct {
+    repo      AccessLogRepository
+    mode      string
+    sensitive map[string]bool
+}
+
+// NewAccessLog creates an access log recording to repo in mode
+func NewAccessLog(repo AccessLogRepository, mode string, sensitive []string) (*AccessLog, error) {
+    switch mode {
+    case AccessLogAll, AccessLogSensitive, AccessLogOff:
+    default:
+        return nil, fmt.Errorf("ACCESS_LOG must be %s, %s or %s, got %q", AccessLogAll, AccessLogSensitive, AccessLogOff, mode)
+    }
+    fields := make(map[string]bool)
+    for _, field := range sensitive {
+        if !accessFields[field] {
+            return nil, fmt.Errorf("ACCESS_LOG_FIELDS: unknown field %q", field)
+        }
+        fields[field] = true
+    }
+    if mode == AccessLogSensitive && len(fields) == 0 {
+        return nil, fmt.Errorf("ACCESS_LOG=%s needs at least one field in ACCESS_LOG_FIELDS", AccessLogSensitive)
+    }
+    return &AccessLog{repo: repo, mode: mode, sensitive: fields}, nil
+}
+
+// LoadAccessLog reads ACCESS_LOG (default sensitive) and ACCESS_LOG_FIELDS
+// (default email)
+func LoadAccessLog(repo AccessLogRepository) (*AccessLog, error) {
+    fields := getEnvList("ACCESS_LOG_FIELDS")
+    if len(fields) == 0 {
+        fields = []string{"email"}
+    }
+    return NewAccessLog(repo, getEnv("ACCESS_LOG", AccessLogSensitive), fields)
+}
+
+// logs reports whether a read exposing fields is recorded
+func (a *AccessLog) logs(fields []string) bool {
+    switch a.mode {
+    case AccessLogAll:
+        return true
+    case AccessLogSensitive:
+        for _, field := range fields {
+            if a.sensitive[field] {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// recordAccess logs that the request read fields of the given students. A
+// failure to record is logged but does not fail the read.
+func (app *App) recordAccess(r *http.Request, fields []string, ids ...int) {
+    app.noteHoneypots(r, ids...)
+    if len(ids) == 0 || !app.access.logs(fields) {
+        return
+    }
+    info := reqctx.From(r.Context())
+    actor := info.User
+    if actor == "" {
+        actor = "anonymous"
+    }
+    now := time.Now().UTC()
+    entries := make([]StudentAccess, len(ids))
+    for i, id := range ids {
+        entries[i] = StudentAccess{StudentID: id, Tenant: info.Tenant, Actor: actor, RequestID: info.RequestID,
+            Route: routeTemplate(r), Fields: fields, At: now}
+    }
+    if err := app.access.repo.Record(entries); err != nil {
+        reqctx.Logger(r.Context()).Error("recording student access failed", "students", len(ids), "error", err)
+        app.metrics.Inc("access_log_errors_total")
+        return
+    }
+    app.metrics.Add("access_log_entries_total", float64(len(ids)), "route", routeTemplate(r))
+}
+
+// studentIDs returns the IDs of students
+func studentIDs(students []Student) []int {
+    ids := make([]int, len(students))
+    for i, s := range students {
+        ids[i] = s.ID
+    }
+    return ids
+}
+
+// AccessActor summarizes one actor's reads of a student
+type AccessActor struct {
+    Actor  string    `json:"actor"`
+    Count  int       `json:"count"`
+    LastAt time.Time `json:"last_at"`
+}
+
+// GetStudentAccess is the "who accessed my data" report:
+// GET /students/{id}/access?limit=100 lists the latest recorded reads, newest
+// first, with a per-actor summary of them. Reads of deleted students stay
+// reportable.
+func (app *App) GetStudentAccess(w http.ResponseWriter, r *http.Request) {
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        httpError(w, r, "Invalid ID", http.StatusBadRequest)
+        return
+    }
+    limit := defaultAccessReportLimit
+    if value := r.URL.Query().Get("limit"); value != "" {
+        n, err := strconv.Atoi(value)
+        if err != nil || n < 1 || n > maxAccessReportLimit {
+            writeValidationErrors(w, r, []ValidationError{{
+                Field:   "limit",
+                Code:    CodeOutOfRange,
+                Message: fmt.Sprintf("Limit must be between 1 and %d", maxAccessReportLimit),
+            }})
+            return
+        }
+        limit = n
+    }
+
+    entries, err := app.access.repo.ForStudent(reqctx.From(r.Context()).Tenant, id, limit)
+    if err != nil {
+        reqctx.Logger(r.Context()).Error("reading access log failed", "student_id", id, "error", err)
+        httpError(w, r, "Internal server error", http.StatusInternalServerError)
+        return
+    }
+
+    byActor := make(map[string]*AccessActor)
+    for _, e := range entries {
+        a := byActor[e.Actor]
+        if a == nil {
+            a = &AccessActor{Actor: e.Actor, LastAt: e.At}
+            byActor[e.Actor] = a
+        }
+        a.Count++
+    }
+    actors := make([]AccessActor, 0, len(byActor))
+    for _, a := range byActor {
+        actors = append(actors, *a)
+    }
+    sort.Slice(actors, func(i, j int) bool { return actors[i].LastAt.After(actors[j].LastAt) })
+
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "student_id": id,
+        "mode":       app.access.mode,
+        "accesses":   entries,
+        "actors":     actors,
+    })
+}
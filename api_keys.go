@@ -0,0 +1,555 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/sha256"
+    "database/sql"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "math"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "github.com/gorilla/mux"
+    "student-api/reqctx"
+)
+
+// apiKeyHeader carries service API keys, as an alternative to a JWT
+const apiKeyHeader = "X-API-Key"
+
+// apiKeySecretPrefix marks API key secrets in logs and listings
+const apiKeySecretPrefix = "ak_"
+
+// apiKeyTouchInterval throttles last_used_at writes to one per key per interval
+const apiKeyTouchInterval = time.Minute
+
+var errAPIKeyNotFound = errors.New("api key not found")
+
+// APIKey is a static key for service-to-service callers. Only a hash of its
+// secret is stored; Prefix identifies it in listings. RateLimit is in
+// requests per minute. A key with Scopes is a read-only token, whose secret
+// may also be presented as a bearer credential. A key with a Tenant is
+// bound to it.
+type APIKey struct {
+    ID         int        `json:"id"`
+    Name       string     `json:"name"`
+    Prefix     string     `json:"prefix"`
+    RateLimit  int        `json:"rate_limit"`
+    Role       string     `json:"role"`
+    Scopes     []string   `json:"scopes,omitempty"`
+    Tenant     string     `json:"tenant,omitempty"`
+    CreatedAt  time.Time  `json:"created_at"`
+    LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+    RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// allows reports whether the key grants a request for a route template
+func (k APIKey) allows(method, route string) bool {
+    if len(k.Scopes) == 0 {
+        return true
+    }
+    if method != http.MethodGet && method != http.MethodHead {
+        return false
+    }
+    for _, scope := range k.Scopes {
+        if scopeRoutes[scope][route] {
+            return true
+        }
+    }
+    return false
+}
+
+type apiKeyCtxKey struct{}
+
+// apiKeyFrom returns the API key that authenticated a request
+func apiKeyFrom(ctx context.Context) (APIKey, bool) {
+    key, ok := ctx.Value(apiKeyCtxKey{}).(APIKey)
+    return key, ok
+}
+
+// APIKeyRequest is the body of POST /admin/api-keys. A zero rate limit
+// takes the API_KEY_RATE_LIMIT default; an empty role is defaultRole, or
+// readonly for a key with scopes, e.g. {"name": "metabase", "scopes":
+// ["students:read"]}.
+type APIKeyRequest struct {
+    Name      string   `json:"name"`
+    RateLimit int      `json:"rate_limit"`
+    Role      string   `json:"role"`
+    Scopes    []string `json:"scopes"`
+    Tenant    string   `json:"tenant"`
+}
+
+// Validate checks if the API key request is usable
+func (k APIKeyRequest) Validate() []ValidationError {
+    var errors []ValidationError
+
+    if strings.TrimSpace(k.Name) == "" {
+        errors = append(errors, ValidationError{
+            Field:   "name",
+            Code:    CodeRequired,
+            Message: "Name is required",
+        })
+    }
+
+    if k.RateLimit < 0 {
+        errors = append(errors, ValidationError{
+            Field:   "rate_limit",
+            Code:    CodeOutOfRange,
+            Message: "Rate limit must be zero or a positive number of requests per minute",
+        })
+    }
+
+    if _, err := parseRole(k.Role); err != nil {
+        errors = append(errors, ValidationError{
+            Field:   "role",
+            Code:    CodeOutOfRange,
+            Message: "Role must be admin, teacher or readonly",
+        })
+    }
+
+    if len(k.Scopes) > 0 && k.Role != "" && k.Role != RoleReadonly {
+        errors = append(errors, ValidationError{
+            Field:   "role",
+            Code:    CodeOutOfRange,
+            Message: "A key with scopes must be readonly",
+        })
+    }
+    for _, scope := range k.Scopes {
+        if _, ok := scopeRoutes[scope]; !ok {
+            errors = append(errors, ValidationError{
+                Field:   "scopes",
+                Code:    CodeOutOfRange,
+                Message: "Unknown scope " + strconv.Quote(scope),
+            })
+        }
+    }
+
+    if k.Tenant != "" && !validTenantID.MatchString(k.Tenant) {
+        errors = append(errors, ValidationError{
+            Field:   "tenant",
+            Code:    CodeOutOfRange,
+            Message: "Tenant must be a tenant ID",
+        })
+    }
+
+    return errors
+}
+
+// APIKeyRepository persists API keys by the SHA-256 hex of their secret
+type APIKeyRepository interface {
+    Create(key APIKey, hash string) (APIKey, error)
+    List() ([]APIKey, error)
+    // ByHash returns the live key with the given hash or errAPIKeyNotFound
+    ByHash(hash string) (APIKey, error)
+    Touch(id int, at time.Time) error
+    Revoke(id int, at time.Time) (APIKey, error)
+}
+
+// MemoryAPIKeyRepository keeps API keys in memory, for STORE_BACKEND=memory
+type MemoryAPIKeyRepository struct {
+    sync.RWMutex
+    keys   map[int]*APIKey
+    hashes map[string]int
+    nextID int
+}
+
+// NewMemoryAPIKeyRepository initializes a new MemoryAPIKeyRepository
+func NewMemoryAPIKeyRepository() *MemoryAPIKeyRepository {
+    return &MemoryAPIKeyRepository{keys: make(map[int]*APIKey), hashes: make(map[string]int), nextID: 1}
+}
+
+func (m *MemoryAPIKeyRepository) Create(key APIKey, hash string) (APIKey, error) {
+    m.Lock()
+    defer m.Unlock()
+    key.ID = m.nextID
+    m.nextID++
+    m.keys[key.ID] = &key
+    m.hashes[hash] = key.ID
+    return key, nil
+}
+
+func (m *MemoryAPIKeyRepository) List() ([]APIKey, error) {
+    m.RLock()
+    keys := make([]APIKey, 0, len(m.keys))
+    for _, k := range m.keys {
+        keys = append(keys, *k)
+    }
+    m.RUnlock()
+    sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+    return keys, nil
+}
+
+func (m *MemoryAPIKeyRepository) ByHash(hash string) (APIKey, error) {
+    m.RLock()
+    defer m.RUnlock()
+    key, exists := m.keys[m.hashes[hash]]
+    if !exists || key.RevokedAt != nil {
+        return APIKey{}, errAPIKeyNotFound
+    }
+    return *key, nil
+}
+
+func (m *MemoryAPIKeyRepository) Touch(id int, at time.Time) error {
+    m.Lock()
+    defer m.Unlock()
+    if key, exists := m.keys[id]; exists {
+        key.LastUsedAt = &at
+    }
+    return nil
+}
+
+func (m *MemoryAPIKeyRepository) Revoke(id int, at time.Time) (APIKey, error) {
+    m.Lock()
+    defer m.Unlock()
+    key, exists := m.keys[id]
+    if !exists {
+        return APIKey{}, errAPIKeyNotFound
+    }
+    if key.RevokedAt == nil {
+        key.RevokedAt = &at
+    }
+    return *key, nil
+}
+
+// SQLAPIKeyRepository keeps API keys in the api_keys table. Timestamps are
+// RFC 3339 text, as in schema_migrations, so one implementation serves every
+// dialect.
+type SQLAPIKeyRepository struct {
+    db     *sql.DB
+    rebind func(string) string
+    // returning is set for PostgreSQL, whose driver has no LastInsertId
+    returning bool
+}
+
+// NewSQLAPIKeyRepository creates a repository; rebind may be nil
+func NewSQLAPIKeyRepository(db *sql.DB, rebind func(string) string, returning bool) *SQLAPIKeyRepository {
+    if rebind == nil {
+        rebind = func(q string) string { return q }
+    }
+    return &SQLAPIKeyRepository{db: db, rebind: rebind, returning: returning}
+}
+
+const apiKeyColumns = `id, name, prefix, rate_limit, role, scopes, tenant, created_at, last_used_at, revoked_at`
+
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (APIKey, error) {
+    var key APIKey
+    var scopes, created string
+    var lastUsed, revoked sql.NullString
+    if err := row.Scan(&key.ID, &key.Name, &key.Prefix, &key.RateLimit, &key.Role, &scopes, &key.Tenant, &created, &lastUsed, &revoked); err != nil {
+        return APIKey{}, err
+    }
+    if scopes != "" {
+        key.Scopes = strings.Split(scopes, ",")
+    }
+    var err error
+    if key.CreatedAt, err = time.Parse(time.RFC3339Nano, created); err != nil {
+        return APIKey{}, err
+    }
+    for _, t := range []struct {
+        text sql.NullString
+        dst  **time.Time
+    }{{lastUsed, &key.LastUsedAt}, {revoked, &key.RevokedAt}} {
+        if !t.text.Valid {
+            continue
+        }
+        parsed, err := time.Parse(time.RFC3339Nano, t.text.String)
+        if err != nil {
+            return APIKey{}, err
+        }
+        *t.dst = &parsed
+    }
+    return key, nil
+}
+
+func (s *SQLAPIKeyRepository) Create(key APIKey, hash string) (APIKey, error) {
+    query := `INSERT INTO api_keys (name, prefix, hash, rate_limit, role, scopes, tenant, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+    args := []interface{}{key.Name, key.Prefix, hash, key.RateLimit, key.Role, strings.Join(key.Scopes, ","), key.Tenant, key.CreatedAt.Format(time.RFC3339Nano)}
+    if s.returning {
+        var id int64
+        if err := s.db.QueryRow(s.rebind(query+` RETURNING id`), args...).Scan(&id); err != nil {
+            return APIKey{}, err
+        }
+        key.ID = int(id)
+        return key, nil
+    }
+    result, err := s.db.Exec(s.rebind(query), args...)
+    if err != nil {
+        return APIKey{}, err
+    }
+    id, err := result.LastInsertId()
+    if err != nil {
+        return APIKey{}, err
+    }
+    key.ID = int(id)
+    return key, nil
+}
+
+func (s *SQLAPIKeyRepository) List() ([]APIKey, error) {
+    rows, err := s.db.Query(`SELECT ` + apiKeyColumns + ` FROM api_keys ORDER BY id`)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    keys := []APIKey{}
+    for rows.Next() {
+        key, err := scanAPIKey(rows)
+        if err != nil {
+            return nil, err
+        }
+        keys = append(keys, key)
+    }
+    return keys, rows.Err()
+}
+
+func (s *SQLAPIKeyRepository) ByHash(hash string) (APIKey, error) {
+    row := s.db.QueryRow(s.rebind(`SELECT `+apiKeyColumns+` FROM api_keys WHERE hash = ? AND revoked_at IS NULL`), hash)
+    key, err := scanAPIKey(row)
+    if errors.Is(err, sql.ErrNoRows) {
+        return APIKey{}, errAPIKeyNotFound
+    }
+    return key, err
+}
+
+func (s *SQLAPIKeyRepository) Touch(id int, at time.Time) error {
+    _, err := s.db.Exec(s.rebind(`UPDATE api_keys SET last_used_at = ? WHERE id = ?`), at.Format(time.RFC3339Nano), id)
+    return err
+}
+
+func (s *SQLAPIKeyRepository) Revoke(id int, at time.Time) (APIKey, error) {
+    _, err := s.db.Exec(s.rebind(`UPDATE api_keys SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL`), at.Format(time.RFC3339Nano), id)
+    if err != nil {
+        return APIKey{}, err
+    }
+    key, err := scanAPIKey(s.db.QueryRow(s.rebind(`SELECT `+apiKeyColumns+` FROM api_keys WHERE id = ?`), id))
+    if errors.Is(err, sql.ErrNoRows) {
+        return APIKey{}, errAPIKeyNotFound
+    }
+    return key, err
+}
+
+// keyBucket is a token bucket holding up to a minute's worth of requests
+type keyBucket struct {
+    tokens  float64
+    updated time.Time
+    touched time.Time
+}
+
+// APIKeyStore authenticates API keys and enforces their per-key rate limits.
+// Buckets live in memory, so limits apply per instance.
+type APIKeyStore struct {
+    repo         APIKeyRepository
+    defaultLimit int
+
+    mu      sync.Mutex
+    buckets map[int]*keyBucket
+}
+
+// NewAPIKeyStore wraps repo; keys without a rate limit get defaultLimit
+func NewAPIKeyStore(repo APIKeyRepository, defaultLimit int) *APIKeyStore {
+    return &APIKeyStore{repo: repo, defaultLimit: defaultLimit, buckets: make(map[int]*keyBucket)}
+}
+
+// hashAPIKey returns the stored form of a secret
+func hashAPIKey(secret string) string {
+    sum := sha256.Sum256([]byte(secret))
+    return hex.EncodeToString(sum[:])
+}
+
+// Issue creates a key and returns it with its secret, which is not stored
+// and cannot be shown again
+func (s *APIKeyStore) Issue(req APIKeyRequest) (APIKey, string, error) {
+    buf := make([]byte, 24)
+    if _, err := rand.Read(buf); err != nil {
+        return APIKey{}, "", err
+    }
+    prefix, role := apiKeySecretPrefix, req.Role
+    if len(req.Scopes) > 0 {
+        prefix, role = tokenSecretPrefix, RoleReadonly
+    }
+    secret := prefix + hex.EncodeToString(buf)
+    role, err := parseRole(role)
+    if err != nil {
+        return APIKey{}, "", err
+    }
+    key, err := s.repo.Create(APIKey{
+        Name:      strings.TrimSpace(req.Name),
+        Prefix:    secret[:len(prefix)+8],
+        RateLimit: req.RateLimit,
+        Role:      role,
+        Scopes:    req.Scopes,
+        Tenant:    req.Tenant,
+        CreatedAt: time.Now().UTC(),
+    }, hashAPIKey(secret))
+    return key, secret, err
+}
+
+// limit returns a key's effective requests per minute
+func (s *APIKeyStore) limit(key APIKey) int {
+    if key.RateLimit > 0 {
+        return key.RateLimit
+    }
+    return s.defaultLimit
+}
+
+// Allow takes a request from key's bucket. When the bucket is empty it
+// returns false and how long until the next request is allowed.
+func (s *APIKeyStore) Allow(key APIKey, now time.Time) (bool, time.Duration) {
+    limit := float64(s.limit(key))
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    b, exists := s.buckets[key.ID]
+    if !exists {
+        b = &keyBucket{tokens: limit, updated: now}
+        s.buckets[key.ID] = b
+    }
+    b.tokens = math.Min(limit, b.tokens+now.Sub(b.updated).Minutes()*limit)
+    b.updated = now
+    if b.tokens < 1 {
+        return false, time.Duration((1 - b.tokens) / limit * float64(time.Minute))
+    }
+    b.tokens--
+    return true, 0
+}
+
+// touch reports whether key's last use should be written now
+func (s *APIKeyStore) touch(key APIKey, now time.Time) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    b := s.buckets[key.ID]
+    if b == nil || now.Sub(b.touched) < apiKeyTouchInterval {
+        return false
+    }
+    b.touched = now
+    return true
+}
+
+// Revoke disables a key and forgets its bucket
+func (s *APIKeyStore) Revoke(id int) (APIKey, error) {
+    key, err := s.repo.Revoke(id, time.Now().UTC())
+    if err == nil {
+        s.mu.Lock()
+        delete(s.buckets, id)
+        s.mu.Unlock()
+    }
+    return key, err
+}
+
+// apiKeys authenticates requests presenting an X-API-Key header and applies
+// the key's rate limit. A valid key stands in for a JWT; requests without
+// the header are passed through unchanged.
+func (app *App) apiKeys(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        secret := strings.TrimSpace(r.Header.Get(apiKeyHeader))
+        if secret == "" {
+            next.ServeHTTP(w, r)
+            return
+        }
+        app.serveAPIKey(w, r, next, secret)
+    })
+}
+
+// serveAPIKey authenticates a key secret, applies its rate limit, scopes and
+// tenant, and serves the request as the key
+func (app *App) serveAPIKey(w http.ResponseWriter, r *http.Request, next http.Handler, secret string) {
+    key, err := app.keys.repo.ByHash(hashAPIKey(secret))
+    if errors.Is(err, errAPIKeyNotFound) {
+        app.metrics.Inc("api_key_requests_total", "key", "", "outcome", "invalid")
+        httpError(w, r, "Invalid or revoked API key", http.StatusUnauthorized)
+        return
+    }
+    if err != nil {
+        reqctx.Logger(r.Context()).Error("looking up API key failed", "error", err)
+        httpError(w, r, "Internal server error", http.StatusInternalServerError)
+        return
+    }
+    r, ok := bindTenant(w, r, key.Role, key.Tenant)
+    if !ok {
+        return
+    }
+    if !key.allows(r.Method, routeTemplate(r)) {
+        app.metrics.Inc("api_key_requests_total", "key", key.Name, "outcome", "forbidden")
+        httpError(w, r, "API key does not grant access to this endpoint", http.StatusForbidden)
+        return
+    }
+
+    now := time.Now()
+    w.Header().Set("X-RateLimit-Limit", strconv.Itoa(app.keys.limit(key)))
+    allowed, wait := app.keys.Allow(key, now)
+    if !allowed {
+        app.metrics.Inc("api_key_requests_total", "key", key.Name, "outcome", "rate_limited")
+        w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+        httpError(w, r, "API key rate limit exceeded", http.StatusTooManyRequests)
+        return
+    }
+    app.metrics.Inc("api_key_requests_total", "key", key.Name, "outcome", "allowed")
+    if app.keys.touch(key, now) {
+        if err := app.keys.repo.Touch(key.ID, now.UTC()); err != nil {
+            reqctx.Logger(r.Context()).Warn("recording API key use failed", "error", err)
+        }
+    }
+
+    ctx := reqctx.WithRole(reqctx.WithUser(r.Context(), "key:"+key.Name), key.Role)
+    ctx = context.WithValue(ctx, apiKeyCtxKey{}, key)
+    next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// CreateAPIKey issues a service key: POST /admin/api-keys
+// {"name": "billing", "rate_limit": 120, "role": "readonly"}. The secret is only returned in
+// this response.
+func (app *App) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+    var req APIKeyRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        httpError(w, r, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    if errors := req.Validate(); len(errors) > 0 {
+        writeValidationErrors(w, r, errors)
+        return
+    }
+
+    key, secret, err := app.keys.Issue(req)
+    if err != nil {
+        reqctx.Logger(r.Context()).Error("issuing API key failed", "error", err)
+        httpError(w, r, "Internal server error", http.StatusInternalServerError)
+        return
+    }
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "key":    key,
+        "secret": secret,
+    })
+}
+
+func (app *App) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+    keys, err := app.keys.repo.List()
+    if err != nil {
+        reqctx.Logger(r.Context()).Error("listing API keys failed", "error", err)
+        httpError(w, r, "Internal server error", http.StatusInternalServerError)
+        return
+    }
+    json.NewEncoder(w).Encode(keys)
+}
+
+func (app *App) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        httpError(w, r, "Invalid ID", http.StatusBadRequest)
+        return
+    }
+    key, err := app.keys.Revoke(id)
+    if errors.Is(err, errAPIKeyNotFound) {
+        httpError(w, r, "API key not found", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        reqctx.Logger(r.Context()).Error("revoking API key failed", "error", err)
+        httpError(w, r, "Internal server error", http.StatusInternalServerError)
+        return
+    }
+    json.NewEncoder(w).Encode(key)
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "log/slog"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "github.com/gorilla/mux"
+    "student-api/reqctx"
+)
+
+// Audit sink names accepted in AUDIT_SINKS
+const (
+    AuditSinkDB     = "db"
+    AuditSinkSyslog = "syslog"
+    AuditSinkHTTPS  = "https"
+)
+
+// Audit actions, derived from the request method or, for a write to a
+// student, from the operation recorded for it
+const (
+    AuditRead    = "read"
+    AuditCreate  = "create"
+    AuditUpdate  = "update"
+    AuditDelete  = "delete"
+    AuditRestore = "restore"
+)
+
+// auditOperations maps history operations onto their audit action
+var auditOperations = map[string]string{
+    OpCreate:  AuditCreate,
+    OpUpdate:  AuditUpdate,
+    OpDelete:  AuditDelete,
+    OpRestore: AuditRestore,
+}
+
+const (
+    auditBatchSize    = 100
+    auditBufferSize   = 4096
+    auditMemoryEvents = 10000
+)
+
+// auditExemptRoutes are probes and documentation that carry no data and are
+// not audited
+var auditExemptRoutes = map[string]bool{
+    "/healthz":      true,
+    "/readyz":       true,
+    "/metrics":      true,
+    "/version":      true,
+    "/openapi.json": true,
+    "/schema":       true,
+    "/docs":         true,
+    "/docs/{file}":  true,
+}
+
+// AuditEvent records one data access or mutation: who did what to which
+// route, and how it ended. A request writing students is recorded once per
+// student written, with StudentID and the old and new value of each field the
+// write changed in Changes. ID is set on events read back from a sink.
+type AuditEvent struct {
+    ID        int64     `json:"id,omitempty"`
+    At        time.Time `json:"at"`
+    RequestID string    `json:"request_id"`
+    Actor     string    `json:"actor,omitempty"`
+    Tenant    string    `json:"tenant,omitempty"`
+    Action    string    `json:"action"`
+    Method    string    `json:"method"`
+    Route     string    `json:"route"`
+    Path      string    `json:"path"`
+    Status    int       `json:"status"`
+    Source    string    `json:"source,omitempty"`
+    // Honeypot lists the decoy students the request touched
+    Honeypot  []int                  `json:"honeypot,omitempty"`
+    StudentID int                    `json:"student_id,omitempty"`
+    Changes   map[string]FieldChange `json:"changes,omitempty"`
+}
+
+// Denied reports whether the request was refused for lack of credentials or
+// permission, which SIEM rules usually alert on
+func (e AuditEvent) Denied() bool {
+    return e.Status == http.StatusUnauthorized || e.Status == http.StatusForbidden
+}
+
+// auditAction maps a request method to its audit action
+func auditAction(method string) string {
+    switch method {
+    case http.MethodPost:
+        return AuditCreate
+    case http.MethodPut, http.MethodPatch:
+        return AuditUpdate
+    case http.MethodDelete:
+        return AuditDelete
+    default:
+        return AuditRead
+    }
+}
+
+// AuditSink receives audit events in batches, oldest first
+type AuditSink interface {
+    Name() string
+    WriteBatch(ctx context.Context, events []AuditEvent) error
+}
+
+// ParseAuditSinks parses AUDIT_SINKS, e.g. "db,syslog"; "none" disables auditing
+func ParseAuditSinks(spec string) ([]string, error) {
+    var names []string
+    for _, name := range strings.Split(spec, ",") {
+        name = strings.TrimSpace(name)
+        switch name {
+        case "", "none":
+        case AuditSinkDB, AuditSinkSyslog, AuditSinkHTTPS:
+            if !containsString(names, name) {
+                names = append(names, name)
+            }
+        default:
+            return nil, fmt.Errorf("unknown audit sink %q", name)
+        }
+    }
+    return names, nil
+}
+
+// LoadAuditSinks builds the sinks named by AUDIT_SINKS (default "db"). local
+// is the store backend's own sink, used for "db"; remote sinks connect on
+// their first write.
+func LoadAuditSinks(local AuditSink) ([]AuditSink, error) {
+    names, err := ParseAuditSinks(getEnv("AUDIT_SINKS", AuditSinkDB))
+    if err != nil {
+        return nil, err
+    }
+    var sinks []AuditSink
+    for _, name := range names {
+        switch name {
+        case AuditSinkDB:
+            sinks = append(sinks, local)
+        case AuditSinkSyslog:
+            sink, err := LoadSyslogAuditSink()
+            if err != nil {
+                return nil, err
+            }
+            sinks = append(sinks, sink)
+        case AuditSinkHTTPS:
+            sink, err := LoadHTTPAuditSink()
+            if err != nil {
+                return nil, err
+            }
+            sinks = append(sinks, sink)
+        }
+    }
+    return sinks, nil
+}
+
+// AuditLog fans events out to its sinks. Each sink has its own buffer and
+// goroutine, so a slow SIEM never delays requests or the other sinks; when a
+// buffer is full its events are dropped and counted.
+type AuditLog struct {
+    sinks   []*auditQueue
+    metrics *Metrics
+    wg      sync.WaitGroup
+}
+
+type auditQueue struct {
+    sink   AuditSink
+    events chan AuditEvent
+}
+
+// NewAuditLog starts delivering to sinks, flushing each at least every interval
+func NewAuditLog(sinks []AuditSink, interval time.Duration, metrics *Metrics) *AuditLog {
+    a := &AuditLog{metrics: metrics}
+    for _, sink := range sinks {
+        q := &auditQueue{sink: sink, events: make(chan AuditEvent, auditBufferSize)}
+        a.sinks = append(a.sinks, q)
+        a.wg.Add(1)
+        go a.deliver(q, interval)
+    }
+    return a
+}
+
+// Record queues an event for every sink without blocking
+func (a *AuditLog) Record(e AuditEvent) {
+    for _, q := range a.sinks {
+        select {
+        case q.events <- e:
+        default:
+            a.metrics.Inc("audit_events_dropped_total", "sink", q.sink.Name())
+        }
+    }
+}
+
+// deliver sends q's events in batches of up to auditBatchSize
+func (a *AuditLog) deliver(q *auditQueue, interval time.Duration) {
+    defer a.wg.Done()
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    batch := make([]AuditEvent, 0, auditBatchSize)
+    flush := func() {
+        if len(batch) == 0 {
+            return
+        }
+        ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+        err := q.sink.WriteBatch(ctx, batch)
+        cancel()
+        if err != nil {
+            slog.Error("audit sink failed; dropping events", "sink", q.sink.Name(), "events", len(batch), "error", err)
+            a.metrics.Inc("audit_sink_errors_total", "sink", q.sink.Name())
+            a.metrics.Add("audit_events_dropped_total", float64(len(batch)), "sink", q.sink.Name())
+        } else {
+            a.metrics.Add("audit_events_total", float64(len(batch)), "sink", q.sink.Name())
+        }
+        batch = batch[:0]
+    }
+    for {
+        select {
+        case e, ok := <-q.events:
+            if !ok {
+                flush()
+                return
+            }
+            batch = append(batch, e)
+            if len(batch) == auditBatchSize {
+                flush()
+            }
+        case <-ticker.C:
+            flush()
+        }
+    }
+}
+
+// Close flushes the queued events and stops delivery
+func (a *AuditLog) Close() {
+    for _, q := range a.sinks {
+        close(q.events)
+    }
+    a.wg.Wait()
+}
+
+// auditWriter captures the response status for the audit event
+type auditWriter struct {
+    http.ResponseWriter
+    status int
+}
+
+func (aw *auditWriter) WriteHeader(status int) {
+    if aw.status == 0 {
+        aw.status = status
+    }
+    aw.ResponseWriter.WriteHeader(status)
+}
+
+func (aw *auditWriter) Write(b []byte) (int, error) {
+    if aw.status == 0 {
+        aw.status = http.StatusOK
+    }
+    return aw.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController flush streamed responses
+func (aw *auditWriter) Unwrap() http.ResponseWriter {
+    return aw.ResponseWriter
+}
+
+// audit is middleware recording every request to a data route once it has
+// been answered. It runs ahead of authentication and tenancy so requests
+// they refuse are recorded too; auditIdentity reports the caller and tenant
+// they resolved.
+func (app *App) audit(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        route := routeTemplate(r)
+        if auditExemptRoutes[route] {
+            next.ServeHTTP(w, r)
+            return
+        }
+        aw := &auditWriter{ResponseWriter: w}
+        // The inner middleware sets the user and tenant on its own copy of
+        // the request, so read them back through a shared pointer
+        state := &auditState{}
+        next.ServeHTTP(aw, r.WithContext(context.WithValue(r.Context(), auditStateKey{}, state)))
+        info := state.info
+        if info.RequestID == "" {
+            info = reqctx.From(r.Context())
+        }
+        if aw.status == 0 {
+            aw.status = http.StatusOK
+        }
+
+        source, _, err := net.SplitHostPort(r.RemoteAddr)
+        if err != nil {
+            source = r.RemoteAddr
+        }
+        event := AuditEvent{
+            At:        time.Now().UTC(),
+            RequestID: info.RequestID,
+            Actor:     info.User,
+            Tenant:    info.Tenant,
+            Action:    auditAction(r.Method),
+            Method:    r.Method,
+            Route:     route,
+            Path:      r.URL.Path,
+            Status:    aw.status,
+            Source:    source,
+            Honeypot:  state.honeypots,
+        }
+        if len(event.Honeypot) > 0 {
+            app.raiseHoneypotAlert(event)
+        }
+        if app.auditLog == nil {
+            return
+        }
+        if len(state.changes) == 0 {
+            app.auditLog.Record(event)
+            return
+        }
+        for _, c := range state.changes {
+            change := event
+            change.Tenant = c.tenant
+            change.Action = auditOperations[c.version.Operation]
+            change.StudentID = c.version.StudentID
+            change.Changes = eventFromVersion(c.tenant, c.version).Changes
+            app.auditLog.Record(change)
+        }
+    })
+}
+
+// auditState is filled in by the inner middleware and handlers for audit
+type auditState struct {
+    info      reqctx.Info
+    honeypots []int
+    changes   []auditChange
+}
+
+// auditChange is a student version a request wrote in a tenant's store
+type auditChange struct {
+    tenant  string
+    version StudentVersion
+}
+
+// recordChanges tells audit which student versions the request wrote, so
+// each is recorded with its old and new values. Versions of writes changing
+// nothing are skipped.
+func (app *App) recordChanges(r *http.Request, versions ...StudentVersion) {
+    app.recordTenantChanges(r, reqctx.From(r.Context()).Tenant, versions...)
+}
+
+// recordTenantChanges is recordChanges for writes to another tenant than
+// the request's own
+func (app *App) recordTenantChanges(r *http.Request, tenant string, versions ...StudentVersion) {
+    state := auditStateFrom(r.Context())
+    if state == nil {
+        return
+    }
+    for _, v := range versions {
+        if v.Seq != 0 {
+            state.changes = append(state.changes, auditChange{tenant, v})
+        }
+    }
+}
+
+type auditStateKey struct{}
+
+// auditStateFrom returns the audit state of a request, or nil outside audit
+func auditStateFrom(ctx context.Context) *auditState {
+    state, _ := ctx.Value(auditStateKey{}).(*auditState)
+    return state
+}
+
+// auditIdentity is the innermost middleware; it reports the request's final
+// identity back to audit and flags requests for a decoy student's routes
+func (app *App) auditIdentity(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if state := auditStateFrom(r.Context()); state != nil {
+            state.info = reqctx.From(r.Context())
+            if strings.HasPrefix(routeTemplate(r), "/students/{id}") {
+                if id, err := strconv.Atoi(mux.Vars(r)["id"]); err == nil {
+                    app.noteHoneypots(r, id)
+                }
+            }
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// MemoryAuditSink keeps the latest audit events in memory, for
+// STORE_BACKEND=memory
+type MemoryAuditSink struct {
+    sync.RWMutex
+    events []AuditEvent
+    max    int
+    lastID int64
+}
+
+// NewMemoryAuditSink keeps up to max events
+func NewMemoryAuditSink(max int) *MemoryAuditSink {
+    return &MemoryAuditSink{max: max}
+}
+
+func (m *MemoryAuditSink) Name() string { return AuditSinkDB }
+
+func (m *MemoryAuditSink) WriteBatch(ctx context.Context, events []AuditEvent) error {
+    m.Lock()
+    defer m.Unlock()
+    for _, e := range events {
+        m.lastID++
+        e.ID = m.lastID
+        m.events = append(m.events, e)
+    }
+    if over := len(m.events) - m.max; over > 0 {
+        m.events = append([]AuditEvent(nil), m.events[over:]...)
+    }
+    return nil
+}
+
+// SQLAuditSink writes audit events to the audit_log table
+type SQLAuditSink struct {
+    db     *sql.DB
+    rebind func(string) string
+}
+
+// NewSQLAuditSink creates a sink; rebind may be nil
+func NewSQLAuditSink(db *sql.DB, rebind func(string) string) *SQLAuditSink {
+    if rebind == nil {
+        rebind = func(q string) string { return q }
+    }
+    return &SQLAuditSink{db: db, rebind: rebind}
+}
+
+func (s *SQLAuditSink) Name() string { return AuditSinkDB }
+
+// WriteBatch inserts the events in one transaction
+func (s *SQLAuditSink) WriteBatch(ctx context.Context, events []AuditEvent) error {
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    stmt, err := tx.PrepareContext(ctx, s.rebind(`INSERT INTO audit_log
+        (at, request_id, actor, tenant, action, method, route, path, status, source, honeypot, student_id, changes)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`))
+    if err != nil {
+        return err
+    }
+    defer stmt.Close()
+    for _, e := range events {
+        var studentID interface{}
+        changes := ""
+        if e.StudentID != 0 {
+            studentID = e.StudentID
+        }
+        if len(e.Changes) > 0 {
+            encoded, err := json.Marshal(e.Changes)
+            if err != nil {
+                return err
+            }
+            changes = string(encoded)
+        }
+        if _, err := stmt.ExecContext(ctx, e.At.Format(time.RFC3339Nano), e.RequestID, e.Actor, e.Tenant,
+            e.Action, e.Method, e.Route, e.Path, e.Status, e.Source, joinInts(e.Honeypot), studentID, changes); err != nil {
+            return err
+        }
+    }
+    return tx.Commit()
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+    "github.com/gorilla/mux"
+    "student-api/reqctx"
+)
+
+// defaultAuditLimit and maxAuditLimit bound GET /audit and
+// GET /students/{id}/history
+const (
+    defaultAuditLimit = 100
+    maxAuditLimit     = 1000
+)
+
+// auditTimeFormat is the prefix of the stored RFC 3339 timestamps that time
+// bounds are compared against, so they hold to the second whatever the
+// fraction stored
+const auditTimeFormat = "2006-01-02T15:04:05"
+
+// AuditQuery selects a tenant's audit events, newest first. Empty fields
+// match everything; Since and Until are inclusive, to the second, and Before
+// continues a listing below the ID of its last event.
+type AuditQuery struct {
+    Tenant    string
+    Actor     string
+    Actions   []string
+    RequestID string
+    Route     string
+    StudentID int
+    Since     time.Time
+    Until     time.Time
+    Before    int64
+    Limit     int
+}
+
+// matches reports whether an event passes the query, for sinks filtering
+// in memory
+func (q AuditQuery) matches(e AuditEvent) bool {
+    switch {
+    case e.Tenant != q.Tenant:
+        return false
+    case q.Actor != "" && e.Actor != q.Actor:
+        return false
+    case len(q.Actions) > 0 && !containsString(q.Actions, e.Action):
+        return false
+    case q.RequestID != "" && e.RequestID != q.RequestID:
+        return false
+    case q.Route != "" && e.Route != q.Route:
+        return false
+    case q.StudentID != 0 && e.StudentID != q.StudentID:
+        return false
+    case !q.Since.IsZero() && e.At.Truncate(time.Second).Before(q.Since.Truncate(time.Second)):
+        return false
+    case !q.Until.IsZero() && !e.At.Before(q.Until.Truncate(time.Second).Add(time.Second)):
+        return false
+    case q.Before > 0 && e.ID >= q.Before:
+        return false
+    }
+    return true
+}
+
+// AuditReader reads back the audit events a sink has stored
+type AuditReader interface {
+    Query(ctx context.Context, q AuditQuery) ([]AuditEvent, error)
+}
+
+func (m *MemoryAuditSink) Query(ctx context.Context, q AuditQuery) ([]AuditEvent, error) {
+    m.RLock()
+    defer m.RUnlock()
+    events := []AuditEvent{}
+    for i := len(m.events) - 1; i >= 0 && len(events) < q.Limit; i-- {
+        if q.matches(m.events[i]) {
+            events = append(events, m.events[i])
+        }
+    }
+    return events, nil
+}
+
+func (s *SQLAuditSink) Query(ctx context.Context, q AuditQuery) ([]AuditEvent, error) {
+    where, args := []string{"tenant = ?"}, []interface{}{q.Tenant}
+    if q.Actor != "" {
+        where, args = append(where, "actor = ?"), append(args, q.Actor)
+    }
+    if len(q.Actions) > 0 {
+        where = append(where, "action IN (?"+strings.Repeat(", ?", len(q.Actions)-1)+")")
+        for _, action := range q.Actions {
+            args = append(args, action)
+        }
+    }
+    if q.RequestID != "" {
+        where, args = append(where, "request_id = ?"), append(args, q.RequestID)
+    }
+    if q.Route != "" {
+        where, args = append(where, "route = ?"), append(args, q.Route)
+    }
+    if q.StudentID != 0 {
+        where, args = append(where, "student_id = ?"), append(args, q.StudentID)
+    }
+    if !q.Since.IsZero() {
+        where, args = append(where, "at >= ?"), append(args, q.Since.UTC().Format(auditTimeFormat))
+    }
+    if !q.Until.IsZero() {
+        where, args = append(where, "at < ?"), append(args, q.Until.UTC().Truncate(time.Second).Add(time.Second).Format(auditTimeFormat))
+    }
+    if q.Before > 0 {
+        where, args = append(where, "id < ?"), append(args, q.Before)
+    }
+    rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT id, at, request_id, actor, tenant, action, method, route, path,
+        status, source, honeypot, student_id, changes FROM audit_log WHERE `+strings.Join(where, " AND ")+`
+        ORDER BY id DESC LIMIT ?`), append(args, q.Limit)...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    events := []AuditEvent{}
+    for rows.Next() {
+        var e AuditEvent
+        var at, honeypot string
+        var studentID sql.NullInt64
+        var changes sql.NullString
+        if err := rows.Scan(&e.ID, &at, &e.RequestID, &e.Actor, &e.Tenant, &e.Action, &e.Method, &e.Route, &e.Path,
+            &e.Status, &e.Source, &honeypot, &studentID, &changes); err != nil {
+            return nil, err
+        }
+        if e.At, err = time.Parse(time.RFC3339Nano, at); err != nil {
+            return nil, err
+        }
+        if e.Honeypot, err = splitInts(honeypot); err != nil {
+            return nil, err
+        }
+        e.StudentID = int(studentID.Int64)
+        if changes.String != "" {
+            if err := json.Unmarshal([]byte(changes.String), &e.Changes); err != nil {
+                return nil, err
+            }
+        }
+        events = append(events, e)
+    }
+    return events, rows.Err()
+}
+
+// splitInts parses the "1,2,3" written by joinInts
+func splitInts(value string) ([]int, error) {
+    if value == "" {
+        return nil, nil
+    }
+    var ids []int
+    for _, part := range strings.Split(value, ",") {
+        id, err := strconv.Atoi(part)
+        if err != nil {
+            return nil, err
+        }
+        ids = append(ids, id)
+    }
+    return ids, nil
+}
+
+// auditQueryFromRequest reads the filters of GET /audit: actor, action (a
+// comma-separated list), request_id, route, student_id, since and until (RFC
+// 3339 timestamps or plain dates), before and limit
+func auditQueryFromRequest(r *http.Request) (AuditQuery, []ValidationError) {
+    query := r.URL.Query()
+    q := AuditQuery{
+        Tenant:    reqctx.From(r.Context()).Tenant,
+        Actor:     query.Get("actor"),
+        RequestID: query.Get("request_id"),
+        Route:     query.Get("route"),
+        Limit:     defaultAuditLimit,
+    }
+    var errs []ValidationError
+    for _, action := range strings.Split(query.Get("action"), ",") {
+        switch action = strings.TrimSpace(action); action {
+        case "":
+        case AuditRead, AuditCreate, AuditUpdate, AuditDelete, AuditRestore:
+            q.Actions = append(q.Actions, action)
+        default:
+            errs = append(errs, ValidationError{Field: "action", Code: CodeInvalidFilter,
+                Message: fmt.Sprintf("Unknown action %q", action)})
+        }
+    }
+    if value := query.Get("student_id"); value != "" {
+        id, err := strconv.Atoi(value)
+        if err != nil || id < 1 {
+            errs = append(errs, ValidationError{Field: "student_id", Code: CodeInvalidFilter, Message: "student_id must be a positive integer"})
+        }
+        q.StudentID = id
+    }
+    if value := query.Get("since"); value != "" {
+        since, err := time.Parse(time.RFC3339, value)
+        if err != nil {
+            since, err = time.Parse("2006-01-02", value)
+        }
+        if err != nil {
+            errs = append(errs, ValidationError{Field: "since", Code: CodeInvalidFilter, Message: "since must be an RFC 3339 timestamp or a date"})
+        }
+        q.Since = since
+    }
+    if value := query.Get("until"); value != "" {
+        until, ok := parseAsOf(value)
+        if !ok {
+            errs = append(errs, ValidationError{Field: "until", Code: CodeInvalidFilter, Message: "until must be an RFC 3339 timestamp or a date"})
+        }
+        q.Until = until
+    }
+    if value := query.Get("before"); value != "" {
+        before, err := strconv.ParseInt(value, 10, 64)
+        if err != nil || before < 1 {
+            errs = append(errs, ValidationError{Field: "before", Code: CodeInvalidFilter, Message: "before must be an audit event ID"})
+        }
+        q.Before = before
+    }
+    if value := query.Get("limit"); value != "" {
+        n, err := strconv.Atoi(value)
+        if err != nil || n < 1 || n > maxAuditLimit {
+            errs = append(errs, ValidationError{Field: "limit", Code: CodeOutOfRange,
+                Message: fmt.Sprintf("Limit must be between 1 and %d", maxAuditLimit)})
+        }
+        q.Limit = n
+    }
+    return q, errs
+}
+
+// nextAuditURL returns the request's URL continued below the last event, or
+// nil when the listing has ended
+func nextAuditURL(r *http.Request, events []AuditEvent, limit int) *string {
+    if len(events) < limit {
+        return nil
+    }
+    u := url.URL{Path: r.URL.Path}
+    query := r.URL.Query()
+    query.Set("before", strconv.FormatInt(events[len(events)-1].ID, 10))
+    u.RawQuery = query.Encode()
+    next := u.String()
+    return &next
+}
+
+// queryAudit runs q against the audit log, writing the error response when
+// it fails. The log holds old and new personal data, so it is only read by
+// an admin principal, the admin token included, even while authentication
+// is off and rbac lets anonymous requests through.
+func (app *App) queryAudit(w http.ResponseWriter, r *http.Request, q AuditQuery) ([]AuditEvent, bool) {
+    if reqctx.Role(r.Context()) != RoleAdmin {
+        w.Header().Set("WWW-Authenticate", "Bearer")
+        httpError(w, r, "The audit log requires an admin", http.StatusUnauthorized)
+        return nil, false
+    }
+    if app.auditReader == nil {
+        httpError(w, r, "The audit log is only kept with the db audit sink", http.StatusNotImplemented)
+        return nil, false
+    }
+    events, err := app.auditReader.Query(r.Context(), q)
+    if err != nil {
+        reqctx.Logger(r.Context()).Error("reading audit log failed", "error", err)
+        httpError(w, r, "Internal server error", http.StatusInternalServerError)
+        return nil, false
+    }
+    for i := range events {
+        events[i] = app.masker.Audit(events[i])
+    }
+    return events, true
+}
+
+// ListAudit serves GET /audit, the tenant's audit events newest first for
+// compliance reviews, e.g. ?actor=alice&action=update,delete&since=2024-01-01.
+// Next continues the listing.
+func (app *App) ListAudit(w http.ResponseWriter, r *http.Request) {
+    q, errs := auditQueryFromRequest(r)
+    if len(errs) > 0 {
+        writeValidationErrors(w, r, errs)
+        return
+    }
+    events, ok := app.queryAudit(w, r, q)
+    if !ok {
+        return
+    }
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "events": events,
+        "next":   nextAuditURL(r, events, q.Limit),
+    })
+}
+
+// GetStudentHistory serves GET /students/{id}/history: who wrote the student
+// when, with the old and new values, newest first. It takes the filters of
+// GET /audit and, like them, covers deleted and purged students.
+func (app *App) GetStudentHistory(w http.ResponseWriter, r *http.Request) {
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        httpError(w, r, "Invalid ID", http.StatusBadRequest)
+        return
+    }
+    q, errs := auditQueryFromRequest(r)
+    if len(errs) > 0 {
+        writeValidationErrors(w, r, errs)
+        return
+    }
+    q.StudentID = id
+    events, ok := app.queryAudit(w, r, q)
+    if !ok {
+        return
+    }
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "student_id": id,
+        "events":     events,
+        "next":       nextAuditURL(r, events, q.Limit),
+    })
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "math/rand"
+    "net/http"
+    "net/http/httptest"
+    "runtime"
+    "sync/atomic"
+    "testing"
+    "time"
+    "github.com/gorilla/mux"
+)
+
+// getStudentBudget is the time GET /students/{id} may take in the handler,
+// leaving out the network and the database
+const getStudentBudget = 100 * time.Microsecond
+
+// discardResponseWriter drops the response, reusing one header map so the
+// benchmark measures the handler rather than the writer
+type discardResponseWriter struct {
+    header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header         { return w.header }
+func (w *discardResponseWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *discardResponseWriter) WriteHeader(int)             {}
+
+// newGetStudentApp returns an app on an in-memory store holding one student
+// whose name needs escaping, and a GET /students/{id} request for it
+func newGetStudentApp(tb testing.TB) (*App, *http.Request) {
+    tb.Helper()
+    store := NewStudentStore(NewMemoryRepository(), NewEventBus())
+    tb.Cleanup(store.Close)
+    student, _, err := store.Create(Student{Name: "Ada <Lovelace> & \"Byron\" ", Age: 36, Email: "ada@example.edu"})
+    if err != nil {
+        tb.Fatal(err)
+    }
+    access, err := NewAccessLog(NewMemoryAccessLogRepository(), AccessLogOff, nil)
+    if err != nil {
+        tb.Fatal(err)
+    }
+    honeypots, err := NewHoneypotStore(MemoryHoneypotRepository{})
+    if err != nil {
+        tb.Fatal(err)
+    }
+    app := &App{store: store, access: access, honeypots: honeypots, metrics: NewMetrics()}
+    r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/students/%d", student.ID), nil)
+    return app, mux.SetURLVars(r, map[string]string{"id": fmt.Sprint(student.ID)})
+}
+
+// BenchmarkGetStudent measures the GET /students/{id} handler, failing when
+// it takes longer than getStudentBudget
+func BenchmarkGetStudent(b *testing.B) {
+    app, r := newGetStudentApp(b)
+    w := &discardResponseWriter{header: make(http.Header)}
+    b.ReportAllocs()
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        app.GetStudent(w, r)
+    }
+    b.StopTimer()
+    if perOp := b.Elapsed() / time.Duration(b.N); b.N > 1 && perOp > getStudentBudget {
+        b.Errorf("handler took %s, over the %s budget", perOp, getStudentBudget)
+    }
+}
+
+func TestGetStudentDoesNotAllocate(t *testing.T) {
+    app, r := newGetStudentApp(t)
+    w := &discardResponseWriter{header: make(http.Header)}
+    if allocs := testing.AllocsPerRun(100, func() { app.GetStudent(w, r) }); allocs > 0 {
+        t.Errorf("handler allocated %v times per request", allocs)
+    }
+}
+
+// TestWriteStudentJSON compares writeStudentJSON with encoding/json
+func TestWriteStudentJSON(t *testing.T) {
+    deleted := time.Date(2024, 3, 1, 12, 30, 0, 5, time.UTC)
+    for _, s := range []Student{
+        {ID: 1, Name: "Ada <Lovelace> & \"Byron\" ", Age: 36, Email: "ada@example.edu"},
+        {ID: 2, Name: "Zoë \t\\", Age: 0, Email: "zoe@example.edu", UpdatedAt: deleted, DeletedAt: &deleted},
+    } {
+        var want bytes.Buffer
+        json.NewEncoder(&want).Encode(s)
+        got := httptest.NewRecorder()
+        writeStudentJSON(got, s)
+        if got.Body.String() != want.String() {
+            t.Errorf("writeStudentJSON wrote %q, encoding/json %q", got.Body, want.String())
+        }
+    }
+}
+
+// memoryWorkloads are the mixes the memory backends are compared under, by
+// the share of operations that read
+var memoryWorkloads = []struct {
+    name        string
+    readPercent int
+}{
+    {"reads=90%", 90},
+    {"reads=50%", 50},
+    {"reads=10%", 10},
+}
+
+// BenchmarkMemoryBackends runs each workload against MemoryRepository and
+// ShardedMemoryRepository from GOMAXPROCS goroutines at once, each getting
+// or updating random students among benchStudents. It drives the
+// repositories directly: through StudentStore every write would also wait
+// for the store's lock and grow its history.
+func BenchmarkMemoryBackends(b *testing.B) {
+    const benchStudents = 10000
+    shards := 4 * runtime.GOMAXPROCS(0)
+    backends := []struct {
+        name string
+        repo func() StudentRepository
+    }{
+        {"single-lock", func() StudentRepository { return NewMemoryRepository() }},
+        {fmt.Sprintf("shards=%d", shards), func() StudentRepository { return NewShardedMemoryRepository(shards) }},
+    }
+    for _, workload := range memoryWorkloads {
+        for _, backend := range backends {
+            b.Run(workload.name+"/"+backend.name, func(b *testing.B) {
+                repo := backend.repo()
+                for i := 0; i < benchStudents; i++ {
+                    repo.Create(Student{Name: fmt.Sprintf("Student %d", i), Age: 20, Email: fmt.Sprintf("s%d@example.edu", i)})
+                }
+                var seed atomic.Int64
+                b.ReportAllocs()
+                b.ResetTimer()
+                b.RunParallel(func(pb *testing.PB) {
+                    rng := rand.New(rand.NewSource(seed.Add(1)))
+                    for pb.Next() {
+                        id := 1 + rng.Intn(benchStudents)
+                        if rng.Intn(100) < workload.readPercent {
+                            repo.Get(id)
+                        } else {
+                            repo.Update(Student{ID: id, Name: "Updated", Age: 21, Email: "updated@example.edu"})
+                        }
+                    }
+                })
+            })
+        }
+    }
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "strconv"
+    "strings"
+    "github.com/gorilla/mux"
+)
+
+// defaultRouteBodyLimits lets uploads past MAX_BODY_BYTES through to the
+// handlers, which cap each upload themselves
+var defaultRouteBodyLimits = map[string]int64{
+    "/students/ingest/roster":        maxRosterUpload,
+    "/students/import":               maxImportUpload,
+    "/imports":                       maxImportUpload,
+    "/students/{id}/notes/audio":     maxNoteAudioUpload,
+    "/students/{id}/photo":           maxStudentPhotoUpload,
+    "/attendance/photo":              maxClassPhotoUpload,
+    "/admin/tenants/{tenant}/import": maxTenantArchive,
+}
+
+// BodyLimits caps request bodies by route template, with a default for
+// routes that are not listed
+type BodyLimits struct {
+    routes      map[string]int64
+    defaultSize int64
+}
+
+// LoadBodyLimits reads MAX_BODY_BYTES (default 1 MiB) and the per-route
+// overrides in ROUTE_MAX_BODY_BYTES, e.g. "/students/bulk=4194304"
+func LoadBodyLimits() (*BodyLimits, error) {
+    routes := make(map[string]int64)
+    for _, item := range getEnvList("ROUTE_MAX_BODY_BYTES") {
+        route, value, ok := strings.Cut(item, "=")
+        if !ok {
+            return nil, fmt.Errorf("route body limit %q: expected route=bytes", item)
+        }
+        n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+        if err != nil || n <= 0 {
+            return nil, fmt.Errorf("route body limit %q: invalid size", item)
+        }
+        routes[strings.TrimSpace(route)] = n
+    }
+    for route, n := range defaultRouteBodyLimits {
+        if _, ok := routes[route]; !ok {
+            routes[route] = n
+        }
+    }
+    defaultSize := int64(getEnvInt("MAX_BODY_BYTES", 1<<20))
+    if defaultSize <= 0 {
+        return nil, fmt.Errorf("MAX_BODY_BYTES must be positive, got %d", defaultSize)
+    }
+    return &BodyLimits{routes: routes, defaultSize: defaultSize}, nil
+}
+
+func (l *BodyLimits) forRoute(r *http.Request) int64 {
+    if route := mux.CurrentRoute(r); route != nil {
+        if template, err := route.GetPathTemplate(); err == nil {
+            if n, ok := l.routes[template]; ok {
+                return n
+            }
+        }
+    }
+    return l.defaultSize
+}
+
+// Middleware answers 413 for bodies over the route's limit: up front when
+// Content-Length says so, otherwise once the handler reads past the limit
+// and fails the request over it
+func (l *BodyLimits) Middleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        limit := l.forRoute(r)
+        if r.ContentLength > limit {
+            writeBodyTooLarge(w, r, limit)
+            return
+        }
+        body := &limitedBody{ReadCloser: http.MaxBytesReader(w, r.Body, limit)}
+        r.Body = body
+        next.ServeHTTP(&bodyLimitWriter{ResponseWriter: w, r: r, body: body, limit: limit}, r)
+    })
+}
+
+func writeBodyTooLarge(w http.ResponseWriter, r *http.Request, limit int64) {
+    w.Header().Set("Connection", "close")
+    writeError(w, r, http.StatusRequestEntityTooLarge, CodeBodyTooLarge, fmt.Sprintf("Request body too large: the limit is %d bytes", limit))
+}
+
+// limitedBody notes when a read fails for going over the limit
+type limitedBody struct {
+    io.ReadCloser
+    exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+    n, err := b.ReadCloser.Read(p)
+    var tooLarge *http.MaxBytesError
+    if errors.As(err, &tooLarge) {
+        b.exceeded = true
+    }
+    return n, err
+}
+
+// bodyLimitWriter turns the 400 a handler answers after its body went over
+// the limit, typically for invalid JSON, into a 413
+type bodyLimitWriter struct {
+    http.ResponseWriter
+    r         *http.Request
+    body      *limitedBody
+    limit     int64
+    rewritten bool
+}
+
+func (w *bodyLimitWriter) WriteHeader(status int) {
+    if status == http.StatusBadRequest && w.body.exceeded && !w.rewritten {
+        w.rewritten = true
+        w.Header().Del("Content-Length")
+        writeBodyTooLarge(w.ResponseWriter, w.r, w.limit)
+        return
+    }
+    if !w.rewritten {
+        w.ResponseWriter.WriteHeader(status)
+    }
+}
+
+func (w *bodyLimitWriter) Write(b []byte) (int, error) {
+    if w.rewritten {
+        // The handler's own message is replaced by the 413's
+        return len(b), nil
+    }
+    return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the connection
+func (w *bodyLimitWriter) Unwrap() http.ResponseWriter {
+    return w.ResponseWriter
+}
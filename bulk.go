@@ -0,0 +1,455 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+)
+
+// maxBulkRows bounds the students accepted by one bulk request
+const maxBulkRows = 1000
+
+// Keys a bulk upsert can match existing students by
+const (
+    UpsertKeyEmail = "email"
+    UpsertKeyID    = "id"
+)
+
+// Per-row outcomes of a bulk upsert
+const (
+    OutcomeCreated   = "created"
+    OutcomeUpdated   = "updated"
+    OutcomeUnchanged = "unchanged"
+    OutcomeDeleted   = "deleted"
+    OutcomeError     = "error"
+)
+
+// BulkUpsertRequest is the body of PUT /students/bulk-upsert. Key is
+// "email" (the default, matched case-insensitively) or "id".
+type BulkUpsertRequest struct {
+    Key      string    `json:"key,omitempty"`
+    Students []Student `json:"students"`
+}
+
+// UpsertOutcome reports what happened to one row of a bulk upsert
+type UpsertOutcome struct {
+    Index   int                    `json:"index"`
+    Status  string                 `json:"status"`
+    ID      int                    `json:"id,omitempty"`
+    Changes map[string]FieldChange `json:"changes,omitempty"`
+    Errors  []ValidationError      `json:"errors,omitempty"`
+}
+
+// BulkUpsertCounts totals the outcomes of a bulk upsert
+type BulkUpsertCounts struct {
+    Created   int `json:"created"`
+    Updated   int `json:"updated"`
+    Unchanged int `json:"unchanged"`
+    Errors    int `json:"errors"`
+}
+
+// BulkUpsertResult is the response of PUT /students/bulk-upsert
+type BulkUpsertResult struct {
+    Key     string           `json:"key"`
+    Counts  BulkUpsertCounts `json:"counts"`
+    Results []UpsertOutcome  `json:"results"`
+}
+
+// upsertKey returns the value a row is matched on
+func upsertKey(key string, student Student) string {
+    if key == UpsertKeyID {
+        return strconv.Itoa(student.ID)
+    }
+    return strings.ToLower(student.Email)
+}
+
+// planBulkUpsert validates every row and decides its outcome against the
+// current students. The caller must hold the store lock.
+func (app *App) planBulkUpsert(store *StudentStore, key string, rows []Student) ([]UpsertOutcome, error) {
+    var index map[string]Student
+    if key == UpsertKeyEmail {
+        var err error
+        if index, err = store.emailIndex(); err != nil {
+            return nil, err
+        }
+    }
+    seen := make(map[string]int)
+    outcomes := make([]UpsertOutcome, len(rows))
+    for i, student := range rows {
+        outcome := &outcomes[i]
+        outcome.Index = i
+        outcome.Errors = app.validateStudent(student)
+        if key == UpsertKeyID && student.ID < 1 {
+            outcome.Errors = append(outcome.Errors, ValidationError{
+                Field:   "id",
+                Code:    CodeRequired,
+                Message: "ID is required when upserting by id",
+            })
+        }
+        match := upsertKey(key, student)
+        if first, dup := seen[match]; dup {
+            outcome.Errors = append(outcome.Errors, ValidationError{
+                Field:   key,
+                Code:    "duplicate",
+                Message: fmt.Sprintf("%s also appears at index %d", key, first),
+            })
+        }
+        seen[match] = i
+        if len(outcome.Errors) > 0 {
+            outcome.Status = OutcomeError
+            continue
+        }
+
+        existing, exists := index[match]
+        if key == UpsertKeyID {
+            var err error
+            existing, err = store.getLive(student.ID)
+            if err != nil && !errors.Is(err, errStudentNotFound) {
+                return nil, err
+            }
+            exists = err == nil
+        }
+        if !exists {
+            outcome.Status = OutcomeCreated
+            continue
+        }
+        outcome.ID = existing.ID
+        if outcome.Changes = diffStudents(existing, student); len(outcome.Changes) > 0 {
+            outcome.Status = OutcomeUpdated
+        } else {
+            outcome.Changes = nil
+            outcome.Status = OutcomeUnchanged
+        }
+    }
+    return outcomes, nil
+}
+
+// BulkUpsertStudents creates or updates many students in one transaction:
+// PUT /students/bulk-upsert {"key": "email", "students": [...]}. Rows are
+// matched to existing students by key; rows that fail validation are
+// reported as errors and skipped, and every other row is written together
+// or, if the store fails, not at all. Upserting by id creates missing
+// students under the given ID.
+func (app *App) BulkUpsertStudents(w http.ResponseWriter, r *http.Request) {
+    store := app.storeFor(r)
+    var req BulkUpsertRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        httpError(w, r, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    if req.Key == "" {
+        req.Key = UpsertKeyEmail
+    }
+    if req.Key != UpsertKeyEmail && req.Key != UpsertKeyID {
+        httpError(w, r, "Key must be email or id", http.StatusBadRequest)
+        return
+    }
+    if len(req.Students) == 0 || len(req.Students) > maxBulkRows {
+        httpError(w, r, fmt.Sprintf("Send between 1 and %d students", maxBulkRows), http.StatusBadRequest)
+        return
+    }
+
+    store.Lock()
+    defer store.Unlock()
+    outcomes, err := app.planBulkUpsert(store, req.Key, req.Students)
+    if err != nil {
+        writeStoreError(w, r, err)
+        return
+    }
+
+    result := BulkUpsertResult{Key: req.Key, Results: outcomes}
+    versions, err := store.transactionLocked(func() error {
+        for i := range outcomes {
+            outcome := &outcomes[i]
+            student := req.Students[i]
+            var err error
+            switch outcome.Status {
+            case OutcomeCreated:
+                if req.Key == UpsertKeyEmail {
+                    student, _, err = store.insertLocked(student)
+                } else {
+                    student, _, err = store.createWithIDLocked(student)
+                }
+                outcome.ID = student.ID
+            case OutcomeUpdated:
+                student.ID = outcome.ID
+                _, _, err = store.replaceLocked(student)
+            }
+            if err != nil {
+                return fmt.Errorf("bulk upsert index %d: %w", i, err)
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        writeStoreError(w, r, err)
+        return
+    }
+    app.recordChanges(r, versions...)
+
+    for _, outcome := range outcomes {
+        switch outcome.Status {
+        case OutcomeCreated:
+            result.Counts.Created++
+        case OutcomeUpdated:
+            result.Counts.Updated++
+        case OutcomeUnchanged:
+            result.Counts.Unchanged++
+        default:
+            result.Counts.Errors++
+        }
+    }
+    json.NewEncoder(w).Encode(result)
+}
+
+// BulkCreateResult is the response of POST /students/bulk
+type BulkCreateResult struct {
+    Created int             `json:"created"`
+    Errors  int             `json:"errors"`
+    Results []UpsertOutcome `json:"results"`
+}
+
+// BulkCreateStudents inserts an array of students in one transaction:
+// POST /students/bulk [{...}, {...}]. Every item is validated first; invalid
+// items are reported and skipped while the valid ones are inserted together.
+// The response is 201 when every item was created, 207 when some failed
+// and 400 when none was valid.
+func (app *App) BulkCreateStudents(w http.ResponseWriter, r *http.Request) {
+    store := app.storeFor(r)
+    var students []Student
+    if err := json.NewDecoder(r.Body).Decode(&students); err != nil {
+        httpError(w, r, "Invalid request body: a JSON array of students is required", http.StatusBadRequest)
+        return
+    }
+    if len(students) == 0 || len(students) > maxBulkRows {
+        httpError(w, r, fmt.Sprintf("Send between 1 and %d students", maxBulkRows), http.StatusBadRequest)
+        return
+    }
+
+    result := BulkCreateResult{Results: make([]UpsertOutcome, len(students))}
+    for i, student := range students {
+        result.Results[i] = UpsertOutcome{Index: i, Status: OutcomeCreated}
+        if errs := app.validateStudent(student); len(errs) > 0 {
+            result.Results[i] = UpsertOutcome{Index: i, Status: OutcomeError, Errors: errs}
+            result.Errors++
+        }
+    }
+
+    if result.Errors < len(students) {
+        store.Lock()
+        versions, err := store.transactionLocked(func() error {
+            for i := range result.Results {
+                outcome := &result.Results[i]
+                if outcome.Status != OutcomeCreated {
+                    continue
+                }
+                student, _, err := store.insertLocked(students[i])
+                if err != nil {
+                    return fmt.Errorf("bulk create index %d: %w", i, err)
+                }
+                outcome.ID = student.ID
+            }
+            return nil
+        })
+        store.Unlock()
+        if err != nil {
+            writeStoreError(w, r, err)
+            return
+        }
+        app.recordChanges(r, versions...)
+        result.Created = len(students) - result.Errors
+    }
+
+    writeBulkStatus(w, result.Errors, len(students), http.StatusCreated)
+    json.NewEncoder(w).Encode(result)
+}
+
+// writeBulkStatus writes okStatus when no item of a bulk request failed,
+// 400 when every item failed and 207 Multi-Status otherwise
+func writeBulkStatus(w http.ResponseWriter, failed, total, okStatus int) {
+    switch failed {
+    case 0:
+        w.WriteHeader(okStatus)
+    case total:
+        w.WriteHeader(http.StatusBadRequest)
+    default:
+        w.WriteHeader(http.StatusMultiStatus)
+    }
+}
+
+// notFoundOutcome reports a bulk item naming a student that does not exist
+func notFoundOutcome(index, id int) UpsertOutcome {
+    return UpsertOutcome{Index: index, Status: OutcomeError, ID: id, Errors: []ValidationError{{
+        Field:   "id",
+        Code:    CodeNotFound,
+        Message: "Student not found",
+    }}}
+}
+
+// BulkUpdateResult is the response of PUT /students/bulk
+type BulkUpdateResult struct {
+    Updated   int             `json:"updated"`
+    Unchanged int             `json:"unchanged"`
+    Errors    int             `json:"errors"`
+    Results   []UpsertOutcome `json:"results"`
+}
+
+// BulkUpdateStudents replaces existing students in one transaction:
+// PUT /students/bulk [{"id": 1, ...}, ...]. Items naming a missing student
+// or failing validation are reported and skipped; unchanged students are
+// not written.
+func (app *App) BulkUpdateStudents(w http.ResponseWriter, r *http.Request) {
+    store := app.storeFor(r)
+    var students []Student
+    if err := json.NewDecoder(r.Body).Decode(&students); err != nil {
+        httpError(w, r, "Invalid request body: a JSON array of students is required", http.StatusBadRequest)
+        return
+    }
+    if len(students) == 0 || len(students) > maxBulkRows {
+        httpError(w, r, fmt.Sprintf("Send between 1 and %d students", maxBulkRows), http.StatusBadRequest)
+        return
+    }
+
+    store.Lock()
+    defer store.Unlock()
+    result := BulkUpdateResult{Results: make([]UpsertOutcome, len(students))}
+    seen := make(map[int]int)
+    for i, student := range students {
+        outcome := UpsertOutcome{Index: i, ID: student.ID, Errors: app.validateStudent(student)}
+        if first, dup := seen[student.ID]; dup {
+            outcome.Errors = append(outcome.Errors, ValidationError{
+                Field:   "id",
+                Code:    "duplicate",
+                Message: fmt.Sprintf("id also appears at index %d", first),
+            })
+        }
+        seen[student.ID] = i
+        existing, err := store.getLive(student.ID)
+        switch {
+        case errors.Is(err, errStudentNotFound):
+            outcome = notFoundOutcome(i, student.ID)
+        case err != nil:
+            writeStoreError(w, r, err)
+            return
+        case len(outcome.Errors) > 0:
+            outcome.Status = OutcomeError
+        default:
+            if outcome.Changes = diffStudents(existing, student); len(outcome.Changes) > 0 {
+                outcome.Status = OutcomeUpdated
+            } else {
+                outcome.Changes = nil
+                outcome.Status = OutcomeUnchanged
+            }
+        }
+        result.Results[i] = outcome
+    }
+
+    versions, err := store.transactionLocked(func() error {
+        for i, outcome := range result.Results {
+            if outcome.Status != OutcomeUpdated {
+                continue
+            }
+            if _, _, err := store.replaceLocked(students[i]); err != nil {
+                return fmt.Errorf("bulk update index %d: %w", i, err)
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        writeStoreError(w, r, err)
+        return
+    }
+    app.recordChanges(r, versions...)
+
+    for _, outcome := range result.Results {
+        switch outcome.Status {
+        case OutcomeUpdated:
+            result.Updated++
+        case OutcomeUnchanged:
+            result.Unchanged++
+        default:
+            result.Errors++
+        }
+    }
+    writeBulkStatus(w, result.Errors, len(students), http.StatusOK)
+    json.NewEncoder(w).Encode(result)
+}
+
+// BulkDeleteResult is the response of DELETE /students?ids=
+type BulkDeleteResult struct {
+    Deleted int             `json:"deleted"`
+    Errors  int             `json:"errors"`
+    Results []UpsertOutcome `json:"results"`
+}
+
+// idsFromRequest parses the comma-separated ?ids= list
+func idsFromRequest(r *http.Request) ([]int, error) {
+    value := r.URL.Query().Get("ids")
+    if value == "" {
+        return nil, errors.New("ids is required, e.g. ?ids=1,2,3")
+    }
+    var ids []int
+    seen := make(map[int]bool)
+    for _, part := range strings.Split(value, ",") {
+        id, err := strconv.Atoi(strings.TrimSpace(part))
+        if err != nil || id < 1 {
+            return nil, fmt.Errorf("invalid id %q", part)
+        }
+        if !seen[id] {
+            seen[id] = true
+            ids = append(ids, id)
+        }
+    }
+    if len(ids) > maxBulkRows {
+        return nil, fmt.Errorf("at most %d ids can be deleted at once", maxBulkRows)
+    }
+    return ids, nil
+}
+
+// BulkDeleteStudents removes many students in one transaction:
+// DELETE /students?ids=1,2,3. IDs of missing students are reported as
+// errors; the others are deleted together.
+func (app *App) BulkDeleteStudents(w http.ResponseWriter, r *http.Request) {
+    store := app.storeFor(r)
+    ids, err := idsFromRequest(r)
+    if err != nil {
+        httpError(w, r, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    store.Lock()
+    defer store.Unlock()
+    result := BulkDeleteResult{Results: make([]UpsertOutcome, len(ids))}
+    versions, err := store.transactionLocked(func() error {
+        for i, id := range ids {
+            _, err := store.removeLocked(id)
+            switch {
+            case errors.Is(err, errStudentNotFound):
+                result.Results[i] = notFoundOutcome(i, id)
+            case err != nil:
+                return fmt.Errorf("bulk delete id %d: %w", id, err)
+            default:
+                result.Results[i] = UpsertOutcome{Index: i, Status: OutcomeDeleted, ID: id}
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        writeStoreError(w, r, err)
+        return
+    }
+    app.recordChanges(r, versions...)
+
+    for _, outcome := range result.Results {
+        if outcome.Status == OutcomeDeleted {
+            result.Deleted++
+        } else {
+            result.Errors++
+        }
+    }
+    writeBulkStatus(w, result.Errors, len(ids), http.StatusOK)
+    json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log/slog"
+    "math/rand"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+    "github.com/gorilla/mux"
+)
+
+// errChaosOllama is returned by the Ollama client when chaos mode injects a failure
+var errChaosOllama = errors.New("ollama: failure injected by chaos mode")
+
+// ChaosRule lists the faults injected for one route, each with the
+// probability (0-1) that it fires on a given request
+type ChaosRule struct {
+    Route       string
+    Latency     time.Duration
+    LatencyProb float64
+    ErrorProb   float64
+    DropProb    float64
+    OllamaProb  float64
+}
+
+// Chaos is dev-only fault-injection middleware. Rules are keyed by route
+// template (e.g. "/students/{id}/summary"); "*" applies to routes without
+// their own rule.
+type Chaos struct {
+    rules map[string]ChaosRule
+}
+
+// ParseChaosRules parses rules of the form
+//
+//	/students/{id}/summary:latency=2s@0.5,ollama@0.2;*:error@0.05,drop@0.01
+//
+// Rules are separated by ";". Each names a route, then a comma-separated
+// list of faults: latency=<duration>@p, error@p (HTTP 500), drop@p (the
+// connection is closed without a response) and ollama@p (Ollama calls fail).
+func ParseChaosRules(spec string) (*Chaos, error) {
+    c := &Chaos{rules: make(map[string]ChaosRule)}
+    for _, part := range strings.Split(spec, ";") {
+        if part = strings.TrimSpace(part); part == "" {
+            continue
+        }
+        i := strings.LastIndex(part, ":")
+        if i <= 0 {
+            return nil, fmt.Errorf("chaos rule %q: expected route:faults", part)
+        }
+        rule := ChaosRule{Route: strings.TrimSpace(part[:i])}
+        for _, fault := range strings.Split(part[i+1:], ",") {
+            name, prob, ok := strings.Cut(strings.TrimSpace(fault), "@")
+            if !ok {
+                return nil, fmt.Errorf("chaos rule %q: fault %q needs @probability", rule.Route, fault)
+            }
+            p, err := strconv.ParseFloat(prob, 64)
+            if err != nil || p < 0 || p > 1 {
+                return nil, fmt.Errorf("chaos rule %q: probability %q must be between 0 and 1", rule.Route, prob)
+            }
+            name, arg, _ := strings.Cut(name, "=")
+            switch name {
+            case "latency":
+                d, err := time.ParseDuration(arg)
+                if err != nil {
+                    return nil, fmt.Errorf("chaos rule %q: invalid latency %q", rule.Route, arg)
+                }
+                rule.Latency, rule.LatencyProb = d, p
+            case "error":
+                rule.ErrorProb = p
+            case "drop":
+                rule.DropProb = p
+            case "ollama":
+                rule.OllamaProb = p
+            default:
+                return nil, fmt.Errorf("chaos rule %q: unknown fault %q", rule.Route, name)
+            }
+        }
+        c.rules[rule.Route] = rule
+    }
+    return c, nil
+}
+
+// LoadChaos reads CHAOS_RULES when CHAOS_ENABLED is set; it returns nil when
+// chaos mode is off. Chaos mode is refused when APP_ENV is production, its
+// default, so staging and development must be named explicitly.
+func LoadChaos() (*Chaos, error) {
+    if !getEnvBool("CHAOS_ENABLED", false) {
+        return nil, nil
+    }
+    if env := strings.ToLower(getEnv("APP_ENV", "production")); env == "production" {
+        return nil, fmt.Errorf("chaos mode cannot be enabled with APP_ENV=%s", env)
+    }
+    c, err := ParseChaosRules(getEnv("CHAOS_RULES", ""))
+    if err != nil {
+        return nil, err
+    }
+    slog.Warn("chaos mode is enabled", "env", getEnv("APP_ENV", "production"), "rules", len(c.rules))
+    return c, nil
+}
+
+func (c *Chaos) ruleFor(r *http.Request) (ChaosRule, bool) {
+    if route := mux.CurrentRoute(r); route != nil {
+        if template, err := route.GetPathTemplate(); err == nil {
+            if rule, ok := c.rules[template]; ok {
+                return rule, true
+            }
+        }
+    }
+    rule, ok := c.rules["*"]
+    return rule, ok
+}
+
+type chaosOllamaKey struct{}
+
+// chaosOllamaFault reports whether chaos mode marked this request's Ollama calls to fail
+func chaosOllamaFault(ctx context.Context) bool {
+    fail, _ := ctx.Value(chaosOllamaKey{}).(bool)
+    return fail
+}
+
+// Middleware injects the faults configured for the matched route. A nil
+// Chaos passes requests through untouched.
+func (c *Chaos) Middleware(next http.Handler) http.Handler {
+    if c == nil {
+        return next
+    }
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        rule, ok := c.ruleFor(r)
+        if !ok {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        if rule.Latency > 0 && rand.Float64() < rule.LatencyProb {
+            select {
+            case <-time.After(rule.Latency):
+            case <-r.Context().Done():
+                return
+            }
+        }
+        if rand.Float64() < rule.DropProb {
+            if hj, ok := w.(http.Hijacker); ok {
+                if conn, _, err := hj.Hijack(); err == nil {
+                    conn.Close()
+                    return
+                }
+            }
+        }
+        if rand.Float64() < rule.ErrorProb {
+            httpError(w, r, "Internal server error (injected by chaos mode)", http.StatusInternalServerError)
+            return
+        }
+        if rand.Float64() < rule.OllamaProb {
+            r = r.WithContext(context.WithValue(r.Context(), chaosOllamaKey{}, true))
+        }
+        next.ServeHTTP(w, r)
+    })
+}
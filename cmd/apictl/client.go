@@ -0,0 +1,157 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// client calls the API with the operator's credentials
+type client struct {
+    baseURL string
+    token   string
+    apiKey  string
+    tenant  string
+    http    *http.Client
+}
+
+// statusError is a non-2xx answer, with the message of its error envelope
+type statusError struct {
+    code    int
+    message string
+}
+
+func (e *statusError) Error() string {
+    if e.message == "" {
+        return http.StatusText(e.code)
+    }
+    return fmt.Sprintf("%d %s", e.code, e.message)
+}
+
+func newClient(baseURL, token, apiKey, tenant string) *client {
+    return &client{
+        baseURL: strings.TrimRight(baseURL, "/"),
+        token:   token,
+        apiKey:  apiKey,
+        tenant:  tenant,
+        http:    &http.Client{Timeout: 10 * time.Second},
+    }
+}
+
+// get fetches path, returning the body of a 2xx response
+func (c *client) get(ctx context.Context, path string) ([]byte, error) {
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+path, nil)
+    if err != nil {
+        return nil, err
+    }
+    if c.token != "" {
+        req.Header.Set("Authorization", "Bearer "+c.token)
+    }
+    if c.apiKey != "" {
+        req.Header.Set("X-API-Key", c.apiKey)
+    }
+    if c.tenant != "" {
+        req.Header.Set("X-Tenant-ID", c.tenant)
+    }
+    resp, err := c.http.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    body, err := io.ReadAll(io.LimitReader(resp.Body, 8<<20))
+    if err != nil {
+        return nil, err
+    }
+    if resp.StatusCode/100 != 2 {
+        var envelope struct {
+            Error struct {
+                Message string `json:"message"`
+            } `json:"error"`
+        }
+        // A body that is not an envelope leaves the message empty
+        json.Unmarshal(body, &envelope)
+        return nil, &statusError{code: resp.StatusCode, message: envelope.Error.Message}
+    }
+    return body, nil
+}
+
+// getJSON fetches path and decodes its JSON body into v
+func (c *client) getJSON(ctx context.Context, path string, v interface{}) error {
+    body, err := c.get(ctx, path)
+    if err != nil {
+        return err
+    }
+    return json.Unmarshal(body, v)
+}
+
+// series is one line of the Prometheus text format
+type series struct {
+    name   string
+    labels map[string]string
+    value  float64
+}
+
+// metrics reads GET /metrics
+func (c *client) metrics(ctx context.Context) ([]series, error) {
+    body, err := c.get(ctx, "/metrics")
+    if err != nil {
+        return nil, err
+    }
+    var all []series
+    scanner := bufio.NewScanner(strings.NewReader(string(body)))
+    for scanner.Scan() {
+        line := scanner.Text()
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        idx := strings.LastIndexByte(line, ' ')
+        if idx < 0 {
+            continue
+        }
+        value, err := strconv.ParseFloat(line[idx+1:], 64)
+        if err != nil {
+            continue
+        }
+        s := series{value: value}
+        s.name, s.labels = parseSeries(line[:idx])
+        all = append(all, s)
+    }
+    return all, scanner.Err()
+}
+
+// parseSeries splits `name{a="b",c="d"}` into the name and its labels
+func parseSeries(text string) (string, map[string]string) {
+    name, rest, found := strings.Cut(text, "{")
+    labels := make(map[string]string)
+    if !found {
+        return name, labels
+    }
+    rest = strings.TrimSuffix(rest, "}")
+    for rest != "" {
+        key, after, ok := strings.Cut(rest, `="`)
+        if !ok {
+            break
+        }
+        var value strings.Builder
+        i := 0
+        for ; i < len(after) && after[i] != '"'; i++ {
+            if after[i] == '\\' && i+1 < len(after) {
+                i++
+                if after[i] == 'n' {
+                    value.WriteByte('\n')
+                    continue
+                }
+            }
+            value.WriteByte(after[i])
+        }
+        labels[strings.TrimPrefix(key, ",")] = value.String()
+        rest = after[min(i+1, len(after)):]
+    }
+    return name, labels
+}
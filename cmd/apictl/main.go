@@ -0,0 +1,37 @@
+// Command apictl is an operator's console for the student API. It talks to
+// a running server over its HTTP endpoints, so it works from any box that
+// can reach it.
+//
+//	apictl tui [-url http://localhost:8080] [-token JWT | -api-key KEY] [-tenant ID]
+package main
+
+import (
+    "fmt"
+    "os"
+)
+
+func usage() {
+    fmt.Fprintln(os.Stderr, `usage: apictl <command> [flags]
+
+commands:
+  tui    live dashboard of requests, errors and student changes, with student lookup
+
+Run "apictl <command> -h" for a command's flags.`)
+}
+
+func main() {
+    if len(os.Args) < 2 {
+        usage()
+        os.Exit(2)
+    }
+    switch command := os.Args[1]; command {
+    case "tui":
+        os.Exit(runTUI(os.Args[2:]))
+    case "help", "-h", "-help", "--help":
+        usage()
+    default:
+        fmt.Fprintf(os.Stderr, "apictl: unknown command %q\n", command)
+        usage()
+        os.Exit(2)
+    }
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "os"
+    "os/signal"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+    "golang.org/x/term"
+)
+
+// Lines kept in the errors and events panels
+const (
+    maxErrorLines = 8
+    maxEventLines = 10
+)
+
+// ANSI escapes used by the dashboard
+const (
+    ansiBold  = "\x1b[1m"
+    ansiDim   = "\x1b[2m"
+    ansiRed   = "\x1b[31m"
+    ansiReset = "\x1b[0m"
+)
+
+// routeRow is one line of the requests panel
+type routeRow struct {
+    route                      string
+    rate, clientErr, serverErr float64
+    avgMs                      float64
+}
+
+// dashboard is what the TUI shows, refreshed from the API every interval
+type dashboard struct {
+    client   *client
+    interval time.Duration
+
+    mu        sync.Mutex
+    health    healthz
+    fetchErr  string
+    counts    map[string]float64
+    durations map[string][2]float64
+    polledAt  time.Time
+    rows      []routeRow
+    errors    []string
+    events    []string
+    // seq is the change history position of the events feed; -1 until known
+    seq int
+
+    lookup  string
+    editing bool
+    found   []string
+}
+
+// healthz is the part of GET /healthz shown in the header
+type healthz struct {
+    Build struct {
+        Version string `json:"version"`
+        Commit  string `json:"commit"`
+    } `json:"build"`
+    Leadership struct {
+        Instance string `json:"instance"`
+        Role     string `json:"role"`
+        Leader   bool   `json:"leader"`
+    } `json:"leadership"`
+}
+
+// deltaResponse is the part of GET /sync/delta the events panel uses
+type deltaResponse struct {
+    Seq   int                               `json:"seq"`
+    Patch map[string]map[string]interface{} `json:"patch"`
+}
+
+// runTUI handles "apictl tui"
+func runTUI(args []string) int {
+    fs := flag.NewFlagSet("tui", flag.ContinueOnError)
+    baseURL := fs.String("url", envOr("APICTL_URL", "http://localhost:8080"), "API base URL (default $APICTL_URL)")
+    token := fs.String("token", os.Getenv("APICTL_TOKEN"), "bearer token (default $APICTL_TOKEN)")
+    apiKey := fs.String("api-key", os.Getenv("APICTL_API_KEY"), "API key (default $APICTL_API_KEY)")
+    tenant := fs.String("tenant", os.Getenv("APICTL_TENANT"), "tenant ID (default $APICTL_TENANT)")
+    interval := fs.Duration("interval", 2*time.Second, "refresh interval")
+    once := fs.Bool("once", false, "print one refresh without a terminal and exit")
+    if err := fs.Parse(args); err != nil {
+        return 2
+    }
+    if *interval <= 0 {
+        fmt.Fprintln(os.Stderr, "apictl tui: -interval must be positive")
+        return 2
+    }
+    d := &dashboard{client: newClient(*baseURL, *token, *apiKey, *tenant), interval: *interval, seq: -1}
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+
+    if *once {
+        // Rates need two samples
+        d.refresh(ctx)
+        time.Sleep(*interval)
+        d.refresh(ctx)
+        d.render(os.Stdout, 100, false)
+        return 0
+    }
+    if !term.IsTerminal(int(os.Stdin.Fd())) {
+        fmt.Fprintln(os.Stderr, "apictl tui: stdin is not a terminal; use -once to print a single refresh")
+        return 2
+    }
+    if err := d.run(ctx); err != nil {
+        fmt.Fprintln(os.Stderr, "apictl tui:", err)
+        return 1
+    }
+    return 0
+}
+
+func envOr(key, fallback string) string {
+    if value := os.Getenv(key); value != "" {
+        return value
+    }
+    return fallback
+}
+
+// run draws the dashboard on the alternate screen until q, Ctrl-C or ctx
+func (d *dashboard) run(ctx context.Context) error {
+    fd := int(os.Stdin.Fd())
+    saved, err := term.MakeRaw(fd)
+    if err != nil {
+        return err
+    }
+    fmt.Print("\x1b[?1049h\x1b[?25l")
+    defer func() {
+        fmt.Print("\x1b[?25h\x1b[?1049l")
+        term.Restore(fd, saved)
+    }()
+
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+    redraw := make(chan struct{}, 1)
+    wake := func() {
+        select {
+        case redraw <- struct{}{}:
+        default:
+        }
+    }
+    go d.readKeys(ctx, cancel, wake)
+    go func() {
+        ticker := time.NewTicker(d.interval)
+        defer ticker.Stop()
+        for {
+            d.refresh(ctx)
+            wake()
+            select {
+            case <-ctx.Done():
+                return
+            case <-ticker.C:
+            }
+        }
+    }()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return nil
+        case <-redraw:
+        }
+        width, height, err := term.GetSize(fd)
+        if err != nil {
+            width, height = 100, 40
+        }
+        var frame strings.Builder
+        d.render(&frame, width, true)
+        lines := strings.Split(strings.TrimRight(frame.String(), "\n"), "\n")
+        if len(lines) > height {
+            lines = lines[:height]
+        }
+        // Raw mode needs explicit carriage returns
+        fmt.Print("\x1b[H\x1b[2J" + strings.Join(lines, "\r\n"))
+    }
+}
+
+// readKeys handles keyboard input: q quits, / starts a lookup by ID or
+// search words, Enter runs it and Esc cancels it
+func (d *dashboard) readKeys(ctx context.Context, quit func(), wake func()) {
+    buf := make([]byte, 16)
+    for {
+        n, err := os.Stdin.Read(buf)
+        if err != nil {
+            quit()
+            return
+        }
+        for _, b := range buf[:n] {
+            d.mu.Lock()
+            editing := d.editing
+            switch {
+            case b == 3: // Ctrl-C
+                d.mu.Unlock()
+                quit()
+                return
+            case !editing && b == 'q':
+                d.mu.Unlock()
+                quit()
+                return
+            case !editing && b == '/':
+                d.editing, d.lookup = true, ""
+            case editing && b == 27: // Esc
+                d.editing = false
+            case editing && (b == '\r' || b == '\n'):
+                d.editing = false
+                query := strings.TrimSpace(d.lookup)
+                d.found = []string{"looking up " + query + "…"}
+                go func() {
+                    found := d.find(ctx, query)
+                    d.mu.Lock()
+                    d.found = found
+                    d.mu.Unlock()
+                    wake()
+                }()
+            case editing && (b == 127 || b == 8):
+                if d.lookup != "" {
+                    d.lookup = d.lookup[:len(d.lookup)-1]
+                }
+            case editing && b >= 32 && b < 127:
+                d.lookup += string(b)
+            }
+            d.mu.Unlock()
+        }
+        wake()
+    }
+}
+
+// find looks a student up by ID, or searches names and emails
+func (d *dashboard) find(ctx context.Context, query string) []string {
+    if query == "" {
+        return nil
+    }
+    if id, err := strconv.Atoi(query); err == nil {
+        var student map[string]interface{}
+        if err := d.client.getJSON(ctx, "/students/"+strconv.Itoa(id), &student); err != nil {
+            return []string{"student " + query + ": " + err.Error()}
+        }
+        return []string{formatStudent(student)}
+    }
+    var results []struct {
+        Student map[string]interface{} `json:"student"`
+    }
+    if err := d.client.getJSON(ctx, "/students/search?limit=5&q="+url.QueryEscape(query), &results); err != nil {
+        return []string{"search " + query + ": " + err.Error()}
+    }
+    if len(results) == 0 {
+        return []string{"no students match " + query}
+    }
+    found := make([]string, len(results))
+    for i, r := range results {
+        found[i] = formatStudent(r.Student)
+    }
+    return found
+}
+
+func formatStudent(s map[string]interface{}) string {
+    return fmt.Sprintf("#%v  %v  age %v  %v", s["id"], s["name"], s["age"], s["email"])
+}
+
+// refresh polls /healthz, /metrics and /sync/delta
+func (d *dashboard) refresh(ctx context.Context) {
+    var health healthz
+    herr := d.client.getJSON(ctx, "/healthz", &health)
+    all, merr := d.client.metrics(ctx)
+    d.mu.Lock()
+    since := max(d.seq, 0)
+    d.mu.Unlock()
+    var delta deltaResponse
+    derr := d.client.getJSON(ctx, "/sync/delta?since="+strconv.Itoa(since), &delta)
+    now := time.Now()
+
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    d.fetchErr = ""
+    if err := errors.Join(herr, merr); err != nil {
+        d.fetchErr = err.Error()
+    }
+    if herr == nil {
+        d.health = health
+    }
+    if merr == nil {
+        d.updateRequests(all, now)
+    }
+    d.updateEvents(delta, derr, now)
+}
+
+// updateRequests turns the request counters into rates since the previous
+// poll, and their non-2xx increments into error lines; the caller holds d.mu
+func (d *dashboard) updateRequests(all []series, now time.Time) {
+    counts := make(map[string]float64)
+    durations := make(map[string][2]float64)
+    byRoute := make(map[string]*routeRow)
+    var errorLines []string
+    elapsed := now.Sub(d.polledAt).Seconds()
+    for _, s := range all {
+        switch s.name {
+        case "http_requests_total":
+            key := s.labels["method"] + " " + s.labels["route"] + " " + s.labels["status"]
+            counts[key] = s.value
+            if d.counts == nil {
+                continue
+            }
+            delta := s.value - d.counts[key]
+            if delta <= 0 {
+                continue
+            }
+            route := s.labels["method"] + " " + s.labels["route"]
+            row := byRoute[route]
+            if row == nil {
+                row = &routeRow{route: route}
+                byRoute[route] = row
+            }
+            row.rate += delta / elapsed
+            status, _ := strconv.Atoi(s.labels["status"])
+            switch {
+            case status >= 500:
+                row.serverErr += delta / elapsed
+            case status >= 400:
+                row.clientErr += delta / elapsed
+            }
+            if status >= 400 {
+                errorLines = append(errorLines, fmt.Sprintf("%s  %s  %d %s  ×%d", now.Format("15:04:05"), route, status, http.StatusText(status), int(delta)))
+            }
+        case "http_request_duration_seconds_sum", "http_request_duration_seconds_count":
+            pair := durations[s.labels["route"]]
+            if s.name == "http_request_duration_seconds_sum" {
+                pair[0] = s.value
+            } else {
+                pair[1] = s.value
+            }
+            durations[s.labels["route"]] = pair
+        }
+    }
+    for _, row := range byRoute {
+        template := row.route[strings.IndexByte(row.route, ' ')+1:]
+        now, prev := durations[template], d.durations[template]
+        if n := now[1] - prev[1]; n > 0 {
+            row.avgMs = (now[0] - prev[0]) / n * 1000
+        }
+    }
+    d.rows = d.rows[:0]
+    for _, row := range byRoute {
+        d.rows = append(d.rows, *row)
+    }
+    sort.Slice(d.rows, func(i, j int) bool {
+        if d.rows[i].rate != d.rows[j].rate {
+            return d.rows[i].rate > d.rows[j].rate
+        }
+        return d.rows[i].route < d.rows[j].route
+    })
+    sort.Strings(errorLines)
+    d.errors = keepLast(append(d.errors, errorLines...), maxErrorLines)
+    d.counts, d.durations, d.polledAt = counts, durations, now
+}
+
+// updateEvents adds the student changes since the last poll; the first
+// poll only finds the current position. The caller holds d.mu.
+func (d *dashboard) updateEvents(delta deltaResponse, err error, now time.Time) {
+    var status *statusError
+    if errors.As(err, &status) && status.code == http.StatusGone {
+        // The server restarted or trimmed its history; start over
+        d.seq = -1
+        return
+    }
+    if err != nil {
+        d.fetchErr = strings.TrimPrefix(d.fetchErr+"; events: "+err.Error(), "; ")
+        return
+    }
+    if d.seq >= 0 {
+        ids := make([]int, 0, len(delta.Patch))
+        for key := range delta.Patch {
+            id, _ := strconv.Atoi(key)
+            ids = append(ids, id)
+        }
+        sort.Ints(ids)
+        for _, id := range ids {
+            patch := delta.Patch[strconv.Itoa(id)]
+            if patch == nil {
+                d.events = append(d.events, fmt.Sprintf("%s  #%d deleted", now.Format("15:04:05"), id))
+                continue
+            }
+            fields := make([]string, 0, len(patch))
+            for field, value := range patch {
+                fields = append(fields, fmt.Sprintf("%s=%v", field, value))
+            }
+            sort.Strings(fields)
+            d.events = append(d.events, fmt.Sprintf("%s  #%d %s", now.Format("15:04:05"), id, strings.Join(fields, " ")))
+        }
+        d.events = keepLast(d.events, maxEventLines)
+    }
+    d.seq = delta.Seq
+}
+
+func keepLast(lines []string, n int) []string {
+    if len(lines) > n {
+        return append([]string(nil), lines[len(lines)-n:]...)
+    }
+    return lines
+}
+
+// render writes the dashboard, cutting lines to width
+func (d *dashboard) render(w io.Writer, width int, color bool) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    style := func(code, text string) string {
+        if !color {
+            return text
+        }
+        return code + text + ansiReset
+    }
+    line := func(text string) {
+        if len(text) > width && width > 1 {
+            text = text[:width-1] + "…"
+        }
+        fmt.Fprintln(w, text)
+    }
+    section := func(title string) {
+        line("")
+        line(style(ansiBold, title))
+    }
+
+    h := d.health
+    role := h.Leadership.Role
+    if h.Leadership.Leader {
+        role += ", leader"
+    }
+    line(style(ansiBold, "apictl") + "  " + d.client.baseURL + "  " + h.Build.Version + "  " + h.Leadership.Instance + " (" + role + ")  " + time.Now().Format("15:04:05"))
+    if d.fetchErr != "" {
+        line(style(ansiRed, "error: "+d.fetchErr))
+    }
+
+    section(fmt.Sprintf("REQUESTS  per second over the last %s", d.interval))
+    line(fmt.Sprintf("  %-44s %8s %8s %8s %9s", "route", "req/s", "4xx/s", "5xx/s", "avg ms"))
+    if len(d.rows) == 0 {
+        line(style(ansiDim, "  no requests"))
+    }
+    for _, row := range d.rows {
+        text := fmt.Sprintf("  %-44s %8.1f %8.1f %8.1f %9.1f", row.route, row.rate, row.clientErr, row.serverErr, row.avgMs)
+        if row.serverErr > 0 {
+            text = style(ansiRed, text)
+        }
+        line(text)
+    }
+
+    section("RECENT ERRORS")
+    if len(d.errors) == 0 {
+        line(style(ansiDim, "  none"))
+    }
+    for _, e := range d.errors {
+        line("  " + e)
+    }
+
+    section("EVENTS  student changes")
+    if len(d.events) == 0 {
+        line(style(ansiDim, "  none yet"))
+    }
+    for _, e := range d.events {
+        line("  " + e)
+    }
+
+    section("LOOKUP")
+    if d.editing {
+        line("  > " + d.lookup + "_")
+    } else {
+        line(style(ansiDim, "  / to look up a student by ID or search, q to quit"))
+    }
+    for _, f := range d.found {
+        line("  " + f)
+    }
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+    "bytes"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "net"
+    "net/url"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strings"
+    "github.com/BurntSushi/toml"
+    "gopkg.in/yaml.v3"
+)
+
+// Defaults of the core settings in Config
+const (
+    defaultListenAddr = ":8080"
+    // defaultDatabasePath is the SQLite database file used unless DATABASE_PATH is set
+    defaultDatabasePath = "./students.db"
+    defaultOllamaURL    = "http://localhost:11434"
+    defaultOllamaModel  = "llama2"
+)
+
+// Config holds the core settings the server starts with. Each comes, in
+// order of precedence, from its command-line flag, its environment
+// variable, the config file or its default. Other settings are read from
+// the environment where they are used, and may be given in the file's env
+// section too.
+type Config struct {
+    // ListenAddr is the HTTP listen address: -addr, LISTEN_ADDR
+    ListenAddr string
+    // StoreBackend is memory, sqlite, postgres or mysql: -store, STORE_BACKEND
+    StoreBackend string
+    // DatabasePath is the SQLite file: -db, DATABASE_PATH
+    DatabasePath string
+    // OllamaURL is the Ollama server: -ollama-url, OLLAMA_URL
+    OllamaURL string
+    // OllamaModel is the default model: -ollama-model, OLLAMA_MODEL
+    OllamaModel string
+}
+
+// configFlags are the command-line flags overriding Config, each named
+// after the environment variable it stands for
+var configFlags = []struct {
+    name, env, usage string
+}{
+    {"addr", "LISTEN_ADDR", "address to listen on (default " + defaultListenAddr + ")"},
+    {"store", "STORE_BACKEND", "store backend: memory, sqlite, postgres or mysql (default " + BackendSQLite + ")"},
+    {"db", "DATABASE_PATH", "SQLite database file (default " + defaultDatabasePath + ")"},
+    {"ollama-url", "OLLAMA_URL", "Ollama server URL (default " + defaultOllamaURL + ")"},
+    {"ollama-model", "OLLAMA_MODEL", "default Ollama model (default " + defaultOllamaModel + ")"},
+}
+
+// configFileKeys maps the top-level keys of a config file to the
+// environment variables they set
+var configFileKeys = map[string]string{
+    "listen_addr":   "LISTEN_ADDR",
+    "store_backend": "STORE_BACKEND",
+    "database_path": "DATABASE_PATH",
+    "ollama_url":    "OLLAMA_URL",
+    "ollama_model":  "OLLAMA_MODEL",
+}
+
+// envName is the shape of a setting in a config file's env section
+var envName = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+
+// configFile is the path of the config file given at startup, if any
+var configFile string
+
+// ConfigSource holds the command-line half of the configuration between
+// flag definition and parsing
+type ConfigSource struct {
+    file  *string
+    flags map[string]*string
+}
+
+// DefineConfigFlags registers -config and the configFlags on fs
+func DefineConfigFlags(fs *flag.FlagSet) *ConfigSource {
+    src := &ConfigSource{
+        file:  fs.String("config", "", "YAML (.yaml, .yml) or TOML (.toml) config file (default $CONFIG_FILE)"),
+        flags: make(map[string]*string),
+    }
+    for _, f := range configFlags {
+        src.flags[f.name] = fs.String(f.name, "", f.usage)
+    }
+    return src
+}
+
+// Apply installs the parsed flags and the config file as the first and last
+// layers of every setting lookup, then loads and validates the Config
+func (src *ConfigSource) Apply(fs *flag.FlagSet) (Config, error) {
+    settings := make(map[string]string)
+    fs.Visit(func(f *flag.Flag) {
+        for _, cf := range configFlags {
+            if cf.name == f.Name {
+                settings[cf.env] = *src.flags[cf.name]
+            }
+        }
+    })
+    flagSettings = settings
+
+    path := *src.file
+    if path == "" {
+        path = getEnv("CONFIG_FILE", "")
+    }
+    configFile = path
+    if path != "" {
+        values, err := readConfigFile(path)
+        if err != nil {
+            return Config{}, err
+        }
+        fileSettings = values
+    }
+    return LoadConfig()
+}
+
+// LoadConfig reads and validates the core settings
+func LoadConfig() (Config, error) {
+    cfg := Config{
+        ListenAddr:   getEnv("LISTEN_ADDR", defaultListenAddr),
+        StoreBackend: getEnv("STORE_BACKEND", BackendSQLite),
+        DatabasePath: getEnv("DATABASE_PATH", defaultDatabasePath),
+        OllamaURL:    getEnv("OLLAMA_URL", defaultOllamaURL),
+        OllamaModel:  getEnv("OLLAMA_MODEL", defaultOllamaModel),
+    }
+    return cfg, cfg.Validate()
+}
+
+// Validate reports every invalid setting at once
+func (c Config) Validate() error {
+    var errs []error
+    if _, port, err := net.SplitHostPort(c.ListenAddr); err != nil || port == "" {
+        errs = append(errs, fmt.Errorf("LISTEN_ADDR must be host:port or :port, got %q", c.ListenAddr))
+    }
+    switch c.StoreBackend {
+    case BackendMemory, BackendSQLite, BackendPostgres, BackendMySQL:
+    default:
+        errs = append(errs, fmt.Errorf("STORE_BACKEND must be %s, %s, %s or %s, got %q",
+            BackendMemory, BackendSQLite, BackendPostgres, BackendMySQL, c.StoreBackend))
+    }
+    if u, err := url.Parse(c.OllamaURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+        errs = append(errs, fmt.Errorf("OLLAMA_URL must be an http(s) URL, got %q", c.OllamaURL))
+    }
+    if strings.TrimSpace(c.OllamaModel) == "" {
+        errs = append(errs, errors.New("OLLAMA_MODEL must not be blank"))
+    }
+    return errors.Join(errs...)
+}
+
+// rawConfigFile is a config file as decoded, before its values are checked
+type rawConfigFile map[string]interface{}
+
+// readConfigFile loads a YAML or TOML config file, chosen by extension, as
+// settings keyed by environment variable. Unknown keys are errors, so a
+// typo does not silently leave a default in place.
+func readConfigFile(path string) (map[string]string, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("reading config file: %w", err)
+    }
+    // Decoded into a plain map, which yaml uses for nested tables too
+    doc := map[string]interface{}{}
+    switch ext := strings.ToLower(filepath.Ext(path)); ext {
+    case ".yaml", ".yml":
+        dec := yaml.NewDecoder(bytes.NewReader(data))
+        if err := dec.Decode(&doc); err != nil && !errors.Is(err, io.EOF) {
+            return nil, fmt.Errorf("config file %s: %w", path, err)
+        }
+    case ".toml":
+        if _, err := toml.Decode(string(data), &doc); err != nil {
+            return nil, fmt.Errorf("config file %s: %w", path, err)
+        }
+    default:
+        return nil, fmt.Errorf("config file %s: extension must be .yaml, .yml or .toml", path)
+    }
+    settings, err := rawConfigFile(doc).settings()
+    if err != nil {
+        return nil, fmt.Errorf("config file %s: %w", path, err)
+    }
+    return settings, nil
+}
+
+// settings flattens the file: the configFileKeys, and the env section
+// naming any other environment variable
+func (raw rawConfigFile) settings() (map[string]string, error) {
+    settings := make(map[string]string)
+    var unknown []string
+    for key, value := range raw {
+        if key == "env" {
+            env, ok := value.(map[string]interface{})
+            if !ok {
+                return nil, errors.New("env must be a table of environment variables")
+            }
+            for name, v := range env {
+                if !envName.MatchString(name) {
+                    return nil, fmt.Errorf("env: %q is not an environment variable name", name)
+                }
+                s, err := configScalar(v)
+                if err != nil {
+                    return nil, fmt.Errorf("env.%s: %w", name, err)
+                }
+                settings[name] = s
+            }
+            continue
+        }
+        name, ok := configFileKeys[key]
+        if !ok {
+            unknown = append(unknown, key)
+            continue
+        }
+        s, err := configScalar(value)
+        if err != nil {
+            return nil, fmt.Errorf("%s: %w", key, err)
+        }
+        settings[name] = s
+    }
+    if len(unknown) > 0 {
+        sort.Strings(unknown)
+        return nil, fmt.Errorf("unknown keys %s", strings.Join(unknown, ", "))
+    }
+    // The core keys win over the same variables in the env section
+    for key, name := range configFileKeys {
+        if value, ok := raw[key]; ok {
+            settings[name], _ = configScalar(value)
+        }
+    }
+    return settings, nil
+}
+
+// configScalar renders a string, number or boolean as an environment
+// variable would hold it
+func configScalar(value interface{}) (string, error) {
+    switch v := value.(type) {
+    case string:
+        return v, nil
+    case bool, int, int64, uint64, float64:
+        return fmt.Sprint(v), nil
+    }
+    return "", fmt.Errorf("must be a string, number or boolean, got %T", value)
+}
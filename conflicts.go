@@ -0,0 +1,234 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+    "github.com/gorilla/mux"
+    "student-api/reqctx"
+)
+
+// ConflictPolicy decides what happens when incoming data would overwrite a local record that differs
+type ConflictPolicy string
+
+const (
+    // PolicySourceWins always applies the incoming values
+    PolicySourceWins ConflictPolicy = "source-wins"
+    // PolicyLocalWins keeps the local record untouched
+    PolicyLocalWins ConflictPolicy = "local-wins"
+    // PolicyNewestWins applies incoming values only when they were updated after the local record
+    PolicyNewestWins ConflictPolicy = "newest-wins"
+    // PolicyManual queues the conflict for review at GET /conflicts
+    PolicyManual ConflictPolicy = "manual"
+)
+
+// ParseConflictPolicy validates a policy name; an empty name selects source-wins
+func ParseConflictPolicy(name string) (ConflictPolicy, error) {
+    switch p := ConflictPolicy(name); p {
+    case "":
+        return PolicySourceWins, nil
+    case PolicySourceWins, PolicyLocalWins, PolicyNewestWins, PolicyManual:
+        return p, nil
+    default:
+        return "", fmt.Errorf("unknown conflict policy %q", name)
+    }
+}
+
+// Conflict resolutions recorded on staged rows and conflicts
+const (
+    ResolutionApplied   = "applied"
+    ResolutionKeptLocal = "kept_local"
+    ResolutionQueued    = "queued"
+)
+
+// decide applies the policy to a conflicting pair of records
+func (p ConflictPolicy) decide(local, incoming Student) string {
+    switch p {
+    case PolicyLocalWins:
+        return ResolutionKeptLocal
+    case PolicyNewestWins:
+        if !incoming.UpdatedAt.IsZero() && incoming.UpdatedAt.After(local.UpdatedAt) {
+            return ResolutionApplied
+        }
+        return ResolutionKeptLocal
+    case PolicyManual:
+        return ResolutionQueued
+    default:
+        return ResolutionApplied
+    }
+}
+
+// Conflict statuses
+const (
+    ConflictOpen     = "open"
+    ConflictResolved = "resolved"
+)
+
+// Conflict is an unresolved difference between a local record and incoming data
+type Conflict struct {
+    ID         int                    `json:"id"`
+    Tenant     string                 `json:"-"`
+    Source     string                 `json:"source"`
+    StudentID  int                    `json:"student_id"`
+    Local      Student                `json:"local"`
+    Incoming   Student                `json:"incoming"`
+    Changes    map[string]FieldChange `json:"changes"`
+    Status     string                 `json:"status"`
+    Resolution string                 `json:"resolution,omitempty"`
+    CreatedAt  time.Time              `json:"created_at"`
+    ResolvedAt *time.Time             `json:"resolved_at,omitempty"`
+}
+
+// ConflictStore queues conflicts awaiting manual review. IDs are shared by
+// every tenant, but each tenant sees only its own conflicts.
+type ConflictStore struct {
+    sync.RWMutex
+    conflicts map[int]*Conflict
+    nextID    int
+}
+
+// NewConflictStore initializes a new ConflictStore
+func NewConflictStore() *ConflictStore {
+    return &ConflictStore{conflicts: make(map[int]*Conflict), nextID: 1}
+}
+
+// Queue records a new open conflict for the tenant and returns its ID
+func (s *ConflictStore) Queue(tenant, source string, local, incoming Student) int {
+    s.Lock()
+    defer s.Unlock()
+    c := &Conflict{
+        ID:        s.nextID,
+        Tenant:    tenant,
+        Source:    source,
+        StudentID: local.ID,
+        Local:     local,
+        Incoming:  incoming,
+        Changes:   diffStudents(local, incoming),
+        Status:    ConflictOpen,
+        CreatedAt: time.Now().UTC(),
+    }
+    s.nextID++
+    s.conflicts[c.ID] = c
+    return c.ID
+}
+
+// conflictLocked returns the tenant's conflict with the given ID. The
+// caller must hold the lock.
+func (s *ConflictStore) conflictLocked(tenant string, id int) (*Conflict, bool) {
+    c, exists := s.conflicts[id]
+    if !exists || c.Tenant != tenant {
+        return nil, false
+    }
+    return c, true
+}
+
+func (app *App) ListConflicts(w http.ResponseWriter, r *http.Request) {
+    status := r.URL.Query().Get("status")
+    tenant := reqctx.Tenant(r.Context())
+
+    app.conflicts.RLock()
+    conflicts := make([]Conflict, 0, len(app.conflicts.conflicts))
+    for _, c := range app.conflicts.conflicts {
+        if c.Tenant == tenant && (status == "" || c.Status == status) {
+            conflicts = append(conflicts, *c)
+        }
+    }
+    app.conflicts.RUnlock()
+
+    sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].ID < conflicts[j].ID })
+    json.NewEncoder(w).Encode(conflicts)
+}
+
+func (app *App) GetConflict(w http.ResponseWriter, r *http.Request) {
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        httpError(w, r, "Invalid ID", http.StatusBadRequest)
+        return
+    }
+
+    app.conflicts.RLock()
+    defer app.conflicts.RUnlock()
+    c, exists := app.conflicts.conflictLocked(reqctx.Tenant(r.Context()), id)
+    if !exists {
+        httpError(w, r, "Conflict not found", http.StatusNotFound)
+        return
+    }
+    json.NewEncoder(w).Encode(c)
+}
+
+// ResolveConflict accepts {"resolution": "source"} to apply the incoming
+// values or {"resolution": "local"} to keep the local record. Resolving is
+// refused when the local record changed after the conflict was queued.
+func (app *App) ResolveConflict(w http.ResponseWriter, r *http.Request) {
+    store := app.storeFor(r)
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        httpError(w, r, "Invalid ID", http.StatusBadRequest)
+        return
+    }
+
+    var body struct {
+        Resolution string `json:"resolution"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+        httpError(w, r, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    if body.Resolution != "source" && body.Resolution != "local" {
+        writeValidationErrors(w, r, []ValidationError{{
+            Field:   "resolution",
+            Code:    CodeOutOfRange,
+            Message: "Resolution must be \"source\" or \"local\"",
+        }})
+        return
+    }
+
+    app.conflicts.Lock()
+    defer app.conflicts.Unlock()
+    c, exists := app.conflicts.conflictLocked(reqctx.Tenant(r.Context()), id)
+    if !exists {
+        httpError(w, r, "Conflict not found", http.StatusNotFound)
+        return
+    }
+    if c.Status != ConflictOpen {
+        httpError(w, r, "Conflict is already resolved", http.StatusConflict)
+        return
+    }
+
+    now := time.Now().UTC()
+    if body.Resolution == "source" {
+        store.Lock()
+        current, err := store.Get(c.StudentID)
+        if err != nil && !errors.Is(err, errStudentNotFound) {
+            store.Unlock()
+            writeStoreError(w, r, err)
+            return
+        }
+        if err != nil || len(diffStudents(current, c.Local)) > 0 {
+            store.Unlock()
+            httpError(w, r, "Local record changed since the conflict was queued", http.StatusConflict)
+            return
+        }
+        incoming := c.Incoming
+        incoming.ID = c.StudentID
+        _, version, err := store.replaceLocked(incoming)
+        store.Unlock()
+        if err != nil {
+            writeStoreError(w, r, err)
+            return
+        }
+        app.recordChanges(r, version)
+        c.Resolution = ResolutionApplied
+    } else {
+        c.Resolution = ResolutionKeptLocal
+    }
+
+    c.Status = ConflictResolved
+    c.ResolvedAt = &now
+    json.NewEncoder(w).Encode(c)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// ConsistencyTokenHeader carries the read-your-writes token. Writes return
+// it; reads that echo it are only served once the data includes that write.
+const ConsistencyTokenHeader = "X-Consistency-Token"
+
+// consistencyTokenPrefix versions the token format so it can change later;
+// clients must treat the token as opaque
+const consistencyTokenPrefix = "v1."
+
+func formatConsistencyToken(seq int) string {
+    return consistencyTokenPrefix + strconv.Itoa(seq)
+}
+
+func parseConsistencyToken(token string) (int, bool) {
+    if !strings.HasPrefix(token, consistencyTokenPrefix) {
+        return 0, false
+    }
+    seq, err := strconv.Atoi(strings.TrimPrefix(token, consistencyTokenPrefix))
+    return seq, err == nil && seq >= 0
+}
+
+// Seq returns the sequence number of the latest recorded change. It does not
+// take the store lock, so handlers may write responses while holding it.
+func (s *StudentStore) Seq() int {
+    return int(s.seq.Load())
+}
+
+// seqPollInterval is how often WaitForSeq rereads the history, for changes
+// written by another instance sharing it
+const seqPollInterval = 50 * time.Millisecond
+
+// WaitForSeq blocks until the store has recorded change seq or ctx is done.
+// It reports whether the store caught up.
+func (s *StudentStore) WaitForSeq(ctx context.Context, seq int) bool {
+    poll := time.NewTicker(seqPollInterval)
+    defer poll.Stop()
+    for {
+        s.RLock()
+        current, err := s.historyLocked().Last()
+        advanced := s.advanced
+        s.RUnlock()
+        if err == nil && current >= seq {
+            s.observeSeq(current)
+            return true
+        }
+        select {
+        case <-advanced:
+        case <-poll.C:
+        case <-ctx.Done():
+            return false
+        }
+    }
+}
+
+// consistencyWriter stamps the consistency token on a write's response just
+// before the headers go out, after the handler has applied its changes
+type consistencyWriter struct {
+    http.ResponseWriter
+    store       *StudentStore
+    wroteHeader bool
+}
+
+func (cw *consistencyWriter) WriteHeader(status int) {
+    if !cw.wroteHeader {
+        cw.wroteHeader = true
+        if status < 300 {
+            cw.Header().Set(ConsistencyTokenHeader, formatConsistencyToken(cw.store.Seq()))
+        }
+    }
+    cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *consistencyWriter) Write(b []byte) (int, error) {
+    if !cw.wroteHeader {
+        cw.WriteHeader(http.StatusOK)
+    }
+    return cw.ResponseWriter.Write(b)
+}
+
+// consistency is middleware implementing read-your-writes. Successful writes
+// get a token naming the latest change; a read presenting a token waits up to
+// consistencyWait for the store to reach it and otherwise fails with 503 so
+// the client can retry instead of seeing stale data.
+func (app *App) consistency(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet && r.Method != http.MethodHead {
+            next.ServeHTTP(&consistencyWriter{ResponseWriter: w, store: app.storeFor(r)}, r)
+            return
+        }
+
+        token := r.Header.Get(ConsistencyTokenHeader)
+        if token == "" {
+            next.ServeHTTP(w, r)
+            return
+        }
+        seq, ok := parseConsistencyToken(token)
+        if !ok {
+            httpError(w, r, "Invalid consistency token", http.StatusBadRequest)
+            return
+        }
+
+        ctx, cancel := context.WithTimeout(r.Context(), app.consistencyWait)
+        defer cancel()
+        if !app.storeFor(r).WaitForSeq(ctx, seq) {
+            w.Header().Set("Retry-After", "1")
+            httpError(w, r, "Data has not caught up with the consistency token", http.StatusServiceUnavailable)
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// cronField bounds one field of a cron expression
+type cronField struct {
+    name     string
+    min, max int
+}
+
+var cronFields = [5]cronField{
+    {"minute", 0, 59},
+    {"hour", 0, 23},
+    {"day of month", 1, 31},
+    {"month", 1, 12},
+    {"day of week", 0, 6},
+}
+
+// CronSchedule is a parsed five-field cron expression ("30 6 * * 1-5")
+// evaluated in UTC. Each field accepts *, values, ranges, lists and /steps.
+// As in cron, when both day fields are restricted either may match.
+type CronSchedule struct {
+    expr string
+    sets [5]map[int]bool
+    // domRestricted and dowRestricted record day fields other than *
+    domRestricted, dowRestricted bool
+}
+
+// ParseCron parses a cron expression
+func ParseCron(expr string) (*CronSchedule, error) {
+    parts := strings.Fields(expr)
+    if len(parts) != len(cronFields) {
+        return nil, fmt.Errorf("cron expression %q: expected 5 fields, got %d", expr, len(parts))
+    }
+    s := &CronSchedule{expr: expr}
+    for i, part := range parts {
+        set, err := parseCronField(part, cronFields[i])
+        if err != nil {
+            return nil, fmt.Errorf("cron expression %q: %v", expr, err)
+        }
+        s.sets[i] = set
+    }
+    s.domRestricted = parts[2] != "*"
+    s.dowRestricted = parts[4] != "*"
+    return s, nil
+}
+
+func parseCronField(part string, f cronField) (map[int]bool, error) {
+    set := make(map[int]bool)
+    for _, item := range strings.Split(part, ",") {
+        rng, stepText, hasStep := strings.Cut(item, "/")
+        step := 1
+        if hasStep {
+            n, err := strconv.Atoi(stepText)
+            if err != nil || n < 1 {
+                return nil, fmt.Errorf("invalid step %q in %s", stepText, f.name)
+            }
+            step = n
+        }
+
+        lo, hi := f.min, f.max
+        if rng != "*" {
+            first, last, isRange := strings.Cut(rng, "-")
+            var err error
+            if lo, err = strconv.Atoi(first); err != nil {
+                return nil, fmt.Errorf("invalid %s %q", f.name, item)
+            }
+            hi = lo
+            if isRange {
+                if hi, err = strconv.Atoi(last); err != nil {
+                    return nil, fmt.Errorf("invalid %s %q", f.name, item)
+                }
+            } else if hasStep {
+                hi = f.max
+            }
+        }
+        if lo < f.min || hi > f.max || lo > hi {
+            return nil, fmt.Errorf("%s %q is outside %d-%d", f.name, item, f.min, f.max)
+        }
+        for v := lo; v <= hi; v += step {
+            set[v] = true
+        }
+    }
+    return set, nil
+}
+
+// String returns the expression the schedule was parsed from
+func (s *CronSchedule) String() string {
+    return s.expr
+}
+
+// Next returns the first matching minute after t, or the zero time if none
+// falls within the next five years (e.g. "0 0 31 2 *")
+func (s *CronSchedule) Next(t time.Time) time.Time {
+    t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+    limit := t.AddDate(5, 0, 0)
+    for t.Before(limit) {
+        switch {
+        case !s.sets[3][int(t.Month())]:
+            t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+        case !s.sets[1][t.Hour()] || !s.matchesDay(t):
+            t = t.Truncate(time.Hour).Add(time.Hour)
+        case !s.sets[0][t.Minute()]:
+            t = t.Add(time.Minute)
+        default:
+            return t
+        }
+    }
+    return time.Time{}
+}
+
+func (s *CronSchedule) matchesDay(t time.Time) bool {
+    dom, dow := s.sets[2][t.Day()], s.sets[4][int(t.Weekday())]
+    if s.domRestricted && s.dowRestricted {
+        return dom || dow
+    }
+    return dom && dow
+}
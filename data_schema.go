@@ -0,0 +1,148 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "reflect"
+    "sort"
+    "strings"
+)
+
+// DataSchema describes the data model for form builders and integrators:
+// GET /schema
+type DataSchema struct {
+    Entities []SchemaEntity `json:"entities"`
+}
+
+// SchemaEntity describes one kind of record and the routes serving it.
+// CustomFields lists fields defined on top of the built-in ones; there are
+// none yet.
+type SchemaEntity struct {
+    Name         string        `json:"name"`
+    Path         string        `json:"path"`
+    Fields       []SchemaField `json:"fields"`
+    CustomFields []SchemaField `json:"custom_fields"`
+}
+
+// SchemaField describes a field as it is encoded in JSON. Required fields
+// must be sent on writes; read-only ones are set by the server and ignored
+// when sent. Operators are those a filter expression may apply to it.
+type SchemaField struct {
+    Name       string       `json:"name"`
+    Label      string       `json:"label"`
+    Type       string       `json:"type"`
+    Format     string       `json:"format,omitempty"`
+    Nullable   bool         `json:"nullable,omitempty"`
+    Required   bool         `json:"required"`
+    ReadOnly   bool         `json:"read_only"`
+    Minimum    *int         `json:"minimum,omitempty"`
+    Maximum    *int         `json:"maximum,omitempty"`
+    Filterable bool         `json:"filterable"`
+    Sortable   bool         `json:"sortable"`
+    Operators  []string     `json:"operators,omitempty"`
+    Rules      []SchemaRule `json:"rules,omitempty"`
+}
+
+// SchemaRule is a validation rule and the error a write breaking it gets.
+// Values lists what the rule accepts, when that is a fixed set.
+type SchemaRule struct {
+    Code    string   `json:"code"`
+    Message string   `json:"message"`
+    Values  []string `json:"values,omitempty"`
+}
+
+// Rules describes the checks Check applies
+func (p *EmailPolicy) Rules() []SchemaRule {
+    rules := []SchemaRule{{Code: CodeEmailInvalid, Message: "Email must be a valid address"}}
+    if len(p.blocked) > 0 {
+        rules = append(rules, SchemaRule{Code: CodeEmailDisposable, Message: "Disposable email addresses are not allowed"})
+    }
+    if len(p.allowed) > 0 {
+        rules = append(rules, SchemaRule{
+            Code:    CodeEmailDomainNotAllowed,
+            Message: "Email domain must be one of: " + strings.Join(p.allowed, ", "),
+            Values:  p.allowed,
+        })
+    }
+    return rules
+}
+
+// schemaFields describes the JSON fields of a struct type, marking those
+// readOnlyFields lists, as in the OpenAPI document
+func schemaFields(t reflect.Type) []SchemaField {
+    b := &schemaBuilder{components: make(map[string]interface{})}
+    var fields []SchemaField
+    for i := 0; i < t.NumField(); i++ {
+        field := t.Field(i)
+        name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+        if name == "" || name == "-" || !field.IsExported() {
+            continue
+        }
+        schema := b.schema(field.Type)
+        f := SchemaField{Name: name, Label: fieldLabel(name), Type: "object", ReadOnly: readOnlyFields[t][name]}
+        if kind, ok := schema["type"].(string); ok {
+            f.Type = kind
+        }
+        f.Format, _ = schema["format"].(string)
+        f.Nullable, _ = schema["nullable"].(bool)
+        fields = append(fields, f)
+    }
+    return fields
+}
+
+// fieldLabel turns a field name into a label: student_id is "Student ID"
+func fieldLabel(name string) string {
+    words := strings.Split(name, "_")
+    for i, word := range words {
+        if word == "id" {
+            words[i] = "ID"
+        } else if i == 0 {
+            words[i] = strings.ToUpper(word[:1]) + word[1:]
+        }
+    }
+    return strings.Join(words, " ")
+}
+
+// studentSchema describes students with the rules of validateStudent,
+// including the email policy in force, and the fields filterFields lets
+// lists filter and sort on
+func (app *App) studentSchema() SchemaEntity {
+    fields := schemaFields(reflect.TypeOf(Student{}))
+    for i := range fields {
+        f := &fields[i]
+        if spec, ok := filterFields[f.Name]; ok {
+            f.Filterable, f.Sortable = true, true
+            for op := range filterOperators[spec.kind] {
+                f.Operators = append(f.Operators, op)
+            }
+            sort.Strings(f.Operators)
+        }
+        switch f.Name {
+        case "name":
+            f.Required = true
+            f.Rules = []SchemaRule{{Code: CodeRequired, Message: "Name is required"}}
+        case "age":
+            min, max := minStudentAge, maxStudentAge
+            f.Minimum, f.Maximum = &min, &max
+            f.Rules = []SchemaRule{{Code: CodeOutOfRange, Message: fmt.Sprintf("Age must be between %d and %d", min, max)}}
+        case "email":
+            f.Required, f.Format = true, "email"
+            f.Rules = append([]SchemaRule{{Code: CodeRequired, Message: "Email is required"}}, app.emailPolicy.Rules()...)
+        }
+    }
+    return SchemaEntity{Name: "student", Path: "/students", Fields: fields, CustomFields: []SchemaField{}}
+}
+
+// GetSchema serves GET /schema. Notes are transcribed by the server from
+// recordings, so all their fields are read-only.
+func (app *App) GetSchema(w http.ResponseWriter, r *http.Request) {
+    notes := schemaFields(reflect.TypeOf(Note{}))
+    for i := range notes {
+        notes[i].ReadOnly = true
+    }
+    json.NewEncoder(w).Encode(DataSchema{Entities: []SchemaEntity{
+        app.studentSchema(),
+        {Name: "note", Path: "/students/{id}/notes", Fields: notes, CustomFields: []SchemaField{}},
+    }})
+}
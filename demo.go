@@ -0,0 +1,173 @@
+package main
+
+import (
+    "database/sql"
+    "fmt"
+    "math/rand"
+    "os"
+    "sort"
+    "strings"
+)
+
+// Name parts for generated students; combined they give a few thousand
+// distinct, obviously fictional names
+var (
+    demoFirstNames = []string{
+        "Ada", "Bea", "Cyrus", "Dara", "Eli", "Fern", "Gus", "Hana", "Ivo", "Juno",
+        "Kit", "Lior", "Mina", "Nico", "Opal", "Pim", "Quin", "Rae", "Sol", "Tove",
+        "Uma", "Vik", "Wren", "Xavi", "Yara", "Zeb",
+    }
+    demoLastNames = []string{
+        "Alder", "Birch", "Cedar", "Dune", "Ember", "Fjord", "Grove", "Heath", "Isle", "Juniper",
+        "Kestrel", "Linden", "Marsh", "Nettle", "Orchard", "Pebble", "Quarry", "Reed", "Sorrel", "Thistle",
+        "Upland", "Vale", "Willow", "Yarrow",
+    }
+)
+
+// demoProfile is the shape of a source dataset: how often each age and
+// email domain occurs. It holds no names or addresses.
+type demoProfile struct {
+    total   int
+    ages    map[int]int
+    domains map[string]int
+}
+
+// profileDB summarizes the age and email domain distributions of a
+// database's students
+func profileDB(db *sql.DB) (demoProfile, error) {
+    p := demoProfile{ages: make(map[int]int), domains: make(map[string]int)}
+    rows, err := db.Query("SELECT age, email FROM students")
+    if err != nil {
+        return p, err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var age int
+        var email string
+        if err := rows.Scan(&age, &email); err != nil {
+            return p, err
+        }
+        p.total++
+        p.ages[age]++
+        if _, domain, ok := strings.Cut(email, "@"); ok {
+            p.domains[strings.ToLower(domain)]++
+        }
+    }
+    return p, rows.Err()
+}
+
+// weightedPicker samples keys in proportion to their counts
+type weightedPicker[K comparable] struct {
+    keys       []K
+    cumulative []int
+}
+
+func newWeightedPicker[K comparable](counts map[K]int, less func(a, b K) bool) weightedPicker[K] {
+    var p weightedPicker[K]
+    for k := range counts {
+        p.keys = append(p.keys, k)
+    }
+    // Sorted keys keep the output reproducible for a given seed
+    sort.Slice(p.keys, func(i, j int) bool { return less(p.keys[i], p.keys[j]) })
+    total := 0
+    for _, k := range p.keys {
+        total += counts[k]
+        p.cumulative = append(p.cumulative, total)
+    }
+    return p
+}
+
+func (p weightedPicker[K]) pick(rng *rand.Rand) K {
+    n := rng.Intn(p.cumulative[len(p.cumulative)-1])
+    i := sort.SearchInts(p.cumulative, n+1)
+    return p.keys[i]
+}
+
+// generateDemoStudents creates count fake students whose ages follow the
+// profile. Each real domain is replaced by a stable placeholder such as
+// school2.example.edu so the domain mix survives without naming schools.
+func generateDemoStudents(p demoProfile, count int, rng *rand.Rand) []Student {
+    ages := p.ages
+    if len(ages) == 0 {
+        ages = map[int]int{18: 1, 19: 2, 20: 2, 21: 2, 22: 1}
+    }
+    domains := make(map[string]int)
+    placeholders := make([]string, 0, len(p.domains))
+    for domain := range p.domains {
+        placeholders = append(placeholders, domain)
+    }
+    sort.Strings(placeholders)
+    for i, domain := range placeholders {
+        domains[fmt.Sprintf("school%d.example.edu", i+1)] = p.domains[domain]
+    }
+    if len(domains) == 0 {
+        domains["school1.example.edu"] = 1
+    }
+
+    agePicker := newWeightedPicker(ages, func(a, b int) bool { return a < b })
+    domainPicker := newWeightedPicker(domains, func(a, b string) bool { return a < b })
+
+    students := make([]Student, 0, count)
+    used := make(map[string]int)
+    for i := 0; i < count; i++ {
+        first := demoFirstNames[rng.Intn(len(demoFirstNames))]
+        last := demoLastNames[rng.Intn(len(demoLastNames))]
+        local := strings.ToLower(first + "." + last)
+        used[local]++
+        if n := used[local]; n > 1 {
+            local = fmt.Sprintf("%s%d", local, n)
+        }
+        students = append(students, Student{
+            Name:  first + " " + last,
+            Age:   agePicker.pick(rng),
+            Email: local + "@" + domainPicker.pick(rng),
+        })
+    }
+    return students
+}
+
+// runDemoGenerator reads the distributions of the source database and writes
+// count generated students to a new database at target. A count of zero
+// matches the source's size.
+func runDemoGenerator(source, target string, count int, seed int64) error {
+    if _, err := os.Stat(target); err == nil {
+        return fmt.Errorf("%s already exists", target)
+    }
+
+    src, err := sql.Open("sqlite3", sqliteDSN(source)+"&_query_only=true")
+    if err != nil {
+        return err
+    }
+    defer src.Close()
+    profile, err := profileDB(src)
+    if err != nil {
+        return fmt.Errorf("%s: %v", source, err)
+    }
+    if count <= 0 {
+        count = profile.total
+    }
+
+    dst, err := sql.Open("sqlite3", sqliteDSN(target))
+    if err != nil {
+        return err
+    }
+    defer dst.Close()
+    if err := migrateDB(dst); err != nil {
+        return err
+    }
+    repo, err := NewSQLiteRepository(dst)
+    if err != nil {
+        return err
+    }
+    targetStore := NewStudentStore(repo, nil)
+    defer targetStore.Close()
+
+    for _, student := range generateDemoStudents(profile, count, rand.New(rand.NewSource(seed))) {
+        if _, _, err := targetStore.Create(student); err != nil {
+            return err
+        }
+    }
+    fmt.Printf("wrote %d demo students to %s (ages from %d source records, %d email domains)\n",
+        count, target, profile.total, len(profile.domains))
+    return nil
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+    "context"
+    "crypto/tls"
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net"
+    "net/smtp"
+    "strconv"
+    "strings"
+    "time"
+    "student-api/migrations"
+)
+
+// Check outcomes. A warning is reported but does not fail the check run.
+const (
+    CheckOK   = "ok"
+    CheckWarn = "warn"
+    CheckFail = "fail"
+    CheckSkip = "skip"
+)
+
+// doctorTimeout bounds each network check
+const doctorTimeout = 5 * time.Second
+
+// CheckResult is the outcome of one startup check
+type CheckResult struct {
+    Name   string `json:"name"`
+    Status string `json:"status"`
+    Detail string `json:"detail,omitempty"`
+}
+
+// CheckReport is printed by --check
+type CheckReport struct {
+    OK     bool          `json:"ok"`
+    Build  BuildInfo     `json:"build"`
+    Checks []CheckResult `json:"checks"`
+}
+
+func (r *CheckReport) add(name, status, detail string) {
+    r.Checks = append(r.Checks, CheckResult{Name: name, Status: status, Detail: detail})
+    if status == CheckFail {
+        r.OK = false
+    }
+}
+
+func (r *CheckReport) addErr(name string, err error, okDetail string) {
+    if err != nil {
+        r.add(name, CheckFail, err.Error())
+        return
+    }
+    r.add(name, CheckOK, okDetail)
+}
+
+// runDoctor validates configuration and external dependencies, writes a JSON
+// report to out and returns the process exit code
+func runDoctor(out io.Writer) int {
+    report := &CheckReport{OK: true, Build: buildInfo()}
+
+    checkConfig(report)
+    checkDatabase(report)
+    checkOllama(report)
+    checkTLS(report)
+    checkSMTP(report)
+
+    enc := json.NewEncoder(out)
+    enc.SetIndent("", "  ")
+    enc.Encode(report)
+    if !report.OK {
+        return 1
+    }
+    return 0
+}
+
+// checkConfig parses every setting main would refuse to start with
+func checkConfig(report *CheckReport) {
+    if configFile != "" {
+        _, err := readConfigFile(configFile)
+        report.addErr("config.file", err, configFile)
+    }
+    cfg, err := LoadConfig()
+    report.addErr("config.core", err, fmt.Sprintf("listening on %s, %s store", cfg.ListenAddr, cfg.StoreBackend))
+    _, err = LoadEmailPolicy()
+    report.addErr("config.email_policy", err, "")
+    _, err = ParsePromptSplit(getEnv("PROMPT_VARIANTS", ""))
+    report.addErr("config.prompt_variants", err, "")
+    _, err = ParseConflictPolicy(getEnv("IMPORT_CONFLICT_POLICY", ""))
+    report.addErr("config.import_conflict_policy", err, "")
+    _, err = LoadChaos()
+    report.addErr("config.chaos", err, "")
+    _, err = LoadTenantStores(nil)
+    report.addErr("config.tenants", err, getEnv("TENANT_MODE", TenantShared))
+    routes, err := LoadRoutePolicies()
+    detail := ""
+    if err == nil {
+        detail = routes.Summary()
+    }
+    report.addErr("config.routes", err, detail)
+    _, err = LoadRouteTimeouts(routes)
+    report.addErr("config.route_timeouts", err, "")
+    _, err = LoadBodyLimits()
+    report.addErr("config.body_limits", err, "")
+    _, err = LoadShutdownConfig()
+    report.addErr("config.shutdown", err, "")
+    _, _, err = listSnapshotConfig()
+    report.addErr("config.list_snapshot", err, "")
+    _, err = LoadModelRouter(NewOllamaClient("", ""), nil)
+    report.addErr("config.ollama_routes", err, "")
+    _, err = LoadRateLimiter(routes)
+    report.addErr("config.rate_limit", err, "")
+    _, err = LoadLLMQuotas()
+    report.addErr("config.llm_quota", err, "")
+    _, err = LoadEventStreams()
+    report.addErr("config.event_streams", err, "")
+    _, err = LoadEventSockets()
+    report.addErr("config.event_sockets", err, "")
+    if backend, sample, err := shadowSettings(); err != nil || backend != "" {
+        report.addErr("config.shadow", err, fmt.Sprintf("mirroring to %s, comparing %g of reads", backend, sample))
+    }
+    if addr := getEnv("GRPC_ADDR", ""); addr != "" {
+        _, _, err := net.SplitHostPort(addr)
+        report.addErr("config.grpc", err, "serving gRPC on "+addr)
+    }
+    _, err = LoadLeaderElector(nil, nil)
+    report.addErr("config.instance_role", err, getEnv("INSTANCE_ROLE", RoleAuto))
+    _, err = LoadJWTAuth()
+    report.addErr("config.jwt", err, "")
+    _, err = LoadRegistrationStore(nil)
+    report.addErr("config.registration", err, "")
+    _, err = LoadInvitationStore(nil)
+    report.addErr("config.invitations", err, "")
+    _, err = LoadWebhooks(nil, nil, nil)
+    report.addErr("config.webhooks", err, "")
+    _, err = LoadEventOutbox(nil, nil, nil)
+    report.addErr("config.event_broker", err, getEnv("EVENT_BROKER", ""))
+    masker, err := LoadMasker()
+    report.addErr("config.masking", err, fmt.Sprintf("APP_ENV=%s, masking %t", getEnv("APP_ENV", "production"), masker != nil))
+    _, err = LoadUserStore(nil)
+    report.addErr("config.users", err, "")
+    _, err = LoadOIDCProvider()
+    report.addErr("config.oidc", err, getEnv("OIDC_ISSUER", ""))
+    _, err = LoadAuditSinks(NewMemoryAuditSink(0))
+    report.addErr("config.audit_sinks", err, getEnv("AUDIT_SINKS", AuditSinkDB))
+    _, err = LoadAccessLog(nil)
+    report.addErr("config.access_log", err, getEnv("ACCESS_LOG", AccessLogSensitive))
+    redactor := LoadRedactor()
+    report.addErr("config.log_redaction", redactor.SelfTest(), getEnv("LOG_REDACT_FIELDS", strings.Join(defaultRedactFields, ",")))
+    _, err = LoadOllamaRecorder()
+    report.addErr("config.ollama_mode", err, getEnv("OLLAMA_MODE", OllamaLive))
+    switch backend := getEnv("STORE_BACKEND", BackendSQLite); backend {
+    case BackendMemory:
+        report.add("config.store_backend", CheckOK, backend)
+        _, err = LoadMemoryRepository()
+        report.addErr("config.memory_shards", err, "")
+    case BackendSQLite, BackendPostgres, BackendMySQL:
+        report.add("config.store_backend", CheckOK, backend)
+    default:
+        report.add("config.store_backend", CheckFail, fmt.Sprintf("unknown store backend %q", backend))
+    }
+}
+
+// checkDatabase opens the database and reports pending schema changes
+func checkDatabase(report *CheckReport) {
+    switch getEnv("STORE_BACKEND", BackendSQLite) {
+    case BackendMemory:
+        report.add("database", CheckSkip, "STORE_BACKEND=memory")
+        return
+    case BackendPostgres:
+        checkPostgres(report)
+        return
+    case BackendMySQL:
+        report.add("database", CheckSkip, "mysql is checked by its startup connection retry loop")
+        return
+    }
+    path := getEnv("DATABASE_PATH", defaultDatabasePath)
+    db, err := sql.Open("sqlite3", sqliteDSN(path))
+    if err == nil {
+        defer db.Close()
+        ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+        defer cancel()
+        err = db.PingContext(ctx)
+    }
+    if err != nil {
+        report.add("database", CheckFail, err.Error())
+        return
+    }
+    report.add("database", CheckOK, path)
+
+    reportMigrations(report, db, sqliteMigrations, nil)
+}
+
+// reportMigrations warns about migrations that will be applied at startup
+func reportMigrations(report *CheckReport, db *sql.DB, list []migrations.Migration, rebind func(string) string) {
+    m, err := migrations.New(db, list, rebind)
+    if err != nil {
+        report.add("database.migrations", CheckFail, err.Error())
+        return
+    }
+    pending, err := m.Pending()
+    switch {
+    case err != nil:
+        report.add("database.migrations", CheckFail, err.Error())
+    case len(pending) > 0:
+        report.add("database.migrations", CheckWarn, fmt.Sprintf("%d pending, starting with %d %s; they are applied at startup",
+            len(pending), pending[0].Version, pending[0].Name))
+    default:
+        report.add("database.migrations", CheckOK, "up to date")
+    }
+}
+
+// checkPostgres connects to DB_DSN and reports whether the schema exists
+func checkPostgres(report *CheckReport) {
+    db, err := openPostgres()
+    if err == nil {
+        defer db.Close()
+        ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+        defer cancel()
+        err = db.PingContext(ctx)
+    }
+    if err != nil {
+        report.add("database", CheckFail, err.Error())
+        return
+    }
+    report.add("database", CheckOK, BackendPostgres)
+
+    reportMigrations(report, db, postgresMigrations, rebindPostgres)
+}
+
+// checkOllama verifies the server answers and has the configured model
+func checkOllama(report *CheckReport) {
+    if getEnv("OLLAMA_MODE", OllamaLive) == OllamaReplay {
+        report.add("ollama", CheckSkip, "replay mode does not contact Ollama")
+        return
+    }
+    client := NewOllamaClient(getEnv("OLLAMA_URL", defaultOllamaURL), getEnv("OLLAMA_MODEL", defaultOllamaModel))
+    ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+    defer cancel()
+
+    models, err := client.ListModels(ctx)
+    if err != nil {
+        report.add("ollama", CheckFail, err.Error())
+        return
+    }
+    for _, m := range models {
+        if sameModel(m, client.Model()) {
+            report.add("ollama", CheckOK, "model "+client.Model()+" is available")
+            return
+        }
+    }
+    status := CheckFail
+    if getEnvBool("OLLAMA_PULL", true) {
+        status = CheckWarn
+    }
+    report.add("ollama", status, "model "+client.Model()+" is not available locally")
+}
+
+// checkTLS validates the TLS_ settings and loads the certificate pair when
+// TLS_CERT_FILE and TLS_KEY_FILE are set
+func checkTLS(report *CheckReport) {
+    cfg, err := LoadTLSConfig()
+    switch {
+    case err != nil:
+        report.add("tls", CheckFail, err.Error())
+        return
+    case cfg.Mode() == "http":
+        report.add("tls", CheckSkip, "TLS_CERT_FILE and TLS_AUTOCERT_DOMAINS are not set")
+        return
+    case cfg.Mode() == "autocert":
+        report.add("tls", CheckOK, "autocert for "+strings.Join(cfg.AutocertDomains, ", "))
+        return
+    }
+    certs := &CertReloader{certFile: cfg.CertFile, keyFile: cfg.KeyFile}
+    if err := certs.Reload(); err != nil {
+        report.add("tls", CheckFail, err.Error())
+        return
+    }
+    detail := fmt.Sprintf("%s, expires %s", cfg.CertFile, certs.NotAfter().Format(time.RFC3339))
+    if time.Until(certs.NotAfter()) < 0 {
+        report.add("tls", CheckFail, cfg.CertFile+" expired "+certs.NotAfter().Format(time.RFC3339))
+        return
+    }
+    report.add("tls", CheckOK, detail)
+}
+
+// checkSMTP connects to SMTP_HOST and, when SMTP_USERNAME is set,
+// authenticates with it and SMTP_PASSWORD
+func checkSMTP(report *CheckReport) {
+    host := getEnv("SMTP_HOST", "")
+    if host == "" {
+        report.add("smtp", CheckSkip, "SMTP_HOST is not set")
+        return
+    }
+    addr := net.JoinHostPort(host, strconv.Itoa(getEnvInt("SMTP_PORT", 587)))
+    report.addErr("smtp", smtpLogin(addr, host), addr)
+}
+
+func smtpLogin(addr, host string) error {
+    conn, err := net.DialTimeout("tcp", addr, doctorTimeout)
+    if err != nil {
+        return err
+    }
+    conn.SetDeadline(time.Now().Add(doctorTimeout))
+    c, err := smtp.NewClient(conn, host)
+    if err != nil {
+        conn.Close()
+        return err
+    }
+    defer c.Close()
+
+    if ok, _ := c.Extension("STARTTLS"); ok {
+        if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+            return fmt.Errorf("starttls: %v", err)
+        }
+    }
+    if user := getEnv("SMTP_USERNAME", ""); user != "" {
+        if err := c.Auth(smtp.PlainAuth("", user, getEnv("SMTP_PASSWORD", ""), host)); err != nil {
+            return fmt.Errorf("auth: %v", err)
+        }
+    }
+    return c.Quit()
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+    "bufio"
+    "os"
+    "strings"
+)
+
+// Validation error codes returned for email policy violations
+const (
+    CodeEmailInvalid          = "email_invalid"
+    CodeEmailDisposable       = "email_disposable"
+    CodeEmailDomainNotAllowed = "email_domain_not_allowed"
+)
+
+// disposableDomains is the bundled list of known throwaway email providers
+var disposableDomains = []string{
+    "10minutemail.com",
+    "33mail.com",
+    "dispostable.com",
+    "emailondeck.com",
+    "fakeinbox.com",
+    "getnada.com",
+    "guerrillamail.com",
+    "guerrillamail.net",
+    "guerrillamailblock.com",
+    "maildrop.cc",
+    "mailinator.com",
+    "mailnesia.com",
+    "mintemail.com",
+    "mohmal.com",
+    "moakt.com",
+    "sharklasers.com",
+    "spamgourmet.com",
+    "temp-mail.org",
+    "tempail.com",
+    "tempmail.com",
+    "tempmailo.com",
+    "throwawaymail.com",
+    "trashmail.com",
+    "yopmail.com",
+}
+
+// EmailPolicy decides which email domains are accepted for student records
+type EmailPolicy struct {
+    blocked map[string]bool
+    allowed []string
+}
+
+// NewEmailPolicy builds a policy from blocked and allowed domain lists.
+// When blockDisposable is set the bundled disposable list is included.
+// An empty allowed list accepts any domain that is not blocked.
+func NewEmailPolicy(blockDisposable bool, blocked, allowed []string) *EmailPolicy {
+    p := &EmailPolicy{blocked: make(map[string]bool)}
+    if blockDisposable {
+        for _, domain := range disposableDomains {
+            p.blocked[domain] = true
+        }
+    }
+    for _, domain := range blocked {
+        p.blocked[normalizeDomain(domain)] = true
+    }
+    for _, domain := range allowed {
+        p.allowed = append(p.allowed, normalizeDomain(domain))
+    }
+    return p
+}
+
+// LoadEmailPolicy reads the policy from the environment:
+// EMAIL_BLOCK_DISPOSABLE (default true), EMAIL_BLOCKED_DOMAINS,
+// EMAIL_BLOCKLIST_FILE (one domain per line) and EMAIL_ALLOWED_DOMAINS.
+func LoadEmailPolicy() (*EmailPolicy, error) {
+    blocked := getEnvList("EMAIL_BLOCKED_DOMAINS")
+    if path := getEnv("EMAIL_BLOCKLIST_FILE", ""); path != "" {
+        fromFile, err := readDomainFile(path)
+        if err != nil {
+            return nil, err
+        }
+        blocked = append(blocked, fromFile...)
+    }
+    return NewEmailPolicy(
+        getEnvBool("EMAIL_BLOCK_DISPOSABLE", true),
+        blocked,
+        getEnvList("EMAIL_ALLOWED_DOMAINS"),
+    ), nil
+}
+
+// Check returns a validation error when the email violates the policy
+func (p *EmailPolicy) Check(email string) *ValidationError {
+    at := strings.LastIndex(email, "@")
+    if at <= 0 || at == len(email)-1 {
+        return &ValidationError{
+            Field:   "email",
+            Code:    CodeEmailInvalid,
+            Message: "Email must be a valid address",
+        }
+    }
+    domain := normalizeDomain(email[at+1:])
+
+    if p.isBlocked(domain) {
+        return &ValidationError{
+            Field:   "email",
+            Code:    CodeEmailDisposable,
+            Message: "Disposable email addresses are not allowed",
+        }
+    }
+
+    if len(p.allowed) > 0 && !p.isAllowed(domain) {
+        return &ValidationError{
+            Field:   "email",
+            Code:    CodeEmailDomainNotAllowed,
+            Message: "Email domain must be one of: " + strings.Join(p.allowed, ", "),
+        }
+    }
+
+    return nil
+}
+
+// isBlocked matches the domain and each of its parent domains against the blocklist
+func (p *EmailPolicy) isBlocked(domain string) bool {
+    for d := domain; d != ""; {
+        if p.blocked[d] {
+            return true
+        }
+        dot := strings.Index(d, ".")
+        if dot < 0 {
+            break
+        }
+        d = d[dot+1:]
+    }
+    return false
+}
+
+// isAllowed accepts an allowed domain or any of its subdomains
+func (p *EmailPolicy) isAllowed(domain string) bool {
+    for _, allowed := range p.allowed {
+        if domain == allowed || strings.HasSuffix(domain, "."+allowed) {
+            return true
+        }
+    }
+    return false
+}
+
+func normalizeDomain(domain string) string {
+    return strings.TrimPrefix(strings.ToLower(strings.TrimSpace(domain)), "@")
+}
+
+func readDomainFile(path string) ([]string, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    var domains []string
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        domains = append(domains, line)
+    }
+    return domains, scanner.Err()
+}
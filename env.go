@@ -0,0 +1,75 @@
+package main
+
+import (
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// flagSettings and fileSettings hold the settings given by command-line
+// flags and the config file, by environment variable; they are set once at
+// startup by ConfigSource.Apply
+var flagSettings, fileSettings map[string]string
+
+// getEnv returns the value of a setting or a fallback. A command-line flag
+// wins over the environment variable, which wins over the config file.
+func getEnv(key, fallback string) string {
+    if value := flagSettings[key]; value != "" {
+        return value
+    }
+    if value, ok := os.LookupEnv(key); ok && value != "" {
+        return value
+    }
+    if value := fileSettings[key]; value != "" {
+        return value
+    }
+    return fallback
+}
+
+// getEnvBool parses a boolean environment variable, falling back on absent or invalid values
+func getEnvBool(key string, fallback bool) bool {
+    value, err := strconv.ParseBool(getEnv(key, ""))
+    if err != nil {
+        return fallback
+    }
+    return value
+}
+
+// getEnvInt parses an integer environment variable, falling back on absent or invalid values
+func getEnvInt(key string, fallback int) int {
+    value, err := strconv.Atoi(getEnv(key, ""))
+    if err != nil {
+        return fallback
+    }
+    return value
+}
+
+// getEnvFloat parses a float environment variable, falling back on absent or invalid values
+func getEnvFloat(key string, fallback float64) float64 {
+    value, err := strconv.ParseFloat(getEnv(key, ""), 64)
+    if err != nil {
+        return fallback
+    }
+    return value
+}
+
+// getEnvList splits a comma-separated environment variable into trimmed, non-empty items
+func getEnvList(key string) []string {
+    var items []string
+    for _, item := range strings.Split(getEnv(key, ""), ",") {
+        if item = strings.TrimSpace(item); item != "" {
+            items = append(items, item)
+        }
+    }
+    return items
+}
+
+// getEnvDuration parses a duration environment variable such as "30s" or "5m"
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+    value, err := time.ParseDuration(getEnv(key, ""))
+    if err != nil {
+        return fallback
+    }
+    return value
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "strings"
+    "github.com/gorilla/mux"
+    "student-api/reqctx"
+)
+
+// Error codes used in the error envelope. Most errors take their code from
+// their status; see statusCodes.
+const (
+    CodeNotFound         = "not_found"
+    CodeMethodNotAllowed = "method_not_allowed"
+    CodeBodyTooLarge     = "body_too_large"
+    CodeTimeout          = "timeout"
+    // CodeValidationFailed carries the failed checks in details
+    CodeValidationFailed = "validation_failed"
+)
+
+// statusCodes gives each error status its default code
+var statusCodes = map[int]string{
+    http.StatusBadRequest:            "bad_request",
+    http.StatusUnauthorized:          "unauthorized",
+    http.StatusForbidden:             "forbidden",
+    http.StatusNotFound:              CodeNotFound,
+    http.StatusMethodNotAllowed:      CodeMethodNotAllowed,
+    http.StatusConflict:              "conflict",
+    http.StatusGone:                  "gone",
+    http.StatusPreconditionFailed:    "precondition_failed",
+    http.StatusRequestEntityTooLarge: CodeBodyTooLarge,
+    http.StatusUnsupportedMediaType:  "unsupported_media_type",
+    http.StatusUnprocessableEntity:   "unprocessable",
+    http.StatusLocked:                "locked",
+    http.StatusPreconditionRequired:  "precondition_required",
+    http.StatusTooManyRequests:       "rate_limited",
+    http.StatusInternalServerError:   "internal",
+    http.StatusNotImplemented:        "not_implemented",
+    http.StatusBadGateway:            "upstream_failed",
+    http.StatusServiceUnavailable:    "unavailable",
+    http.StatusGatewayTimeout:        CodeTimeout,
+}
+
+// statusCode returns the default code for an error status
+func statusCode(status int) string {
+    if code, ok := statusCodes[status]; ok {
+        return code
+    }
+    return "error"
+}
+
+// APIError is the body of every error response, wrapped as
+// {"error": {"code": ..., "message": ..., "details": [...], "request_id": ...}}.
+// Code is stable for clients to branch on; Message is for people.
+type APIError struct {
+    Code    string `json:"code"`
+    Message string `json:"message"`
+    // Details lists the failed checks of a validation error
+    Details []ValidationError `json:"details,omitempty"`
+    // RequestID matches the X-Request-ID header and the request's log lines
+    RequestID string `json:"request_id,omitempty"`
+}
+
+func (e *APIError) Error() string {
+    return e.Code + ": " + e.Message
+}
+
+type errorEnvelope struct {
+    Error APIError `json:"error"`
+}
+
+// writeAPIError writes e in the error envelope with the given status,
+// filling in the request ID
+func writeAPIError(w http.ResponseWriter, r *http.Request, status int, e APIError) {
+    e.RequestID = reqctx.RequestID(r.Context())
+    w.Header().Del("Content-Length")
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("X-Content-Type-Options", "nosniff")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(errorEnvelope{Error: e})
+}
+
+// writeError writes a JSON error envelope with the given status
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+    writeAPIError(w, r, status, APIError{Code: code, Message: message})
+}
+
+// httpError replaces http.Error: it writes message in the error envelope,
+// coded by status
+func httpError(w http.ResponseWriter, r *http.Request, message string, status int) {
+    writeError(w, r, status, statusCode(status), message)
+}
+
+// writeValidationErrors answers 400 with the failed checks as details
+func writeValidationErrors(w http.ResponseWriter, r *http.Request, errs []ValidationError) {
+    message := "Request validation failed"
+    if len(errs) == 1 {
+        message = errs[0].Message
+    }
+    writeAPIError(w, r, http.StatusBadRequest, APIError{Code: CodeValidationFailed, Message: message, Details: errs})
+}
+
+// routedMethods are the methods probed when building an Allow header
+var routedMethods = []string{
+    http.MethodGet,
+    http.MethodPost,
+    http.MethodPut,
+    http.MethodPatch,
+    http.MethodDelete,
+}
+
+// allowedMethods lists the methods some route accepts for the request's path
+func allowedMethods(router *mux.Router, r *http.Request) []string {
+    var allowed []string
+    for _, method := range routedMethods {
+        probe := r.Clone(r.Context())
+        probe.Method = method
+        var match mux.RouteMatch
+        if router.Match(probe, &match) && match.MatchErr == nil {
+            allowed = append(allowed, method)
+        }
+    }
+    return allowed
+}
+
+// notFound answers requests that match no route
+func (app *App) notFound(w http.ResponseWriter, r *http.Request) {
+    app.metrics.Inc("http_unmatched_requests_total", "reason", "not_found")
+    writeError(w, r, http.StatusNotFound, CodeNotFound, "No route matches "+r.URL.Path)
+}
+
+// methodNotAllowed answers requests whose path matches a route registered
+// for other methods, listing those methods in the Allow header
+func (app *App) methodNotAllowed(router *mux.Router) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        app.metrics.Inc("http_unmatched_requests_total", "reason", "method_not_allowed")
+        allowed := allowedMethods(router, r)
+        w.Header().Set("Allow", strings.Join(allowed, ", "))
+        writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed,
+            r.Method+" is not allowed on "+r.URL.Path+"; use "+strings.Join(allowed, ", "))
+    })
+}
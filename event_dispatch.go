@@ -0,0 +1,212 @@
+package main
+
+import (
+    "context"
+    "log/slog"
+    "sync"
+    "time"
+)
+
+// EventDeliverer sends one event to a consumer such as a webhook or stream
+type EventDeliverer func(ctx context.Context, e Event) error
+
+// aggregateKey identifies the student an event belongs to
+type aggregateKey struct {
+    tenant    string
+    studentID int
+}
+
+func eventAggregate(e Event) aggregateKey {
+    return aggregateKey{e.Tenant, e.StudentID}
+}
+
+// EventDispatcher delivers events in order per student. Each student with
+// pending events has its own queue, drained by one goroutine at a time: a
+// failed delivery is retried with exponential backoff before the student's
+// next event is tried, so retries never let a later change overtake an
+// earlier one. Other students' events keep flowing meanwhile, up to the
+// worker limit. An event that still fails after the last attempt is handed
+// to the giveUp callback, dead-lettering it, and the student's queue moves
+// on; its consumer sees the gap in Version.
+type EventDispatcher struct {
+    name        string
+    deliver     EventDeliverer
+    maxAttempts int
+    backoff     time.Duration
+    maxBackoff  time.Duration
+    giveUp      func(e Event, err error)
+    metrics     *Metrics
+    // workers bounds concurrent deliveries across all students
+    workers chan struct{}
+
+    ctx    context.Context
+    cancel context.CancelFunc
+    wg     sync.WaitGroup
+
+    mu sync.Mutex
+    // closed is set by Close under mu, so no drain starts once it waits
+    closed bool
+    // queues holds the pending events of students being drained; a key is
+    // present exactly while its goroutine runs
+    queues  map[aggregateKey][]Event
+    pending int
+}
+
+// EventDispatcherOptions tune retries; zero values take the defaults of 5
+// attempts, 1s initial backoff doubling up to 1m, and 8 workers
+type EventDispatcherOptions struct {
+    MaxAttempts int
+    Backoff     time.Duration
+    MaxBackoff  time.Duration
+    Workers     int
+    // GiveUp receives events that failed every attempt; nil only logs them
+    GiveUp func(e Event, err error)
+}
+
+// NewEventDispatcher creates a dispatcher; name labels its logs and metrics
+func NewEventDispatcher(name string, deliver EventDeliverer, opts EventDispatcherOptions, metrics *Metrics) *EventDispatcher {
+    if opts.MaxAttempts <= 0 {
+        opts.MaxAttempts = 5
+    }
+    if opts.Backoff <= 0 {
+        opts.Backoff = time.Second
+    }
+    if opts.MaxBackoff <= 0 {
+        opts.MaxBackoff = time.Minute
+    }
+    if opts.Workers <= 0 {
+        opts.Workers = 8
+    }
+    ctx, cancel := context.WithCancel(context.Background())
+    return &EventDispatcher{
+        name:        name,
+        deliver:     deliver,
+        maxAttempts: opts.MaxAttempts,
+        backoff:     opts.Backoff,
+        maxBackoff:  opts.MaxBackoff,
+        giveUp:      opts.GiveUp,
+        metrics:     metrics,
+        workers:     make(chan struct{}, opts.Workers),
+        ctx:         ctx,
+        cancel:      cancel,
+        queues:      make(map[aggregateKey][]Event),
+    }
+}
+
+// Attach feeds the dispatcher every event published on bus that matches
+// filter. It hooks the bus rather than subscribing, so no event is dropped
+// and each store's events arrive in the order they were published.
+func (d *EventDispatcher) Attach(bus *EventBus, filter EventFilter) {
+    bus.Hook(func(e Event) {
+        if filter.Match(e) {
+            d.Enqueue(e)
+        }
+    })
+}
+
+// Enqueue queues an event behind the student's pending events without
+// blocking. Events enqueued after Close are discarded.
+func (d *EventDispatcher) Enqueue(e Event) {
+    key := eventAggregate(e)
+    d.mu.Lock()
+    if d.closed {
+        d.mu.Unlock()
+        return
+    }
+    queue, draining := d.queues[key]
+    d.queues[key] = append(queue, e)
+    d.pending++
+    d.metrics.Set("event_dispatch_pending", float64(d.pending), "dispatcher", d.name)
+    if !draining {
+        d.wg.Add(1)
+        go d.drain(key)
+    }
+    d.mu.Unlock()
+}
+
+// Pending returns how many events wait for delivery
+func (d *EventDispatcher) Pending() int {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    return d.pending
+}
+
+// drain delivers a student's events one at a time until its queue is empty
+func (d *EventDispatcher) drain(key aggregateKey) {
+    defer d.wg.Done()
+    for {
+        d.mu.Lock()
+        queue := d.queues[key]
+        if len(queue) == 0 || d.ctx.Err() != nil {
+            d.pending -= len(queue)
+            delete(d.queues, key)
+            d.metrics.Set("event_dispatch_pending", float64(d.pending), "dispatcher", d.name)
+            d.mu.Unlock()
+            return
+        }
+        e := queue[0]
+        d.mu.Unlock()
+
+        d.deliverWithRetry(e)
+
+        d.mu.Lock()
+        d.queues[key] = d.queues[key][1:]
+        d.pending--
+        d.metrics.Set("event_dispatch_pending", float64(d.pending), "dispatcher", d.name)
+        d.mu.Unlock()
+    }
+}
+
+// deliverWithRetry tries an event until it is delivered, attempts run out
+// or the dispatcher closes
+func (d *EventDispatcher) deliverWithRetry(e Event) {
+    backoff := d.backoff
+    var err error
+    for attempt := 1; attempt <= d.maxAttempts; attempt++ {
+        select {
+        case d.workers <- struct{}{}:
+        case <-d.ctx.Done():
+            return
+        }
+        err = d.deliver(d.ctx, e)
+        <-d.workers
+        if err == nil {
+            d.metrics.Inc("event_deliveries_total", "dispatcher", d.name, "outcome", "delivered")
+            return
+        }
+        if d.ctx.Err() != nil {
+            return
+        }
+        slog.Warn("event delivery failed", "dispatcher", d.name, "tenant", e.Tenant, "student_id", e.StudentID,
+            "version", e.Version, "attempt", attempt, "error", err)
+        if attempt == d.maxAttempts {
+            break
+        }
+        d.metrics.Inc("event_deliveries_total", "dispatcher", d.name, "outcome", "retried")
+        select {
+        case <-time.After(backoff):
+        case <-d.ctx.Done():
+            return
+        }
+        if backoff *= 2; backoff > d.maxBackoff {
+            backoff = d.maxBackoff
+        }
+    }
+
+    d.metrics.Inc("event_deliveries_total", "dispatcher", d.name, "outcome", "failed")
+    slog.Error("event delivery gave up", "dispatcher", d.name, "tenant", e.Tenant, "student_id", e.StudentID,
+        "version", e.Version, "attempts", d.maxAttempts, "error", err)
+    if d.giveUp != nil {
+        d.giveUp(e, err)
+    }
+}
+
+// Close stops delivery, abandoning pending events, and waits for in-flight
+// deliveries to return
+func (d *EventDispatcher) Close() {
+    d.mu.Lock()
+    d.closed = true
+    d.mu.Unlock()
+    d.cancel()
+    d.wg.Wait()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "sync"
+    "testing"
+    "time"
+)
+
+// recordingDeliverer logs delivered events, failing the first attempts of
+// every event
+type recordingDeliverer struct {
+    mu        sync.Mutex
+    delivered []Event
+    attempts  map[aggregateKey]map[int]int
+    fails     int
+    done      chan struct{}
+}
+
+func newRecordingDeliverer(fails, expect int) *recordingDeliverer {
+    return &recordingDeliverer{attempts: make(map[aggregateKey]map[int]int), fails: fails, done: make(chan struct{}, expect)}
+}
+
+func (r *recordingDeliverer) deliver(ctx context.Context, e Event) error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    key := eventAggregate(e)
+    if r.attempts[key] == nil {
+        r.attempts[key] = make(map[int]int)
+    }
+    r.attempts[key][e.Version]++
+    if r.attempts[key][e.Version] <= r.fails {
+        return errors.New("receiver unavailable")
+    }
+    r.delivered = append(r.delivered, e)
+    r.done <- struct{}{}
+    return nil
+}
+
+func (r *recordingDeliverer) wait(t *testing.T, n int) {
+    t.Helper()
+    for i := 0; i < n; i++ {
+        select {
+        case <-r.done:
+        case <-time.After(5 * time.Second):
+            t.Fatalf("%d of %d events delivered", i, n)
+        }
+    }
+}
+
+// TestEventDispatcherKeepsStudentOrder retries every event and checks that
+// each student's versions still arrive in order
+func TestEventDispatcherKeepsStudentOrder(t *testing.T) {
+    const students, versions = 4, 5
+    r := newRecordingDeliverer(2, students*versions)
+    d := NewEventDispatcher("test", r.deliver, EventDispatcherOptions{Backoff: time.Millisecond, Workers: 2}, NewMetrics())
+    t.Cleanup(d.Close)
+    for v := 1; v <= versions; v++ {
+        for id := 1; id <= students; id++ {
+            d.Enqueue(Event{Tenant: "acme", StudentID: id, Version: v})
+        }
+    }
+    r.wait(t, students*versions)
+
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    last := make(map[int]int)
+    for _, e := range r.delivered {
+        if e.Version != last[e.StudentID]+1 {
+            t.Fatalf("student %d got version %d after %d", e.StudentID, e.Version, last[e.StudentID])
+        }
+        last[e.StudentID] = e.Version
+    }
+    for key, tries := range r.attempts {
+        for version, n := range tries {
+            if n != 3 {
+                t.Errorf("student %d version %d took %d attempts, want 3", key.studentID, version, n)
+            }
+        }
+    }
+    if pending := d.Pending(); pending != 0 {
+        t.Errorf("Pending = %d after every event was delivered", pending)
+    }
+}
+
+// TestEventDispatcherGivesUp checks that an event failing every attempt is
+// handed to GiveUp and the student's next event is still delivered
+func TestEventDispatcherGivesUp(t *testing.T) {
+    failing := errors.New("receiver unavailable")
+    var mu sync.Mutex
+    attempts := 0
+    delivered := make(chan Event, 1)
+    deliver := func(ctx context.Context, e Event) error {
+        if e.Version == 1 {
+            mu.Lock()
+            attempts++
+            mu.Unlock()
+            return failing
+        }
+        delivered <- e
+        return nil
+    }
+    gaveUp := make(chan error, 1)
+    d := NewEventDispatcher("test", deliver, EventDispatcherOptions{
+        MaxAttempts: 3,
+        Backoff:     time.Millisecond,
+        GiveUp: func(e Event, err error) {
+            if e.Version != 1 {
+                t.Errorf("gave up on version %d", e.Version)
+            }
+            gaveUp <- err
+        },
+    }, NewMetrics())
+    t.Cleanup(d.Close)
+    d.Enqueue(Event{StudentID: 1, Version: 1})
+    d.Enqueue(Event{StudentID: 1, Version: 2})
+
+    select {
+    case err := <-gaveUp:
+        if !errors.Is(err, failing) {
+            t.Errorf("GiveUp got %v, want the delivery error", err)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("GiveUp was not called")
+    }
+    select {
+    case e := <-delivered:
+        if e.Version != 2 {
+            t.Errorf("delivered version %d, want 2", e.Version)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("the event after the dead one was not delivered")
+    }
+    mu.Lock()
+    defer mu.Unlock()
+    if attempts != 3 {
+        t.Errorf("version 1 took %d attempts, want 3", attempts)
+    }
+}
+
+// TestEventDispatcherEnqueueDuringClose races Enqueue against Close, which
+// must neither panic nor leave events pending
+func TestEventDispatcherEnqueueDuringClose(t *testing.T) {
+    for i := 0; i < 100; i++ {
+        d := NewEventDispatcher("test", func(ctx context.Context, e Event) error { return nil }, EventDispatcherOptions{}, NewMetrics())
+        var wg sync.WaitGroup
+        for id := 1; id <= 4; id++ {
+            wg.Add(1)
+            go func(id int) {
+                defer wg.Done()
+                for v := 1; v <= 10; v++ {
+                    d.Enqueue(Event{StudentID: id, Version: v})
+                }
+            }(id)
+        }
+        d.Close()
+        wg.Wait()
+        d.Enqueue(Event{StudentID: 5, Version: 1})
+        if pending := d.Pending(); pending != 0 {
+            t.Fatalf("Pending = %d after Close", pending)
+        }
+    }
+}
@@ -0,0 +1,594 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log/slog"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "github.com/nats-io/nats.go"
+    "github.com/segmentio/kafka-go"
+)
+
+// Event brokers, as EVENT_BROKER sets them
+const (
+    BrokerKafka = "kafka"
+    // BrokerNATS publishes with core NATS, acknowledged by the server only
+    BrokerNATS = "nats"
+    // BrokerJetStream publishes to a JetStream stream, which must cover the
+    // subjects, acknowledged once stored
+    BrokerJetStream = "jetstream"
+)
+
+// brokerEventSchema names the version of the BrokerEvent format
+const brokerEventSchema = "student-api.event.v1"
+
+// BrokerEvent is the JSON message published for each change: the Event
+// with the schema version and the outbox ID. Delivery is at least once, so
+// consumers discard an ID they have seen; they apply a student's events in
+// Version order as on GET /events.
+//
+// On Kafka messages go to EVENT_TOPIC keyed by tenant and student ID, so a
+// student's events share a partition, with schema, type and id headers. On
+// NATS the subject is EVENT_TOPIC, the tenant ("_" for the default one) and
+// the event type, e.g. student-events._.student.updated, and the
+// Nats-Msg-Id header holds the ID for JetStream's duplicate window.
+type BrokerEvent struct {
+    Schema string `json:"schema"`
+    ID     int64  `json:"id"`
+    Event
+}
+
+// OutboxEntry is a change event waiting in the outbox to be published
+type OutboxEntry struct {
+    ID    int64
+    Event Event
+}
+
+func (o OutboxEntry) message() ([]byte, error) {
+    return json.Marshal(BrokerEvent{Schema: brokerEventSchema, ID: o.ID, Event: o.Event})
+}
+
+// OutboxRepository persists events until they are published
+type OutboxRepository interface {
+    Add(e Event, at time.Time) error
+    // Pending returns up to limit unpublished entries, oldest first
+    Pending(limit int) ([]OutboxEntry, error)
+    MarkPublished(ids []int64, at time.Time) error
+    // Backlog counts the unpublished entries
+    Backlog() (int, error)
+    // Prune deletes entries published before the given time
+    Prune(before time.Time) (int, error)
+}
+
+// MemoryOutboxRepository keeps the outbox in memory, for
+// STORE_BACKEND=memory; it survives broker outages but not restarts
+type MemoryOutboxRepository struct {
+    sync.RWMutex
+    entries   map[int64]OutboxEntry
+    published map[int64]time.Time
+    nextID    int64
+}
+
+// NewMemoryOutboxRepository initializes a new MemoryOutboxRepository
+func NewMemoryOutboxRepository() *MemoryOutboxRepository {
+    return &MemoryOutboxRepository{entries: make(map[int64]OutboxEntry), published: make(map[int64]time.Time), nextID: 1}
+}
+
+func (m *MemoryOutboxRepository) Add(e Event, at time.Time) error {
+    m.Lock()
+    defer m.Unlock()
+    m.entries[m.nextID] = OutboxEntry{ID: m.nextID, Event: e}
+    m.nextID++
+    return nil
+}
+
+func (m *MemoryOutboxRepository) Pending(limit int) ([]OutboxEntry, error) {
+    m.RLock()
+    pending := []OutboxEntry{}
+    for id, entry := range m.entries {
+        if _, done := m.published[id]; !done {
+            pending = append(pending, entry)
+        }
+    }
+    m.RUnlock()
+    sort.Slice(pending, func(i, j int) bool { return pending[i].ID < pending[j].ID })
+    if len(pending) > limit {
+        pending = pending[:limit]
+    }
+    return pending, nil
+}
+
+func (m *MemoryOutboxRepository) MarkPublished(ids []int64, at time.Time) error {
+    m.Lock()
+    defer m.Unlock()
+    for _, id := range ids {
+        if _, exists := m.entries[id]; exists {
+            m.published[id] = at
+        }
+    }
+    return nil
+}
+
+func (m *MemoryOutboxRepository) Backlog() (int, error) {
+    m.RLock()
+    defer m.RUnlock()
+    return len(m.entries) - len(m.published), nil
+}
+
+func (m *MemoryOutboxRepository) Prune(before time.Time) (int, error) {
+    m.Lock()
+    defer m.Unlock()
+    pruned := 0
+    for id, at := range m.published {
+        if at.Before(before) {
+            delete(m.entries, id)
+            delete(m.published, id)
+            pruned++
+        }
+    }
+    return pruned, nil
+}
+
+// OutboxStudentRepository is implemented by student repositories whose
+// database holds the event_outbox table. Its entries are written in the
+// transaction of the change they announce, so neither is saved without the
+// other.
+type OutboxStudentRepository interface {
+    Outbox() OutboxRepository
+}
+
+// outboxOf returns the outbox a repository keeps, or nil
+func outboxOf(repo StudentRepository) OutboxRepository {
+    if o, ok := repo.(OutboxStudentRepository); ok {
+        return o.Outbox()
+    }
+    return nil
+}
+
+// SQLOutboxRepository keeps the outbox in the event_outbox table, on a
+// database or open transaction
+type SQLOutboxRepository struct {
+    conn   sqlConn
+    rebind func(string) string
+}
+
+// NewSQLOutboxRepository creates a repository; rebind may be nil
+func NewSQLOutboxRepository(conn sqlConn, rebind func(string) string) *SQLOutboxRepository {
+    if rebind == nil {
+        rebind = func(q string) string { return q }
+    }
+    return &SQLOutboxRepository{conn: conn, rebind: rebind}
+}
+
+func (s *SQLOutboxRepository) Add(e Event, at time.Time) error {
+    payload, err := json.Marshal(e)
+    if err != nil {
+        return err
+    }
+    _, err = s.conn.Exec(s.rebind(`INSERT INTO event_outbox (tenant, payload, created_at) VALUES (?, ?, ?)`),
+        e.Tenant, string(payload), at.UTC().Format(sortableTimeLayout))
+    return err
+}
+
+func (s *SQLOutboxRepository) Pending(limit int) ([]OutboxEntry, error) {
+    rows, err := s.conn.Query(s.rebind(`SELECT id, payload FROM event_outbox WHERE published_at IS NULL ORDER BY id LIMIT ?`), limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    pending := []OutboxEntry{}
+    for rows.Next() {
+        var entry OutboxEntry
+        var payload string
+        if err := rows.Scan(&entry.ID, &payload); err != nil {
+            return nil, err
+        }
+        if err := json.Unmarshal([]byte(payload), &entry.Event); err != nil {
+            return nil, fmt.Errorf("outbox entry %d: %v", entry.ID, err)
+        }
+        pending = append(pending, entry)
+    }
+    return pending, rows.Err()
+}
+
+func (s *SQLOutboxRepository) MarkPublished(ids []int64, at time.Time) error {
+    if len(ids) == 0 {
+        return nil
+    }
+    // IDs are marked one by one: an entry another instance inserted
+    // meanwhile may have a lower ID and still be unpublished
+    placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+    args := []interface{}{at.UTC().Format(sortableTimeLayout)}
+    for _, id := range ids {
+        args = append(args, id)
+    }
+    _, err := s.conn.Exec(s.rebind(`UPDATE event_outbox SET published_at = ? WHERE id IN (`+placeholders+`)`), args...)
+    return err
+}
+
+func (s *SQLOutboxRepository) Backlog() (int, error) {
+    var n int
+    err := s.conn.QueryRow(`SELECT COUNT(*) FROM event_outbox WHERE published_at IS NULL`).Scan(&n)
+    return n, err
+}
+
+func (s *SQLOutboxRepository) Prune(before time.Time) (int, error) {
+    result, err := s.conn.Exec(s.rebind(`DELETE FROM event_outbox WHERE published_at IS NOT NULL AND published_at < ?`), before.UTC().Format(sortableTimeLayout))
+    if err != nil {
+        return 0, err
+    }
+    n, err := result.RowsAffected()
+    return int(n), err
+}
+
+// EventPublisher sends outbox entries to a broker, returning once the
+// broker has acknowledged all of them
+type EventPublisher interface {
+    Publish(ctx context.Context, entries []OutboxEntry) error
+    Close() error
+}
+
+// KafkaPublisher publishes to a Kafka topic
+type KafkaPublisher struct {
+    writer *kafka.Writer
+}
+
+// NewKafkaPublisher writes to topic on the comma-separated brokers,
+// waiting for every in-sync replica
+func NewKafkaPublisher(brokers, topic string, timeout time.Duration) *KafkaPublisher {
+    return &KafkaPublisher{writer: &kafka.Writer{
+        Addr:                   kafka.TCP(strings.Split(brokers, ",")...),
+        Topic:                  topic,
+        Balancer:               &kafka.Hash{},
+        RequiredAcks:           kafka.RequireAll,
+        BatchTimeout:           10 * time.Millisecond,
+        WriteTimeout:           timeout,
+        AllowAutoTopicCreation: true,
+    }}
+}
+
+func (p *KafkaPublisher) Publish(ctx context.Context, entries []OutboxEntry) error {
+    messages := make([]kafka.Message, 0, len(entries))
+    for _, entry := range entries {
+        value, err := entry.message()
+        if err != nil {
+            return err
+        }
+        messages = append(messages, kafka.Message{
+            Key:   []byte(fmt.Sprintf("%s/%d", entry.Event.Tenant, entry.Event.StudentID)),
+            Value: value,
+            Headers: []kafka.Header{
+                {Key: "schema", Value: []byte(brokerEventSchema)},
+                {Key: "type", Value: []byte(entry.Event.Type)},
+                {Key: "id", Value: []byte(strconv.FormatInt(entry.ID, 10))},
+            },
+        })
+    }
+    return p.writer.WriteMessages(ctx, messages...)
+}
+
+func (p *KafkaPublisher) Close() error {
+    return p.writer.Close()
+}
+
+// NATSPublisher publishes to NATS subjects under a prefix
+type NATSPublisher struct {
+    conn   *nats.Conn
+    js     nats.JetStreamContext
+    prefix string
+}
+
+// NewNATSPublisher connects to url; with jetstream set, each message waits
+// for the stream's acknowledgement
+func NewNATSPublisher(url, prefix string, jetstream bool, timeout time.Duration) (*NATSPublisher, error) {
+    conn, err := nats.Connect(url, nats.Name("student-api"), nats.Timeout(timeout), nats.MaxReconnects(-1))
+    if err != nil {
+        return nil, err
+    }
+    p := &NATSPublisher{conn: conn, prefix: prefix}
+    if jetstream {
+        if p.js, err = conn.JetStream(nats.MaxWait(timeout)); err != nil {
+            conn.Close()
+            return nil, err
+        }
+    }
+    return p, nil
+}
+
+// subject returns the subject of an event, e.g. student-events._.student.created
+func (p *NATSPublisher) subject(e Event) string {
+    tenant := e.Tenant
+    if tenant == "" {
+        tenant = "_"
+    }
+    return p.prefix + "." + tenant + "." + e.Type
+}
+
+func (p *NATSPublisher) Publish(ctx context.Context, entries []OutboxEntry) error {
+    for _, entry := range entries {
+        data, err := entry.message()
+        if err != nil {
+            return err
+        }
+        msg := nats.NewMsg(p.subject(entry.Event))
+        msg.Data = data
+        msg.Header.Set(nats.MsgIdHdr, strconv.FormatInt(entry.ID, 10))
+        msg.Header.Set("Event-Schema", brokerEventSchema)
+        if p.js != nil {
+            if _, err := p.js.PublishMsg(msg, nats.Context(ctx)); err != nil {
+                return err
+            }
+        } else if err := p.conn.PublishMsg(msg); err != nil {
+            return err
+        }
+    }
+    if p.js != nil {
+        return nil
+    }
+    // Core NATS has no acknowledgements; a flush at least confirms the
+    // server received everything
+    return p.conn.FlushWithContext(ctx)
+}
+
+func (p *NATSPublisher) Close() error {
+    p.conn.Close()
+    return nil
+}
+
+// EventOutbox publishes change events to Kafka or NATS. Every instance
+// writes the events of its own changes to the outbox along with them; the
+// leader relays the outbox to the broker in
+// order and marks what was acknowledged, so events wait out broker outages
+// and leader changes instead of being lost.
+type EventOutbox struct {
+    repo      OutboxRepository
+    broker    string
+    url       string
+    topic     string
+    batch     int
+    interval  time.Duration
+    timeout   time.Duration
+    retention time.Duration
+    alerts    *Alerter
+    metrics   *Metrics
+    // wake has the relay check the outbox after a local write
+    wake    chan struct{}
+    connect func() (EventPublisher, error)
+}
+
+// LoadEventOutbox reads EVENT_BROKER (kafka, nats or jetstream; unset
+// disables publishing, and nil is returned), EVENT_BROKER_URL (the Kafka
+// brokers, comma-separated, or the NATS URL), EVENT_TOPIC (default
+// student-events), EVENT_OUTBOX_BATCH (default 100), EVENT_OUTBOX_INTERVAL
+// (default 1s), how often the outbox is checked for other instances'
+// events, EVENT_BROKER_TIMEOUT (default 10s) and EVENT_OUTBOX_RETENTION
+// (default 24h), how long published events are kept
+func LoadEventOutbox(repo OutboxRepository, alerts *Alerter, metrics *Metrics) (*EventOutbox, error) {
+    broker := getEnv("EVENT_BROKER", "")
+    if broker == "" {
+        return nil, nil
+    }
+    o := &EventOutbox{
+        repo:      repo,
+        broker:    broker,
+        url:       getEnv("EVENT_BROKER_URL", ""),
+        topic:     getEnv("EVENT_TOPIC", "student-events"),
+        batch:     getEnvInt("EVENT_OUTBOX_BATCH", 100),
+        interval:  getEnvDuration("EVENT_OUTBOX_INTERVAL", time.Second),
+        timeout:   getEnvDuration("EVENT_BROKER_TIMEOUT", 10*time.Second),
+        retention: getEnvDuration("EVENT_OUTBOX_RETENTION", 24*time.Hour),
+        alerts:    alerts,
+        metrics:   metrics,
+        wake:      make(chan struct{}, 1),
+    }
+    switch broker {
+    case BrokerKafka:
+        if o.url == "" {
+            o.url = "localhost:9092"
+        }
+        o.connect = func() (EventPublisher, error) { return NewKafkaPublisher(o.url, o.topic, o.timeout), nil }
+    case BrokerNATS, BrokerJetStream:
+        if o.url == "" {
+            o.url = nats.DefaultURL
+        }
+        o.connect = func() (EventPublisher, error) {
+            p, err := NewNATSPublisher(o.url, o.topic, broker == BrokerJetStream, o.timeout)
+            if err != nil {
+                return nil, err
+            }
+            return p, nil
+        }
+    default:
+        return nil, fmt.Errorf("EVENT_BROKER must be %s, %s or %s, got %q", BrokerKafka, BrokerNATS, BrokerJetStream, broker)
+    }
+    if o.topic == "" || strings.ContainsAny(o.topic, " \t*>") {
+        return nil, fmt.Errorf("EVENT_TOPIC must be a topic or subject name, got %q", o.topic)
+    }
+    if o.batch < 1 {
+        return nil, fmt.Errorf("EVENT_OUTBOX_BATCH must be positive, got %d", o.batch)
+    }
+    for _, setting := range []struct {
+        name  string
+        value time.Duration
+    }{
+        {"EVENT_OUTBOX_INTERVAL", o.interval},
+        {"EVENT_BROKER_TIMEOUT", o.timeout},
+        {"EVENT_OUTBOX_RETENTION", o.retention},
+    } {
+        if setting.value <= 0 {
+            return nil, fmt.Errorf("%s must be positive, got %s", setting.name, setting.value)
+        }
+    }
+    return o, nil
+}
+
+// Attach has store write the event of every change it records to the
+// outbox. A repository keeping the outbox on its own database writes the
+// event in the change's transaction, rolling the change back when it fails.
+// Other repositories write it once the change is saved, and a change whose
+// event fails to be written is logged and counted but not undone.
+func (o *EventOutbox) Attach(store *StudentStore) {
+    store.Lock()
+    defer store.Unlock()
+    store.outbox, store.outboxInRepo = o, outboxOf(store.repo) != nil
+}
+
+// AttachTenants attaches the outbox to each tenant store as it is opened.
+// Tenant databases are not the outbox's, so their events are written once
+// their changes are saved.
+func (o *EventOutbox) AttachTenants(tenants *TenantStores) {
+    tenants.mu.Lock()
+    defer tenants.mu.Unlock()
+    tenants.outbox = o
+    for _, entry := range tenants.entries {
+        entry.store.Lock()
+        entry.store.outbox = o
+        entry.store.Unlock()
+    }
+}
+
+// addSaved writes the event of a change already saved
+func (o *EventOutbox) addSaved(e Event) {
+    if err := o.repo.Add(e, time.Now().UTC()); err != nil {
+        o.metrics.Inc("event_outbox_errors_total", "op", "add")
+        slog.Error("writing event to the outbox failed", "tenant", e.Tenant, "student_id", e.StudentID, "seq", e.Seq, "error", err)
+    }
+}
+
+// wakeRelay has the relay check the outbox for a local write
+func (o *EventOutbox) wakeRelay() {
+    select {
+    case o.wake <- struct{}{}:
+    default:
+    }
+}
+
+// Describe names the broker and topic, for logs and the doctor
+func (o *EventOutbox) Describe() string {
+    return o.broker + " " + o.url + " " + o.topic
+}
+
+// Relay runs on the leader until ctx ends, publishing the outbox in order.
+// A failed batch is retried from its first event, backing off up to a
+// minute, so events are published at least once and in outbox order.
+func (o *EventOutbox) Relay(ctx context.Context) {
+    var publisher EventPublisher
+    defer func() {
+        if publisher != nil {
+            publisher.Close()
+        }
+    }()
+    ticker := time.NewTicker(o.interval)
+    defer ticker.Stop()
+    lastPrune := time.Now()
+    var failingSince time.Time
+    backoff := o.interval
+
+    for {
+        published, err := o.relayBatch(ctx, &publisher)
+        switch {
+        case ctx.Err() != nil:
+            return
+        case err != nil:
+            o.metrics.Inc("event_outbox_errors_total", "op", "publish")
+            slog.Warn("publishing outbox events failed", "broker", o.broker, "error", err, "retry_in", backoff)
+            if failingSince.IsZero() {
+                failingSince = time.Now()
+            }
+            if time.Since(failingSince) >= time.Minute {
+                o.raiseBrokerDown(failingSince, err)
+            }
+            if publisher != nil {
+                publisher.Close()
+                publisher = nil
+            }
+            select {
+            case <-ctx.Done():
+                return
+            case <-time.After(backoff):
+            }
+            if backoff *= 2; backoff > time.Minute {
+                backoff = time.Minute
+            }
+            continue
+        }
+        if !failingSince.IsZero() {
+            slog.Info("publishing outbox events recovered", "broker", o.broker, "failing_for", time.Since(failingSince).Round(time.Second))
+            failingSince, backoff = time.Time{}, o.interval
+        }
+        if published == o.batch {
+            // More may be waiting
+            continue
+        }
+        if time.Since(lastPrune) >= time.Hour {
+            lastPrune = time.Now()
+            if pruned, err := o.repo.Prune(time.Now().UTC().Add(-o.retention)); err != nil {
+                slog.Error("pruning the event outbox failed", "error", err)
+            } else if pruned > 0 {
+                slog.Info("pruned published outbox events", "events", pruned)
+            }
+        }
+        select {
+        case <-ctx.Done():
+            return
+        case <-o.wake:
+        case <-ticker.C:
+        }
+    }
+}
+
+// relayBatch publishes the oldest pending events and returns how many
+func (o *EventOutbox) relayBatch(ctx context.Context, publisher *EventPublisher) (int, error) {
+    entries, err := o.repo.Pending(o.batch)
+    if err != nil {
+        return 0, fmt.Errorf("reading the outbox: %w", err)
+    }
+    if backlog, err := o.repo.Backlog(); err == nil {
+        o.metrics.Set("event_outbox_pending", float64(backlog))
+    }
+    if len(entries) == 0 {
+        return 0, nil
+    }
+    if *publisher == nil {
+        if *publisher, err = o.connect(); err != nil {
+            return 0, fmt.Errorf("connecting to %s: %w", o.broker, err)
+        }
+    }
+    publishCtx, cancel := context.WithTimeout(ctx, o.timeout)
+    defer cancel()
+    if err := (*publisher).Publish(publishCtx, entries); err != nil {
+        return 0, err
+    }
+    ids := make([]int64, len(entries))
+    for i, entry := range entries {
+        ids[i] = entry.ID
+    }
+    // Failing here publishes the batch again, which consumers discard by ID
+    if err := o.repo.MarkPublished(ids, time.Now().UTC()); err != nil {
+        return 0, fmt.Errorf("marking events published: %w", err)
+    }
+    o.metrics.Add("event_outbox_published_total", float64(len(entries)))
+    return len(entries), nil
+}
+
+// raiseBrokerDown alerts operators that events are piling up in the outbox
+func (o *EventOutbox) raiseBrokerDown(since time.Time, err error) {
+    backlog, _ := o.repo.Backlog()
+    o.alerts.Raise(Alert{
+        Kind:     "event_broker_down",
+        Severity: AlertCritical,
+        Summary:  fmt.Sprintf("Publishing events to %s has failed since %s; %d events wait in the outbox", o.broker, since.UTC().Format(time.RFC3339), backlog),
+        Fields: map[string]string{
+            "broker":  o.broker,
+            "topic":   o.topic,
+            "backlog": strconv.Itoa(backlog),
+            "error":   err.Error(),
+        },
+        Key: "event_broker_down",
+    })
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "net"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/gorilla/websocket"
+    "student-api/reqctx"
+)
+
+// Messages of the /ws protocol besides the change events, which are sent
+// as they are, with their student.* type
+const (
+    wsSubscribe  = "subscribe"
+    wsSubscribed = "subscribed"
+    wsPing       = "ping"
+    wsPong       = "pong"
+    wsLagged     = "lagged"
+    wsError      = "error"
+)
+
+// EventSockets serves the change events of the EventBus over WebSocket at
+// GET /ws, for clients that talk back: they change their subscription and
+// ping on the open connection. Like EventStreams, each connection has its
+// own buffer, so a client reading too slowly misses events rather than
+// slowing writes; it is told how many with a lagged message and can
+// resubscribe from the last Seq it saw.
+type EventSockets struct {
+    upgrader     websocket.Upgrader
+    pingInterval time.Duration
+    pongTimeout  time.Duration
+    writeTimeout time.Duration
+    buffer       int
+    max          int
+    active       atomic.Int64
+    // done is closed on shutdown; Server.Shutdown does not wait for
+    // hijacked connections, so they are closed here and waited for by conns
+    done      chan struct{}
+    closeOnce sync.Once
+    conns     sync.WaitGroup
+}
+
+// LoadEventSockets reads WS_PING_INTERVAL (default 30s), how often the
+// server pings, WS_PONG_TIMEOUT (default 60s), how long a client may stay
+// silent, WS_WRITE_TIMEOUT (default 10s), WS_BUFFER (default 64), the events
+// queued per connection, WS_MAX_CONNECTIONS (default 100) and
+// WS_ALLOWED_ORIGINS, the browser origins allowed besides the API's own, or
+// "*" for any
+func LoadEventSockets() (*EventSockets, error) {
+    s := &EventSockets{
+        pingInterval: getEnvDuration("WS_PING_INTERVAL", 30*time.Second),
+        pongTimeout:  getEnvDuration("WS_PONG_TIMEOUT", 60*time.Second),
+        writeTimeout: getEnvDuration("WS_WRITE_TIMEOUT", 10*time.Second),
+        buffer:       getEnvInt("WS_BUFFER", 64),
+        max:          getEnvInt("WS_MAX_CONNECTIONS", 100),
+        done:         make(chan struct{}),
+    }
+    if s.pingInterval <= 0 || s.writeTimeout <= 0 {
+        return nil, fmt.Errorf("WS_PING_INTERVAL and WS_WRITE_TIMEOUT must be positive")
+    }
+    if s.pongTimeout <= s.pingInterval {
+        return nil, fmt.Errorf("WS_PONG_TIMEOUT (%s) must be longer than WS_PING_INTERVAL (%s)", s.pongTimeout, s.pingInterval)
+    }
+    if s.buffer < 1 {
+        return nil, fmt.Errorf("WS_BUFFER must be positive, got %d", s.buffer)
+    }
+    if s.max < 1 {
+        return nil, fmt.Errorf("WS_MAX_CONNECTIONS must be positive, got %d", s.max)
+    }
+    origins := getEnvList("WS_ALLOWED_ORIGINS")
+    for _, origin := range origins {
+        if origin == "*" {
+            s.upgrader.CheckOrigin = func(*http.Request) bool { return true }
+            origins = nil
+            break
+        }
+        if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" {
+            return nil, fmt.Errorf("WS_ALLOWED_ORIGINS: %q is not an origin such as https://app.example.com", origin)
+        }
+    }
+    if len(origins) > 0 {
+        s.upgrader.CheckOrigin = func(r *http.Request) bool {
+            origin := r.Header.Get("Origin")
+            if origin == "" || containsString(origins, origin) {
+                return true
+            }
+            u, err := url.Parse(origin)
+            return err == nil && strings.EqualFold(u.Host, r.Host)
+        }
+    }
+    s.upgrader.Error = func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+        httpError(w, r, reason.Error(), status)
+    }
+    return s, nil
+}
+
+// Close ends every open connection; clients reconnect to another instance
+func (s *EventSockets) Close() {
+    s.closeOnce.Do(func() { close(s.done) })
+}
+
+// Wait returns once every connection has been closed
+func (s *EventSockets) Wait() {
+    s.conns.Wait()
+}
+
+// wsRequest is a message from a /ws client. A subscribe replaces the
+// connection's subscription; with Since it first replays the changes after
+// that Seq.
+type wsRequest struct {
+    Type   string   `json:"type"`
+    IDs    []int    `json:"ids,omitempty"`
+    Types  []string `json:"types,omitempty"`
+    Fields []string `json:"fields,omitempty"`
+    Since  *int     `json:"since,omitempty"`
+}
+
+// wsMessage is a control message to a /ws client
+type wsMessage struct {
+    Type    string       `json:"type"`
+    Filter  *EventFilter `json:"filter,omitempty"`
+    Missed  int64        `json:"missed,omitempty"`
+    Seq     int          `json:"seq,omitempty"`
+    Message string       `json:"message,omitempty"`
+}
+
+// parseSocketFilter validates a subscription
+func parseSocketFilter(req wsRequest) (EventFilter, error) {
+    filter, err := ParseEventFilter(strings.Join(req.Types, ","), strings.Join(req.Fields, ","))
+    if err != nil {
+        return EventFilter{}, err
+    }
+    for _, id := range req.IDs {
+        if id < 1 {
+            return EventFilter{}, fmt.Errorf("invalid student ID %d", id)
+        }
+    }
+    filter.IDs = req.IDs
+    return filter, nil
+}
+
+// hijackWriter lets the upgrader hijack a connection through the
+// middleware's response writers, which only expose it through Unwrap
+type hijackWriter struct {
+    http.ResponseWriter
+}
+
+func (w hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+    return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// ServeEventSocket upgrades GET /ws?ids=1,2&types=student.updated&fields=email
+// to a WebSocket carrying the changes to the students. Clients send
+// {"type": "subscribe", "ids": [...], "types": [...], "fields": [...],
+// "since": 42} to change what they receive and {"type": "ping"} to be
+// answered with a pong; the server pings every WS_PING_INTERVAL and drops
+// clients that stop answering.
+func (app *App) ServeEventSocket(w http.ResponseWriter, r *http.Request) {
+    query := r.URL.Query()
+    var ids []int
+    for _, value := range strings.Split(query.Get("ids"), ",") {
+        if value = strings.TrimSpace(value); value == "" {
+            continue
+        }
+        id, err := strconv.Atoi(value)
+        if err != nil || id < 1 {
+            writeValidationErrors(w, r, []ValidationError{{Field: "ids", Code: CodeInvalidFilter, Message: fmt.Sprintf("Invalid student ID %q", value)}})
+            return
+        }
+        ids = append(ids, id)
+    }
+    filter, err := ParseEventFilter(query.Get("types"), query.Get("fields"))
+    if err != nil {
+        writeValidationErrors(w, r, []ValidationError{{Field: "types", Code: CodeInvalidFilter, Message: err.Error()}})
+        return
+    }
+    filter.IDs = ids
+
+    conn, closeConn := app.sockets.open(app, w, r, nil)
+    if conn == nil {
+        return
+    }
+    defer closeConn()
+    socket := &eventSocket{app: app, r: r, conn: conn, store: app.storeFor(r), sockets: app.sockets, quit: make(chan struct{})}
+    socket.serve(filter)
+}
+
+// open upgrades a request to a WebSocket counted against WS_MAX_CONNECTIONS,
+// returning a nil conn when it has answered the request itself. The
+// returned function closes the connection and frees its place.
+func (s *EventSockets) open(app *App, w http.ResponseWriter, r *http.Request, header http.Header) (*websocket.Conn, func()) {
+    if int(s.active.Add(1)) > s.max {
+        s.active.Add(-1)
+        httpError(w, r, "Too many WebSocket connections, try again later", http.StatusServiceUnavailable)
+        return nil, nil
+    }
+    app.metrics.Set("event_sockets_active", float64(s.active.Load()))
+    release := func() {
+        app.metrics.Set("event_sockets_active", float64(s.active.Add(-1)))
+    }
+
+    conn, err := s.upgrader.Upgrade(hijackWriter{w}, r, header)
+    if err != nil {
+        // The upgrader has answered already
+        reqctx.Logger(r.Context()).Warn("WebSocket upgrade failed", "error", err)
+        release()
+        return nil, nil
+    }
+    s.conns.Add(1)
+    return conn, func() {
+        conn.Close()
+        s.conns.Done()
+        release()
+    }
+}
+
+// eventSocket is one /ws connection. Only serve writes to it; the reader
+// goroutine hands it the client's requests.
+type eventSocket struct {
+    app     *App
+    r       *http.Request
+    conn    *websocket.Conn
+    store   *StudentStore
+    sockets *EventSockets
+    // quit is closed when serve returns, releasing the reader
+    quit chan struct{}
+
+    events      <-chan Event
+    dropped     func() int64
+    unsubscribe func()
+    // reported is the drop count the client has been told about
+    reported int64
+    // last is the Seq of the latest event sent, so a replay and the live
+    // events it overlaps are not sent twice
+    last int
+}
+
+func (s *eventSocket) serve(filter EventFilter) {
+    requests := make(chan wsRequest)
+    defer close(s.quit)
+    go s.read(requests)
+
+    s.subscribe(filter, nil)
+    defer func() { s.unsubscribe() }()
+
+    ping := time.NewTicker(s.sockets.pingInterval)
+    defer ping.Stop()
+    for {
+        var err error
+        select {
+        case <-s.sockets.done:
+            s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+                time.Now().Add(s.sockets.writeTimeout))
+            return
+        case <-ping.C:
+            err = s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(s.sockets.writeTimeout))
+        case req, ok := <-requests:
+            if !ok {
+                return
+            }
+            err = s.handle(req)
+        case e := <-s.events:
+            if e.Tenant != s.store.tenant || e.Seq <= s.last {
+                continue
+            }
+            err = s.send(e)
+        }
+        if err == nil {
+            err = s.reportLag()
+        }
+        if err != nil {
+            return
+        }
+    }
+}
+
+// read passes the client's requests to serve until the connection fails or
+// the client goes quiet for longer than WS_PONG_TIMEOUT
+func (s *eventSocket) read(requests chan<- wsRequest) {
+    defer close(requests)
+    s.conn.SetReadLimit(4096)
+    alive := func() { s.conn.SetReadDeadline(time.Now().Add(s.sockets.pongTimeout)) }
+    alive()
+    s.conn.SetPongHandler(func(string) error {
+        alive()
+        return nil
+    })
+    for {
+        kind, data, err := s.conn.ReadMessage()
+        if err != nil {
+            if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+                reqctx.Logger(s.r.Context()).Info("WebSocket closed", "error", err)
+            }
+            return
+        }
+        alive()
+        var req wsRequest
+        if kind != websocket.TextMessage || json.Unmarshal(data, &req) != nil {
+            req = wsRequest{Type: wsError}
+        }
+        select {
+        case requests <- req:
+        case <-s.quit:
+            return
+        }
+    }
+}
+
+// handle answers one client request
+func (s *eventSocket) handle(req wsRequest) error {
+    switch req.Type {
+    case wsPing:
+        return s.write(wsMessage{Type: wsPong})
+    case wsSubscribe:
+        filter, err := parseSocketFilter(req)
+        if err != nil {
+            return s.write(wsMessage{Type: wsError, Message: err.Error()})
+        }
+        if req.Since != nil && *req.Since < 0 {
+            return s.write(wsMessage{Type: wsError, Message: "Since must be a non-negative event ID"})
+        }
+        return s.subscribe(filter, req.Since)
+    case wsError:
+        return s.write(wsMessage{Type: wsError, Message: "Messages must be JSON text"})
+    default:
+        return s.write(wsMessage{Type: wsError, Message: fmt.Sprintf("Unknown message type %q; expected subscribe or ping", req.Type)})
+    }
+}
+
+// subscribe replaces the connection's subscription with filter, replaying
+// the matching changes after since when it is set. The new subscription is
+// taken before the old one is dropped, so no change falls in between.
+func (s *eventSocket) subscribe(filter EventFilter, since *int) error {
+    events, dropped, unsubscribe := s.app.events.SubscribeCounted(s.sockets.buffer, filter)
+    if s.unsubscribe != nil {
+        s.unsubscribe()
+    }
+    s.events, s.dropped, s.unsubscribe, s.reported = events, dropped, unsubscribe, 0
+    if err := s.write(wsMessage{Type: wsSubscribed, Filter: &filter}); err != nil {
+        return err
+    }
+    if since == nil {
+        return nil
+    }
+    versions, ok, err := s.store.VersionsSince(*since)
+    if err != nil {
+        return err
+    }
+    if !ok {
+        if err := s.write(wsMessage{Type: eventStreamReset, Seq: s.store.Seq()}); err != nil {
+            return err
+        }
+    }
+    s.last = 0
+    for _, v := range versions {
+        if e := eventFromVersion(s.store.tenant, v); filter.Match(e) {
+            if err := s.send(e); err != nil {
+                return err
+            }
+        }
+        s.last = v.Seq
+    }
+    return nil
+}
+
+// send writes a change event and records the read of its student
+func (s *eventSocket) send(e Event) error {
+    s.app.recordAccess(s.r, fieldsStudent, e.StudentID)
+    if e.Seq > s.last {
+        s.last = e.Seq
+    }
+    return s.write(s.app.masker.Event(e))
+}
+
+// reportLag tells the client how many events it missed since it was last
+// told, with the Seq to resubscribe from
+func (s *eventSocket) reportLag() error {
+    dropped := s.dropped()
+    if dropped == s.reported {
+        return nil
+    }
+    missed := dropped - s.reported
+    s.reported = dropped
+    s.app.metrics.Add("event_sockets_lagged_total", float64(missed))
+    return s.write(wsMessage{Type: wsLagged, Missed: missed, Seq: s.last})
+}
+
+func (s *eventSocket) write(v interface{}) error {
+    s.conn.SetWriteDeadline(time.Now().Add(s.sockets.writeTimeout))
+    return s.conn.WriteJSON(v)
+}
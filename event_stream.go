@@ -0,0 +1,162 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+    "student-api/reqctx"
+)
+
+// EventStreams serves the change events of the EventBus to GET /events
+// clients as Server-Sent Events. Each stream subscribes to the bus with its
+// own buffer, so a stalled client misses events rather than slowing writes;
+// it sees the gap in Seq and Version, and can reconnect with Last-Event-ID
+// to be sent the events it missed.
+type EventStreams struct {
+    heartbeat time.Duration
+    buffer    int
+    max       int
+    active    atomic.Int64
+    // done is closed on shutdown, ending every stream so the server can drain
+    done      chan struct{}
+    closeOnce sync.Once
+}
+
+// LoadEventStreams reads EVENTS_HEARTBEAT (default 15s), the interval of the
+// comments keeping idle streams open through proxies, EVENTS_BUFFER (default
+// 64), the events queued per stream, and EVENTS_MAX_STREAMS (default 100)
+func LoadEventStreams() (*EventStreams, error) {
+    s := &EventStreams{
+        heartbeat: getEnvDuration("EVENTS_HEARTBEAT", 15*time.Second),
+        buffer:    getEnvInt("EVENTS_BUFFER", 64),
+        max:       getEnvInt("EVENTS_MAX_STREAMS", 100),
+        done:      make(chan struct{}),
+    }
+    if s.heartbeat <= 0 {
+        return nil, fmt.Errorf("EVENTS_HEARTBEAT must be positive, got %s", s.heartbeat)
+    }
+    if s.buffer < 1 {
+        return nil, fmt.Errorf("EVENTS_BUFFER must be positive, got %d", s.buffer)
+    }
+    if s.max < 1 {
+        return nil, fmt.Errorf("EVENTS_MAX_STREAMS must be positive, got %d", s.max)
+    }
+    return s, nil
+}
+
+// Close ends every open stream; clients reconnect to another instance
+func (s *EventStreams) Close() {
+    s.closeOnce.Do(func() { close(s.done) })
+}
+
+// eventStreamReset is sent when a client resumes from an event this
+// instance no longer has, e.g. after a restart; it should reload the
+// students and carry on from Seq
+const eventStreamReset = "reset"
+
+// StreamEvents streams student changes as Server-Sent Events: GET
+// /events?types=student.updated&fields=email. Each event's id is its Seq,
+// so a client reconnecting with Last-Event-ID, or ?since=, first receives
+// the changes it missed.
+func (app *App) StreamEvents(w http.ResponseWriter, r *http.Request) {
+    query := r.URL.Query()
+    filter, err := ParseEventFilter(query.Get("types"), query.Get("fields"))
+    if err != nil {
+        writeValidationErrors(w, r, []ValidationError{{Field: "types", Code: CodeInvalidFilter, Message: err.Error()}})
+        return
+    }
+    since := -1
+    if value := r.Header.Get("Last-Event-ID"); value != "" || query.Has("since") {
+        if value == "" {
+            value = query.Get("since")
+        }
+        if since, err = strconv.Atoi(value); err != nil || since < 0 {
+            writeValidationErrors(w, r, []ValidationError{{Field: "since", Code: CodeOutOfRange, Message: "Since must be a non-negative event ID"}})
+            return
+        }
+    }
+    streams := app.streams
+    if int(streams.active.Add(1)) > streams.max {
+        streams.active.Add(-1)
+        httpError(w, r, "Too many event streams, try again later", http.StatusServiceUnavailable)
+        return
+    }
+    app.metrics.Set("event_streams_active", float64(streams.active.Load()))
+    defer func() {
+        app.metrics.Set("event_streams_active", float64(streams.active.Add(-1)))
+    }()
+
+    // Subscribe before reading the history, so no change falls in between;
+    // live events already replayed are skipped by their Seq
+    store := app.storeFor(r)
+    events, unsubscribe := app.events.SubscribeFiltered(streams.buffer, filter)
+    defer unsubscribe()
+
+    rc := http.NewResponseController(w)
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Header().Set("X-Accel-Buffering", "no")
+    w.WriteHeader(http.StatusOK)
+
+    last := 0
+    if since >= 0 {
+        versions, ok, err := store.VersionsSince(since)
+        if err != nil {
+            reqctx.Logger(r.Context()).Error("reading student history failed", "error", err)
+            return
+        }
+        if !ok {
+            writeStreamEvent(w, "", eventStreamReset, map[string]int{"seq": store.Seq()})
+        }
+        for _, v := range versions {
+            if e := eventFromVersion(store.tenant, v); filter.Match(e) {
+                app.sendStreamEvent(w, r, e)
+            }
+            last = v.Seq
+        }
+    }
+    if err := rc.Flush(); err != nil {
+        reqctx.Logger(r.Context()).Error("event stream cannot flush", "error", err)
+        return
+    }
+
+    heartbeat := time.NewTicker(streams.heartbeat)
+    defer heartbeat.Stop()
+    for {
+        select {
+        case <-r.Context().Done():
+            return
+        case <-streams.done:
+            return
+        case <-heartbeat.C:
+            fmt.Fprint(w, ": keepalive\n\n")
+        case e := <-events:
+            if e.Tenant != store.tenant || e.Seq <= last {
+                continue
+            }
+            app.sendStreamEvent(w, r, e)
+        }
+        if err := rc.Flush(); err != nil {
+            return
+        }
+    }
+}
+
+// sendStreamEvent writes a change event and records the read of its student
+func (app *App) sendStreamEvent(w http.ResponseWriter, r *http.Request, e Event) {
+    app.recordAccess(r, fieldsStudent, e.StudentID)
+    writeStreamEvent(w, strconv.Itoa(e.Seq), e.Type, e)
+}
+
+// writeStreamEvent writes one Server-Sent Event with a JSON data line
+func writeStreamEvent(w http.ResponseWriter, id, event string, data interface{}) {
+    body, _ := json.Marshal(data)
+    if id != "" {
+        fmt.Fprintf(w, "id: %s\n", id)
+    }
+    fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, body)
+}
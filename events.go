@@ -0,0 +1,243 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Student change event types
+const (
+    EventStudentCreated = "student.created"
+    EventStudentUpdated = "student.updated"
+    EventStudentDeleted = "student.deleted"
+)
+
+// eventTypes maps history operations onto the event published for them
+var eventTypes = map[string]string{
+    OpCreate:  EventStudentCreated,
+    OpUpdate:  EventStudentUpdated,
+    OpDelete:  EventStudentDeleted,
+    OpRestore: EventStudentCreated,
+}
+
+// Event describes a change to a student. Seq is the history sequence number
+// of the change across the tenant's store, so consumers can detect gaps.
+// Version is the student's own sequence number, 1 for its creation and one
+// more for each later change; consumers apply a student's events in Version
+// order and can discard one whose Version they have already seen. Both
+// come from the store's history, which outlives restarts unless the store
+// is kept in memory. Changes holds the before and after value of every
+// field the change touched: all fields of a created student have a nil
+// From, those of a deleted one a nil To.
+type Event struct {
+    Type      string                 `json:"type"`
+    Tenant    string                 `json:"tenant,omitempty"`
+    Seq       int                    `json:"seq"`
+    StudentID int                    `json:"student_id"`
+    Version   int                    `json:"version"`
+    Student   Student                `json:"student"`
+    Changes   map[string]FieldChange `json:"changes,omitempty"`
+    At        time.Time              `json:"at"`
+}
+
+// eventFromVersion builds the event announcing a history entry in a tenant's store
+func eventFromVersion(tenant string, v StudentVersion) Event {
+    e := Event{
+        Type:      eventTypes[v.Operation],
+        Tenant:    tenant,
+        Seq:       v.Seq,
+        StudentID: v.StudentID,
+        Version:   v.Version,
+        Student:   v.Student,
+        Changes:   v.Changes,
+        At:        v.At,
+    }
+    switch v.Operation {
+    case OpCreate, OpRestore:
+        e.Changes = studentFieldChanges(v.Student, false)
+    case OpDelete:
+        e.Changes = studentFieldChanges(v.Student, true)
+    }
+    return e
+}
+
+// studentFieldChanges lists every field of a student appearing (From nil)
+// or, when removed is set, disappearing (To nil)
+func studentFieldChanges(s Student, removed bool) map[string]FieldChange {
+    values := map[string]interface{}{"name": s.Name, "age": s.Age, "email": s.Email}
+    changes := make(map[string]FieldChange, len(values))
+    for field, value := range values {
+        if removed {
+            changes[field] = FieldChange{From: value}
+        } else {
+            changes[field] = FieldChange{To: value}
+        }
+    }
+    return changes
+}
+
+// EventFilter selects the events a subscriber receives. Empty lists match
+// everything; Fields matches events that change at least one of the fields.
+type EventFilter struct {
+    Types  []string `json:"types,omitempty"`
+    Fields []string `json:"fields,omitempty"`
+    IDs    []int    `json:"ids,omitempty"`
+}
+
+// diffFields are the student fields events report changes to
+var diffFields = map[string]bool{"name": true, "age": true, "email": true}
+
+// ParseEventFilter builds a filter from comma-separated event types and
+// field names, e.g. ("student.updated", "email")
+func ParseEventFilter(types, fields string) (EventFilter, error) {
+    var f EventFilter
+    for _, t := range strings.Split(types, ",") {
+        if t = strings.TrimSpace(t); t == "" {
+            continue
+        }
+        if t != EventStudentCreated && t != EventStudentUpdated && t != EventStudentDeleted {
+            return EventFilter{}, fmt.Errorf("unknown event type %q", t)
+        }
+        f.Types = append(f.Types, t)
+    }
+    for _, field := range strings.Split(fields, ",") {
+        if field = strings.TrimSpace(field); field == "" {
+            continue
+        }
+        if !diffFields[field] {
+            return EventFilter{}, fmt.Errorf("unknown field %q", field)
+        }
+        f.Fields = append(f.Fields, field)
+    }
+    return f, nil
+}
+
+// Match reports whether the event passes the filter
+func (f EventFilter) Match(e Event) bool {
+    if len(f.Types) > 0 && !containsString(f.Types, e.Type) {
+        return false
+    }
+    if len(f.IDs) > 0 && !containsInt(f.IDs, e.StudentID) {
+        return false
+    }
+    if len(f.Fields) == 0 {
+        return true
+    }
+    for _, field := range f.Fields {
+        if _, changed := e.Changes[field]; changed {
+            return true
+        }
+    }
+    return false
+}
+
+func containsString(list []string, s string) bool {
+    for _, item := range list {
+        if item == s {
+            return true
+        }
+    }
+    return false
+}
+
+// subscriber is a registered event channel and the events it wants
+type subscriber struct {
+    ch      chan Event
+    filter  EventFilter
+    dropped *atomic.Int64
+}
+
+// EventBus is an in-process publish/subscribe hub for change events.
+// Publishing never blocks: a subscriber whose buffer is full misses the
+// event and the drop is counted, so a slow consumer cannot stall writes.
+type EventBus struct {
+    mu          sync.RWMutex
+    subscribers map[int]subscriber
+    nextID      int
+    dropped     atomic.Int64
+    // hooks see every event, in publication order, while it is published
+    hooks []func(Event)
+}
+
+// NewEventBus initializes a new EventBus
+func NewEventBus() *EventBus {
+    return &EventBus{subscribers: make(map[int]subscriber)}
+}
+
+// Hook registers fn to be called with every event as it is published.
+// Stores publish while holding their write lock, so fn sees each store's
+// events in order and misses none, but it must return at once; it suits
+// consumers such as EventDispatcher that queue events for later delivery.
+func (b *EventBus) Hook(fn func(Event)) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.hooks = append(b.hooks, fn)
+}
+
+// Subscribe registers a subscriber for every event with the given buffer
+// size. The returned function unsubscribes and closes the channel.
+func (b *EventBus) Subscribe(buffer int) (<-chan Event, func()) {
+    return b.SubscribeFiltered(buffer, EventFilter{})
+}
+
+// SubscribeFiltered is Subscribe for the events matching filter; events it
+// filters out are neither delivered nor counted as dropped
+func (b *EventBus) SubscribeFiltered(buffer int, filter EventFilter) (<-chan Event, func()) {
+    ch, _, unsubscribe := b.SubscribeCounted(buffer, filter)
+    return ch, unsubscribe
+}
+
+// SubscribeCounted is SubscribeFiltered that also returns how many matching
+// events the subscriber has missed because its buffer was full, so it can
+// tell its own consumer that it fell behind
+func (b *EventBus) SubscribeCounted(buffer int, filter EventFilter) (<-chan Event, func() int64, func()) {
+    ch := make(chan Event, buffer)
+    dropped := new(atomic.Int64)
+
+    b.mu.Lock()
+    id := b.nextID
+    b.nextID++
+    b.subscribers[id] = subscriber{ch: ch, filter: filter, dropped: dropped}
+    b.mu.Unlock()
+
+    var once sync.Once
+    return ch, dropped.Load, func() {
+        once.Do(func() {
+            b.mu.Lock()
+            delete(b.subscribers, id)
+            b.mu.Unlock()
+            close(ch)
+        })
+    }
+}
+
+// Publish delivers the event to every subscriber with room in its buffer
+func (b *EventBus) Publish(e Event) {
+    if b == nil {
+        return
+    }
+    b.mu.RLock()
+    defer b.mu.RUnlock()
+    for _, hook := range b.hooks {
+        hook(e)
+    }
+    for _, sub := range b.subscribers {
+        if !sub.filter.Match(e) {
+            continue
+        }
+        select {
+        case sub.ch <- e:
+        default:
+            b.dropped.Add(1)
+            sub.dropped.Add(1)
+        }
+    }
+}
+
+// Dropped returns how many deliveries were skipped because a subscriber was full
+func (b *EventBus) Dropped() int64 {
+    return b.dropped.Load()
+}
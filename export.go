@@ -0,0 +1,221 @@
+package main
+
+import (
+    "encoding/csv"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "student-api/reqctx"
+)
+
+// csvFormulaPrefixes are leading characters spreadsheet applications treat as formulas
+const csvFormulaPrefixes = "=+-@\t\r"
+
+// escapeCSVCell neutralises cells that would otherwise be evaluated as a
+// formula by Excel or LibreOffice by prefixing them with a single quote
+func escapeCSVCell(value string) string {
+    if value != "" && strings.ContainsRune(csvFormulaPrefixes, rune(value[0])) {
+        return "'" + value
+    }
+    return value
+}
+
+// studentCSVRecord renders a student as a CSV row
+func studentCSVRecord(student Student, escapeFormulas bool) []string {
+    record := []string{
+        strconv.Itoa(student.ID),
+        student.Name,
+        strconv.Itoa(student.Age),
+        student.Email,
+    }
+    if escapeFormulas {
+        for i := range record {
+            record[i] = escapeCSVCell(record[i])
+        }
+    }
+    return record
+}
+
+// exportChunkSize is how many students an export reads from the store at a time
+const exportChunkSize = 500
+
+// unescapeCSVCell undoes escapeCSVCell
+func unescapeCSVCell(value string) string {
+    if len(value) > 1 && value[0] == '\'' && strings.ContainsRune(csvFormulaPrefixes, rune(value[1])) {
+        return value[1:]
+    }
+    return value
+}
+
+// exportCursorFromRequest parses ?after=, the position of a resumed CSV
+// export: the sort fields of the last complete row the client received, as
+// CSV, followed by its id unless the export is sorted on id. With the
+// default order that is just the id, and for sort=age,-name a row
+// "7,Ada,20,ada@example.edu" resumes with after=20,Ada,7. It returns a nil
+// filter when the export starts from the beginning.
+func exportCursorFromRequest(r *http.Request, keys []SortKey, escapedFormulas bool) (*Filter, *ValidationError) {
+    value := r.URL.Query().Get("after")
+    if value == "" {
+        return nil, nil
+    }
+    seek := seekKeys(keys)
+    var fields []string
+    for _, key := range seek {
+        fields = append(fields, key.Field)
+    }
+    invalid := &ValidationError{
+        Field:   "after",
+        Code:    CodeInvalidFilter,
+        Message: fmt.Sprintf("after must hold the last row's %s as CSV", strings.Join(fields, ", ")),
+    }
+    cr := csv.NewReader(strings.NewReader(value))
+    cr.FieldsPerRecord = len(seek)
+    values, err := cr.Read()
+    if err != nil {
+        return nil, invalid
+    }
+    var last Student
+    for i, key := range seek {
+        cell := values[i]
+        if escapedFormulas {
+            cell = unescapeCSVCell(cell)
+        }
+        switch key.Field {
+        case "id", "age":
+            n, err := strconv.Atoi(strings.TrimSpace(cell))
+            if err != nil {
+                return nil, invalid
+            }
+            if key.Field == "id" {
+                last.ID = n
+            } else {
+                last.Age = n
+            }
+        case "name":
+            last.Name = cell
+        default:
+            last.Email = cell
+        }
+    }
+    return seekFilter(keys, last), nil
+}
+
+// ExportStudents downloads every student matching the request's filters:
+// GET /students/export?format=csv|xlsx, CSV by default. Students are read
+// and written in chunks, flushing after each, so large exports are never
+// held in memory; rows changed mid-export may be seen before or after.
+// Chunks continue after the last row read rather than at an offset, so rows
+// added or removed meanwhile do not shift it. The same position lets a
+// client resume a dropped CSV export with ?after= (see
+// exportCursorFromRequest) and append the rows that follow, sent without a
+// header line, to what it already has.
+func (app *App) ExportStudents(w http.ResponseWriter, r *http.Request) {
+    store := app.storeFor(r)
+    format := r.URL.Query().Get("format")
+    if format == "" {
+        format = "csv"
+    }
+    if format != "csv" && format != "xlsx" {
+        httpError(w, r, "Format must be csv or xlsx", http.StatusBadRequest)
+        return
+    }
+
+    filter, ferr := filterFromRequest(r)
+    if ferr != nil {
+        writeValidationErrors(w, r, []ValidationError{*ferr})
+        return
+    }
+
+    keys, serr := sortFromRequest(r)
+    if serr != nil {
+        writeValidationErrors(w, r, []ValidationError{*serr})
+        return
+    }
+
+    after, aerr := exportCursorFromRequest(r, keys, app.csvEscapeFormulas)
+    if aerr != nil {
+        writeValidationErrors(w, r, []ValidationError{*aerr})
+        return
+    }
+    resumed := after != nil
+    if resumed && format != "csv" {
+        httpError(w, r, "Only csv exports can be resumed", http.StatusBadRequest)
+        return
+    }
+
+    // The first chunk is read before any headers so store errors get a status
+    opts := ListOptions{Filter: filter.And(after), Sort: keys, Limit: exportChunkSize}
+    students, err := store.List(opts)
+    if err != nil {
+        writeStoreError(w, r, err)
+        return
+    }
+
+    // flush pushes buffered rows out after each chunk; the zip compressor
+    // writes through on its own as its window fills
+    var writeRow func(Student) error
+    flush := func() {}
+    var finish func() error
+    switch format {
+    case "csv":
+        w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+        w.Header().Set("Content-Disposition", `attachment; filename="students.csv"`)
+        cw := csv.NewWriter(w)
+        if !resumed {
+            cw.Write([]string{"id", "name", "age", "email"})
+        }
+        writeRow = func(student Student) error {
+            return cw.Write(studentCSVRecord(student, app.csvEscapeFormulas))
+        }
+        flush = cw.Flush
+        finish = func() error {
+            cw.Flush()
+            return cw.Error()
+        }
+    case "xlsx":
+        w.Header().Set("Content-Type", xlsxContentType)
+        w.Header().Set("Content-Disposition", `attachment; filename="students.xlsx"`)
+        xw, err := newXLSXWriter(w, "Students")
+        if err == nil {
+            err = xw.WriteRow("id", "name", "age", "email")
+        }
+        if err != nil {
+            reqctx.Logger(r.Context()).Error("export failed", "format", "xlsx", "error", err)
+            return
+        }
+        writeRow = func(student Student) error {
+            return xw.WriteRow(student.ID, student.Name, student.Age, student.Email)
+        }
+        finish = xw.Close
+    }
+
+    flusher := http.NewResponseController(w)
+    rows := 0
+    for {
+        app.recordAccess(r, fieldsStudent, studentIDs(students)...)
+        for _, student := range students {
+            if err := writeRow(app.masker.Student(student)); err != nil {
+                reqctx.Logger(r.Context()).Error("export failed", "format", format, "rows", rows, "error", err)
+                return
+            }
+            rows++
+        }
+        if len(students) < exportChunkSize {
+            break
+        }
+        flush()
+        flusher.Flush()
+        last := students[len(students)-1]
+        opts.Filter = filter.And(seekFilter(keys, last))
+        if students, err = store.List(opts); err != nil {
+            reqctx.Logger(r.Context()).Error("export aborted", "format", format, "rows", rows, "after_id", last.ID, "error", err)
+            return
+        }
+    }
+    if err := finish(); err != nil {
+        reqctx.Logger(r.Context()).Error("export failed", "format", format, "error", err)
+        return
+    }
+    reqctx.Logger(r.Context()).Debug("export finished", "format", format, "rows", rows, "resumed", resumed)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+    "bytes"
+    "encoding/csv"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "testing"
+)
+
+// formulaNames are student names a spreadsheet would evaluate
+var formulaNames = []string{
+    "=cmd|' /C calc'!A0",
+    "+1",
+    "@SUM(A1:A9)",
+    "\tTab Lead",
+}
+
+func TestEscapeCSVCell(t *testing.T) {
+    tests := []struct {
+        value, want string
+    }{
+        {"=cmd|' /C calc'!A0", "'=cmd|' /C calc'!A0"},
+        {"+1", "'+1"},
+        {"@SUM(A1:A9)", "'@SUM(A1:A9)"},
+        {"\tTab Lead", "'\tTab Lead"},
+        {"-2", "'-2"},
+        {"\rCR", "'\rCR"},
+        {"Ada Lovelace", "Ada Lovelace"},
+        {"ada+tag@example.edu", "ada+tag@example.edu"},
+        {"'quoted", "'quoted"},
+        {"", ""},
+    }
+    for _, tt := range tests {
+        if got := escapeCSVCell(tt.value); got != tt.want {
+            t.Errorf("escapeCSVCell(%q) = %q, want %q", tt.value, got, tt.want)
+        }
+        if got := unescapeCSVCell(escapeCSVCell(tt.value)); got != tt.value {
+            t.Errorf("unescapeCSVCell(escapeCSVCell(%q)) = %q", tt.value, got)
+        }
+    }
+}
+
+func TestUnescapeCSVCellKeepsPlainQuotes(t *testing.T) {
+    for _, value := range []string{"'", "'quoted", "O'Brien", "''=x"} {
+        if got := unescapeCSVCell(value); got != value {
+            t.Errorf("unescapeCSVCell(%q) = %q, want it unchanged", value, got)
+        }
+    }
+}
+
+// newExportApp returns an app serving exports of students with formulaNames
+// and a plain name, with formula escaping on
+func newExportApp(t *testing.T) *App {
+    t.Helper()
+    access, err := NewAccessLog(NewMemoryAccessLogRepository(), AccessLogOff, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    store := NewStudentStore(NewMemoryRepository(), NewEventBus())
+    t.Cleanup(store.Close)
+    for i, name := range append(formulaNames, "Zed Plain") {
+        student := Student{Name: name, Age: 20 + i, Email: "student" + string(rune('a'+i)) + "@example.edu"}
+        if _, _, err := store.Create(student); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return &App{store: store, access: access, csvEscapeFormulas: true}
+}
+
+// export serves GET /students/export with query and returns its CSV rows
+func export(t *testing.T, app *App, query url.Values) [][]string {
+    t.Helper()
+    rec := httptest.NewRecorder()
+    app.ExportStudents(rec, httptest.NewRequest(http.MethodGet, "/students/export?"+query.Encode(), nil))
+    if rec.Code != http.StatusOK {
+        t.Fatalf("export?%s: status %d: %s", query.Encode(), rec.Code, rec.Body)
+    }
+    rows, err := csv.NewReader(rec.Body).ReadAll()
+    if err != nil {
+        t.Fatalf("export?%s: %v", query.Encode(), err)
+    }
+    return rows
+}
+
+// csvLine encodes cells as one CSV line without its line ending
+func csvLine(t *testing.T, cells ...string) string {
+    t.Helper()
+    var b bytes.Buffer
+    w := csv.NewWriter(&b)
+    w.Write(cells)
+    w.Flush()
+    if err := w.Error(); err != nil {
+        t.Fatal(err)
+    }
+    return strings.TrimSuffix(b.String(), "\n")
+}
+
+func TestExportEscapesFormulas(t *testing.T) {
+    rows := export(t, newExportApp(t), url.Values{})
+    if len(rows) != len(formulaNames)+2 {
+        t.Fatalf("got %d rows, want a header and %d students", len(rows), len(formulaNames)+1)
+    }
+    escaped := make(map[string]bool)
+    for _, row := range rows[1:] {
+        escaped[row[1]] = true
+    }
+    for _, name := range formulaNames {
+        if !escaped["'"+name] {
+            t.Errorf("name %q was not exported escaped; got names %v", name, escaped)
+        }
+    }
+}
+
+// TestExportResumesAfterEscapedRow resumes a name-sorted export after each
+// row in turn, passing the row's cells back as they were received, and
+// checks the resumed export sends exactly the rows that followed
+func TestExportResumesAfterEscapedRow(t *testing.T) {
+    app := newExportApp(t)
+    full := export(t, app, url.Values{"sort": {"name"}})
+    header, rows := full[0], full[1:]
+    if strings.Join(header, ",") != "id,name,age,email" {
+        t.Fatalf("header = %v", header)
+    }
+    for i, row := range rows {
+        after := csvLine(t, row[1], row[0])
+        resumed := export(t, app, url.Values{"sort": {"name"}, "after": {after}})
+        want := rows[i+1:]
+        if len(resumed) != len(want) {
+            t.Errorf("after=%q: got %d rows %v, want %d %v", after, len(resumed), resumed, len(want), want)
+            continue
+        }
+        for j := range want {
+            if strings.Join(resumed[j], ",") != strings.Join(want[j], ",") {
+                t.Errorf("after=%q: row %d = %v, want %v", after, j, resumed[j], want[j])
+            }
+        }
+    }
+}
+
+func TestExportRejectsMalformedCursor(t *testing.T) {
+    app := newExportApp(t)
+    for _, after := range []string{"x", "'=1,2,3", "\"unterminated"} {
+        rec := httptest.NewRecorder()
+        app.ExportStudents(rec, httptest.NewRequest(http.MethodGet, "/students/export?"+url.Values{"after": {after}}.Encode(), nil))
+        if rec.Code != http.StatusBadRequest {
+            t.Errorf("after=%q: status %d, want %d", after, rec.Code, http.StatusBadRequest)
+        }
+    }
+}
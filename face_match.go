@@ -0,0 +1,427 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "github.com/gorilla/mux"
+    "student-api/reqctx"
+)
+
+// Upload limits for enrolled student photos and class photos
+const (
+    maxStudentPhotoUpload = 5 << 20
+    maxClassPhotoUpload   = 20 << 20
+)
+
+// Review states of a proposed attendance match
+const (
+    MatchPending   = "pending"
+    MatchConfirmed = "confirmed"
+    MatchRejected  = "rejected"
+)
+
+// FaceReference is an enrolled photo of a consenting student
+type FaceReference struct {
+    StudentID   int
+    Photo       []byte
+    ContentType string
+}
+
+// FaceBox locates a face in the class photo, in pixels
+type FaceBox struct {
+    X      int `json:"x"`
+    Y      int `json:"y"`
+    Width  int `json:"width"`
+    Height int `json:"height"`
+}
+
+// FaceMatch is a face in the class photo the provider attributes to a student
+type FaceMatch struct {
+    StudentID  int      `json:"student_id"`
+    Confidence float64  `json:"confidence"`
+    Box        *FaceBox `json:"box,omitempty"`
+}
+
+// FaceMatcher finds enrolled students in a class photo
+type FaceMatcher interface {
+    Match(ctx context.Context, photo []byte, contentType string, references []FaceReference) ([]FaceMatch, error)
+}
+
+// HTTPFaceMatcher posts the class photo and the references to an external
+// recognition service as base64 JSON. The service must not retain them.
+type HTTPFaceMatcher struct {
+    url    string
+    apiKey string
+    http   *http.Client
+}
+
+type faceImage struct {
+    ID          string `json:"id,omitempty"`
+    Image       []byte `json:"image"`
+    ContentType string `json:"content_type"`
+}
+
+type faceMatchRequest struct {
+    faceImage
+    References []faceImage `json:"references"`
+}
+
+type faceMatchResponse struct {
+    Matches []struct {
+        ID         string   `json:"id"`
+        Confidence float64  `json:"confidence"`
+        Box        *FaceBox `json:"box"`
+    } `json:"matches"`
+}
+
+func (m *HTTPFaceMatcher) Match(ctx context.Context, photo []byte, contentType string, references []FaceReference) ([]FaceMatch, error) {
+    body := faceMatchRequest{faceImage: faceImage{Image: photo, ContentType: contentType}}
+    for _, ref := range references {
+        body.References = append(body.References, faceImage{ID: strconv.Itoa(ref.StudentID), Image: ref.Photo, ContentType: ref.ContentType})
+    }
+    jsonBody, err := json.Marshal(body)
+    if err != nil {
+        return nil, err
+    }
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.url, bytes.NewReader(jsonBody))
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    if m.apiKey != "" {
+        req.Header.Set("Authorization", "Bearer "+m.apiKey)
+    }
+
+    resp, err := m.http.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("face match: unexpected status %s", resp.Status)
+    }
+
+    var result faceMatchResponse
+    if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+        return nil, err
+    }
+    matches := make([]FaceMatch, 0, len(result.Matches))
+    for _, match := range result.Matches {
+        id, err := strconv.Atoi(match.ID)
+        if err != nil {
+            return nil, fmt.Errorf("face match: unknown reference %q", match.ID)
+        }
+        matches = append(matches, FaceMatch{StudentID: id, Confidence: match.Confidence, Box: match.Box})
+    }
+    return matches, nil
+}
+
+// LoadFaceMatcher returns the provider configured by FACE_MATCH_URL, or nil
+// unless photo recognition is opted into with FACE_MATCH_ENABLED
+func LoadFaceMatcher() FaceMatcher {
+    url := getEnv("FACE_MATCH_URL", "")
+    if !getEnvBool("FACE_MATCH_ENABLED", false) || url == "" {
+        return nil
+    }
+    return &HTTPFaceMatcher{url: url, apiKey: getEnv("FACE_MATCH_API_KEY", ""), http: &http.Client{}}
+}
+
+// StudentPhoto is a student's enrolled reference photo, kept only while
+// consent stands
+type StudentPhoto struct {
+    StudentID   int       `json:"student_id"`
+    ContentType string    `json:"content_type"`
+    Size        int       `json:"size"`
+    ConsentedAt time.Time `json:"consented_at"`
+
+    photo []byte
+}
+
+// AttendanceMatch is a proposed attendee awaiting a teacher's review
+type AttendanceMatch struct {
+    FaceMatch
+    Name       string     `json:"name"`
+    Status     string     `json:"status"`
+    ReviewedAt *time.Time `json:"reviewed_at,omitempty"`
+}
+
+// AttendanceProposal is the outcome of matching one class photo. Students
+// only count as present once their match is confirmed; the photo itself is
+// not kept.
+type AttendanceProposal struct {
+    ID        int               `json:"id"`
+    CreatedAt time.Time         `json:"created_at"`
+    Matches   []AttendanceMatch `json:"matches"`
+    Present   []int             `json:"present"`
+
+    tenant string
+}
+
+// PhotoStore keeps enrolled photos and attendance proposals
+type PhotoStore struct {
+    sync.RWMutex
+    photos    map[studentKey]StudentPhoto
+    proposals map[int]*AttendanceProposal
+    nextID    int
+}
+
+// NewPhotoStore initializes a new PhotoStore
+func NewPhotoStore() *PhotoStore {
+    return &PhotoStore{photos: make(map[studentKey]StudentPhoto), proposals: make(map[int]*AttendanceProposal), nextID: 1}
+}
+
+// references returns a tenant's enrolled photos, deleting those of
+// students who no longer exist
+func (s *PhotoStore) references(store *StudentStore, tenant string) ([]FaceReference, error) {
+    s.Lock()
+    defer s.Unlock()
+    var refs []FaceReference
+    for key, p := range s.photos {
+        if key.tenant != tenant {
+            continue
+        }
+        if _, err := store.Get(p.StudentID); errors.Is(err, errStudentNotFound) {
+            delete(s.photos, key)
+            continue
+        } else if err != nil {
+            return nil, err
+        }
+        refs = append(refs, FaceReference{StudentID: p.StudentID, Photo: p.photo, ContentType: p.ContentType})
+    }
+    sort.Slice(refs, func(i, j int) bool { return refs[i].StudentID < refs[j].StudentID })
+    return refs, nil
+}
+
+// readImageUpload reads the multipart "file" field and checks it is an image
+func readImageUpload(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, string, bool) {
+    r.Body = http.MaxBytesReader(w, r.Body, limit)
+    file, _, err := r.FormFile("file")
+    if err != nil {
+        httpError(w, r, "Missing image file", http.StatusBadRequest)
+        return nil, "", false
+    }
+    defer file.Close()
+    data, err := io.ReadAll(file)
+    if err != nil {
+        httpError(w, r, "Invalid image file", http.StatusBadRequest)
+        return nil, "", false
+    }
+    contentType := http.DetectContentType(data)
+    if !strings.HasPrefix(contentType, "image/") {
+        httpError(w, r, "Unsupported image type "+contentType, http.StatusUnsupportedMediaType)
+        return nil, "", false
+    }
+    return data, contentType, true
+}
+
+// PutStudentPhoto enrols a student's reference photo: a multipart "file"
+// plus the form field consent=true, recording that consent was given
+func (app *App) PutStudentPhoto(w http.ResponseWriter, r *http.Request) {
+    store := app.storeFor(r)
+    if app.faces == nil {
+        httpError(w, r, "Photo recognition is not enabled", http.StatusServiceUnavailable)
+        return
+    }
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        httpError(w, r, "Invalid ID", http.StatusBadRequest)
+        return
+    }
+    if _, err := store.Get(id); err != nil {
+        writeStoreError(w, r, err)
+        return
+    }
+
+    data, contentType, ok := readImageUpload(w, r, maxStudentPhotoUpload)
+    if !ok {
+        return
+    }
+    if consent, _ := strconv.ParseBool(r.FormValue("consent")); !consent {
+        writeValidationErrors(w, r, []ValidationError{{
+            Field:   "consent",
+            Code:    CodeRequired,
+            Message: "Consent to photo recognition is required",
+        }})
+        return
+    }
+
+    photo := StudentPhoto{StudentID: id, ContentType: contentType, Size: len(data), ConsentedAt: time.Now().UTC(), photo: data}
+    app.photos.Lock()
+    app.photos.photos[studentKey{reqctx.From(r.Context()).Tenant, id}] = photo
+    app.photos.Unlock()
+    json.NewEncoder(w).Encode(photo)
+}
+
+// DeleteStudentPhoto withdraws consent, deleting the enrolled photo
+func (app *App) DeleteStudentPhoto(w http.ResponseWriter, r *http.Request) {
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        httpError(w, r, "Invalid ID", http.StatusBadRequest)
+        return
+    }
+    key := studentKey{reqctx.From(r.Context()).Tenant, id}
+    app.photos.Lock()
+    _, exists := app.photos.photos[key]
+    delete(app.photos.photos, key)
+    app.photos.Unlock()
+    if !exists {
+        httpError(w, r, "Photo not found", http.StatusNotFound)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// MatchClassPhoto matches a class photo (multipart "file") against the
+// enrolled photos and stores the matches as a proposal for review. Matches
+// below FACE_MATCH_MIN_CONFIDENCE are dropped; none are confirmed.
+func (app *App) MatchClassPhoto(w http.ResponseWriter, r *http.Request) {
+    store := app.storeFor(r)
+    if app.faces == nil {
+        httpError(w, r, "Photo recognition is not enabled", http.StatusServiceUnavailable)
+        return
+    }
+    tenant := reqctx.From(r.Context()).Tenant
+    refs, err := app.photos.references(store, tenant)
+    if err != nil {
+        writeStoreError(w, r, err)
+        return
+    }
+    if len(refs) == 0 {
+        httpError(w, r, "No students have enrolled photos", http.StatusConflict)
+        return
+    }
+
+    data, contentType, ok := readImageUpload(w, r, maxClassPhotoUpload)
+    if !ok {
+        return
+    }
+    matches, err := app.faces.Match(r.Context(), data, contentType, refs)
+    if err != nil {
+        reqctx.Logger(r.Context()).Error("class photo matching failed", "error", err)
+        httpError(w, r, "Failed to match class photo", http.StatusBadGateway)
+        return
+    }
+
+    enrolled := make(map[int]bool, len(refs))
+    for _, ref := range refs {
+        enrolled[ref.StudentID] = true
+    }
+    proposal := &AttendanceProposal{CreatedAt: time.Now().UTC(), Matches: []AttendanceMatch{}, Present: []int{}, tenant: tenant}
+    seen := make(map[int]bool)
+    for _, match := range matches {
+        if !enrolled[match.StudentID] || seen[match.StudentID] || match.Confidence < app.faceMinConfidence {
+            continue
+        }
+        student, err := store.Get(match.StudentID)
+        if err != nil {
+            continue
+        }
+        seen[match.StudentID] = true
+        proposal.Matches = append(proposal.Matches, AttendanceMatch{FaceMatch: match, Name: student.Name, Status: MatchPending})
+    }
+    sort.Slice(proposal.Matches, func(i, j int) bool { return proposal.Matches[i].Confidence > proposal.Matches[j].Confidence })
+
+    app.photos.Lock()
+    proposal.ID = app.photos.nextID
+    app.photos.nextID++
+    app.photos.proposals[proposal.ID] = proposal
+    app.photos.Unlock()
+
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(proposal)
+}
+
+// proposalFromRequest returns the tenant's proposal named by the route; the
+// caller holds the photo store lock
+func (app *App) proposalFromRequest(w http.ResponseWriter, r *http.Request) *AttendanceProposal {
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        httpError(w, r, "Invalid ID", http.StatusBadRequest)
+        return nil
+    }
+    proposal, exists := app.photos.proposals[id]
+    if !exists || proposal.tenant != reqctx.From(r.Context()).Tenant {
+        httpError(w, r, "Attendance proposal not found", http.StatusNotFound)
+        return nil
+    }
+    return proposal
+}
+
+func (app *App) GetAttendanceProposal(w http.ResponseWriter, r *http.Request) {
+    app.photos.RLock()
+    defer app.photos.RUnlock()
+    if proposal := app.proposalFromRequest(w, r); proposal != nil {
+        json.NewEncoder(w).Encode(proposal)
+    }
+}
+
+// ReviewAttendanceProposal records a teacher's decisions on proposed
+// matches: {"confirm": [1, 2], "reject": [3]}. Confirmed students are the
+// proposal's present list; a decision can be changed by reviewing again.
+func (app *App) ReviewAttendanceProposal(w http.ResponseWriter, r *http.Request) {
+    var body struct {
+        Confirm []int `json:"confirm"`
+        Reject  []int `json:"reject"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+        httpError(w, r, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+
+    app.photos.Lock()
+    defer app.photos.Unlock()
+    proposal := app.proposalFromRequest(w, r)
+    if proposal == nil {
+        return
+    }
+
+    index := make(map[int]int, len(proposal.Matches))
+    for i, m := range proposal.Matches {
+        index[m.StudentID] = i
+    }
+    decisions := make(map[int]string)
+    var errs []ValidationError
+    for _, group := range []struct {
+        field, status string
+        ids           []int
+    }{{"confirm", MatchConfirmed, body.Confirm}, {"reject", MatchRejected, body.Reject}} {
+        for _, id := range group.ids {
+            if _, ok := index[id]; !ok {
+                errs = append(errs, ValidationError{Field: group.field, Code: CodeNotFound, Message: fmt.Sprintf("Student %d is not a proposed match", id)})
+            } else if previous, dup := decisions[id]; dup && previous != group.status {
+                errs = append(errs, ValidationError{Field: group.field, Code: CodeOutOfRange, Message: fmt.Sprintf("Student %d is both confirmed and rejected", id)})
+            }
+            decisions[id] = group.status
+        }
+    }
+    if len(errs) > 0 {
+        writeValidationErrors(w, r, errs)
+        return
+    }
+
+    now := time.Now().UTC()
+    for id, status := range decisions {
+        m := &proposal.Matches[index[id]]
+        m.Status, m.ReviewedAt = status, &now
+    }
+    proposal.Present = []int{}
+    for _, m := range proposal.Matches {
+        if m.Status == MatchConfirmed {
+            proposal.Present = append(proposal.Present, m.StudentID)
+        }
+    }
+    sort.Ints(proposal.Present)
+    json.NewEncoder(w).Encode(proposal)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+    "github.com/gorilla/mux"
+)
+
+// Summary feedback ratings
+const (
+    RatingUp   = "up"
+    RatingDown = "down"
+)
+
+// maxFeedbackComment caps the free-text comment length
+const maxFeedbackComment = 1000
+
+// SummaryFeedback is a rating of a generated summary, tied to the prompt variant and model that produced it
+type SummaryFeedback struct {
+    ID        int       `json:"id"`
+    StudentID int       `json:"student_id"`
+    Rating    string    `json:"rating"`
+    Comment   string    `json:"comment,omitempty"`
+    Model     string    `json:"model"`
+    Variant   string    `json:"variant"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+// Validate checks if feedback data is valid
+func (f SummaryFeedback) Validate() []ValidationError {
+    var errors []ValidationError
+
+    if f.Rating != RatingUp && f.Rating != RatingDown {
+        errors = append(errors, ValidationError{
+            Field:   "rating",
+            Code:    CodeOutOfRange,
+            Message: "Rating must be \"up\" or \"down\"",
+        })
+    }
+
+    if len(f.Comment) > maxFeedbackComment {
+        errors = append(errors, ValidationError{
+            Field:   "comment",
+            Code:    CodeOutOfRange,
+            Message: "Comment must be at most 1000 characters",
+        })
+    }
+
+    return errors
+}
+
+// FeedbackMetrics aggregates ratings for one model and prompt variant
+type FeedbackMetrics struct {
+    Model        string  `json:"model"`
+    Variant      string  `json:"variant"`
+    Up           int     `json:"up"`
+    Down         int     `json:"down"`
+    Total        int     `json:"total"`
+    ApprovalRate float64 `json:"approval_rate"`
+    Comments     int     `json:"comments"`
+}
+
+// FeedbackStore keeps summary feedback with thread-safe operations
+type FeedbackStore struct {
+    sync.RWMutex
+    feedback []SummaryFeedback
+    nextID   int
+}
+
+// NewFeedbackStore initializes a new FeedbackStore
+func NewFeedbackStore() *FeedbackStore {
+    return &FeedbackStore{nextID: 1}
+}
+
+// Add stores feedback and assigns its ID
+func (s *FeedbackStore) Add(f SummaryFeedback) SummaryFeedback {
+    s.Lock()
+    defer s.Unlock()
+    f.ID = s.nextID
+    s.nextID++
+    s.feedback = append(s.feedback, f)
+    return f
+}
+
+// Metrics aggregates feedback per model and prompt variant
+func (s *FeedbackStore) Metrics() []FeedbackMetrics {
+    s.RLock()
+    byKey := make(map[[2]string]*FeedbackMetrics)
+    for _, f := range s.feedback {
+        key := [2]string{f.Model, f.Variant}
+        m, ok := byKey[key]
+        if !ok {
+            m = &FeedbackMetrics{Model: f.Model, Variant: f.Variant}
+            byKey[key] = m
+        }
+        if f.Rating == RatingUp {
+            m.Up++
+        } else {
+            m.Down++
+        }
+        if f.Comment != "" {
+            m.Comments++
+        }
+    }
+    s.RUnlock()
+
+    metrics := make([]FeedbackMetrics, 0, len(byKey))
+    for _, m := range byKey {
+        m.Total = m.Up + m.Down
+        m.ApprovalRate = float64(m.Up) / float64(m.Total)
+        metrics = append(metrics, *m)
+    }
+    sort.Slice(metrics, func(i, j int) bool {
+        if metrics[i].Model != metrics[j].Model {
+            return metrics[i].Model < metrics[j].Model
+        }
+        return metrics[i].Variant < metrics[j].Variant
+    })
+    return metrics
+}
+
+func (app *App) CreateSummaryFeedback(w http.ResponseWriter, r *http.Request) {
+    store := app.storeFor(r)
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        httpError(w, r, "Invalid ID", http.StatusBadRequest)
+        return
+    }
+
+    if _, err := store.Get(id); err != nil {
+        writeStoreError(w, r, err)
+        return
+    }
+
+    var feedback SummaryFeedback
+    if err := json.NewDecoder(r.Body).Decode(&feedback); err != nil {
+        httpError(w, r, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+
+    if errors := feedback.Validate(); len(errors) > 0 {
+        writeValidationErrors(w, r, errors)
+        return
+    }
+
+    // Clients echo the model and variant from the summary response; fall
+    // back to the current configuration and the student's stable assignment.
+    if feedback.Model == "" {
+        feedback.Model = app.models.Primary(TaskSummary)
+    }
+    if feedback.Variant == "" {
+        feedback.Variant = app.prompts.VariantFor(id).Name
+    }
+    feedback.StudentID = id
+    feedback.CreatedAt = time.Now().UTC()
+
+    feedback = app.feedback.Add(feedback)
+
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(feedback)
+}
+
+func (app *App) GetSummaryFeedbackMetrics(w http.ResponseWriter, r *http.Request) {
+    json.NewEncoder(w).Encode(app.feedback.Metrics())
+}
@@ -0,0 +1,643 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "net/url"
+    "sort"
+    "strconv"
+    "strings"
+    "unicode"
+)
+
+// Limits that keep hostile filter expressions cheap to parse and run
+const (
+    maxFilterLength = 1024
+    maxFilterDepth  = 32
+)
+
+// CodeInvalidFilter is the validation error code for unparseable or disallowed filters
+const CodeInvalidFilter = "invalid_filter"
+
+// filterFieldKind is the value type of a filterable field
+type filterFieldKind int
+
+const (
+    kindNumber filterFieldKind = iota
+    kindString
+)
+
+// filterFields is the allowlist of fields a filter may reference, mapped to
+// their type and SQL column
+var filterFields = map[string]struct {
+    kind   filterFieldKind
+    column string
+}{
+    "id":    {kindNumber, "id"},
+    "name":  {kindString, "name"},
+    "age":   {kindNumber, "age"},
+    "email": {kindString, "email"},
+}
+
+// filterOperators lists the operators allowed for each field type
+var filterOperators = map[filterFieldKind]map[string]bool{
+    kindNumber: {"=": true, "!=": true, ">": true, ">=": true, "<": true, "<=": true},
+    kindString: {"=": true, "!=": true, "contains": true, "startswith": true, "endswith": true},
+}
+
+// Filter is a parsed, validated filter expression such as
+// `age>=18 AND email endswith "@school.edu"`. It can be evaluated against a
+// student in memory or compiled to a parameterized SQL condition.
+type Filter struct {
+    root filterNode
+}
+
+type filterNode interface {
+    match(s Student) bool
+    sql(b *strings.Builder, args *[]interface{})
+}
+
+type logicalNode struct {
+    op          string // "AND" or "OR"
+    left, right filterNode
+}
+
+type notNode struct {
+    inner filterNode
+}
+
+type comparisonNode struct {
+    field string
+    op    string
+    num   int
+    str   string
+}
+
+func (n *logicalNode) match(s Student) bool {
+    if n.op == "AND" {
+        return n.left.match(s) && n.right.match(s)
+    }
+    return n.left.match(s) || n.right.match(s)
+}
+
+func (n *logicalNode) sql(b *strings.Builder, args *[]interface{}) {
+    b.WriteString("(")
+    n.left.sql(b, args)
+    b.WriteString(" " + n.op + " ")
+    n.right.sql(b, args)
+    b.WriteString(")")
+}
+
+func (n *notNode) match(s Student) bool {
+    return !n.inner.match(s)
+}
+
+func (n *notNode) sql(b *strings.Builder, args *[]interface{}) {
+    b.WriteString("NOT ")
+    n.inner.sql(b, args)
+}
+
+func (n *comparisonNode) match(s Student) bool {
+    switch n.field {
+    case "id":
+        return compareNumbers(s.ID, n.op, n.num)
+    case "age":
+        return compareNumbers(s.Age, n.op, n.num)
+    case "name":
+        return compareStrings(s.Name, n.op, n.str)
+    default:
+        return compareStrings(s.Email, n.op, n.str)
+    }
+}
+
+func (n *comparisonNode) sql(b *strings.Builder, args *[]interface{}) {
+    column := filterFields[n.field].column
+    switch n.op {
+    case "contains":
+        b.WriteString(column + ` LIKE ? ESCAPE '\'`)
+        *args = append(*args, "%"+escapeLike(n.str)+"%")
+    case "startswith":
+        b.WriteString(column + ` LIKE ? ESCAPE '\'`)
+        *args = append(*args, escapeLike(n.str)+"%")
+    case "endswith":
+        b.WriteString(column + ` LIKE ? ESCAPE '\'`)
+        *args = append(*args, "%"+escapeLike(n.str))
+    case "!=":
+        b.WriteString(column + " <> ?")
+        *args = append(*args, n.value())
+    default:
+        b.WriteString(column + " " + n.op + " ?")
+        *args = append(*args, n.value())
+    }
+}
+
+// deletedNode matches students by whether they are deleted. Filter
+// expressions cannot name it; StudentStore adds it to leave deleted
+// students out of reads.
+type deletedNode struct {
+    deleted bool
+}
+
+func (n deletedNode) match(s Student) bool {
+    return (s.DeletedAt != nil) == n.deleted
+}
+
+func (n deletedNode) sql(b *strings.Builder, args *[]interface{}) {
+    if n.deleted {
+        b.WriteString("deleted_at IS NOT NULL")
+    } else {
+        b.WriteString("deleted_at IS NULL")
+    }
+}
+
+// Filters selecting the students that are not deleted and those that are
+var (
+    liveStudents    = &Filter{root: deletedNode{}}
+    deletedStudents = &Filter{root: deletedNode{deleted: true}}
+)
+
+func (n *comparisonNode) value() interface{} {
+    if filterFields[n.field].kind == kindNumber {
+        return n.num
+    }
+    return n.str
+}
+
+func compareNumbers(a int, op string, b int) bool {
+    switch op {
+    case "=":
+        return a == b
+    case "!=":
+        return a != b
+    case ">":
+        return a > b
+    case ">=":
+        return a >= b
+    case "<":
+        return a < b
+    default:
+        return a <= b
+    }
+}
+
+// compareStrings matches SQL semantics: equality is exact while the LIKE-based
+// operators are case-insensitive. The ordering operators are not in
+// filterOperators for strings; only seekFilter builds them.
+func compareStrings(a, op, b string) bool {
+    switch op {
+    case "=":
+        return a == b
+    case "!=":
+        return a != b
+    case ">":
+        return a > b
+    case "<":
+        return a < b
+    case "contains":
+        return strings.Contains(strings.ToLower(a), strings.ToLower(b))
+    case "startswith":
+        return strings.HasPrefix(strings.ToLower(a), strings.ToLower(b))
+    default:
+        return strings.HasSuffix(strings.ToLower(a), strings.ToLower(b))
+    }
+}
+
+func escapeLike(s string) string {
+    return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// Match reports whether the student satisfies the filter; a nil filter matches everything
+func (f *Filter) Match(s Student) bool {
+    return f == nil || f.root.match(s)
+}
+
+// SQL compiles the filter to a condition with "?" placeholders and its arguments.
+// A nil filter compiles to a condition that is always true.
+func (f *Filter) SQL() (string, []interface{}) {
+    if f == nil {
+        return "1=1", nil
+    }
+    var b strings.Builder
+    var args []interface{}
+    f.root.sql(&b, &args)
+    return b.String(), args
+}
+
+// filterToken is a lexical token of the filter language
+type filterToken struct {
+    kind string // "ident", "op", "number", "string", "(", ")", "eof"
+    text string
+    pos  int
+}
+
+func lexFilter(input string) ([]filterToken, error) {
+    var tokens []filterToken
+    for i := 0; i < len(input); {
+        c := rune(input[i])
+        switch {
+        case unicode.IsSpace(c):
+            i++
+        case c == '(' || c == ')':
+            tokens = append(tokens, filterToken{kind: string(c), text: string(c), pos: i})
+            i++
+        case c == '"' || c == '\'':
+            var sb strings.Builder
+            j := i + 1
+            for ; j < len(input) && rune(input[j]) != c; j++ {
+                if input[j] == '\\' && j+1 < len(input) {
+                    j++
+                }
+                sb.WriteByte(input[j])
+            }
+            if j >= len(input) {
+                return nil, fmt.Errorf("unterminated string at position %d", i)
+            }
+            tokens = append(tokens, filterToken{kind: "string", text: sb.String(), pos: i})
+            i = j + 1
+        case strings.ContainsRune("=!<>", c):
+            j := i + 1
+            if j < len(input) && input[j] == '=' {
+                j++
+            }
+            op := input[i:j]
+            if op == "!" {
+                return nil, fmt.Errorf("unexpected '!' at position %d", i)
+            }
+            tokens = append(tokens, filterToken{kind: "op", text: op, pos: i})
+            i = j
+        case c == '-' || unicode.IsDigit(c):
+            j := i + 1
+            for j < len(input) && unicode.IsDigit(rune(input[j])) {
+                j++
+            }
+            tokens = append(tokens, filterToken{kind: "number", text: input[i:j], pos: i})
+            i = j
+        case unicode.IsLetter(c) || c == '_':
+            j := i + 1
+            for j < len(input) && (unicode.IsLetter(rune(input[j])) || unicode.IsDigit(rune(input[j])) || input[j] == '_') {
+                j++
+            }
+            tokens = append(tokens, filterToken{kind: "ident", text: input[i:j], pos: i})
+            i = j
+        default:
+            return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+        }
+    }
+    return append(tokens, filterToken{kind: "eof", pos: len(input)}), nil
+}
+
+// filterParser is a recursive-descent parser over the token stream:
+//
+//	expr       = and { "OR" and }
+//	and        = unary { "AND" unary }
+//	unary      = "NOT" unary | "(" expr ")" | comparison
+//	comparison = field operator value
+type filterParser struct {
+    tokens []filterToken
+    pos    int
+    depth  int
+}
+
+func (p *filterParser) peek() filterToken {
+    return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() filterToken {
+    t := p.tokens[p.pos]
+    if t.kind != "eof" {
+        p.pos++
+    }
+    return t
+}
+
+func (p *filterParser) keyword(word string) bool {
+    t := p.peek()
+    if t.kind == "ident" && strings.EqualFold(t.text, word) {
+        p.pos++
+        return true
+    }
+    return false
+}
+
+func (p *filterParser) expr() (filterNode, error) {
+    p.depth++
+    defer func() { p.depth-- }()
+    if p.depth > maxFilterDepth {
+        return nil, fmt.Errorf("filter is nested too deeply")
+    }
+
+    left, err := p.and()
+    if err != nil {
+        return nil, err
+    }
+    for p.keyword("OR") {
+        right, err := p.and()
+        if err != nil {
+            return nil, err
+        }
+        left = &logicalNode{op: "OR", left: left, right: right}
+    }
+    return left, nil
+}
+
+func (p *filterParser) and() (filterNode, error) {
+    left, err := p.unary()
+    if err != nil {
+        return nil, err
+    }
+    for p.keyword("AND") {
+        right, err := p.unary()
+        if err != nil {
+            return nil, err
+        }
+        left = &logicalNode{op: "AND", left: left, right: right}
+    }
+    return left, nil
+}
+
+func (p *filterParser) unary() (filterNode, error) {
+    if p.keyword("NOT") {
+        p.depth++
+        defer func() { p.depth-- }()
+        if p.depth > maxFilterDepth {
+            return nil, fmt.Errorf("filter is nested too deeply")
+        }
+        inner, err := p.unary()
+        if err != nil {
+            return nil, err
+        }
+        return &notNode{inner: inner}, nil
+    }
+
+    if p.peek().kind == "(" {
+        p.next()
+        inner, err := p.expr()
+        if err != nil {
+            return nil, err
+        }
+        if t := p.next(); t.kind != ")" {
+            return nil, fmt.Errorf("expected ')' at position %d", t.pos)
+        }
+        return inner, nil
+    }
+
+    return p.comparison()
+}
+
+func (p *filterParser) comparison() (filterNode, error) {
+    fieldTok := p.next()
+    if fieldTok.kind != "ident" {
+        return nil, fmt.Errorf("expected a field name at position %d", fieldTok.pos)
+    }
+    field := strings.ToLower(fieldTok.text)
+    spec, ok := filterFields[field]
+    if !ok {
+        return nil, fmt.Errorf("unknown field %q", fieldTok.text)
+    }
+
+    opTok := p.next()
+    op := strings.ToLower(opTok.text)
+    if opTok.kind != "op" && opTok.kind != "ident" {
+        return nil, fmt.Errorf("expected an operator at position %d", opTok.pos)
+    }
+    if !filterOperators[spec.kind][op] {
+        return nil, fmt.Errorf("operator %q is not allowed for field %q", opTok.text, field)
+    }
+
+    valueTok := p.next()
+    node := &comparisonNode{field: field, op: op}
+    switch spec.kind {
+    case kindNumber:
+        if valueTok.kind != "number" {
+            return nil, fmt.Errorf("field %q needs a number at position %d", field, valueTok.pos)
+        }
+        n, err := strconv.Atoi(valueTok.text)
+        if err != nil {
+            return nil, fmt.Errorf("invalid number %q", valueTok.text)
+        }
+        node.num = n
+    case kindString:
+        if valueTok.kind != "string" {
+            return nil, fmt.Errorf("field %q needs a quoted string at position %d", field, valueTok.pos)
+        }
+        node.str = valueTok.text
+    }
+    return node, nil
+}
+
+// ParseFilter parses and validates a filter expression
+func ParseFilter(input string) (*Filter, error) {
+    if len(input) > maxFilterLength {
+        return nil, fmt.Errorf("filter is longer than %d characters", maxFilterLength)
+    }
+    tokens, err := lexFilter(input)
+    if err != nil {
+        return nil, err
+    }
+    p := &filterParser{tokens: tokens}
+    root, err := p.expr()
+    if err != nil {
+        return nil, err
+    }
+    if t := p.peek(); t.kind != "eof" {
+        return nil, fmt.Errorf("unexpected %q at position %d", t.text, t.pos)
+    }
+    return &Filter{root: root}, nil
+}
+
+// And returns a filter matching students that satisfy both f and other;
+// either may be nil
+func (f *Filter) And(other *Filter) *Filter {
+    switch {
+    case f == nil:
+        return other
+    case other == nil:
+        return f
+    }
+    return &Filter{root: &logicalNode{op: "AND", left: f.root, right: other.root}}
+}
+
+// filterParams are the shorthand query parameters for common filters, each
+// mapped to the field and operator it compares with
+var filterParams = []struct {
+    param, field, op string
+}{
+    {"name", "name", "contains"},
+    {"email", "email", "="},
+    {"min_age", "age", ">="},
+    {"max_age", "age", "<="},
+}
+
+// filterFromRequest parses the ?filter= query parameter and ANDs it with the
+// ?name=, ?email=, ?min_age= and ?max_age= shorthands. It returns a nil
+// filter when none is given and a validation error when one is invalid.
+func filterFromRequest(r *http.Request) (*Filter, *ValidationError) {
+    return filterFromQuery(r.URL.Query())
+}
+
+// filterFromQuery is filterFromRequest for parameters from elsewhere, such
+// as GraphQL arguments
+func filterFromQuery(query url.Values) (*Filter, *ValidationError) {
+    var f *Filter
+    if input := query.Get("filter"); strings.TrimSpace(input) != "" {
+        parsed, err := ParseFilter(input)
+        if err != nil {
+            return nil, &ValidationError{Field: "filter", Code: CodeInvalidFilter, Message: err.Error()}
+        }
+        f = parsed
+    }
+    for _, p := range filterParams {
+        value := query.Get(p.param)
+        if value == "" {
+            continue
+        }
+        node := &comparisonNode{field: p.field, op: p.op, str: value}
+        if filterFields[p.field].kind == kindNumber {
+            n, err := strconv.Atoi(value)
+            if err != nil {
+                return nil, &ValidationError{Field: p.param, Code: CodeInvalidFilter, Message: p.param + " must be an integer"}
+            }
+            node.num, node.str = n, ""
+        }
+        f = f.And(&Filter{root: node})
+    }
+    return f, nil
+}
+
+// SortKey orders students by one field, descending when Desc is set
+type SortKey struct {
+    Field string
+    Desc  bool
+}
+
+// ParseSort parses a comma-separated list of fields such as "age,-name",
+// where a leading "-" sorts that field in descending order
+func ParseSort(input string) ([]SortKey, error) {
+    var keys []SortKey
+    seen := make(map[string]bool)
+    for _, part := range strings.Split(input, ",") {
+        part = strings.TrimSpace(part)
+        key := SortKey{Field: strings.TrimPrefix(part, "-"), Desc: strings.HasPrefix(part, "-")}
+        if _, ok := filterFields[key.Field]; !ok {
+            return nil, fmt.Errorf("cannot sort by %q", part)
+        }
+        if seen[key.Field] {
+            return nil, fmt.Errorf("%q is sorted on twice", key.Field)
+        }
+        seen[key.Field] = true
+        keys = append(keys, key)
+    }
+    return keys, nil
+}
+
+// sortFromRequest parses the ?sort= query parameter, returning nil when none
+// is given
+func sortFromRequest(r *http.Request) ([]SortKey, *ValidationError) {
+    input := r.URL.Query().Get("sort")
+    if strings.TrimSpace(input) == "" {
+        return nil, nil
+    }
+    keys, err := ParseSort(input)
+    if err != nil {
+        return nil, &ValidationError{Field: "sort", Code: CodeInvalidFilter, Message: err.Error()}
+    }
+    return keys, nil
+}
+
+// sortSQL compiles sort keys to an ORDER BY list; ID breaks ties so pages
+// stay stable
+func sortSQL(keys []SortKey) string {
+    var parts []string
+    for _, key := range keys {
+        part := filterFields[key.Field].column
+        if key.Desc {
+            part += " DESC"
+        }
+        parts = append(parts, part)
+        if key.Field == "id" {
+            return strings.Join(parts, ", ")
+        }
+    }
+    return strings.Join(append(parts, "id"), ", ")
+}
+
+// sortStudents orders students in place the way sortSQL orders rows
+func sortStudents(students []Student, keys []SortKey) {
+    sort.SliceStable(students, func(i, j int) bool {
+        a, b := students[i], students[j]
+        for _, key := range keys {
+            var c int
+            switch key.Field {
+            case "id":
+                c = a.ID - b.ID
+            case "age":
+                c = a.Age - b.Age
+            case "name":
+                c = strings.Compare(a.Name, b.Name)
+            default:
+                c = strings.Compare(a.Email, b.Email)
+            }
+            if c != 0 {
+                return (c < 0) != key.Desc
+            }
+        }
+        return a.ID < b.ID
+    })
+}
+
+// seekKeys returns the keys that fully order a listing: keys up to the first
+// on id, or keys followed by id when none is, as sortSQL orders rows
+func seekKeys(keys []SortKey) []SortKey {
+    for i, key := range keys {
+        if key.Field == "id" {
+            return keys[:i+1]
+        }
+    }
+    return append(append([]SortKey(nil), keys...), SortKey{Field: "id"})
+}
+
+// seekFilter matches the students that sort after last under keys, so a
+// listing can continue after a row without counting an offset that shifts
+// as rows are added or removed before it
+func seekFilter(keys []SortKey, last Student) *Filter {
+    var root filterNode
+    var equal filterNode
+    for _, key := range seekKeys(keys) {
+        op := ">"
+        if key.Desc {
+            op = "<"
+        }
+        var term filterNode = seekComparison(key.Field, op, last)
+        if equal != nil {
+            term = &logicalNode{op: "AND", left: equal, right: term}
+        }
+        if root == nil {
+            root = term
+        } else {
+            root = &logicalNode{op: "OR", left: root, right: term}
+        }
+        eq := seekComparison(key.Field, "=", last)
+        if equal == nil {
+            equal = eq
+        } else {
+            equal = &logicalNode{op: "AND", left: equal, right: eq}
+        }
+    }
+    return &Filter{root: root}
+}
+
+// seekComparison compares a field with its value in last
+func seekComparison(field, op string, last Student) *comparisonNode {
+    node := &comparisonNode{field: field, op: op}
+    switch field {
+    case "id":
+        node.num = last.ID
+    case "age":
+        node.num = last.Age
+    case "name":
+        node.str = last.Name
+    default:
+        node.str = last.Email
+    }
+    return node
+}
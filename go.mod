@@ -5,4 +5,52 @@ go 1.21
 
 require github.com/gorilla/mux v1.8.1
 
-require github.com/mattn/go-sqlite3 v1.14.24 
+require github.com/mattn/go-sqlite3 v1.14.24
+
+require golang.org/x/sync v0.10.0
+
+require github.com/lib/pq v1.10.9
+
+require github.com/go-sql-driver/mysql v1.8.1
+
+require golang.org/x/crypto v0.31.0
+
+require gopkg.in/yaml.v3 v3.0.1
+
+require github.com/BurntSushi/toml v1.4.0
+
+require golang.org/x/term v0.27.0
+
+require google.golang.org/grpc v1.60.1
+
+require google.golang.org/protobuf v1.32.0
+
+require google.golang.org/genproto/googleapis/rpc v0.0.0-20231002182017-d307bd883b97
+
+require github.com/graphql-go/graphql v0.8.1
+
+require github.com/gorilla/websocket v1.5.3
+
+require github.com/nats-io/nats.go v1.31.0
+
+require github.com/segmentio/kafka-go v0.4.47
+
+require filippo.io/edwards25519 v1.1.0 // indirect
+
+require golang.org/x/net v0.21.0 // indirect
+
+require golang.org/x/text v0.21.0 // indirect
+
+require golang.org/x/sys v0.28.0 // indirect
+
+require github.com/golang/protobuf v1.5.3 // indirect
+
+require google.golang.org/genproto v0.0.0-20231002182017-d307bd883b97 // indirect
+
+require github.com/klauspost/compress v1.17.0 // indirect
+
+require github.com/nats-io/nkeys v0.4.5 // indirect
+
+require github.com/nats-io/nuid v1.0.1 // indirect
+
+require github.com/pierrec/lz4/v4 v4.1.15 // indirect
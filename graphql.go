@@ -0,0 +1,639 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/url"
+    "sort"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "time"
+    "github.com/graphql-go/graphql"
+    "student-api/reqctx"
+)
+
+// GraphQL is the schema served at /graphql. Students are the root of every
+// query; their versions, notes and summary are fields of a student, so a
+// client asks for exactly the related data it shows.
+type GraphQL struct {
+    schema graphql.Schema
+    // maxSummaries bounds the summaries one request may ask for, as each may
+    // take a language model call
+    maxSummaries int
+}
+
+// LoadGraphQL builds the schema and reads GRAPHQL_MAX_SUMMARIES (default 5)
+func LoadGraphQL() (*GraphQL, error) {
+    maxSummaries := getEnvInt("GRAPHQL_MAX_SUMMARIES", 5)
+    if maxSummaries < 0 {
+        return nil, fmt.Errorf("GRAPHQL_MAX_SUMMARIES must not be negative, got %d", maxSummaries)
+    }
+    schema, err := newGraphQLSchema()
+    if err != nil {
+        return nil, fmt.Errorf("GraphQL schema: %w", err)
+    }
+    return &GraphQL{schema: schema, maxSummaries: maxSummaries}, nil
+}
+
+// graphqlRequest is the body of POST /graphql
+type graphqlRequest struct {
+    Query         string                 `json:"query"`
+    Variables     map[string]interface{} `json:"variables"`
+    OperationName string                 `json:"operationName"`
+}
+
+// graphqlCall is the request a resolver runs for
+type graphqlCall struct {
+    app       *App
+    r         *http.Request
+    summaries atomic.Int32
+}
+
+type graphqlCallKey struct{}
+
+func graphqlCallFrom(p graphql.ResolveParams) *graphqlCall {
+    return p.Context.Value(graphqlCallKey{}).(*graphqlCall)
+}
+
+// GraphQL executes a query or mutation: POST /graphql {"query": "...",
+// "variables": {...}}. Errors in the query are answered in the errors of a
+// 200 response, as GraphQL clients expect, each with the error envelope's
+// code in its extensions.
+func (app *App) GraphQL(w http.ResponseWriter, r *http.Request) {
+    var req graphqlRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Query) == "" {
+        httpError(w, r, `Invalid request body: expected {"query": "..."}`, http.StatusBadRequest)
+        return
+    }
+    call := &graphqlCall{app: app, r: r}
+    result := graphql.Do(graphql.Params{
+        Schema:         app.graphql.schema,
+        RequestString:  req.Query,
+        VariableValues: req.Variables,
+        OperationName:  req.OperationName,
+        Context:        context.WithValue(r.Context(), graphqlCallKey{}, call),
+    })
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
+
+// graphqlError is a resolver error with the code of the error envelope, and
+// the failed checks of a validation error, in its extensions
+type graphqlError struct {
+    code    string
+    message string
+    details []ValidationError
+}
+
+func (e *graphqlError) Error() string {
+    return e.message
+}
+
+func (e *graphqlError) Extensions() map[string]interface{} {
+    extensions := map[string]interface{}{"code": e.code}
+    if len(e.details) > 0 {
+        extensions["details"] = e.details
+    }
+    return extensions
+}
+
+func validationError(errs []ValidationError) error {
+    message := "Request validation failed"
+    if len(errs) == 1 {
+        message = errs[0].Message
+    }
+    return &graphqlError{code: CodeValidationFailed, message: message, details: errs}
+}
+
+// storeError is writeStoreError for resolvers
+func (c *graphqlCall) storeError(err error) error {
+    if errors.Is(err, errStudentNotFound) {
+        return &graphqlError{code: CodeNotFound, message: "Student not found"}
+    }
+    reqctx.Logger(c.r.Context()).Error("student store failed", "error", err)
+    return &graphqlError{code: statusCode(http.StatusInternalServerError), message: "Internal server error"}
+}
+
+// requireRole checks the caller's role for mutations, which share the
+// endpoint with queries open to readonly principals
+func (c *graphqlCall) requireRole(required string) error {
+    role := reqctx.Role(c.r.Context())
+    if role == "" || hasRole(role, required) {
+        return nil
+    }
+    return &graphqlError{code: statusCode(http.StatusForbidden), message: fmt.Sprintf("Role %s may not run mutations; %s required", role, required)}
+}
+
+func newGraphQLSchema() (graphql.Schema, error) {
+    // StudentRecord is a student without its related data, as kept in each
+    // version; it keeps the types acyclic, bounding how deep a query goes
+    record := graphql.NewObject(graphql.ObjectConfig{
+        Name:        "StudentRecord",
+        Description: "A student's fields as recorded in one version",
+        Fields:      studentScalarFields(),
+    })
+    fieldChange := graphql.NewObject(graphql.ObjectConfig{
+        Name: "FieldChange",
+        Fields: graphql.Fields{
+            "field": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+            "from":  &graphql.Field{Type: graphql.String},
+            "to":    &graphql.Field{Type: graphql.String},
+        },
+    })
+    version := graphql.NewObject(graphql.ObjectConfig{
+        Name: "StudentVersion",
+        Fields: graphql.Fields{
+            "seq":       &graphql.Field{Type: graphql.NewNonNull(graphql.Int), Description: "Position in the store's history"},
+            "version":   &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+            "operation": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+            "at":        &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+            "student":   &graphql.Field{Type: graphql.NewNonNull(record)},
+            "changes": &graphql.Field{
+                Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(fieldChange))),
+                Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+                    return fieldChangeList(p.Source.(StudentVersion).Changes), nil
+                },
+            },
+        },
+    })
+    studentEvent := graphql.NewObject(graphql.ObjectConfig{
+        Name:        "StudentEvent",
+        Description: "A change to a student, as published to GET /events",
+        Fields: graphql.Fields{
+            "type": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+            "seq":  &graphql.Field{Type: graphql.NewNonNull(graphql.Int), Description: "Position in the store's history"},
+            "studentId": &graphql.Field{
+                Type: graphql.NewNonNull(graphql.Int),
+                Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+                    return p.Source.(Event).StudentID, nil
+                },
+            },
+            "version": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+            "student": &graphql.Field{Type: graphql.NewNonNull(record)},
+            "changes": &graphql.Field{
+                Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(fieldChange))),
+                Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+                    return fieldChangeList(p.Source.(Event).Changes), nil
+                },
+            },
+            "at": &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+        },
+    })
+    insightFields := func() graphql.Fields {
+        return graphql.Fields{
+            "summary":        &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+            "strengths":      &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String)))},
+            "risks":          &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String)))},
+            "recommendation": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+        }
+    }
+    insights := graphql.NewObject(graphql.ObjectConfig{Name: "Insights", Fields: insightFields()})
+    summaryFields := insightFields()
+    summaryFields["model"] = &graphql.Field{Type: graphql.NewNonNull(graphql.String)}
+    summaryFields["variant"] = &graphql.Field{Type: graphql.NewNonNull(graphql.String)}
+    summaryFields["generatedAt"] = &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)}
+    summaryFields["stale"] = &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)}
+    summaryFields["generating"] = &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)}
+    summary := graphql.NewObject(graphql.ObjectConfig{Name: "StudentSummary", Fields: summaryFields})
+    note := graphql.NewObject(graphql.ObjectConfig{
+        Name: "Note",
+        Fields: graphql.Fields{
+            "id":       &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+            "source":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+            "text":     &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+            "model":    &graphql.Field{Type: graphql.String},
+            "insights": &graphql.Field{Type: insights},
+            "createdAt": &graphql.Field{
+                Type: graphql.NewNonNull(graphql.DateTime),
+                Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+                    return p.Source.(Note).CreatedAt, nil
+                },
+            },
+        },
+    })
+
+    studentFields := studentScalarFields()
+    studentFields["versions"] = &graphql.Field{
+        Type:    graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(version))),
+        Resolve: resolveVersions,
+    }
+    studentFields["notes"] = &graphql.Field{
+        Type:    graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(note))),
+        Resolve: resolveNotes,
+    }
+    studentFields["summary"] = &graphql.Field{
+        Type:        summary,
+        Description: "The generated summary; a request may ask for at most GRAPHQL_MAX_SUMMARIES, each counting against the caller's LLM quota",
+        Args: graphql.FieldConfigArgument{
+            "refresh": &graphql.ArgumentConfig{Type: graphql.Boolean, DefaultValue: false, Description: "Regenerate rather than answer from the cache"},
+        },
+        Resolve: resolveSummary,
+    }
+    student := graphql.NewObject(graphql.ObjectConfig{Name: "Student", Fields: studentFields})
+
+    page := graphql.NewObject(graphql.ObjectConfig{
+        Name: "StudentPage",
+        Fields: graphql.Fields{
+            "total":  &graphql.Field{Type: graphql.NewNonNull(graphql.Int), Description: "Students matching the filter, across pages"},
+            "limit":  &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+            "offset": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+            "items": &graphql.Field{
+                Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(student))),
+                Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+                    return p.Source.(StudentPage).Data, nil
+                },
+            },
+        },
+    })
+    searchResult := graphql.NewObject(graphql.ObjectConfig{
+        Name: "SearchResult",
+        Fields: graphql.Fields{
+            "student": &graphql.Field{Type: graphql.NewNonNull(student)},
+            "score":   &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+        },
+    })
+    studentInput := graphql.NewInputObject(graphql.InputObjectConfig{
+        Name: "StudentInput",
+        Fields: graphql.InputObjectConfigFieldMap{
+            "name":  &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+            "age":   &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.Int)},
+            "email": &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+        },
+    })
+
+    query := graphql.NewObject(graphql.ObjectConfig{
+        Name: "Query",
+        Fields: graphql.Fields{
+            "student": &graphql.Field{
+                Type:        student,
+                Description: "A student by ID, null when there is none",
+                Args: graphql.FieldConfigArgument{
+                    "id":   &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+                    "asOf": &graphql.ArgumentConfig{Type: graphql.DateTime, Description: "Read the student as it was at this time"},
+                },
+                Resolve: resolveStudent,
+            },
+            "students": &graphql.Field{
+                Type:        graphql.NewNonNull(page),
+                Description: "A page of students, filtered and sorted as GET /students",
+                Args: graphql.FieldConfigArgument{
+                    "filter": &graphql.ArgumentConfig{Type: graphql.String, Description: `Filter expression, e.g. age>=18 AND email endswith "@school.edu"`},
+                    "name":   &graphql.ArgumentConfig{Type: graphql.String, Description: "Name contains"},
+                    "email":  &graphql.ArgumentConfig{Type: graphql.String, Description: "Email equals"},
+                    "minAge": &graphql.ArgumentConfig{Type: graphql.Int},
+                    "maxAge": &graphql.ArgumentConfig{Type: graphql.Int},
+                    "sort":   &graphql.ArgumentConfig{Type: graphql.String, Description: "Comma-separated sort fields, - for descending, e.g. age,-name"},
+                    "limit":  &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: defaultPageLimit},
+                    "offset": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 0},
+                },
+                Resolve: resolveStudents,
+            },
+            "search": &graphql.Field{
+                Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(searchResult))),
+                Description: "Students matching every word by name or email, most relevant first",
+                Args: graphql.FieldConfigArgument{
+                    "q":     &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+                    "limit": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: defaultSearchLimit},
+                },
+                Resolve: resolveSearch,
+            },
+        },
+    })
+
+    idArg := &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)}
+    inputArg := &graphql.ArgumentConfig{Type: graphql.NewNonNull(studentInput)}
+    mutation := graphql.NewObject(graphql.ObjectConfig{
+        Name: "Mutation",
+        Fields: graphql.Fields{
+            "createStudent": &graphql.Field{
+                Type:    graphql.NewNonNull(student),
+                Args:    graphql.FieldConfigArgument{"input": inputArg},
+                Resolve: resolveCreateStudent,
+            },
+            "updateStudent": &graphql.Field{
+                Type:    graphql.NewNonNull(student),
+                Args:    graphql.FieldConfigArgument{"id": idArg, "input": inputArg},
+                Resolve: resolveUpdateStudent,
+            },
+            "deleteStudent": &graphql.Field{
+                Type:    graphql.NewNonNull(graphql.Boolean),
+                Args:    graphql.FieldConfigArgument{"id": idArg},
+                Resolve: resolveDeleteStudent,
+            },
+        },
+    })
+
+    // Subscriptions are served over WebSocket at /graphql/ws
+    subscription := graphql.NewObject(graphql.ObjectConfig{
+        Name: "Subscription",
+        Fields: graphql.Fields{
+            "studentUpdated": &graphql.Field{
+                Type:        graphql.NewNonNull(studentEvent),
+                Description: "Updates to students, optionally only those with the given IDs or changing one of the given fields",
+                Args: graphql.FieldConfigArgument{
+                    "ids":    &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.Int))},
+                    "fields": &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String)), Description: "name, age or email"},
+                },
+                Subscribe: subscribeStudentEvents(EventStudentUpdated),
+                Resolve:   resolveStudentEvent,
+            },
+            "enrollmentCreated": &graphql.Field{
+                Type:        graphql.NewNonNull(studentEvent),
+                Description: "Students as they are enrolled: created, or restored after a delete",
+                Subscribe:   subscribeStudentEvents(EventStudentCreated),
+                Resolve:     resolveStudentEvent,
+            },
+        },
+    })
+    return graphql.NewSchema(graphql.SchemaConfig{Query: query, Mutation: mutation, Subscription: subscription})
+}
+
+// fieldChangeList lists changes by field name for the FieldChange type
+func fieldChangeList(changes map[string]FieldChange) []map[string]interface{} {
+    list := make([]map[string]interface{}, 0, len(changes))
+    for field, change := range changes {
+        list = append(list, map[string]interface{}{"field": field, "from": fmt.Sprint(change.From), "to": fmt.Sprint(change.To)})
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i]["field"].(string) < list[j]["field"].(string) })
+    return list
+}
+
+// studentScalarFields are a student's own fields, resolved from Student by
+// their JSON names
+func studentScalarFields() graphql.Fields {
+    return graphql.Fields{
+        "id":    &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+        "name":  &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+        "age":   &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+        "email": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+        "updatedAt": &graphql.Field{
+            Type: graphql.NewNonNull(graphql.DateTime),
+            Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+                return p.Source.(Student).UpdatedAt, nil
+            },
+        },
+    }
+}
+
+func resolveStudent(p graphql.ResolveParams) (interface{}, error) {
+    call := graphqlCallFrom(p)
+    store := call.app.storeFor(call.r)
+    id := p.Args["id"].(int)
+    if asOf, ok := p.Args["asOf"].(time.Time); ok {
+        student, exists, err := store.AsOf(id, asOf)
+        if err != nil {
+            return nil, call.storeError(err)
+        }
+        if !exists {
+            return nil, nil
+        }
+        call.app.recordAccess(call.r, fieldsStudent, id)
+        return student, nil
+    }
+    student, err := store.Get(id)
+    if errors.Is(err, errStudentNotFound) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, call.storeError(err)
+    }
+    call.app.recordAccess(call.r, fieldsStudent, id)
+    return student, nil
+}
+
+// graphqlFilterParams maps the students arguments to the query parameters
+// of GET /students
+var graphqlFilterParams = map[string]string{"filter": "filter", "name": "name", "email": "email", "minAge": "min_age", "maxAge": "max_age"}
+
+func resolveStudents(p graphql.ResolveParams) (interface{}, error) {
+    call := graphqlCallFrom(p)
+    query := url.Values{}
+    for arg, param := range graphqlFilterParams {
+        switch value := p.Args[arg].(type) {
+        case string:
+            query.Set(param, value)
+        case int:
+            query.Set(param, strconv.Itoa(value))
+        }
+    }
+    filter, ferr := filterFromQuery(query)
+    if ferr != nil {
+        return nil, validationError([]ValidationError{*ferr})
+    }
+    opts := ListOptions{Filter: filter}
+    if input, _ := p.Args["sort"].(string); strings.TrimSpace(input) != "" {
+        keys, err := ParseSort(input)
+        if err != nil {
+            return nil, validationError([]ValidationError{{Field: "sort", Code: CodeInvalidFilter, Message: err.Error()}})
+        }
+        opts.Sort = keys
+    }
+    opts.Limit, opts.Offset = p.Args["limit"].(int), p.Args["offset"].(int)
+    if opts.Limit < 1 || opts.Limit > maxPageLimit {
+        return nil, validationError([]ValidationError{{Field: "limit", Code: CodeOutOfRange, Message: fmt.Sprintf("Limit must be between 1 and %d", maxPageLimit)}})
+    }
+    if opts.Offset < 0 {
+        return nil, validationError([]ValidationError{{Field: "offset", Code: CodeOutOfRange, Message: "Offset must be a non-negative integer"}})
+    }
+
+    students, total, err := call.app.storeFor(call.r).Page(opts)
+    if err != nil {
+        return nil, call.storeError(err)
+    }
+    call.app.recordAccess(call.r, fieldsStudent, studentIDs(students)...)
+    return StudentPage{Data: students, Total: total, Limit: opts.Limit, Offset: opts.Offset}, nil
+}
+
+func resolveSearch(p graphql.ResolveParams) (interface{}, error) {
+    call := graphqlCallFrom(p)
+    terms := searchTerms(p.Args["q"].(string))
+    if len(terms) == 0 || len(terms) > maxSearchTerms {
+        return nil, validationError([]ValidationError{{Field: "q", Code: CodeRequired, Message: fmt.Sprintf("Query must have between 1 and %d words", maxSearchTerms)}})
+    }
+    limit := p.Args["limit"].(int)
+    if limit < 1 || limit > maxSearchLimit {
+        return nil, validationError([]ValidationError{{Field: "limit", Code: CodeOutOfRange, Message: fmt.Sprintf("Limit must be between 1 and %d", maxSearchLimit)}})
+    }
+    results, err := call.app.storeFor(call.r).Search(terms, limit)
+    if err != nil {
+        return nil, call.storeError(err)
+    }
+    ids := make([]int, len(results))
+    for i, result := range results {
+        ids[i] = result.Student.ID
+    }
+    call.app.recordAccess(call.r, fieldsStudent, ids...)
+    return results, nil
+}
+
+func resolveVersions(p graphql.ResolveParams) (interface{}, error) {
+    call := graphqlCallFrom(p)
+    student := p.Source.(Student)
+    call.app.recordAccess(call.r, fieldsStudent, student.ID)
+    versions, err := call.app.storeFor(call.r).Versions(student.ID)
+    if err != nil {
+        return nil, call.storeError(err)
+    }
+    return versions, nil
+}
+
+func resolveNotes(p graphql.ResolveParams) (interface{}, error) {
+    call := graphqlCallFrom(p)
+    student := p.Source.(Student)
+    call.app.recordAccess(call.r, fieldsNotes, student.ID)
+    return call.app.notes.List(reqctx.From(p.Context).Tenant, student.ID), nil
+}
+
+func resolveSummary(p graphql.ResolveParams) (interface{}, error) {
+    call := graphqlCallFrom(p)
+    if n := int(call.summaries.Add(1)); n > call.app.graphql.maxSummaries {
+        return nil, &graphqlError{code: "too_many_summaries", message: fmt.Sprintf("A request may ask for at most %d summaries", call.app.graphql.maxSummaries)}
+    }
+    if call.app.llmQuotas != nil {
+        status, denied, _ := call.app.llmQuotas.Take(call.app.llmQuotaUser(call.r), time.Now())
+        if denied != "" {
+            call.app.metrics.Inc("llm_quota_denied_total", "limit", denied)
+            code, message := llmQuotaDenial(status, denied)
+            return nil, &graphqlError{code: code, message: message}
+        }
+    }
+    student := p.Source.(Student)
+    summary, err := call.app.cachedSummary(p.Context, student, p.Args["refresh"].(bool))
+    if errors.Is(err, errLLMQueueFull) {
+        return nil, &graphqlError{code: statusCode(http.StatusServiceUnavailable), message: "The summary service is busy, try again later"}
+    }
+    if err != nil {
+        reqctx.Logger(p.Context).Error("summary generation failed", "student_id", student.ID, "error", err)
+        return nil, &graphqlError{code: statusCode(http.StatusBadGateway), message: "Failed to generate summary"}
+    }
+    call.app.recordAccess(call.r, fieldsSummary, student.ID)
+    return map[string]interface{}{
+        "summary":        summary.Summary,
+        "strengths":      summary.Strengths,
+        "risks":          summary.Risks,
+        "recommendation": summary.Recommendation,
+        "model":          summary.Model,
+        "variant":        summary.Variant,
+        "generatedAt":    summary.GeneratedAt,
+        "stale":          summary.Stale,
+        "generating":     summary.Generating,
+    }, nil
+}
+
+// studentFromInput reads a StudentInput argument
+func studentFromInput(p graphql.ResolveParams) Student {
+    input := p.Args["input"].(map[string]interface{})
+    return Student{Name: input["name"].(string), Age: input["age"].(int), Email: input["email"].(string)}
+}
+
+func resolveCreateStudent(p graphql.ResolveParams) (interface{}, error) {
+    call := graphqlCallFrom(p)
+    if err := call.requireRole(RoleTeacher); err != nil {
+        return nil, err
+    }
+    student := studentFromInput(p)
+    if errs := call.app.validateStudent(student); len(errs) > 0 {
+        return nil, validationError(errs)
+    }
+    student, version, err := call.app.storeFor(call.r).Create(student)
+    if err != nil {
+        return nil, call.storeError(err)
+    }
+    call.app.recordChanges(call.r, version)
+    return student, nil
+}
+
+func resolveUpdateStudent(p graphql.ResolveParams) (interface{}, error) {
+    call := graphqlCallFrom(p)
+    if err := call.requireRole(RoleTeacher); err != nil {
+        return nil, err
+    }
+    student := studentFromInput(p)
+    if errs := call.app.validateStudent(student); len(errs) > 0 {
+        return nil, validationError(errs)
+    }
+    student.ID = p.Args["id"].(int)
+    student, version, err := call.app.storeFor(call.r).Update(student)
+    if err != nil {
+        return nil, call.storeError(err)
+    }
+    call.app.recordChanges(call.r, version)
+    return student, nil
+}
+
+func resolveDeleteStudent(p graphql.ResolveParams) (interface{}, error) {
+    call := graphqlCallFrom(p)
+    if err := call.requireRole(RoleTeacher); err != nil {
+        return nil, err
+    }
+    version, err := call.app.storeFor(call.r).Delete(p.Args["id"].(int))
+    if err != nil {
+        return nil, call.storeError(err)
+    }
+    call.app.recordChanges(call.r, version)
+    return true, nil
+}
+
+// subscribeStudentEvents returns the source of a subscription to the
+// caller's tenant's events of one type, filtered by the ids and fields
+// arguments. Like GET /events, a subscriber reading too slowly misses
+// events rather than slowing writes.
+func subscribeStudentEvents(eventType string) graphql.FieldResolveFn {
+    return func(p graphql.ResolveParams) (interface{}, error) {
+        call := graphqlCallFrom(p)
+        filter := EventFilter{Types: []string{eventType}}
+        ids, _ := p.Args["ids"].([]interface{})
+        for _, id := range ids {
+            if id.(int) < 1 {
+                return nil, validationError([]ValidationError{{Field: "ids", Code: CodeInvalidFilter, Message: fmt.Sprintf("Invalid student ID %d", id)}})
+            }
+            filter.IDs = append(filter.IDs, id.(int))
+        }
+        fields, _ := p.Args["fields"].([]interface{})
+        for _, field := range fields {
+            if !diffFields[field.(string)] {
+                return nil, validationError([]ValidationError{{Field: "fields", Code: CodeInvalidFilter, Message: fmt.Sprintf("Unknown field %q", field)}})
+            }
+            filter.Fields = append(filter.Fields, field.(string))
+        }
+
+        tenant := call.app.storeFor(call.r).tenant
+        events, unsubscribe := call.app.events.SubscribeFiltered(call.app.sockets.buffer, filter)
+        source := make(chan interface{})
+        go func() {
+            defer unsubscribe()
+            for {
+                select {
+                case <-p.Context.Done():
+                    return
+                case e := <-events:
+                    if e.Tenant != tenant {
+                        continue
+                    }
+                    select {
+                    case source <- e:
+                    case <-p.Context.Done():
+                        return
+                    }
+                }
+            }
+        }()
+        return source, nil
+    }
+}
+
+// resolveStudentEvent sends a subscription its next event, recording the
+// read of its student
+func resolveStudentEvent(p graphql.ResolveParams) (interface{}, error) {
+    e, ok := p.Source.(Event)
+    if !ok {
+        return nil, &graphqlError{code: statusCode(http.StatusBadRequest), message: "Subscriptions are served over WebSocket at /graphql/ws"}
+    }
+    call := graphqlCallFrom(p)
+    call.app.recordAccess(call.r, fieldsStudent, e.StudentID)
+    return call.app.masker.Event(e), nil
+}
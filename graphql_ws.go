@@ -0,0 +1,296 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strings"
+    "time"
+    "github.com/gorilla/websocket"
+    "github.com/graphql-go/graphql"
+    "github.com/graphql-go/graphql/language/ast"
+    "github.com/graphql-go/graphql/language/parser"
+    "student-api/reqctx"
+)
+
+// graphqlWSProtocol is the WebSocket subprotocol of the graphql-ws library,
+// which Apollo, urql and Relay clients speak
+const graphqlWSProtocol = "graphql-transport-ws"
+
+// Messages of the graphql-transport-ws protocol
+const (
+    gqlConnectionInit = "connection_init"
+    gqlConnectionAck  = "connection_ack"
+    gqlPing           = "ping"
+    gqlPong           = "pong"
+    gqlSubscribe      = "subscribe"
+    gqlNext           = "next"
+    gqlError          = "error"
+    gqlComplete       = "complete"
+)
+
+// Close codes of the graphql-transport-ws protocol
+const (
+    gqlCloseBadRequest   = 4400
+    gqlCloseUnauthorized = 4401
+    gqlCloseInitTimeout  = 4408
+    gqlCloseDuplicateID  = 4409
+    gqlCloseTooManyInits = 4429
+)
+
+// graphqlWSInitTimeout is how long a client has to send connection_init
+const graphqlWSInitTimeout = 10 * time.Second
+
+// graphqlWSMessage is a message of the protocol. Payload is a graphqlRequest
+// for subscribe, a result for next and a list of errors for error.
+type graphqlWSMessage struct {
+    ID      string          `json:"id,omitempty"`
+    Type    string          `json:"type"`
+    Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// graphqlWSReply is a message to the client
+type graphqlWSReply struct {
+    ID      string      `json:"id,omitempty"`
+    Type    string      `json:"type"`
+    Payload interface{} `json:"payload,omitempty"`
+}
+
+// ServeGraphQLSocket upgrades GET /graphql/ws to a WebSocket speaking the
+// graphql-transport-ws protocol. Clients run subscriptions, such as
+// subscription { studentUpdated(ids: [1]) { seq changes { field to } } },
+// and may send queries and mutations on the same connection. Connections
+// count against WS_MAX_CONNECTIONS and are pinged like those of GET /ws.
+func (app *App) ServeGraphQLSocket(w http.ResponseWriter, r *http.Request) {
+    if !containsString(websocket.Subprotocols(r), graphqlWSProtocol) {
+        httpError(w, r, "Expected the "+graphqlWSProtocol+" WebSocket subprotocol", http.StatusBadRequest)
+        return
+    }
+    conn, closeConn := app.sockets.open(app, w, r, http.Header{"Sec-WebSocket-Protocol": {graphqlWSProtocol}})
+    if conn == nil {
+        return
+    }
+    defer closeConn()
+    socket := &graphqlSocket{
+        app:     app,
+        r:       r,
+        conn:    conn,
+        sockets: app.sockets,
+        quit:    make(chan struct{}),
+        replies: make(chan graphqlWSReply, app.sockets.buffer),
+        ops:     make(map[string]context.CancelFunc),
+    }
+    socket.serve()
+}
+
+// graphqlSocket is one /graphql/ws connection. Only serve writes to it and
+// touches ops; operations hand it their results through replies.
+type graphqlSocket struct {
+    app     *App
+    r       *http.Request
+    conn    *websocket.Conn
+    sockets *EventSockets
+    // quit is closed when serve returns, releasing the reader and operations
+    quit    chan struct{}
+    replies chan graphqlWSReply
+    // ops cancels each running operation by its ID
+    ops   map[string]context.CancelFunc
+    acked bool
+}
+
+func (s *graphqlSocket) serve() {
+    requests := make(chan *graphqlWSMessage)
+    defer close(s.quit)
+    go s.read(requests)
+    defer func() {
+        for _, cancel := range s.ops {
+            cancel()
+        }
+    }()
+
+    ping := time.NewTicker(s.sockets.pingInterval)
+    defer ping.Stop()
+    initTimeout := time.NewTimer(graphqlWSInitTimeout)
+    defer initTimeout.Stop()
+    for {
+        var err error
+        select {
+        case <-s.sockets.done:
+            s.close(websocket.CloseGoingAway, "server shutting down")
+            return
+        case <-initTimeout.C:
+            if !s.acked {
+                s.close(gqlCloseInitTimeout, "Connection initialisation timeout")
+                return
+            }
+        case <-ping.C:
+            err = s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(s.sockets.writeTimeout))
+        case msg, ok := <-requests:
+            if !ok {
+                return
+            }
+            if !s.handle(msg) {
+                return
+            }
+        case reply := <-s.replies:
+            // A client's complete ends an operation before its last results
+            if _, running := s.ops[reply.ID]; !running {
+                continue
+            }
+            if reply.Type == gqlComplete || reply.Type == gqlError {
+                s.ops[reply.ID]()
+                delete(s.ops, reply.ID)
+            }
+            err = s.write(reply)
+        }
+        if err != nil {
+            return
+        }
+    }
+}
+
+// read passes the client's messages to serve, nil for one that is not a
+// protocol message, until the connection fails or the client goes quiet for
+// longer than WS_PONG_TIMEOUT
+func (s *graphqlSocket) read(requests chan<- *graphqlWSMessage) {
+    defer close(requests)
+    s.conn.SetReadLimit(64 << 10)
+    alive := func() { s.conn.SetReadDeadline(time.Now().Add(s.sockets.pongTimeout)) }
+    alive()
+    s.conn.SetPongHandler(func(string) error {
+        alive()
+        return nil
+    })
+    for {
+        kind, data, err := s.conn.ReadMessage()
+        if err != nil {
+            if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+                reqctx.Logger(s.r.Context()).Info("GraphQL WebSocket closed", "error", err)
+            }
+            return
+        }
+        alive()
+        msg := new(graphqlWSMessage)
+        if kind != websocket.TextMessage || json.Unmarshal(data, msg) != nil || msg.Type == "" {
+            msg = nil
+        }
+        select {
+        case requests <- msg:
+        case <-s.quit:
+            return
+        }
+    }
+}
+
+// handle answers one client message, reporting false once it has closed
+// the connection
+func (s *graphqlSocket) handle(msg *graphqlWSMessage) bool {
+    if msg == nil {
+        return s.close(gqlCloseBadRequest, "Invalid message")
+    }
+    switch msg.Type {
+    case gqlConnectionInit:
+        if s.acked {
+            return s.close(gqlCloseTooManyInits, "Too many initialisation requests")
+        }
+        s.acked = true
+        return s.write(graphqlWSReply{Type: gqlConnectionAck}) == nil
+    case gqlPing:
+        return s.write(graphqlWSReply{Type: gqlPong}) == nil
+    case gqlPong:
+        return true
+    case gqlSubscribe:
+        if !s.acked {
+            return s.close(gqlCloseUnauthorized, "Unauthorized")
+        }
+        var req graphqlRequest
+        if msg.ID == "" || json.Unmarshal(msg.Payload, &req) != nil || strings.TrimSpace(req.Query) == "" {
+            return s.close(gqlCloseBadRequest, "Invalid subscribe message")
+        }
+        if _, running := s.ops[msg.ID]; running {
+            return s.close(gqlCloseDuplicateID, fmt.Sprintf("Subscriber for %s already exists", msg.ID))
+        }
+        ctx, cancel := context.WithCancel(context.WithValue(s.r.Context(), graphqlCallKey{}, &graphqlCall{app: s.app, r: s.r}))
+        s.ops[msg.ID] = cancel
+        go s.run(ctx, msg.ID, graphql.Params{
+            Schema:         s.app.graphql.schema,
+            RequestString:  req.Query,
+            VariableValues: req.Variables,
+            OperationName:  req.OperationName,
+            Context:        ctx,
+        })
+        return true
+    case gqlComplete:
+        if cancel, running := s.ops[msg.ID]; running {
+            cancel()
+            delete(s.ops, msg.ID)
+        }
+        return true
+    default:
+        return s.close(gqlCloseBadRequest, fmt.Sprintf("Unknown message type %q", msg.Type))
+    }
+}
+
+// run executes an operation, sending each result and then complete. A
+// query or mutation has one result; a subscription one per event until it
+// is cancelled.
+func (s *graphqlSocket) run(ctx context.Context, id string, params graphql.Params) {
+    reply := func(r graphqlWSReply) {
+        select {
+        case s.replies <- r:
+        case <-s.quit:
+        }
+    }
+    if !isSubscription(params.RequestString, params.OperationName) {
+        reply(graphqlWSReply{ID: id, Type: gqlNext, Payload: graphql.Do(params)})
+        reply(graphqlWSReply{ID: id, Type: gqlComplete})
+        return
+    }
+    results := graphql.Subscribe(params)
+    // results must be drained after cancelling, or the executor blocks
+    for result := range results {
+        if ctx.Err() != nil {
+            continue
+        }
+        if result.HasErrors() && result.Data == nil {
+            reply(graphqlWSReply{ID: id, Type: gqlError, Payload: result.Errors})
+            return
+        }
+        reply(graphqlWSReply{ID: id, Type: gqlNext, Payload: result})
+    }
+    if ctx.Err() == nil {
+        reply(graphqlWSReply{ID: id, Type: gqlComplete})
+    }
+}
+
+// isSubscription reports whether the operation a request runs is a
+// subscription; a document that does not parse is left to the executor
+func isSubscription(query, operationName string) bool {
+    doc, err := parser.Parse(parser.ParseParams{Source: query})
+    if err != nil {
+        return false
+    }
+    for _, def := range doc.Definitions {
+        op, ok := def.(*ast.OperationDefinition)
+        if !ok {
+            continue
+        }
+        if operationName == "" || (op.Name != nil && op.Name.Value == operationName) {
+            return op.Operation == ast.OperationTypeSubscription
+        }
+    }
+    return false
+}
+
+// close ends the connection with a protocol close code and reports false,
+// for handle to return
+func (s *graphqlSocket) close(code int, reason string) bool {
+    s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(s.sockets.writeTimeout))
+    return false
+}
+
+func (s *graphqlSocket) write(reply graphqlWSReply) error {
+    s.conn.SetWriteDeadline(time.Now().Add(s.sockets.writeTimeout))
+    return s.conn.WriteJSON(reply)
+}
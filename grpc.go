@@ -0,0 +1,338 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/tls"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log/slog"
+    "net"
+    "net/http"
+    "net/url"
+    "strconv"
+    "time"
+    "google.golang.org/genproto/googleapis/rpc/errdetails"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/credentials"
+    "google.golang.org/grpc/metadata"
+    "google.golang.org/grpc/peer"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/runtime/protoiface"
+    "google.golang.org/protobuf/types/known/emptypb"
+    "google.golang.org/protobuf/types/known/timestamppb"
+    "student-api/studentpb"
+)
+
+// grpcRequestHeaders are the metadata keys passed on to the REST handlers as
+// request headers
+var grpcRequestHeaders = []string{"authorization", "x-api-key", "x-tenant-id", "x-request-id", ConsistencyTokenHeader, "user-agent"}
+
+// grpcResponseHeaders are the REST response headers returned as header
+// metadata
+var grpcResponseHeaders = []string{"X-Request-ID", "X-Operation-ID", ConsistencyTokenHeader, "X-RateLimit-Limit", "Retry-After", "X-LLM-Quota-Remaining", "X-LLM-RateLimit-Remaining"}
+
+// grpcCodes maps REST error statuses to gRPC codes; other 4xx statuses are
+// FailedPrecondition and 5xx ones Internal
+var grpcCodes = map[int]codes.Code{
+    http.StatusBadRequest:            codes.InvalidArgument,
+    http.StatusUnauthorized:          codes.Unauthenticated,
+    http.StatusForbidden:             codes.PermissionDenied,
+    http.StatusNotFound:              codes.NotFound,
+    http.StatusConflict:              codes.AlreadyExists,
+    http.StatusRequestEntityTooLarge: codes.InvalidArgument,
+    http.StatusUnprocessableEntity:   codes.InvalidArgument,
+    http.StatusTooManyRequests:       codes.ResourceExhausted,
+    http.StatusNotImplemented:        codes.Unimplemented,
+    http.StatusServiceUnavailable:    codes.Unavailable,
+    http.StatusGatewayTimeout:        codes.DeadlineExceeded,
+}
+
+// GRPCServer serves studentpb.StudentService. Each RPC is turned into the
+// REST request it stands for and served by the HTTP handler in process, so
+// gRPC clients get the authentication, roles, tenancy, validation, rate
+// limits, auditing and metrics of REST ones. The REST API itself is the HTTP
+// mapping of the service, so there is no separate gateway.
+type GRPCServer struct {
+    studentpb.UnimplementedStudentServiceServer
+    addr    string
+    handler http.Handler
+    server  *grpc.Server
+    metrics *Metrics
+}
+
+// LoadGRPCServer reads GRPC_ADDR, e.g. ":9090", returning nil when it is
+// unset. The server uses tlsConfig, the HTTP server's, when that is not nil.
+func LoadGRPCServer(handler http.Handler, tlsConfig *tls.Config, metrics *Metrics) *GRPCServer {
+    addr := getEnv("GRPC_ADDR", "")
+    if addr == "" {
+        return nil
+    }
+    s := &GRPCServer{addr: addr, handler: handler, metrics: metrics}
+    options := []grpc.ServerOption{grpc.UnaryInterceptor(s.countRequests)}
+    if tlsConfig != nil {
+        options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+    }
+    s.server = grpc.NewServer(options...)
+    studentpb.RegisterStudentServiceServer(s.server, s)
+    return s
+}
+
+// Serve listens on GRPC_ADDR until ctx is done, then stops gracefully,
+// cancelling the RPCs still running after timeout
+func (s *GRPCServer) Serve(ctx context.Context, timeout time.Duration) error {
+    listener, err := net.Listen("tcp", s.addr)
+    if err != nil {
+        return fmt.Errorf("gRPC server: %w", err)
+    }
+    slog.Info("serving gRPC", "addr", listener.Addr().String())
+    errc := make(chan error, 1)
+    go func() {
+        errc <- s.server.Serve(listener)
+    }()
+    select {
+    case err := <-errc:
+        return err
+    case <-ctx.Done():
+    }
+
+    stopped := make(chan struct{})
+    go func() {
+        s.server.GracefulStop()
+        close(stopped)
+    }()
+    select {
+    case <-stopped:
+    case <-time.After(timeout):
+        slog.Error("gRPC calls still running at the shutdown timeout; cancelling them")
+        s.server.Stop()
+    }
+    return <-errc
+}
+
+func (s *GRPCServer) countRequests(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+    resp, err := handler(ctx, req)
+    s.metrics.Inc("grpc_requests_total", "method", info.FullMethod, "code", status.Code(err).String())
+    return resp, err
+}
+
+func (s *GRPCServer) CreateStudent(ctx context.Context, req *studentpb.CreateStudentRequest) (*studentpb.Student, error) {
+    var student Student
+    if err := s.call(ctx, http.MethodPost, "/students", nil, studentFromProto(req.GetStudent()), &student); err != nil {
+        return nil, err
+    }
+    return studentToProto(student), nil
+}
+
+func (s *GRPCServer) GetStudent(ctx context.Context, req *studentpb.GetStudentRequest) (*studentpb.Student, error) {
+    var student Student
+    if err := s.call(ctx, http.MethodGet, studentPath(req.GetId()), nil, nil, &student); err != nil {
+        return nil, err
+    }
+    return studentToProto(student), nil
+}
+
+func (s *GRPCServer) ListStudents(ctx context.Context, req *studentpb.ListStudentsRequest) (*studentpb.ListStudentsResponse, error) {
+    query := url.Values{}
+    if req.GetFilter() != "" {
+        query.Set("filter", req.GetFilter())
+    }
+    if req.GetSort() != "" {
+        query.Set("sort", req.GetSort())
+    }
+    limit := int(req.GetPageSize())
+    if limit == 0 {
+        limit = defaultPageLimit
+    }
+    query.Set("limit", strconv.Itoa(limit))
+    query.Set("offset", strconv.Itoa(int(req.GetOffset())))
+
+    var page StudentPage
+    if err := s.call(ctx, http.MethodGet, "/students?"+query.Encode(), nil, nil, &page); err != nil {
+        return nil, err
+    }
+    resp := &studentpb.ListStudentsResponse{Total: int32(page.Total)}
+    for _, student := range page.Data {
+        resp.Students = append(resp.Students, studentToProto(student))
+    }
+    return resp, nil
+}
+
+func (s *GRPCServer) UpdateStudent(ctx context.Context, req *studentpb.UpdateStudentRequest) (*studentpb.Student, error) {
+    var student Student
+    if err := s.call(ctx, http.MethodPut, studentPath(req.GetStudent().GetId()), nil, studentFromProto(req.GetStudent()), &student); err != nil {
+        return nil, err
+    }
+    return studentToProto(student), nil
+}
+
+func (s *GRPCServer) DeleteStudent(ctx context.Context, req *studentpb.DeleteStudentRequest) (*emptypb.Empty, error) {
+    if err := s.call(ctx, http.MethodDelete, studentPath(req.GetId()), nil, nil, nil); err != nil {
+        return nil, err
+    }
+    return &emptypb.Empty{}, nil
+}
+
+func (s *GRPCServer) GetStudentSummary(ctx context.Context, req *studentpb.GetStudentSummaryRequest) (*studentpb.StudentSummary, error) {
+    header := make(http.Header)
+    if req.GetRefresh() {
+        header.Set("Cache-Control", "no-cache")
+    }
+    var summary SummaryResponse
+    if err := s.call(ctx, http.MethodGet, studentPath(req.GetId())+"/summary", header, nil, &summary); err != nil {
+        return nil, err
+    }
+    return &studentpb.StudentSummary{
+        Summary:        summary.Summary,
+        Strengths:      summary.Strengths,
+        Risks:          summary.Risks,
+        Recommendation: summary.Recommendation,
+        Model:          summary.Model,
+        Variant:        summary.Variant,
+        GeneratedAt:    timestamppb.New(summary.GeneratedAt),
+        Stale:          summary.Stale,
+        Generating:     summary.Generating,
+    }, nil
+}
+
+func studentPath(id int64) string {
+    return "/students/" + strconv.FormatInt(id, 10)
+}
+
+func studentToProto(s Student) *studentpb.Student {
+    return &studentpb.Student{
+        Id:        int64(s.ID),
+        Name:      s.Name,
+        Age:       int32(s.Age),
+        Email:     s.Email,
+        UpdatedAt: timestamppb.New(s.UpdatedAt),
+    }
+}
+
+func studentFromProto(p *studentpb.Student) Student {
+    return Student{ID: int(p.GetId()), Name: p.GetName(), Age: int(p.GetAge()), Email: p.GetEmail()}
+}
+
+// call serves the REST request for an RPC with the caller's metadata as
+// headers and decodes the JSON response into out. Error responses become
+// status errors carrying the envelope's code, request ID and failed checks.
+func (s *GRPCServer) call(ctx context.Context, method, target string, header http.Header, body, out interface{}) error {
+    var reader io.Reader = http.NoBody
+    if body != nil {
+        data, err := json.Marshal(body)
+        if err != nil {
+            return status.Error(codes.Internal, err.Error())
+        }
+        reader = bytes.NewReader(data)
+    }
+    r, err := http.NewRequestWithContext(ctx, method, target, reader)
+    if err != nil {
+        return status.Error(codes.Internal, err.Error())
+    }
+    r.RequestURI = target
+    if header != nil {
+        r.Header = header
+    }
+    if body != nil {
+        r.Header.Set("Content-Type", "application/json")
+    }
+    md, _ := metadata.FromIncomingContext(ctx)
+    for _, key := range grpcRequestHeaders {
+        for _, value := range md.Get(key) {
+            r.Header.Add(key, value)
+        }
+    }
+    if p, ok := peer.FromContext(ctx); ok {
+        r.RemoteAddr = p.Addr.String()
+    }
+
+    w := &grpcResponse{header: make(http.Header), status: http.StatusOK}
+    s.handler.ServeHTTP(w, r)
+
+    returned := metadata.MD{}
+    for _, name := range grpcResponseHeaders {
+        if value := w.header.Get(name); value != "" {
+            returned.Set(name, value)
+        }
+    }
+    if len(returned) > 0 {
+        grpc.SetHeader(ctx, returned)
+    }
+    if w.status >= http.StatusBadRequest {
+        return grpcError(w.status, w.body.Bytes())
+    }
+    if out != nil {
+        if err := json.Unmarshal(w.body.Bytes(), out); err != nil {
+            return status.Errorf(codes.Internal, "decoding %s %s response: %v", method, r.URL.Path, err)
+        }
+    }
+    return nil
+}
+
+// grpcError converts an error envelope answered with the given status
+func grpcError(httpStatus int, body []byte) error {
+    code, ok := grpcCodes[httpStatus]
+    switch {
+    case ok:
+    case httpStatus >= http.StatusInternalServerError:
+        code = codes.Internal
+    default:
+        code = codes.FailedPrecondition
+    }
+    var envelope errorEnvelope
+    if err := json.Unmarshal(body, &envelope); err != nil || envelope.Error.Message == "" {
+        return status.Error(code, http.StatusText(httpStatus))
+    }
+    e := envelope.Error
+    st := status.New(code, e.Message)
+    details := []protoiface.MessageV1{
+        &errdetails.ErrorInfo{Reason: e.Code, Domain: "student-api"},
+        &errdetails.RequestInfo{RequestId: e.RequestID},
+    }
+    if len(e.Details) > 0 {
+        violations := make([]*errdetails.BadRequest_FieldViolation, 0, len(e.Details))
+        for _, d := range e.Details {
+            violations = append(violations, &errdetails.BadRequest_FieldViolation{Field: d.Field, Description: d.Message})
+        }
+        details = append(details, &errdetails.BadRequest{FieldViolations: violations})
+    }
+    if detailed, err := st.WithDetails(details...); err == nil {
+        st = detailed
+    }
+    return st.Err()
+}
+
+// grpcResponse records the REST response to an RPC
+type grpcResponse struct {
+    header http.Header
+    status int
+    wrote  bool
+    body   bytes.Buffer
+}
+
+func (w *grpcResponse) Header() http.Header {
+    return w.header
+}
+
+func (w *grpcResponse) WriteHeader(status int) {
+    if !w.wrote {
+        w.status, w.wrote = status, true
+    }
+}
+
+func (w *grpcResponse) Write(b []byte) (int, error) {
+    w.wrote = true
+    return w.body.Write(b)
+}
+
+// SetReadDeadline and SetWriteDeadline satisfy http.ResponseController; the
+// RPC's own deadline bounds the call instead
+func (w *grpcResponse) SetReadDeadline(time.Time) error {
+    return nil
+}
+
+func (w *grpcResponse) SetWriteDeadline(time.Time) error {
+    return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+    "net/http"
+    "testing"
+    "time"
+    "student-api/testkit"
+)
+
+// goldenScrub adds the request ID, which changes on every request, to the
+// keys testkit scrubs
+var goldenScrub = append([]string{"request_id"}, testkit.DefaultScrub...)
+
+// newTestServer wires an app on the memory backend the way main does, with
+// the environment's defaults, and returns it behind serverHandler
+func newTestServer(t *testing.T) http.Handler {
+    t.Helper()
+    must := func(err error) {
+        t.Helper()
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    metrics := NewMetrics()
+    events := NewEventBus()
+    store := NewStudentStore(NewMemoryRepository(), events)
+    t.Cleanup(store.Close)
+
+    emailPolicy, err := LoadEmailPolicy()
+    must(err)
+    ollama := NewOllamaClient("http://127.0.0.1:0", "test")
+    models, err := LoadModelRouter(ollama, metrics)
+    must(err)
+    routes, err := LoadRoutePolicies()
+    must(err)
+    limiter, err := LoadRateLimiter(routes)
+    must(err)
+    leader, err := LoadLeaderElector(NewLocker(BackendMemory, nil, ""), metrics)
+    must(err)
+    prompts, err := ParsePromptSplit("")
+    must(err)
+    access, err := NewAccessLog(NewMemoryAccessLogRepository(), AccessLogOff, nil)
+    must(err)
+    honeypots, err := NewHoneypotStore(MemoryHoneypotRepository{})
+    must(err)
+    users, err := LoadUserStore(NewMemoryUserRepository())
+    must(err)
+    registrations, err := LoadRegistrationStore(NewMemoryRegistrationRepository())
+    must(err)
+    invitations, err := LoadInvitationStore(NewMemoryInvitationRepository())
+    must(err)
+    graphQL, err := LoadGraphQL()
+    must(err)
+    streams, err := LoadEventStreams()
+    must(err)
+    sockets, err := LoadEventSockets()
+    must(err)
+    alerts := LoadAlerter(metrics)
+    webhooks, err := LoadWebhooks(NewMemoryWebhookRepository(), alerts, metrics)
+    must(err)
+    must(webhooks.Attach(events))
+    auditLocal := NewMemoryAuditSink(auditMemoryEvents)
+    auditLog := NewAuditLog([]AuditSink{auditLocal}, time.Second, metrics)
+    t.Cleanup(auditLog.Close)
+
+    app := &App{
+        store:            store,
+        events:           events,
+        emailPolicy:      emailPolicy,
+        ollama:           ollama,
+        models:           models,
+        feedback:         NewFeedbackStore(),
+        prompts:          prompts,
+        summaryCache:     LoadSummaryCache(),
+        notes:            NewNoteStore(),
+        photos:           NewPhotoStore(),
+        importProfiles:   NewImportProfileStore(),
+        imports:          NewImportStore(),
+        conflicts:        NewConflictStore(),
+        undoWindow:       15 * time.Minute,
+        consistencyWait:  2 * time.Second,
+        metrics:          metrics,
+        auditLog:         auditLog,
+        auditReader:      auditLocal,
+        access:           access,
+        honeypots:        honeypots,
+        alerts:           alerts,
+        keys:             NewAPIKeyStore(NewMemoryAPIKeyRepository(), 600),
+        limiter:          limiter,
+        routes:           routes,
+        leader:           leader,
+        savedReports:     NewSavedReportStore(NewMemorySavedReportRepository()),
+        users:            users,
+        graphql:          graphQL,
+        streams:          streams,
+        sockets:          sockets,
+        registrations:    registrations,
+        invitations:      invitations,
+        summaryTemplates: NewSummaryTemplates(NewMemorySummaryTemplateRepository()),
+        webhooks:         webhooks,
+
+        csvEscapeFormulas: true,
+    }
+    return serverHandler(app.newRouter(NewModelWarmer(ollama, false)))
+}
+
+// TestStudentResponses walks a student through its lifecycle, comparing
+// each response with testdata/golden
+func TestStudentResponses(t *testing.T) {
+    handler := newTestServer(t)
+    steps := []struct {
+        golden, method, path string
+        body                 []byte
+    }{
+        {"create_student", http.MethodPost, "/students", testkit.NewStudentBuilder().JSON()},
+        {"create_second_student", http.MethodPost, "/students", testkit.NthStudent(5).JSON()},
+        {"get_student", http.MethodGet, "/students/1", nil},
+        {"list_students", http.MethodGet, "/students", nil},
+        {"list_students_filtered", http.MethodGet, "/students?filter=age%3E20", nil},
+        {"update_student", http.MethodPut, "/students/1", testkit.NewStudentBuilder().WithName("Ada King").WithAge(21).JSON()},
+        {"delete_student", http.MethodDelete, "/students/2", nil},
+        {"get_deleted_student", http.MethodGet, "/students/2", nil},
+    }
+    for _, step := range steps {
+        rec := testkit.Do(t, handler, step.method, step.path, step.body)
+        testkit.AssertGolden(t, step.golden, rec, goldenScrub...)
+    }
+}
+
+func TestStudentErrorResponses(t *testing.T) {
+    handler := newTestServer(t)
+    tests := []struct {
+        golden, method, path string
+        body                 []byte
+    }{
+        {"error_invalid_student", http.MethodPost, "/students", testkit.NewStudentBuilder().WithName("").WithAge(200).WithEmail("not-an-email").JSON()},
+        {"error_malformed_body", http.MethodPost, "/students", []byte(`{"name": `)},
+        {"error_invalid_filter", http.MethodGet, "/students?filter=age%3E%3E20", nil},
+        {"error_not_found", http.MethodGet, "/students/999", nil},
+        {"error_invalid_id", http.MethodGet, "/students/abc", nil},
+        {"error_unknown_route", http.MethodGet, "/no-such-route", nil},
+        {"error_method_not_allowed", http.MethodPatch, "/students", nil},
+    }
+    for _, tt := range tests {
+        rec := testkit.Do(t, handler, tt.method, tt.path, tt.body)
+        testkit.AssertGolden(t, tt.golden, rec, goldenScrub...)
+    }
+}
@@ -0,0 +1,719 @@
+package main
+
+import (
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "strconv"
+    "time"
+    "github.com/gorilla/mux"
+)
+
+// Operations recorded in student history
+const (
+    OpCreate  = "create"
+    OpUpdate  = "update"
+    OpDelete  = "delete"
+    OpRestore = "restore"
+)
+
+// Errors returned when an operation cannot be undone
+var (
+    errOperationNotFound = errors.New("operation not found")
+    errUndoExpired       = errors.New("operation is outside the undo window")
+    errUndoSuperseded    = errors.New("student has changed since this operation")
+    // errUndoNoPrevious refuses to undo the first recorded update of a
+    // student that existed before its history was kept
+    errUndoNoPrevious = errors.New("no earlier version to revert to")
+)
+
+// errStudentNotDeleted is returned when restoring a student that is not deleted
+var errStudentNotDeleted = errors.New("student is not deleted")
+
+// StudentVersion is one entry in a student's history. Seq is a store-wide
+// sequence number; Version counts the changes to this student starting at 1.
+// For deletes, Student holds the record as it was when deleted.
+type StudentVersion struct {
+    Seq       int                    `json:"seq"`
+    StudentID int                    `json:"student_id"`
+    Version   int                    `json:"version"`
+    Operation string                 `json:"operation"`
+    Student   Student                `json:"student"`
+    Changes   map[string]FieldChange `json:"changes,omitempty"`
+    At        time.Time              `json:"at"`
+}
+
+// StudentHistory keeps the versions StudentStore records, in Seq order
+type StudentHistory interface {
+    // Append stores a version, numbering its Seq and Version
+    Append(v StudentVersion) (StudentVersion, error)
+    // Get returns the version with the sequence number, or
+    // errOperationNotFound
+    Get(seq int) (StudentVersion, error)
+    // Student returns the versions of one student
+    Student(id int) ([]StudentVersion, error)
+    // Since returns the versions recorded after seq
+    Since(seq int) ([]StudentVersion, error)
+    // Last returns the sequence number of the latest version, 0 before any
+    Last() (int, error)
+}
+
+// HistoryRepository is implemented by repositories that keep student
+// history in their student_history table. Its versions are written in the
+// transaction of the student row they record, so they survive restarts and
+// are shared by every instance on the database.
+type HistoryRepository interface {
+    History() StudentHistory
+}
+
+// historyOf returns the history a repository keeps, or nil
+func historyOf(repo StudentRepository) StudentHistory {
+    if h, ok := repo.(HistoryRepository); ok {
+        return h.History()
+    }
+    return nil
+}
+
+// MemoryHistory is the StudentHistory of repositories without one of their
+// own; it is lost on restart like their students. StudentStore's lock
+// guards it.
+type MemoryHistory struct {
+    versions []StudentVersion
+    // students indexes versions by student ID
+    students map[int][]int
+}
+
+// NewMemoryHistory initializes an empty MemoryHistory
+func NewMemoryHistory() *MemoryHistory {
+    return &MemoryHistory{students: make(map[int][]int)}
+}
+
+func (h *MemoryHistory) Append(v StudentVersion) (StudentVersion, error) {
+    v.Seq = len(h.versions) + 1
+    v.Version = len(h.students[v.StudentID]) + 1
+    h.versions = append(h.versions, v)
+    h.students[v.StudentID] = append(h.students[v.StudentID], len(h.versions)-1)
+    return v, nil
+}
+
+func (h *MemoryHistory) Get(seq int) (StudentVersion, error) {
+    if seq < 1 || seq > len(h.versions) {
+        return StudentVersion{}, errOperationNotFound
+    }
+    return h.versions[seq-1], nil
+}
+
+func (h *MemoryHistory) Student(id int) ([]StudentVersion, error) {
+    versions := make([]StudentVersion, 0, len(h.students[id]))
+    for _, i := range h.students[id] {
+        versions = append(versions, h.versions[i])
+    }
+    return versions, nil
+}
+
+func (h *MemoryHistory) Since(seq int) ([]StudentVersion, error) {
+    return append([]StudentVersion(nil), h.versions[min(max(seq, 0), len(h.versions)):]...), nil
+}
+
+func (h *MemoryHistory) Last() (int, error) {
+    return len(h.versions), nil
+}
+
+// truncate drops the versions after seq, those of a failed transaction
+func (h *MemoryHistory) truncate(seq int) {
+    for i := len(h.versions) - 1; i >= seq; i-- {
+        id := h.versions[i].StudentID
+        if h.students[id] = h.students[id][:len(h.students[id])-1]; len(h.students[id]) == 0 {
+            delete(h.students, id)
+        }
+    }
+    h.versions = h.versions[:seq]
+}
+
+// SQLHistory is the StudentHistory the SQL repositories keep in their
+// student_history table, on their database or open transaction
+type SQLHistory struct {
+    conn   sqlConn
+    rebind func(string) string
+    // returning reads the new seq back with RETURNING, for PostgreSQL,
+    // which has no LastInsertId
+    returning bool
+}
+
+// historyColumns is the column list every history query selects
+const historyColumns = "seq, student_id, version, operation, student, changes, at"
+
+func (h *SQLHistory) query(q string) string {
+    if h.rebind == nil {
+        return q
+    }
+    return h.rebind(q)
+}
+
+func (h *SQLHistory) Append(v StudentVersion) (StudentVersion, error) {
+    if err := h.conn.QueryRow(h.query(`SELECT COALESCE(MAX(version), 0) + 1 FROM student_history WHERE student_id = ?`),
+        v.StudentID).Scan(&v.Version); err != nil {
+        return StudentVersion{}, err
+    }
+    student, err := json.Marshal(v.Student)
+    if err != nil {
+        return StudentVersion{}, err
+    }
+    var changes interface{}
+    if v.Changes != nil {
+        encoded, err := json.Marshal(v.Changes)
+        if err != nil {
+            return StudentVersion{}, err
+        }
+        changes = string(encoded)
+    }
+    insert := `INSERT INTO student_history (student_id, version, operation, student, changes, at) VALUES (?, ?, ?, ?, ?, ?)`
+    args := []interface{}{v.StudentID, v.Version, v.Operation, string(student), changes, formatTimestamp(v.At)}
+    if h.returning {
+        err := h.conn.QueryRow(h.query(insert+" RETURNING seq"), args...).Scan(&v.Seq)
+        return v, err
+    }
+    result, err := h.conn.Exec(h.query(insert), args...)
+    if err != nil {
+        return StudentVersion{}, err
+    }
+    seq, err := result.LastInsertId()
+    v.Seq = int(seq)
+    return v, err
+}
+
+func (h *SQLHistory) Get(seq int) (StudentVersion, error) {
+    versions, err := h.list(`WHERE seq = ?`, seq)
+    if err == nil && len(versions) == 0 {
+        err = errOperationNotFound
+    }
+    if err != nil {
+        return StudentVersion{}, err
+    }
+    return versions[0], nil
+}
+
+func (h *SQLHistory) Student(id int) ([]StudentVersion, error) {
+    return h.list(`WHERE student_id = ?`, id)
+}
+
+func (h *SQLHistory) Since(seq int) ([]StudentVersion, error) {
+    return h.list(`WHERE seq > ?`, seq)
+}
+
+func (h *SQLHistory) Last() (int, error) {
+    var seq int
+    err := h.conn.QueryRow(`SELECT COALESCE(MAX(seq), 0) FROM student_history`).Scan(&seq)
+    return seq, err
+}
+
+// list loads the versions matching a WHERE clause, in Seq order
+func (h *SQLHistory) list(where string, args ...interface{}) ([]StudentVersion, error) {
+    rows, err := h.conn.Query(h.query("SELECT "+historyColumns+" FROM student_history "+where+" ORDER BY seq"), args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    versions := []StudentVersion{}
+    for rows.Next() {
+        var v StudentVersion
+        var student, at string
+        var changes sql.NullString
+        if err := rows.Scan(&v.Seq, &v.StudentID, &v.Version, &v.Operation, &student, &changes, &at); err != nil {
+            return nil, err
+        }
+        if err := json.Unmarshal([]byte(student), &v.Student); err != nil {
+            return nil, err
+        }
+        if changes.Valid {
+            if err := json.Unmarshal([]byte(changes.String), &v.Changes); err != nil {
+                return nil, err
+            }
+        }
+        if v.At, err = time.Parse(time.RFC3339Nano, at); err != nil {
+            return nil, err
+        }
+        versions = append(versions, v)
+    }
+    return versions, rows.Err()
+}
+
+// historyLocked returns where the store's versions are kept: the
+// repository's own history, that of the open transaction inside
+// transactionLocked, or else memory
+func (s *StudentStore) historyLocked() StudentHistory {
+    if h := historyOf(s.repo); h != nil {
+        return h
+    }
+    return s.memory
+}
+
+// recordLocked stores a history entry, and its change event in the
+// repository's outbox when it keeps the one attached, then publishes the
+// event, or holds it back until the open transaction commits; the caller
+// must hold the write lock
+func (s *StudentStore) recordLocked(op string, before, after Student) (StudentVersion, error) {
+    v := StudentVersion{
+        StudentID: after.ID,
+        Operation: op,
+        Student:   after,
+        At:        after.UpdatedAt,
+    }
+    if op == OpUpdate {
+        v.Changes = diffStudents(before, after)
+    }
+    if op == OpDelete {
+        v.At = time.Now().UTC()
+    }
+    v, err := s.historyLocked().Append(v)
+    if err != nil {
+        return StudentVersion{}, err
+    }
+    if s.outbox != nil && s.outboxInRepo {
+        if err := outboxOf(s.repo).Add(eventFromVersion(s.tenant, v), time.Now().UTC()); err != nil {
+            return StudentVersion{}, err
+        }
+    }
+    if s.inTx {
+        s.pending = append(s.pending, v)
+    } else {
+        s.publishLocked(v)
+    }
+    return v, nil
+}
+
+// publishLocked announces a recorded version to readers and subscribers
+func (s *StudentStore) publishLocked(v StudentVersion) {
+    s.observeSeq(v.Seq)
+    e := eventFromVersion(s.tenant, v)
+    if s.outbox != nil {
+        if !s.outboxInRepo {
+            s.outbox.addSaved(e)
+        }
+        s.outbox.wakeRelay()
+    }
+    s.events.Publish(e)
+    close(s.advanced)
+    s.advanced = make(chan struct{})
+}
+
+// observeSeq moves Seq up to seq, which another instance sharing the
+// history may have written
+func (s *StudentStore) observeSeq(seq int) {
+    for {
+        current := s.seq.Load()
+        if int64(seq) <= current || s.seq.CompareAndSwap(current, int64(seq)) {
+            return
+        }
+    }
+}
+
+// transactionLocked runs fn with the locked helpers writing through one
+// repository transaction. When fn fails the versions it recorded are
+// dropped again; otherwise their events are published after the commit and
+// the versions are returned. The caller must hold the write lock.
+func (s *StudentStore) transactionLocked(fn func() error) ([]StudentVersion, error) {
+    repo, mark := s.repo, len(s.memory.versions)
+    s.inTx = true
+    err := repo.Transaction(func(tx StudentRepository) error {
+        s.repo = tx
+        return fn()
+    })
+    versions := s.pending
+    s.repo, s.inTx, s.pending = repo, false, nil
+
+    if err != nil {
+        s.memory.truncate(mark)
+        return nil, err
+    }
+    for _, v := range versions {
+        s.publishLocked(v)
+    }
+    return versions, nil
+}
+
+// atomicLocked runs fn, a write and the version recording it, in one
+// repository transaction when the repository keeps the history or outbox,
+// so neither is stored without the other. Inside transactionLocked, fn joins the
+// transaction already open. The caller must hold the write lock.
+func (s *StudentStore) atomicLocked(fn func() error) error {
+    if s.inTx || (historyOf(s.repo) == nil && !s.outboxInRepo) {
+        return fn()
+    }
+    _, err := s.transactionLocked(fn)
+    return err
+}
+
+// getLive returns a student unless it is missing or deleted
+func (s *StudentStore) getLive(id int) (Student, error) {
+    student, err := s.repo.Get(id)
+    if err == nil && student.DeletedAt != nil {
+        return Student{}, errStudentNotFound
+    }
+    return student, err
+}
+
+// liveOptions leaves deleted students out of opts unless they are asked for
+func liveOptions(opts ListOptions) ListOptions {
+    if !opts.IncludeDeleted {
+        opts.Filter = liveStudents.And(opts.Filter)
+    }
+    return opts
+}
+
+// insertLocked stores a new student under a fresh ID; the caller must hold the write lock
+func (s *StudentStore) insertLocked(student Student) (Student, StudentVersion, error) {
+    var version StudentVersion
+    err := s.atomicLocked(func() (err error) {
+        student.UpdatedAt = time.Now().UTC()
+        student.ID, student.DeletedAt = 0, nil
+        if student, err = s.repo.Create(student); err != nil {
+            return err
+        }
+        version, err = s.recordLocked(OpCreate, Student{}, student)
+        return err
+    })
+    if err != nil {
+        return Student{}, StudentVersion{}, err
+    }
+    return student, version, nil
+}
+
+// replaceLocked overwrites an existing student; the caller must hold the write lock
+func (s *StudentStore) replaceLocked(student Student) (Student, StudentVersion, error) {
+    var version StudentVersion
+    err := s.atomicLocked(func() error {
+        before, err := s.getLive(student.ID)
+        if err != nil {
+            return err
+        }
+        student.UpdatedAt, student.DeletedAt = time.Now().UTC(), nil
+        if _, err := s.repo.Update(student); err != nil {
+            return err
+        }
+        version, err = s.recordLocked(OpUpdate, before, student)
+        return err
+    })
+    if err != nil {
+        return Student{}, StudentVersion{}, err
+    }
+    return student, version, nil
+}
+
+// removeLocked marks a student deleted, keeping it to be restored until it
+// is purged; the caller must hold the write lock
+func (s *StudentStore) removeLocked(id int) (StudentVersion, error) {
+    var version StudentVersion
+    err := s.atomicLocked(func() error {
+        student, err := s.getLive(id)
+        if err != nil {
+            return err
+        }
+        deleted := student
+        now := time.Now().UTC()
+        deleted.DeletedAt = &now
+        if _, err := s.repo.Update(deleted); err != nil {
+            return err
+        }
+        version, err = s.recordLocked(OpDelete, student, student)
+        return err
+    })
+    return version, err
+}
+
+// createWithIDLocked stores a new student under its own ID; the caller must
+// hold the write lock. The ID of a deleted student is taken until it is
+// purged, so the student is restored with the new values instead.
+func (s *StudentStore) createWithIDLocked(student Student) (Student, StudentVersion, error) {
+    if current, err := s.repo.Get(student.ID); err == nil && current.DeletedAt != nil {
+        return s.restoreLocked(student)
+    }
+    var version StudentVersion
+    err := s.atomicLocked(func() (err error) {
+        student.UpdatedAt, student.DeletedAt = time.Now().UTC(), nil
+        if student, err = s.repo.Create(student); err != nil {
+            return err
+        }
+        version, err = s.recordLocked(OpCreate, Student{}, student)
+        return err
+    })
+    if err != nil {
+        return Student{}, StudentVersion{}, err
+    }
+    return student, version, nil
+}
+
+// restoreLocked puts a deleted student back under its original ID, clearing
+// its deletion or, once it has been purged, storing it anew; the caller must
+// hold the write lock
+func (s *StudentStore) restoreLocked(student Student) (Student, StudentVersion, error) {
+    var version StudentVersion
+    err := s.atomicLocked(func() error {
+        current, err := s.repo.Get(student.ID)
+        switch {
+        case err == nil && current.DeletedAt == nil:
+            return errStudentNotDeleted
+        case err != nil && !errors.Is(err, errStudentNotFound):
+            return err
+        }
+        student.UpdatedAt, student.DeletedAt = time.Now().UTC(), nil
+        if err == nil {
+            _, err = s.repo.Update(student)
+        } else {
+            _, err = s.repo.Create(student)
+        }
+        if err != nil {
+            return err
+        }
+        version, err = s.recordLocked(OpRestore, Student{}, student)
+        return err
+    })
+    if err != nil {
+        return Student{}, StudentVersion{}, err
+    }
+    return student, version, nil
+}
+
+// Get returns a student by ID; deleted students are not found
+func (s *StudentStore) Get(id int) (Student, error) {
+    return s.getLive(id)
+}
+
+// List returns the students selected by opts
+func (s *StudentStore) List(opts ListOptions) ([]Student, error) {
+    return s.repo.List(liveOptions(opts))
+}
+
+// Page returns one page of the students matching opts.Filter and the total
+// number of matches
+func (s *StudentStore) Page(opts ListOptions) ([]Student, int, error) {
+    opts = liveOptions(opts)
+    total, err := s.repo.Count(opts.Filter)
+    if err != nil {
+        return nil, 0, err
+    }
+    students, err := s.repo.List(opts)
+    return students, total, err
+}
+
+// Create stores a new student and records its first version
+func (s *StudentStore) Create(student Student) (Student, StudentVersion, error) {
+    s.Lock()
+    defer s.Unlock()
+    return s.insertLocked(student)
+}
+
+// Update replaces an existing student
+func (s *StudentStore) Update(student Student) (Student, StudentVersion, error) {
+    s.Lock()
+    defer s.Unlock()
+    return s.replaceLocked(student)
+}
+
+// Delete removes a student
+func (s *StudentStore) Delete(id int) (StudentVersion, error) {
+    s.Lock()
+    defer s.Unlock()
+    return s.removeLocked(id)
+}
+
+// Undo reverses the operation with the given sequence number if it happened
+// within window and is still the latest change to its student: a create is
+// deleted, an update is reverted to the previous version and a delete is
+// restored. The undo itself is recorded as a new operation and returned.
+func (s *StudentStore) Undo(seq int, window time.Duration) (StudentVersion, error) {
+    s.Lock()
+    defer s.Unlock()
+
+    history := s.historyLocked()
+    op, err := history.Get(seq)
+    if err != nil {
+        return StudentVersion{}, err
+    }
+    if time.Since(op.At) > window {
+        return StudentVersion{}, errUndoExpired
+    }
+    versions, err := history.Student(op.StudentID)
+    if err != nil {
+        return StudentVersion{}, err
+    }
+    if versions[len(versions)-1].Seq != seq {
+        return StudentVersion{}, errUndoSuperseded
+    }
+
+    switch op.Operation {
+    case OpCreate, OpRestore:
+        return s.removeLocked(op.StudentID)
+    case OpDelete:
+        _, version, err := s.restoreLocked(op.Student)
+        return version, err
+    default:
+        if len(versions) < 2 {
+            return StudentVersion{}, errUndoNoPrevious
+        }
+        previous := versions[len(versions)-2].Student
+        _, version, err := s.replaceLocked(previous)
+        return version, err
+    }
+}
+
+// Versions returns the full history of a student, oldest first
+func (s *StudentStore) Versions(id int) ([]StudentVersion, error) {
+    s.RLock()
+    defer s.RUnlock()
+    return s.historyLocked().Student(id)
+}
+
+// VersionsSince returns the history recorded after seq, oldest first. ok is
+// false when seq lies beyond the store's history, e.g. that of a memory
+// store before a restart.
+func (s *StudentStore) VersionsSince(seq int) (versions []StudentVersion, ok bool, err error) {
+    s.RLock()
+    defer s.RUnlock()
+    history := s.historyLocked()
+    last, err := history.Last()
+    if err != nil || seq < 0 || seq > last {
+        return nil, false, err
+    }
+    versions, err = history.Since(seq)
+    return versions, err == nil, err
+}
+
+// AsOf returns the student as it was at the given time. It reports false
+// when the student did not exist yet or had been deleted by then.
+func (s *StudentStore) AsOf(id int, at time.Time) (Student, bool, error) {
+    versions, err := s.Versions(id)
+    if err != nil {
+        return Student{}, false, err
+    }
+    var found *StudentVersion
+    for i := range versions {
+        if versions[i].At.After(at) {
+            break
+        }
+        found = &versions[i]
+    }
+    if found == nil || found.Operation == OpDelete {
+        return Student{}, false, nil
+    }
+    return found.Student, true, nil
+}
+
+// parseAsOf accepts an RFC 3339 timestamp or a plain date. A plain date
+// means the end of that day (UTC), so as_of=2024-01-01 includes changes
+// made on January 1st.
+func parseAsOf(value string) (time.Time, bool) {
+    if t, err := time.Parse(time.RFC3339, value); err == nil {
+        return t, true
+    }
+    if t, err := time.Parse("2006-01-02", value); err == nil {
+        return t.Add(24*time.Hour - time.Nanosecond), true
+    }
+    return time.Time{}, false
+}
+
+func (app *App) GetStudentVersions(w http.ResponseWriter, r *http.Request) {
+    store := app.storeFor(r)
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        httpError(w, r, "Invalid ID", http.StatusBadRequest)
+        return
+    }
+
+    versions, err := store.Versions(id)
+    if err != nil {
+        writeStoreError(w, r, err)
+        return
+    }
+    if len(versions) == 0 {
+        // Students stored before history was kept exist without any
+        // recorded versions
+        if _, err := store.Get(id); err != nil {
+            writeStoreError(w, r, err)
+            return
+        }
+    }
+    app.recordAccess(r, fieldsStudent, id)
+    json.NewEncoder(w).Encode(versions)
+}
+
+// GetStudentDiff compares two versions: /students/{id}/diff?from=1&to=3.
+// "to" defaults to the latest version.
+func (app *App) GetStudentDiff(w http.ResponseWriter, r *http.Request) {
+    store := app.storeFor(r)
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        httpError(w, r, "Invalid ID", http.StatusBadRequest)
+        return
+    }
+
+    versions, err := store.Versions(id)
+    if err != nil {
+        writeStoreError(w, r, err)
+        return
+    }
+    if len(versions) == 0 {
+        httpError(w, r, "Student not found", http.StatusNotFound)
+        return
+    }
+
+    from, err := strconv.Atoi(r.URL.Query().Get("from"))
+    if err != nil || from < 1 || from > len(versions) {
+        httpError(w, r, "Invalid from version", http.StatusBadRequest)
+        return
+    }
+    to := len(versions)
+    if value := r.URL.Query().Get("to"); value != "" {
+        if to, err = strconv.Atoi(value); err != nil || to < 1 || to > len(versions) {
+            httpError(w, r, "Invalid to version", http.StatusBadRequest)
+            return
+        }
+    }
+
+    before, after := versions[from-1], versions[to-1]
+    app.recordAccess(r, fieldsStudent, id)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "student_id": id,
+        "from":       before,
+        "to":         after,
+        "changes":    diffStudents(before.Student, after.Student),
+    })
+}
+
+// UndoOperation reverses a recent mutation: POST /undo/{operation_id}, where
+// the operation ID is the X-Operation-ID header returned by the mutation
+func (app *App) UndoOperation(w http.ResponseWriter, r *http.Request) {
+    store := app.storeFor(r)
+    seq, err := strconv.Atoi(mux.Vars(r)["operation_id"])
+    if err != nil {
+        httpError(w, r, "Invalid operation ID", http.StatusBadRequest)
+        return
+    }
+
+    version, err := store.Undo(seq, app.undoWindow)
+    switch {
+    case errors.Is(err, errOperationNotFound):
+        httpError(w, r, "Operation not found", http.StatusNotFound)
+        return
+    case errors.Is(err, errUndoExpired):
+        httpError(w, r, "Operation is too old to undo", http.StatusGone)
+        return
+    case errors.Is(err, errUndoSuperseded):
+        httpError(w, r, "Student has changed since this operation", http.StatusConflict)
+        return
+    case errors.Is(err, errUndoNoPrevious):
+        httpError(w, r, "No earlier version of the student to revert to", http.StatusConflict)
+        return
+    case err != nil:
+        writeStoreError(w, r, err)
+        return
+    }
+
+    app.recordChanges(r, version)
+    w.Header().Set("X-Operation-ID", strconv.Itoa(version.Seq))
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "undone":    seq,
+        "operation": version,
+    })
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "testing"
+    "time"
+    "github.com/gorilla/mux"
+)
+
+// TestUndoFirstRecordedUpdate undoes the update of a student written to the
+// repository before the store kept its history, so the update is its only
+// version
+func TestUndoFirstRecordedUpdate(t *testing.T) {
+    repo := NewMemoryRepository()
+    seeded, err := repo.Create(Student{Name: "Ada Lovelace", Age: 36, Email: "ada@example.edu"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    store := NewStudentStore(repo, NewEventBus())
+    t.Cleanup(store.Close)
+    seeded.Age = 37
+    _, version, err := store.Update(seeded)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if _, err := store.Undo(version.Seq, time.Minute); !errors.Is(err, errUndoNoPrevious) {
+        t.Fatalf("Undo = %v, want errUndoNoPrevious", err)
+    }
+    if student, err := store.Get(seeded.ID); err != nil || student.Age != 37 {
+        t.Errorf("after the refused undo the student is %+v, %v; want it unchanged", student, err)
+    }
+
+    app := &App{store: store, undoWindow: time.Minute}
+    operation := strconv.Itoa(version.Seq)
+    req := mux.SetURLVars(httptest.NewRequest(http.MethodPost, "/undo/"+operation, nil), map[string]string{"operation_id": operation})
+    rec := httptest.NewRecorder()
+    app.UndoOperation(rec, req)
+    if rec.Code != http.StatusConflict {
+        t.Errorf("POST /undo/%s: status %d, want %d: %s", operation, rec.Code, http.StatusConflict, rec.Body)
+    }
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "github.com/gorilla/mux"
+    "student-api/reqctx"
+)
+
+// Honeypot flags a decoy student record. Decoys are ordinary students to
+// every other route, so any read or write of one by a caller who does not
+// manage them suggests leaked credentials or bulk exfiltration.
+type Honeypot struct {
+    StudentID int       `json:"student_id"`
+    Tenant    string    `json:"-"`
+    Label     string    `json:"label,omitempty"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+// HoneypotRepository persists honeypot flags
+type HoneypotRepository interface {
+    // All returns the honeypots of every tenant
+    All() ([]Honeypot, error)
+    Add(h Honeypot) error
+    Remove(tenant string, studentID int) error
+}
+
+// MemoryHoneypotRepository keeps nothing beyond the HoneypotStore itself,
+// for STORE_BACKEND=memory
+type MemoryHoneypotRepository struct{}
+
+func (MemoryHoneypotRepository) All() ([]Honeypot, error)           { return nil, nil }
+func (MemoryHoneypotRepository) Add(Honeypot) error                 { return nil }
+func (MemoryHoneypotRepository) Remove(tenant string, id int) error { return nil }
+
+// SQLHoneypotRepository keeps honeypot flags in the honeypots table
+type SQLHoneypotRepository struct {
+    db     *sql.DB
+    rebind func(string) string
+}
+
+// NewSQLHoneypotRepository creates a repository; rebind may be nil
+func NewSQLHoneypotRepository(db *sql.DB, rebind func(string) string) *SQLHoneypotRepository {
+    if rebind == nil {
+        rebind = func(q string) string { return q }
+    }
+    return &SQLHoneypotRepository{db: db, rebind: rebind}
+}
+
+func (s *SQLHoneypotRepository) All() ([]Honeypot, error) {
+    rows, err := s.db.Query(`SELECT tenant, student_id, label, created_at FROM honeypots`)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    var honeypots []Honeypot
+    for rows.Next() {
+        var h Honeypot
+        var created string
+        if err := rows.Scan(&h.Tenant, &h.StudentID, &h.Label, &created); err != nil {
+            return nil, err
+        }
+        if h.CreatedAt, err = time.Parse(time.RFC3339Nano, created); err != nil {
+            return nil, err
+        }
+        honeypots = append(honeypots, h)
+    }
+    return honeypots, rows.Err()
+}
+
+func (s *SQLHoneypotRepository) Add(h Honeypot) error {
+    _, err := s.db.Exec(s.rebind(`INSERT INTO honeypots (tenant, student_id, label, created_at) VALUES (?, ?, ?, ?)`),
+        h.Tenant, h.StudentID, h.Label, h.CreatedAt.Format(time.RFC3339Nano))
+    return err
+}
+
+func (s *SQLHoneypotRepository) Remove(tenant string, studentID int) error {
+    _, err := s.db.Exec(s.rebind(`DELETE FROM honeypots WHERE tenant = ? AND student_id = ?`), tenant, studentID)
+    return err
+}
+
+// HoneypotStore holds the honeypot flags in memory for lookups on every read
+type HoneypotStore struct {
+    sync.RWMutex
+    repo   HoneypotRepository
+    decoys map[studentKey]Honeypot
+}
+
+// NewHoneypotStore loads the flags persisted in repo
+func NewHoneypotStore(repo HoneypotRepository) (*HoneypotStore, error) {
+    honeypots, err := repo.All()
+    if err != nil {
+        return nil, fmt.Errorf("loading honeypots: %w", err)
+    }
+    s := &HoneypotStore{repo: repo, decoys: make(map[studentKey]Honeypot)}
+    for _, h := range honeypots {
+        s.decoys[studentKey{h.Tenant, h.StudentID}] = h
+    }
+    return s, nil
+}
+
+// Is reports whether a tenant's student is a decoy
+func (s *HoneypotStore) Is(tenant string, studentID int) bool {
+    s.RLock()
+    defer s.RUnlock()
+    _, ok := s.decoys[studentKey{tenant, studentID}]
+    return ok
+}
+
+// Add flags a student as a decoy
+func (s *HoneypotStore) Add(h Honeypot) error {
+    s.Lock()
+    defer s.Unlock()
+    if err := s.repo.Add(h); err != nil {
+        return err
+    }
+    s.decoys[studentKey{h.Tenant, h.StudentID}] = h
+    return nil
+}
+
+// Remove unflags a decoy, reporting false if it was not one
+func (s *HoneypotStore) Remove(tenant string, studentID int) (bool, error) {
+    s.Lock()
+    defer s.Unlock()
+    key := studentKey{tenant, studentID}
+    if _, ok := s.decoys[key]; !ok {
+        return false, nil
+    }
+    if err := s.repo.Remove(tenant, studentID); err != nil {
+        return false, err
+    }
+    delete(s.decoys, key)
+    return true, nil
+}
+
+// List returns a tenant's decoys by student ID
+func (s *HoneypotStore) List(tenant string) []Honeypot {
+    s.RLock()
+    var honeypots []Honeypot
+    for key, h := range s.decoys {
+        if key.tenant == tenant {
+            honeypots = append(honeypots, h)
+        }
+    }
+    s.RUnlock()
+    sort.Slice(honeypots, func(i, j int) bool { return honeypots[i].StudentID < honeypots[j].StudentID })
+    return honeypots
+}
+
+// noteHoneypots flags the decoys among the students a request touched on its
+// audit event, which raises the alert once the request is answered. Bulk
+// writes, which do not go through a student route or recordAccess, are not
+// covered.
+func (app *App) noteHoneypots(r *http.Request, ids ...int) {
+    state := auditStateFrom(r.Context())
+    if state == nil {
+        return
+    }
+    tenant := reqctx.Tenant(r.Context())
+    for _, id := range ids {
+        if app.honeypots.Is(tenant, id) && !containsInt(state.honeypots, id) {
+            state.honeypots = append(state.honeypots, id)
+        }
+    }
+}
+
+// raiseHoneypotAlert alerts on a request that touched decoys, throttled per
+// tenant and actor so bulk exfiltration raises one alert rather than many
+func (app *App) raiseHoneypotAlert(e AuditEvent) {
+    actor := e.Actor
+    if actor == "" {
+        actor = "anonymous"
+    }
+    app.alerts.Raise(Alert{
+        Kind:     "honeypot_access",
+        Severity: AlertCritical,
+        Summary:  fmt.Sprintf("Decoy students %s touched by %s via %s %s", joinInts(e.Honeypot), actor, e.Method, e.Route),
+        Fields: map[string]string{
+            "actor":       actor,
+            "tenant":      e.Tenant,
+            "request_id":  e.RequestID,
+            "method":      e.Method,
+            "path":        e.Path,
+            "status":      strconv.Itoa(e.Status),
+            "source":      e.Source,
+            "student_ids": joinInts(e.Honeypot),
+        },
+        At:  e.At,
+        Key: "honeypot:" + e.Tenant + ":" + actor,
+    })
+}
+
+func containsInt(list []int, n int) bool {
+    for _, item := range list {
+        if item == n {
+            return true
+        }
+    }
+    return false
+}
+
+// joinInts formats ids as "1,2,3"
+func joinInts(ids []int) string {
+    parts := make([]string, len(ids))
+    for i, id := range ids {
+        parts[i] = strconv.Itoa(id)
+    }
+    return strings.Join(parts, ",")
+}
+
+// HoneypotRequest is the body of POST /admin/honeypots: either the decoy
+// student to create, or the ID of an existing student to flag
+type HoneypotRequest struct {
+    Label     string   `json:"label"`
+    Student   *Student `json:"student"`
+    StudentID int      `json:"student_id"`
+}
+
+// PlantHoneypot creates or flags a decoy student: POST /admin/honeypots
+// {"label": "q3", "student": {"name": "...", "age": 20, "email": "..."}}
+func (app *App) PlantHoneypot(w http.ResponseWriter, r *http.Request) {
+    store := app.storeFor(r)
+    var req HoneypotRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        httpError(w, r, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    if (req.Student == nil) == (req.StudentID == 0) {
+        httpError(w, r, "Give either student or student_id", http.StatusBadRequest)
+        return
+    }
+
+    var student Student
+    var err error
+    if req.Student != nil {
+        if verrs := app.validateStudent(*req.Student); len(verrs) > 0 {
+            writeValidationErrors(w, r, verrs)
+            return
+        }
+        var version StudentVersion
+        student, version, err = store.Create(*req.Student)
+        app.recordChanges(r, version)
+    } else {
+        student, err = store.Get(req.StudentID)
+    }
+    if err != nil {
+        writeStoreError(w, r, err)
+        return
+    }
+
+    h := Honeypot{StudentID: student.ID, Tenant: reqctx.Tenant(r.Context()), Label: strings.TrimSpace(req.Label), CreatedAt: time.Now().UTC()}
+    if app.honeypots.Is(h.Tenant, h.StudentID) {
+        httpError(w, r, "Student is already a honeypot", http.StatusConflict)
+        return
+    }
+    if err := app.honeypots.Add(h); err != nil {
+        reqctx.Logger(r.Context()).Error("planting honeypot failed", "student_id", student.ID, "error", err)
+        httpError(w, r, "Internal server error", http.StatusInternalServerError)
+        return
+    }
+    reqctx.Logger(r.Context()).Info("honeypot planted", "student_id", student.ID, "label", h.Label)
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "honeypot": h,
+        "student":  student,
+    })
+}
+
+func (app *App) ListHoneypots(w http.ResponseWriter, r *http.Request) {
+    honeypots := app.honeypots.List(reqctx.Tenant(r.Context()))
+    if honeypots == nil {
+        honeypots = []Honeypot{}
+    }
+    json.NewEncoder(w).Encode(honeypots)
+}
+
+// RemoveHoneypot unflags a decoy and deletes its student record, so it does
+// not linger as fake data: DELETE /admin/honeypots/{id}
+func (app *App) RemoveHoneypot(w http.ResponseWriter, r *http.Request) {
+    store := app.storeFor(r)
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        httpError(w, r, "Invalid ID", http.StatusBadRequest)
+        return
+    }
+    removed, err := app.honeypots.Remove(reqctx.Tenant(r.Context()), id)
+    if err != nil {
+        reqctx.Logger(r.Context()).Error("removing honeypot failed", "student_id", id, "error", err)
+        httpError(w, r, "Internal server error", http.StatusInternalServerError)
+        return
+    }
+    if !removed {
+        httpError(w, r, "Honeypot not found", http.StatusNotFound)
+        return
+    }
+    version, err := store.Delete(id)
+    if err != nil && !errors.Is(err, errStudentNotFound) {
+        writeStoreError(w, r, err)
+        return
+    }
+    app.recordChanges(r, version)
+    w.WriteHeader(http.StatusNoContent)
+}
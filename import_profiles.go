@@ -0,0 +1,274 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "github.com/gorilla/mux"
+)
+
+// Student fields an import column can be mapped to. birth_date is converted
+// into an age using the column's date format; updated_at is the source
+// system's modification time, used by the newest-wins conflict policy.
+var importFields = map[string]bool{
+    "name":       true,
+    "age":        true,
+    "email":      true,
+    "birth_date": true,
+    "updated_at": true,
+}
+
+// columnTransforms are the value transforms applied in order to a mapped cell
+var columnTransforms = map[string]func(string) string{
+    "trim":      strings.TrimSpace,
+    "lower":     strings.ToLower,
+    "upper":     strings.ToUpper,
+    "titlecase": titleCase,
+    "collapse":  func(s string) string { return strings.Join(strings.Fields(s), " ") },
+}
+
+// dateFormatTokens translates common date tokens into Go reference layouts
+var dateFormatTokens = strings.NewReplacer(
+    "YYYY", "2006",
+    "YY", "06",
+    "MM", "01",
+    "DD", "02",
+)
+
+var profileNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// ColumnMapping maps one source column onto a student field
+type ColumnMapping struct {
+    Source     string   `json:"source"`
+    Field      string   `json:"field"`
+    Transforms []string `json:"transforms,omitempty"`
+    // DateFormat is required for birth_date, e.g. "MM/DD/YYYY" or a Go layout;
+    // updated_at defaults to RFC 3339
+    DateFormat string `json:"date_format,omitempty"`
+}
+
+// ImportProfile is a saved, named set of column mappings for a recurring import format
+type ImportProfile struct {
+    Name      string          `json:"name"`
+    Columns   []ColumnMapping `json:"columns"`
+    UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// Validate checks if the profile is usable
+func (p ImportProfile) Validate() []ValidationError {
+    var errors []ValidationError
+
+    if !profileNamePattern.MatchString(p.Name) {
+        errors = append(errors, ValidationError{
+            Field:   "name",
+            Code:    CodeOutOfRange,
+            Message: "Name must be lowercase letters, digits, '-' or '_'",
+        })
+    }
+
+    if len(p.Columns) == 0 {
+        errors = append(errors, ValidationError{
+            Field:   "columns",
+            Code:    CodeRequired,
+            Message: "At least one column mapping is required",
+        })
+    }
+
+    mapped := make(map[string]bool)
+    for i, c := range p.Columns {
+        field := fmt.Sprintf("columns[%d]", i)
+        if c.Source == "" {
+            errors = append(errors, ValidationError{Field: field + ".source", Code: CodeRequired, Message: "Source column is required"})
+        }
+        if !importFields[c.Field] {
+            errors = append(errors, ValidationError{Field: field + ".field", Code: CodeOutOfRange, Message: "Field must be one of name, age, email, birth_date, updated_at"})
+        } else if mapped[c.Field] {
+            errors = append(errors, ValidationError{Field: field + ".field", Code: CodeOutOfRange, Message: "Field " + c.Field + " is mapped more than once"})
+        }
+        mapped[c.Field] = true
+        for _, t := range c.Transforms {
+            if _, ok := columnTransforms[t]; !ok {
+                errors = append(errors, ValidationError{Field: field + ".transforms", Code: CodeOutOfRange, Message: "Unknown transform " + t})
+            }
+        }
+        if c.Field == "birth_date" && c.DateFormat == "" {
+            errors = append(errors, ValidationError{Field: field + ".date_format", Code: CodeRequired, Message: "Date format is required for birth_date"})
+        }
+    }
+
+    if mapped["age"] && mapped["birth_date"] {
+        errors = append(errors, ValidationError{Field: "columns", Code: CodeOutOfRange, Message: "Map either age or birth_date, not both"})
+    }
+
+    return errors
+}
+
+// MapRow converts one source row into a student using the profile's mappings.
+// The header gives the source column names in row order; matching is case-insensitive.
+func (p ImportProfile) MapRow(header, row []string, now time.Time) (Student, []ValidationError) {
+    index := make(map[string]int, len(header))
+    for i, h := range header {
+        index[strings.ToLower(strings.TrimSpace(h))] = i
+    }
+
+    var student Student
+    var errors []ValidationError
+    for _, c := range p.Columns {
+        i, ok := index[strings.ToLower(c.Source)]
+        if !ok || i >= len(row) {
+            errors = append(errors, ValidationError{Field: c.Field, Code: CodeRequired, Message: "Missing source column " + c.Source})
+            continue
+        }
+
+        value := row[i]
+        for _, t := range c.Transforms {
+            value = columnTransforms[t](value)
+        }
+
+        switch c.Field {
+        case "name":
+            student.Name = value
+        case "email":
+            student.Email = value
+        case "age":
+            age, err := strconv.Atoi(strings.TrimSpace(value))
+            if err != nil {
+                errors = append(errors, ValidationError{Field: "age", Code: CodeOutOfRange, Message: "Age must be a whole number"})
+                continue
+            }
+            student.Age = age
+        case "birth_date":
+            born, err := time.Parse(dateFormatTokens.Replace(c.DateFormat), strings.TrimSpace(value))
+            if err != nil {
+                errors = append(errors, ValidationError{Field: "birth_date", Code: CodeOutOfRange, Message: "Birth date does not match format " + c.DateFormat})
+                continue
+            }
+            student.Age = ageOn(born, now)
+        case "updated_at":
+            layout := time.RFC3339
+            if c.DateFormat != "" {
+                layout = dateFormatTokens.Replace(c.DateFormat)
+            }
+            updated, err := time.Parse(layout, strings.TrimSpace(value))
+            if err != nil {
+                errors = append(errors, ValidationError{Field: "updated_at", Code: CodeOutOfRange, Message: "Updated at does not match format " + layout})
+                continue
+            }
+            student.UpdatedAt = updated.UTC()
+        }
+    }
+    return student, errors
+}
+
+// defaultImportProfile maps columns named after the student fields with trimming
+var defaultImportProfile = ImportProfile{
+    Name: "default",
+    Columns: []ColumnMapping{
+        {Source: "name", Field: "name", Transforms: []string{"trim"}},
+        {Source: "age", Field: "age", Transforms: []string{"trim"}},
+        {Source: "email", Field: "email", Transforms: []string{"trim"}},
+    },
+}
+
+// ageOn returns the age in whole years of someone born on born at the given time
+func ageOn(born, now time.Time) int {
+    age := now.Year() - born.Year()
+    if now.Month() < born.Month() || (now.Month() == born.Month() && now.Day() < born.Day()) {
+        age--
+    }
+    return age
+}
+
+func titleCase(s string) string {
+    words := strings.Fields(strings.ToLower(s))
+    for i, w := range words {
+        words[i] = strings.ToUpper(w[:1]) + w[1:]
+    }
+    return strings.Join(words, " ")
+}
+
+// ImportProfileStore keeps saved import profiles with thread-safe operations
+type ImportProfileStore struct {
+    sync.RWMutex
+    profiles map[string]ImportProfile
+}
+
+// NewImportProfileStore initializes a new ImportProfileStore
+func NewImportProfileStore() *ImportProfileStore {
+    return &ImportProfileStore{profiles: make(map[string]ImportProfile)}
+}
+
+// Get returns a saved profile by name
+func (s *ImportProfileStore) Get(name string) (ImportProfile, bool) {
+    s.RLock()
+    defer s.RUnlock()
+    p, ok := s.profiles[name]
+    return p, ok
+}
+
+func (app *App) ListImportProfiles(w http.ResponseWriter, r *http.Request) {
+    app.importProfiles.RLock()
+    profiles := make([]ImportProfile, 0, len(app.importProfiles.profiles))
+    for _, p := range app.importProfiles.profiles {
+        profiles = append(profiles, p)
+    }
+    app.importProfiles.RUnlock()
+
+    sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name < profiles[j].Name })
+    json.NewEncoder(w).Encode(profiles)
+}
+
+func (app *App) GetImportProfile(w http.ResponseWriter, r *http.Request) {
+    profile, exists := app.importProfiles.Get(mux.Vars(r)["name"])
+    if !exists {
+        httpError(w, r, "Import profile not found", http.StatusNotFound)
+        return
+    }
+    json.NewEncoder(w).Encode(profile)
+}
+
+func (app *App) PutImportProfile(w http.ResponseWriter, r *http.Request) {
+    var profile ImportProfile
+    if err := json.NewDecoder(r.Body).Decode(&profile); err != nil {
+        httpError(w, r, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    profile.Name = mux.Vars(r)["name"]
+
+    if errors := profile.Validate(); len(errors) > 0 {
+        writeValidationErrors(w, r, errors)
+        return
+    }
+    profile.UpdatedAt = time.Now().UTC()
+
+    app.importProfiles.Lock()
+    _, existed := app.importProfiles.profiles[profile.Name]
+    app.importProfiles.profiles[profile.Name] = profile
+    app.importProfiles.Unlock()
+
+    if !existed {
+        w.WriteHeader(http.StatusCreated)
+    }
+    json.NewEncoder(w).Encode(profile)
+}
+
+func (app *App) DeleteImportProfile(w http.ResponseWriter, r *http.Request) {
+    name := mux.Vars(r)["name"]
+
+    app.importProfiles.Lock()
+    if _, exists := app.importProfiles.profiles[name]; !exists {
+        app.importProfiles.Unlock()
+        httpError(w, r, "Import profile not found", http.StatusNotFound)
+        return
+    }
+    delete(app.importProfiles.profiles, name)
+    app.importProfiles.Unlock()
+
+    w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+    "encoding/csv"
+    "encoding/json"
+    "fmt"
+    "errors"
+    "io"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "github.com/gorilla/mux"
+    "student-api/reqctx"
+)
+
+// maxImportUpload caps CSV uploads into the staging area
+const maxImportUpload = 32 << 20
+
+// Import batch statuses
+const (
+    ImportStaged    = "staged"
+    ImportCommitted = "committed"
+)
+
+// Staged row actions describing what a commit would do
+const (
+    ActionCreate    = "create"
+    ActionUpdate    = "update"
+    ActionUnchanged = "unchanged"
+    ActionInvalid   = "invalid"
+)
+
+// StagedRow is one uploaded row with its validation result and diff against existing data
+type StagedRow struct {
+    Line       int                    `json:"line"`
+    Student    Student                `json:"student"`
+    Action     string                 `json:"action"`
+    ExistingID int                    `json:"existing_id,omitempty"`
+    Changes    map[string]FieldChange `json:"changes,omitempty"`
+    Errors     []ValidationError      `json:"errors,omitempty"`
+    // Resolution and ConflictID are set on update rows when the batch is committed
+    Resolution string `json:"resolution,omitempty"`
+    ConflictID int    `json:"conflict_id,omitempty"`
+    // CreatedID is the new student's ID once a create row is applied
+    CreatedID int `json:"created_id,omitempty"`
+
+    // mappingErrors come from reading the source row and survive re-planning
+    mappingErrors []ValidationError
+}
+
+// ImportCounts tallies staged rows by action
+type ImportCounts struct {
+    Create    int `json:"create"`
+    Update    int `json:"update"`
+    Unchanged int `json:"unchanged"`
+    Invalid   int `json:"invalid"`
+    // Filled in on commit: updates kept local by policy and updates queued for review
+    KeptLocal int `json:"kept_local"`
+    Queued    int `json:"queued"`
+}
+
+// ImportBatch is an upload held in the staging area until it is committed or discarded
+type ImportBatch struct {
+    ID          int            `json:"id"`
+    Tenant      string         `json:"-"`
+    Status      string         `json:"status"`
+    Profile     string         `json:"profile"`
+    Policy      ConflictPolicy `json:"conflict_policy"`
+    CreatedAt   time.Time      `json:"created_at"`
+    CommittedAt *time.Time     `json:"committed_at,omitempty"`
+    Counts      ImportCounts   `json:"counts"`
+    Rows        []StagedRow    `json:"rows"`
+}
+
+// ImportStore is the staging area for two-phase imports. IDs are shared
+// by every tenant, but each tenant sees only its own batches.
+type ImportStore struct {
+    sync.RWMutex
+    batches map[int]*ImportBatch
+    nextID  int
+}
+
+// NewImportStore initializes a new ImportStore
+func NewImportStore() *ImportStore {
+    return &ImportStore{batches: make(map[int]*ImportBatch), nextID: 1}
+}
+
+// batchLocked returns the tenant's batch with the given ID. The caller must
+// hold the lock.
+func (s *ImportStore) batchLocked(tenant string, id int) (*ImportBatch, bool) {
+    batch, exists := s.batches[id]
+    if !exists || batch.Tenant != tenant {
+        return nil, false
+    }
+    return batch, true
+}
+
+// errNoHeader is returned for an empty CSV upload
+var errNoHeader = errors.New("CSV file has no header row")
+
+// readImportCSV maps every CSV row through the profile. Line numbers are
+// 1-based and count the header, so they match what users see in a spreadsheet.
+func readImportCSV(r io.Reader, profile ImportProfile, now time.Time) ([]StagedRow, error) {
+    var rows []StagedRow
+    err := scanImportCSV(r, profile, now, func(row StagedRow) {
+        rows = append(rows, row)
+    })
+    return rows, err
+}
+
+// scanImportCSV reads the CSV one record at a time, passing each mapped row
+// to fn as soon as it is parsed
+func scanImportCSV(r io.Reader, profile ImportProfile, now time.Time, fn func(StagedRow)) error {
+    cr := csv.NewReader(r)
+    cr.FieldsPerRecord = -1
+    cr.TrimLeadingSpace = true
+    cr.ReuseRecord = true
+
+    header, err := cr.Read()
+    if err == io.EOF {
+        return errNoHeader
+    }
+    if err != nil {
+        return err
+    }
+    header = append([]string(nil), header...)
+
+    for line := 2; ; line++ {
+        record, err := cr.Read()
+        if err == io.EOF {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        student, errs := profile.MapRow(header, record, now)
+        fn(StagedRow{Line: line, Student: student, mappingErrors: errs})
+    }
+}
+
+// emailIndex maps lower-cased emails to students; the caller must hold the store lock
+func (s *StudentStore) emailIndex() (map[string]Student, error) {
+    students, err := s.repo.List(liveOptions(ListOptions{}))
+    if err != nil {
+        return nil, err
+    }
+    index := make(map[string]Student, len(students))
+    for _, student := range students {
+        index[strings.ToLower(student.Email)] = student
+    }
+    return index, nil
+}
+
+// planImport validates each row and diffs it against the current students,
+// matching existing records by email. The caller must hold the store lock.
+func (app *App) planImport(store *StudentStore, rows []StagedRow) (ImportCounts, error) {
+    index, err := store.emailIndex()
+    if err != nil {
+        return ImportCounts{}, err
+    }
+    seen := make(map[string]int)
+
+    var counts ImportCounts
+    for i := range rows {
+        row := &rows[i]
+        row.ExistingID = 0
+        row.Changes = nil
+        row.Errors = append(append([]ValidationError(nil), row.mappingErrors...), app.validateStudent(row.Student)...)
+
+        email := strings.ToLower(row.Student.Email)
+        if first, dup := seen[email]; dup && email != "" {
+            row.Errors = append(row.Errors, ValidationError{
+                Field:   "email",
+                Code:    "duplicate",
+                Message: "Email also appears on line " + strconv.Itoa(first),
+            })
+        }
+        seen[email] = row.Line
+
+        if len(row.Errors) > 0 {
+            row.Action = ActionInvalid
+            counts.Invalid++
+            continue
+        }
+
+        existing, exists := index[email]
+        if !exists {
+            row.Action = ActionCreate
+            counts.Create++
+            continue
+        }
+
+        row.ExistingID = existing.ID
+        if changes := diffStudents(existing, row.Student); len(changes) > 0 {
+            row.Action = ActionUpdate
+            row.Changes = changes
+            counts.Update++
+        } else {
+            row.Action = ActionUnchanged
+            counts.Unchanged++
+        }
+    }
+    return counts, nil
+}
+
+// CreateImport parses an uploaded CSV (multipart field "file") into the staging
+// area. An optional ?profile= names the column mapping profile to apply and
+// ?conflict_policy= overrides the default policy used when committing.
+func (app *App) CreateImport(w http.ResponseWriter, r *http.Request) {
+    store := app.storeFor(r)
+    policy := app.conflictPolicy
+    if name := r.URL.Query().Get("conflict_policy"); name != "" {
+        var err error
+        if policy, err = ParseConflictPolicy(name); err != nil {
+            httpError(w, r, err.Error(), http.StatusBadRequest)
+            return
+        }
+    }
+
+    profile := defaultImportProfile
+    if name := r.URL.Query().Get("profile"); name != "" {
+        var exists bool
+        if profile, exists = app.importProfiles.Get(name); !exists {
+            httpError(w, r, "Import profile not found", http.StatusBadRequest)
+            return
+        }
+    }
+
+    r.Body = http.MaxBytesReader(w, r.Body, maxImportUpload)
+    file, _, err := r.FormFile("file")
+    if err != nil {
+        httpError(w, r, "Missing CSV file", http.StatusBadRequest)
+        return
+    }
+    defer file.Close()
+
+    rows, err := readImportCSV(file, profile, time.Now())
+    if err != nil {
+        httpError(w, r, "Invalid CSV: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    batch := &ImportBatch{
+        Tenant:    reqctx.Tenant(r.Context()),
+        Status:    ImportStaged,
+        Profile:   profile.Name,
+        Policy:    policy,
+        CreatedAt: time.Now().UTC(),
+        Rows:      rows,
+    }
+
+    store.RLock()
+    batch.Counts, err = app.planImport(store, batch.Rows)
+    store.RUnlock()
+    if err != nil {
+        writeStoreError(w, r, err)
+        return
+    }
+
+    app.imports.Lock()
+    batch.ID = app.imports.nextID
+    app.imports.nextID++
+    app.imports.batches[batch.ID] = batch
+    app.imports.Unlock()
+
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(batch)
+}
+
+func (app *App) ListImports(w http.ResponseWriter, r *http.Request) {
+    tenant := reqctx.Tenant(r.Context())
+    app.imports.RLock()
+    batches := make([]ImportBatch, 0, len(app.imports.batches))
+    for _, b := range app.imports.batches {
+        if b.Tenant != tenant {
+            continue
+        }
+        summary := *b
+        summary.Rows = nil
+        batches = append(batches, summary)
+    }
+    app.imports.RUnlock()
+
+    sort.Slice(batches, func(i, j int) bool { return batches[i].ID < batches[j].ID })
+    json.NewEncoder(w).Encode(batches)
+}
+
+func (app *App) GetImport(w http.ResponseWriter, r *http.Request) {
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        httpError(w, r, "Invalid ID", http.StatusBadRequest)
+        return
+    }
+
+    app.imports.RLock()
+    defer app.imports.RUnlock()
+    batch, exists := app.imports.batchLocked(reqctx.Tenant(r.Context()), id)
+    if !exists {
+        httpError(w, r, "Import not found", http.StatusNotFound)
+        return
+    }
+    json.NewEncoder(w).Encode(batch)
+}
+
+// CommitImport applies a staged batch in one step while holding the store
+// lock, so readers see either none or all of its changes. The plan is
+// recomputed against current data first; if any row has become invalid the
+// commit is refused and the refreshed plan is returned for review. Updates to
+// existing records go through the batch's conflict policy.
+func (app *App) CommitImport(w http.ResponseWriter, r *http.Request) {
+    store := app.storeFor(r)
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        httpError(w, r, "Invalid ID", http.StatusBadRequest)
+        return
+    }
+
+    app.imports.Lock()
+    defer app.imports.Unlock()
+    batch, exists := app.imports.batchLocked(reqctx.Tenant(r.Context()), id)
+    if !exists {
+        httpError(w, r, "Import not found", http.StatusNotFound)
+        return
+    }
+    if batch.Status != ImportStaged {
+        httpError(w, r, "Import has already been committed", http.StatusConflict)
+        return
+    }
+
+    store.Lock()
+    defer store.Unlock()
+
+    batch.Counts, err = app.planImport(store, batch.Rows)
+    if err != nil {
+        writeStoreError(w, r, err)
+        return
+    }
+
+    if batch.Counts.Invalid > 0 {
+        var details []ValidationError
+        for _, row := range batch.Rows {
+            for _, e := range row.Errors {
+                e.Field = fmt.Sprintf("line %d: %s", row.Line, e.Field)
+                details = append(details, e)
+            }
+        }
+        writeAPIError(w, r, http.StatusConflict, APIError{
+            Code:    "import_invalid",
+            Message: fmt.Sprintf("Import has %d invalid rows; see GET /imports/%d", batch.Counts.Invalid, id),
+            Details: details,
+        })
+        return
+    }
+
+    now := time.Now().UTC()
+    source := "import:" + strconv.Itoa(batch.ID)
+    for i := range batch.Rows {
+        row := &batch.Rows[i]
+        var version StudentVersion
+        var err error
+        switch row.Action {
+        case ActionCreate:
+            _, version, err = store.insertLocked(row.Student)
+        case ActionUpdate:
+            var local Student
+            if local, err = store.Get(row.ExistingID); err != nil {
+                break
+            }
+            row.Resolution = batch.Policy.decide(local, row.Student)
+            switch row.Resolution {
+            case ResolutionApplied:
+                student := row.Student
+                student.ID = row.ExistingID
+                _, version, err = store.replaceLocked(student)
+            case ResolutionKeptLocal:
+                batch.Counts.KeptLocal++
+            case ResolutionQueued:
+                row.ConflictID = app.conflicts.Queue(batch.Tenant, source, local, row.Student)
+                batch.Counts.Queued++
+            }
+        }
+        app.recordChanges(r, version)
+        if err != nil {
+            writeStoreError(w, r, fmt.Errorf("import %d line %d: %w", batch.ID, row.Line, err))
+            return
+        }
+    }
+
+    batch.Status = ImportCommitted
+    batch.CommittedAt = &now
+
+    json.NewEncoder(w).Encode(batch)
+}
+
+func (app *App) DeleteImport(w http.ResponseWriter, r *http.Request) {
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        httpError(w, r, "Invalid ID", http.StatusBadRequest)
+        return
+    }
+
+    app.imports.Lock()
+    if _, exists := app.imports.batchLocked(reqctx.Tenant(r.Context()), id); !exists {
+        app.imports.Unlock()
+        httpError(w, r, "Import not found", http.StatusNotFound)
+        return
+    }
+    delete(app.imports.batches, id)
+    app.imports.Unlock()
+
+    w.WriteHeader(http.StatusNoContent)
+}
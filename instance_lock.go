@@ -0,0 +1,255 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "fmt"
+    "hash/fnv"
+    "log/slog"
+    "os"
+    "sync"
+    "syscall"
+    "time"
+)
+
+// Names of the locks that keep work to one instance among those sharing
+// storage
+const (
+    lockMigrations = "migrations"
+    // lockLeader is held by the instance running the leader's subsystems
+    lockLeader = "leader"
+)
+
+// lockRetryInterval is how often a lock held elsewhere is tried again, and
+// how often a held one is checked
+const lockRetryInterval = 2 * time.Second
+
+// migrationLockTimeout bounds the wait for another instance's migrations
+const migrationLockTimeout = 5 * time.Minute
+
+// Locker hands out named locks that exclude every other instance sharing
+// the same storage
+type Locker interface {
+    // TryLock takes name without waiting, returning nil when another
+    // instance holds it
+    TryLock(ctx context.Context, name string) (HeldLock, error)
+}
+
+// HeldLock is a lock taken by TryLock
+type HeldLock interface {
+    // Check fails once the lock may have been lost, e.g. with the database
+    // session that held it
+    Check(ctx context.Context) error
+    Unlock() error
+}
+
+// NewLocker returns the Locker for a backend: advisory locks on PostgreSQL
+// and MySQL, lock files next to the SQLite database, and for the memory
+// backend, which has no other instances, locks within the process
+func NewLocker(backend string, db *sql.DB, databasePath string) Locker {
+    switch backend {
+    case BackendPostgres:
+        return &sessionLocker{db: db, lock: "SELECT pg_try_advisory_lock($1)", unlock: "SELECT pg_advisory_unlock($1)", key: postgresLockKey}
+    case BackendMySQL:
+        return &sessionLocker{db: db, lock: "SELECT GET_LOCK(?, 0)", unlock: "SELECT RELEASE_LOCK(?)", key: mysqlLockKey}
+    case BackendSQLite:
+        return fileLocker{prefix: databasePath}
+    }
+    return &processLocker{held: make(map[string]bool)}
+}
+
+// postgresLockKey hashes a lock name into PostgreSQL's bigint lock space
+func postgresLockKey(name string) interface{} {
+    h := fnv.New64a()
+    h.Write([]byte("student-api/" + name))
+    return int64(h.Sum64())
+}
+
+// mysqlLockKey names a MySQL user lock, which is global to the server
+func mysqlLockKey(name string) interface{} {
+    return "student-api/" + name
+}
+
+// sessionLocker takes session-level advisory locks, each on a connection of
+// its own kept for as long as the lock is held; the database releases the
+// lock if that connection drops
+type sessionLocker struct {
+    db     *sql.DB
+    lock   string
+    unlock string
+    key    func(name string) interface{}
+}
+
+func (l *sessionLocker) TryLock(ctx context.Context, name string) (HeldLock, error) {
+    conn, err := l.db.Conn(ctx)
+    if err != nil {
+        return nil, err
+    }
+    key := l.key(name)
+    // MySQL answers NULL rather than 0 when the lock could not be taken
+    var ok sql.NullBool
+    if err := conn.QueryRowContext(ctx, l.lock, key).Scan(&ok); err != nil || !ok.Bool {
+        conn.Close()
+        return nil, err
+    }
+    return &sessionLock{conn: conn, unlock: l.unlock, key: key}, nil
+}
+
+// sessionLock is an advisory lock and the connection holding it
+type sessionLock struct {
+    conn   *sql.Conn
+    unlock string
+    key    interface{}
+}
+
+func (l *sessionLock) Check(ctx context.Context) error {
+    return l.conn.PingContext(ctx)
+}
+
+func (l *sessionLock) Unlock() error {
+    _, err := l.conn.ExecContext(context.Background(), l.unlock, l.key)
+    // Closing the connection releases the lock even if unlocking failed
+    if cerr := l.conn.Close(); err == nil {
+        err = cerr
+    }
+    return err
+}
+
+// fileLocker takes flock(2) locks on files beside the SQLite database,
+// which only instances on the same host can share
+type fileLocker struct {
+    prefix string
+}
+
+func (l fileLocker) TryLock(ctx context.Context, name string) (HeldLock, error) {
+    f, err := os.OpenFile(l.prefix+"."+name+".lock", os.O_CREATE|os.O_RDWR, 0o644)
+    if err != nil {
+        return nil, err
+    }
+    if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+        f.Close()
+        if errors.Is(err, syscall.EWOULDBLOCK) {
+            return nil, nil
+        }
+        return nil, err
+    }
+    return fileLock{f}, nil
+}
+
+// fileLock is a locked file; the lock goes with the file descriptor, so
+// the file itself is left in place
+type fileLock struct {
+    f *os.File
+}
+
+func (l fileLock) Check(context.Context) error { return nil }
+
+func (l fileLock) Unlock() error {
+    return l.f.Close()
+}
+
+// processLocker excludes holders within this process only
+type processLocker struct {
+    mu   sync.Mutex
+    held map[string]bool
+}
+
+func (l *processLocker) TryLock(ctx context.Context, name string) (HeldLock, error) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.held[name] {
+        return nil, nil
+    }
+    l.held[name] = true
+    return processLock{l, name}, nil
+}
+
+type processLock struct {
+    l    *processLocker
+    name string
+}
+
+func (p processLock) Check(context.Context) error { return nil }
+
+func (p processLock) Unlock() error {
+    p.l.mu.Lock()
+    defer p.l.mu.Unlock()
+    delete(p.l.held, p.name)
+    return nil
+}
+
+// waitLock takes name, trying again every lockRetryInterval, until ctx ends
+func waitLock(ctx context.Context, locker Locker, name string) (HeldLock, error) {
+    for {
+        lock, err := locker.TryLock(ctx, name)
+        if lock != nil {
+            return lock, nil
+        }
+        if err != nil && ctx.Err() == nil {
+            slog.Warn("taking instance lock failed; retrying", "lock", name, "error", err)
+        }
+        select {
+        case <-ctx.Done():
+            return nil, ctx.Err()
+        case <-time.After(lockRetryInterval):
+        }
+    }
+}
+
+// withLock runs fn holding name, waiting up to timeout for another instance
+// to release it
+func withLock(locker Locker, name string, timeout time.Duration, fn func() error) error {
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    lock, err := waitLock(ctx, locker, name)
+    if err != nil {
+        return fmt.Errorf("waiting for the %s lock: %w", name, err)
+    }
+    defer lock.Unlock()
+    return fn()
+}
+
+// runExclusive runs fn on one instance at a time. It waits for the lock, then
+// runs fn with a context cancelled when ctx ends or the lock is lost, and
+// once fn returns releases the lock and, unless ctx has ended, waits for it
+// again. Standby instances keep trying, so one takes over within
+// lockRetryInterval of the holder stopping.
+func runExclusive(ctx context.Context, locker Locker, name string, metrics *Metrics, fn func(ctx context.Context)) {
+    for {
+        lock, err := waitLock(ctx, locker, name)
+        if err != nil {
+            return
+        }
+        slog.Info("holding instance lock; running here", "lock", name)
+        metrics.Set("instance_lock_held", 1, "lock", name)
+
+        runCtx, cancel := context.WithCancel(ctx)
+        done := make(chan struct{})
+        go func() {
+            defer close(done)
+            fn(runCtx)
+        }()
+        ticker := time.NewTicker(lockRetryInterval)
+    running:
+        for {
+            select {
+            case <-done:
+                break running
+            case <-ticker.C:
+                if err := lock.Check(runCtx); err != nil && runCtx.Err() == nil {
+                    slog.Error("instance lock lost; stopping", "lock", name, "error", err)
+                    metrics.Inc("instance_lock_lost_total", "lock", name)
+                    cancel()
+                }
+            }
+        }
+        ticker.Stop()
+        cancel()
+        lock.Unlock()
+        metrics.Set("instance_lock_held", 0, "lock", name)
+        if ctx.Err() != nil {
+            return
+        }
+    }
+}
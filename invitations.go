@@ -0,0 +1,708 @@
+package main
+
+import (
+    "crypto/rand"
+    "database/sql"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "github.com/gorilla/mux"
+    "student-api/reqctx"
+)
+
+// Invitation statuses. Only open, redeemed and revoked are stored; an open
+// invitation past its expiry reads as expired.
+const (
+    InvitationOpen     = "open"
+    InvitationRedeemed = "redeemed"
+    InvitationRevoked  = "revoked"
+    InvitationExpired  = "expired"
+)
+
+// invitationTokenPrefix marks invitation tokens in links and logs
+const invitationTokenPrefix = "inv_"
+
+var (
+    errInvitationNotFound = errors.New("invitation not found")
+    errInvitationChanged  = errors.New("invitation has changed")
+    errInvitationToken    = errors.New("invitation is invalid, used or expired")
+)
+
+// Invitation is an admin's single-use link to enrol one student. Its fields
+// pre-fill the student record; redeeming it creates the student and,
+// optionally, the student's account.
+type Invitation struct {
+    ID         int        `json:"id"`
+    Tenant     string     `json:"tenant,omitempty"`
+    Name       string     `json:"name,omitempty"`
+    Age        int        `json:"age,omitempty"`
+    Email      string     `json:"email,omitempty"`
+    Status     string     `json:"status"`
+    CreatedBy  string     `json:"created_by"`
+    CreatedAt  time.Time  `json:"created_at"`
+    ExpiresAt  time.Time  `json:"expires_at"`
+    RedeemedAt *time.Time `json:"redeemed_at,omitempty"`
+    RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+    RevokedBy  string     `json:"revoked_by,omitempty"`
+    // StudentID and Username are the student and account redeeming created
+    StudentID int    `json:"student_id,omitempty"`
+    Username  string `json:"username,omitempty"`
+
+    tokenHash string
+}
+
+// withStatus reports an open invitation past its expiry as expired
+func (inv Invitation) withStatus(now time.Time) Invitation {
+    if inv.Status == InvitationOpen && !now.Before(inv.ExpiresAt) {
+        inv.Status = InvitationExpired
+    }
+    return inv
+}
+
+// InvitationRequest is the body of POST /admin/invitations. Every student
+// field is optional; ExpiresIn defaults to INVITATION_TTL.
+type InvitationRequest struct {
+    Name      string `json:"name,omitempty"`
+    Age       int    `json:"age,omitempty"`
+    Email     string `json:"email,omitempty"`
+    ExpiresIn string `json:"expires_in,omitempty"`
+    // Send mails the link to Email
+    Send bool `json:"send,omitempty"`
+}
+
+// InvitationPreview is what an invitation pre-fills, for the redeem form
+type InvitationPreview struct {
+    Name      string    `json:"name,omitempty"`
+    Age       int       `json:"age,omitempty"`
+    Email     string    `json:"email,omitempty"`
+    ExpiresAt time.Time `json:"expires_at"`
+}
+
+// InvitationRedemption is the body of POST /invitations/redeem. Student
+// fields complete or correct the pre-filled ones, except a pre-filled email,
+// which is the address the invitation was made for. Username and Password
+// create a readonly account when JWT auth is on.
+type InvitationRedemption struct {
+    Token    string `json:"token"`
+    Name     string `json:"name,omitempty"`
+    Age      int    `json:"age,omitempty"`
+    Email    string `json:"email,omitempty"`
+    Username string `json:"username,omitempty"`
+    Password string `json:"password,omitempty"`
+}
+
+// InvitationRepository persists invitations with the SHA-256 hex of their
+// token
+type InvitationRepository interface {
+    Create(inv Invitation) (Invitation, error)
+    ByID(tenant string, id int) (Invitation, error)
+    ByToken(tokenHash string) (Invitation, error)
+    // List returns the tenant's invitations, oldest first
+    List(tenant string) ([]Invitation, error)
+    // Update saves inv if its stored status is still from, and otherwise
+    // fails with errInvitationChanged, so an invitation is redeemed once
+    Update(inv Invitation, from string) error
+}
+
+// MemoryInvitationRepository keeps invitations in memory, for
+// STORE_BACKEND=memory
+type MemoryInvitationRepository struct {
+    sync.RWMutex
+    invitations map[int]*Invitation
+    nextID      int
+}
+
+// NewMemoryInvitationRepository initializes a new MemoryInvitationRepository
+func NewMemoryInvitationRepository() *MemoryInvitationRepository {
+    return &MemoryInvitationRepository{invitations: make(map[int]*Invitation), nextID: 1}
+}
+
+func (m *MemoryInvitationRepository) Create(inv Invitation) (Invitation, error) {
+    m.Lock()
+    defer m.Unlock()
+    inv.ID = m.nextID
+    m.nextID++
+    m.invitations[inv.ID] = &inv
+    return inv, nil
+}
+
+func (m *MemoryInvitationRepository) ByID(tenant string, id int) (Invitation, error) {
+    m.RLock()
+    defer m.RUnlock()
+    if inv, exists := m.invitations[id]; exists && inv.Tenant == tenant {
+        return *inv, nil
+    }
+    return Invitation{}, errInvitationNotFound
+}
+
+func (m *MemoryInvitationRepository) ByToken(tokenHash string) (Invitation, error) {
+    m.RLock()
+    defer m.RUnlock()
+    for _, inv := range m.invitations {
+        if inv.tokenHash == tokenHash {
+            return *inv, nil
+        }
+    }
+    return Invitation{}, errInvitationNotFound
+}
+
+func (m *MemoryInvitationRepository) List(tenant string) ([]Invitation, error) {
+    m.RLock()
+    invitations := []Invitation{}
+    for _, inv := range m.invitations {
+        if inv.Tenant == tenant {
+            invitations = append(invitations, *inv)
+        }
+    }
+    m.RUnlock()
+    sort.Slice(invitations, func(i, j int) bool { return invitations[i].ID < invitations[j].ID })
+    return invitations, nil
+}
+
+func (m *MemoryInvitationRepository) Update(inv Invitation, from string) error {
+    m.Lock()
+    defer m.Unlock()
+    stored, exists := m.invitations[inv.ID]
+    if !exists {
+        return errInvitationNotFound
+    }
+    if stored.Status != from {
+        return errInvitationChanged
+    }
+    m.invitations[inv.ID] = &inv
+    return nil
+}
+
+// SQLInvitationRepository keeps invitations in the invitations table
+type SQLInvitationRepository struct {
+    db     *sql.DB
+    rebind func(string) string
+    // returning is set for PostgreSQL, whose driver has no LastInsertId
+    returning bool
+}
+
+// NewSQLInvitationRepository creates a repository; rebind may be nil
+func NewSQLInvitationRepository(db *sql.DB, rebind func(string) string, returning bool) *SQLInvitationRepository {
+    if rebind == nil {
+        rebind = func(q string) string { return q }
+    }
+    return &SQLInvitationRepository{db: db, rebind: rebind, returning: returning}
+}
+
+const invitationColumns = `id, tenant, token_hash, name, age, email, status, created_by, created_at, expires_at, redeemed_at, revoked_at, revoked_by, student_id, username`
+
+func scanInvitation(row interface{ Scan(...interface{}) error }) (Invitation, error) {
+    var inv Invitation
+    var created, expires string
+    var redeemed, revoked sql.NullString
+    if err := row.Scan(&inv.ID, &inv.Tenant, &inv.tokenHash, &inv.Name, &inv.Age, &inv.Email, &inv.Status, &inv.CreatedBy,
+        &created, &expires, &redeemed, &revoked, &inv.RevokedBy, &inv.StudentID, &inv.Username); err != nil {
+        return Invitation{}, err
+    }
+    var err error
+    if inv.CreatedAt, err = time.Parse(time.RFC3339Nano, created); err != nil {
+        return Invitation{}, err
+    }
+    if inv.ExpiresAt, err = time.Parse(time.RFC3339Nano, expires); err != nil {
+        return Invitation{}, err
+    }
+    for _, field := range []struct {
+        value sql.NullString
+        to    **time.Time
+    }{{redeemed, &inv.RedeemedAt}, {revoked, &inv.RevokedAt}} {
+        if !field.value.Valid {
+            continue
+        }
+        at, err := time.Parse(time.RFC3339Nano, field.value.String)
+        if err != nil {
+            return Invitation{}, err
+        }
+        *field.to = &at
+    }
+    return inv, nil
+}
+
+func (s *SQLInvitationRepository) Create(inv Invitation) (Invitation, error) {
+    query := `INSERT INTO invitations (tenant, token_hash, name, age, email, status, created_by, created_at, expires_at, revoked_by, student_id, username) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, '', 0, '')`
+    args := []interface{}{inv.Tenant, inv.tokenHash, inv.Name, inv.Age, inv.Email, inv.Status, inv.CreatedBy,
+        inv.CreatedAt.Format(time.RFC3339Nano), inv.ExpiresAt.Format(time.RFC3339Nano)}
+    if s.returning {
+        var id int64
+        if err := s.db.QueryRow(s.rebind(query+` RETURNING id`), args...).Scan(&id); err != nil {
+            return Invitation{}, err
+        }
+        inv.ID = int(id)
+        return inv, nil
+    }
+    result, err := s.db.Exec(s.rebind(query), args...)
+    if err != nil {
+        return Invitation{}, err
+    }
+    id, err := result.LastInsertId()
+    if err != nil {
+        return Invitation{}, err
+    }
+    inv.ID = int(id)
+    return inv, nil
+}
+
+func (s *SQLInvitationRepository) one(where string, args ...interface{}) (Invitation, error) {
+    row := s.db.QueryRow(s.rebind(`SELECT `+invitationColumns+` FROM invitations WHERE `+where), args...)
+    inv, err := scanInvitation(row)
+    if errors.Is(err, sql.ErrNoRows) {
+        return Invitation{}, errInvitationNotFound
+    }
+    return inv, err
+}
+
+func (s *SQLInvitationRepository) ByID(tenant string, id int) (Invitation, error) {
+    return s.one(`tenant = ? AND id = ?`, tenant, id)
+}
+
+func (s *SQLInvitationRepository) ByToken(tokenHash string) (Invitation, error) {
+    return s.one(`token_hash = ?`, tokenHash)
+}
+
+func (s *SQLInvitationRepository) List(tenant string) ([]Invitation, error) {
+    rows, err := s.db.Query(s.rebind(`SELECT `+invitationColumns+` FROM invitations WHERE tenant = ? ORDER BY id`), tenant)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    invitations := []Invitation{}
+    for rows.Next() {
+        inv, err := scanInvitation(rows)
+        if err != nil {
+            return nil, err
+        }
+        invitations = append(invitations, inv)
+    }
+    return invitations, rows.Err()
+}
+
+func (s *SQLInvitationRepository) Update(inv Invitation, from string) error {
+    result, err := s.db.Exec(s.rebind(`UPDATE invitations SET status = ?, redeemed_at = ?, revoked_at = ?, revoked_by = ?, student_id = ?, username = ? WHERE id = ? AND status = ?`),
+        inv.Status, nullTime(inv.RedeemedAt), nullTime(inv.RevokedAt), inv.RevokedBy, inv.StudentID, inv.Username, inv.ID, from)
+    if err != nil {
+        return err
+    }
+    if n, err := result.RowsAffected(); err == nil && n == 0 {
+        if _, err := s.ByID(inv.Tenant, inv.ID); err != nil {
+            return err
+        }
+        return errInvitationChanged
+    }
+    return nil
+}
+
+// InvitationStore issues, redeems and revokes invitations
+type InvitationStore struct {
+    repo InvitationRepository
+    ttl  time.Duration
+    // link is INVITATION_URL, to which tokens are appended
+    link string
+}
+
+// LoadInvitationStore reads INVITATION_TTL (default 7 days) and
+// INVITATION_URL, the redeem page links are made from
+func LoadInvitationStore(repo InvitationRepository) (*InvitationStore, error) {
+    s := &InvitationStore{
+        repo: repo,
+        ttl:  getEnvDuration("INVITATION_TTL", 7*24*time.Hour),
+        link: getEnv("INVITATION_URL", ""),
+    }
+    if s.ttl <= 0 {
+        return nil, fmt.Errorf("INVITATION_TTL must be positive, got %s", s.ttl)
+    }
+    return s, nil
+}
+
+// Issue creates an invitation and returns it with its token, which is not
+// stored and cannot be shown again
+func (s *InvitationStore) Issue(tenant, by string, req InvitationRequest, ttl time.Duration, now time.Time) (Invitation, string, error) {
+    buf := make([]byte, 32)
+    if _, err := rand.Read(buf); err != nil {
+        return Invitation{}, "", err
+    }
+    token := invitationTokenPrefix + hex.EncodeToString(buf)
+    inv, err := s.repo.Create(Invitation{
+        Tenant:    tenant,
+        Name:      strings.TrimSpace(req.Name),
+        Age:       req.Age,
+        Email:     strings.ToLower(strings.TrimSpace(req.Email)),
+        Status:    InvitationOpen,
+        CreatedBy: by,
+        CreatedAt: now,
+        ExpiresAt: now.Add(ttl),
+        tokenHash: hashResetToken(token),
+    })
+    return inv, token, err
+}
+
+// linkFor returns the link to hand to the invitee, or "" without
+// INVITATION_URL
+func (s *InvitationStore) linkFor(token string) string {
+    if s.link == "" {
+        return ""
+    }
+    return s.link + token
+}
+
+// Open returns the open invitation of a token
+func (s *InvitationStore) Open(token string, now time.Time) (Invitation, error) {
+    inv, err := s.repo.ByToken(hashResetToken(token))
+    if errors.Is(err, errInvitationNotFound) {
+        return Invitation{}, errInvitationToken
+    }
+    if err != nil {
+        return Invitation{}, err
+    }
+    if inv.withStatus(now).Status != InvitationOpen {
+        return Invitation{}, errInvitationToken
+    }
+    return inv, nil
+}
+
+// Claim marks an open invitation redeemed, so no one else can redeem it
+// while its student is created
+func (s *InvitationStore) Claim(inv Invitation, now time.Time) (Invitation, error) {
+    inv.Status, inv.RedeemedAt = InvitationRedeemed, &now
+    if err := s.repo.Update(inv, InvitationOpen); errors.Is(err, errInvitationChanged) {
+        return Invitation{}, errInvitationToken
+    } else if err != nil {
+        return Invitation{}, err
+    }
+    return inv, nil
+}
+
+// Redeemed records the student and account a claimed invitation created,
+// or with a studentID of 0 reopens it
+func (s *InvitationStore) Redeemed(inv Invitation, studentID int, username string) (Invitation, error) {
+    if studentID == 0 {
+        inv.Status, inv.RedeemedAt = InvitationOpen, nil
+        return inv, s.repo.Update(inv, InvitationRedeemed)
+    }
+    inv.StudentID, inv.Username = studentID, username
+    return inv, s.repo.Update(inv, InvitationRedeemed)
+}
+
+// Revoke withdraws an open invitation. Revoking a redeemed or revoked one
+// fails with errInvitationChanged and the invitation as it is.
+func (s *InvitationStore) Revoke(tenant string, id int, by string, now time.Time) (Invitation, error) {
+    inv, err := s.repo.ByID(tenant, id)
+    if err != nil {
+        return Invitation{}, err
+    }
+    if inv.Status != InvitationOpen {
+        return inv, errInvitationChanged
+    }
+    revoked := inv
+    revoked.Status, revoked.RevokedAt, revoked.RevokedBy = InvitationRevoked, &now, by
+    if err := s.repo.Update(revoked, InvitationOpen); errors.Is(err, errInvitationChanged) {
+        if inv, err = s.repo.ByID(tenant, id); err != nil {
+            return Invitation{}, err
+        }
+        return inv, errInvitationChanged
+    } else if err != nil {
+        return Invitation{}, err
+    }
+    return revoked, nil
+}
+
+// emailInvitation mails an invitation through SMTP_HOST
+func emailInvitation(inv Invitation, token, link string) error {
+    host := getEnv("SMTP_HOST", "")
+    if host == "" {
+        return errors.New("SMTP_HOST is not set")
+    }
+    from := getEnv("SMTP_FROM", "accounts@localhost")
+    instructions := "Your invitation code is:\r\n\r\n" + token
+    if link != "" {
+        instructions = "Complete your registration at:\r\n\r\n" + link
+    }
+    greeting := "Hello"
+    if inv.Name != "" {
+        greeting += " " + inv.Name
+    }
+    msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: You are invited to enrol\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n"+
+        "%s,\r\n\r\n%s\r\n\r\nIt expires at %s and works once.\r\n",
+        from, inv.Email, greeting, instructions, inv.ExpiresAt.Format(time.RFC1123))
+    return sendMail(host, from, []string{inv.Email}, []byte(msg))
+}
+
+// CreateInvitation issues an invitation link: POST /admin/invitations
+// {"name": "...", "email": "...", "expires_in": "72h", "send": true}.
+// The token is in the answer only, for the admin to hand over when it is
+// not mailed.
+func (app *App) CreateInvitation(w http.ResponseWriter, r *http.Request) {
+    var req InvitationRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        httpError(w, r, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    ttl := app.invitations.ttl
+    var verrs []ValidationError
+    if req.ExpiresIn != "" {
+        var err error
+        if ttl, err = time.ParseDuration(req.ExpiresIn); err != nil || ttl <= 0 {
+            verrs = append(verrs, ValidationError{Field: "expires_in", Code: CodeOutOfRange, Message: "Expires in must be a positive duration such as 72h"})
+        }
+    }
+    // Pre-filled fields must be valid on their own; the rest is left to the invitee
+    prefill := Student{Name: req.Name, Age: req.Age, Email: req.Email}
+    for _, verr := range app.validateStudent(prefill) {
+        if verr.Code != CodeRequired {
+            verrs = append(verrs, verr)
+        }
+    }
+    if req.Send && strings.TrimSpace(req.Email) == "" {
+        verrs = append(verrs, ValidationError{Field: "email", Code: CodeRequired, Message: "Email is required to send the invitation"})
+    }
+    if len(verrs) > 0 {
+        writeValidationErrors(w, r, verrs)
+        return
+    }
+
+    by := reqctx.User(r.Context())
+    if by == "" {
+        by = "admin"
+    }
+    logger := reqctx.Logger(r.Context())
+    inv, token, err := app.invitations.Issue(reqctx.Tenant(r.Context()), by, req, ttl, time.Now().UTC())
+    if err != nil {
+        logger.Error("issuing invitation failed", "error", err)
+        httpError(w, r, "Internal server error", http.StatusInternalServerError)
+        return
+    }
+    app.metrics.Inc("invitations_total", "event", "issued")
+    logger.Info("invitation issued", "invitation_id", inv.ID, "expires_at", inv.ExpiresAt)
+    link := app.invitations.linkFor(token)
+    if req.Send {
+        go func() {
+            if err := emailInvitation(inv, token, link); err != nil {
+                logger.Error("mailing invitation failed", "invitation_id", inv.ID, "error", err)
+                return
+            }
+            logger.Info("invitation mailed", "invitation_id", inv.ID)
+        }()
+    }
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "invitation": inv,
+        "token":      token,
+        "link":       link,
+    })
+}
+
+// ListInvitations tracks the tenant's invitations: GET /admin/invitations,
+// optionally ?status=open, redeemed, revoked or expired
+func (app *App) ListInvitations(w http.ResponseWriter, r *http.Request) {
+    status := r.URL.Query().Get("status")
+    switch status {
+    case "", InvitationOpen, InvitationRedeemed, InvitationRevoked, InvitationExpired:
+    default:
+        writeValidationErrors(w, r, []ValidationError{{Field: "status", Code: CodeOutOfRange,
+            Message: fmt.Sprintf("Status must be %s, %s, %s or %s", InvitationOpen, InvitationRedeemed, InvitationRevoked, InvitationExpired)}})
+        return
+    }
+    invitations, err := app.invitations.repo.List(reqctx.Tenant(r.Context()))
+    if err != nil {
+        reqctx.Logger(r.Context()).Error("listing invitations failed", "error", err)
+        httpError(w, r, "Internal server error", http.StatusInternalServerError)
+        return
+    }
+    now := time.Now()
+    matched := []Invitation{}
+    for _, inv := range invitations {
+        if inv = inv.withStatus(now); status == "" || inv.Status == status {
+            matched = append(matched, inv)
+        }
+    }
+    json.NewEncoder(w).Encode(matched)
+}
+
+// RevokeInvitation withdraws an open invitation: DELETE /admin/invitations/{id}
+func (app *App) RevokeInvitation(w http.ResponseWriter, r *http.Request) {
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        httpError(w, r, "Invalid ID", http.StatusBadRequest)
+        return
+    }
+    by := reqctx.User(r.Context())
+    if by == "" {
+        by = "admin"
+    }
+    now := time.Now().UTC()
+    inv, err := app.invitations.Revoke(reqctx.Tenant(r.Context()), id, by, now)
+    switch {
+    case errors.Is(err, errInvitationNotFound):
+        httpError(w, r, "Invitation not found", http.StatusNotFound)
+        return
+    case errors.Is(err, errInvitationChanged):
+        httpError(w, r, fmt.Sprintf("Invitation is %s, not open", inv.Status), http.StatusConflict)
+        return
+    case err != nil:
+        reqctx.Logger(r.Context()).Error("revoking invitation failed", "invitation_id", id, "error", err)
+        httpError(w, r, "Internal server error", http.StatusInternalServerError)
+        return
+    }
+    app.metrics.Inc("invitations_total", "event", "revoked")
+    reqctx.Logger(r.Context()).Info("invitation revoked", "invitation_id", inv.ID)
+    json.NewEncoder(w).Encode(inv)
+}
+
+// PreviewInvitation returns what an invitation pre-fills:
+// POST /invitations/lookup {"token": "inv_..."}. The token travels in the
+// body so it stays out of access logs.
+func (app *App) PreviewInvitation(w http.ResponseWriter, r *http.Request) {
+    var body struct {
+        Token string `json:"token"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Token == "" {
+        httpError(w, r, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    inv, ok := app.openInvitation(w, r, body.Token)
+    if !ok {
+        return
+    }
+    json.NewEncoder(w).Encode(InvitationPreview{Name: inv.Name, Age: inv.Age, Email: inv.Email, ExpiresAt: inv.ExpiresAt})
+}
+
+// RedeemInvitation completes an invited registration:
+// POST /invitations/redeem {"token": "inv_...", "age": 20, "username": "...",
+// "password": "..."}. It creates the student in the invitation's tenant and,
+// when a username is given, the student's readonly account.
+func (app *App) RedeemInvitation(w http.ResponseWriter, r *http.Request) {
+    var req InvitationRedemption
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+        httpError(w, r, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    inv, ok := app.openInvitation(w, r, req.Token)
+    if !ok {
+        return
+    }
+
+    student := Student{Name: inv.Name, Age: inv.Age, Email: inv.Email}
+    if name := strings.TrimSpace(req.Name); name != "" {
+        student.Name = name
+    }
+    if req.Age != 0 {
+        student.Age = req.Age
+    }
+    if inv.Email == "" {
+        student.Email = strings.ToLower(strings.TrimSpace(req.Email))
+    }
+    verrs := app.validateStudent(student)
+    var account *UserRequest
+    if req.Username != "" || req.Password != "" {
+        if app.auth == nil {
+            httpError(w, r, "Accounts need authentication; set JWT_SECRET", http.StatusNotFound)
+            return
+        }
+        account = &UserRequest{Username: req.Username, Email: student.Email, Password: req.Password, Role: RoleReadonly}
+        verrs = append(verrs, account.Validate()...)
+    }
+    if len(verrs) > 0 {
+        writeValidationErrors(w, r, verrs)
+        return
+    }
+    if account != nil {
+        if _, static := app.auth.users[account.Username]; static {
+            httpError(w, r, "Username or email is already registered", http.StatusConflict)
+            return
+        }
+    }
+    store, release, err := app.invitationStore(inv.Tenant)
+    if err != nil {
+        reqctx.Logger(r.Context()).Error("opening tenant database failed", "tenant", inv.Tenant, "error", err)
+        httpError(w, r, "Tenant database unavailable", http.StatusServiceUnavailable)
+        return
+    }
+    defer release()
+
+    logger := reqctx.Logger(r.Context())
+    if inv, err = app.invitations.Claim(inv, time.Now().UTC()); err != nil {
+        app.writeInvitationError(w, r, err)
+        return
+    }
+    // The account comes first, since a taken username is the likely
+    // failure; the invitation reopens so the invitee can pick another
+    var username string
+    if account != nil {
+        u, err := app.users.Register(*account, time.Now().UTC())
+        if err != nil {
+            if _, rerr := app.invitations.Redeemed(inv, 0, ""); rerr != nil {
+                logger.Error("reopening invitation failed", "invitation_id", inv.ID, "error", rerr)
+            }
+            if errors.Is(err, errUserExists) {
+                httpError(w, r, "Username or email is already registered", http.StatusConflict)
+                return
+            }
+            logger.Error("registering invited user failed", "invitation_id", inv.ID, "error", err)
+            httpError(w, r, "Internal server error", http.StatusInternalServerError)
+            return
+        }
+        username = u.Username
+    }
+    created, version, err := store.Create(student)
+    if err != nil {
+        // An account already made stays; the invitee can log in and ask an admin
+        if _, rerr := app.invitations.Redeemed(inv, 0, ""); rerr != nil {
+            logger.Error("reopening invitation failed", "invitation_id", inv.ID, "error", rerr)
+        }
+        writeStoreError(w, r, err)
+        return
+    }
+    app.recordChanges(r, version)
+    if inv, err = app.invitations.Redeemed(inv, created.ID, username); err != nil {
+        logger.Error("recording redeemed invitation failed", "invitation_id", inv.ID, "student_id", created.ID, "error", err)
+    }
+    app.metrics.Inc("invitations_total", "event", "redeemed")
+    logger.Info("invitation redeemed", "invitation_id", inv.ID, "student_id", created.ID, "username", username)
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "invitation": inv,
+        "student":    created,
+    })
+}
+
+// openInvitation returns the open invitation of a token, answering the
+// request when there is none
+func (app *App) openInvitation(w http.ResponseWriter, r *http.Request, token string) (Invitation, bool) {
+    inv, err := app.invitations.Open(token, time.Now().UTC())
+    if err != nil {
+        app.writeInvitationError(w, r, err)
+        return Invitation{}, false
+    }
+    return inv, true
+}
+
+// writeInvitationError answers a failed redemption. Unknown, used, revoked
+// and expired tokens get the same answer.
+func (app *App) writeInvitationError(w http.ResponseWriter, r *http.Request, err error) {
+    if errors.Is(err, errInvitationToken) {
+        httpError(w, r, "Invalid or expired invitation", http.StatusBadRequest)
+        return
+    }
+    reqctx.Logger(r.Context()).Error("redeeming invitation failed", "error", err)
+    httpError(w, r, "Internal server error", http.StatusInternalServerError)
+}
+
+// invitationStore returns the store of the tenant an invitation was issued
+// for, with the release func of TenantStores.Store. Redemption is
+// tenant-free, since the invitee knows only the token.
+func (app *App) invitationStore(tenant string) (*StudentStore, func(), error) {
+    if app.tenants == nil {
+        return app.store, func() {}, nil
+    }
+    return app.tenants.Store(tenant)
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+    "student-api/reqctx"
+)
+
+// JWT token types carried in the "typ" claim
+const (
+    TokenAccess  = "access"
+    TokenRefresh = "refresh"
+)
+
+// minJWTSecret is the shortest HS256 secret accepted
+const minJWTSecret = 32
+
+// jwtHeader is the fixed, pre-encoded HS256 header
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+var errInvalidJWT = errors.New("invalid token")
+
+// Claims are the JWT claims issued by /auth/login
+type Claims struct {
+    Subject   string `json:"sub"`
+    Issuer    string `json:"iss"`
+    IssuedAt  int64  `json:"iat"`
+    ExpiresAt int64  `json:"exp"`
+    Type      string `json:"typ"`
+    Role      string `json:"role,omitempty"`
+    // Tenant binds the principal to one tenant; see bindTenant
+    Tenant string `json:"tenant,omitempty"`
+    // ID identifies refresh tokens so each can be used only once
+    ID string `json:"jti,omitempty"`
+}
+
+type claimsKey struct{}
+
+// claimsFrom returns the JWT claims of an authenticated request
+func claimsFrom(ctx context.Context) (Claims, bool) {
+    claims, ok := ctx.Value(claimsKey{}).(Claims)
+    return claims, ok
+}
+
+// JWTAuth issues and verifies HS256 tokens for the users in AUTH_USERS.
+// Refresh tokens rotate: each is accepted once and replaced by a new pair.
+type JWTAuth struct {
+    secret     []byte
+    issuer     string
+    accessTTL  time.Duration
+    refreshTTL time.Duration
+    // users maps usernames to their password hash and role
+    users map[string]authUser
+
+    mu sync.Mutex
+    // refresh maps live refresh token IDs to their expiry
+    refresh map[string]time.Time
+}
+
+// authUser is a configured user: the SHA-256 of their password, their role
+// and the tenant they are bound to, if any
+type authUser struct {
+    hash   [sha256.Size]byte
+    role   string
+    tenant string
+}
+
+// ParseAuthUsers parses "alice:<sha256 hex>:admin,bob:<sha256 hex>::acme";
+// users without a role get defaultRole, and those with a tenant are bound
+// to it
+func ParseAuthUsers(spec string) (map[string]authUser, error) {
+    users := make(map[string]authUser)
+    for _, part := range strings.Split(spec, ",") {
+        part = strings.TrimSpace(part)
+        if part == "" {
+            continue
+        }
+        name, rest, found := strings.Cut(part, ":")
+        digest, rest, _ := strings.Cut(rest, ":")
+        role, tenant, _ := strings.Cut(rest, ":")
+        raw, err := hex.DecodeString(digest)
+        if !found || name == "" || err != nil || len(raw) != sha256.Size {
+            return nil, fmt.Errorf("auth user %q: expected name:<sha256 hex of password>[:role[:tenant]]", name)
+        }
+        if tenant != "" && !validTenantID.MatchString(tenant) {
+            return nil, fmt.Errorf("auth user %q: invalid tenant %q", name, tenant)
+        }
+        user := authUser{tenant: tenant}
+        if user.role, err = parseRole(role); err != nil {
+            return nil, fmt.Errorf("auth user %q: %w", name, err)
+        }
+        copy(user.hash[:], raw)
+        users[name] = user
+    }
+    return users, nil
+}
+
+// LoadJWTAuth reads JWT_SECRET, JWT_ISSUER, JWT_TTL, JWT_REFRESH_TTL and
+// AUTH_USERS. It returns nil, leaving routes open, while JWT_SECRET is unset.
+func LoadJWTAuth() (*JWTAuth, error) {
+    secret := getEnv("JWT_SECRET", "")
+    if secret == "" {
+        return nil, nil
+    }
+    if len(secret) < minJWTSecret {
+        return nil, fmt.Errorf("JWT_SECRET must be at least %d bytes", minJWTSecret)
+    }
+    users, err := ParseAuthUsers(getEnv("AUTH_USERS", ""))
+    if err != nil {
+        return nil, err
+    }
+    return &JWTAuth{
+        secret:     []byte(secret),
+        issuer:     getEnv("JWT_ISSUER", "student-api"),
+        accessTTL:  getEnvDuration("JWT_TTL", 15*time.Minute),
+        refreshTTL: getEnvDuration("JWT_REFRESH_TTL", 7*24*time.Hour),
+        users:      users,
+        refresh:    make(map[string]time.Time),
+    }, nil
+}
+
+func (a *JWTAuth) sign(claims Claims) (string, error) {
+    payload, err := json.Marshal(claims)
+    if err != nil {
+        return "", err
+    }
+    unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+    mac := hmac.New(sha256.New, a.secret)
+    mac.Write([]byte(unsigned))
+    return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Verify checks a token's signature, issuer, expiry and type
+func (a *JWTAuth) Verify(token, typ string, now time.Time) (Claims, error) {
+    parts := strings.Split(token, ".")
+    if len(parts) != 3 || parts[0] != jwtHeader {
+        return Claims{}, errInvalidJWT
+    }
+    signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+    if err != nil {
+        return Claims{}, errInvalidJWT
+    }
+    mac := hmac.New(sha256.New, a.secret)
+    mac.Write([]byte(parts[0] + "." + parts[1]))
+    if !hmac.Equal(signature, mac.Sum(nil)) {
+        return Claims{}, errInvalidJWT
+    }
+
+    payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+    if err != nil {
+        return Claims{}, errInvalidJWT
+    }
+    var claims Claims
+    if err := json.Unmarshal(payload, &claims); err != nil {
+        return Claims{}, errInvalidJWT
+    }
+    if claims.Issuer != a.issuer || claims.Type != typ || claims.Subject == "" {
+        return Claims{}, errInvalidJWT
+    }
+    if now.Unix() >= claims.ExpiresAt {
+        return Claims{}, fmt.Errorf("%w: token expired", errInvalidJWT)
+    }
+    return claims, nil
+}
+
+// TokenPair is the response of /auth/login and /auth/refresh
+type TokenPair struct {
+    AccessToken  string `json:"access_token"`
+    TokenType    string `json:"token_type"`
+    ExpiresIn    int    `json:"expires_in"`
+    RefreshToken string `json:"refresh_token"`
+}
+
+// issue signs a new access and refresh token for user. The access token
+// carries the user's current role and tenant.
+func (a *JWTAuth) issue(user, role, tenant string, now time.Time) (TokenPair, error) {
+    buf := make([]byte, 16)
+    if _, err := rand.Read(buf); err != nil {
+        return TokenPair{}, err
+    }
+    access, err := a.sign(Claims{Subject: user, Issuer: a.issuer, IssuedAt: now.Unix(), ExpiresAt: now.Add(a.accessTTL).Unix(), Type: TokenAccess, Role: role, Tenant: tenant})
+    if err != nil {
+        return TokenPair{}, err
+    }
+    refreshClaims := Claims{Subject: user, Issuer: a.issuer, IssuedAt: now.Unix(), ExpiresAt: now.Add(a.refreshTTL).Unix(), Type: TokenRefresh, ID: hex.EncodeToString(buf)}
+    refresh, err := a.sign(refreshClaims)
+    if err != nil {
+        return TokenPair{}, err
+    }
+
+    a.mu.Lock()
+    for id, expires := range a.refresh {
+        if !now.Before(expires) {
+            delete(a.refresh, id)
+        }
+    }
+    a.refresh[refreshClaims.ID] = now.Add(a.refreshTTL)
+    a.mu.Unlock()
+    return TokenPair{AccessToken: access, TokenType: "Bearer", ExpiresIn: int(a.accessTTL.Seconds()), RefreshToken: refresh}, nil
+}
+
+// checkPassword compares in constant time, also for unknown users
+func (a *JWTAuth) checkPassword(user, password string) bool {
+    want, known := a.users[user]
+    got := sha256.Sum256([]byte(password))
+    return subtle.ConstantTimeCompare(want.hash[:], got[:]) == 1 && known
+}
+
+// authEnabled reports whether JWTs or OIDC tokens are configured, so
+// requests must authenticate
+func (app *App) authEnabled() bool {
+    return app.auth != nil || app.oidc != nil
+}
+
+// authRequired reports whether a request to a route needs credentials once
+// authentication is enabled: every route does unless its role is RoleAny.
+// Route policies may say otherwise.
+func (app *App) authRequired(method, route string) bool {
+    policy := app.routes.For(method, route)
+    if policy != nil && policy.Auth != "" {
+        return policy.Auth == AuthRequired
+    }
+    if policy != nil && policy.Role != "" {
+        return policy.Role != RoleAny
+    }
+    return requiredRole(method, route) != RoleAny
+}
+
+// jwtAuth verifies bearer JWTs and puts their claims into the request
+// context, binding the request to the token's tenant. The ADMIN_TOKEN
+// secret authenticates as the admin of every tenant. Routes of
+// authRequired need a valid access token, an API token or an API key,
+// which apiTokens and apiKeys have already checked; rbac refuses requests
+// that reach them without one. Tokens not signed with our own header go to
+// the OIDC provider when one is configured.
+func (app *App) jwtAuth(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        credential := bearerToken(r)
+        if app.adminToken != "" && subtle.ConstantTimeCompare([]byte(credential), []byte(app.adminToken)) == 1 {
+            next.ServeHTTP(w, r.WithContext(reqctx.WithRole(reqctx.WithUser(r.Context(), "admin"), RoleAdmin)))
+            return
+        }
+        if !app.authEnabled() {
+            next.ServeHTTP(w, r)
+            return
+        }
+        if _, ok := apiKeyFrom(r.Context()); ok || strings.HasPrefix(credential, tokenSecretPrefix) {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        required := app.authRequired(r.Method, routeTemplate(r))
+        claims, err := app.verifyBearer(r.Context(), credential)
+        if err != nil {
+            if !required {
+                next.ServeHTTP(w, r)
+                return
+            }
+            challenge := `Bearer error="invalid_token"`
+            if credential == "" {
+                challenge = "Bearer"
+            } else {
+                reqctx.Logger(r.Context()).Info("bearer token rejected", "error", err)
+            }
+            w.Header().Set("WWW-Authenticate", challenge)
+            httpError(w, r, "A valid bearer token is required", http.StatusUnauthorized)
+            return
+        }
+        role := claims.Role
+        if role == "" {
+            role = defaultRole
+        }
+        r, ok := bindTenant(w, r, role, claims.Tenant)
+        if !ok {
+            return
+        }
+        ctx := reqctx.WithRole(reqctx.WithUser(r.Context(), claims.Subject), role)
+        ctx = context.WithValue(ctx, claimsKey{}, claims)
+        next.ServeHTTP(w, r.WithContext(ctx))
+    })
+}
+
+// verifyBearer checks an access token with whichever verifier issued it
+func (app *App) verifyBearer(ctx context.Context, token string) (Claims, error) {
+    if token == "" {
+        return Claims{}, errInvalidJWT
+    }
+    if app.auth != nil && strings.HasPrefix(token, jwtHeader+".") {
+        return app.auth.Verify(token, TokenAccess, time.Now())
+    }
+    if app.oidc != nil {
+        return app.oidc.Verify(ctx, token, time.Now())
+    }
+    return Claims{}, errInvalidJWT
+}
+
+// Login issues a token pair: POST /auth/login {"username": "...", "password": "..."}
+func (app *App) Login(w http.ResponseWriter, r *http.Request) {
+    if app.auth == nil {
+        httpError(w, r, "Authentication is disabled; set JWT_SECRET", http.StatusNotFound)
+        return
+    }
+    var body struct {
+        Username string `json:"username"`
+        Password string `json:"password"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+        httpError(w, r, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    now := time.Now()
+    role, tenant, err := app.authenticate(body.Username, body.Password, now)
+    if err != nil {
+        app.writeLoginError(w, r, body.Username, err)
+        return
+    }
+
+    pair, err := app.auth.issue(body.Username, role, tenant, now)
+    if err != nil {
+        httpError(w, r, "Failed to issue token", http.StatusInternalServerError)
+        return
+    }
+    reqctx.Logger(r.Context()).Info("login", "username", body.Username)
+    json.NewEncoder(w).Encode(pair)
+}
+
+// RefreshToken exchanges a refresh token for a new pair: POST /auth/refresh
+// {"refresh_token": "..."}. The presented refresh token stops working.
+func (app *App) RefreshToken(w http.ResponseWriter, r *http.Request) {
+    if app.auth == nil {
+        httpError(w, r, "Authentication is disabled; set JWT_SECRET", http.StatusNotFound)
+        return
+    }
+    var body struct {
+        RefreshToken string `json:"refresh_token"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+        httpError(w, r, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+
+    now := time.Now()
+    claims, err := app.auth.Verify(body.RefreshToken, TokenRefresh, now)
+    if err == nil {
+        app.auth.mu.Lock()
+        if _, live := app.auth.refresh[claims.ID]; !live {
+            err = fmt.Errorf("%w: refresh token already used", errInvalidJWT)
+        }
+        delete(app.auth.refresh, claims.ID)
+        app.auth.mu.Unlock()
+    }
+    var role, tenant string
+    if err == nil {
+        role, tenant, err = app.userRole(claims)
+    }
+    if err != nil {
+        httpError(w, r, "Invalid refresh token", http.StatusUnauthorized)
+        return
+    }
+
+    pair, err := app.auth.issue(claims.Subject, role, tenant, now)
+    if err != nil {
+        httpError(w, r, "Failed to issue token", http.StatusInternalServerError)
+        return
+    }
+    json.NewEncoder(w).Encode(pair)
+}
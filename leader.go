@@ -0,0 +1,145 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "os"
+    "sort"
+    "sync"
+    "time"
+)
+
+// Instance roles, as INSTANCE_ROLE sets them
+const (
+    // RoleAuto campaigns for leadership, and leads when elected
+    RoleAuto = "auto"
+    // RoleFollower serves HTTP only and never leads
+    RoleFollower = "follower"
+)
+
+// LeaderElector campaigns for the leader lock and, while this instance holds
+// it, runs the background subsystems registered with it. Every instance
+// serves HTTP whatever its role; leadership only decides where the work that
+// must happen once across instances runs.
+type LeaderElector struct {
+    locker   Locker
+    instance string
+    role     string
+    metrics  *Metrics
+
+    mu          sync.Mutex
+    subsystems  map[string]func(ctx context.Context)
+    leaderSince *time.Time
+}
+
+// LeaderStatus is the leadership part of /healthz
+type LeaderStatus struct {
+    Instance string `json:"instance"`
+    // Role is the configured role; Leader whether this instance leads now
+    Role        string     `json:"role"`
+    Leader      bool       `json:"leader"`
+    LeaderSince *time.Time `json:"leader_since,omitempty"`
+    // Subsystems run only on the leader
+    Subsystems []string `json:"subsystems"`
+}
+
+// LoadLeaderElector reads INSTANCE_ROLE (auto or follower, default auto) and
+// INSTANCE_ID, which names the instance in logs and /healthz (default
+// hostname-pid)
+func LoadLeaderElector(locker Locker, metrics *Metrics) (*LeaderElector, error) {
+    role := getEnv("INSTANCE_ROLE", RoleAuto)
+    if role != RoleAuto && role != RoleFollower {
+        return nil, fmt.Errorf("INSTANCE_ROLE must be %s or %s, got %q", RoleAuto, RoleFollower, role)
+    }
+    host, _ := os.Hostname()
+    instance := getEnv("INSTANCE_ID", fmt.Sprintf("%s-%d", host, os.Getpid()))
+    return &LeaderElector{
+        locker:     locker,
+        instance:   instance,
+        role:       role,
+        metrics:    metrics,
+        subsystems: make(map[string]func(ctx context.Context)),
+    }, nil
+}
+
+// Register adds a subsystem run on the leader until its context ends, which
+// it does when leadership is lost or the server stops. Subsystems are
+// registered before Run.
+func (e *LeaderElector) Register(name string, fn func(ctx context.Context)) {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    e.subsystems[name] = fn
+}
+
+// Run campaigns for leadership until ctx ends; followers only wait for it
+func (e *LeaderElector) Run(ctx context.Context) {
+    e.metrics.Set("instance_leader", 0)
+    if e.role == RoleFollower {
+        slog.Info("running as a follower; background subsystems run on the leader", "instance", e.instance)
+        <-ctx.Done()
+        return
+    }
+    runExclusive(ctx, e.locker, lockLeader, e.metrics, e.lead)
+}
+
+// lead runs every subsystem, holding leadership until ctx ends
+func (e *LeaderElector) lead(ctx context.Context) {
+    now := time.Now().UTC()
+    e.mu.Lock()
+    e.leaderSince = &now
+    subsystems := make(map[string]func(ctx context.Context), len(e.subsystems))
+    for name, fn := range e.subsystems {
+        subsystems[name] = fn
+    }
+    e.mu.Unlock()
+    slog.Info("elected leader", "instance", e.instance, "subsystems", len(subsystems))
+    e.metrics.Set("instance_leader", 1)
+    e.metrics.Inc("leader_elections_total")
+
+    var running sync.WaitGroup
+    for name, fn := range subsystems {
+        running.Add(1)
+        go func(name string, fn func(ctx context.Context)) {
+            defer running.Done()
+            fn(ctx)
+            if ctx.Err() == nil {
+                slog.Warn("leader subsystem stopped early", "subsystem", name)
+            }
+        }(name, fn)
+    }
+    running.Wait()
+    // Leadership is kept even if every subsystem stopped early
+    <-ctx.Done()
+
+    e.mu.Lock()
+    e.leaderSince = nil
+    e.mu.Unlock()
+    e.metrics.Set("instance_leader", 0)
+    slog.Info("stepped down as leader", "instance", e.instance)
+}
+
+// Status reports this instance's role and leadership
+func (e *LeaderElector) Status() LeaderStatus {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    status := LeaderStatus{Instance: e.instance, Role: e.role, Leader: e.leaderSince != nil, LeaderSince: e.leaderSince, Subsystems: make([]string, 0, len(e.subsystems))}
+    for name := range e.subsystems {
+        status.Subsystems = append(status.Subsystems, name)
+    }
+    sort.Strings(status.Subsystems)
+    return status
+}
+
+// Healthz reports that the process is up and serving, with its build and
+// leadership. Unlike /readyz it does not depend on the model or draining.
+func (app *App) Healthz(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(struct {
+        Status string       `json:"status"`
+        Build  BuildInfo    `json:"build"`
+        Leader LeaderStatus `json:"leadership"`
+    }{"ok", buildInfo(), app.leader.Status()})
+}
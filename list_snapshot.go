@@ -0,0 +1,162 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "strconv"
+    "sync/atomic"
+    "time"
+)
+
+// listSnapshot is an immutable copy of a store's students in ID order,
+// together with the bare array GET /students answers with, already encoded
+type listSnapshot struct {
+    students []Student
+    body     []byte
+    seq      int
+    builtAt  time.Time
+}
+
+// ListSnapshot serves GET /students for public, read-heavy deployments
+// from an in-memory snapshot of the shared store. Readers load the current
+// snapshot with one atomic read and never touch the store or its locks;
+// change events mark it stale and a background goroutine rebuilds it and
+// swaps the new one in, coalescing bursts of writes into one rebuild.
+// Only requests without filter or sort use it, plain or paginated, so its
+// answers are the ones the store would give, at most one rebuild behind.
+type ListSnapshot struct {
+    store   *StudentStore
+    maxAge  time.Duration
+    metrics *Metrics
+    current atomic.Pointer[listSnapshot]
+    // changed holds a pending rebuild request
+    changed chan struct{}
+}
+
+// listSnapshotConfig reads LIST_SNAPSHOT and LIST_SNAPSHOT_MAX_AGE
+func listSnapshotConfig() (enabled bool, maxAge time.Duration, err error) {
+    maxAge = getEnvDuration("LIST_SNAPSHOT_MAX_AGE", time.Minute)
+    if maxAge < 0 {
+        return false, 0, fmt.Errorf("LIST_SNAPSHOT_MAX_AGE must not be negative, got %s", maxAge)
+    }
+    return getEnvBool("LIST_SNAPSHOT", false), maxAge, nil
+}
+
+// LoadListSnapshot builds the first snapshot of store when LIST_SNAPSHOT is
+// set, returning nil otherwise. LIST_SNAPSHOT_MAX_AGE (default 1m, 0 to
+// disable) also rebuilds it periodically, picking up writes made by other
+// instances sharing the database, which raise no local events.
+func LoadListSnapshot(store *StudentStore, events *EventBus, metrics *Metrics) (*ListSnapshot, error) {
+    enabled, maxAge, err := listSnapshotConfig()
+    if err != nil || !enabled {
+        return nil, err
+    }
+    s := &ListSnapshot{store: store, maxAge: maxAge, metrics: metrics, changed: make(chan struct{}, 1)}
+    if err := s.rebuild(); err != nil {
+        return nil, fmt.Errorf("building list snapshot: %w", err)
+    }
+    events.Hook(func(e Event) {
+        if e.Tenant == store.tenant {
+            s.invalidate()
+        }
+    })
+    return s, nil
+}
+
+// invalidate requests a rebuild without blocking the publishing store
+func (s *ListSnapshot) invalidate() {
+    select {
+    case s.changed <- struct{}{}:
+    default:
+    }
+}
+
+// Run rebuilds the snapshot after changes and every maxAge until ctx ends
+func (s *ListSnapshot) Run(ctx context.Context) {
+    var tick <-chan time.Time
+    if s.maxAge > 0 {
+        ticker := time.NewTicker(s.maxAge)
+        defer ticker.Stop()
+        tick = ticker.C
+    }
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-s.changed:
+        case <-tick:
+        }
+        if err := s.rebuild(); err != nil {
+            slog.Error("rebuilding list snapshot failed; serving the previous one", "error", err)
+            s.metrics.Inc("list_snapshot_errors_total")
+        }
+    }
+}
+
+// rebuild reads every student and swaps in a new snapshot
+func (s *ListSnapshot) rebuild() error {
+    started := time.Now()
+    students, seq, err := s.store.Snapshot()
+    if err != nil {
+        return err
+    }
+    if students == nil {
+        students = []Student{}
+    }
+    var body bytes.Buffer
+    if err := json.NewEncoder(&body).Encode(students); err != nil {
+        return err
+    }
+    s.current.Store(&listSnapshot{students: students, body: body.Bytes(), seq: seq, builtAt: started})
+    s.metrics.Inc("list_snapshot_rebuilds_total")
+    s.metrics.Set("list_snapshot_students", float64(len(students)))
+    s.metrics.Set("list_snapshot_rebuild_seconds", time.Since(started).Seconds())
+    return nil
+}
+
+// serveListSnapshot answers GET /students from the snapshot, reporting false
+// when the request needs the store: it filters or sorts, or carries a
+// consistency token for a change the snapshot does not include yet
+func (app *App) serveListSnapshot(w http.ResponseWriter, r *http.Request) bool {
+    if app.listSnapshot == nil || app.storeFor(r) != app.store {
+        return false
+    }
+    snap := app.listSnapshot.current.Load()
+    query := r.URL.Query()
+    for key := range query {
+        if key != "limit" && key != "offset" {
+            return false
+        }
+    }
+    if token := r.Header.Get(ConsistencyTokenHeader); token != "" {
+        // The consistency middleware has already rejected malformed tokens
+        if seq, _ := parseConsistencyToken(token); seq > snap.seq {
+            return false
+        }
+    }
+    limit, offset, paged, perr := pageFromRequest(r)
+    if perr != nil {
+        return false
+    }
+
+    if !paged {
+        app.recordAccess(r, fieldsStudent, studentIDs(snap.students)...)
+        w.Write(snap.body)
+        return true
+    }
+    total := len(snap.students)
+    start, end := min(offset, total), min(offset+limit, total)
+    // The page shares the snapshot's array, which is never written again
+    page := StudentPage{Data: snap.students[start:end:end], Total: total, Limit: limit, Offset: offset}
+    app.recordAccess(r, fieldsStudent, studentIDs(page.Data)...)
+    if page.Next = nextPageURL(r, limit, offset, total); page.Next != nil {
+        w.Header().Set("Link", "<"+*page.Next+`>; rel="next"`)
+    }
+    w.Header().Set("X-Total-Count", strconv.Itoa(total))
+    json.NewEncoder(w).Encode(page)
+    return true
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "math"
+    "net/url"
+    "sort"
+    "sync"
+    "time"
+)
+
+// hedgeWindow is how many recent latencies of a task's model the hedge
+// delay is taken from, and hedgeMinSamples how many it needs before the
+// initial delay gives way to the observed percentile
+const (
+    hedgeWindow     = 200
+    hedgeMinSamples = 20
+)
+
+// LLMHedge issues a second, hedged request when an interactive LLM call has
+// not answered within the configured percentile of its recent latencies, and
+// takes whichever completes first, cancelling the other. The hedge goes to
+// LLM_HEDGE_URL and LLM_HEDGE_MODEL when set, otherwise to the next model in
+// the task's route, otherwise to the same model again.
+type LLMHedge struct {
+    percentile   float64
+    minDelay     time.Duration
+    initialDelay time.Duration
+    url          string
+    model        string
+
+    mu sync.Mutex
+    // latencies holds a ring of recent latencies per task and model
+    latencies map[string]*latencyRing
+}
+
+// latencyRing is a fixed-size window of durations
+type latencyRing struct {
+    samples []time.Duration
+    next    int
+}
+
+// LoadLLMHedge reads LLM_HEDGE_PERCENTILE (0, the default, disables
+// hedging), LLM_HEDGE_MIN_DELAY (default 100ms), LLM_HEDGE_INITIAL_DELAY
+// (default 5s, used until enough latencies are known), LLM_HEDGE_URL and
+// LLM_HEDGE_MODEL. It returns nil when hedging is off.
+func LoadLLMHedge() (*LLMHedge, error) {
+    h := &LLMHedge{
+        percentile:   getEnvFloat("LLM_HEDGE_PERCENTILE", 0),
+        minDelay:     getEnvDuration("LLM_HEDGE_MIN_DELAY", 100*time.Millisecond),
+        initialDelay: getEnvDuration("LLM_HEDGE_INITIAL_DELAY", 5*time.Second),
+        url:          getEnv("LLM_HEDGE_URL", ""),
+        model:        getEnv("LLM_HEDGE_MODEL", ""),
+        latencies:    make(map[string]*latencyRing),
+    }
+    if h.percentile < 0 || h.percentile >= 100 || math.IsNaN(h.percentile) {
+        return nil, fmt.Errorf("LLM_HEDGE_PERCENTILE must be at least 0 and below 100, got %v", h.percentile)
+    }
+    if h.minDelay < 0 || h.initialDelay < 0 {
+        return nil, fmt.Errorf("LLM_HEDGE_MIN_DELAY and LLM_HEDGE_INITIAL_DELAY must not be negative, got %s and %s", h.minDelay, h.initialDelay)
+    }
+    if h.url != "" {
+        if u, err := url.Parse(h.url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+            return nil, fmt.Errorf("LLM_HEDGE_URL must be an http(s) URL, got %q", h.url)
+        }
+    }
+    if h.percentile == 0 {
+        return nil, nil
+    }
+    return h, nil
+}
+
+// target returns the client a hedge of model goes to; next is the model
+// after it in the route, if any
+func (h *LLMHedge) target(base *OllamaClient, model, next string) *OllamaClient {
+    switch {
+    case h.url != "" && h.model != "":
+        return base.WithEndpoint(h.url, h.model)
+    case h.url != "":
+        return base.WithEndpoint(h.url, model)
+    case h.model != "":
+        return base.WithModel(h.model)
+    case next != "":
+        return base.WithModel(next)
+    }
+    return base.WithModel(model)
+}
+
+// delay returns how long a call of task on model runs before it is hedged
+func (h *LLMHedge) delay(task, model string) time.Duration {
+    h.mu.Lock()
+    ring := h.latencies[task+"\x00"+model]
+    var samples []time.Duration
+    if ring != nil {
+        samples = append(samples, ring.samples...)
+    }
+    h.mu.Unlock()
+    if len(samples) < hedgeMinSamples {
+        return max(h.initialDelay, h.minDelay)
+    }
+    sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+    i := int(math.Ceil(h.percentile/100*float64(len(samples)))) - 1
+    return max(samples[max(i, 0)], h.minDelay)
+}
+
+// observe records how long a call of task on model took
+func (h *LLMHedge) observe(task, model string, d time.Duration) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    key := task + "\x00" + model
+    ring := h.latencies[key]
+    if ring == nil {
+        ring = &latencyRing{}
+        h.latencies[key] = ring
+    }
+    if len(ring.samples) < hedgeWindow {
+        ring.samples = append(ring.samples, d)
+        return
+    }
+    ring.samples[ring.next] = d
+    ring.next = (ring.next + 1) % hedgeWindow
+}
+
+// hedgeResult is the outcome of one of the racing calls
+type hedgeResult struct {
+    resp   *OllamaResponse
+    err    error
+    client *OllamaClient
+}
+
+// generateHedged runs prompt on model, hedging it with a call to the model's
+// hedge target once the delay passes. It returns the client that answered.
+// Only the first call's latencies feed the delay; when it loses, the time it
+// had run when cancelled is recorded, a lower bound that keeps slow models
+// from being measured only by their fast answers. Batch calls, which nobody
+// is waiting on, are never hedged.
+func (r *ModelRouter) generateHedged(ctx context.Context, task, model, next, prompt string, format json.RawMessage) (*OllamaResponse, *OllamaClient, error) {
+    primary := r.base.WithModel(model)
+    if r.hedge == nil || llmPriority(ctx) != PriorityInteractive {
+        resp, err := r.generateWith(ctx, task, primary, prompt, format)
+        return resp, primary, err
+    }
+
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+    results := make(chan hedgeResult, 2)
+    started := time.Now()
+    go func() {
+        resp, err := r.generateWith(ctx, task, primary, prompt, format)
+        if err == nil || errors.Is(err, context.Canceled) {
+            r.hedge.observe(task, model, time.Since(started))
+        }
+        results <- hedgeResult{resp, err, primary}
+    }()
+
+    timer := time.NewTimer(r.hedge.delay(task, model))
+    defer timer.Stop()
+    hedgeAt := timer.C
+    pending := 1
+    var primaryErr, hedgeErr error
+    for {
+        select {
+        case <-hedgeAt:
+            hedgeAt = nil
+            pending++
+            target := r.hedge.target(r.base, model, next)
+            r.metrics.Inc("llm_hedges_total", "task", task, "model", model)
+            go func() {
+                resp, err := r.generateWith(ctx, task, target, prompt, format)
+                results <- hedgeResult{resp, err, target}
+            }()
+        case res := <-results:
+            pending--
+            if res.err == nil {
+                if res.client != primary {
+                    r.metrics.Inc("llm_hedge_wins_total", "task", task, "model", res.client.Model())
+                }
+                return res.resp, res.client, nil
+            }
+            if res.client == primary {
+                primaryErr = res.err
+            } else {
+                hedgeErr = res.err
+            }
+            if pending == 0 {
+                // A first call failing before the delay is left to the route's fallbacks
+                if primaryErr == nil {
+                    primaryErr = hedgeErr
+                }
+                return nil, primary, primaryErr
+            }
+        }
+    }
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net/http"
+    "sync"
+    "time"
+)
+
+// LLM call priorities; interactive calls are always dequeued before batch ones
+const (
+    PriorityInteractive = iota
+    PriorityBatch
+)
+
+var priorityNames = [...]string{PriorityInteractive: "interactive", PriorityBatch: "batch"}
+
+// errLLMQueueFull is returned when a call is shed because the queue is full
+var errLLMQueueFull = errors.New("llm: request queue is full")
+
+// writeLLMBusy answers 503 with Retry-After when err is a call shed by the
+// LLM queue, reporting whether it did
+func writeLLMBusy(w http.ResponseWriter, r *http.Request, err error) bool {
+    if !errors.Is(err, errLLMQueueFull) {
+        return false
+    }
+    w.Header().Set("Retry-After", "5")
+    httpError(w, r, "The summary service is busy, try again later", http.StatusServiceUnavailable)
+    return true
+}
+
+type llmPriorityKey struct{}
+
+// withLLMPriority marks the LLM calls made with ctx, e.g. as background work
+func withLLMPriority(ctx context.Context, priority int) context.Context {
+    return context.WithValue(ctx, llmPriorityKey{}, priority)
+}
+
+// llmPriority returns ctx's priority; unmarked calls are interactive
+func llmPriority(ctx context.Context) int {
+    priority, _ := ctx.Value(llmPriorityKey{}).(int)
+    return priority
+}
+
+// llmWaiter is a queued call; ready is closed once it holds a slot, and err
+// is set first if it was evicted instead
+type llmWaiter struct {
+    ready chan struct{}
+    err   error
+}
+
+// LLMQueue is a bounded priority queue in front of the LLM provider. At most
+// concurrency calls run at once; up to size more wait, interactive ahead of
+// batch. When the queue is full an interactive call evicts the newest batch
+// waiter, and any other call is shed with errLLMQueueFull.
+type LLMQueue struct {
+    mu          sync.Mutex
+    concurrency int
+    size        int
+    active      int
+    waiting     [len(priorityNames)][]*llmWaiter
+    metrics     *Metrics
+}
+
+// NewLLMQueue returns a queue running concurrency calls with size waiting
+func NewLLMQueue(concurrency, size int, metrics *Metrics) (*LLMQueue, error) {
+    if concurrency < 1 || size < 0 {
+        return nil, fmt.Errorf("llm queue: concurrency must be at least 1 and size at least 0, got %d and %d", concurrency, size)
+    }
+    return &LLMQueue{concurrency: concurrency, size: size, metrics: metrics}, nil
+}
+
+// LoadLLMQueue reads LLM_CONCURRENCY and LLM_QUEUE_SIZE
+func LoadLLMQueue(metrics *Metrics) (*LLMQueue, error) {
+    return NewLLMQueue(getEnvInt("LLM_CONCURRENCY", 4), getEnvInt("LLM_QUEUE_SIZE", 64), metrics)
+}
+
+// depth returns the number of waiting calls; the caller holds q.mu
+func (q *LLMQueue) depth() int {
+    n := 0
+    for _, w := range q.waiting {
+        n += len(w)
+    }
+    return n
+}
+
+// observe publishes the queue gauges; the caller holds q.mu
+func (q *LLMQueue) observe() {
+    q.metrics.Set("llm_queue_active", float64(q.active))
+    for priority, w := range q.waiting {
+        q.metrics.Set("llm_queue_depth", float64(len(w)), "priority", priorityNames[priority])
+    }
+}
+
+// Acquire waits for a slot at ctx's priority and returns its release function
+func (q *LLMQueue) Acquire(ctx context.Context) (func(), error) {
+    priority := llmPriority(ctx)
+    started := time.Now()
+
+    q.mu.Lock()
+    if q.active < q.concurrency && q.depth() == 0 {
+        q.active++
+        q.observe()
+        q.mu.Unlock()
+        return q.release, nil
+    }
+    if q.depth() >= q.size && !q.evictBatch(priority) {
+        q.mu.Unlock()
+        q.metrics.Inc("llm_queue_shed_total", "priority", priorityNames[priority])
+        return nil, errLLMQueueFull
+    }
+    w := &llmWaiter{ready: make(chan struct{})}
+    q.waiting[priority] = append(q.waiting[priority], w)
+    q.observe()
+    q.mu.Unlock()
+
+    select {
+    case <-w.ready:
+    case <-ctx.Done():
+        q.mu.Lock()
+        removed := q.remove(priority, w)
+        q.observe()
+        q.mu.Unlock()
+        if removed {
+            return nil, ctx.Err()
+        }
+        // The slot was handed over or the call evicted while cancelling
+        <-w.ready
+        if w.err == nil {
+            q.release()
+        }
+        return nil, ctx.Err()
+    }
+    if w.err != nil {
+        return nil, w.err
+    }
+    q.metrics.Add("llm_queue_wait_seconds_sum", time.Since(started).Seconds(), "priority", priorityNames[priority])
+    q.metrics.Inc("llm_queue_wait_seconds_count", "priority", priorityNames[priority])
+    return q.release, nil
+}
+
+// evictBatch sheds the newest batch waiter to make room for an interactive
+// call; the caller holds q.mu
+func (q *LLMQueue) evictBatch(priority int) bool {
+    batch := q.waiting[PriorityBatch]
+    if priority != PriorityInteractive || len(batch) == 0 {
+        return false
+    }
+    w := batch[len(batch)-1]
+    q.waiting[PriorityBatch] = batch[:len(batch)-1]
+    w.err = errLLMQueueFull
+    close(w.ready)
+    q.metrics.Inc("llm_queue_shed_total", "priority", priorityNames[PriorityBatch])
+    return true
+}
+
+// remove drops w from its queue, reporting whether it was still waiting
+func (q *LLMQueue) remove(priority int, w *llmWaiter) bool {
+    for i, queued := range q.waiting[priority] {
+        if queued == w {
+            q.waiting[priority] = append(q.waiting[priority][:i], q.waiting[priority][i+1:]...)
+            return true
+        }
+    }
+    return false
+}
+
+// release hands the slot to the next waiter, highest priority first
+func (q *LLMQueue) release() {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    defer q.observe()
+    for priority, w := range q.waiting {
+        if len(w) > 0 {
+            q.waiting[priority] = w[1:]
+            close(w[0].ready)
+            return
+        }
+    }
+    q.active--
+}
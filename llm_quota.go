@@ -0,0 +1,234 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "math"
+    "net"
+    "net/http"
+    "strconv"
+    "sync"
+    "time"
+    "student-api/reqctx"
+)
+
+// Limits of the LLM quota, named in the status and in denials
+const (
+    llmLimitPerMinute = "per_minute"
+    llmLimitDaily     = "daily"
+)
+
+// CodeLLMQuotaExceeded answers a request past the caller's daily LLM cap
+const CodeLLMQuotaExceeded = "llm_quota_exceeded"
+
+// llmUsage is one caller's share of the LLM: a token bucket refilled at the
+// per-minute rate and the calls made on the current UTC day
+type llmUsage struct {
+    tokens  float64
+    updated time.Time
+    day     string
+    used    int
+}
+
+// LLMQuotas limits each user's calls to the routes in llmRoutes, on top of
+// the per-client RATE_LIMIT_LLM: a stricter rate per minute and a cap per UTC
+// day. Users are the authenticated principal, or the client address for
+// anonymous callers. Usage lives in memory, so quotas apply per instance.
+type LLMQuotas struct {
+    perMinute float64
+    daily     int
+
+    mu        sync.Mutex
+    users     map[string]*llmUsage
+    lastSweep time.Time
+}
+
+// LoadLLMQuotas reads LLM_USER_RATE_LIMIT, in calls per minute per user, and
+// LLM_USER_DAILY_CAP, in calls per user per UTC day; 0, the default, leaves
+// either unlimited. It returns nil when both are.
+func LoadLLMQuotas() (*LLMQuotas, error) {
+    perMinute := getEnvInt("LLM_USER_RATE_LIMIT", 0)
+    if perMinute < 0 {
+        return nil, fmt.Errorf("LLM_USER_RATE_LIMIT must be zero or a positive number of calls per minute, got %d", perMinute)
+    }
+    daily := getEnvInt("LLM_USER_DAILY_CAP", 0)
+    if daily < 0 {
+        return nil, fmt.Errorf("LLM_USER_DAILY_CAP must be zero or a positive number of calls per day, got %d", daily)
+    }
+    if perMinute == 0 && daily == 0 {
+        return nil, nil
+    }
+    return &LLMQuotas{perMinute: float64(perMinute), daily: daily, users: make(map[string]*llmUsage)}, nil
+}
+
+// LLMQuotaStatus is what remains of a user's quota; a limit left out is
+// unlimited
+type LLMQuotaStatus struct {
+    User      string       `json:"user"`
+    PerMinute *QuotaWindow `json:"per_minute,omitempty"`
+    Daily     *QuotaWindow `json:"daily,omitempty"`
+}
+
+// QuotaWindow is one limit of a quota. Remaining calls are back to Limit
+// at ResetsAt.
+type QuotaWindow struct {
+    Limit     int       `json:"limit"`
+    Remaining int       `json:"remaining"`
+    ResetsAt  time.Time `json:"resets_at"`
+}
+
+// Take counts a call by user when neither limit is exhausted. Otherwise it
+// returns the exhausted limit and how long until the user may call again.
+// The status is the quota after the call.
+func (q *LLMQuotas) Take(user string, now time.Time) (LLMQuotaStatus, string, time.Duration) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    q.sweep(now)
+
+    u := q.usage(user, now)
+    var denied string
+    var wait time.Duration
+    if q.perMinute > 0 && u.tokens < 1 {
+        denied, wait = llmLimitPerMinute, time.Duration((1-u.tokens)/q.perMinute*float64(time.Minute))
+    }
+    if q.daily > 0 && u.used >= q.daily {
+        denied, wait = llmLimitDaily, nextUTCDay(now).Sub(now)
+    }
+    if denied == "" {
+        u.tokens--
+        u.used++
+    }
+    return q.status(user, u, now), denied, wait
+}
+
+// Status returns user's quota without counting a call
+func (q *LLMQuotas) Status(user string, now time.Time) LLMQuotaStatus {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    return q.status(user, q.usage(user, now), now)
+}
+
+// usage returns user's usage, refilled and rolled over to now's day; the
+// caller holds q.mu
+func (q *LLMQuotas) usage(user string, now time.Time) *llmUsage {
+    u, ok := q.users[user]
+    if !ok {
+        u = &llmUsage{tokens: q.perMinute, updated: now}
+        q.users[user] = u
+    }
+    u.tokens = math.Min(q.perMinute, u.tokens+now.Sub(u.updated).Minutes()*q.perMinute)
+    u.updated = now
+    if day := now.UTC().Format(time.DateOnly); u.day != day {
+        u.day, u.used = day, 0
+    }
+    return u
+}
+
+func (q *LLMQuotas) status(user string, u *llmUsage, now time.Time) LLMQuotaStatus {
+    status := LLMQuotaStatus{User: user}
+    if q.perMinute > 0 {
+        full := time.Duration((q.perMinute - u.tokens) / q.perMinute * float64(time.Minute))
+        status.PerMinute = &QuotaWindow{Limit: int(q.perMinute), Remaining: int(u.tokens), ResetsAt: now.Add(full)}
+    }
+    if q.daily > 0 {
+        status.Daily = &QuotaWindow{Limit: q.daily, Remaining: q.daily - u.used, ResetsAt: nextUTCDay(now)}
+    }
+    return status
+}
+
+// sweep drops users whose bucket has refilled and who have not called today;
+// the caller holds q.mu
+func (q *LLMQuotas) sweep(now time.Time) {
+    if now.Sub(q.lastSweep) < rateSweepInterval {
+        return
+    }
+    q.lastSweep = now
+    today := now.UTC().Format(time.DateOnly)
+    for user, u := range q.users {
+        if now.Sub(u.updated) >= time.Minute && u.day != today {
+            delete(q.users, user)
+        }
+    }
+}
+
+func nextUTCDay(now time.Time) time.Time {
+    return now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+}
+
+// llmQuotaUser names the caller a quota is kept for
+func (app *App) llmQuotaUser(r *http.Request) string {
+    if user := reqctx.User(r.Context()); user != "" {
+        return "user:" + user
+    }
+    if app.limiter != nil {
+        return "ip:" + app.limiter.clientIP(r)
+    }
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        host = r.RemoteAddr
+    }
+    return "ip:" + host
+}
+
+// takeLLMQuota counts an LLM call by the caller of r, setting the quota
+// headers on w. It answers 429 and returns false once the caller has used
+// up either limit.
+func (app *App) takeLLMQuota(w http.ResponseWriter, r *http.Request) bool {
+    status, denied, wait := app.llmQuotas.Take(app.llmQuotaUser(r), time.Now())
+    setLLMQuotaHeaders(w.Header(), status)
+    if denied == "" {
+        return true
+    }
+    app.metrics.Inc("llm_quota_denied_total", "limit", denied)
+    w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+    code, message := llmQuotaDenial(status, denied)
+    writeError(w, r, http.StatusTooManyRequests, code, message)
+    return false
+}
+
+// llmQuotaDenial returns the error code and message for an exhausted limit
+func llmQuotaDenial(status LLMQuotaStatus, denied string) (string, string) {
+    if denied == llmLimitDaily {
+        return CodeLLMQuotaExceeded, fmt.Sprintf("Daily limit of %d model calls reached", status.Daily.Limit)
+    }
+    return statusCode(http.StatusTooManyRequests), fmt.Sprintf("Limit of %d model calls per minute reached", status.PerMinute.Limit)
+}
+
+// setLLMQuotaHeaders reports the remaining quota: X-LLM-RateLimit-* for the
+// rate per minute, X-LLM-Quota-* for the daily cap, with Reset in seconds
+func setLLMQuotaHeaders(h http.Header, status LLMQuotaStatus) {
+    if w := status.PerMinute; w != nil {
+        h.Set("X-LLM-RateLimit-Limit", strconv.Itoa(w.Limit))
+        h.Set("X-LLM-RateLimit-Remaining", strconv.Itoa(w.Remaining))
+    }
+    if w := status.Daily; w != nil {
+        h.Set("X-LLM-Quota-Limit", strconv.Itoa(w.Limit))
+        h.Set("X-LLM-Quota-Remaining", strconv.Itoa(w.Remaining))
+        h.Set("X-LLM-Quota-Reset", strconv.Itoa(int(math.Ceil(time.Until(w.ResetsAt).Seconds()))))
+    }
+}
+
+// llmQuota applies the per-user LLM quotas to the routes in llmRoutes. It
+// runs after rbac and tenancy, so requests they refuse cost nothing.
+func (app *App) llmQuota(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if app.llmQuotas == nil || !llmRoutes[routeTemplate(r)] {
+            next.ServeHTTP(w, r)
+            return
+        }
+        if app.takeLLMQuota(w, r) {
+            next.ServeHTTP(w, r)
+        }
+    })
+}
+
+// GetLLMQuota reports the caller's remaining LLM quota: GET /llm/quota
+func (app *App) GetLLMQuota(w http.ResponseWriter, r *http.Request) {
+    status := LLMQuotaStatus{User: app.llmQuotaUser(r)}
+    if app.llmQuotas != nil {
+        status = app.llmQuotas.Status(status.User, time.Now())
+        setLLMQuotaHeaders(w.Header(), status)
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "io"
+    "log/slog"
+    "net/http"
+    "os"
+    "os/signal"
+    "strings"
+    "syscall"
+    "time"
+    "student-api/reqctx"
+)
+
+// logLevel is the structured logger's level; it can be changed while running
+var logLevel = new(slog.LevelVar)
+
+// logLevelCycle is the order SIGUSR1 steps through
+var logLevelCycle = []slog.Level{slog.LevelDebug, slog.LevelInfo, slog.LevelWarn, slog.LevelError}
+
+// setupLogging installs the structured logger configured by LOG_LEVEL
+// (debug, info, warn, error) and LOG_FORMAT (text or json), redacting the
+// fields in LOG_REDACT_FIELDS from every record. LOG_REQUESTS=false turns
+// off the per-request access lines. The standard log package is routed
+// through it at info level.
+func setupLogging() error {
+    if err := logLevel.UnmarshalText([]byte(getEnv("LOG_LEVEL", "info"))); err != nil {
+        return err
+    }
+    logRedactor = LoadRedactor()
+    logRequestLines = getEnvBool("LOG_REQUESTS", true)
+    bodyLogLimit = getEnvInt("LOG_BODY_LIMIT", 0)
+    opts := &slog.HandlerOptions{Level: logLevel, ReplaceAttr: logRedactor.ReplaceAttr}
+    var handler slog.Handler = slog.NewTextHandler(os.Stderr, opts)
+    if strings.EqualFold(getEnv("LOG_FORMAT", "text"), "json") {
+        handler = slog.NewJSONHandler(os.Stderr, opts)
+    }
+    slog.SetDefault(slog.New(handler).With("version", version))
+    return nil
+}
+
+// cycleLogLevelOnSignal moves to the next level in logLevelCycle on every SIGUSR1
+func cycleLogLevelOnSignal() {
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGUSR1)
+    for range signals {
+        next := logLevelCycle[0]
+        for i, level := range logLevelCycle {
+            if level == logLevel.Level() && i+1 < len(logLevelCycle) {
+                next = logLevelCycle[i+1]
+            }
+        }
+        logLevel.Set(next)
+        slog.Warn("log level changed by SIGUSR1", "level", next.String())
+    }
+}
+
+// GetLogLevel serves GET /admin/loglevel
+func GetLogLevel(w http.ResponseWriter, r *http.Request) {
+    json.NewEncoder(w).Encode(map[string]string{"level": strings.ToLower(logLevel.Level().String())})
+}
+
+// PutLogLevel changes the log level: PUT /admin/loglevel {"level": "debug"}
+func PutLogLevel(w http.ResponseWriter, r *http.Request) {
+    var body struct {
+        Level string `json:"level"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+        httpError(w, r, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    var level slog.Level
+    if err := level.UnmarshalText([]byte(body.Level)); err != nil {
+        writeValidationErrors(w, r, []ValidationError{{
+            Field:   "level",
+            Code:    CodeOutOfRange,
+            Message: "Level must be debug, info, warn or error",
+        }})
+        return
+    }
+
+    previous := logLevel.Level()
+    logLevel.Set(level)
+    reqctx.Logger(r.Context()).Warn("log level changed", "from", previous.String(), "to", level.String(), "remote", r.RemoteAddr)
+    json.NewEncoder(w).Encode(map[string]string{"level": strings.ToLower(level.String())})
+}
+
+// logRequestLines enables the access line logRequests writes per request
+var logRequestLines = true
+
+// bodyLogLimit caps the bytes of each body logRequests logs; 0 disables it
+var bodyLogLimit int
+
+// quietPaths are probed constantly, so their access lines are debug level
+var quietPaths = map[string]bool{"/healthz": true, "/readyz": true, "/metrics": true}
+
+// logRecorder captures a response's status, size and, for body logging,
+// its first bodyLogLimit bytes
+type logRecorder struct {
+    http.ResponseWriter
+    status int
+    bytes  int
+    body   *bytes.Buffer
+}
+
+func (lr *logRecorder) WriteHeader(status int) {
+    if lr.status == 0 {
+        lr.status = status
+    }
+    lr.ResponseWriter.WriteHeader(status)
+}
+
+func (lr *logRecorder) Write(b []byte) (int, error) {
+    if lr.status == 0 {
+        lr.status = http.StatusOK
+    }
+    if lr.body != nil {
+        if room := bodyLogLimit - lr.body.Len(); room > 0 {
+            lr.body.Write(b[:min(room, len(b))])
+        }
+    }
+    n, err := lr.ResponseWriter.Write(b)
+    lr.bytes += n
+    return n, err
+}
+
+// Unwrap lets http.ResponseController flush streamed responses
+func (lr *logRecorder) Unwrap() http.ResponseWriter {
+    return lr.ResponseWriter
+}
+
+// logRequests writes an access line for every request once it has been
+// answered, carrying the request ID like every other line logged for it.
+// With LOG_BODY_LIMIT set, debug level adds the query and the request and
+// response bodies; the logger's redactor removes configured fields from
+// them like from every other attribute.
+func logRequests(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        logger := reqctx.Logger(r.Context())
+        bodies := bodyLogLimit > 0 && logger.Enabled(r.Context(), slog.LevelDebug)
+        if !logRequestLines && !bodies {
+            next.ServeHTTP(w, r)
+            return
+        }
+        start := time.Now()
+        rec := &logRecorder{ResponseWriter: w}
+        var requestBody []byte
+        if bodies {
+            rec.body = new(bytes.Buffer)
+            if r.Body != nil {
+                requestBody, _ = io.ReadAll(io.LimitReader(r.Body, int64(bodyLogLimit)))
+                r.Body = struct {
+                    io.Reader
+                    io.Closer
+                }{io.MultiReader(bytes.NewReader(requestBody), r.Body), r.Body}
+            }
+        }
+        next.ServeHTTP(rec, r)
+
+        if rec.status == 0 {
+            rec.status = http.StatusOK
+        }
+        if logRequestLines {
+            level := slog.LevelInfo
+            switch {
+            case quietPaths[r.URL.Path]:
+                level = slog.LevelDebug
+            case rec.status >= 500:
+                level = slog.LevelError
+            }
+            logger.Log(r.Context(), level, "request",
+                "method", r.Method,
+                "path", r.URL.Path,
+                "status", rec.status,
+                "bytes", rec.bytes,
+                "duration_ms", time.Since(start).Milliseconds(),
+                "remote", r.RemoteAddr)
+        }
+        if bodies {
+            logger.Debug("http bodies",
+                "method", r.Method,
+                "path", r.URL.Path,
+                "query", logRedactor.Query(r.URL.Query()),
+                "status", rec.status,
+                "request_body", string(requestBody),
+                "response_body", rec.body.String())
+        }
+    })
+}
@@ -2,48 +2,108 @@
 package main
 
 import (
+    "context"
     "database/sql"
     "encoding/json"
+    "errors"
+    "flag"
     "fmt"
+    "io"
     "log"
+    "log/slog"
     "net/http"
+    "os"
+    "os/signal"
     "strconv"
     "sync"
+    "sync/atomic"
+    "syscall"
+    "time"
     "github.com/gorilla/mux"
     _ "github.com/mattn/go-sqlite3" // Import the SQLite driver
+    "golang.org/x/sync/singleflight"
+    "student-api/reqctx"
 )
 
 // Student represents a student entity
 type Student struct {
-    ID    int    `json:"id"`
-    Name  string `json:"name"`
-    Age   int    `json:"age"`
-    Email string `json:"email"`
+    ID        int       `json:"id"`
+    Name      string    `json:"name"`
+    Age       int       `json:"age"`
+    Email     string    `json:"email"`
+    UpdatedAt time.Time `json:"updated_at"`
+    // DeletedAt is set while a deleted student can still be restored
+    DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
 // StudentStore manages student data with thread-safe operations
 type StudentStore struct {
     sync.RWMutex
-    students map[int]Student
-    nextID   int
-    db       *sql.DB
+    repo StudentRepository
+    // tenant is set on per-tenant stores and tags their events
+    tenant string
+    // memory keeps the history unless the repository keeps its own
+    memory *MemoryHistory
+    // seq is the latest sequence number seen, for lock-free reads
+    seq atomic.Int64
+    // events receives a change event for every recorded version
+    events *EventBus
+    // advanced is closed and replaced whenever history grows, waking
+    // readers waiting on a consistency token
+    advanced chan struct{}
+    // inTx is set while transactionLocked runs, holding back the change
+    // events of the versions in pending until the transaction commits
+    inTx    bool
+    pending []StudentVersion
+    // outbox is set when events are published to a broker; outboxInRepo
+    // when the repository keeps it, writing events in their transaction
+    outbox       *EventOutbox
+    outboxInRepo bool
 }
 
-// NewStudentStore initializes a new StudentStore
-func NewStudentStore(db *sql.DB) *StudentStore {
-    return &StudentStore{
-        students: make(map[int]Student),
-        nextID:   1,
-        db:       db,
+// NewStudentStore initializes a new StudentStore on top of a repository,
+// continuing the sequence of the history it keeps
+func NewStudentStore(repo StudentRepository, events *EventBus) *StudentStore {
+    s := &StudentStore{
+        repo:     repo,
+        memory:   NewMemoryHistory(),
+        events:   events,
+        advanced: make(chan struct{}),
+    }
+    if last, err := s.historyLocked().Last(); err != nil {
+        slog.Error("reading student history failed", "error", err)
+    } else {
+        s.observeSeq(last)
+    }
+    return s
+}
+
+// Close closes the repository if it holds resources
+func (s *StudentStore) Close() {
+    if closer, ok := s.repo.(io.Closer); ok {
+        closer.Close()
     }
 }
 
 // ValidationError represents an input validation error
 type ValidationError struct {
     Field   string `json:"field"`
+    Code    string `json:"code"`
     Message string `json:"message"`
 }
 
+// Validation error codes for basic field checks
+const (
+    CodeRequired   = "required"
+    CodeOutOfRange = "out_of_range"
+)
+
+// Bounds of a student's age
+const (
+    minStudentAge = 0
+    maxStudentAge = 150
+)
+
 // Validate checks if student data is valid
 func (s Student) Validate() []ValidationError {
     var errors []ValidationError
@@ -51,13 +111,15 @@ func (s Student) Validate() []ValidationError {
     if s.Name == "" {
         errors = append(errors, ValidationError{
             Field:   "name",
+            Code:    CodeRequired,
             Message: "Name is required",
         })
     }
 
-    if s.Age < 0 || s.Age > 150 {
+    if s.Age < minStudentAge || s.Age > maxStudentAge {
         errors = append(errors, ValidationError{
             Field:   "age",
+            Code:    CodeOutOfRange,
             Message: "Age must be between 0 and 150",
         })
     }
@@ -65,6 +127,7 @@ func (s Student) Validate() []ValidationError {
     if s.Email == "" {
         errors = append(errors, ValidationError{
             Field:   "email",
+            Code:    CodeRequired,
             Message: "Email is required",
         })
     }
@@ -72,166 +135,1041 @@ func (s Student) Validate() []ValidationError {
     return errors
 }
 
+// FieldChange records the old and new value of a changed field
+type FieldChange struct {
+    From interface{} `json:"from"`
+    To   interface{} `json:"to"`
+}
+
+// diffStudents returns the fields that differ between two versions of a student, ignoring the ID and timestamps
+func diffStudents(before, after Student) map[string]FieldChange {
+    changes := make(map[string]FieldChange)
+    if before.Name != after.Name {
+        changes["name"] = FieldChange{From: before.Name, To: after.Name}
+    }
+    if before.Age != after.Age {
+        changes["age"] = FieldChange{From: before.Age, To: after.Age}
+    }
+    if before.Email != after.Email {
+        changes["email"] = FieldChange{From: before.Email, To: after.Email}
+    }
+    return changes
+}
+
 type App struct {
-    store *StudentStore
+    store  *StudentStore
+    events *EventBus
+    // tenants is set when each tenant has its own database (TENANT_MODE=database)
+    tenants     *TenantStores
+    emailPolicy *EmailPolicy
+    ollama      *OllamaClient
+    // models routes each LLM task to its models
+    models    *ModelRouter
+    summaries singleflight.Group
+    // summaryCache serves stored summaries while new ones are generated
+    summaryCache *SummaryCache
+    feedback     *FeedbackStore
+    prompts      *PromptExperiment
+    // summaryRepairs is how many repair prompts are sent when the model's
+    // structured output fails schema validation
+    summaryRepairs int
+    tts            TTSProvider
+    ocr            OCRProvider
+    stt            STTProvider
+    notes          *NoteStore
+    // faces is nil unless photo recognition is opted into
+    faces             FaceMatcher
+    photos            *PhotoStore
+    faceMinConfidence float64
+    // csvEscapeFormulas guards CSV exports against spreadsheet formula injection
+    csvEscapeFormulas bool
+    importProfiles    *ImportProfileStore
+    imports           *ImportStore
+    conflicts         *ConflictStore
+    // conflictPolicy is the default policy for import commits
+    conflictPolicy ConflictPolicy
+    // undoWindow is how long after a mutation it can still be undone
+    undoWindow time.Duration
+    // deletedRetention is how long deleted students can be restored before
+    // they are purged; zero keeps them
+    deletedRetention time.Duration
+    // consistencyWait bounds how long a read waits to catch up with a consistency token
+    consistencyWait time.Duration
+    metrics         *Metrics
+    keys            *APIKeyStore
+    // limiter applies per-client rate limits; nil when none are set
+    limiter *RateLimiter
+    // routes holds the route policies and feature flags of routes.yaml
+    routes *RoutePolicies
+    // shadow mirrors the shared store to SHADOW_BACKEND; nil when off
+    shadow *ShadowRepository
+    // leader decides whether this instance runs the background subsystems
+    leader *LeaderElector
+    // auditLog streams data access and mutation events to the audit sinks
+    auditLog *AuditLog
+    // auditReader reads the audit log back from the db sink; nil when
+    // AUDIT_SINKS leaves it out
+    auditReader AuditReader
+    // access records who read which student's data
+    access    *AccessLog
+    honeypots *HoneypotStore
+    // alerts notifies operators of security and delivery problems
+    alerts *Alerter
+    // reports runs admin SQL reports; nil unless the backend is sqlite
+    reports      *ReportRunner
+    savedReports *SavedReportStore
+    // adminToken is a bearer secret that authenticates as the admin; empty
+    // leaves the admin routes to admin users and API keys
+    adminToken string
+    // auth issues and verifies JWTs; nil leaves /students open
+    auth *JWTAuth
+    // users holds the password accounts that log in besides AUTH_USERS
+    users *UserStore
+    // oidc verifies access tokens from an external identity provider; nil
+    // unless OIDC_ISSUER is set
+    oidc *OIDCProvider
+    // listSnapshot serves unfiltered student lists; nil unless LIST_SNAPSHOT
+    // is set
+    listSnapshot *ListSnapshot
+    // openAPI documents the routes of newRouter
+    openAPI *OpenAPIDoc
+    // graphql is the schema served at /graphql
+    graphql *GraphQL
+    // llmQuotas limits each user's model calls; nil when unlimited
+    llmQuotas *LLMQuotas
+    // streams serves change events to GET /events
+    streams *EventStreams
+    // sockets serves change events to GET /ws and GraphQL subscriptions to
+    // GET /graphql/ws
+    sockets *EventSockets
+    // registrations queues self-registered students for approval
+    registrations *RegistrationStore
+    // invitations are admins' single-use enrolment links
+    invitations *InvitationStore
+    // summaryTemplates are tenants' own summary prompts and output formats
+    summaryTemplates *SummaryTemplates
+    // webhooks post student changes to operators' URLs
+    webhooks *Webhooks
+    // masker masks the personal data the API returns; nil in production
+    masker *Masker
+}
+
+// StudentSummary is a generated structured summary tagged with what produced it
+type StudentSummary struct {
+    StructuredSummary
+    Model   string `json:"model"`
+    Variant string `json:"variant"`
+    // Template is the version of the tenant's summary template used, if any
+    Template int `json:"template,omitempty"`
+}
+
+// summaryTimeout bounds a coalesced Ollama call independently of any single waiter
+const summaryTimeout = 2 * time.Minute
+
+// validateStudent runs field validation followed by the email domain policy
+func (app *App) validateStudent(student Student) []ValidationError {
+    errors := student.Validate()
+    if student.Email == "" {
+        return errors
+    }
+    if err := app.emailPolicy.Check(student.Email); err != nil {
+        errors = append(errors, *err)
+    }
+    return errors
 }
 
 func (app *App) CreateStudent(w http.ResponseWriter, r *http.Request) {
+    store := app.storeFor(r)
     var student Student
     if err := json.NewDecoder(r.Body).Decode(&student); err != nil {
-        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        httpError(w, r, "Invalid request body", http.StatusBadRequest)
         return
     }
 
-    if errors := student.Validate(); len(errors) > 0 {
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(errors)
+    if errors := app.validateStudent(student); len(errors) > 0 {
+        writeValidationErrors(w, r, errors)
         return
     }
 
-    app.store.Lock()
-    student.ID = app.store.nextID
-    app.store.nextID++
-    app.store.students[student.ID] = student
-    app.store.Unlock()
+    student, version, err := store.Create(student)
+    if err != nil {
+        writeStoreError(w, r, err)
+        return
+    }
 
+    app.recordChanges(r, version)
+    w.Header().Set("X-Operation-ID", strconv.Itoa(version.Seq))
     w.WriteHeader(http.StatusCreated)
     json.NewEncoder(w).Encode(student)
 }
 
 func (app *App) GetAllStudents(w http.ResponseWriter, r *http.Request) {
-    app.store.RLock()
-    students := make([]Student, 0, len(app.store.students))
-    for _, student := range app.store.students {
-        students = append(students, student)
+    if app.serveListSnapshot(w, r) {
+        return
+    }
+    store := app.storeFor(r)
+    filter, ferr := filterFromRequest(r)
+    if ferr != nil {
+        writeValidationErrors(w, r, []ValidationError{*ferr})
+        return
     }
-    app.store.RUnlock()
 
-    json.NewEncoder(w).Encode(students)
+    keys, serr := sortFromRequest(r)
+    if serr != nil {
+        writeValidationErrors(w, r, []ValidationError{*serr})
+        return
+    }
+    includeDeleted, derr := includeDeletedFromRequest(r)
+    if derr != nil {
+        writeValidationErrors(w, r, []ValidationError{*derr})
+        return
+    }
+    limit, offset, paged, perr := pageFromRequest(r)
+    if perr != nil {
+        writeValidationErrors(w, r, []ValidationError{*perr})
+        return
+    }
+    opts := ListOptions{Filter: filter, Sort: keys, IncludeDeleted: includeDeleted}
+    if !paged {
+        students, err := store.List(opts)
+        if err != nil {
+            writeStoreError(w, r, err)
+            return
+        }
+        app.recordAccess(r, fieldsStudent, studentIDs(students)...)
+        json.NewEncoder(w).Encode(students)
+        return
+    }
+
+    opts.Limit, opts.Offset = limit, offset
+    students, total, err := store.Page(opts)
+    if err != nil {
+        writeStoreError(w, r, err)
+        return
+    }
+    app.recordAccess(r, fieldsStudent, studentIDs(students)...)
+    page := StudentPage{Data: students, Total: total, Limit: limit, Offset: offset}
+    if page.Next = nextPageURL(r, limit, offset, total); page.Next != nil {
+        w.Header().Set("Link", "<"+*page.Next+`>; rel="next"`)
+    }
+    w.Header().Set("X-Total-Count", strconv.Itoa(total))
+    json.NewEncoder(w).Encode(page)
 }
 
 func (app *App) GetStudent(w http.ResponseWriter, r *http.Request) {
+    store := app.storeFor(r)
     id, err := strconv.Atoi(mux.Vars(r)["id"])
     if err != nil {
-        http.Error(w, "Invalid ID", http.StatusBadRequest)
+        httpError(w, r, "Invalid ID", http.StatusBadRequest)
         return
     }
 
-    app.store.RLock()
-    student, exists := app.store.students[id]
-    app.store.RUnlock()
+    // Parsing the query allocates, so plain gets skip it
+    if r.URL.RawQuery != "" {
+        if value := r.URL.Query().Get("as_of"); value != "" {
+            asOf, ok := parseAsOf(value)
+            if !ok {
+                httpError(w, r, "Invalid as_of timestamp", http.StatusBadRequest)
+                return
+            }
+            student, exists, err := store.AsOf(id, asOf)
+            if err != nil {
+                writeStoreError(w, r, err)
+                return
+            }
+            if !exists {
+                httpError(w, r, "Student not found", http.StatusNotFound)
+                return
+            }
+            app.recordAccess(r, fieldsStudent, id)
+            writeStudentJSON(w, student)
+            return
+        }
+    }
 
-    if !exists {
-        http.Error(w, "Student not found", http.StatusNotFound)
+    student, err := store.Get(id)
+    if err != nil {
+        writeStoreError(w, r, err)
         return
     }
 
-    json.NewEncoder(w).Encode(student)
+    app.recordAccess(r, fieldsStudent, id)
+    writeStudentJSON(w, student)
 }
 
 func (app *App) UpdateStudent(w http.ResponseWriter, r *http.Request) {
+    store := app.storeFor(r)
     id, err := strconv.Atoi(mux.Vars(r)["id"])
     if err != nil {
-        http.Error(w, "Invalid ID", http.StatusBadRequest)
+        httpError(w, r, "Invalid ID", http.StatusBadRequest)
         return
     }
 
     var student Student
     if err := json.NewDecoder(r.Body).Decode(&student); err != nil {
-        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        httpError(w, r, "Invalid request body", http.StatusBadRequest)
         return
     }
 
-    if errors := student.Validate(); len(errors) > 0 {
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(errors)
+    if errors := app.validateStudent(student); len(errors) > 0 {
+        writeValidationErrors(w, r, errors)
         return
     }
 
-    app.store.Lock()
-    if _, exists := app.store.students[id]; !exists {
-        app.store.Unlock()
-        http.Error(w, "Student not found", http.StatusNotFound)
+    student.ID = id
+    student, version, err := store.Update(student)
+    if err != nil {
+        writeStoreError(w, r, err)
         return
     }
 
-    student.ID = id
-    app.store.students[id] = student
-    app.store.Unlock()
-
+    app.recordChanges(r, version)
+    w.Header().Set("X-Operation-ID", strconv.Itoa(version.Seq))
     json.NewEncoder(w).Encode(student)
 }
 
 func (app *App) DeleteStudent(w http.ResponseWriter, r *http.Request) {
+    store := app.storeFor(r)
     id, err := strconv.Atoi(mux.Vars(r)["id"])
     if err != nil {
-        http.Error(w, "Invalid ID", http.StatusBadRequest)
+        httpError(w, r, "Invalid ID", http.StatusBadRequest)
         return
     }
 
-    app.store.Lock()
-    if _, exists := app.store.students[id]; !exists {
-        app.store.Unlock()
-        http.Error(w, "Student not found", http.StatusNotFound)
+    version, err := store.Delete(id)
+    if err != nil {
+        writeStoreError(w, r, err)
         return
     }
 
-    delete(app.store.students, id)
-    app.store.Unlock()
-
+    app.recordChanges(r, version)
+    w.Header().Set("X-Operation-ID", strconv.Itoa(version.Seq))
     w.WriteHeader(http.StatusNoContent)
 }
 
 func (app *App) GetStudentSummary(w http.ResponseWriter, r *http.Request) {
+    store := app.storeFor(r)
     id, err := strconv.Atoi(mux.Vars(r)["id"])
     if err != nil {
-        http.Error(w, "Invalid ID", http.StatusBadRequest)
+        httpError(w, r, "Invalid ID", http.StatusBadRequest)
         return
     }
 
-    app.store.RLock()
-    student, exists := app.store.students[id]
-    app.store.RUnlock()
+    student, err := store.Get(id)
+    if err != nil {
+        writeStoreError(w, r, err)
+        return
+    }
 
-    if !exists {
-        http.Error(w, "Student not found", http.StatusNotFound)
+    summary, err := app.cachedSummary(r.Context(), student, wantsFreshSummary(r))
+    if writeLLMBusy(w, r, err) {
         return
     }
+    if err != nil {
+        reqctx.Logger(r.Context()).Error("summary generation failed", "student_id", id, "error", err)
+        httpError(w, r, "Failed to generate summary", http.StatusBadGateway)
+        return
+    }
+
+    app.recordAccess(r, fieldsSummary, id)
+    setSummaryAge(w, summary)
+    json.NewEncoder(w).Encode(summary)
+}
 
-    summary := fmt.Sprintf("Student %s is %d years old with email %s.", student.Name, student.Age, student.Email)
-    json.NewEncoder(w).Encode(map[string]string{"summary": summary})
+// generateSummary coalesces concurrent requests for the same tenant,
+// student, model, prompt variant and tenant template into a single Ollama
+// call and shares the result among all waiters. The call is detached from
+// the first caller's cancellation so that one client disconnecting does not
+// fail the others.
+func (app *App) generateSummary(ctx context.Context, student Student, tmpl *summaryPrompt) (StudentSummary, error) {
+    variant := app.prompts.VariantFor(student.ID)
+    model := app.models.Primary(TaskSummary)
+
+    // Student IDs repeat across tenant databases, so the tenant is always
+    // part of the key
+    key := fmt.Sprintf("%s:%d:%s:%s%s", reqctx.Tenant(ctx), student.ID, model, variant.Name, tmpl.key())
+    result, err, _ := app.summaries.Do(key, func() (interface{}, error) {
+        prompt, name, err := tmpl.render(variant, student)
+        if err != nil {
+            return nil, err
+        }
+
+        callCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), summaryTimeout)
+        defer cancel()
+        generator := app.models.For(TaskSummary)
+        structured, err := generateStructured(callCtx, generator, prompt, tmpl.format(), app.summaryRepairs, func(resp *OllamaResponse) {
+            app.prompts.RecordUsage(name, resp)
+        })
+        if err != nil {
+            return nil, err
+        }
+
+        summary := StudentSummary{StructuredSummary: structured, Model: generator.Model(), Variant: name}
+        if tmpl != nil {
+            summary.Template = tmpl.Version
+        }
+        return summary, nil
+    })
+    if err != nil {
+        return StudentSummary{}, err
+    }
+    return result.(StudentSummary), nil
 }
 
 func main() {
-    db, err := sql.Open("sqlite3", "./students.db")
-    if (err != nil) {
+    check := flag.Bool("check", false, "validate configuration and dependencies, print a report and exit")
+    migrate := flag.String("migrate", "", "run schema migrations (status, up or down) and exit")
+    demoOut := flag.String("demo-out", "", "write a database of fake students shaped like DATABASE_PATH's to this file and exit")
+    demoCount := flag.Int("demo-count", 0, "number of demo students to generate (default: as many as the source)")
+    demoSeed := flag.Int64("demo-seed", 1, "random seed for the demo generator")
+    config := DefineConfigFlags(flag.CommandLine)
+    flag.Parse()
+    // The doctor reports a bad config instead of refusing to run
+    cfg, err := config.Apply(flag.CommandLine)
+    if err != nil && !*check {
+        log.Fatal(err)
+    }
+    if err := setupLogging(); err != nil {
+        log.Fatal(err)
+    }
+    if *check {
+        os.Exit(runDoctor(os.Stdout))
+    }
+    if *migrate != "" {
+        os.Exit(runMigrateCommand(os.Stdout, *migrate))
+    }
+    if *demoOut != "" {
+        if err := runDemoGenerator(cfg.DatabasePath, *demoOut, *demoCount, *demoSeed); err != nil {
+            log.Fatal(err)
+        }
+        return
+    }
+
+    var repo StudentRepository
+    var keyRepo APIKeyRepository
+    var auditLocal AuditSink
+    var accessRepo AccessLogRepository
+    var honeypotRepo HoneypotRepository
+    var userRepo UserRepository
+    var registrationRepo RegistrationRepository
+    var invitationRepo InvitationRepository
+    var summaryTemplateRepo SummaryTemplateRepository
+    var webhookRepo WebhookRepository
+    var outboxRepo OutboxRepository
+    var savedReportRepo SavedReportRepository
+    var reports *ReportRunner
+    var locker Locker
+    switch backend := cfg.StoreBackend; backend {
+    case BackendMemory:
+        locker = NewLocker(backend, nil, "")
+        if repo, err = LoadMemoryRepository(); err != nil {
+            log.Fatal(err)
+        }
+        keyRepo = NewMemoryAPIKeyRepository()
+        auditLocal = NewMemoryAuditSink(auditMemoryEvents)
+        accessRepo = NewMemoryAccessLogRepository()
+        honeypotRepo = MemoryHoneypotRepository{}
+        userRepo = NewMemoryUserRepository()
+        registrationRepo = NewMemoryRegistrationRepository()
+        invitationRepo = NewMemoryInvitationRepository()
+        summaryTemplateRepo = NewMemorySummaryTemplateRepository()
+        webhookRepo = NewMemoryWebhookRepository()
+        outboxRepo = NewMemoryOutboxRepository()
+        savedReportRepo = NewMemorySavedReportRepository()
+    case BackendSQLite:
+        db, err := sql.Open("sqlite3", sqliteDSN(cfg.DatabasePath))
+        if (err != nil) {
+            log.Fatal(err)
+        }
+        defer db.Close()
+
+        locker = NewLocker(backend, db, cfg.DatabasePath)
+        if err := withLock(locker, lockMigrations, migrationLockTimeout, func() error { return migrateDB(db) }); err != nil {
+            log.Fatal(err)
+        }
+        sqlite, err := NewSQLiteRepository(db)
+        if err != nil {
+            log.Fatal(err)
+        }
+        repo = sqlite
+        keyRepo = NewSQLAPIKeyRepository(db, nil, false)
+        auditLocal = NewSQLAuditSink(db, nil)
+        accessRepo = NewSQLAccessLogRepository(db, nil)
+        honeypotRepo = NewSQLHoneypotRepository(db, nil)
+        userRepo = NewSQLUserRepository(db, nil, false)
+        registrationRepo = NewSQLRegistrationRepository(db, nil, false)
+        invitationRepo = NewSQLInvitationRepository(db, nil, false)
+        summaryTemplateRepo = NewSQLSummaryTemplateRepository(db, nil)
+        webhookRepo = NewSQLWebhookRepository(db, nil, false)
+        outboxRepo = NewSQLOutboxRepository(db, nil)
+        savedReportRepo = NewSQLSavedReportRepository(db, nil, false)
+
+        reports, err = OpenReportRunner(cfg.DatabasePath)
+        if err != nil {
+            log.Fatal(err)
+        }
+        defer reports.Close()
+    case BackendPostgres:
+        db, err := openPostgres()
+        if err != nil {
+            log.Fatal(err)
+        }
+        defer db.Close()
+
+        locker = NewLocker(backend, db, "")
+        if err := withLock(locker, lockMigrations, migrationLockTimeout, func() error { return migratePostgres(db) }); err != nil {
+            log.Fatal(err)
+        }
+        postgres, err := NewPostgresRepository(db)
+        if err != nil {
+            log.Fatal(err)
+        }
+        repo = postgres
+        keyRepo = NewSQLAPIKeyRepository(db, rebindPostgres, true)
+        auditLocal = NewSQLAuditSink(db, rebindPostgres)
+        accessRepo = NewSQLAccessLogRepository(db, rebindPostgres)
+        honeypotRepo = NewSQLHoneypotRepository(db, rebindPostgres)
+        userRepo = NewSQLUserRepository(db, rebindPostgres, true)
+        registrationRepo = NewSQLRegistrationRepository(db, rebindPostgres, true)
+        invitationRepo = NewSQLInvitationRepository(db, rebindPostgres, true)
+        summaryTemplateRepo = NewSQLSummaryTemplateRepository(db, rebindPostgres)
+        webhookRepo = NewSQLWebhookRepository(db, rebindPostgres, true)
+        outboxRepo = NewSQLOutboxRepository(db, rebindPostgres)
+        savedReportRepo = NewSQLSavedReportRepository(db, rebindPostgres, true)
+    case BackendMySQL:
+        db, err := openMySQL()
+        if err != nil {
+            log.Fatal(err)
+        }
+        defer db.Close()
+
+        locker = NewLocker(backend, db, "")
+        if err := withLock(locker, lockMigrations, migrationLockTimeout, func() error { return migrateMySQL(db) }); err != nil {
+            log.Fatal(err)
+        }
+        mysql, err := NewMySQLRepository(db)
+        if err != nil {
+            log.Fatal(err)
+        }
+        repo = mysql
+        keyRepo = NewSQLAPIKeyRepository(db, nil, false)
+        auditLocal = NewSQLAuditSink(db, nil)
+        accessRepo = NewSQLAccessLogRepository(db, nil)
+        honeypotRepo = NewSQLHoneypotRepository(db, nil)
+        userRepo = NewSQLUserRepository(db, nil, false)
+        registrationRepo = NewSQLRegistrationRepository(db, nil, false)
+        invitationRepo = NewSQLInvitationRepository(db, nil, false)
+        summaryTemplateRepo = NewSQLSummaryTemplateRepository(db, nil)
+        webhookRepo = NewSQLWebhookRepository(db, nil, false)
+        outboxRepo = NewSQLOutboxRepository(db, nil)
+        savedReportRepo = NewSQLSavedReportRepository(db, nil, false)
+    default:
+        log.Fatalf("unknown STORE_BACKEND %q", backend)
+    }
+
+    emailPolicy, err := LoadEmailPolicy()
+    if err != nil {
         log.Fatal(err)
     }
-    defer db.Close()
 
-    _, err = db.Exec(`CREATE TABLE IF NOT EXISTS students (
-        id INTEGER PRIMARY KEY AUTOINCREMENT,
-        name TEXT,
-        age INTEGER,
-        email TEXT
-    )`)
+    ollama := NewOllamaClient(cfg.OllamaURL, cfg.OllamaModel)
+    recorder, err := LoadOllamaRecorder()
     if err != nil {
         log.Fatal(err)
     }
+    if recorder != nil {
+        ollama.SetTransport(recorder)
+    }
+
+    metrics := NewMetrics()
+    // While migrating to another backend, the shared store is mirrored to it
+    shadow, shadowDB, err := LoadShadowRepository(repo, metrics)
+    if err != nil {
+        log.Fatal(err)
+    }
+    if shadowDB != nil {
+        defer shadowDB.Close()
+    }
+    if shadow != nil {
+        slog.Info("mirroring the store to a shadow backend", "backend", shadow.backend, "read_sample", shadow.sample)
+        repo = shadow
+    }
+    models, err := LoadModelRouter(ollama, metrics)
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    routes, err := LoadRoutePolicies()
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    limiter, err := LoadRateLimiter(routes)
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    llmQuotas, err := LoadLLMQuotas()
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    leader, err := LoadLeaderElector(locker, metrics)
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    prompts, err := ParsePromptSplit(getEnv("PROMPT_VARIANTS", ""))
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    conflictPolicy, err := ParseConflictPolicy(getEnv("IMPORT_CONFLICT_POLICY", ""))
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    auth, err := LoadJWTAuth()
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    oidc, err := LoadOIDCProvider()
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    chaos, err := LoadChaos()
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    timeouts, err := LoadRouteTimeouts(routes)
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    bodyLimits, err := LoadBodyLimits()
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    shutdown, err := LoadShutdownConfig()
+    if err != nil {
+        log.Fatal(err)
+    }
+    tlsConfig, err := LoadTLSConfig()
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    events := NewEventBus()
+
+    tenants, err := LoadTenantStores(events)
+    if err != nil {
+        log.Fatal(err)
+    }
+    if tenants != nil {
+        defer tenants.Close()
+    }
+
+    store := NewStudentStore(repo, events)
+    defer store.Close()
+
+    auditSinks, err := LoadAuditSinks(auditLocal)
+    if err != nil {
+        log.Fatal(err)
+    }
+    var auditReader AuditReader
+    for _, sink := range auditSinks {
+        if sink == auditLocal {
+            auditReader = auditLocal.(AuditReader)
+        }
+    }
+    access, err := LoadAccessLog(accessRepo)
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    honeypots, err := NewHoneypotStore(honeypotRepo)
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    users, err := LoadUserStore(userRepo)
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    registrations, err := LoadRegistrationStore(registrationRepo)
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    invitations, err := LoadInvitationStore(invitationRepo)
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    graphQL, err := LoadGraphQL()
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    streams, err := LoadEventStreams()
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    sockets, err := LoadEventSockets()
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    alerts := LoadAlerter(metrics)
+    webhooks, err := LoadWebhooks(webhookRepo, alerts, metrics)
+    if err != nil {
+        log.Fatal(err)
+    }
+    if err := webhooks.Attach(events); err != nil {
+        log.Fatal(err)
+    }
+    outbox, err := LoadEventOutbox(outboxRepo, alerts, metrics)
+    if err != nil {
+        log.Fatal(err)
+    }
+    if outbox != nil {
+        outbox.Attach(store)
+        if tenants != nil {
+            outbox.AttachTenants(tenants)
+        }
+        slog.Info("publishing events", "broker", outbox.Describe())
+    }
+
+    masker, err := LoadMasker()
+    if err != nil {
+        log.Fatal(err)
+    }
+    if masker != nil {
+        slog.Warn("masking personal data in responses", "env", getEnv("APP_ENV", "production"))
+    }
+
+    auditLog := NewAuditLog(auditSinks, getEnvDuration("AUDIT_FLUSH_INTERVAL", time.Second), metrics)
+    defer auditLog.Close()
 
     app := &App{
-        store: NewStudentStore(db),
+        store:       store,
+        events:      events,
+        tenants:     tenants,
+        emailPolicy: emailPolicy,
+        ollama:      ollama,
+        models:      models,
+        feedback:    NewFeedbackStore(),
+        prompts:     prompts,
+
+        summaryCache: LoadSummaryCache(),
+
+        summaryRepairs: getEnvInt("SUMMARY_MAX_REPAIRS", 2),
+        tts:            LoadTTSProvider(),
+        ocr:            LoadOCRProvider(),
+        stt:            LoadSTTProvider(),
+        notes:          NewNoteStore(),
+
+        faces:             LoadFaceMatcher(),
+        photos:            NewPhotoStore(),
+        faceMinConfidence: getEnvFloat("FACE_MATCH_MIN_CONFIDENCE", 0.8),
+
+        csvEscapeFormulas: getEnvBool("CSV_ESCAPE_FORMULAS", true),
+        importProfiles:    NewImportProfileStore(),
+        imports:           NewImportStore(),
+        conflicts:         NewConflictStore(),
+        conflictPolicy:    conflictPolicy,
+        undoWindow:        getEnvDuration("UNDO_WINDOW", 15*time.Minute),
+        deletedRetention:  getEnvDuration("DELETED_RETENTION", 30*24*time.Hour),
+        consistencyWait:   getEnvDuration("CONSISTENCY_WAIT", 2*time.Second),
+        metrics:           metrics,
+        auditLog:          auditLog,
+        auditReader:       auditReader,
+        access:            access,
+        honeypots:         honeypots,
+        alerts:            alerts,
+        keys:              NewAPIKeyStore(keyRepo, getEnvInt("API_KEY_RATE_LIMIT", 600)),
+        limiter:           limiter,
+        llmQuotas:         llmQuotas,
+        routes:            routes,
+        shadow:            shadow,
+        leader:            leader,
+        reports:           reports,
+        savedReports:      NewSavedReportStore(savedReportRepo),
+        adminToken:        getEnv("ADMIN_TOKEN", ""),
+        auth:              auth,
+        oidc:              oidc,
+        users:             users,
+        graphql:           graphQL,
+        streams:           streams,
+        sockets:           sockets,
+        registrations:     registrations,
+        invitations:       invitations,
+        summaryTemplates:  NewSummaryTemplates(summaryTemplateRepo),
+        webhooks:          webhooks,
+        masker:            masker,
+    }
+
+    // ctx is cancelled by SIGINT or SIGTERM, stopping the server and the
+    // background workers; a second signal kills the process outright
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+    var workers sync.WaitGroup
+
+    if app.listSnapshot, err = LoadListSnapshot(store, events, metrics); err != nil {
+        log.Fatal(err)
+    }
+    if app.listSnapshot != nil {
+        workers.Add(1)
+        go func() {
+            defer workers.Done()
+            app.listSnapshot.Run(ctx)
+        }()
+    }
+
+    warmer := NewModelWarmer(ollama, getEnvBool("OLLAMA_PULL", true))
+    if getEnvBool("OLLAMA_WARMUP", true) {
+        workers.Add(1)
+        go func() {
+            defer workers.Done()
+            warmer.Run(ctx, getEnvDuration("OLLAMA_WARMUP_INTERVAL", 5*time.Minute))
+        }()
+    }
+
+    router := app.newRouter(warmer, chaos.Middleware, bodyLimits.Middleware, timeouts.Middleware)
+    if err := routes.CheckRoutes(router); err != nil {
+        log.Fatal(err)
+    }
+    slog.Info("route policies loaded", "routes", routes.Summary())
+
+    go cycleLogLevelOnSignal()
+    // Only the leader among the instances sharing the database runs the
+    // saved report schedules
+    app.leader.Register("report-schedules", func(ctx context.Context) {
+        app.runReportSchedules(ctx, getEnvDuration("REPORT_SCHEDULE_INTERVAL", 30*time.Second))
+    })
+    // and sweeps webhook deliveries, while every instance delivers the
+    // changes it makes to the webhooks registered on any of them
+    app.leader.Register("webhook-sweeper", func(ctx context.Context) {
+        app.webhooks.sweep(ctx, getEnvDuration("WEBHOOK_SWEEP_INTERVAL", time.Minute))
+    })
+    if outbox != nil {
+        app.leader.Register("event-outbox", outbox.Relay)
+    }
+    if app.deletedRetention > 0 {
+        app.leader.Register("student-purge", func(ctx context.Context) {
+            app.purgeDeletedStudents(ctx, getEnvDuration("DELETED_PURGE_INTERVAL", time.Hour))
+        })
+    }
+    workers.Add(1)
+    go func() {
+        defer workers.Done()
+        app.webhooks.Run(ctx)
+    }()
+    workers.Add(1)
+    go func() {
+        defer workers.Done()
+        app.leader.Run(ctx)
+    }()
+
+    server := &http.Server{
+        Addr:    cfg.ListenAddr,
+        Handler: serverHandler(router),
     }
+    timeouts.Apply(server)
+    // Event streams never finish on their own; end them as shutdown begins
+    server.RegisterOnShutdown(app.streams.Close)
+    server.RegisterOnShutdown(app.sockets.Close)
 
+    certs, challenges, err := tlsConfig.Apply(server)
+    if err != nil {
+        log.Fatal(err)
+    }
+    if certs != nil {
+        go certs.reloadOnSignal()
+    }
+    if challenges != nil {
+        go func() {
+            if err := challenges.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+                log.Fatal(err)
+            }
+        }()
+    }
+    // gRPC calls are served by the same handler, and drain alongside it
+    if grpcServer := LoadGRPCServer(server.Handler, server.TLSConfig, metrics); grpcServer != nil {
+        workers.Add(1)
+        go func() {
+            defer workers.Done()
+            if err := grpcServer.Serve(ctx, shutdown.Timeout); err != nil {
+                log.Fatal(err)
+            }
+        }()
+    }
+
+    slog.Info("starting", "build", buildInfo(), "addr", server.Addr, "tls", tlsConfig.Mode())
+    if err := serve(ctx, server, warmer, shutdown); err != nil {
+        log.Fatal(err)
+    }
+    app.sockets.Wait()
+    stop()
+    if challenges != nil {
+        challenges.Close()
+    }
+
+    // The deferred closes then flush the audit log and close the stores and
+    // databases, in reverse order of opening
+    workers.Wait()
+    app.webhooks.Close()
+    app.alerts.Close()
+    slog.Info("stopped")
+}
+
+// newRouter registers every API route behind response masking, feature
+// gating and the given middleware, followed by the app's own audit, token,
+// JWT, role, tenancy, LLM quota and consistency middleware
+func (app *App) newRouter(warmer *ModelWarmer, middleware ...mux.MiddlewareFunc) *mux.Router {
     router := mux.NewRouter()
+    router.NotFoundHandler = http.HandlerFunc(app.notFound)
+    router.MethodNotAllowedHandler = app.methodNotAllowed(router)
+    router.Use(app.requestMetrics)
+    router.Use(app.maskResponses)
+    router.Use(app.featureGate)
+    router.Use(middleware...)
+    router.Use(app.audit)
+    router.Use(app.apiTokens)
+    router.Use(app.apiKeys)
+    router.Use(app.rateLimit)
+    router.Use(app.jwtAuth)
+    router.Use(app.rbac)
+    router.Use(app.tenancy)
+    router.Use(app.llmQuota)
+    router.Use(app.consistency)
+    router.Use(app.auditIdentity)
 
+    router.HandleFunc("/auth/login", app.Login).Methods("POST")
+    router.HandleFunc("/auth/refresh", app.RefreshToken).Methods("POST")
+    router.HandleFunc("/auth/register", app.Register).Methods("POST")
+    router.HandleFunc("/auth/password", app.ChangePassword).Methods("PUT")
+    router.HandleFunc("/auth/password-reset", app.RequestPasswordReset).Methods("POST")
+    router.HandleFunc("/auth/password-reset/confirm", app.ConfirmPasswordReset).Methods("POST")
+    router.HandleFunc("/register", app.RegisterStudent).Methods("POST")
+    router.HandleFunc("/register/verify", app.VerifyRegistration).Methods("POST")
+    router.HandleFunc("/invitations/lookup", app.PreviewInvitation).Methods("POST")
+    router.HandleFunc("/invitations/redeem", app.RedeemInvitation).Methods("POST")
     router.HandleFunc("/students", app.CreateStudent).Methods("POST")
     router.HandleFunc("/students", app.GetAllStudents).Methods("GET")
+    router.HandleFunc("/students", app.BulkDeleteStudents).Methods("DELETE")
+    router.HandleFunc("/students/ingest/roster", app.IngestRoster).Methods("POST")
+    router.HandleFunc("/students/export", app.ExportStudents).Methods("GET")
+    router.HandleFunc("/students/search", app.SearchStudents).Methods("GET")
+    router.HandleFunc("/students/bulk", app.BulkCreateStudents).Methods("POST")
+    router.HandleFunc("/students/bulk", app.BulkUpdateStudents).Methods("PUT")
+    router.HandleFunc("/students/bulk-upsert", app.BulkUpsertStudents).Methods("PUT")
+    router.HandleFunc("/students/import", app.ImportStudents).Methods("POST")
     router.HandleFunc("/students/{id}", app.GetStudent).Methods("GET")
     router.HandleFunc("/students/{id}", app.UpdateStudent).Methods("PUT")
+    router.HandleFunc("/students/{id}", app.PatchStudent).Methods("PATCH")
     router.HandleFunc("/students/{id}", app.DeleteStudent).Methods("DELETE")
+    router.HandleFunc("/students/{id}/restore", app.RestoreStudent).Methods("POST")
+    router.HandleFunc("/students/{id}/versions", app.GetStudentVersions).Methods("GET")
+    router.HandleFunc("/students/{id}/diff", app.GetStudentDiff).Methods("GET")
+    router.HandleFunc("/students/{id}/access", app.GetStudentAccess).Methods("GET")
+    router.HandleFunc("/students/{id}/history", app.GetStudentHistory).Methods("GET")
     router.HandleFunc("/students/{id}/summary", app.GetStudentSummary).Methods("GET")
+    router.HandleFunc("/students/{id}/summary/audio", app.GetStudentSummaryAudio).Methods("GET")
+    router.HandleFunc("/students/{id}/summary/feedback", app.CreateSummaryFeedback).Methods("POST")
+    router.HandleFunc("/students/{id}/notes", app.ListNotes).Methods("GET")
+    router.HandleFunc("/students/{id}/notes/audio", app.CreateAudioNote).Methods("POST")
+    router.HandleFunc("/students/{id}/photo", app.PutStudentPhoto).Methods("PUT")
+    router.HandleFunc("/students/{id}/photo", app.DeleteStudentPhoto).Methods("DELETE")
+    router.HandleFunc("/graphql", app.GraphQL).Methods("POST")
+    router.HandleFunc("/graphql/ws", app.ServeGraphQLSocket).Methods("GET")
+    router.HandleFunc("/audit", app.ListAudit).Methods("GET")
+    router.HandleFunc("/attendance/photo", app.MatchClassPhoto).Methods("POST")
+    router.HandleFunc("/attendance/photo/{id}", app.GetAttendanceProposal).Methods("GET")
+    router.HandleFunc("/attendance/photo/{id}/review", app.ReviewAttendanceProposal).Methods("POST")
+    router.HandleFunc("/summary/feedback/metrics", app.GetSummaryFeedbackMetrics).Methods("GET")
+    router.HandleFunc("/summary/variants/report", app.GetPromptVariantReport).Methods("GET")
+    router.HandleFunc("/llm/quota", app.GetLLMQuota).Methods("GET")
+    router.HandleFunc("/import-profiles", app.ListImportProfiles).Methods("GET")
+    router.HandleFunc("/import-profiles/{name}", app.GetImportProfile).Methods("GET")
+    router.HandleFunc("/import-profiles/{name}", app.PutImportProfile).Methods("PUT")
+    router.HandleFunc("/import-profiles/{name}", app.DeleteImportProfile).Methods("DELETE")
+    router.HandleFunc("/imports", app.CreateImport).Methods("POST")
+    router.HandleFunc("/imports", app.ListImports).Methods("GET")
+    router.HandleFunc("/imports/{id}", app.GetImport).Methods("GET")
+    router.HandleFunc("/imports/{id}", app.DeleteImport).Methods("DELETE")
+    router.HandleFunc("/imports/{id}/commit", app.CommitImport).Methods("POST")
+    router.HandleFunc("/conflicts", app.ListConflicts).Methods("GET")
+    router.HandleFunc("/conflicts/{id}", app.GetConflict).Methods("GET")
+    router.HandleFunc("/conflicts/{id}/resolve", app.ResolveConflict).Methods("POST")
+    router.HandleFunc("/undo/{operation_id}", app.UndoOperation).Methods("POST")
+    router.HandleFunc("/events", app.StreamEvents).Methods("GET")
+    router.HandleFunc("/ws", app.ServeEventSocket).Methods("GET")
+    router.HandleFunc("/sync/snapshot", app.GetSyncSnapshot).Methods("GET")
+    router.HandleFunc("/sync/checksums", app.GetSyncChecksums).Methods("GET")
+    router.HandleFunc("/sync/buckets/{bucket}", app.GetSyncBucket).Methods("GET")
+    router.HandleFunc("/sync/delta", app.GetSyncDelta).Methods("GET")
+    router.HandleFunc("/healthz", app.Healthz).Methods("GET")
+    router.HandleFunc("/readyz", warmer.Readyz).Methods("GET")
+    router.Handle("/metrics", app.metrics).Methods("GET")
+    router.HandleFunc("/version", GetVersion).Methods("GET")
+    router.HandleFunc("/openapi.json", app.GetOpenAPI).Methods("GET")
+    router.HandleFunc("/schema", app.GetSchema).Methods("GET")
+    router.HandleFunc("/docs", GetDocs).Methods("GET")
+    router.HandleFunc("/docs/{file}", GetDocsAsset).Methods("GET")
+    router.HandleFunc("/admin/loglevel", app.requireAdmin(GetLogLevel)).Methods("GET")
+    router.HandleFunc("/admin/loglevel", app.requireAdmin(PutLogLevel)).Methods("PUT")
+    router.HandleFunc("/admin/tenants/{tenant}", app.requireAdmin(app.ProvisionTenant)).Methods("PUT")
+    router.HandleFunc("/admin/tenants/{tenant}/export", app.requireAdmin(app.ExportTenant)).Methods("GET")
+    router.HandleFunc("/admin/tenants/{tenant}/import", app.requireAdmin(app.ImportTenant)).Methods("POST")
+    router.HandleFunc("/admin/api-keys", app.requireAdmin(app.CreateAPIKey)).Methods("POST")
+    router.HandleFunc("/admin/api-keys", app.requireAdmin(app.ListAPIKeys)).Methods("GET")
+    router.HandleFunc("/admin/api-keys/{id}", app.requireAdmin(app.RevokeAPIKey)).Methods("DELETE")
+    router.HandleFunc("/admin/users", app.requireAdmin(app.CreateUser)).Methods("POST")
+    router.HandleFunc("/admin/users", app.requireAdmin(app.ListUsers)).Methods("GET")
+    router.HandleFunc("/admin/users/{username}/unlock", app.requireAdmin(app.UnlockUser)).Methods("POST")
+    router.HandleFunc("/admin/users/{username}/password-reset", app.requireAdmin(app.IssuePasswordReset)).Methods("POST")
+    router.HandleFunc("/admin/pending", app.requireAdmin(app.ListPendingRegistrations)).Methods("GET")
+    router.HandleFunc("/admin/pending/{id}/approve", app.requireAdmin(app.ApproveRegistration)).Methods("POST")
+    router.HandleFunc("/admin/pending/{id}/reject", app.requireAdmin(app.RejectRegistration)).Methods("POST")
+    router.HandleFunc("/admin/invitations", app.requireAdmin(app.CreateInvitation)).Methods("POST")
+    router.HandleFunc("/admin/invitations", app.requireAdmin(app.ListInvitations)).Methods("GET")
+    router.HandleFunc("/admin/invitations/{id}", app.requireAdmin(app.RevokeInvitation)).Methods("DELETE")
+    router.HandleFunc("/admin/webhooks", app.requireAdmin(app.CreateWebhook)).Methods("POST")
+    router.HandleFunc("/admin/webhooks", app.requireAdmin(app.ListWebhooks)).Methods("GET")
+    router.HandleFunc("/admin/webhooks/dead-letters", app.requireAdmin(app.ListDeadLetters)).Methods("GET")
+    router.HandleFunc("/admin/webhooks/dead-letters/replay", app.requireAdmin(app.ReplayDeadLetters)).Methods("POST")
+    router.HandleFunc("/admin/webhooks/deliveries/{id}/replay", app.requireAdmin(app.ReplayDelivery)).Methods("POST")
+    router.HandleFunc("/webhooks/deliveries/{id}/replay", app.requireAdmin(app.ReplayDelivery)).Methods("POST")
+    router.HandleFunc("/admin/webhooks/{id}", app.requireAdmin(app.DeleteWebhook)).Methods("DELETE")
+    router.HandleFunc("/admin/webhooks/{id}/deliveries", app.requireAdmin(app.ListWebhookDeliveries)).Methods("GET")
+    router.HandleFunc("/admin/summary-template", app.requireAdmin(app.GetSummaryTemplate)).Methods("GET")
+    router.HandleFunc("/admin/summary-template", app.requireAdmin(app.PutSummaryTemplate)).Methods("PUT")
+    router.HandleFunc("/admin/summary-template", app.requireAdmin(app.DeleteSummaryTemplate)).Methods("DELETE")
+    router.HandleFunc("/admin/summary-template/preview", app.requireAdmin(app.PreviewSummaryTemplate)).Methods("POST")
+    router.HandleFunc("/admin/honeypots", app.requireAdmin(app.PlantHoneypot)).Methods("POST")
+    router.HandleFunc("/admin/honeypots", app.requireAdmin(app.ListHoneypots)).Methods("GET")
+    router.HandleFunc("/admin/honeypots/{id}", app.requireAdmin(app.RemoveHoneypot)).Methods("DELETE")
+    router.HandleFunc("/admin/reports/query", app.requireAdmin(app.RunReport)).Methods("POST")
+    router.HandleFunc("/admin/shadow", app.requireAdmin(app.GetShadowStatus)).Methods("GET")
+    router.HandleFunc("/admin/shadow/verify", app.requireAdmin(app.VerifyShadow)).Methods("POST")
+    router.HandleFunc("/admin/reports", app.requireAdmin(app.ListSavedReports)).Methods("GET")
+    router.HandleFunc("/admin/reports/{name}", app.requireAdmin(app.GetSavedReport)).Methods("GET")
+    router.HandleFunc("/admin/reports/{name}", app.requireAdmin(app.PutSavedReport)).Methods("PUT")
+    router.HandleFunc("/admin/reports/{name}", app.requireAdmin(app.DeleteSavedReport)).Methods("DELETE")
+    router.HandleFunc("/admin/reports/{name}/run", app.requireAdmin(app.RunSavedReport)).Methods("POST")
+    router.HandleFunc("/admin/reports/{name}/runs", app.requireAdmin(app.ListReportRuns)).Methods("GET")
+    app.openAPI = newOpenAPIDoc(app, router)
+    return router
+}
 
-    log.Println("Server starting on :8080")
-    log.Fatal(http.ListenAndServe(":8080", router))
+// serverHandler wraps the router with the middleware that runs before routing
+func serverHandler(router *mux.Router) http.Handler {
+    return versionHeader(requestContext(logRequests(methodOverride(normalizePaths(router)))))
 }
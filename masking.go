@@ -0,0 +1,482 @@
+package main
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "mime"
+    "net/http"
+    "regexp"
+    "slices"
+    "strings"
+)
+
+// DataMaskedHeader marks responses whose personal data was masked
+const DataMaskedHeader = "X-Data-Masked"
+
+// maskedEmailPattern matches the addresses Masker.Email produces
+var maskedEmailPattern = regexp.MustCompile(`^[a-z]+\.[a-z]+\.[0-9a-f]{6}@school[0-9]+\.example\.edu$`)
+
+// maskStudentKeys hold student data even where their objects carry no email
+// or age of their own, such as a merge patch or a change set
+var maskStudentKeys = map[string]bool{
+    "student": true, "students": true, "changes": true, "patch": true, "highlights": true,
+}
+
+// Masker replaces students' names and email addresses with fictional ones
+// outside production. Masking is keyed by MASK_SECRET and deterministic: the
+// same input masks to the same output on every instance and across restarts,
+// so search, filters and comparisons made on masked data still line up.
+// Masked values mask to themselves, so a masked record sent back unchanged
+// keeps its values. A nil Masker leaves data as it is.
+type Masker struct {
+    key []byte
+}
+
+// LoadMasker reads APP_ENV (production, staging or development; default
+// production) and MASK_PII, on by default only in staging. Masking needs
+// MASK_SECRET: without a secret, masked names could be reversed by masking
+// guesses. Returns nil when masking is off.
+func LoadMasker() (*Masker, error) {
+    env := strings.ToLower(getEnv("APP_ENV", "production"))
+    if env != "production" && env != "staging" && env != "development" {
+        return nil, fmt.Errorf("APP_ENV must be production, staging or development, not %q", env)
+    }
+    if !getEnvBool("MASK_PII", env == "staging") {
+        return nil, nil
+    }
+    secret := getEnv("MASK_SECRET", "")
+    if len(secret) < 16 {
+        return nil, fmt.Errorf("masking personal data (APP_ENV=%s) needs MASK_SECRET of at least 16 characters", env)
+    }
+    return &Masker{key: []byte(secret)}, nil
+}
+
+// digest keys a value of the given kind
+func (m *Masker) digest(kind, value string) []byte {
+    mac := hmac.New(sha256.New, m.key)
+    mac.Write([]byte(kind))
+    mac.Write([]byte{0})
+    mac.Write([]byte(value))
+    return mac.Sum(nil)
+}
+
+// pickName chooses a first and last name from the demo name parts
+func pickName(sum []byte) (first, last string) {
+    first = demoFirstNames[binary.BigEndian.Uint32(sum[0:4])%uint32(len(demoFirstNames))]
+    last = demoLastNames[binary.BigEndian.Uint32(sum[4:8])%uint32(len(demoLastNames))]
+    return first, last
+}
+
+// Name masks a person's name, ignoring case and spacing
+func (m *Masker) Name(name string) string {
+    if m == nil || strings.TrimSpace(name) == "" {
+        return name
+    }
+    parts := strings.Fields(name)
+    if len(parts) == 2 && slices.Contains(demoFirstNames, parts[0]) && slices.Contains(demoLastNames, parts[1]) {
+        return name
+    }
+    first, last := pickName(m.digest("name", strings.ToLower(strings.Join(parts, " "))))
+    return first + " " + last
+}
+
+// Email masks an address. The domain is masked on its own, so students who
+// share a domain keep sharing one.
+func (m *Masker) Email(email string) string {
+    if m == nil || strings.TrimSpace(email) == "" {
+        return email
+    }
+    email = strings.ToLower(strings.TrimSpace(email))
+    if maskedEmailPattern.MatchString(email) {
+        return email
+    }
+    sum := m.digest("email", email)
+    first, last := pickName(sum)
+    domain := "school1.example.edu"
+    if at := strings.LastIndex(email, "@"); at >= 0 {
+        domain = fmt.Sprintf("school%d.example.edu", binary.BigEndian.Uint32(m.digest("domain", email[at+1:]))%1000+1)
+    }
+    return strings.ToLower(first+"."+last) + "." + hex.EncodeToString(sum[8:11]) + "@" + domain
+}
+
+// Text masks the email addresses in free text
+func (m *Masker) Text(s string) string {
+    if m == nil {
+        return s
+    }
+    return emailPattern.ReplaceAllStringFunc(s, m.Email)
+}
+
+// Student masks a student's name and email
+func (m *Masker) Student(s Student) Student {
+    if m == nil {
+        return s
+    }
+    s.Name, s.Email = m.Name(s.Name), m.Email(s.Email)
+    return s
+}
+
+// Students masks a copy of students
+func (m *Masker) Students(students []Student) []Student {
+    if m == nil {
+        return students
+    }
+    masked := make([]Student, len(students))
+    for i, s := range students {
+        masked[i] = m.Student(s)
+    }
+    return masked
+}
+
+// Event masks the student of a change event and its changed name or email
+func (m *Masker) Event(e Event) Event {
+    if m == nil {
+        return e
+    }
+    e.Student = m.Student(e.Student)
+    e.Changes = m.changes(e.Changes)
+    return e
+}
+
+// Audit masks the old and new values of an audit event
+func (m *Masker) Audit(e AuditEvent) AuditEvent {
+    if m == nil {
+        return e
+    }
+    e.Changes = m.changes(e.Changes)
+    return e
+}
+
+// changes masks the values of changed fields
+func (m *Masker) changes(changes map[string]FieldChange) map[string]FieldChange {
+    if len(changes) == 0 {
+        return changes
+    }
+    masked := make(map[string]FieldChange, len(changes))
+    for field, change := range changes {
+        if mask := m.fieldMask(field); mask != nil {
+            change.From, change.To = m.strings(change.From, mask), m.strings(change.To, mask)
+        }
+        masked[field] = change
+    }
+    return masked
+}
+
+// Report masks the name and email columns of a report and the addresses
+// anywhere else in it
+func (m *Masker) Report(result ReportResult) ReportResult {
+    if m == nil {
+        return result
+    }
+    masks := make([]func(string) string, len(result.Columns))
+    for i, column := range result.Columns {
+        if masks[i] = m.fieldMask(column); masks[i] == nil {
+            masks[i] = m.Text
+        }
+    }
+    rows := make([][]interface{}, len(result.Rows))
+    for i, row := range result.Rows {
+        rows[i] = make([]interface{}, len(row))
+        for j, v := range row {
+            if j < len(masks) {
+                v = m.strings(v, masks[j])
+            }
+            rows[i][j] = v
+        }
+    }
+    result.Rows = rows
+    return result
+}
+
+// fieldMask returns the mask for a field holding a name or an email, or nil
+func (m *Masker) fieldMask(field string) func(string) string {
+    switch normalizeField(field) {
+    case "name":
+        return m.Name
+    case "email":
+        return m.Email
+    }
+    return nil
+}
+
+// strings applies mask to every string in v
+func (m *Masker) strings(v interface{}, mask func(string) string) interface{} {
+    switch v := v.(type) {
+    case string:
+        return mask(v)
+    case []byte:
+        return mask(string(v))
+    case jsonObject:
+        for i := range v {
+            v[i].value = m.strings(v[i].value, mask)
+        }
+    case []interface{}:
+        for i, item := range v {
+            v[i] = m.strings(item, mask)
+        }
+    }
+    return v
+}
+
+// JSON masks a JSON document, keeping the order of its keys. Emails are
+// masked under any key and in free text; names are masked in objects that
+// describe a student, those with an email or age or held under a key such
+// as "student" or "changes". It reports false if body is not valid JSON.
+func (m *Masker) JSON(body []byte) ([]byte, bool) {
+    dec := json.NewDecoder(bytes.NewReader(body))
+    dec.UseNumber()
+    doc, err := decodeOrdered(dec)
+    if err != nil || dec.More() {
+        return nil, false
+    }
+    out, err := json.Marshal(m.value(doc, false))
+    if err != nil {
+        return nil, false
+    }
+    return out, true
+}
+
+func (m *Masker) value(v interface{}, student bool) interface{} {
+    switch v := v.(type) {
+    case jsonObject:
+        student = student || v.has("email") || v.has("age")
+        for i, member := range v {
+            switch key := normalizeField(member.key); {
+            case key == "email" || key == "name" && student:
+                v[i].value = m.strings(member.value, m.fieldMask(key))
+            default:
+                v[i].value = m.value(member.value, student || maskStudentKeys[key])
+            }
+        }
+    case []interface{}:
+        for i, item := range v {
+            v[i] = m.value(item, student)
+        }
+    case string:
+        return m.Text(v)
+    }
+    return v
+}
+
+// jsonObject is a decoded JSON object that keeps the order of its keys
+type jsonObject []jsonMember
+
+type jsonMember struct {
+    key   string
+    value interface{}
+}
+
+func (o jsonObject) has(key string) bool {
+    for _, member := range o {
+        if normalizeField(member.key) == key {
+            return true
+        }
+    }
+    return false
+}
+
+func (o jsonObject) MarshalJSON() ([]byte, error) {
+    buf := []byte{'{'}
+    for i, member := range o {
+        if i > 0 {
+            buf = append(buf, ',')
+        }
+        key, err := json.Marshal(member.key)
+        if err != nil {
+            return nil, err
+        }
+        value, err := json.Marshal(member.value)
+        if err != nil {
+            return nil, err
+        }
+        buf = append(append(append(buf, key...), ':'), value...)
+    }
+    return append(buf, '}'), nil
+}
+
+// decodeOrdered decodes the next JSON value, objects as jsonObject
+func decodeOrdered(dec *json.Decoder) (interface{}, error) {
+    tok, err := dec.Token()
+    if err != nil {
+        return nil, err
+    }
+    switch tok {
+    case json.Delim('{'):
+        obj := jsonObject{}
+        for dec.More() {
+            key, err := dec.Token()
+            if err != nil {
+                return nil, err
+            }
+            value, err := decodeOrdered(dec)
+            if err != nil {
+                return nil, err
+            }
+            obj = append(obj, jsonMember{key: key.(string), value: value})
+        }
+        _, err = dec.Token()
+        return obj, err
+    case json.Delim('['):
+        arr := []interface{}{}
+        for dec.More() {
+            value, err := decodeOrdered(dec)
+            if err != nil {
+                return nil, err
+            }
+            arr = append(arr, value)
+        }
+        _, err = dec.Token()
+        return arr, err
+    }
+    return tok, nil
+}
+
+// Line masks one line of an event stream or NDJSON body
+func (m *Masker) Line(line []byte) []byte {
+    prefix := []byte(nil)
+    if rest, ok := bytes.CutPrefix(line, []byte("data: ")); ok {
+        prefix, line = []byte("data: "), rest
+    }
+    if out, ok := m.JSON(line); ok {
+        return append(prefix, out...)
+    }
+    return append(prefix, m.Text(string(line))...)
+}
+
+// maskResponses masks the personal data of every response when masking is
+// on. Routes that carry no data, such as /healthz and /openapi.json, are
+// left alone.
+func (app *App) maskResponses(next http.Handler) http.Handler {
+    if app.masker == nil {
+        return next
+    }
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if auditExemptRoutes[routeTemplate(r)] {
+            next.ServeHTTP(w, r)
+            return
+        }
+        w.Header().Set(DataMaskedHeader, "true")
+        mw := &maskWriter{ResponseWriter: w, masker: app.masker}
+        next.ServeHTTP(mw, r)
+        mw.finish()
+    })
+}
+
+type maskMode int
+
+const (
+    maskUndecided maskMode = iota
+    // maskDocument holds a JSON body until the handler returns
+    maskDocument
+    // maskLines masks an event stream or NDJSON line by line as it is written
+    maskLines
+    // maskNone passes other bodies through; exports mask at the source
+    maskNone
+)
+
+// maskWriter masks a response on its way out
+type maskWriter struct {
+    http.ResponseWriter
+    masker *Masker
+    mode   maskMode
+    status int
+    buf    bytes.Buffer
+}
+
+func (w *maskWriter) decide() {
+    if w.mode != maskUndecided {
+        return
+    }
+    mediaType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+    switch {
+    case mediaType == "text/event-stream" || mediaType == "application/x-ndjson":
+        w.mode = maskLines
+    case mediaType == "" || mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+        w.mode = maskDocument
+    default:
+        w.mode = maskNone
+    }
+}
+
+func (w *maskWriter) WriteHeader(status int) {
+    w.decide()
+    if w.mode == maskDocument && status >= http.StatusOK {
+        if w.status == 0 {
+            w.status = status
+        }
+        return
+    }
+    w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *maskWriter) Write(b []byte) (int, error) {
+    w.decide()
+    switch w.mode {
+    case maskDocument:
+        return w.buf.Write(b)
+    case maskLines:
+        w.buf.Write(b)
+        for {
+            i := bytes.IndexByte(w.buf.Bytes(), '\n')
+            if i < 0 {
+                return len(b), nil
+            }
+            line := append(w.masker.Line(w.buf.Next(i)), '\n')
+            w.buf.Next(1)
+            if _, err := w.ResponseWriter.Write(line); err != nil {
+                return 0, err
+            }
+        }
+    }
+    return w.ResponseWriter.Write(b)
+}
+
+// FlushError holds back flushes of a JSON body, which is written whole once
+// masked
+func (w *maskWriter) FlushError() error {
+    w.decide()
+    if w.mode == maskDocument {
+        return nil
+    }
+    return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the connection
+func (w *maskWriter) Unwrap() http.ResponseWriter {
+    return w.ResponseWriter
+}
+
+// finish writes what the handler's writes left held back
+func (w *maskWriter) finish() {
+    switch w.mode {
+    case maskDocument:
+        if w.status == 0 && w.buf.Len() == 0 {
+            return
+        }
+        body := w.buf.Bytes()
+        if len(body) > 0 {
+            if out, ok := w.masker.JSON(body); ok {
+                if bytes.HasSuffix(body, []byte("\n")) {
+                    out = append(out, '\n')
+                }
+                body = out
+            } else if strings.HasPrefix(http.DetectContentType(body), "text/") {
+                body = []byte(w.masker.Text(string(body)))
+            }
+        }
+        w.Header().Del("Content-Length")
+        if w.status != 0 {
+            w.ResponseWriter.WriteHeader(w.status)
+        }
+        w.ResponseWriter.Write(body)
+    case maskLines:
+        if w.buf.Len() > 0 {
+            w.ResponseWriter.Write(w.masker.Line(w.buf.Bytes()))
+        }
+    }
+}
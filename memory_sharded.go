@@ -0,0 +1,198 @@
+package main
+
+import (
+    "fmt"
+    "maps"
+    "math/bits"
+    "runtime"
+    "sync"
+    "sync/atomic"
+)
+
+// maxMemoryShards bounds MEMORY_SHARDS; more shards only cost List and Count
+const maxMemoryShards = 1024
+
+// memoryShard is one lock and the students hashed to it
+type memoryShard struct {
+    sync.RWMutex
+    students map[int]Student
+    // pad rounds a shard up to a 64-byte cache line on 64-bit platforms,
+    // so neighbouring shards' locks do not contend for one
+    _ [32]byte
+}
+
+// ShardedMemoryRepository is the memory backend with its students spread
+// over shards by ID hash, each behind its own lock, so reads and writes of
+// different students do not wait for one another. IDs are handed out
+// atomically. List and Count visit the shards one at a time, so they are
+// only consistent across shards when writes are held off, as StudentStore
+// does: its own lock still orders every write to keep history in sequence,
+// and what sharding removes is readers queueing behind those writes.
+type ShardedMemoryRepository struct {
+    shards []memoryShard
+    // shift maps an ID's hash to its shard
+    shift  uint
+    nextID atomic.Int64
+}
+
+// NewShardedMemoryRepository creates a repository with n shards, rounded
+// up to a power of two
+func NewShardedMemoryRepository(n int) *ShardedMemoryRepository {
+    n = max(n, 1)
+    size := 1 << bits.Len(uint(n-1))
+    r := &ShardedMemoryRepository{shards: make([]memoryShard, size), shift: uint(64 - bits.Len(uint(size-1)))}
+    for i := range r.shards {
+        r.shards[i].students = make(map[int]Student)
+    }
+    r.nextID.Store(1)
+    return r
+}
+
+// LoadMemoryRepository reads MEMORY_SHARDS for STORE_BACKEND=memory: 1 keeps
+// the single-lock MemoryRepository, and the default is four shards per CPU
+func LoadMemoryRepository() (StudentRepository, error) {
+    n := getEnvInt("MEMORY_SHARDS", 4*runtime.GOMAXPROCS(0))
+    if n < 1 || n > maxMemoryShards {
+        return nil, fmt.Errorf("MEMORY_SHARDS must be between 1 and %d, got %d", maxMemoryShards, n)
+    }
+    if n == 1 {
+        return NewMemoryRepository(), nil
+    }
+    return NewShardedMemoryRepository(n), nil
+}
+
+// shard returns the shard of an ID. IDs are sequential, so they are
+// spread by Fibonacci hashing rather than taken modulo the shard count.
+func (r *ShardedMemoryRepository) shard(id int) *memoryShard {
+    if r.shift == 64 {
+        return &r.shards[0]
+    }
+    return &r.shards[(uint64(id)*0x9E3779B97F4A7C15)>>r.shift]
+}
+
+// reserveID makes sure an explicitly given ID is never handed out again
+func (r *ShardedMemoryRepository) reserveID(id int) {
+    for {
+        next := r.nextID.Load()
+        if int64(id) < next || r.nextID.CompareAndSwap(next, int64(id)+1) {
+            return
+        }
+    }
+}
+
+// Create stores a student, under its own ID if it has one
+func (r *ShardedMemoryRepository) Create(student Student) (Student, error) {
+    if student.ID == 0 {
+        student.ID = int(r.nextID.Add(1) - 1)
+    }
+    s := r.shard(student.ID)
+    s.Lock()
+    defer s.Unlock()
+    if _, exists := s.students[student.ID]; exists {
+        return Student{}, fmt.Errorf("student %d already exists", student.ID)
+    }
+    r.reserveID(student.ID)
+    s.students[student.ID] = student
+    return student, nil
+}
+
+// Get returns a student by ID
+func (r *ShardedMemoryRepository) Get(id int) (Student, error) {
+    s := r.shard(id)
+    s.RLock()
+    student, exists := s.students[id]
+    s.RUnlock()
+    if !exists {
+        return Student{}, errStudentNotFound
+    }
+    return student, nil
+}
+
+// List returns the students selected by opts, in opts.Sort order
+func (r *ShardedMemoryRepository) List(opts ListOptions) ([]Student, error) {
+    var students []Student
+    for i := range r.shards {
+        s := &r.shards[i]
+        s.RLock()
+        for _, student := range s.students {
+            if opts.Filter.Match(student) {
+                students = append(students, student)
+            }
+        }
+        s.RUnlock()
+    }
+    if students == nil {
+        students = make([]Student, 0)
+    }
+    sortStudents(students, opts.Sort)
+    if opts.Limit > 0 {
+        start := min(opts.Offset, len(students))
+        students = students[start:min(start+opts.Limit, len(students))]
+    }
+    return students, nil
+}
+
+// Count returns how many students match the filter
+func (r *ShardedMemoryRepository) Count(f *Filter) (int, error) {
+    n := 0
+    for i := range r.shards {
+        s := &r.shards[i]
+        s.RLock()
+        for _, student := range s.students {
+            if f.Match(student) {
+                n++
+            }
+        }
+        s.RUnlock()
+    }
+    return n, nil
+}
+
+// Update overwrites an existing student
+func (r *ShardedMemoryRepository) Update(student Student) (Student, error) {
+    s := r.shard(student.ID)
+    s.Lock()
+    defer s.Unlock()
+    if _, exists := s.students[student.ID]; !exists {
+        return Student{}, errStudentNotFound
+    }
+    s.students[student.ID] = student
+    return student, nil
+}
+
+// Delete removes a student
+func (r *ShardedMemoryRepository) Delete(id int) error {
+    s := r.shard(id)
+    s.Lock()
+    defer s.Unlock()
+    if _, exists := s.students[id]; !exists {
+        return errStudentNotFound
+    }
+    delete(s.students, id)
+    return nil
+}
+
+// Transaction runs fn against the repository, restoring every shard's
+// previous contents when fn fails. Like MemoryRepository's, it relies on
+// the caller to keep other writers out meanwhile.
+func (r *ShardedMemoryRepository) Transaction(fn func(tx StudentRepository) error) error {
+    saved := make([]map[int]Student, len(r.shards))
+    for i := range r.shards {
+        s := &r.shards[i]
+        s.RLock()
+        saved[i] = maps.Clone(s.students)
+        s.RUnlock()
+    }
+    nextID := r.nextID.Load()
+    if err := fn(r); err != nil {
+        for i := range r.shards {
+            s := &r.shards[i]
+            s.Lock()
+            s.students = saved[i]
+            s.Unlock()
+        }
+        r.nextID.Store(nextID)
+        return err
+    }
+    return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "github.com/gorilla/mux"
+)
+
+// Metrics is a minimal registry of counters and gauges exposed in the
+// Prometheus text format at GET /metrics
+type Metrics struct {
+    mu       sync.Mutex
+    counters map[string]map[string]float64 // name -> labels -> value
+    gauges   map[string]map[string]float64
+}
+
+// NewMetrics initializes a new Metrics registry
+func NewMetrics() *Metrics {
+    return &Metrics{counters: make(map[string]map[string]float64), gauges: make(map[string]map[string]float64)}
+}
+
+// Inc adds one to a counter. Labels are given as name/value pairs.
+func (m *Metrics) Inc(name string, labels ...string) {
+    m.Add(name, 1, labels...)
+}
+
+// Add adds value to a counter. Labels are given as name/value pairs.
+func (m *Metrics) Add(name string, value float64, labels ...string) {
+    series := metricSeries(labels)
+
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if m.counters[name] == nil {
+        m.counters[name] = make(map[string]float64)
+    }
+    m.counters[name][series] += value
+}
+
+// Set sets a gauge. Labels are given as name/value pairs.
+func (m *Metrics) Set(name string, value float64, labels ...string) {
+    series := metricSeries(labels)
+
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if m.gauges[name] == nil {
+        m.gauges[name] = make(map[string]float64)
+    }
+    m.gauges[name][series] = value
+}
+
+// metricSeries renders label pairs as a Prometheus series suffix
+func metricSeries(labels []string) string {
+    var parts []string
+    for i := 0; i+1 < len(labels); i += 2 {
+        label := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+        parts = append(parts, fmt.Sprintf(`%s="%s"`, labels[i], label))
+    }
+    if len(parts) == 0 {
+        return ""
+    }
+    return "{" + strings.Join(parts, ",") + "}"
+}
+
+// ServeHTTP writes every counter and gauge, sorted by name and labels
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+    writeMetricFamily(w, "counter", m.counters)
+    writeMetricFamily(w, "gauge", m.gauges)
+}
+
+func writeMetricFamily(w io.Writer, kind string, family map[string]map[string]float64) {
+    names := make([]string, 0, len(family))
+    for name := range family {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    for _, name := range names {
+        fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+        series := make([]string, 0, len(family[name]))
+        for s := range family[name] {
+            series = append(series, s)
+        }
+        sort.Strings(series)
+        for _, s := range series {
+            fmt.Fprintf(w, "%s%s %g\n", name, s, family[name][s])
+        }
+    }
+}
+
+// requestMetrics counts routed requests by method, route template and
+// status, and sums their durations by route
+func (app *App) requestMetrics(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        route, _ := mux.CurrentRoute(r).GetPathTemplate()
+        start := time.Now()
+        rec := &logRecorder{ResponseWriter: w}
+        next.ServeHTTP(rec, r)
+        if rec.status == 0 {
+            rec.status = http.StatusOK
+        }
+        app.metrics.Inc("http_requests_total", "method", r.Method, "route", route, "status", strconv.Itoa(rec.status))
+        app.metrics.Add("http_request_duration_seconds_sum", time.Since(start).Seconds(), "route", route)
+        app.metrics.Inc("http_request_duration_seconds_count", "route", route)
+    })
+}
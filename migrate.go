@@ -0,0 +1,97 @@
+package main
+
+import (
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "io"
+    "student-api/migrations"
+)
+
+// openMigrator opens the STORE_BACKEND database with the migrations for its
+// dialect; the caller closes the returned database
+func openMigrator() (*migrations.Migrator, *sql.DB, error) {
+    var db *sql.DB
+    var err error
+    var list []migrations.Migration
+    var rebind func(string) string
+    switch backend := getEnv("STORE_BACKEND", BackendSQLite); backend {
+    case BackendSQLite:
+        db, err = sql.Open("sqlite3", sqliteDSN(getEnv("DATABASE_PATH", defaultDatabasePath)))
+        list = sqliteMigrations
+    case BackendPostgres:
+        db, err = openPostgres()
+        list, rebind = postgresMigrations, rebindPostgres
+    case BackendMySQL:
+        db, err = openMySQL()
+        list = mysqlMigrations
+    default:
+        return nil, nil, fmt.Errorf("store backend %q has no schema to migrate", backend)
+    }
+    if err != nil {
+        return nil, nil, err
+    }
+    m, err := migrations.New(db, list, rebind)
+    if err != nil {
+        db.Close()
+        return nil, nil, err
+    }
+    return m, db, nil
+}
+
+// runMigrateCommand handles --migrate: "status" lists every migration, "up"
+// applies pending ones and "down" reverts the latest. It prints the
+// resulting status as JSON and returns the process exit code.
+func runMigrateCommand(out io.Writer, command string) int {
+    m, db, err := openMigrator()
+    if err != nil {
+        fmt.Fprintln(out, err)
+        return 1
+    }
+    defer db.Close()
+    // Running instances migrate at startup too, under the same lock
+    locker := NewLocker(getEnv("STORE_BACKEND", BackendSQLite), db, getEnv("DATABASE_PATH", defaultDatabasePath))
+
+    switch command {
+    case "status":
+    case "up":
+        var n int
+        err := withLock(locker, lockMigrations, migrationLockTimeout, func() (err error) {
+            n, err = m.Up()
+            return err
+        })
+        fmt.Fprintf(out, "applied %d migrations\n", n)
+        if err != nil {
+            fmt.Fprintln(out, err)
+            return 1
+        }
+    case "down":
+        var mig *migrations.Migration
+        err := withLock(locker, lockMigrations, migrationLockTimeout, func() (err error) {
+            mig, err = m.Down()
+            return err
+        })
+        if err != nil {
+            fmt.Fprintln(out, err)
+            return 1
+        }
+        if mig == nil {
+            fmt.Fprintln(out, "no migrations to revert")
+        } else {
+            fmt.Fprintf(out, "reverted migration %d %s\n", mig.Version, mig.Name)
+        }
+    default:
+        fmt.Fprintf(out, "unknown migrate command %q; use status, up or down\n", command)
+        return 2
+    }
+
+    statuses, err := m.Status()
+    if err != nil {
+        fmt.Fprintln(out, err)
+        return 1
+    }
+    enc := json.NewEncoder(out)
+    enc.SetIndent("", "  ")
+    enc.Encode(statuses)
+    return 0
+}
@@ -0,0 +1,189 @@
+// Package migrations applies versioned schema changes to a database/sql
+// database, recording each applied version in a schema_migrations table so
+// every startup brings the schema up to date and changes can be rolled back.
+package migrations
+
+import (
+    "database/sql"
+    "fmt"
+    "sort"
+    "time"
+)
+
+// Migration is one schema change. Up applies it and Down reverts it; both
+// run inside a transaction together with the bookkeeping row.
+type Migration struct {
+    Version int
+    Name    string
+    Up      func(tx *sql.Tx) error
+    Down    func(tx *sql.Tx) error
+}
+
+// Exec returns a migration step running the statements in order
+func Exec(statements ...string) func(tx *sql.Tx) error {
+    return func(tx *sql.Tx) error {
+        for _, stmt := range statements {
+            if _, err := tx.Exec(stmt); err != nil {
+                return err
+            }
+        }
+        return nil
+    }
+}
+
+// Status is a migration and whether it has been applied
+type Status struct {
+    Version   int        `json:"version"`
+    Name      string     `json:"name"`
+    AppliedAt *time.Time `json:"applied_at,omitempty"`
+}
+
+// Migrator runs a set of migrations against one database
+type Migrator struct {
+    db         *sql.DB
+    migrations []Migration
+    // rebind rewrites "?" placeholders for drivers that number them
+    rebind func(string) string
+}
+
+// New returns a migrator for db. rebind may be nil when the driver accepts
+// "?" placeholders.
+func New(db *sql.DB, migrations []Migration, rebind func(string) string) (*Migrator, error) {
+    sorted := append([]Migration(nil), migrations...)
+    sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+    for i, m := range sorted {
+        if m.Version < 1 || m.Up == nil {
+            return nil, fmt.Errorf("migration %d %q: needs a positive version and an Up step", m.Version, m.Name)
+        }
+        if i > 0 && sorted[i-1].Version == m.Version {
+            return nil, fmt.Errorf("migration version %d is used twice", m.Version)
+        }
+    }
+    if rebind == nil {
+        rebind = func(query string) string { return query }
+    }
+    return &Migrator{db: db, migrations: sorted, rebind: rebind}, nil
+}
+
+func (m *Migrator) ensureTable() error {
+    _, err := m.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+        version BIGINT PRIMARY KEY,
+        name VARCHAR(255) NOT NULL,
+        applied_at VARCHAR(64) NOT NULL
+    )`)
+    return err
+}
+
+// applied returns the applied versions and when they were applied
+func (m *Migrator) applied() (map[int]time.Time, error) {
+    if err := m.ensureTable(); err != nil {
+        return nil, err
+    }
+    rows, err := m.db.Query(`SELECT version, applied_at FROM schema_migrations`)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    versions := make(map[int]time.Time)
+    for rows.Next() {
+        var version int
+        var at string
+        if err := rows.Scan(&version, &at); err != nil {
+            return nil, err
+        }
+        versions[version], _ = time.Parse(time.RFC3339Nano, at)
+    }
+    return versions, rows.Err()
+}
+
+// Status lists every known migration in version order
+func (m *Migrator) Status() ([]Status, error) {
+    applied, err := m.applied()
+    if err != nil {
+        return nil, err
+    }
+    statuses := make([]Status, 0, len(m.migrations))
+    for _, mig := range m.migrations {
+        status := Status{Version: mig.Version, Name: mig.Name}
+        if at, ok := applied[mig.Version]; ok {
+            status.AppliedAt = &at
+        }
+        statuses = append(statuses, status)
+    }
+    return statuses, nil
+}
+
+// Pending returns the migrations that have not been applied yet
+func (m *Migrator) Pending() ([]Migration, error) {
+    applied, err := m.applied()
+    if err != nil {
+        return nil, err
+    }
+    var pending []Migration
+    for _, mig := range m.migrations {
+        if _, ok := applied[mig.Version]; !ok {
+            pending = append(pending, mig)
+        }
+    }
+    return pending, nil
+}
+
+// Up applies every pending migration in version order and returns how many ran
+func (m *Migrator) Up() (int, error) {
+    pending, err := m.Pending()
+    if err != nil {
+        return 0, err
+    }
+    for i, mig := range pending {
+        err := m.run(mig, mig.Up, func(tx *sql.Tx) error {
+            _, err := tx.Exec(m.rebind(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`),
+                mig.Version, mig.Name, time.Now().UTC().Format(time.RFC3339Nano))
+            return err
+        })
+        if err != nil {
+            return i, err
+        }
+    }
+    return len(pending), nil
+}
+
+// Down reverts the latest applied migration, returning it, or nil when none
+// is applied
+func (m *Migrator) Down() (*Migration, error) {
+    applied, err := m.applied()
+    if err != nil {
+        return nil, err
+    }
+    for i := len(m.migrations) - 1; i >= 0; i-- {
+        mig := m.migrations[i]
+        if _, ok := applied[mig.Version]; !ok {
+            continue
+        }
+        if mig.Down == nil {
+            return nil, fmt.Errorf("migration %d %q cannot be reverted", mig.Version, mig.Name)
+        }
+        err := m.run(mig, mig.Down, func(tx *sql.Tx) error {
+            _, err := tx.Exec(m.rebind(`DELETE FROM schema_migrations WHERE version = ?`), mig.Version)
+            return err
+        })
+        return &mig, err
+    }
+    return nil, nil
+}
+
+// run executes a migration step and its bookkeeping in one transaction
+func (m *Migrator) run(mig Migration, step, record func(tx *sql.Tx) error) error {
+    tx, err := m.db.Begin()
+    if err != nil {
+        return err
+    }
+    if err := step(tx); err != nil {
+        tx.Rollback()
+        return fmt.Errorf("migration %d %q: %v", mig.Version, mig.Name, err)
+    }
+    if err := record(tx); err != nil {
+        tx.Rollback()
+        return fmt.Errorf("migration %d %q: %v", mig.Version, mig.Name, err)
+    }
+    return tx.Commit()
+}
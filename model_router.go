@@ -0,0 +1,245 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "student-api/reqctx"
+)
+
+// LLM tasks a route can be configured for
+const (
+    TaskSummary      = "summary"
+    TaskAutocomplete = "autocomplete"
+    TaskTranscript   = "transcript"
+)
+
+var llmTasks = map[string]bool{TaskSummary: true, TaskAutocomplete: true, TaskTranscript: true}
+
+// textGenerator is what generateStructured needs from a model
+type textGenerator interface {
+    Generate(ctx context.Context, prompt string, format json.RawMessage) (*OllamaResponse, error)
+}
+
+// modelUnavailable reports whether err means the model cannot serve right
+// now (missing, overloaded or the server unreachable), so the next model in
+// the route should be tried. Cancellation and bad output are not retried.
+func modelUnavailable(err error) bool {
+    var statusErr *ollamaStatusError
+    if errors.As(err, &statusErr) {
+        return statusErr.code == http.StatusNotFound || statusErr.code >= 500
+    }
+    var netErr net.Error
+    return errors.As(err, &netErr) && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// ModelRouter sends each LLM task to an ordered list of models, falling back
+// to the next one when a model is unavailable and, with an LLMHedge, racing
+// a slow call against a second one. Models with a concurrency limit queue
+// callers beyond it, and every call then waits its turn in the shared LLM
+// queue.
+type ModelRouter struct {
+    base    *OllamaClient
+    routes  map[string][]string
+    limits  map[string]chan struct{}
+    queue   *LLMQueue
+    hedge   *LLMHedge
+    metrics *Metrics
+}
+
+// ParseModelRoutes parses a routing table such as
+// "summary=llama3:8b|llama2,autocomplete=phi3:mini"; models after the first
+// are fallbacks. Tasks without a route use the default model.
+func ParseModelRoutes(spec string) (map[string][]string, error) {
+    routes := make(map[string][]string)
+    for _, part := range strings.Split(spec, ",") {
+        part = strings.TrimSpace(part)
+        if part == "" {
+            continue
+        }
+        task, models, found := strings.Cut(part, "=")
+        task = strings.TrimSpace(task)
+        if !found {
+            return nil, fmt.Errorf("model route %q: expected task=model", part)
+        }
+        if !llmTasks[task] {
+            return nil, fmt.Errorf("model route %q: unknown task %q", part, task)
+        }
+        var list []string
+        for _, m := range strings.Split(models, "|") {
+            if m = strings.TrimSpace(m); m != "" {
+                list = append(list, m)
+            }
+        }
+        if len(list) == 0 {
+            return nil, fmt.Errorf("model route %q: no models", part)
+        }
+        routes[task] = list
+    }
+    return routes, nil
+}
+
+// ParseModelLimits parses per-model concurrency limits such as
+// "llama3:70b=1,phi3:mini=8". Models without a limit are not queued.
+func ParseModelLimits(spec string) (map[string]int, error) {
+    limits := make(map[string]int)
+    for _, part := range strings.Split(spec, ",") {
+        part = strings.TrimSpace(part)
+        if part == "" {
+            continue
+        }
+        idx := strings.LastIndex(part, "=")
+        if idx < 0 {
+            return nil, fmt.Errorf("model limit %q: expected model=n", part)
+        }
+        n, err := strconv.Atoi(part[idx+1:])
+        if err != nil || n < 1 {
+            return nil, fmt.Errorf("model limit %q: limit must be a positive integer", part)
+        }
+        limits[strings.TrimSpace(part[:idx])] = n
+    }
+    return limits, nil
+}
+
+// NewModelRouter routes tasks through base, whose model is the default;
+// hedge may be nil
+func NewModelRouter(base *OllamaClient, routes map[string][]string, limits map[string]int, queue *LLMQueue, hedge *LLMHedge, metrics *Metrics) *ModelRouter {
+    r := &ModelRouter{base: base, routes: routes, limits: make(map[string]chan struct{}), queue: queue, hedge: hedge, metrics: metrics}
+    for model, n := range limits {
+        r.limits[model] = make(chan struct{}, n)
+    }
+    return r
+}
+
+// LoadModelRouter reads OLLAMA_ROUTES and OLLAMA_MODEL_CONCURRENCY, and the
+// LLM queue and hedging settings
+func LoadModelRouter(base *OllamaClient, metrics *Metrics) (*ModelRouter, error) {
+    routes, err := ParseModelRoutes(getEnv("OLLAMA_ROUTES", ""))
+    if err != nil {
+        return nil, err
+    }
+    limits, err := ParseModelLimits(getEnv("OLLAMA_MODEL_CONCURRENCY", ""))
+    if err != nil {
+        return nil, err
+    }
+    queue, err := LoadLLMQueue(metrics)
+    if err != nil {
+        return nil, err
+    }
+    hedge, err := LoadLLMHedge()
+    if err != nil {
+        return nil, err
+    }
+    return NewModelRouter(base, routes, limits, queue, hedge, metrics), nil
+}
+
+// Models returns the models tried for task, in order
+func (r *ModelRouter) Models(task string) []string {
+    if models := r.routes[task]; len(models) > 0 {
+        return models
+    }
+    return []string{r.base.Model()}
+}
+
+// Primary returns the first model routed for task
+func (r *ModelRouter) Primary(task string) string {
+    return r.Models(task)[0]
+}
+
+// acquire waits for a slot on model, returning the release function
+func (r *ModelRouter) acquire(ctx context.Context, model string) (func(), error) {
+    sem := r.limits[model]
+    if sem == nil {
+        return func() {}, nil
+    }
+    select {
+    case sem <- struct{}{}:
+        return func() { <-sem }, nil
+    case <-ctx.Done():
+        return nil, ctx.Err()
+    }
+}
+
+// For returns a generator for task. It sticks to the first model that
+// answers, hedge included, so follow-up prompts (e.g. schema repairs) see
+// the same model.
+func (r *ModelRouter) For(task string) *RoutedGenerator {
+    return &RoutedGenerator{router: r, task: task, models: r.Models(task)}
+}
+
+// RoutedGenerator runs one task's prompts through its route
+type RoutedGenerator struct {
+    router *ModelRouter
+    task   string
+    models []string
+    // answered is the client that answered first, used from then on
+    answered *OllamaClient
+}
+
+// Model returns the model that answered, or the primary before any call
+func (g *RoutedGenerator) Model() string {
+    if g.answered != nil {
+        return g.answered.Model()
+    }
+    return g.models[0]
+}
+
+// Generate tries each model in turn until one is available
+func (g *RoutedGenerator) Generate(ctx context.Context, prompt string, format json.RawMessage) (*OllamaResponse, error) {
+    if g.answered != nil {
+        return g.router.generateWith(ctx, g.task, g.answered, prompt, format)
+    }
+    var lastErr error
+    for i, model := range g.models {
+        next := ""
+        if i+1 < len(g.models) {
+            next = g.models[i+1]
+        }
+        resp, client, err := g.router.generateHedged(ctx, g.task, model, next, prompt, format)
+        if err == nil {
+            g.answered = client
+            return resp, nil
+        }
+        lastErr = err
+        if !modelUnavailable(err) || i == len(g.models)-1 {
+            break
+        }
+        reqctx.Logger(ctx).Warn("model unavailable, falling back", "task", g.task, "model", model, "fallback", g.models[i+1], "error", err)
+        g.router.metrics.Inc("llm_fallbacks_total", "task", g.task, "model", model)
+    }
+    return nil, lastErr
+}
+
+// generateWith runs one call on client, within its model's concurrency
+// limit when it is on the base server
+func (r *ModelRouter) generateWith(ctx context.Context, task string, client *OllamaClient, prompt string, format json.RawMessage) (*OllamaResponse, error) {
+    model := client.Model()
+    if client.baseURL == r.base.baseURL {
+        release, err := r.acquire(ctx, model)
+        if err != nil {
+            return nil, err
+        }
+        defer release()
+    }
+    dequeue, err := r.queue.Acquire(ctx)
+    if err != nil {
+        return nil, err
+    }
+    defer dequeue()
+
+    resp, err := client.Generate(ctx, prompt, format)
+    outcome := "ok"
+    switch {
+    case errors.Is(err, context.Canceled):
+        outcome = "canceled"
+    case err != nil:
+        outcome = "error"
+    }
+    r.metrics.Inc("llm_requests_total", "task", task, "model", model, "outcome", outcome)
+    return resp, err
+}
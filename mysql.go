@@ -0,0 +1,502 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "fmt"
+    "log/slog"
+    "strings"
+    "time"
+    "github.com/go-sql-driver/mysql"
+    "student-api/migrations"
+)
+
+// BackendMySQL keeps students in the MySQL or MariaDB database at DB_DSN
+const BackendMySQL = "mysql"
+
+// openMySQL opens DB_DSN (user:pass@tcp(host:3306)/dbname) with the
+// configured pool settings. Timestamps are exchanged as UTC time.Time values
+// whatever the DSN says. Until the server answers, connecting is retried
+// every DB_CONNECT_RETRY_INTERVAL for up to DB_CONNECT_TIMEOUT, so the API
+// can start alongside its database.
+func openMySQL() (*sql.DB, error) {
+    return openMySQLFrom("DB_DSN")
+}
+
+// openMySQLFrom opens the DSN in the named setting, as openMySQL does
+func openMySQLFrom(setting string) (*sql.DB, error) {
+    dsn := getEnv(setting, "")
+    if dsn == "" {
+        return nil, fmt.Errorf("%s is required for the mysql backend", setting)
+    }
+    cfg, err := mysql.ParseDSN(dsn)
+    if err != nil {
+        return nil, err
+    }
+    cfg.ParseTime = true
+    cfg.Loc = time.UTC
+    // Report matched rather than changed rows, so rewriting identical values
+    // is not mistaken for a missing student
+    cfg.ClientFoundRows = true
+    connector, err := mysql.NewConnector(cfg)
+    if err != nil {
+        return nil, err
+    }
+    db := sql.OpenDB(connector)
+    configurePool(db)
+
+    timeout := getEnvDuration("DB_CONNECT_TIMEOUT", time.Minute)
+    interval := getEnvDuration("DB_CONNECT_RETRY_INTERVAL", 2*time.Second)
+    deadline := time.Now().Add(timeout)
+    for attempt := 1; ; attempt++ {
+        ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+        err = db.PingContext(ctx)
+        cancel()
+        if err == nil {
+            return db, nil
+        }
+        if time.Now().Add(interval).After(deadline) {
+            db.Close()
+            return nil, fmt.Errorf("mysql unreachable after %d attempts: %v", attempt, err)
+        }
+        slog.Warn("mysql not ready; retrying", "attempt", attempt, "retry_in", interval, "error", err)
+        time.Sleep(interval)
+    }
+}
+
+// mysqlMigrations are the MySQL and MariaDB schema versions. Text columns
+// use a binary collation so equality is exact, as it is in SQLite.
+var mysqlMigrations = []migrations.Migration{
+    {
+        Version: 1,
+        Name:    "create_students",
+        Up: migrations.Exec(`CREATE TABLE IF NOT EXISTS students (
+            id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+            name VARCHAR(255) COLLATE utf8mb4_bin,
+            age INT,
+            email VARCHAR(320) COLLATE utf8mb4_bin
+        ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`),
+        Down: migrations.Exec(`DROP TABLE students`),
+    },
+    {
+        Version: 2,
+        Name:    "add_students_updated_at",
+        Up: func(tx *sql.Tx) error {
+            // MySQL, unlike MariaDB, has no ADD COLUMN IF NOT EXISTS
+            var exists int
+            err := tx.QueryRow(`SELECT COUNT(*) FROM information_schema.columns
+                WHERE table_schema = DATABASE() AND table_name = 'students' AND column_name = 'updated_at'`).Scan(&exists)
+            if err != nil || exists > 0 {
+                return err
+            }
+            _, err = tx.Exec(`ALTER TABLE students ADD COLUMN updated_at DATETIME(6) NULL`)
+            return err
+        },
+        Down: migrations.Exec(`ALTER TABLE students DROP COLUMN updated_at`),
+    },
+    {
+        Version: 3,
+        Name:    "create_api_keys",
+        Up: migrations.Exec(`CREATE TABLE api_keys (
+            id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+            name VARCHAR(255) COLLATE utf8mb4_bin NOT NULL,
+            prefix VARCHAR(32) NOT NULL,
+            hash CHAR(64) NOT NULL UNIQUE,
+            rate_limit INT NOT NULL,
+            created_at VARCHAR(64) NOT NULL,
+            last_used_at VARCHAR(64) NULL,
+            revoked_at VARCHAR(64) NULL
+        ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`),
+        Down: migrations.Exec(`DROP TABLE api_keys`),
+    },
+    {
+        Version: 4,
+        Name:    "create_audit_log",
+        Up: migrations.Exec(`CREATE TABLE audit_log (
+            id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+            at VARCHAR(64) NOT NULL,
+            request_id VARCHAR(64) NOT NULL,
+            actor VARCHAR(255) NOT NULL,
+            tenant VARCHAR(255) NOT NULL,
+            action VARCHAR(16) NOT NULL,
+            method VARCHAR(16) NOT NULL,
+            route VARCHAR(255) NOT NULL,
+            path VARCHAR(2048) NOT NULL,
+            status INT NOT NULL,
+            source VARCHAR(64) NOT NULL
+        ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`),
+        Down: migrations.Exec(`DROP TABLE audit_log`),
+    },
+    {
+        Version: 5,
+        Name:    "create_access_log",
+        Up: migrations.Exec(`CREATE TABLE access_log (
+            id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+            at VARCHAR(64) NOT NULL,
+            tenant VARCHAR(255) NOT NULL,
+            student_id BIGINT NOT NULL,
+            actor VARCHAR(255) NOT NULL,
+            request_id VARCHAR(64) NOT NULL,
+            route VARCHAR(255) NOT NULL,
+            fields VARCHAR(255) NOT NULL
+        ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`, `CREATE INDEX access_log_student ON access_log (tenant, student_id, id)`),
+        Down: migrations.Exec(`DROP TABLE access_log`),
+    },
+    {
+        Version: 6,
+        Name:    "add_api_keys_role",
+        Up:      migrations.Exec(`ALTER TABLE api_keys ADD COLUMN role VARCHAR(16) NOT NULL DEFAULT 'teacher'`),
+        Down:    migrations.Exec(`ALTER TABLE api_keys DROP COLUMN role`),
+    },
+    {
+        Version: 7,
+        Name:    "create_honeypots",
+        Up: migrations.Exec(`CREATE TABLE honeypots (
+            tenant VARCHAR(255) NOT NULL,
+            student_id BIGINT NOT NULL,
+            label VARCHAR(255) NOT NULL,
+            created_at VARCHAR(64) NOT NULL,
+            PRIMARY KEY (tenant, student_id)
+        ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`, `ALTER TABLE audit_log ADD COLUMN honeypot VARCHAR(1024) NOT NULL DEFAULT ''`),
+        Down: migrations.Exec(`ALTER TABLE audit_log DROP COLUMN honeypot`, `DROP TABLE honeypots`),
+    },
+    {
+        Version: 8,
+        Name:    "create_users",
+        Up: migrations.Exec(`CREATE TABLE users (
+            id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+            username VARCHAR(255) COLLATE utf8mb4_bin NOT NULL UNIQUE,
+            email VARCHAR(255) NOT NULL UNIQUE,
+            password_hash VARCHAR(255) NOT NULL,
+            role VARCHAR(32) NOT NULL,
+            failed_logins INT NOT NULL DEFAULT 0,
+            locked_until VARCHAR(64) NULL,
+            password_changed_at VARCHAR(64) NOT NULL,
+            created_at VARCHAR(64) NOT NULL
+        ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`, `CREATE TABLE password_resets (
+            token_hash CHAR(64) NOT NULL PRIMARY KEY,
+            user_id BIGINT NOT NULL,
+            expires_at VARCHAR(64) NOT NULL,
+            used_at VARCHAR(64) NULL,
+            FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+        ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`),
+        Down: migrations.Exec(`DROP TABLE password_resets`, `DROP TABLE users`),
+    },
+    {
+        Version: 9,
+        Name:    "create_registrations",
+        Up: migrations.Exec(`CREATE TABLE registrations (
+            id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+            tenant VARCHAR(64) NOT NULL,
+            name VARCHAR(255) NOT NULL,
+            age INT NOT NULL,
+            email VARCHAR(255) NOT NULL,
+            status VARCHAR(16) NOT NULL,
+            token_hash VARCHAR(64) NOT NULL,
+            token_expires_at VARCHAR(64) NOT NULL,
+            created_at VARCHAR(64) NOT NULL,
+            verified_at VARCHAR(64) NULL,
+            decided_at VARCHAR(64) NULL,
+            decided_by VARCHAR(255) NOT NULL,
+            reason VARCHAR(1024) NOT NULL,
+            student_id BIGINT NOT NULL,
+            INDEX registrations_status (tenant, status, id),
+            INDEX registrations_token (token_hash)
+        ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`),
+        Down: migrations.Exec(`DROP TABLE registrations`),
+    },
+    {
+        Version: 10,
+        Name:    "create_invitations",
+        Up: migrations.Exec(`CREATE TABLE invitations (
+            id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+            tenant VARCHAR(64) NOT NULL,
+            token_hash CHAR(64) NOT NULL UNIQUE,
+            name VARCHAR(255) NOT NULL,
+            age INT NOT NULL,
+            email VARCHAR(255) NOT NULL,
+            status VARCHAR(16) NOT NULL,
+            created_by VARCHAR(255) NOT NULL,
+            created_at VARCHAR(64) NOT NULL,
+            expires_at VARCHAR(64) NOT NULL,
+            redeemed_at VARCHAR(64) NULL,
+            revoked_at VARCHAR(64) NULL,
+            revoked_by VARCHAR(255) NOT NULL,
+            student_id BIGINT NOT NULL,
+            username VARCHAR(64) NOT NULL,
+            INDEX invitations_tenant (tenant, id)
+        ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`),
+        Down: migrations.Exec(`DROP TABLE invitations`),
+    },
+    {
+        Version: 11,
+        Name:    "create_summary_templates",
+        Up: migrations.Exec(`CREATE TABLE summary_templates (
+            tenant VARCHAR(64) NOT NULL PRIMARY KEY,
+            prompt TEXT NOT NULL,
+            fields VARCHAR(255) NOT NULL,
+            tone VARCHAR(64) NOT NULL,
+            language VARCHAR(64) NOT NULL,
+            version INT NOT NULL,
+            updated_at VARCHAR(64) NOT NULL,
+            updated_by VARCHAR(255) NOT NULL
+        ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`),
+        Down: migrations.Exec(`DROP TABLE summary_templates`),
+    },
+    {
+        Version: 12,
+        Name:    "create_webhooks",
+        Up: migrations.Exec(`CREATE TABLE webhooks (
+            id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+            tenant VARCHAR(64) NOT NULL,
+            url VARCHAR(2048) NOT NULL,
+            secret VARCHAR(255) NOT NULL,
+            types VARCHAR(255) NOT NULL,
+            fields VARCHAR(255) NOT NULL,
+            created_by VARCHAR(255) NOT NULL,
+            created_at VARCHAR(64) NOT NULL
+        ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`, `CREATE TABLE webhook_deliveries (
+            id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+            tenant VARCHAR(64) NOT NULL,
+            webhook_id BIGINT NOT NULL,
+            payload MEDIUMTEXT NOT NULL,
+            status VARCHAR(16) NOT NULL,
+            attempts INT NOT NULL,
+            last_status INT NOT NULL,
+            last_error TEXT NOT NULL,
+            created_at VARCHAR(64) NOT NULL,
+            updated_at VARCHAR(64) NOT NULL,
+            delivered_at VARCHAR(64) NULL,
+            INDEX webhook_deliveries_tenant (tenant, status, created_at),
+            INDEX webhook_deliveries_status (status, updated_at)
+        ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`),
+        Down: migrations.Exec(`DROP TABLE webhook_deliveries`, `DROP TABLE webhooks`),
+    },
+    {
+        Version: 13,
+        Name:    "create_event_outbox",
+        Up: migrations.Exec(`CREATE TABLE event_outbox (
+            id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+            tenant VARCHAR(64) NOT NULL,
+            payload MEDIUMTEXT NOT NULL,
+            created_at VARCHAR(64) NOT NULL,
+            published_at VARCHAR(64) NULL,
+            INDEX event_outbox_published (published_at, id)
+        ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`),
+        Down: migrations.Exec(`DROP TABLE event_outbox`),
+    },
+    {
+        Version: 14,
+        Name:    "add_students_deleted_at",
+        Up:      migrations.Exec(`ALTER TABLE students ADD COLUMN deleted_at DATETIME(6) NULL`, `CREATE INDEX students_deleted_at ON students (deleted_at)`),
+        Down:    migrations.Exec(`DROP INDEX students_deleted_at ON students`, `ALTER TABLE students DROP COLUMN deleted_at`),
+    },
+    {
+        Version: 15,
+        Name:    "add_audit_log_changes",
+        Up: migrations.Exec(`ALTER TABLE audit_log ADD COLUMN student_id BIGINT NULL`, `ALTER TABLE audit_log ADD COLUMN changes TEXT NULL`,
+            `CREATE INDEX audit_log_student ON audit_log (tenant, student_id, id)`),
+        Down: migrations.Exec(`DROP INDEX audit_log_student ON audit_log`, `ALTER TABLE audit_log DROP COLUMN changes`, `ALTER TABLE audit_log DROP COLUMN student_id`),
+    },
+    {
+        Version: 16,
+        Name:    "create_student_history",
+        Up: migrations.Exec(`CREATE TABLE student_history (
+            seq BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+            student_id BIGINT NOT NULL,
+            version INT NOT NULL,
+            operation VARCHAR(16) NOT NULL,
+            student TEXT NOT NULL,
+            changes TEXT NULL,
+            at VARCHAR(64) NOT NULL,
+            UNIQUE KEY student_history_version (student_id, version)
+        ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`),
+        Down: migrations.Exec(`DROP TABLE student_history`),
+    },
+    {
+        Version: 17,
+        Name:    "create_saved_reports",
+        Up: migrations.Exec(`CREATE TABLE saved_reports (
+            name VARCHAR(64) NOT NULL PRIMARY KEY,
+            sql_text TEXT NOT NULL,
+            params TEXT NOT NULL,
+            filter TEXT NOT NULL,
+            format VARCHAR(16) NOT NULL,
+            schedule VARCHAR(255) NOT NULL,
+            delivery TEXT NOT NULL,
+            next_run_at VARCHAR(64) NULL,
+            updated_at VARCHAR(64) NOT NULL
+        ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`, `CREATE TABLE report_runs (
+            id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+            report VARCHAR(64) NOT NULL,
+            triggered_by VARCHAR(16) NOT NULL,
+            started_at VARCHAR(64) NOT NULL,
+            finished_at VARCHAR(64) NOT NULL,
+            row_count INT NOT NULL,
+            truncated TINYINT NOT NULL,
+            error TEXT NOT NULL,
+            deliveries TEXT NOT NULL,
+            INDEX report_runs_report (report, id)
+        ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`),
+        Down: migrations.Exec(`DROP TABLE report_runs`, `DROP TABLE saved_reports`),
+    },
+    {
+        Version: 18,
+        Name:    "add_api_keys_scopes",
+        Up:      migrations.Exec(`ALTER TABLE api_keys ADD COLUMN scopes VARCHAR(255) NOT NULL DEFAULT ''`),
+        Down:    migrations.Exec(`ALTER TABLE api_keys DROP COLUMN scopes`),
+    },
+    {
+        Version: 19,
+        Name:    "add_principal_tenants",
+        Up: migrations.Exec(`ALTER TABLE users ADD COLUMN tenant VARCHAR(63) NOT NULL DEFAULT ''`,
+            `ALTER TABLE api_keys ADD COLUMN tenant VARCHAR(63) NOT NULL DEFAULT ''`),
+        Down: migrations.Exec(`ALTER TABLE users DROP COLUMN tenant`, `ALTER TABLE api_keys DROP COLUMN tenant`),
+    },
+}
+
+// migrateMySQL applies pending MySQL migrations. MySQL commits DDL
+// implicitly, so a failed migration can leave its changes behind.
+func migrateMySQL(db *sql.DB) error {
+    return applyMigrations(db, mysqlMigrations, nil)
+}
+
+// MySQLRepository is the StudentRepository backed by MySQL or MariaDB
+type MySQLRepository struct {
+    db *sql.DB
+    // conn is db, or the transaction of a repository made by Transaction
+    conn  sqlConn
+    stmts *studentStatements
+    // upsert inserts a student by ID or overwrites it on a duplicate key;
+    // VALUES() is what MariaDB understands
+    upsert *sql.Stmt
+}
+
+// NewMySQLRepository prepares the repository's statements on a migrated
+// database. The database stays owned by the caller.
+func NewMySQLRepository(db *sql.DB) (*MySQLRepository, error) {
+    r := &MySQLRepository{db: db, conn: db, stmts: &studentStatements{}}
+    for _, p := range []struct {
+        stmt  **sql.Stmt
+        query string
+    }{
+        {&r.stmts.get, "SELECT " + studentColumns + " FROM students WHERE id = ?"},
+        {&r.stmts.insert, "INSERT INTO students (name, age, email, updated_at, deleted_at) VALUES (?, ?, ?, ?, ?)"},
+        {&r.stmts.insertWithID, "INSERT INTO students (id, name, age, email, updated_at, deleted_at) VALUES (?, ?, ?, ?, ?, ?)"},
+        {&r.stmts.update, "UPDATE students SET name = ?, age = ?, email = ?, updated_at = ?, deleted_at = ? WHERE id = ?"},
+        {&r.stmts.remove, "DELETE FROM students WHERE id = ?"},
+        {&r.upsert, `INSERT INTO students (id, name, age, email, updated_at, deleted_at) VALUES (?, ?, ?, ?, ?, ?)
+            ON DUPLICATE KEY UPDATE name = VALUES(name), age = VALUES(age), email = VALUES(email), updated_at = VALUES(updated_at), deleted_at = VALUES(deleted_at)`},
+    } {
+        stmt, err := db.Prepare(p.query)
+        if err != nil {
+            r.Close()
+            return nil, fmt.Errorf("preparing %q: %v", p.query, err)
+        }
+        *p.stmt = stmt
+    }
+    return r, nil
+}
+
+// Close releases the prepared statements
+func (r *MySQLRepository) Close() error {
+    r.stmts.Close()
+    if r.upsert != nil {
+        r.upsert.Close()
+    }
+    return nil
+}
+
+// Create inserts a student, under its own ID if it has one. An explicit ID
+// above the AUTO_INCREMENT counter moves the counter past it.
+func (r *MySQLRepository) Create(student Student) (Student, error) {
+    if student.ID != 0 {
+        _, err := r.stmts.insertWithID.Exec(student.ID, student.Name, student.Age, student.Email, student.UpdatedAt, student.DeletedAt)
+        return student, err
+    }
+    result, err := r.stmts.insert.Exec(student.Name, student.Age, student.Email, student.UpdatedAt, student.DeletedAt)
+    if err != nil {
+        return Student{}, err
+    }
+    id, err := result.LastInsertId()
+    if err != nil {
+        return Student{}, err
+    }
+    student.ID = int(id)
+    return student, nil
+}
+
+// Upsert inserts the student under its ID, or overwrites the existing row
+func (r *MySQLRepository) Upsert(student Student) (Student, error) {
+    _, err := r.upsert.Exec(student.ID, student.Name, student.Age, student.Email, student.UpdatedAt, student.DeletedAt)
+    return student, err
+}
+
+// Transaction runs fn against a repository bound to one database transaction
+func (r *MySQLRepository) Transaction(fn func(tx StudentRepository) error) error {
+    return runTransaction(r.db, fn, func(tx *sql.Tx) StudentRepository {
+        return &MySQLRepository{db: r.db, conn: tx, stmts: r.stmts.in(tx), upsert: tx.Stmt(r.upsert)}
+    })
+}
+
+// History returns the student_history of the database or transaction
+func (r *MySQLRepository) History() StudentHistory {
+    return &SQLHistory{conn: r.conn}
+}
+
+// Outbox returns the event_outbox of the database or transaction
+func (r *MySQLRepository) Outbox() OutboxRepository {
+    return NewSQLOutboxRepository(r.conn, nil)
+}
+
+// Get loads one student
+func (r *MySQLRepository) Get(id int) (Student, error) {
+    student, err := scanStudent(r.stmts.get.QueryRow(id))
+    if errors.Is(err, sql.ErrNoRows) {
+        return Student{}, errStudentNotFound
+    }
+    return student, err
+}
+
+// List loads the students selected by opts, in opts.Sort order
+func (r *MySQLRepository) List(opts ListOptions) ([]Student, error) {
+    where, args := mysqlFilter(opts.Filter)
+    query, args := studentListSQL(where, args, opts)
+    return queryStudents(r.conn, query, args...)
+}
+
+// Count returns how many students match the filter
+func (r *MySQLRepository) Count(f *Filter) (int, error) {
+    where, args := mysqlFilter(f)
+    var n int
+    err := r.conn.QueryRow("SELECT COUNT(*) FROM students WHERE "+where, args...).Scan(&n)
+    return n, err
+}
+
+// mysqlFilter compiles a filter for MySQL. Backslash is already MySQL's LIKE
+// escape, and a backslash inside a quoted literal would need escaping
+// itself. The case-insensitive collation keeps LIKE matching as loose as in
+// SQLite despite the binary column collation.
+func mysqlFilter(f *Filter) (string, []interface{}) {
+    where, args := f.SQL()
+    return strings.ReplaceAll(where, ` LIKE ? ESCAPE '\'`, ` COLLATE utf8mb4_general_ci LIKE ?`), args
+}
+
+// Update overwrites an existing student
+func (r *MySQLRepository) Update(student Student) (Student, error) {
+    result, err := r.stmts.update.Exec(student.Name, student.Age, student.Email, student.UpdatedAt, student.DeletedAt, student.ID)
+    if err != nil {
+        return Student{}, err
+    }
+    return student, requireRow(result)
+}
+
+// Delete removes a student
+func (r *MySQLRepository) Delete(id int) error {
+    result, err := r.stmts.remove.Exec(id)
+    if err != nil {
+        return err
+    }
+    return requireRow(result)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+    "net/http"
+    "strings"
+    "github.com/gorilla/mux"
+)
+
+// routeExists reports whether any route matches the request's path, whatever its method
+func routeExists(router *mux.Router, r *http.Request) bool {
+    var match mux.RouteMatch
+    router.Match(r, &match)
+    return match.MatchErr == nil || match.MatchErr == mux.ErrMethodMismatch
+}
+
+// normalizePaths redirects non-canonical paths with 308 Permanent Redirect,
+// which keeps the method and body: a trailing slash is dropped and, when the
+// path only matches a route in lower case, /Students becomes /students. Paths
+// that already match are left alone so mixed-case IDs such as import profile
+// names keep working.
+func normalizePaths(router *mux.Router) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        path := r.URL.Path
+        if len(path) > 1 && strings.HasSuffix(path, "/") {
+            path = strings.TrimRight(path, "/")
+            if path == "" {
+                path = "/"
+            }
+        }
+        if path == r.URL.Path && routeExists(router, r) {
+            router.ServeHTTP(w, r)
+            return
+        }
+
+        candidate := r.Clone(r.Context())
+        candidate.URL.Path = path
+        if !routeExists(router, candidate) {
+            candidate.URL.Path = strings.ToLower(path)
+            if !routeExists(router, candidate) {
+                router.ServeHTTP(w, r)
+                return
+            }
+        }
+
+        target := candidate.URL.Path
+        if r.URL.RawQuery != "" {
+            target += "?" + r.URL.RawQuery
+        }
+        http.Redirect(w, r, target, http.StatusPermanentRedirect)
+    })
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "mime/multipart"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "github.com/gorilla/mux"
+    "student-api/reqctx"
+)
+
+// maxNoteAudioUpload matches the 25 MB limit of Whisper-compatible APIs
+const maxNoteAudioUpload = 25 << 20
+
+// NoteSourceAudio marks notes transcribed from a recording
+const NoteSourceAudio = "audio"
+
+// STTProvider transcribes recorded speech into text
+type STTProvider interface {
+    Transcribe(ctx context.Context, audio io.Reader, filename, contentType string) (string, error)
+}
+
+// WhisperSTTProvider talks to an OpenAI-compatible /v1/audio/transcriptions
+// endpoint, such as a self-hosted Whisper server
+type WhisperSTTProvider struct {
+    baseURL  string
+    apiKey   string
+    model    string
+    language string
+    http     *http.Client
+}
+
+// NewWhisperSTTProvider creates a provider for a Whisper-compatible API
+func NewWhisperSTTProvider(baseURL, apiKey, model, language string) *WhisperSTTProvider {
+    return &WhisperSTTProvider{
+        baseURL:  baseURL,
+        apiKey:   apiKey,
+        model:    model,
+        language: language,
+        http:     &http.Client{},
+    }
+}
+
+// Transcribe streams the audio to the API as a multipart upload
+func (p *WhisperSTTProvider) Transcribe(ctx context.Context, audio io.Reader, filename, contentType string) (string, error) {
+    body, pw := io.Pipe()
+    mw := multipart.NewWriter(pw)
+    go func() {
+        fields := map[string]string{"model": p.model, "response_format": "json"}
+        if p.language != "" {
+            fields["language"] = p.language
+        }
+        for name, value := range fields {
+            if err := mw.WriteField(name, value); err != nil {
+                pw.CloseWithError(err)
+                return
+            }
+        }
+        part, err := mw.CreateFormFile("file", filename)
+        if err == nil {
+            _, err = io.Copy(part, audio)
+        }
+        if err == nil {
+            err = mw.Close()
+        }
+        pw.CloseWithError(err)
+    }()
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/v1/audio/transcriptions", body)
+    if err != nil {
+        body.Close()
+        return "", err
+    }
+    req.Header.Set("Content-Type", mw.FormDataContentType())
+    if p.apiKey != "" {
+        req.Header.Set("Authorization", "Bearer "+p.apiKey)
+    }
+
+    resp, err := p.http.Do(req)
+    if err != nil {
+        return "", err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return "", fmt.Errorf("stt: unexpected status %s", resp.Status)
+    }
+
+    var result struct {
+        Text string `json:"text"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+        return "", err
+    }
+    return strings.TrimSpace(result.Text), nil
+}
+
+// LoadSTTProvider returns the provider configured by STT_URL, or nil when
+// speech-to-text is disabled
+func LoadSTTProvider() STTProvider {
+    baseURL := getEnv("STT_URL", "")
+    if baseURL == "" {
+        return nil
+    }
+    return NewWhisperSTTProvider(
+        baseURL,
+        getEnv("STT_API_KEY", ""),
+        getEnv("STT_MODEL", "whisper-1"),
+        getEnv("STT_LANGUAGE", ""),
+    )
+}
+
+// Note is an advisor note about a student. Insights are generated from the
+// text by the LLM; InsightError explains why they are missing.
+type Note struct {
+    ID           int                `json:"id"`
+    StudentID    int                `json:"student_id"`
+    Source       string             `json:"source"`
+    Text         string             `json:"text"`
+    Insights     *StructuredSummary `json:"insights,omitempty"`
+    Model        string             `json:"model,omitempty"`
+    InsightError string             `json:"insight_error,omitempty"`
+    CreatedAt    time.Time          `json:"created_at"`
+}
+
+// studentKey identifies a student across tenants
+type studentKey struct {
+    tenant    string
+    studentID int
+}
+
+// NoteStore keeps advisor notes with thread-safe operations
+type NoteStore struct {
+    sync.RWMutex
+    notes  map[studentKey][]Note // oldest first
+    nextID int
+}
+
+// NewNoteStore initializes a new NoteStore
+func NewNoteStore() *NoteStore {
+    return &NoteStore{notes: make(map[studentKey][]Note), nextID: 1}
+}
+
+// Add stores a note for a tenant's student and assigns its ID
+func (s *NoteStore) Add(tenant string, n Note) Note {
+    s.Lock()
+    defer s.Unlock()
+    n.ID = s.nextID
+    s.nextID++
+    key := studentKey{tenant, n.StudentID}
+    s.notes[key] = append(s.notes[key], n)
+    return n
+}
+
+// List returns a tenant's student's notes, newest first
+func (s *NoteStore) List(tenant string, studentID int) []Note {
+    s.RLock()
+    notes := append([]Note{}, s.notes[studentKey{tenant, studentID}]...)
+    s.RUnlock()
+    sort.Slice(notes, func(i, j int) bool { return notes[i].ID > notes[j].ID })
+    return notes
+}
+
+// noteInsightPrompt asks for the structured summary fields about a note
+const noteInsightPrompt = "An advisor recorded the following note about the student %s (age %d). " +
+    "Summarize what the note says about the student, list the strengths and risks it mentions " +
+    "and recommend a next step for the advisor.\nNote:\n%s"
+
+// noteInsights runs the LLM insight pipeline on a note's text, routed as a
+// transcript task
+func (app *App) noteInsights(ctx context.Context, student Student, text string) (StructuredSummary, string, error) {
+    ctx, cancel := context.WithTimeout(ctx, summaryTimeout)
+    defer cancel()
+    generator := app.models.For(TaskTranscript)
+    prompt := fmt.Sprintf(noteInsightPrompt, student.Name, student.Age, text)
+    insights, err := generateStructured(ctx, generator, prompt, nil, app.summaryRepairs, func(*OllamaResponse) {})
+    return insights, generator.Model(), err
+}
+
+// isAudioUpload reports whether a content type is one Whisper accepts
+func isAudioUpload(contentType string) bool {
+    return strings.HasPrefix(contentType, "audio/") || contentType == "video/mp4" || contentType == "video/webm"
+}
+
+// CreateAudioNote transcribes a recorded advisor note (multipart field
+// "file"), stores the transcript as a note on the student and attaches LLM
+// insights. A failed insight run still stores the note, with insight_error set.
+func (app *App) CreateAudioNote(w http.ResponseWriter, r *http.Request) {
+    store := app.storeFor(r)
+    if app.stt == nil {
+        httpError(w, r, "Speech-to-text is not configured", http.StatusServiceUnavailable)
+        return
+    }
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        httpError(w, r, "Invalid ID", http.StatusBadRequest)
+        return
+    }
+    student, err := store.Get(id)
+    if err != nil {
+        writeStoreError(w, r, err)
+        return
+    }
+
+    r.Body = http.MaxBytesReader(w, r.Body, maxNoteAudioUpload)
+    file, header, err := r.FormFile("file")
+    if err != nil {
+        httpError(w, r, "Missing audio file", http.StatusBadRequest)
+        return
+    }
+    defer file.Close()
+
+    contentType := header.Header.Get("Content-Type")
+    if contentType == "" || contentType == "application/octet-stream" {
+        sniff := make([]byte, 512)
+        n, _ := io.ReadFull(file, sniff)
+        contentType = http.DetectContentType(sniff[:n])
+        if _, err := file.Seek(0, io.SeekStart); err != nil {
+            httpError(w, r, "Invalid audio file", http.StatusBadRequest)
+            return
+        }
+    }
+    if !isAudioUpload(contentType) {
+        httpError(w, r, "Unsupported audio type "+contentType, http.StatusUnsupportedMediaType)
+        return
+    }
+
+    text, err := app.stt.Transcribe(r.Context(), file, header.Filename, contentType)
+    if err != nil {
+        reqctx.Logger(r.Context()).Error("note transcription failed", "student_id", id, "error", err)
+        httpError(w, r, "Failed to transcribe audio", http.StatusBadGateway)
+        return
+    }
+    if text == "" {
+        httpError(w, r, "No speech found in audio", http.StatusUnprocessableEntity)
+        return
+    }
+
+    note := Note{StudentID: id, Source: NoteSourceAudio, Text: text, CreatedAt: time.Now().UTC()}
+    insights, model, err := app.noteInsights(r.Context(), student, text)
+    if err != nil {
+        reqctx.Logger(r.Context()).Error("note insights failed", "student_id", id, "error", err)
+        note.InsightError = err.Error()
+    } else {
+        note.Insights, note.Model = &insights, model
+    }
+    note = app.notes.Add(reqctx.From(r.Context()).Tenant, note)
+
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(note)
+}
+
+// ListNotes returns a student's notes, newest first
+func (app *App) ListNotes(w http.ResponseWriter, r *http.Request) {
+    store := app.storeFor(r)
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        httpError(w, r, "Invalid ID", http.StatusBadRequest)
+        return
+    }
+    if _, err := store.Get(id); err != nil {
+        writeStoreError(w, r, err)
+        return
+    }
+    app.recordAccess(r, fieldsNotes, id)
+    json.NewEncoder(w).Encode(app.notes.List(reqctx.From(r.Context()).Tenant, id))
+}
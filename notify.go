@@ -0,0 +1,184 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "sync"
+    "time"
+)
+
+// Alert severities
+const (
+    AlertWarning  = "warning"
+    AlertCritical = "critical"
+)
+
+// Alert is a notification for operators. Key groups repeats of the same
+// condition so they can be throttled.
+type Alert struct {
+    Kind     string            `json:"kind"`
+    Severity string            `json:"severity"`
+    Summary  string            `json:"summary"`
+    Fields   map[string]string `json:"fields,omitempty"`
+    At       time.Time         `json:"at"`
+    Key      string            `json:"-"`
+}
+
+// Notifier delivers alerts to operators
+type Notifier interface {
+    Notify(ctx context.Context, alert Alert) error
+}
+
+// WebhookNotifier posts alerts as JSON. The "text" field makes the payload
+// usable as a Slack or Mattermost incoming webhook.
+type WebhookNotifier struct {
+    url  string
+    http *http.Client
+}
+
+// NewWebhookNotifier creates a notifier posting to url
+func NewWebhookNotifier(url string) *WebhookNotifier {
+    return &WebhookNotifier{url: url, http: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (n *WebhookNotifier) Notify(ctx context.Context, alert Alert) error {
+    body, err := json.Marshal(map[string]interface{}{
+        "text":  fmt.Sprintf("[%s] %s", alert.Severity, alert.Summary),
+        "alert": alert,
+    })
+    if err != nil {
+        return err
+    }
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    resp, err := n.http.Do(req)
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        return fmt.Errorf("alert webhook: unexpected status %s", resp.Status)
+    }
+    return nil
+}
+
+// Alerter logs every alert and forwards it to a notifier in the background.
+// Alerts sharing a key are sent at most once per throttle window; the
+// suppressed ones are counted in the next alert sent for that key.
+type Alerter struct {
+    notifier Notifier
+    throttle time.Duration
+    metrics  *Metrics
+    queue    chan Alert
+    // done is closed once every queued alert has been delivered after Close
+    done chan struct{}
+
+    mu         sync.Mutex
+    lastSent   map[string]time.Time
+    suppressed map[string]int
+    closed     bool
+}
+
+// NewAlerter creates an alerter; notifier may be nil to only log alerts
+func NewAlerter(notifier Notifier, throttle time.Duration, metrics *Metrics) *Alerter {
+    a := &Alerter{
+        notifier:   notifier,
+        throttle:   throttle,
+        metrics:    metrics,
+        queue:      make(chan Alert, 256),
+        done:       make(chan struct{}),
+        lastSent:   make(map[string]time.Time),
+        suppressed: make(map[string]int),
+    }
+    if notifier != nil {
+        go a.deliver()
+    } else {
+        close(a.done)
+    }
+    return a
+}
+
+// LoadAlerter reads ALERT_WEBHOOK_URL and ALERT_THROTTLE
+func LoadAlerter(metrics *Metrics) *Alerter {
+    var notifier Notifier
+    if url := getEnv("ALERT_WEBHOOK_URL", ""); url != "" {
+        notifier = NewWebhookNotifier(url)
+    }
+    return NewAlerter(notifier, getEnvDuration("ALERT_THROTTLE", 5*time.Minute), metrics)
+}
+
+// Raise records an alert and queues it for the notifier without blocking
+func (a *Alerter) Raise(alert Alert) {
+    if alert.At.IsZero() {
+        alert.At = time.Now().UTC()
+    }
+    attrs := []any{"kind", alert.Kind, "severity", alert.Severity}
+    for k, v := range alert.Fields {
+        attrs = append(attrs, k, v)
+    }
+    slog.Warn("alert: "+alert.Summary, attrs...)
+    a.metrics.Inc("alerts_total", "kind", alert.Kind)
+
+    a.mu.Lock()
+    if last, ok := a.lastSent[alert.Key]; ok && alert.At.Sub(last) < a.throttle {
+        a.suppressed[alert.Key]++
+        a.mu.Unlock()
+        a.metrics.Inc("alerts_suppressed_total", "kind", alert.Kind)
+        return
+    }
+    a.lastSent[alert.Key] = alert.At
+    if n := a.suppressed[alert.Key]; n > 0 {
+        alert.Fields = copyFields(alert.Fields)
+        alert.Fields["suppressed"] = fmt.Sprint(n)
+        delete(a.suppressed, alert.Key)
+    }
+    if a.notifier == nil || a.closed {
+        a.mu.Unlock()
+        return
+    }
+    select {
+    case a.queue <- alert:
+    default:
+        a.metrics.Inc("alerts_dropped_total", "kind", alert.Kind)
+    }
+    a.mu.Unlock()
+}
+
+// Close stops queueing alerts and waits for the queued ones to be delivered;
+// alerts raised afterwards are only logged
+func (a *Alerter) Close() {
+    a.mu.Lock()
+    if !a.closed && a.notifier != nil {
+        close(a.queue)
+    }
+    a.closed = true
+    a.mu.Unlock()
+    <-a.done
+}
+
+func (a *Alerter) deliver() {
+    defer close(a.done)
+    for alert := range a.queue {
+        ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+        if err := a.notifier.Notify(ctx, alert); err != nil {
+            slog.Error("alert delivery failed", "kind", alert.Kind, "error", err)
+            a.metrics.Inc("alerts_failed_total", "kind", alert.Kind)
+        }
+        cancel()
+    }
+}
+
+func copyFields(fields map[string]string) map[string]string {
+    out := make(map[string]string, len(fields)+1)
+    for k, v := range fields {
+        out[k] = v
+    }
+    return out
+}
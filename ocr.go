@@ -0,0 +1,194 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "os/exec"
+    "regexp"
+    "strconv"
+    "strings"
+    "student-api/reqctx"
+)
+
+// maxRosterUpload caps scanned roster uploads
+const maxRosterUpload = 20 << 20
+
+// errUnsupportedDocument is returned when a provider cannot read the uploaded file type
+var errUnsupportedDocument = errors.New("unsupported document type")
+
+// OCRProvider extracts plain text from a scanned document
+type OCRProvider interface {
+    ExtractText(ctx context.Context, document io.Reader, contentType string) (string, error)
+}
+
+// TesseractOCR shells out to the tesseract CLI, which reads images from stdin
+type TesseractOCR struct {
+    binary string
+    lang   string
+}
+
+func (t *TesseractOCR) ExtractText(ctx context.Context, document io.Reader, contentType string) (string, error) {
+    if !strings.HasPrefix(contentType, "image/") {
+        return "", fmt.Errorf("%w: tesseract only reads images, got %s", errUnsupportedDocument, contentType)
+    }
+
+    cmd := exec.CommandContext(ctx, t.binary, "stdin", "stdout", "-l", t.lang)
+    cmd.Stdin = document
+    var stdout, stderr bytes.Buffer
+    cmd.Stdout = &stdout
+    cmd.Stderr = &stderr
+    if err := cmd.Run(); err != nil {
+        return "", fmt.Errorf("tesseract: %v: %s", err, strings.TrimSpace(stderr.String()))
+    }
+    return stdout.String(), nil
+}
+
+// HTTPOCRProvider posts the raw document to an external OCR service that
+// answers with {"text": "..."}; it is expected to handle both PDFs and images
+type HTTPOCRProvider struct {
+    url    string
+    apiKey string
+    http   *http.Client
+}
+
+func (p *HTTPOCRProvider) ExtractText(ctx context.Context, document io.Reader, contentType string) (string, error) {
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, document)
+    if err != nil {
+        return "", err
+    }
+    req.Header.Set("Content-Type", contentType)
+    if p.apiKey != "" {
+        req.Header.Set("Authorization", "Bearer "+p.apiKey)
+    }
+
+    resp, err := p.http.Do(req)
+    if err != nil {
+        return "", err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return "", fmt.Errorf("ocr: unexpected status %s", resp.Status)
+    }
+
+    var result struct {
+        Text string `json:"text"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+        return "", err
+    }
+    return result.Text, nil
+}
+
+// LoadOCRProvider returns the provider selected by OCR_PROVIDER, or nil when OCR is disabled
+func LoadOCRProvider() OCRProvider {
+    switch getEnv("OCR_PROVIDER", "") {
+    case "tesseract":
+        return &TesseractOCR{
+            binary: getEnv("TESSERACT_BIN", "tesseract"),
+            lang:   getEnv("TESSERACT_LANG", "eng"),
+        }
+    case "http":
+        return &HTTPOCRProvider{
+            url:    getEnv("OCR_URL", ""),
+            apiKey: getEnv("OCR_API_KEY", ""),
+            http:   &http.Client{},
+        }
+    default:
+        return nil
+    }
+}
+
+// RosterCandidate is a student row recognised in a scanned roster, awaiting review
+type RosterCandidate struct {
+    Line    int               `json:"line"`
+    Raw     string            `json:"raw"`
+    Student Student           `json:"student"`
+    Errors  []ValidationError `json:"errors,omitempty"`
+}
+
+var (
+    rosterEmailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+    rosterAgePattern   = regexp.MustCompile(`\b\d{1,3}\b`)
+    rosterSeparators   = regexp.MustCompile(`[|,;\t]+|\s{2,}`)
+)
+
+// parseRosterText turns OCR output into candidate rows. Each line holding an
+// email address is treated as one student; the first standalone number is the
+// age and the remaining words form the name.
+func parseRosterText(text string) []RosterCandidate {
+    var candidates []RosterCandidate
+    for i, line := range strings.Split(text, "\n") {
+        raw := strings.TrimSpace(line)
+        email := rosterEmailPattern.FindString(raw)
+        if email == "" {
+            continue
+        }
+
+        rest := strings.Replace(raw, email, " ", 1)
+        student := Student{Email: strings.ToLower(email)}
+        if age := rosterAgePattern.FindString(rest); age != "" {
+            student.Age, _ = strconv.Atoi(age)
+            rest = strings.Replace(rest, age, " ", 1)
+        }
+        student.Name = strings.Join(strings.Fields(rosterSeparators.ReplaceAllString(rest, " ")), " ")
+
+        candidates = append(candidates, RosterCandidate{Line: i + 1, Raw: raw, Student: student})
+    }
+    return candidates
+}
+
+// IngestRoster accepts a scanned roster (PDF or image) as the multipart field
+// "file" and returns the recognised student rows for review. Nothing is created;
+// clients submit the reviewed rows through the regular create endpoint.
+func (app *App) IngestRoster(w http.ResponseWriter, r *http.Request) {
+    if app.ocr == nil {
+        httpError(w, r, "OCR is not configured", http.StatusServiceUnavailable)
+        return
+    }
+
+    r.Body = http.MaxBytesReader(w, r.Body, maxRosterUpload)
+    file, header, err := r.FormFile("file")
+    if err != nil {
+        httpError(w, r, "Missing roster file", http.StatusBadRequest)
+        return
+    }
+    defer file.Close()
+
+    contentType := header.Header.Get("Content-Type")
+    if contentType == "" || contentType == "application/octet-stream" {
+        sniff := make([]byte, 512)
+        n, _ := io.ReadFull(file, sniff)
+        contentType = http.DetectContentType(sniff[:n])
+        if _, err := file.Seek(0, io.SeekStart); err != nil {
+            httpError(w, r, "Invalid roster file", http.StatusBadRequest)
+            return
+        }
+    }
+
+    text, err := app.ocr.ExtractText(r.Context(), file, contentType)
+    if errors.Is(err, errUnsupportedDocument) {
+        httpError(w, r, err.Error(), http.StatusUnsupportedMediaType)
+        return
+    }
+    if err != nil {
+        reqctx.Logger(r.Context()).Error("roster OCR failed", "error", err)
+        httpError(w, r, "Failed to read roster", http.StatusBadGateway)
+        return
+    }
+
+    candidates := parseRosterText(text)
+    for i := range candidates {
+        candidates[i].Errors = app.validateStudent(candidates[i].Student)
+    }
+
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "candidates": candidates,
+        "text":       text,
+    })
+}
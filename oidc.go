@@ -0,0 +1,386 @@
+package main
+
+import (
+    "context"
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rsa"
+    _ "crypto/sha256"
+    _ "crypto/sha512"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "math/big"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+)
+
+// oidcLeeway tolerates clock skew between the API and the identity provider
+const oidcLeeway = time.Minute
+
+// oidcMinRefetch is the shortest interval between JWKS fetches triggered by
+// tokens with an unknown key ID, so forged kids cannot hammer the provider
+const oidcMinRefetch = 30 * time.Second
+
+// oidcAlgs are the accepted signature algorithms and their hashes
+var oidcAlgs = map[string]crypto.Hash{
+    "RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+    "ES256": crypto.SHA256, "ES384": crypto.SHA384,
+}
+
+// OIDCProvider validates access tokens issued by an external OpenID Connect
+// provider such as Keycloak or Auth0. Signing keys come from the JWKS named
+// in the provider's discovery document and are refetched on key rotation.
+type OIDCProvider struct {
+    issuer        string
+    audience      string
+    usernameClaim string
+    groupsClaim   string
+    tenantClaim   string
+    // roles maps IdP groups to internal roles; the highest match wins
+    roles       map[string]string
+    defaultRole string
+    refresh     time.Duration
+    http        *http.Client
+
+    mu        sync.Mutex
+    jwksURI   string
+    keys      map[string]crypto.PublicKey
+    fetchedAt time.Time
+}
+
+// ParseRoleMap parses "kc-admins=admin,teachers=teacher"
+func ParseRoleMap(spec string) (map[string]string, error) {
+    roles := make(map[string]string)
+    for _, part := range strings.Split(spec, ",") {
+        part = strings.TrimSpace(part)
+        if part == "" {
+            continue
+        }
+        group, role, found := strings.Cut(part, "=")
+        if !found || group == "" || role == "" {
+            return nil, fmt.Errorf("role mapping %q: expected group=role", part)
+        }
+        if _, err := parseRole(role); err != nil {
+            return nil, fmt.Errorf("role mapping %q: %w", part, err)
+        }
+        roles[group] = role
+    }
+    return roles, nil
+}
+
+// LoadOIDCProvider reads OIDC_ISSUER, OIDC_AUDIENCE, OIDC_USERNAME_CLAIM,
+// OIDC_GROUPS_CLAIM, OIDC_TENANT_CLAIM (default tenant), binding users to
+// the tenant it names, OIDC_ROLE_MAP, OIDC_DEFAULT_ROLE and
+// OIDC_JWKS_REFRESH.
+// It returns nil while OIDC_ISSUER is unset. Nothing is fetched until the
+// first token arrives.
+func LoadOIDCProvider() (*OIDCProvider, error) {
+    issuer := getEnv("OIDC_ISSUER", "")
+    if issuer == "" {
+        return nil, nil
+    }
+    audience := getEnv("OIDC_AUDIENCE", "")
+    if audience == "" {
+        return nil, errors.New("OIDC_AUDIENCE is required with OIDC_ISSUER")
+    }
+    roles, err := ParseRoleMap(getEnv("OIDC_ROLE_MAP", ""))
+    if err != nil {
+        return nil, err
+    }
+    defaultRole := getEnv("OIDC_DEFAULT_ROLE", RoleReadonly)
+    if defaultRole != "none" {
+        if _, err := parseRole(defaultRole); err != nil {
+            return nil, fmt.Errorf("OIDC_DEFAULT_ROLE: %w", err)
+        }
+    }
+    return &OIDCProvider{
+        issuer:        strings.TrimSuffix(issuer, "/"),
+        audience:      audience,
+        usernameClaim: getEnv("OIDC_USERNAME_CLAIM", "preferred_username"),
+        groupsClaim:   getEnv("OIDC_GROUPS_CLAIM", "groups"),
+        tenantClaim:   getEnv("OIDC_TENANT_CLAIM", "tenant"),
+        roles:         roles,
+        defaultRole:   defaultRole,
+        refresh:       getEnvDuration("OIDC_JWKS_REFRESH", time.Hour),
+        http:          &http.Client{Timeout: 10 * time.Second},
+    }, nil
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, url string, v interface{}) error {
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+    if err != nil {
+        return err
+    }
+    resp, err := p.http.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("oidc: GET %s: unexpected status %s", url, resp.Status)
+    }
+    return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// jwk is one key of a JSON Web Key Set
+type jwk struct {
+    Kty string `json:"kty"`
+    Kid string `json:"kid"`
+    Use string `json:"use"`
+    N   string `json:"n"`
+    E   string `json:"e"`
+    Crv string `json:"crv"`
+    X   string `json:"x"`
+    Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+    decode := base64.RawURLEncoding.DecodeString
+    switch k.Kty {
+    case "RSA":
+        n, err := decode(k.N)
+        if err != nil {
+            return nil, err
+        }
+        e, err := decode(k.E)
+        if err != nil {
+            return nil, err
+        }
+        return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+    case "EC":
+        var curve elliptic.Curve
+        switch k.Crv {
+        case "P-256":
+            curve = elliptic.P256()
+        case "P-384":
+            curve = elliptic.P384()
+        default:
+            return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+        }
+        x, err := decode(k.X)
+        if err != nil {
+            return nil, err
+        }
+        y, err := decode(k.Y)
+        if err != nil {
+            return nil, err
+        }
+        return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+    }
+    return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// fetchKeys discovers the JWKS URI if needed and reloads the signing keys;
+// the caller holds p.mu
+func (p *OIDCProvider) fetchKeys(ctx context.Context) error {
+    p.fetchedAt = time.Now()
+    if p.jwksURI == "" {
+        var discovery struct {
+            Issuer  string `json:"issuer"`
+            JWKSURI string `json:"jwks_uri"`
+        }
+        if err := p.getJSON(ctx, p.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+            return err
+        }
+        if strings.TrimSuffix(discovery.Issuer, "/") != p.issuer || discovery.JWKSURI == "" {
+            return fmt.Errorf("oidc: discovery document for %s names issuer %q", p.issuer, discovery.Issuer)
+        }
+        p.jwksURI = discovery.JWKSURI
+    }
+
+    var set struct {
+        Keys []jwk `json:"keys"`
+    }
+    if err := p.getJSON(ctx, p.jwksURI, &set); err != nil {
+        return err
+    }
+    keys := make(map[string]crypto.PublicKey)
+    for _, k := range set.Keys {
+        if k.Use != "" && k.Use != "sig" {
+            continue
+        }
+        key, err := k.publicKey()
+        if err != nil {
+            return fmt.Errorf("oidc: key %q: %w", k.Kid, err)
+        }
+        keys[k.Kid] = key
+    }
+    p.keys = keys
+    return nil
+}
+
+// key returns the signing key for kid, refetching the JWKS when the cache is
+// stale or the kid is new, as it is right after the provider rotates keys
+func (p *OIDCProvider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    key, ok := p.keys[kid]
+    stale := time.Since(p.fetchedAt) > p.refresh
+    if (!ok && time.Since(p.fetchedAt) >= oidcMinRefetch) || stale {
+        if err := p.fetchKeys(ctx); err != nil {
+            if ok {
+                // Keep serving the cached key while the provider is unreachable
+                return key, nil
+            }
+            return nil, err
+        }
+        key, ok = p.keys[kid]
+    }
+    if !ok {
+        return nil, fmt.Errorf("%w: unknown signing key %q", errInvalidJWT, kid)
+    }
+    return key, nil
+}
+
+// verifySignature checks a JOSE signature over signed with key
+func verifySignature(alg string, key crypto.PublicKey, signed, signature []byte) bool {
+    hash, ok := oidcAlgs[alg]
+    if !ok {
+        return false
+    }
+    h := hash.New()
+    h.Write(signed)
+    digest := h.Sum(nil)
+    switch k := key.(type) {
+    case *rsa.PublicKey:
+        return strings.HasPrefix(alg, "RS") && rsa.VerifyPKCS1v15(k, hash, digest, signature) == nil
+    case *ecdsa.PublicKey:
+        size := (k.Curve.Params().BitSize + 7) / 8
+        if !strings.HasPrefix(alg, "ES") || len(signature) != 2*size {
+            return false
+        }
+        r := new(big.Int).SetBytes(signature[:size])
+        s := new(big.Int).SetBytes(signature[size:])
+        return ecdsa.Verify(k, digest, r, s)
+    }
+    return false
+}
+
+// claimPath looks up a dotted claim such as "realm_access.roles"
+func claimPath(claims map[string]interface{}, path string) interface{} {
+    var value interface{} = claims
+    for _, part := range strings.Split(path, ".") {
+        m, ok := value.(map[string]interface{})
+        if !ok {
+            return nil
+        }
+        value = m[part]
+    }
+    return value
+}
+
+// claimStrings reads a claim holding a string or a list of strings
+func claimStrings(value interface{}) []string {
+    switch v := value.(type) {
+    case string:
+        return []string{v}
+    case []interface{}:
+        var out []string
+        for _, item := range v {
+            if s, ok := item.(string); ok {
+                out = append(out, s)
+            }
+        }
+        return out
+    }
+    return nil
+}
+
+// role maps groups to the most privileged matching role, or the default
+func (p *OIDCProvider) role(groups []string) string {
+    role := ""
+    for _, group := range groups {
+        // Keycloak reports group paths such as "/teachers"
+        mapped, ok := p.roles[group]
+        if !ok {
+            mapped, ok = p.roles[strings.TrimPrefix(group, "/")]
+        }
+        if ok && roleRanks[mapped] > roleRanks[role] {
+            role = mapped
+        }
+    }
+    if role == "" && p.defaultRole != "none" {
+        role = p.defaultRole
+    }
+    return role
+}
+
+// Verify validates a provider-issued access token and returns it as local
+// claims carrying the mapped role. Tokens of users whose groups map to no
+// role are rejected when OIDC_DEFAULT_ROLE is "none".
+func (p *OIDCProvider) Verify(ctx context.Context, token string, now time.Time) (Claims, error) {
+    parts := strings.Split(token, ".")
+    if len(parts) != 3 {
+        return Claims{}, errInvalidJWT
+    }
+    rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+    if err != nil {
+        return Claims{}, errInvalidJWT
+    }
+    var header struct {
+        Alg string `json:"alg"`
+        Kid string `json:"kid"`
+    }
+    if err := json.Unmarshal(rawHeader, &header); err != nil {
+        return Claims{}, errInvalidJWT
+    }
+    if _, ok := oidcAlgs[header.Alg]; !ok {
+        return Claims{}, fmt.Errorf("%w: unsupported algorithm %q", errInvalidJWT, header.Alg)
+    }
+    signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+    if err != nil {
+        return Claims{}, errInvalidJWT
+    }
+    key, err := p.key(ctx, header.Kid)
+    if err != nil {
+        return Claims{}, err
+    }
+    if !verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature) {
+        return Claims{}, errInvalidJWT
+    }
+
+    payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+    if err != nil {
+        return Claims{}, errInvalidJWT
+    }
+    var claims map[string]interface{}
+    if err := json.Unmarshal(payload, &claims); err != nil {
+        return Claims{}, errInvalidJWT
+    }
+    if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != p.issuer {
+        return Claims{}, fmt.Errorf("%w: wrong issuer", errInvalidJWT)
+    }
+    if !containsString(claimStrings(claims["aud"]), p.audience) {
+        return Claims{}, fmt.Errorf("%w: wrong audience", errInvalidJWT)
+    }
+    exp, ok := claims["exp"].(float64)
+    if !ok || now.After(time.Unix(int64(exp), 0).Add(oidcLeeway)) {
+        return Claims{}, fmt.Errorf("%w: token expired", errInvalidJWT)
+    }
+    if nbf, ok := claims["nbf"].(float64); ok && now.Add(oidcLeeway).Before(time.Unix(int64(nbf), 0)) {
+        return Claims{}, fmt.Errorf("%w: token not yet valid", errInvalidJWT)
+    }
+
+    subject, _ := claims[p.usernameClaim].(string)
+    if subject == "" {
+        subject, _ = claims["sub"].(string)
+    }
+    if subject == "" {
+        return Claims{}, fmt.Errorf("%w: no subject", errInvalidJWT)
+    }
+    role := p.role(claimStrings(claimPath(claims, p.groupsClaim)))
+    if role == "" {
+        return Claims{}, fmt.Errorf("%w: no role for the user's groups", errInvalidJWT)
+    }
+    tenant, _ := claimPath(claims, p.tenantClaim).(string)
+    if tenant != "" && !validTenantID.MatchString(tenant) {
+        return Claims{}, fmt.Errorf("%w: invalid tenant %q", errInvalidJWT, tenant)
+    }
+    iat, _ := claims["iat"].(float64)
+    return Claims{Subject: subject, Issuer: p.issuer, IssuedAt: int64(iat), ExpiresAt: int64(exp), Type: TokenAccess, Role: role, Tenant: tenant}, nil
+}
@@ -2,60 +2,196 @@ package main
 
 import (
     "bytes"
+    "context"
     "encoding/json"
     "fmt"
     "net/http"
+    "strings"
+    "student-api/reqctx"
 )
 
 type OllamaClient struct {
     baseURL string
+    model   string
+    http    *http.Client
 }
 
 type OllamaRequest struct {
-    Model  string `json:"model"`
-    Prompt string `json:"prompt"`
+    Model  string          `json:"model"`
+    Prompt string          `json:"prompt"`
+    Stream bool            `json:"stream"`
+    Format json.RawMessage `json:"format,omitempty"`
 }
 
 type OllamaResponse struct {
-    Response string `json:"response"`
+    Response        string `json:"response"`
+    PromptEvalCount int    `json:"prompt_eval_count"`
+    EvalCount       int    `json:"eval_count"`
 }
 
-func NewOllamaClient(baseURL string) *OllamaClient {
-    return &OllamaClient{baseURL: baseURL}
+// ollamaStatusError is a non-200 answer from Ollama
+type ollamaStatusError struct {
+    code   int
+    status string
 }
 
-func (c *OllamaClient) GenerateStudentSummary(student Student) (string, error) {
-    prompt := fmt.Sprintf(
-        "Generate a brief summary of this student:\nName: %s\nAge: %d\nEmail: %s",
-        student.Name,
-        student.Age,
-        student.Email,
-    )
+func (e *ollamaStatusError) Error() string {
+    return "ollama: unexpected status " + e.status
+}
+
+func NewOllamaClient(baseURL, model string) *OllamaClient {
+    return &OllamaClient{baseURL: baseURL, model: model, http: &http.Client{}}
+}
+
+// WithModel returns a client for another model on the same server and transport
+func (c *OllamaClient) WithModel(model string) *OllamaClient {
+    return &OllamaClient{baseURL: c.baseURL, model: model, http: c.http}
+}
+
+// WithEndpoint returns a client for model on another server, sharing the transport
+func (c *OllamaClient) WithEndpoint(baseURL, model string) *OllamaClient {
+    return &OllamaClient{baseURL: baseURL, model: model, http: c.http}
+}
+
+// SetTransport replaces the HTTP transport, e.g. with an OllamaRecorder
+func (c *OllamaClient) SetTransport(rt http.RoundTripper) {
+    c.http.Transport = rt
+}
+
+// Model returns the name of the model used for generation
+func (c *OllamaClient) Model() string {
+    return c.model
+}
+
+// Generate runs a single non-streaming completion and returns the response with token counts.
+// A non-empty format is passed through as Ollama's "format" option (e.g. a JSON schema).
+func (c *OllamaClient) Generate(ctx context.Context, prompt string, format json.RawMessage) (*OllamaResponse, error) {
+    if chaosOllamaFault(ctx) {
+        return nil, errChaosOllama
+    }
 
     reqBody := OllamaRequest{
-        Model:  "llama2",
+        Model:  c.model,
         Prompt: prompt,
+        Format: format,
     }
 
     jsonBody, err := json.Marshal(reqBody)
     if err != nil {
-        return "", err
+        return nil, err
     }
 
-    resp, err := http.Post(
-        c.baseURL+"/api/generate",
-        "application/json",
-        bytes.NewBuffer(jsonBody),
-    )
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/api/generate", bytes.NewBuffer(jsonBody))
     if err != nil {
-        return "", err
+        return nil, err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    if id := reqctx.RequestID(ctx); id != "" {
+        req.Header.Set(RequestIDHeader, id)
+    }
+
+    resp, err := c.http.Do(req)
+    if err != nil {
+        return nil, err
     }
     defer resp.Body.Close()
 
+    if resp.StatusCode != http.StatusOK {
+        return nil, &ollamaStatusError{code: resp.StatusCode, status: resp.Status}
+    }
+
     var ollamaResp OllamaResponse
     if err := json.NewDecoder(resp.Body).Decode(&ollamaResp); err != nil {
-        return "", err
+        return nil, err
+    }
+    reqctx.Logger(ctx).Debug("ollama generate", "model", c.model, "prompt_tokens", ollamaResp.PromptEvalCount, "completion_tokens", ollamaResp.EvalCount)
+
+    return &ollamaResp, nil
+}
+
+// ollamaTagsResponse lists the models available locally on the Ollama server
+type ollamaTagsResponse struct {
+    Models []struct {
+        Name string `json:"name"`
+    } `json:"models"`
+}
+
+// ollamaPullRequest asks Ollama to download a model
+type ollamaPullRequest struct {
+    Name   string `json:"name"`
+    Stream bool   `json:"stream"`
+}
+
+// ListModels pings Ollama and returns the names of locally available models
+func (c *OllamaClient) ListModels(ctx context.Context) ([]string, error) {
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/api/tags", nil)
+    if err != nil {
+        return nil, err
+    }
+
+    resp, err := c.http.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("ollama: unexpected status %s", resp.Status)
+    }
+
+    var tags ollamaTagsResponse
+    if err := json.NewDecoder(resp.Body).Decode(&tags); err != nil {
+        return nil, err
     }
 
-    return ollamaResp.Response, nil
+    names := make([]string, 0, len(tags.Models))
+    for _, m := range tags.Models {
+        names = append(names, m.Name)
+    }
+    return names, nil
+}
+
+// PullModel downloads the configured model, blocking until the pull completes
+func (c *OllamaClient) PullModel(ctx context.Context) error {
+    return c.post(ctx, "/api/pull", ollamaPullRequest{Name: c.model})
+}
+
+// LoadModel sends an empty prompt, which makes Ollama load the model into memory
+func (c *OllamaClient) LoadModel(ctx context.Context) error {
+    return c.post(ctx, "/api/generate", OllamaRequest{Model: c.model})
+}
+
+func (c *OllamaClient) post(ctx context.Context, path string, body interface{}) error {
+    jsonBody, err := json.Marshal(body)
+    if err != nil {
+        return err
+    }
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, bytes.NewBuffer(jsonBody))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+
+    resp, err := c.http.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("ollama: %s returned %s", path, resp.Status)
+    }
+    return nil
+}
+
+// sameModel compares model names, treating a missing tag as ":latest"
+func sameModel(a, b string) bool {
+    if !strings.Contains(a, ":") {
+        a += ":latest"
+    }
+    if !strings.Contains(b, ":") {
+        b += ":latest"
+    }
+    return a == b
 }
@@ -0,0 +1,205 @@
+package main
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log/slog"
+    "net/http"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strings"
+    "student-api/reqctx"
+)
+
+// Ollama client modes selected by OLLAMA_MODE
+const (
+    OllamaLive   = "live"
+    OllamaRecord = "record"
+    OllamaReplay = "replay"
+)
+
+// Patterns for the personal data scrubbed from recorded fixtures. Prompts
+// put the student's name on a "Name:" line; emails can appear anywhere.
+var (
+    piiNamePattern  = regexp.MustCompile(`Name: ([^\\"]+)`)
+    piiEmailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+)
+
+// OllamaFixture is one recorded request/response pair
+type OllamaFixture struct {
+    Request struct {
+        Method string `json:"method"`
+        Path   string `json:"path"`
+        Body   string `json:"body"`
+    } `json:"request"`
+    Response struct {
+        Status int    `json:"status"`
+        Body   string `json:"body"`
+    } `json:"response"`
+}
+
+// piiScrubber replaces personal data with numbered placeholders such as
+// "[name-1]" and can put the original values back
+type piiScrubber struct {
+    values []string
+    tokens []string
+}
+
+// newPIIScrubber collects the personal data found in a request body
+func newPIIScrubber(body string) *piiScrubber {
+    s := &piiScrubber{}
+    add := func(kind, value string) {
+        value = strings.TrimSpace(value)
+        for _, v := range s.values {
+            if v == value {
+                return
+            }
+        }
+        if value != "" {
+            s.values = append(s.values, value)
+            s.tokens = append(s.tokens, fmt.Sprintf("[%s-%d]", kind, len(s.values)))
+        }
+    }
+    for _, m := range piiNamePattern.FindAllStringSubmatch(body, -1) {
+        add("name", m[1])
+    }
+    for _, email := range piiEmailPattern.FindAllString(body, -1) {
+        add("email", email)
+    }
+    return s
+}
+
+// Scrub replaces every collected value with its placeholder, longest first so
+// a name inside an email is not replaced piecemeal
+func (s *piiScrubber) Scrub(text string) string {
+    order := make([]int, len(s.values))
+    for i := range order {
+        order[i] = i
+    }
+    sort.Slice(order, func(a, b int) bool { return len(s.values[order[a]]) > len(s.values[order[b]]) })
+    for _, i := range order {
+        text = strings.ReplaceAll(text, s.values[i], s.tokens[i])
+    }
+    return text
+}
+
+// Restore puts the original values back in place of the placeholders
+func (s *piiScrubber) Restore(text string) string {
+    for i, token := range s.tokens {
+        text = strings.ReplaceAll(text, token, s.values[i])
+    }
+    return text
+}
+
+// OllamaRecorder is an http.RoundTripper that records Ollama traffic to
+// fixture files or replays it from them. Fixtures are keyed by a hash of the
+// scrubbed request, so replay is deterministic and never needs the real PII:
+// the live request's values are substituted back into the recorded response.
+type OllamaRecorder struct {
+    mode string
+    dir  string
+    next http.RoundTripper
+}
+
+// NewOllamaRecorder creates a recorder for the given mode and fixture directory
+func NewOllamaRecorder(mode, dir string) (*OllamaRecorder, error) {
+    if mode != OllamaRecord && mode != OllamaReplay {
+        return nil, fmt.Errorf("unknown ollama mode %q", mode)
+    }
+    if mode == OllamaRecord {
+        if err := os.MkdirAll(dir, 0755); err != nil {
+            return nil, err
+        }
+    }
+    return &OllamaRecorder{mode: mode, dir: dir, next: http.DefaultTransport}, nil
+}
+
+// LoadOllamaRecorder reads OLLAMA_MODE and OLLAMA_FIXTURES; it returns nil in live mode
+func LoadOllamaRecorder() (*OllamaRecorder, error) {
+    mode := getEnv("OLLAMA_MODE", OllamaLive)
+    if mode == OllamaLive {
+        return nil, nil
+    }
+    rec, err := NewOllamaRecorder(mode, getEnv("OLLAMA_FIXTURES", "testdata/ollama"))
+    if err != nil {
+        return nil, err
+    }
+    slog.Info("ollama fixtures in use", "mode", mode, "dir", rec.dir)
+    return rec, nil
+}
+
+// fixturePath names the fixture file for a scrubbed request
+func (rec *OllamaRecorder) fixturePath(method, path, body string) string {
+    sum := sha256.Sum256([]byte(method + " " + path + "\n" + body))
+    name := strings.Trim(strings.ReplaceAll(path, "/", "_"), "_")
+    return filepath.Join(rec.dir, fmt.Sprintf("%s-%s.json", name, hex.EncodeToString(sum[:8])))
+}
+
+func (rec *OllamaRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+    var body []byte
+    if req.Body != nil {
+        var err error
+        if body, err = io.ReadAll(req.Body); err != nil {
+            return nil, err
+        }
+        req.Body.Close()
+        req.Body = io.NopCloser(bytes.NewReader(body))
+    }
+
+    scrubber := newPIIScrubber(string(body))
+    scrubbed := scrubber.Scrub(string(body))
+    path := rec.fixturePath(req.Method, req.URL.Path, scrubbed)
+
+    if rec.mode == OllamaReplay {
+        data, err := os.ReadFile(path)
+        if err != nil {
+            return nil, fmt.Errorf("ollama replay: no fixture for %s %s (%s)", req.Method, req.URL.Path, filepath.Base(path))
+        }
+        var fixture OllamaFixture
+        if err := json.Unmarshal(data, &fixture); err != nil {
+            return nil, fmt.Errorf("ollama replay: %s: %v", filepath.Base(path), err)
+        }
+        return &http.Response{
+            Status:     fmt.Sprintf("%d %s", fixture.Response.Status, http.StatusText(fixture.Response.Status)),
+            StatusCode: fixture.Response.Status,
+            Proto:      "HTTP/1.1",
+            ProtoMajor: 1,
+            ProtoMinor: 1,
+            Header:     http.Header{"Content-Type": {"application/json"}},
+            Body:       io.NopCloser(strings.NewReader(scrubber.Restore(fixture.Response.Body))),
+            Request:    req,
+        }, nil
+    }
+
+    resp, err := rec.next.RoundTrip(req)
+    if err != nil {
+        return nil, err
+    }
+    respBody, err := io.ReadAll(resp.Body)
+    resp.Body.Close()
+    if err != nil {
+        return nil, err
+    }
+    resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+    var fixture OllamaFixture
+    fixture.Request.Method = req.Method
+    fixture.Request.Path = req.URL.Path
+    fixture.Request.Body = scrubbed
+    fixture.Response.Status = resp.StatusCode
+    fixture.Response.Body = scrubber.Scrub(string(respBody))
+    data, err := json.MarshalIndent(fixture, "", "  ")
+    if err == nil {
+        err = os.WriteFile(path, data, 0644)
+    }
+    if err != nil {
+        reqctx.Logger(req.Context()).Error("recording ollama fixture failed", "error", err)
+    }
+    return resp, nil
+}
@@ -0,0 +1,761 @@
+package main
+
+import (
+    "embed"
+    "encoding/json"
+    "net/http"
+    "reflect"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "unicode"
+    "github.com/gorilla/mux"
+    "student-api/reqctx"
+)
+
+// swaggerUI holds the Swagger UI assets served under /docs; see
+// swagger-ui/NOTICE
+//
+//go:embed swagger-ui/swagger-ui-bundle.js swagger-ui/swagger-ui.css
+var swaggerUI embed.FS
+
+// swaggerPage loads Swagger UI on /openapi.json
+const swaggerPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Student API</title>
+<link rel="stylesheet" href="/docs/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="/docs/swagger-ui-bundle.js"></script>
+<script>
+window.ui = SwaggerUIBundle({url: "/openapi.json", dom_id: "#swagger-ui", deepLinking: true});
+</script>
+</body>
+</html>
+`
+
+// Media types of documented bodies
+const (
+    mediaJSON      = "application/json"
+    mediaMultipart = "multipart/form-data"
+    mediaCSV       = "text/csv"
+    mediaGzip      = "application/gzip"
+)
+
+// apiParam is a query or form parameter of a documented operation; kind is
+// string, integer or boolean
+type apiParam struct {
+    name, kind, description string
+}
+
+// apiOperation documents one method of a route. request and response are
+// zero values whose types give the JSON body schemas; nil means no body, or
+// a file for the other media types.
+type apiOperation struct {
+    id      string
+    summary string
+    query   []apiParam
+    request interface{}
+    // requestTypes default to JSON when there is a request
+    requestTypes []string
+    // form lists the multipart fields besides the "file" upload
+    form     []apiParam
+    response interface{}
+    // responseTypes default to JSON
+    responseTypes []string
+    // status is the success status, 200 by default
+    status int
+    // admin marks routes behind requireAdmin
+    admin bool
+}
+
+// Query parameters shared by the student list routes
+var (
+    studentFilterParams = []apiParam{
+        {"filter", "string", `Filter expression, e.g. age>=18 AND email endswith "@school.edu"`},
+        {"name", "string", "Name contains"},
+        {"email", "string", "Email equals"},
+        {"min_age", "integer", "Minimum age"},
+        {"max_age", "integer", "Maximum age"},
+        {"sort", "string", "Comma-separated sort fields, - for descending, e.g. age,-name"},
+    }
+    pageParams = []apiParam{
+        {"limit", "integer", "Page size; with offset, answers a page instead of a bare array"},
+        {"offset", "integer", "Students to skip"},
+    }
+    auditParams = []apiParam{
+        {"actor", "string", "Who made the request"},
+        {"action", "string", "Comma-separated actions: read, create, update, delete, restore"},
+        {"request_id", "string", "Request ID"},
+        {"route", "string", "Route template, e.g. /students/{id}"},
+        {"since", "string", "RFC 3339 timestamp or date the events start at"},
+        {"until", "string", "RFC 3339 timestamp or date the events end at"},
+        {"before", "integer", "Continue below this event ID"},
+        {"limit", "integer", "Maximum events"},
+    }
+)
+
+// Request bodies the handlers decode into anonymous structs
+type (
+    loginRequest struct {
+        Username string `json:"username"`
+        Password string `json:"password"`
+    }
+    refreshRequest struct {
+        RefreshToken string `json:"refresh_token"`
+    }
+    passwordChangeRequest struct {
+        CurrentPassword string `json:"current_password"`
+        NewPassword     string `json:"new_password"`
+    }
+    passwordResetRequest struct {
+        Login string `json:"login"`
+    }
+    passwordResetConfirmation struct {
+        Token    string `json:"token"`
+        Password string `json:"password"`
+    }
+    attendanceReview struct {
+        Confirm []int `json:"confirm"`
+        Reject  []int `json:"reject"`
+    }
+    conflictResolution struct {
+        Resolution string `json:"resolution"`
+    }
+    logLevelChange struct {
+        Level string `json:"level"`
+    }
+    registrationVerification struct {
+        Token string `json:"token"`
+    }
+    registrationRejection struct {
+        Reason string `json:"reason,omitempty"`
+    }
+    invitationLookup struct {
+        Token string `json:"token"`
+    }
+    summaryTemplatePreview struct {
+        StudentID int                     `json:"student_id,omitempty"`
+        Template  *SummaryTemplateRequest `json:"template,omitempty"`
+    }
+)
+
+// apiOperations documents every route of newRouter by method and route
+// template. Routes missing here are still listed, without bodies.
+var apiOperations = map[string]apiOperation{
+    "POST /auth/login":                            {id: "login", summary: "Log in with a username and password", request: loginRequest{}, response: TokenPair{}},
+    "POST /auth/refresh":                          {id: "refreshToken", summary: "Exchange a refresh token for a new token pair", request: refreshRequest{}, response: TokenPair{}},
+    "POST /auth/register":                         {id: "register", summary: "Register a readonly account", request: UserRequest{}, response: User{}, status: http.StatusCreated},
+    "PUT /auth/password":                          {id: "changePassword", summary: "Change the caller's password", request: passwordChangeRequest{}, status: http.StatusNoContent},
+    "POST /auth/password-reset":                   {id: "requestPasswordReset", summary: "Email a password reset link", request: passwordResetRequest{}, response: map[string]string{}, status: http.StatusAccepted},
+    "POST /auth/password-reset/confirm":           {id: "confirmPasswordReset", summary: "Set a new password with a reset token", request: passwordResetConfirmation{}, status: http.StatusNoContent},
+    "POST /register":                              {id: "registerStudent", summary: "Ask to be enrolled as a student", request: RegistrationRequest{}, response: map[string]string{}, status: http.StatusAccepted},
+    "POST /register/verify":                       {id: "verifyRegistration", summary: "Confirm a registration's email address", request: registrationVerification{}, response: map[string]string{}},
+    "POST /invitations/lookup":                    {id: "previewInvitation", summary: "Show what an invitation pre-fills", request: invitationLookup{}, response: InvitationPreview{}},
+    "POST /invitations/redeem":                    {id: "redeemInvitation", summary: "Redeem an invitation, creating the student and an account", request: InvitationRedemption{}, response: redeemedInvitation{}, status: http.StatusCreated},
+    "POST /students":                              {id: "createStudent", summary: "Create a student", request: Student{}, response: Student{}, status: http.StatusCreated},
+    "GET /students":                               {id: "listStudents", summary: "List students, filtered and sorted, as an array or a page", query: append(append([]apiParam{{"include_deleted", "boolean", "Also list deleted students that have not been purged"}}, studentFilterParams...), pageParams...), response: apiOneOf{[]Student{}, StudentPage{}}},
+    "DELETE /students":                            {id: "bulkDeleteStudents", summary: "Delete students by ID", query: []apiParam{{"ids", "string", "Comma-separated student IDs"}}, response: BulkDeleteResult{}},
+    "POST /students/ingest/roster":                {id: "ingestRoster", summary: "Extract candidate students from a roster scan", requestTypes: []string{mediaMultipart}, response: rosterCandidates{}},
+    "GET /students/export":                        {id: "exportStudents", summary: "Export students as CSV or XLSX", query: append([]apiParam{{"format", "string", "csv (default) or xlsx"}, {"after", "string", "Resume a CSV export after this row's sort fields"}}, studentFilterParams...), responseTypes: []string{mediaCSV, xlsxContentType}},
+    "GET /students/search":                        {id: "searchStudents", summary: "Search students by name and email", query: []apiParam{{"q", "string", "Search words"}, {"limit", "integer", "Maximum results"}}, response: []SearchResult{}},
+    "POST /students/bulk":                         {id: "bulkCreateStudents", summary: "Create students in one request", request: []Student{}, response: BulkCreateResult{}, status: http.StatusCreated},
+    "PUT /students/bulk":                          {id: "bulkUpdateStudents", summary: "Update students in one request", request: []Student{}, response: BulkUpdateResult{}},
+    "PUT /students/bulk-upsert":                   {id: "bulkUpsertStudents", summary: "Create or update students matched by a key", request: BulkUpsertRequest{}, response: BulkUpsertResult{}},
+    "POST /students/import":                       {id: "importStudents", summary: "Import a roster CSV in one step", query: []apiParam{{"dry_run", "boolean", "Report the changes without writing"}, {"profile", "string", "Import profile mapping the columns"}}, requestTypes: []string{mediaMultipart, mediaCSV}, response: ImportReport{}},
+    "GET /students/{id}":                          {id: "getStudent", summary: "Get a student", query: []apiParam{{"as_of", "string", "RFC 3339 time to read the student as it was then"}}, response: Student{}},
+    "PUT /students/{id}":                          {id: "updateStudent", summary: "Replace a student", request: Student{}, response: Student{}},
+    "PATCH /students/{id}":                        {id: "patchStudent", summary: "Change some fields of a student", request: map[string]interface{}{}, requestTypes: []string{"application/merge-patch+json"}, response: Student{}},
+    "DELETE /students/{id}":                       {id: "deleteStudent", summary: "Delete a student, keeping it restorable until purged", status: http.StatusNoContent},
+    "POST /students/{id}/restore":                 {id: "restoreStudent", summary: "Restore a deleted student", response: Student{}},
+    "GET /students/{id}/versions":                 {id: "listStudentVersions", summary: "List every version of a student", response: []StudentVersion{}},
+    "GET /students/{id}/diff":                     {id: "diffStudentVersions", summary: "Compare two versions of a student", query: []apiParam{{"from", "integer", "Earlier version"}, {"to", "integer", "Later version, the latest by default"}}, response: studentDiff{}},
+    "GET /students/{id}/access":                   {id: "getStudentAccess", summary: "List who read a student's record", query: []apiParam{{"limit", "integer", "Maximum accesses"}}, response: studentAccessReport{}},
+    "GET /students/{id}/history":                  {id: "getStudentHistory", summary: "List who changed a student when, with old and new values", query: auditParams, response: studentHistory{}},
+    "GET /students/{id}/summary":                  {id: "getStudentSummary", summary: "Generate or fetch the cached summary of a student", response: SummaryResponse{}},
+    "GET /students/{id}/summary/audio":            {id: "getStudentSummaryAudio", summary: "Read the summary aloud", query: []apiParam{{"format", "string", "mp3 (default) or ogg"}}, responseTypes: []string{"audio/mpeg", "audio/ogg"}},
+    "POST /students/{id}/summary/feedback":        {id: "createSummaryFeedback", summary: "Rate a summary", request: SummaryFeedback{}, response: SummaryFeedback{}, status: http.StatusCreated},
+    "GET /students/{id}/notes":                    {id: "listNotes", summary: "List a student's notes", response: []Note{}},
+    "POST /students/{id}/notes/audio":             {id: "createAudioNote", summary: "Transcribe a voice note", requestTypes: []string{mediaMultipart}, response: Note{}, status: http.StatusCreated},
+    "PUT /students/{id}/photo":                    {id: "putStudentPhoto", summary: "Enroll a reference photo for attendance", requestTypes: []string{mediaMultipart}, form: []apiParam{{"consent", "boolean", "Consent to face matching, required"}}, response: StudentPhoto{}},
+    "DELETE /students/{id}/photo":                 {id: "deleteStudentPhoto", summary: "Remove a student's reference photo", status: http.StatusNoContent},
+    "POST /graphql":                               {id: "graphql", summary: "Run a GraphQL query or mutation over students", request: graphqlRequest{}, response: graphqlResponse{}},
+    "GET /graphql/ws":                             {id: "serveGraphQLSocket", summary: "Run GraphQL subscriptions over WebSocket (graphql-transport-ws)", status: http.StatusSwitchingProtocols},
+    "GET /schema":                                 {id: "getSchema", summary: "Describe the data model: entities, fields, types and validation rules", response: DataSchema{}},
+    "GET /audit":                                  {id: "listAudit", summary: "List the audit log for compliance reviews, newest first", query: append([]apiParam{{"student_id", "integer", "Student written"}}, auditParams...), response: auditListing{}},
+    "POST /attendance/photo":                      {id: "matchClassPhoto", summary: "Propose attendance from a class photo", requestTypes: []string{mediaMultipart}, response: AttendanceProposal{}, status: http.StatusCreated},
+    "GET /attendance/photo/{id}":                  {id: "getAttendanceProposal", summary: "Get an attendance proposal", response: AttendanceProposal{}},
+    "POST /attendance/photo/{id}/review":          {id: "reviewAttendanceProposal", summary: "Confirm or reject proposed matches", request: attendanceReview{}, response: AttendanceProposal{}},
+    "GET /summary/feedback/metrics":               {id: "getSummaryFeedbackMetrics", summary: "Summary ratings by model and variant", response: []FeedbackMetrics{}},
+    "GET /summary/variants/report":                {id: "getPromptVariantReport", summary: "Compare the prompt variants", response: []VariantReport{}},
+    "GET /llm/quota":                              {id: "getLLMQuota", summary: "The caller's remaining model call quota", response: LLMQuotaStatus{}},
+    "GET /import-profiles":                        {id: "listImportProfiles", summary: "List import profiles", response: []ImportProfile{}},
+    "GET /import-profiles/{name}":                 {id: "getImportProfile", summary: "Get an import profile", response: ImportProfile{}},
+    "PUT /import-profiles/{name}":                 {id: "putImportProfile", summary: "Create or replace an import profile", request: ImportProfile{}, response: ImportProfile{}},
+    "DELETE /import-profiles/{name}":              {id: "deleteImportProfile", summary: "Delete an import profile", status: http.StatusNoContent},
+    "POST /imports":                               {id: "createImport", summary: "Stage a roster CSV for review", query: []apiParam{{"conflict_policy", "string", "How to treat rows matching existing students"}, {"profile", "string", "Import profile mapping the columns"}}, requestTypes: []string{mediaMultipart}, response: ImportBatch{}, status: http.StatusCreated},
+    "GET /imports":                                {id: "listImports", summary: "List staged imports", response: []ImportBatch{}},
+    "GET /imports/{id}":                           {id: "getImport", summary: "Get a staged import with its rows", response: ImportBatch{}},
+    "DELETE /imports/{id}":                        {id: "deleteImport", summary: "Discard a staged import", status: http.StatusNoContent},
+    "POST /imports/{id}/commit":                   {id: "commitImport", summary: "Write a staged import", response: ImportBatch{}},
+    "GET /conflicts":                              {id: "listConflicts", summary: "List import conflicts", query: []apiParam{{"status", "string", "Only conflicts with this status"}}, response: []Conflict{}},
+    "GET /conflicts/{id}":                         {id: "getConflict", summary: "Get an import conflict", response: Conflict{}},
+    "POST /conflicts/{id}/resolve":                {id: "resolveConflict", summary: "Resolve an import conflict", request: conflictResolution{}, response: Conflict{}},
+    "POST /undo/{operation_id}":                   {id: "undoOperation", summary: "Undo a recent change by its X-Operation-ID", response: undoResult{}},
+    "GET /events":                                 {id: "streamEvents", summary: "Stream student changes as Server-Sent Events", query: []apiParam{{"types", "string", "Comma-separated event types"}, {"fields", "string", "Only changes touching one of these comma-separated fields"}, {"since", "integer", "Resume after this event ID, as Last-Event-ID does"}}, responseTypes: []string{"text/event-stream"}},
+    "GET /ws":                                     {id: "serveEventSocket", summary: "Subscribe to student changes over WebSocket", query: []apiParam{{"ids", "string", "Comma-separated student IDs"}, {"types", "string", "Comma-separated event types"}, {"fields", "string", "Only changes touching one of these comma-separated fields"}}, status: http.StatusSwitchingProtocols},
+    "GET /sync/snapshot":                          {id: "getSyncSnapshot", summary: "Download every student as a tar.gz snapshot", responseTypes: []string{mediaGzip}},
+    "GET /sync/checksums":                         {id: "getSyncChecksums", summary: "Checksums of the students by bucket", query: []apiParam{{"buckets", "integer", "Number of buckets"}}, response: ChecksumReport{}},
+    "GET /sync/buckets/{bucket}":                  {id: "getSyncBucket", summary: "The students of one checksum bucket", query: []apiParam{{"buckets", "integer", "Number of buckets"}}, response: syncBucket{}},
+    "GET /sync/delta":                             {id: "getSyncDelta", summary: "Changes since a sequence number", query: []apiParam{{"since", "integer", "Sequence number of the last sync"}, {"fields", "string", "Comma-separated fields to return"}}, response: DeltaResponse{}},
+    "GET /healthz":                                {id: "healthz", summary: "Liveness, build and leadership", response: health{}},
+    "GET /readyz":                                 {id: "readyz", summary: "Readiness of the language models", response: ModelStatus{}},
+    "GET /metrics":                                {id: "metrics", summary: "Prometheus metrics", responseTypes: []string{"text/plain"}},
+    "GET /version":                                {id: "version", summary: "Build information", response: BuildInfo{}},
+    "GET /openapi.json":                           {id: "openAPI", summary: "This OpenAPI document", response: map[string]interface{}{}},
+    "GET /docs":                                   {id: "docs", summary: "Swagger UI for this document", responseTypes: []string{"text/html"}},
+    "GET /admin/loglevel":                         {id: "getLogLevel", summary: "Get the log level", response: logLevelChange{}, admin: true},
+    "PUT /admin/loglevel":                         {id: "putLogLevel", summary: "Change the log level", request: logLevelChange{}, response: logLevelChange{}, admin: true},
+    "PUT /admin/tenants/{tenant}":                 {id: "provisionTenant", summary: "Create a tenant's database", response: tenantProvision{}, status: http.StatusCreated, admin: true},
+    "GET /admin/tenants/{tenant}/export":          {id: "exportTenant", summary: "Export a tenant's data as a snapshot archive", responseTypes: []string{mediaGzip}, admin: true},
+    "POST /admin/tenants/{tenant}/import":         {id: "importTenant", summary: "Import a snapshot archive into a tenant", requestTypes: []string{mediaGzip}, response: TenantImportReport{}, admin: true},
+    "POST /admin/api-keys":                        {id: "createAPIKey", summary: "Issue a service API key or a read-only token", request: APIKeyRequest{}, response: issuedAPIKey{}, status: http.StatusCreated, admin: true},
+    "GET /admin/api-keys":                         {id: "listAPIKeys", summary: "List API keys", response: []APIKey{}, admin: true},
+    "DELETE /admin/api-keys/{id}":                 {id: "revokeAPIKey", summary: "Revoke an API key", response: APIKey{}, admin: true},
+    "POST /admin/users":                           {id: "createUser", summary: "Create a user account", request: UserRequest{}, response: User{}, status: http.StatusCreated, admin: true},
+    "GET /admin/users":                            {id: "listUsers", summary: "List user accounts", response: []User{}, admin: true},
+    "POST /admin/users/{username}/unlock":         {id: "unlockUser", summary: "Unlock an account locked out by failed logins", response: User{}, admin: true},
+    "POST /admin/users/{username}/password-reset": {id: "issuePasswordReset", summary: "Issue a password reset token for a user", response: issuedResetToken{}, status: http.StatusCreated, admin: true},
+    "GET /admin/pending":                          {id: "listPendingRegistrations", summary: "List registrations awaiting approval", query: []apiParam{{"status", "string", "unverified, pending (default), approved or rejected"}}, response: []Registration{}, admin: true},
+    "POST /admin/pending/{id}/approve":            {id: "approveRegistration", summary: "Approve a registration, creating its student", response: Registration{}, admin: true},
+    "POST /admin/pending/{id}/reject":             {id: "rejectRegistration", summary: "Reject a registration", request: registrationRejection{}, response: Registration{}, admin: true},
+    "POST /admin/invitations":                     {id: "createInvitation", summary: "Issue a single-use invitation link", request: InvitationRequest{}, response: issuedInvitation{}, status: http.StatusCreated, admin: true},
+    "GET /admin/invitations":                      {id: "listInvitations", summary: "List invitations", query: []apiParam{{"status", "string", "open, redeemed, revoked or expired"}}, response: []Invitation{}, admin: true},
+    "DELETE /admin/invitations/{id}":              {id: "revokeInvitation", summary: "Revoke an open invitation", response: Invitation{}, admin: true},
+    "POST /admin/webhooks":                        {id: "createWebhook", summary: "Register a webhook for student changes", request: WebhookRequest{}, response: createdWebhook{}, status: http.StatusCreated, admin: true},
+    "GET /admin/webhooks":                         {id: "listWebhooks", summary: "List webhooks", response: []Webhook{}, admin: true},
+    "DELETE /admin/webhooks/{id}":                 {id: "deleteWebhook", summary: "Delete a webhook and its deliveries", status: http.StatusNoContent, admin: true},
+    "GET /admin/webhooks/{id}/deliveries":         {id: "listWebhookDeliveries", summary: "List a webhook's deliveries, newest first", query: []apiParam{{"status", "string", "pending, delivered or dead"}, {"from", "string", "RFC 3339 time of the earliest delivery"}, {"to", "string", "RFC 3339 time the deliveries are before"}, {"limit", "integer", "Maximum results, default 100"}}, response: []WebhookDelivery{}, admin: true},
+    "GET /admin/webhooks/dead-letters":            {id: "listDeadLetters", summary: "List dead webhook deliveries, oldest first", query: []apiParam{{"webhook_id", "integer", "Only this webhook's deliveries"}, {"from", "string", "RFC 3339 time of the earliest delivery"}, {"to", "string", "RFC 3339 time the deliveries are before"}, {"limit", "integer", "Maximum results, default 100"}}, response: []WebhookDelivery{}, admin: true},
+    "POST /admin/webhooks/deliveries/{id}/replay": {id: "replayDelivery", summary: "Send a dead delivery again, as it was first sent", response: WebhookDelivery{}, status: http.StatusAccepted, admin: true},
+    "POST /webhooks/deliveries/{id}/replay":       {id: "replayWebhookDelivery", summary: "Send a dead delivery again; the same as POST /admin/webhooks/deliveries/{id}/replay", response: WebhookDelivery{}, status: http.StatusAccepted, admin: true},
+    "POST /admin/webhooks/dead-letters/replay":    {id: "replayDeadLetters", summary: "Send again the dead deliveries created in a time range", request: deadLetterReplay{}, response: replayedDeadLetters{}, status: http.StatusAccepted, admin: true},
+    "GET /admin/summary-template":                 {id: "getSummaryTemplate", summary: "Show the tenant's summary template", response: SummaryTemplate{}, admin: true},
+    "PUT /admin/summary-template":                 {id: "putSummaryTemplate", summary: "Set the tenant's summary prompt, fields, tone and language", request: SummaryTemplateRequest{}, response: SummaryTemplate{}, admin: true},
+    "DELETE /admin/summary-template":              {id: "deleteSummaryTemplate", summary: "Return the tenant to the default summaries", status: http.StatusNoContent, admin: true},
+    "POST /admin/summary-template/preview":        {id: "previewSummaryTemplate", summary: "Render the summary prompt for a student without calling the model", request: summaryTemplatePreview{}, response: SummaryTemplatePreview{}, admin: true},
+    "POST /admin/honeypots":                       {id: "plantHoneypot", summary: "Plant a honeypot student", request: HoneypotRequest{}, response: plantedHoneypot{}, status: http.StatusCreated, admin: true},
+    "GET /admin/honeypots":                        {id: "listHoneypots", summary: "List honeypot students", response: []Honeypot{}, admin: true},
+    "DELETE /admin/honeypots/{id}":                {id: "removeHoneypot", summary: "Remove a honeypot student", status: http.StatusNoContent, admin: true},
+    "POST /admin/reports/query":                   {id: "runReport", summary: "Run a read-only SQL report", request: ReportRequest{}, response: ReportResult{}, responseTypes: []string{mediaJSON, mediaCSV}, admin: true},
+    "GET /admin/shadow":                           {id: "getShadowStatus", summary: "Shadow backend comparison counts and divergences", response: ShadowStatus{}, admin: true},
+    "POST /admin/shadow/verify":                   {id: "verifyShadow", summary: "Compare the shadow backend with the primary", query: []apiParam{{"repair", "boolean", "Copy differing students to the shadow"}}, response: ShadowVerification{}, admin: true},
+    "GET /admin/reports":                          {id: "listSavedReports", summary: "List saved reports", response: []SavedReport{}, admin: true},
+    "GET /admin/reports/{name}":                   {id: "getSavedReport", summary: "Get a saved report", response: SavedReport{}, admin: true},
+    "PUT /admin/reports/{name}":                   {id: "putSavedReport", summary: "Create or replace a saved report", request: SavedReport{}, response: SavedReport{}, admin: true},
+    "DELETE /admin/reports/{name}":                {id: "deleteSavedReport", summary: "Delete a saved report", status: http.StatusNoContent, admin: true},
+    "POST /admin/reports/{name}/run":              {id: "runSavedReport", summary: "Run a saved report now", response: ReportRun{}, admin: true},
+    "GET /admin/reports/{name}/runs":              {id: "listReportRuns", summary: "Recent runs of a saved report", response: []ReportRun{}, admin: true},
+}
+
+// Responses the handlers encode from maps or anonymous structs
+type (
+    rosterCandidates struct {
+        Candidates []RosterCandidate `json:"candidates"`
+        Text       string            `json:"text"`
+    }
+    studentDiff struct {
+        StudentID int                    `json:"student_id"`
+        From      StudentVersion         `json:"from"`
+        To        StudentVersion         `json:"to"`
+        Changes   map[string]FieldChange `json:"changes"`
+    }
+    studentAccessReport struct {
+        StudentID int             `json:"student_id"`
+        Mode      string          `json:"mode"`
+        Accesses  []StudentAccess `json:"accesses"`
+        Actors    []AccessActor   `json:"actors"`
+    }
+    studentHistory struct {
+        StudentID int          `json:"student_id"`
+        Events    []AuditEvent `json:"events"`
+        Next      *string      `json:"next"`
+    }
+    auditListing struct {
+        Events []AuditEvent `json:"events"`
+        Next   *string      `json:"next"`
+    }
+    graphqlResponse struct {
+        Data   map[string]interface{}   `json:"data,omitempty"`
+        Errors []map[string]interface{} `json:"errors,omitempty"`
+    }
+    undoResult struct {
+        Undone    int            `json:"undone"`
+        Operation StudentVersion `json:"operation"`
+    }
+    syncBucket struct {
+        Seq      int64     `json:"seq"`
+        Bucket   int       `json:"bucket"`
+        Buckets  int       `json:"buckets"`
+        SHA256   string    `json:"sha256"`
+        Students []Student `json:"students"`
+    }
+    health struct {
+        Status string       `json:"status"`
+        Build  BuildInfo    `json:"build"`
+        Leader LeaderStatus `json:"leadership"`
+    }
+    issuedAPIKey struct {
+        Key    APIKey `json:"key"`
+        Secret string `json:"secret"`
+    }
+    issuedResetToken struct {
+        Token     string    `json:"token"`
+        ExpiresAt time.Time `json:"expires_at"`
+    }
+    issuedInvitation struct {
+        Invitation Invitation `json:"invitation"`
+        Token      string     `json:"token"`
+        Link       string     `json:"link"`
+    }
+    redeemedInvitation struct {
+        Invitation Invitation `json:"invitation"`
+        Student    Student    `json:"student"`
+    }
+    createdWebhook struct {
+        Webhook Webhook `json:"webhook"`
+        Secret  string  `json:"secret"`
+    }
+    replayedDeadLetters struct {
+        Replayed int  `json:"replayed"`
+        Skipped  int  `json:"skipped"`
+        More     bool `json:"more"`
+    }
+    plantedHoneypot struct {
+        Honeypot Honeypot `json:"honeypot"`
+        Student  Student  `json:"student"`
+    }
+)
+
+// apiOneOf documents a response that is one of several types
+type apiOneOf []interface{}
+
+// integerPathParams are the route variables the handlers parse as integers
+var integerPathParams = map[string]bool{"id": true, "operation_id": true, "bucket": true}
+
+// readOnlyFields are set by the server and ignored in request bodies
+var readOnlyFields = map[reflect.Type]map[string]bool{
+    reflect.TypeOf(Student{}): {"id": true, "updated_at": true, "deleted_at": true},
+}
+
+// undocumentedRoutes serve the documentation itself
+var undocumentedRoutes = map[string]bool{"/docs/{file}": true}
+
+// OpenAPIDoc is the OpenAPI 3 document of a router's routes. It is built on
+// first use, once newRouter has registered every route.
+type OpenAPIDoc struct {
+    app    *App
+    router *mux.Router
+    once   sync.Once
+    doc    []byte
+    err    error
+}
+
+func newOpenAPIDoc(app *App, router *mux.Router) *OpenAPIDoc {
+    return &OpenAPIDoc{app: app, router: router}
+}
+
+// JSON returns the encoded document
+func (d *OpenAPIDoc) JSON() ([]byte, error) {
+    d.once.Do(func() {
+        var doc map[string]interface{}
+        if doc, d.err = d.build(); d.err == nil {
+            d.doc, d.err = json.MarshalIndent(doc, "", "  ")
+        }
+    })
+    return d.doc, d.err
+}
+
+// build walks the router: every route template becomes a path and each of
+// its methods an operation, described by apiOperations. Routes whose feature
+// flag is off are left out, as they answer 404.
+func (d *OpenAPIDoc) build() (map[string]interface{}, error) {
+    schemas := &schemaBuilder{components: make(map[string]interface{})}
+    paths := make(map[string]interface{})
+    err := d.router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+        template, err := route.GetPathTemplate()
+        if err != nil || undocumentedRoutes[template] {
+            return nil
+        }
+        methods, err := route.GetMethods()
+        if err != nil {
+            return nil
+        }
+        path, params := openAPIPath(template)
+        item, _ := paths[path].(map[string]interface{})
+        if item == nil {
+            item = make(map[string]interface{})
+            paths[path] = item
+        }
+        for _, method := range methods {
+            policy := d.app.routes.For(method, template)
+            if policy != nil && policy.Feature != "" && !d.app.routes.Enabled(policy.Feature) {
+                continue
+            }
+            item[strings.ToLower(method)] = d.operation(schemas, method, template, params, policy)
+        }
+        if len(item) == 0 {
+            delete(paths, path)
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    schemas.schema(reflect.TypeOf(errorEnvelope{}))
+    return map[string]interface{}{
+        "openapi": "3.0.3",
+        "info": map[string]interface{}{
+            "title":       "Student API",
+            "version":     buildInfo().Version,
+            "description": "Errors answer with an error envelope; see the ErrorEnvelope schema.",
+        },
+        "paths": paths,
+        "components": map[string]interface{}{
+            "schemas": schemas.components,
+            "responses": map[string]interface{}{
+                "Error": map[string]interface{}{
+                    "description": "Error",
+                    "content":     map[string]interface{}{mediaJSON: map[string]interface{}{"schema": componentRef("ErrorEnvelope")}},
+                },
+            },
+            "securitySchemes": map[string]interface{}{
+                "bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer", "description": "Access token from /auth/login, or an API token"},
+                "apiKey":     map[string]interface{}{"type": "apiKey", "in": "header", "name": apiKeyHeader},
+                "adminToken": map[string]interface{}{"type": "http", "scheme": "bearer", "description": "ADMIN_TOKEN, or an admin's access token"},
+            },
+        },
+    }, nil
+}
+
+// openAPIPath converts a route template to an OpenAPI path and its path
+// parameters, dropping variable patterns: /students/{id:[0-9]+} is
+// /students/{id}
+func openAPIPath(template string) (string, []interface{}) {
+    var params []interface{}
+    segments := strings.Split(template, "/")
+    for i, segment := range segments {
+        if !strings.HasPrefix(segment, "{") || !strings.HasSuffix(segment, "}") {
+            continue
+        }
+        name, _, _ := strings.Cut(segment[1:len(segment)-1], ":")
+        segments[i] = "{" + name + "}"
+        kind := "string"
+        if integerPathParams[name] {
+            kind = "integer"
+        }
+        params = append(params, map[string]interface{}{"name": name, "in": "path", "required": true, "schema": map[string]interface{}{"type": kind}})
+    }
+    return strings.Join(segments, "/"), params
+}
+
+func (d *OpenAPIDoc) operation(schemas *schemaBuilder, method, template string, pathParams []interface{}, policy *RoutePolicy) map[string]interface{} {
+    op, documented := apiOperations[policyKey(method, template)]
+    if !documented {
+        op.id = strings.ToLower(method) + operationName(template)
+    }
+    out := map[string]interface{}{"operationId": op.id, "tags": []string{operationTag(template)}}
+    if op.summary != "" {
+        out["summary"] = op.summary
+    }
+
+    params := append([]interface{}{}, pathParams...)
+    for _, p := range op.query {
+        params = append(params, map[string]interface{}{"name": p.name, "in": "query", "description": p.description, "schema": map[string]interface{}{"type": p.kind}})
+    }
+    if d.app.tenants != nil && !tenantFreeRoutes[template] {
+        params = append(params, map[string]interface{}{"name": "X-Tenant-ID", "in": "header", "required": true, "schema": map[string]interface{}{"type": "string"}})
+    }
+    if len(params) > 0 {
+        out["parameters"] = params
+    }
+
+    requestTypes := op.requestTypes
+    if len(requestTypes) == 0 && op.request != nil {
+        requestTypes = []string{mediaJSON}
+    }
+    if len(requestTypes) > 0 {
+        content := make(map[string]interface{})
+        for _, mediaType := range requestTypes {
+            content[mediaType] = map[string]interface{}{"schema": schemas.body(mediaType, op.request, op.form)}
+        }
+        out["requestBody"] = map[string]interface{}{"required": true, "content": content}
+    }
+
+    status := op.status
+    if status == 0 {
+        status = http.StatusOK
+    }
+    success := map[string]interface{}{"description": http.StatusText(status)}
+    responseTypes := op.responseTypes
+    if len(responseTypes) == 0 && op.response != nil {
+        responseTypes = []string{mediaJSON}
+    }
+    if len(responseTypes) > 0 && status != http.StatusNoContent {
+        content := make(map[string]interface{})
+        for _, mediaType := range responseTypes {
+            content[mediaType] = map[string]interface{}{"schema": schemas.body(mediaType, op.response, nil)}
+        }
+        success["content"] = content
+    }
+    out["responses"] = map[string]interface{}{
+        strconv.Itoa(status): success,
+        "default":            map[string]interface{}{"$ref": "#/components/responses/Error"},
+    }
+
+    if security := d.security(method, template, op); security != nil {
+        out["security"] = security
+    }
+    return out
+}
+
+// security lists the credentials an operation takes: the admin token or an
+// admin's bearer token or API key for admin routes, otherwise a bearer token or API key where authentication is
+// configured, optional unless the route requires it
+func (d *OpenAPIDoc) security(method, template string, op apiOperation) []map[string][]string {
+    if op.admin {
+        return []map[string][]string{{"adminToken": {}}, {"apiKey": {}}}
+    }
+    if !d.app.authEnabled() || !d.app.authRequired(method, template) {
+        return nil
+    }
+    return []map[string][]string{{"bearerAuth": {}}, {"apiKey": {}}}
+}
+
+// operationName turns a route template into the camel-case part of a
+// generated operation ID: /students/{id}/notes is StudentsIdNotes
+func operationName(template string) string {
+    var b strings.Builder
+    upper := true
+    for _, r := range template {
+        if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+            upper = true
+            continue
+        }
+        if upper {
+            r = unicode.ToUpper(r)
+        }
+        b.WriteRune(r)
+        upper = false
+    }
+    return b.String()
+}
+
+// operationTag groups operations by their first path segment
+func operationTag(template string) string {
+    tag, _, _ := strings.Cut(strings.TrimPrefix(template, "/"), "/")
+    return tag
+}
+
+func componentRef(name string) map[string]interface{} {
+    return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+// schemaBuilder derives JSON schemas from Go types the way encoding/json
+// encodes them, collecting named structs as components
+type schemaBuilder struct {
+    components map[string]interface{}
+}
+
+// body is the schema of a request or response body: the JSON schema of the
+// example value's type, a multipart form with a file, or a file
+func (b *schemaBuilder) body(mediaType string, example interface{}, form []apiParam) map[string]interface{} {
+    switch {
+    case mediaType == mediaMultipart:
+        properties := map[string]interface{}{"file": map[string]interface{}{"type": "string", "format": "binary"}}
+        for _, p := range form {
+            properties[p.name] = map[string]interface{}{"type": p.kind, "description": p.description}
+        }
+        return map[string]interface{}{"type": "object", "properties": properties, "required": []string{"file"}}
+    case example == nil || !strings.HasSuffix(mediaType, "json"):
+        return map[string]interface{}{"type": "string", "format": "binary"}
+    }
+    if alternatives, ok := example.(apiOneOf); ok {
+        var oneOf []interface{}
+        for _, alternative := range alternatives {
+            oneOf = append(oneOf, b.schema(reflect.TypeOf(alternative)))
+        }
+        return map[string]interface{}{"oneOf": oneOf}
+    }
+    return b.schema(reflect.TypeOf(example))
+}
+
+var (
+    timeType       = reflect.TypeOf(time.Time{})
+    durationType   = reflect.TypeOf(time.Duration(0))
+    rawMessageType = reflect.TypeOf(json.RawMessage(nil))
+)
+
+func (b *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+    switch t {
+    case timeType:
+        return map[string]interface{}{"type": "string", "format": "date-time"}
+    case durationType:
+        return map[string]interface{}{"type": "integer", "format": "int64", "description": "Nanoseconds"}
+    case rawMessageType:
+        return map[string]interface{}{}
+    }
+    switch t.Kind() {
+    case reflect.Pointer:
+        elem := b.schema(t.Elem())
+        if _, ref := elem["$ref"]; ref {
+            return map[string]interface{}{"allOf": []interface{}{elem}, "nullable": true}
+        }
+        elem["nullable"] = true
+        return elem
+    case reflect.Bool:
+        return map[string]interface{}{"type": "boolean"}
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32:
+        return map[string]interface{}{"type": "integer"}
+    case reflect.Int64:
+        return map[string]interface{}{"type": "integer", "format": "int64"}
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return map[string]interface{}{"type": "integer", "minimum": 0}
+    case reflect.Float32, reflect.Float64:
+        return map[string]interface{}{"type": "number"}
+    case reflect.String:
+        return map[string]interface{}{"type": "string"}
+    case reflect.Slice, reflect.Array:
+        if t.Elem().Kind() == reflect.Uint8 {
+            return map[string]interface{}{"type": "string", "format": "byte"}
+        }
+        return map[string]interface{}{"type": "array", "items": b.schema(t.Elem())}
+    case reflect.Map:
+        return map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem())}
+    case reflect.Struct:
+        if t.Name() == "" {
+            return b.object(t)
+        }
+        name := componentName(t)
+        if _, seen := b.components[name]; !seen {
+            // Placeholder first, for types that refer to themselves
+            b.components[name] = nil
+            b.components[name] = b.object(t)
+        }
+        return componentRef(name)
+    }
+    // Interfaces hold any value
+    return map[string]interface{}{}
+}
+
+// componentName exports the type name: errorEnvelope is ErrorEnvelope
+func componentName(t reflect.Type) string {
+    name := []rune(t.Name())
+    name[0] = unicode.ToUpper(name[0])
+    return string(name)
+}
+
+// object is the schema of a struct's JSON fields. Fields without omitempty
+// are always encoded, so they are required.
+func (b *schemaBuilder) object(t reflect.Type) map[string]interface{} {
+    properties := make(map[string]interface{})
+    var required []string
+    b.fields(t, properties, &required)
+    sort.Strings(required)
+    schema := map[string]interface{}{"type": "object", "properties": properties}
+    if len(required) > 0 {
+        schema["required"] = required
+    }
+    return schema
+}
+
+func (b *schemaBuilder) fields(t reflect.Type, properties map[string]interface{}, required *[]string) {
+    for i := 0; i < t.NumField(); i++ {
+        field := t.Field(i)
+        tag := field.Tag.Get("json")
+        if tag == "-" {
+            continue
+        }
+        name, options, _ := strings.Cut(tag, ",")
+        if field.Anonymous && name == "" {
+            embedded := field.Type
+            if embedded.Kind() == reflect.Pointer {
+                embedded = embedded.Elem()
+            }
+            if embedded.Kind() == reflect.Struct {
+                b.fields(embedded, properties, required)
+                continue
+            }
+        }
+        if !field.IsExported() {
+            continue
+        }
+        if name == "" {
+            name = field.Name
+        }
+        var schema map[string]interface{}
+        if hasTagOption(options, "string") {
+            schema = map[string]interface{}{"type": "string"}
+        } else {
+            schema = b.schema(field.Type)
+        }
+        if readOnlyFields[t][name] {
+            if _, ref := schema["$ref"]; !ref {
+                schema["readOnly"] = true
+            }
+        }
+        properties[name] = schema
+        if !hasTagOption(options, "omitempty") {
+            *required = append(*required, name)
+        }
+    }
+}
+
+func hasTagOption(options, option string) bool {
+    for _, o := range strings.Split(options, ",") {
+        if o == option {
+            return true
+        }
+    }
+    return false
+}
+
+// GetOpenAPI serves the OpenAPI document of the API: GET /openapi.json
+func (app *App) GetOpenAPI(w http.ResponseWriter, r *http.Request) {
+    doc, err := app.openAPI.JSON()
+    if err != nil {
+        reqctx.Logger(r.Context()).Error("building the OpenAPI document failed", "error", err)
+        httpError(w, r, "Internal server error", http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.Write(doc)
+}
+
+// GetDocs serves Swagger UI on the OpenAPI document: GET /docs
+func GetDocs(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/html; charset=utf-8")
+    w.Write([]byte(swaggerPage))
+}
+
+// GetDocsAsset serves the Swagger UI script and stylesheet under /docs
+func GetDocsAsset(w http.ResponseWriter, r *http.Request) {
+    data, err := swaggerUI.ReadFile("swagger-ui/" + mux.Vars(r)["file"])
+    if err != nil {
+        httpError(w, r, "Not found", http.StatusNotFound)
+        return
+    }
+    if strings.HasSuffix(r.URL.Path, ".css") {
+        w.Header().Set("Content-Type", "text/css; charset=utf-8")
+    } else {
+        w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+    }
+    w.Header().Set("Cache-Control", "public, max-age=86400")
+    w.Write(data)
+}
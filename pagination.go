@@ -0,0 +1,71 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "net/url"
+    "strconv"
+)
+
+const (
+    defaultPageLimit = 50
+    maxPageLimit     = 1000
+)
+
+// StudentPage is the paginated response of GET /students. Next is the URL of
+// the following page, or null on the last one.
+type StudentPage struct {
+    Data   []Student `json:"data"`
+    Total  int       `json:"total"`
+    Limit  int       `json:"limit"`
+    Offset int       `json:"offset"`
+    Next   *string   `json:"next"`
+}
+
+// pageFromRequest reads ?limit= and ?offset=. paged is false when neither is
+// given, so plain requests keep receiving a bare array.
+func pageFromRequest(r *http.Request) (limit, offset int, paged bool, verr *ValidationError) {
+    query := r.URL.Query()
+    if !query.Has("limit") && !query.Has("offset") {
+        return 0, 0, false, nil
+    }
+    limit = defaultPageLimit
+    if value := query.Get("limit"); value != "" {
+        n, err := strconv.Atoi(value)
+        if err != nil || n < 1 || n > maxPageLimit {
+            return 0, 0, true, &ValidationError{
+                Field:   "limit",
+                Code:    CodeOutOfRange,
+                Message: fmt.Sprintf("Limit must be between 1 and %d", maxPageLimit),
+            }
+        }
+        limit = n
+    }
+    if value := query.Get("offset"); value != "" {
+        n, err := strconv.Atoi(value)
+        if err != nil || n < 0 {
+            return 0, 0, true, &ValidationError{
+                Field:   "offset",
+                Code:    CodeOutOfRange,
+                Message: "Offset must be a non-negative integer",
+            }
+        }
+        offset = n
+    }
+    return limit, offset, true, nil
+}
+
+// nextPageURL returns the request's URL advanced to the following page, or
+// nil when this page reaches the end
+func nextPageURL(r *http.Request, limit, offset, total int) *string {
+    if offset+limit >= total {
+        return nil
+    }
+    u := url.URL{Path: r.URL.Path}
+    query := r.URL.Query()
+    query.Set("limit", strconv.Itoa(limit))
+    query.Set("offset", strconv.Itoa(offset+limit))
+    u.RawQuery = query.Encode()
+    next := u.String()
+    return &next
+}
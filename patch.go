@@ -0,0 +1,145 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "mime"
+    "net/http"
+    "strconv"
+    "github.com/gorilla/mux"
+)
+
+// errPatchRejected is returned through Patch when a change function refuses
+// the patched student
+var errPatchRejected = errors.New("patch rejected")
+
+// Patch applies change to the current version of a student and stores the
+// result, all under the write lock. When change returns the student as it
+// was, nothing is written and the zero StudentVersion is returned.
+func (s *StudentStore) Patch(id int, change func(Student) (Student, error)) (Student, StudentVersion, error) {
+    s.Lock()
+    defer s.Unlock()
+    current, err := s.getLive(id)
+    if err != nil {
+        return Student{}, StudentVersion{}, err
+    }
+    patched, err := change(current)
+    if err != nil {
+        return Student{}, StudentVersion{}, err
+    }
+    patched.ID = id
+    if len(diffStudents(current, patched)) == 0 {
+        return current, StudentVersion{}, nil
+    }
+    return s.replaceLocked(patched)
+}
+
+// mergePatch applies a JSON merge patch (RFC 7386) to target: null removes
+// a member, objects merge recursively and any other value replaces it
+func mergePatch(target, patch interface{}) interface{} {
+    fields, ok := patch.(map[string]interface{})
+    if !ok {
+        return patch
+    }
+    doc, ok := target.(map[string]interface{})
+    if !ok {
+        doc = make(map[string]interface{})
+    }
+    for key, value := range fields {
+        if value == nil {
+            delete(doc, key)
+        } else {
+            doc[key] = mergePatch(doc[key], value)
+        }
+    }
+    return doc
+}
+
+// applyStudentPatch merges patch into a student. Removed fields fall back
+// to their zero value, so validation reports required ones as missing; the
+// ID and timestamp cannot be patched.
+func applyStudentPatch(student Student, patch map[string]interface{}) (Student, error) {
+    for _, key := range []string{"id", "updated_at"} {
+        if _, ok := patch[key]; ok {
+            return Student{}, errors.New(key + " cannot be changed")
+        }
+    }
+    data, err := json.Marshal(student)
+    if err != nil {
+        return Student{}, err
+    }
+    var doc map[string]interface{}
+    if err := json.Unmarshal(data, &doc); err != nil {
+        return Student{}, err
+    }
+    merged, err := json.Marshal(mergePatch(doc, patch))
+    if err != nil {
+        return Student{}, err
+    }
+
+    var patched Student
+    dec := json.NewDecoder(bytes.NewReader(merged))
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(&patched); err != nil {
+        return Student{}, err
+    }
+    patched.UpdatedAt = student.UpdatedAt
+    return patched, nil
+}
+
+// PatchStudent changes only the fields present in a JSON merge patch:
+// PATCH /students/{id} {"email": "new@school.edu"}. The body is sent as
+// application/merge-patch+json or application/json.
+func (app *App) PatchStudent(w http.ResponseWriter, r *http.Request) {
+    store := app.storeFor(r)
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        httpError(w, r, "Invalid ID", http.StatusBadRequest)
+        return
+    }
+    if contentType := r.Header.Get("Content-Type"); contentType != "" {
+        mediaType, _, _ := mime.ParseMediaType(contentType)
+        if mediaType != "application/merge-patch+json" && mediaType != "application/json" {
+            httpError(w, r, "Content-Type must be application/merge-patch+json", http.StatusUnsupportedMediaType)
+            return
+        }
+    }
+
+    var patch map[string]interface{}
+    if err := json.NewDecoder(r.Body).Decode(&patch); err != nil || patch == nil {
+        httpError(w, r, "Invalid request body: a JSON object is required", http.StatusBadRequest)
+        return
+    }
+
+    var invalid []ValidationError
+    var patchErr error
+    student, version, err := store.Patch(id, func(current Student) (Student, error) {
+        patched, err := applyStudentPatch(current, patch)
+        if err != nil {
+            patchErr = err
+            return Student{}, errPatchRejected
+        }
+        if invalid = app.validateStudent(patched); len(invalid) > 0 {
+            return Student{}, errPatchRejected
+        }
+        return patched, nil
+    })
+    switch {
+    case errors.Is(err, errPatchRejected) && patchErr != nil:
+        httpError(w, r, "Invalid patch: "+patchErr.Error(), http.StatusBadRequest)
+        return
+    case errors.Is(err, errPatchRejected):
+        writeValidationErrors(w, r, invalid)
+        return
+    case err != nil:
+        writeStoreError(w, r, err)
+        return
+    }
+
+    app.recordChanges(r, version)
+    if version.Seq != 0 {
+        w.Header().Set("X-Operation-ID", strconv.Itoa(version.Seq))
+    }
+    json.NewEncoder(w).Encode(student)
+}
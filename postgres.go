@@ -0,0 +1,454 @@
+package main
+
+import (
+    "database/sql"
+    "errors"
+    "fmt"
+    "strconv"
+    "strings"
+    _ "github.com/lib/pq"
+    "student-api/migrations"
+)
+
+// BackendPostgres keeps students in the PostgreSQL database at DB_DSN
+const BackendPostgres = "postgres"
+
+// openPostgres opens DB_DSN with the configured pool settings
+func openPostgres() (*sql.DB, error) {
+    return openPostgresFrom("DB_DSN")
+}
+
+// openPostgresFrom opens the DSN in the named setting
+func openPostgresFrom(setting string) (*sql.DB, error) {
+    dsn := getEnv(setting, "")
+    if dsn == "" {
+        return nil, fmt.Errorf("%s is required for the postgres backend", setting)
+    }
+    db, err := sql.Open("postgres", dsn)
+    if err != nil {
+        return nil, err
+    }
+    configurePool(db)
+    return db, nil
+}
+
+// postgresMigrations are the PostgreSQL schema versions. IDs come from the
+// students_id_seq sequence behind the BIGSERIAL column.
+var postgresMigrations = []migrations.Migration{
+    {
+        Version: 1,
+        Name:    "create_students",
+        Up: migrations.Exec(`CREATE TABLE IF NOT EXISTS students (
+            id BIGSERIAL PRIMARY KEY,
+            name TEXT,
+            age INTEGER,
+            email TEXT
+        )`),
+        Down: migrations.Exec(`DROP TABLE students`),
+    },
+    {
+        Version: 2,
+        Name:    "add_students_updated_at",
+        Up:      migrations.Exec(`ALTER TABLE students ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ`),
+        Down:    migrations.Exec(`ALTER TABLE students DROP COLUMN updated_at`),
+    },
+    {
+        Version: 3,
+        Name:    "create_api_keys",
+        Up: migrations.Exec(`CREATE TABLE api_keys (
+            id BIGSERIAL PRIMARY KEY,
+            name TEXT NOT NULL,
+            prefix TEXT NOT NULL,
+            hash CHAR(64) NOT NULL UNIQUE,
+            rate_limit INTEGER NOT NULL,
+            created_at VARCHAR(64) NOT NULL,
+            last_used_at VARCHAR(64),
+            revoked_at VARCHAR(64)
+        )`),
+        Down: migrations.Exec(`DROP TABLE api_keys`),
+    },
+    {
+        Version: 4,
+        Name:    "create_audit_log",
+        Up: migrations.Exec(`CREATE TABLE audit_log (
+            id BIGSERIAL PRIMARY KEY,
+            at VARCHAR(64) NOT NULL,
+            request_id TEXT NOT NULL,
+            actor TEXT NOT NULL,
+            tenant TEXT NOT NULL,
+            action TEXT NOT NULL,
+            method TEXT NOT NULL,
+            route TEXT NOT NULL,
+            path TEXT NOT NULL,
+            status INTEGER NOT NULL,
+            source TEXT NOT NULL
+        )`),
+        Down: migrations.Exec(`DROP TABLE audit_log`),
+    },
+    {
+        Version: 5,
+        Name:    "create_access_log",
+        Up: migrations.Exec(`CREATE TABLE access_log (
+            id BIGSERIAL PRIMARY KEY,
+            at VARCHAR(64) NOT NULL,
+            tenant TEXT NOT NULL,
+            student_id BIGINT NOT NULL,
+            actor TEXT NOT NULL,
+            request_id TEXT NOT NULL,
+            route TEXT NOT NULL,
+            fields TEXT NOT NULL
+        )`, `CREATE INDEX access_log_student ON access_log (tenant, student_id, id)`),
+        Down: migrations.Exec(`DROP TABLE access_log`),
+    },
+    {
+        Version: 6,
+        Name:    "add_api_keys_role",
+        Up:      migrations.Exec(`ALTER TABLE api_keys ADD COLUMN role TEXT NOT NULL DEFAULT 'teacher'`),
+        Down:    migrations.Exec(`ALTER TABLE api_keys DROP COLUMN role`),
+    },
+    {
+        Version: 7,
+        Name:    "create_honeypots",
+        Up: migrations.Exec(`CREATE TABLE honeypots (
+            tenant TEXT NOT NULL,
+            student_id BIGINT NOT NULL,
+            label TEXT NOT NULL,
+            created_at VARCHAR(64) NOT NULL,
+            PRIMARY KEY (tenant, student_id)
+        )`, `ALTER TABLE audit_log ADD COLUMN honeypot TEXT NOT NULL DEFAULT ''`),
+        Down: migrations.Exec(`ALTER TABLE audit_log DROP COLUMN honeypot`, `DROP TABLE honeypots`),
+    },
+    {
+        Version: 8,
+        Name:    "create_users",
+        Up: migrations.Exec(`CREATE TABLE users (
+            id BIGSERIAL PRIMARY KEY,
+            username TEXT NOT NULL UNIQUE,
+            email TEXT NOT NULL UNIQUE,
+            password_hash TEXT NOT NULL,
+            role TEXT NOT NULL,
+            failed_logins INTEGER NOT NULL DEFAULT 0,
+            locked_until VARCHAR(64),
+            password_changed_at VARCHAR(64) NOT NULL,
+            created_at VARCHAR(64) NOT NULL
+        )`, `CREATE TABLE password_resets (
+            token_hash CHAR(64) PRIMARY KEY,
+            user_id BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+            expires_at VARCHAR(64) NOT NULL,
+            used_at VARCHAR(64)
+        )`),
+        Down: migrations.Exec(`DROP TABLE password_resets`, `DROP TABLE users`),
+    },
+    {
+        Version: 9,
+        Name:    "create_registrations",
+        Up: migrations.Exec(`CREATE TABLE registrations (
+            id BIGSERIAL PRIMARY KEY,
+            tenant TEXT NOT NULL,
+            name TEXT NOT NULL,
+            age INTEGER NOT NULL,
+            email TEXT NOT NULL,
+            status TEXT NOT NULL,
+            token_hash TEXT NOT NULL,
+            token_expires_at VARCHAR(64) NOT NULL,
+            created_at VARCHAR(64) NOT NULL,
+            verified_at VARCHAR(64),
+            decided_at VARCHAR(64),
+            decided_by TEXT NOT NULL,
+            reason TEXT NOT NULL,
+            student_id BIGINT NOT NULL
+        )`, `CREATE INDEX registrations_status ON registrations (tenant, status, id)`,
+            `CREATE INDEX registrations_token ON registrations (token_hash)`),
+        Down: migrations.Exec(`DROP TABLE registrations`),
+    },
+    {
+        Version: 10,
+        Name:    "create_invitations",
+        Up: migrations.Exec(`CREATE TABLE invitations (
+            id BIGSERIAL PRIMARY KEY,
+            tenant TEXT NOT NULL,
+            token_hash CHAR(64) NOT NULL UNIQUE,
+            name TEXT NOT NULL,
+            age INTEGER NOT NULL,
+            email TEXT NOT NULL,
+            status TEXT NOT NULL,
+            created_by TEXT NOT NULL,
+            created_at VARCHAR(64) NOT NULL,
+            expires_at VARCHAR(64) NOT NULL,
+            redeemed_at VARCHAR(64),
+            revoked_at VARCHAR(64),
+            revoked_by TEXT NOT NULL,
+            student_id BIGINT NOT NULL,
+            username TEXT NOT NULL
+        )`, `CREATE INDEX invitations_tenant ON invitations (tenant, id)`),
+        Down: migrations.Exec(`DROP TABLE invitations`),
+    },
+    {
+        Version: 11,
+        Name:    "create_summary_templates",
+        Up: migrations.Exec(`CREATE TABLE summary_templates (
+            tenant TEXT PRIMARY KEY,
+            prompt TEXT NOT NULL,
+            fields TEXT NOT NULL,
+            tone TEXT NOT NULL,
+            language TEXT NOT NULL,
+            version INTEGER NOT NULL,
+            updated_at VARCHAR(64) NOT NULL,
+            updated_by TEXT NOT NULL
+        )`),
+        Down: migrations.Exec(`DROP TABLE summary_templates`),
+    },
+    {
+        Version: 12,
+        Name:    "create_webhooks",
+        Up: migrations.Exec(`CREATE TABLE webhooks (
+            id BIGSERIAL PRIMARY KEY,
+            tenant TEXT NOT NULL,
+            url TEXT NOT NULL,
+            secret TEXT NOT NULL,
+            types TEXT NOT NULL,
+            fields TEXT NOT NULL,
+            created_by TEXT NOT NULL,
+            created_at VARCHAR(64) NOT NULL
+        )`, `CREATE TABLE webhook_deliveries (
+            id BIGSERIAL PRIMARY KEY,
+            tenant TEXT NOT NULL,
+            webhook_id BIGINT NOT NULL,
+            payload TEXT NOT NULL,
+            status TEXT NOT NULL,
+            attempts INTEGER NOT NULL,
+            last_status INTEGER NOT NULL,
+            last_error TEXT NOT NULL,
+            created_at VARCHAR(64) NOT NULL,
+            updated_at VARCHAR(64) NOT NULL,
+            delivered_at VARCHAR(64)
+        )`, `CREATE INDEX webhook_deliveries_tenant ON webhook_deliveries (tenant, status, created_at)`,
+            `CREATE INDEX webhook_deliveries_status ON webhook_deliveries (status, updated_at)`),
+        Down: migrations.Exec(`DROP TABLE webhook_deliveries`, `DROP TABLE webhooks`),
+    },
+    {
+        Version: 13,
+        Name:    "create_event_outbox",
+        Up: migrations.Exec(`CREATE TABLE event_outbox (
+            id BIGSERIAL PRIMARY KEY,
+            tenant TEXT NOT NULL,
+            payload TEXT NOT NULL,
+            created_at VARCHAR(64) NOT NULL,
+            published_at VARCHAR(64)
+        )`, `CREATE INDEX event_outbox_published ON event_outbox (published_at, id)`),
+        Down: migrations.Exec(`DROP TABLE event_outbox`),
+    },
+    {
+        Version: 14,
+        Name:    "add_students_deleted_at",
+        Up:      migrations.Exec(`ALTER TABLE students ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ`, `CREATE INDEX students_deleted_at ON students (deleted_at)`),
+        Down:    migrations.Exec(`DROP INDEX students_deleted_at`, `ALTER TABLE students DROP COLUMN deleted_at`),
+    },
+    {
+        Version: 15,
+        Name:    "add_audit_log_changes",
+        Up: migrations.Exec(`ALTER TABLE audit_log ADD COLUMN student_id INTEGER`, `ALTER TABLE audit_log ADD COLUMN changes TEXT`,
+            `CREATE INDEX audit_log_student ON audit_log (tenant, student_id, id)`),
+        Down: migrations.Exec(`DROP INDEX audit_log_student`, `ALTER TABLE audit_log DROP COLUMN changes`, `ALTER TABLE audit_log DROP COLUMN student_id`),
+    },
+    {
+        Version: 16,
+        Name:    "create_student_history",
+        Up: migrations.Exec(`CREATE TABLE student_history (
+            seq BIGSERIAL PRIMARY KEY,
+            student_id INTEGER NOT NULL,
+            version INTEGER NOT NULL,
+            operation VARCHAR(16) NOT NULL,
+            student TEXT NOT NULL,
+            changes TEXT,
+            at VARCHAR(64) NOT NULL,
+            UNIQUE (student_id, version)
+        )`),
+        Down: migrations.Exec(`DROP TABLE student_history`),
+    },
+    {
+        Version: 17,
+        Name:    "create_saved_reports",
+        Up: migrations.Exec(`CREATE TABLE saved_reports (
+            name VARCHAR(64) PRIMARY KEY,
+            sql_text TEXT NOT NULL,
+            params TEXT NOT NULL,
+            filter TEXT NOT NULL,
+            format VARCHAR(16) NOT NULL,
+            schedule VARCHAR(255) NOT NULL,
+            delivery TEXT NOT NULL,
+            next_run_at VARCHAR(64),
+            updated_at VARCHAR(64) NOT NULL
+        )`, `CREATE TABLE report_runs (
+            id BIGSERIAL PRIMARY KEY,
+            report VARCHAR(64) NOT NULL,
+            triggered_by VARCHAR(16) NOT NULL,
+            started_at VARCHAR(64) NOT NULL,
+            finished_at VARCHAR(64) NOT NULL,
+            row_count INTEGER NOT NULL,
+            truncated INTEGER NOT NULL,
+            error TEXT NOT NULL,
+            deliveries TEXT NOT NULL
+        )`, `CREATE INDEX report_runs_report ON report_runs (report, id)`),
+        Down: migrations.Exec(`DROP TABLE report_runs`, `DROP TABLE saved_reports`),
+    },
+    {
+        Version: 18,
+        Name:    "add_api_keys_scopes",
+        Up:      migrations.Exec(`ALTER TABLE api_keys ADD COLUMN scopes TEXT NOT NULL DEFAULT ''`),
+        Down:    migrations.Exec(`ALTER TABLE api_keys DROP COLUMN scopes`),
+    },
+    {
+        Version: 19,
+        Name:    "add_principal_tenants",
+        Up: migrations.Exec(`ALTER TABLE users ADD COLUMN tenant TEXT NOT NULL DEFAULT ''`,
+            `ALTER TABLE api_keys ADD COLUMN tenant TEXT NOT NULL DEFAULT ''`),
+        Down: migrations.Exec(`ALTER TABLE users DROP COLUMN tenant`, `ALTER TABLE api_keys DROP COLUMN tenant`),
+    },
+}
+
+// migratePostgres applies pending PostgreSQL migrations
+func migratePostgres(db *sql.DB) error {
+    return applyMigrations(db, postgresMigrations, rebindPostgres)
+}
+
+// PostgresRepository is the StudentRepository backed by PostgreSQL
+type PostgresRepository struct {
+    db *sql.DB
+    // conn is db, or the transaction of a repository made by Transaction
+    conn  sqlConn
+    stmts *studentStatements
+    // bumpSeq moves the ID sequence past an explicitly inserted ID
+    bumpSeq *sql.Stmt
+}
+
+// NewPostgresRepository prepares the repository's statements on a migrated
+// database. The database stays owned by the caller.
+func NewPostgresRepository(db *sql.DB) (*PostgresRepository, error) {
+    r := &PostgresRepository{db: db, conn: db, stmts: &studentStatements{}}
+    for _, p := range []struct {
+        stmt  **sql.Stmt
+        query string
+    }{
+        {&r.stmts.get, "SELECT " + studentColumns + " FROM students WHERE id = $1"},
+        {&r.stmts.insert, "INSERT INTO students (name, age, email, updated_at, deleted_at) VALUES ($1, $2, $3, $4, $5) RETURNING id"},
+        {&r.stmts.insertWithID, "INSERT INTO students (id, name, age, email, updated_at, deleted_at) VALUES ($1, $2, $3, $4, $5, $6)"},
+        {&r.stmts.update, "UPDATE students SET name = $1, age = $2, email = $3, updated_at = $4, deleted_at = $5 WHERE id = $6"},
+        {&r.stmts.remove, "DELETE FROM students WHERE id = $1"},
+        {&r.bumpSeq, "SELECT setval('students_id_seq', GREATEST(last_value, $1)) FROM students_id_seq"},
+    } {
+        stmt, err := db.Prepare(p.query)
+        if err != nil {
+            r.Close()
+            return nil, fmt.Errorf("preparing %q: %v", p.query, err)
+        }
+        *p.stmt = stmt
+    }
+    return r, nil
+}
+
+// Close releases the prepared statements
+func (r *PostgresRepository) Close() error {
+    r.stmts.Close()
+    if r.bumpSeq != nil {
+        r.bumpSeq.Close()
+    }
+    return nil
+}
+
+// Create inserts a student, under its own ID if it has one. Unlike SQLite,
+// an explicit ID does not advance the sequence, so it is moved past the ID
+// to keep later inserts from colliding with it; IDs are never reused.
+func (r *PostgresRepository) Create(student Student) (Student, error) {
+    if student.ID == 0 {
+        err := r.stmts.insert.QueryRow(student.Name, student.Age, student.Email, student.UpdatedAt, student.DeletedAt).Scan(&student.ID)
+        return student, err
+    }
+    if _, err := r.stmts.insertWithID.Exec(student.ID, student.Name, student.Age, student.Email, student.UpdatedAt, student.DeletedAt); err != nil {
+        return Student{}, err
+    }
+    _, err := r.bumpSeq.Exec(student.ID)
+    return student, err
+}
+
+// Transaction runs fn against a repository bound to one database transaction
+func (r *PostgresRepository) Transaction(fn func(tx StudentRepository) error) error {
+    return runTransaction(r.db, fn, func(tx *sql.Tx) StudentRepository {
+        return &PostgresRepository{db: r.db, conn: tx, stmts: r.stmts.in(tx), bumpSeq: tx.Stmt(r.bumpSeq)}
+    })
+}
+
+// History returns the student_history of the database or transaction
+func (r *PostgresRepository) History() StudentHistory {
+    return &SQLHistory{conn: r.conn, rebind: rebindPostgres, returning: true}
+}
+
+// Outbox returns the event_outbox of the database or transaction
+func (r *PostgresRepository) Outbox() OutboxRepository {
+    return NewSQLOutboxRepository(r.conn, rebindPostgres)
+}
+
+// Get loads one student
+func (r *PostgresRepository) Get(id int) (Student, error) {
+    student, err := scanStudent(r.stmts.get.QueryRow(id))
+    if errors.Is(err, sql.ErrNoRows) {
+        return Student{}, errStudentNotFound
+    }
+    return student, err
+}
+
+// List loads the students selected by opts, in opts.Sort order
+func (r *PostgresRepository) List(opts ListOptions) ([]Student, error) {
+    where, args := postgresFilter(opts.Filter)
+    query, args := studentListSQL(where, args, opts)
+    return queryStudents(r.conn, rebindPostgres(query), args...)
+}
+
+// Count returns how many students match the filter
+func (r *PostgresRepository) Count(f *Filter) (int, error) {
+    where, args := postgresFilter(f)
+    var n int
+    err := r.conn.QueryRow(rebindPostgres("SELECT COUNT(*) FROM students WHERE "+where), args...).Scan(&n)
+    return n, err
+}
+
+// postgresFilter compiles a filter with case-insensitive LIKE operators, as
+// they are in SQLite
+func postgresFilter(f *Filter) (string, []interface{}) {
+    where, args := f.SQL()
+    return strings.ReplaceAll(where, " LIKE ", " ILIKE "), args
+}
+
+// Update overwrites an existing student
+func (r *PostgresRepository) Update(student Student) (Student, error) {
+    result, err := r.stmts.update.Exec(student.Name, student.Age, student.Email, student.UpdatedAt, student.DeletedAt, student.ID)
+    if err != nil {
+        return Student{}, err
+    }
+    return student, requireRow(result)
+}
+
+// Delete removes a student
+func (r *PostgresRepository) Delete(id int) error {
+    result, err := r.stmts.remove.Exec(id)
+    if err != nil {
+        return err
+    }
+    return requireRow(result)
+}
+
+// rebindPostgres numbers the "?" placeholders of a generated condition as
+// $1, $2, ...; generated conditions hold no quoted question marks
+func rebindPostgres(query string) string {
+    var b strings.Builder
+    n := 0
+    for _, c := range query {
+        if c == '?' {
+            n++
+            b.WriteString("$" + strconv.Itoa(n))
+            continue
+        }
+        b.WriteRune(c)
+    }
+    return b.String()
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "hash/fnv"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "text/template"
+)
+
+// defaultPromptVariant is used when no traffic split is configured
+const defaultPromptVariant = "v1"
+
+// PromptVariant is one wording of the summary prompt under evaluation
+type PromptVariant struct {
+    Name     string
+    Template *template.Template
+    Weight   int
+}
+
+// Render fills the template with the student's fields
+func (v *PromptVariant) Render(student Student) (string, error) {
+    var buf bytes.Buffer
+    if err := v.Template.Execute(&buf, student); err != nil {
+        return "", err
+    }
+    return buf.String(), nil
+}
+
+// summaryPromptTemplates holds every known summary prompt variant by name
+var summaryPromptTemplates = map[string]string{
+    "v1": "Generate a brief summary of this student:\nName: {{.Name}}\nAge: {{.Age}}\nEmail: {{.Email}}",
+    "v2": "You are writing for a school advisor. In two sentences, describe this student " +
+        "and note anything an advisor should know.\nName: {{.Name}}\nAge: {{.Age}}\nEmail: {{.Email}}",
+}
+
+// variantUsage accumulates generation counts and token usage for a variant
+type variantUsage struct {
+    Generations      int
+    PromptTokens     int
+    CompletionTokens int
+}
+
+// PromptExperiment splits summary traffic across active prompt variants and
+// tracks the token cost of each one
+type PromptExperiment struct {
+    variants    []*PromptVariant
+    totalWeight int
+
+    mu    sync.Mutex
+    usage map[string]*variantUsage
+}
+
+// ParsePromptSplit parses a traffic split such as "v1:80,v2:20".
+// An empty split sends all traffic to the default variant.
+func ParsePromptSplit(split string) (*PromptExperiment, error) {
+    e := &PromptExperiment{usage: make(map[string]*variantUsage)}
+    if strings.TrimSpace(split) == "" {
+        split = defaultPromptVariant + ":100"
+    }
+
+    for _, part := range strings.Split(split, ",") {
+        name, weightStr, found := strings.Cut(strings.TrimSpace(part), ":")
+        if !found {
+            weightStr = "1"
+        }
+        source, ok := summaryPromptTemplates[name]
+        if !ok {
+            return nil, fmt.Errorf("unknown prompt variant %q", name)
+        }
+        weight, err := strconv.Atoi(weightStr)
+        if err != nil || weight < 0 {
+            return nil, fmt.Errorf("invalid weight %q for prompt variant %q", weightStr, name)
+        }
+        if weight == 0 {
+            continue
+        }
+        tmpl, err := template.New(name).Parse(source)
+        if err != nil {
+            return nil, fmt.Errorf("prompt variant %q: %w", name, err)
+        }
+        e.variants = append(e.variants, &PromptVariant{Name: name, Template: tmpl, Weight: weight})
+        e.totalWeight += weight
+    }
+
+    if e.totalWeight == 0 {
+        return nil, fmt.Errorf("prompt split %q has no active variants", split)
+    }
+    return e, nil
+}
+
+// VariantFor assigns a student to a variant. The assignment is a stable hash
+// of the student ID so repeat requests and feedback land on the same variant.
+func (e *PromptExperiment) VariantFor(studentID int) *PromptVariant {
+    h := fnv.New32a()
+    h.Write([]byte(strconv.Itoa(studentID)))
+    bucket := int(h.Sum32() % uint32(e.totalWeight))
+
+    for _, v := range e.variants {
+        if bucket < v.Weight {
+            return v
+        }
+        bucket -= v.Weight
+    }
+    return e.variants[len(e.variants)-1]
+}
+
+// RecordUsage adds the token counts of one generation to the variant's totals
+func (e *PromptExperiment) RecordUsage(variant string, resp *OllamaResponse) {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    u, ok := e.usage[variant]
+    if !ok {
+        u = &variantUsage{}
+        e.usage[variant] = u
+    }
+    u.Generations++
+    u.PromptTokens += resp.PromptEvalCount
+    u.CompletionTokens += resp.EvalCount
+}
+
+// VariantReport compares feedback and token cost for a single prompt variant
+type VariantReport struct {
+    Variant             string  `json:"variant"`
+    Weight              int     `json:"weight"`
+    Active              bool    `json:"active"`
+    Generations         int     `json:"generations"`
+    AvgPromptTokens     float64 `json:"avg_prompt_tokens"`
+    AvgCompletionTokens float64 `json:"avg_completion_tokens"`
+    AvgTotalTokens      float64 `json:"avg_total_tokens"`
+    FeedbackUp          int     `json:"feedback_up"`
+    FeedbackDown        int     `json:"feedback_down"`
+    ApprovalRate        float64 `json:"approval_rate"`
+}
+
+// Report merges usage with feedback metrics into one row per variant
+func (e *PromptExperiment) Report(feedback []FeedbackMetrics) []VariantReport {
+    rows := make(map[string]*VariantReport)
+    row := func(name string) *VariantReport {
+        r, ok := rows[name]
+        if !ok {
+            r = &VariantReport{Variant: name}
+            rows[name] = r
+        }
+        return r
+    }
+
+    for _, v := range e.variants {
+        r := row(v.Name)
+        r.Weight = v.Weight
+        r.Active = true
+    }
+
+    e.mu.Lock()
+    for name, u := range e.usage {
+        r := row(name)
+        r.Generations = u.Generations
+        if u.Generations > 0 {
+            r.AvgPromptTokens = float64(u.PromptTokens) / float64(u.Generations)
+            r.AvgCompletionTokens = float64(u.CompletionTokens) / float64(u.Generations)
+            r.AvgTotalTokens = r.AvgPromptTokens + r.AvgCompletionTokens
+        }
+    }
+    e.mu.Unlock()
+
+    for _, m := range feedback {
+        r := row(m.Variant)
+        r.FeedbackUp += m.Up
+        r.FeedbackDown += m.Down
+    }
+
+    report := make([]VariantReport, 0, len(rows))
+    for _, r := range rows {
+        if total := r.FeedbackUp + r.FeedbackDown; total > 0 {
+            r.ApprovalRate = float64(r.FeedbackUp) / float64(total)
+        }
+        report = append(report, *r)
+    }
+    sort.Slice(report, func(i, j int) bool { return report[i].Variant < report[j].Variant })
+    return report
+}
+
+func (app *App) GetPromptVariantReport(w http.ResponseWriter, r *http.Request) {
+    json.NewEncoder(w).Encode(app.prompts.Report(app.feedback.Metrics()))
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+    "fmt"
+    "math"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Rate limit classes. Every request counts against its client's overall
+// bucket; writes, which contend for the store, and routes that call the
+// model count against a stricter bucket of their own as well.
+const (
+    rateClassAll   = "all"
+    rateClassWrite = "write"
+    rateClassLLM   = "llm"
+)
+
+// llmRoutes are the route templates that wait on the LLM provider
+var llmRoutes = map[string]bool{
+    "/students/{id}/summary":       true,
+    "/students/{id}/summary/audio": true,
+    "/students/{id}/notes/audio":   true,
+    "/students/ingest/roster":      true,
+}
+
+// rateSweepInterval is how often buckets that have refilled are dropped
+const rateSweepInterval = time.Minute
+
+// rateBucket is a client's token bucket in one class
+type rateBucket struct {
+    tokens  float64
+    updated time.Time
+}
+
+// RateLimiter applies per-client token buckets, refilled at each class's
+// requests per minute. Clients are API keys, whose overall limit is the key's
+// own, or else IP addresses. Buckets live in memory, so limits apply per
+// instance.
+type RateLimiter struct {
+    // limits holds the requests per minute of each enabled class
+    limits  map[string]float64
+    proxies []*net.IPNet
+    routes  *RoutePolicies
+
+    mu        sync.Mutex
+    buckets   map[string]*rateBucket
+    lastSweep time.Time
+}
+
+// LoadRateLimiter reads RATE_LIMIT, RATE_LIMIT_WRITE and RATE_LIMIT_LLM, in
+// requests per minute per client (0, the default, leaves a class unlimited),
+// and TRUSTED_PROXIES, the comma-separated addresses or CIDR ranges whose
+// X-Forwarded-For is believed. Route policies with a rate_limit add a class
+// of their own. It returns nil when every class is unlimited.
+func LoadRateLimiter(routes *RoutePolicies) (*RateLimiter, error) {
+    l := &RateLimiter{limits: make(map[string]float64), routes: routes, buckets: make(map[string]*rateBucket)}
+    for class, key := range map[string]string{rateClassAll: "RATE_LIMIT", rateClassWrite: "RATE_LIMIT_WRITE", rateClassLLM: "RATE_LIMIT_LLM"} {
+        n := getEnvInt(key, 0)
+        if n < 0 {
+            return nil, fmt.Errorf("%s must be zero or a positive number of requests per minute, got %d", key, n)
+        }
+        if n > 0 {
+            l.limits[class] = float64(n)
+        }
+    }
+    for _, proxy := range getEnvList("TRUSTED_PROXIES") {
+        if !strings.Contains(proxy, "/") {
+            if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+                proxy += "/32"
+            } else {
+                proxy += "/128"
+            }
+        }
+        _, network, err := net.ParseCIDR(proxy)
+        if err != nil {
+            return nil, fmt.Errorf("TRUSTED_PROXIES: %q is not an address or CIDR range", proxy)
+        }
+        l.proxies = append(l.proxies, network)
+    }
+    for _, policy := range routes.Policies() {
+        if policy.RateLimit > 0 {
+            l.limits[routeRateClass(policy)] = float64(policy.RateLimit)
+        }
+    }
+    if len(l.limits) == 0 {
+        return nil, nil
+    }
+    return l, nil
+}
+
+// routeRateClass names the rate limit class of a route policy, shared by
+// the methods it lists
+func routeRateClass(policy *RoutePolicy) string {
+    return "route:" + strings.Join(policy.Methods, ",") + " " + policy.Route
+}
+
+// trusted reports whether ip is one of the TRUSTED_PROXIES
+func (l *RateLimiter) trusted(ip net.IP) bool {
+    for _, network := range l.proxies {
+        if network.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+// clientIP returns the address a request came from: the peer, or when the
+// peer is a trusted proxy, the last X-Forwarded-For hop it did not add itself
+func (l *RateLimiter) clientIP(r *http.Request) string {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        host = r.RemoteAddr
+    }
+    ip := net.ParseIP(host)
+    if ip == nil || !l.trusted(ip) {
+        return host
+    }
+    hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+    for i := len(hops) - 1; i >= 0; i-- {
+        hop := net.ParseIP(strings.TrimSpace(hops[i]))
+        if hop == nil {
+            break
+        }
+        if host = hop.String(); !l.trusted(hop) {
+            break
+        }
+    }
+    return host
+}
+
+// requestRateClasses returns the rate limit classes r counts against besides "all"
+func (l *RateLimiter) requestRateClasses(r *http.Request) []string {
+    var classes []string
+    switch r.Method {
+    case http.MethodGet, http.MethodHead, http.MethodOptions:
+    default:
+        classes = append(classes, rateClassWrite)
+    }
+    route := routeTemplate(r)
+    if llmRoutes[route] {
+        classes = append(classes, rateClassLLM)
+    }
+    if policy := l.routes.For(r.Method, route); policy != nil && policy.RateLimit > 0 {
+        classes = append(classes, routeRateClass(policy))
+    }
+    return classes
+}
+
+// Allow takes a token from client's bucket in each of classes, or from none
+// of them when any is empty. It then returns false, the exhausted class and
+// how long until it has a token again.
+func (l *RateLimiter) Allow(client string, classes []string, now time.Time) (bool, string, time.Duration) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    l.sweep(now)
+
+    var buckets []*rateBucket
+    var denied string
+    var wait time.Duration
+    for _, class := range classes {
+        limit, ok := l.limits[class]
+        if !ok {
+            continue
+        }
+        key := class + "\x00" + client
+        b, exists := l.buckets[key]
+        if !exists {
+            b = &rateBucket{tokens: limit, updated: now}
+            l.buckets[key] = b
+        }
+        b.tokens = math.Min(limit, b.tokens+now.Sub(b.updated).Minutes()*limit)
+        b.updated = now
+        if b.tokens < 1 {
+            if w := time.Duration((1 - b.tokens) / limit * float64(time.Minute)); w > wait {
+                denied, wait = class, w
+            }
+        }
+        buckets = append(buckets, b)
+    }
+    if denied != "" {
+        return false, denied, wait
+    }
+    for _, b := range buckets {
+        b.tokens--
+    }
+    return true, "", 0
+}
+
+// sweep drops buckets idle long enough to have refilled, which are the same
+// as no bucket; the caller holds l.mu
+func (l *RateLimiter) sweep(now time.Time) {
+    if now.Sub(l.lastSweep) < rateSweepInterval {
+        return
+    }
+    l.lastSweep = now
+    for key, b := range l.buckets {
+        // A bucket refills completely within a minute at any rate
+        if now.Sub(b.updated) >= time.Minute {
+            delete(l.buckets, key)
+        }
+    }
+}
+
+// rateLimit answers 429 with Retry-After once a client exhausts one of its
+// buckets. It runs after apiKeys, so a request with a valid key is counted
+// against the key rather than its address.
+func (app *App) rateLimit(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if app.limiter == nil {
+            next.ServeHTTP(w, r)
+            return
+        }
+        classes := app.limiter.requestRateClasses(r)
+        var client string
+        if key, ok := apiKeyFrom(r.Context()); ok {
+            // The key's own limit stands in for the overall one
+            client = "key:" + strconv.Itoa(key.ID)
+        } else {
+            client = "ip:" + app.limiter.clientIP(r)
+            classes = append(classes, rateClassAll)
+        }
+        allowed, class, wait := app.limiter.Allow(client, classes, time.Now())
+        if !allowed {
+            app.metrics.Inc("rate_limited_requests_total", "class", class)
+            w.Header().Set("X-RateLimit-Limit", strconv.Itoa(int(app.limiter.limits[class])))
+            w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+            httpError(w, r, "Rate limit exceeded", http.StatusTooManyRequests)
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "strings"
+    "student-api/reqctx"
+)
+
+// Roles of authenticated principals, from least to most privileged
+const (
+    RoleReadonly = "readonly"
+    RoleTeacher  = "teacher"
+    RoleAdmin    = "admin"
+)
+
+// RoleAny annotates routes open to every principal, whatever its role
+const RoleAny = "any"
+
+// defaultRole is given to users and API keys configured without a role; it
+// keeps the write access they had before roles existed
+const defaultRole = RoleTeacher
+
+var roleRanks = map[string]int{RoleReadonly: 1, RoleTeacher: 2, RoleAdmin: 3}
+
+// parseRole validates a configured role, defaulting an empty one
+func parseRole(role string) (string, error) {
+    if role == "" {
+        return defaultRole, nil
+    }
+    if _, ok := roleRanks[role]; !ok {
+        return "", fmt.Errorf("unknown role %q: expected %s, %s or %s", role, RoleAdmin, RoleTeacher, RoleReadonly)
+    }
+    return role, nil
+}
+
+// routeRoles annotates routes whose minimum role differs from the default of
+// readonly for reads and teacher for writes, by route template and method
+var routeRoles = map[string]map[string]string{
+    "/healthz":      {http.MethodGet: RoleAny},
+    "/readyz":       {http.MethodGet: RoleAny},
+    "/metrics":      {http.MethodGet: RoleAny},
+    "/version":      {http.MethodGet: RoleAny},
+    "/openapi.json": {http.MethodGet: RoleAny},
+    "/docs":         {http.MethodGet: RoleAny},
+    "/docs/{file}":  {http.MethodGet: RoleAny},
+    "/auth/login":   {http.MethodPost: RoleAny},
+    "/auth/refresh": {http.MethodPost: RoleAny},
+    "/llm/quota":    {http.MethodGet: RoleAny},
+
+    "/auth/register":               {http.MethodPost: RoleAny},
+    "/auth/password":               {http.MethodPut: RoleAny},
+    "/auth/password-reset":         {http.MethodPost: RoleAny},
+    "/auth/password-reset/confirm": {http.MethodPost: RoleAny},
+    "/register":                    {http.MethodPost: RoleAny},
+    "/register/verify":             {http.MethodPost: RoleAny},
+    "/invitations/lookup":          {http.MethodPost: RoleAny},
+    "/invitations/redeem":          {http.MethodPost: RoleAny},
+
+    "/students":               {http.MethodDelete: RoleAdmin},
+    "/students/{id}/access":   {http.MethodGet: RoleAdmin},
+    "/students/{id}/history":  {http.MethodGet: RoleAdmin},
+    "/audit":                  {http.MethodGet: RoleAdmin},
+    "/import-profiles/{name}": {http.MethodPut: RoleAdmin, http.MethodDelete: RoleAdmin},
+
+    "/webhooks/deliveries/{id}/replay": {http.MethodPost: RoleAdmin},
+
+    // queries are reads; the mutation resolvers check for teacher themselves
+    "/graphql": {http.MethodPost: RoleReadonly},
+}
+
+// requiredRole returns the minimum role for a request to a route template
+func requiredRole(method, route string) string {
+    if role, ok := routeRoles[route][method]; ok {
+        return role
+    }
+    if strings.HasPrefix(route, "/admin/") {
+        return RoleAdmin
+    }
+    if method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions {
+        return RoleReadonly
+    }
+    return RoleTeacher
+}
+
+// hasRole reports whether role meets the required one
+func hasRole(role, required string) bool {
+    return required == RoleAny || roleRanks[role] >= roleRanks[required]
+}
+
+// rbac enforces route roles. It runs after the authentication middleware,
+// which set the role. Requests without a principal only pass when
+// authentication is off or the route is open to anyone.
+func (app *App) rbac(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        role := reqctx.Role(r.Context())
+        route := routeTemplate(r)
+        if role == "" {
+            if app.authEnabled() && app.authRequired(r.Method, route) {
+                w.Header().Set("WWW-Authenticate", "Bearer")
+                httpError(w, r, "A valid bearer token is required", http.StatusUnauthorized)
+                return
+            }
+            next.ServeHTTP(w, r)
+            return
+        }
+        required := requiredRole(r.Method, route)
+        if policy := app.routes.For(r.Method, route); policy != nil && policy.Role != "" {
+            required = policy.Role
+        }
+        if !hasRole(role, required) {
+            app.metrics.Inc("rbac_denied_total", "role", role, "route", route)
+            reqctx.Logger(r.Context()).Warn("role denied", "method", r.Method, "route", route, "required", required)
+            httpError(w, r, fmt.Sprintf("Role %s may not %s %s; %s required", role, r.Method, route, required), http.StatusForbidden)
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "log/slog"
+    "net/url"
+    "regexp"
+    "sort"
+    "strings"
+)
+
+// redacted replaces the value of a redacted field
+const redacted = "[REDACTED]"
+
+// defaultRedactFields are redacted when LOG_REDACT_FIELDS is unset
+var defaultRedactFields = []string{"email", "phone", "dob", "date_of_birth", "password"}
+
+// emailPattern finds email addresses in free text such as error messages
+var emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+
+// Redactor scrubs personal data from log output. Attributes, JSON object
+// keys and query parameters named like a configured field lose their value;
+// when email is configured, addresses are also removed from free text.
+type Redactor struct {
+    fields map[string]bool
+    // jsonPair matches "field": value in JSON that does not parse, such as a
+    // truncated body
+    jsonPair *regexp.Regexp
+}
+
+// normalizeField folds "Date-Of-Birth", "date_of_birth" and "dateOfBirth"
+// to one name
+func normalizeField(name string) string {
+    return strings.NewReplacer("_", "", "-", "").Replace(strings.ToLower(strings.TrimSpace(name)))
+}
+
+// NewRedactor redacts the named fields
+func NewRedactor(fields []string) *Redactor {
+    r := &Redactor{fields: make(map[string]bool)}
+    var quoted []string
+    for _, field := range fields {
+        if field = strings.TrimSpace(field); field != "" {
+            r.fields[normalizeField(field)] = true
+            quoted = append(quoted, regexp.QuoteMeta(field))
+        }
+    }
+    if len(quoted) > 0 {
+        r.jsonPair = regexp.MustCompile(`(?i)("(?:` + strings.Join(quoted, "|") + `)"\s*:\s*)("(?:[^"\\]|\\.)*"?|[^,}\]\s]+)`)
+    }
+    return r
+}
+
+// LoadRedactor reads LOG_REDACT_FIELDS, a comma-separated list of field
+// names; "none" turns redaction off
+func LoadRedactor() *Redactor {
+    fields := getEnvList("LOG_REDACT_FIELDS")
+    if len(fields) == 0 {
+        fields = defaultRedactFields
+    } else if len(fields) == 1 && fields[0] == "none" {
+        fields = nil
+    }
+    return NewRedactor(fields)
+}
+
+// Field reports whether a key names a redacted field
+func (r *Redactor) Field(key string) bool {
+    return r.fields[normalizeField(key)]
+}
+
+// String scrubs free text, redacting fields inside JSON documents
+func (r *Redactor) String(s string) string {
+    if trimmed := strings.TrimSpace(s); strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+        if out, ok := r.JSON([]byte(trimmed)); ok {
+            s = string(out)
+        } else if r.jsonPair != nil {
+            s = r.jsonPair.ReplaceAllString(s, `${1}"`+redacted+`"`)
+        }
+    }
+    if r.fields["email"] {
+        s = emailPattern.ReplaceAllString(s, redacted)
+    }
+    return s
+}
+
+// JSON redacts fields at any depth of a JSON document, reporting false if
+// body is not valid JSON
+func (r *Redactor) JSON(body []byte) ([]byte, bool) {
+    dec := json.NewDecoder(bytes.NewReader(body))
+    dec.UseNumber()
+    var doc interface{}
+    if err := dec.Decode(&doc); err != nil || dec.More() {
+        return nil, false
+    }
+    out, err := json.Marshal(r.value(doc))
+    if err != nil {
+        return nil, false
+    }
+    return out, true
+}
+
+func (r *Redactor) value(v interface{}) interface{} {
+    switch v := v.(type) {
+    case map[string]interface{}:
+        for key, item := range v {
+            if r.Field(key) {
+                v[key] = redacted
+            } else {
+                v[key] = r.value(item)
+            }
+        }
+    case []interface{}:
+        for i, item := range v {
+            v[i] = r.value(item)
+        }
+    case string:
+        if r.fields["email"] {
+            return emailPattern.ReplaceAllString(v, redacted)
+        }
+    }
+    return v
+}
+
+// Query redacts the values of query parameters named like a field, keeping
+// the rest readable
+func (r *Redactor) Query(query url.Values) string {
+    keys := make([]string, 0, len(query))
+    for key := range query {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    var parts []string
+    for _, key := range keys {
+        for _, value := range query[key] {
+            if r.Field(key) {
+                value = redacted
+            }
+            parts = append(parts, key+"="+r.String(value))
+        }
+    }
+    return strings.Join(parts, "&")
+}
+
+// ReplaceAttr is the slog hook applying the redactor to every record the
+// logger writes, including error values and log messages
+func (r *Redactor) ReplaceAttr(groups []string, a slog.Attr) slog.Attr {
+    if len(r.fields) == 0 {
+        return a
+    }
+    if r.Field(a.Key) {
+        return slog.String(a.Key, redacted)
+    }
+    switch a.Value.Kind() {
+    case slog.KindString:
+        a.Value = slog.StringValue(r.String(a.Value.String()))
+    case slog.KindAny:
+        if err, ok := a.Value.Any().(error); ok {
+            a.Value = slog.StringValue(r.String(err.Error()))
+        }
+    }
+    return a
+}
+
+// logRedactor is the redactor of the structured logger, set by setupLogging
+var logRedactor = NewRedactor(defaultRedactFields)
+
+// SelfTest writes a record full of sample personal data through a logger
+// using the redactor and fails if any of it comes out, so the doctor can
+// assert that LOG_REDACT_FIELDS does what the operator expects
+func (r *Redactor) SelfTest() error {
+    samples := map[string]string{
+        "email":         "ada.lovelace@example.edu",
+        "phone":         "+44 20 7946 0958",
+        "dob":           "1815-12-10",
+        "date_of_birth": "1815-12-10",
+        "password":      "correct horse battery staple",
+    }
+    var buf bytes.Buffer
+    logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{ReplaceAttr: r.ReplaceAttr}))
+    body, _ := json.Marshal(map[string]interface{}{"student": samples})
+    attrs := []any{"request_body", string(body), "error", fmt.Errorf("duplicate email %s", samples["email"])}
+    for field, value := range samples {
+        attrs = append(attrs, field, value)
+    }
+    logger.Info("redaction self-test", attrs...)
+    var leaked []string
+    for field, value := range samples {
+        if r.Field(field) && strings.Contains(buf.String(), value) {
+            leaked = append(leaked, field)
+        }
+    }
+    if len(leaked) > 0 {
+        sort.Strings(leaked)
+        return fmt.Errorf("redacted fields still logged: %s", strings.Join(leaked, ", "))
+    }
+    return nil
+}
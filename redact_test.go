@@ -0,0 +1,171 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "testing"
+    "student-api/reqctx"
+)
+
+// Sample personal data that must never reach the logs
+const (
+    sampleEmail = "ada.lovelace@example.edu"
+    samplePhone = "+44 20 7946 0958"
+    sampleDOB   = "1815-12-10"
+)
+
+var samplePersonalData = []string{sampleEmail, samplePhone, sampleDOB}
+
+// captureLogs sends the structured logger to a buffer, redacting the default
+// fields, at level with bodies logged up to bodyLimit bytes, until the test
+// ends
+func captureLogs(t *testing.T, level slog.Level, bodyLimit int) *bytes.Buffer {
+    t.Helper()
+    previous, previousLevel, previousRedactor := slog.Default(), logLevel.Level(), logRedactor
+    previousLines, previousLimit := logRequestLines, bodyLogLimit
+    t.Cleanup(func() {
+        slog.SetDefault(previous)
+        logLevel.Set(previousLevel)
+        logRedactor = previousRedactor
+        logRequestLines, bodyLogLimit = previousLines, previousLimit
+    })
+
+    var buf bytes.Buffer
+    logLevel.Set(level)
+    logRedactor = NewRedactor(defaultRedactFields)
+    logRequestLines, bodyLogLimit = true, bodyLimit
+    slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: logLevel, ReplaceAttr: logRedactor.ReplaceAttr})))
+    return &buf
+}
+
+// assertNoPersonalData fails the test if any sample value appears in logs
+func assertNoPersonalData(t *testing.T, logs string) {
+    t.Helper()
+    if logs == "" {
+        t.Fatal("nothing was logged")
+    }
+    for _, value := range samplePersonalData {
+        if strings.Contains(logs, value) {
+            t.Errorf("%q was logged:\n%s", value, logs)
+        }
+    }
+    if !strings.Contains(logs, redacted) {
+        t.Errorf("nothing was redacted:\n%s", logs)
+    }
+}
+
+// serveLogged serves one request through the request context and logging
+// middleware
+func serveLogged(handler http.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+    rec := httptest.NewRecorder()
+    requestContext(logRequests(handler)).ServeHTTP(rec, req)
+    return rec
+}
+
+func TestAccessLogRedactsPersonalData(t *testing.T) {
+    logs := captureLogs(t, slog.LevelInfo, 0)
+    req := httptest.NewRequest(http.MethodGet, "/students/by-email/"+sampleEmail, nil)
+    serveLogged(func(w http.ResponseWriter, r *http.Request) {}, req)
+
+    assertNoPersonalData(t, logs.String())
+    if !strings.Contains(logs.String(), `"msg":"request"`) {
+        t.Errorf("no access line was logged:\n%s", logs)
+    }
+}
+
+func TestBodyLogRedactsPersonalData(t *testing.T) {
+    logs := captureLogs(t, slog.LevelDebug, 4096)
+    body, _ := json.Marshal(map[string]interface{}{
+        "name":    "Ada Lovelace",
+        "email":   sampleEmail,
+        "contact": map[string]string{"phone": samplePhone, "dateOfBirth": sampleDOB},
+    })
+    query := url.Values{"email": {sampleEmail}, "phone": {samplePhone}, "dob": {sampleDOB}, "sort": {"name"}}
+    req := httptest.NewRequest(http.MethodPost, "/students?"+query.Encode(), bytes.NewReader(body))
+    rec := serveLogged(func(w http.ResponseWriter, r *http.Request) {
+        received, _ := io.ReadAll(r.Body)
+        w.WriteHeader(http.StatusCreated)
+        w.Write(received)
+    }, req)
+
+    if rec.Body.String() != string(body) {
+        t.Fatalf("the handler received %s, want the request body unchanged", rec.Body)
+    }
+    assertNoPersonalData(t, logs.String())
+    for _, kept := range []string{"Ada Lovelace", "sort=name"} {
+        if !strings.Contains(logs.String(), kept) {
+            t.Errorf("%q should be logged:\n%s", kept, logs)
+        }
+    }
+}
+
+// TestBodyLogRedactsTruncatedBodies cuts the logged body inside the date of
+// birth, so it no longer parses as JSON
+func TestBodyLogRedactsTruncatedBodies(t *testing.T) {
+    body := fmt.Sprintf(`{"name": "Ada Lovelace", "phone": "%s", "dob": "%s", "email": "%s"}`, samplePhone, sampleDOB, sampleEmail)
+    logs := captureLogs(t, slog.LevelDebug, strings.Index(body, sampleDOB)+4)
+    serveLogged(func(w http.ResponseWriter, r *http.Request) {
+        io.Copy(io.Discard, r.Body)
+    }, httptest.NewRequest(http.MethodPost, "/students", strings.NewReader(body)))
+
+    assertNoPersonalData(t, logs.String())
+    if strings.Contains(logs.String(), sampleDOB[:4]) {
+        t.Errorf("the cut date of birth was logged:\n%s", logs)
+    }
+}
+
+func TestErrorLogRedactsPersonalData(t *testing.T) {
+    logs := captureLogs(t, slog.LevelInfo, 0)
+    serveLogged(func(w http.ResponseWriter, r *http.Request) {
+        err := fmt.Errorf("inserting student: %w", errors.New("duplicate email "+sampleEmail))
+        reqctx.Logger(r.Context()).Error("create failed for "+sampleEmail, "error", err,
+            "phone", samplePhone, "date_of_birth", sampleDOB, "student", `{"email":"`+sampleEmail+`"}`)
+        httpError(w, r, "Internal server error", http.StatusInternalServerError)
+    }, httptest.NewRequest(http.MethodPost, "/students", nil))
+
+    assertNoPersonalData(t, logs.String())
+    if !strings.Contains(logs.String(), "duplicate email "+redacted) {
+        t.Errorf("the error should be logged with the address redacted:\n%s", logs)
+    }
+}
+
+func TestRedactorFieldNames(t *testing.T) {
+    r := NewRedactor([]string{"date_of_birth", "phone"})
+    for _, key := range []string{"date_of_birth", "Date-Of-Birth", "dateOfBirth", "PHONE"} {
+        if !r.Field(key) {
+            t.Errorf("Field(%q) = false, want true", key)
+        }
+    }
+    if r.Field("email") {
+        t.Error("Field(\"email\") = true for a redactor without email")
+    }
+    if got := r.String("write to " + sampleEmail); !strings.Contains(got, sampleEmail) {
+        t.Errorf("String redacted an address without email configured: %q", got)
+    }
+}
+
+func TestLoadRedactorNone(t *testing.T) {
+    t.Setenv("LOG_REDACT_FIELDS", "none")
+    r := LoadRedactor()
+    a := r.ReplaceAttr(nil, slog.String("email", sampleEmail))
+    if a.Value.String() != sampleEmail {
+        t.Errorf("LOG_REDACT_FIELDS=none redacted email: %q", a.Value)
+    }
+}
+
+func TestRedactorSelfTest(t *testing.T) {
+    if err := NewRedactor(defaultRedactFields).SelfTest(); err != nil {
+        t.Error(err)
+    }
+    if err := NewRedactor([]string{"email"}).SelfTest(); err != nil {
+        t.Errorf("SelfTest only checks configured fields, got %v", err)
+    }
+}
@@ -0,0 +1,603 @@
+package main
+
+import (
+    "crypto/rand"
+    "database/sql"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "github.com/gorilla/mux"
+    "student-api/reqctx"
+)
+
+// Registration statuses. A registration is unverified until its email
+// address is confirmed, then pending until an admin approves it, which
+// creates the student, or rejects it.
+const (
+    RegistrationUnverified = "unverified"
+    RegistrationPending    = "pending"
+    RegistrationApproved   = "approved"
+    RegistrationRejected   = "rejected"
+)
+
+var registrationStatuses = map[string]bool{
+    RegistrationUnverified: true,
+    RegistrationPending:    true,
+    RegistrationApproved:   true,
+    RegistrationRejected:   true,
+}
+
+// registrationTokenPrefix marks email verification tokens in mail and logs
+const registrationTokenPrefix = "rv_"
+
+var (
+    errRegistrationNotFound = errors.New("registration not found")
+    errRegistrationChanged  = errors.New("registration has changed")
+    errRegistrationToken    = errors.New("verification token is invalid or expired")
+)
+
+// Registration is a student's request to be enrolled, made through the
+// public POST /register. It holds the student's fields until approval.
+type Registration struct {
+    ID         int        `json:"id"`
+    Tenant     string     `json:"tenant,omitempty"`
+    Name       string     `json:"name"`
+    Age        int        `json:"age"`
+    Email      string     `json:"email"`
+    Status     string     `json:"status"`
+    CreatedAt  time.Time  `json:"created_at"`
+    VerifiedAt *time.Time `json:"verified_at,omitempty"`
+    DecidedAt  *time.Time `json:"decided_at,omitempty"`
+    DecidedBy  string     `json:"decided_by,omitempty"`
+    Reason     string     `json:"reason,omitempty"`
+    // StudentID is the student an approval created
+    StudentID int `json:"student_id,omitempty"`
+
+    tokenHash      string
+    tokenExpiresAt time.Time
+}
+
+func (reg Registration) student() Student {
+    return Student{Name: reg.Name, Age: reg.Age, Email: reg.Email}
+}
+
+// RegistrationRequest is the body of POST /register
+type RegistrationRequest struct {
+    Name  string `json:"name"`
+    Age   int    `json:"age"`
+    Email string `json:"email"`
+}
+
+// RegistrationRepository persists registrations with the SHA-256 hex of
+// their verification token
+type RegistrationRepository interface {
+    Create(reg Registration) (Registration, error)
+    ByID(tenant string, id int) (Registration, error)
+    ByToken(tokenHash string) (Registration, error)
+    // Open returns the tenant's unverified or pending registration for an
+    // email address
+    Open(tenant, email string) (Registration, error)
+    // List returns the tenant's registrations with the status, oldest first
+    List(tenant, status string) ([]Registration, error)
+    // Update saves reg if its stored status is still from, and otherwise
+    // fails with errRegistrationChanged, so concurrent decisions cannot
+    // both apply
+    Update(reg Registration, from string) error
+}
+
+// MemoryRegistrationRepository keeps registrations in memory, for
+// STORE_BACKEND=memory
+type MemoryRegistrationRepository struct {
+    sync.RWMutex
+    registrations map[int]*Registration
+    nextID        int
+}
+
+// NewMemoryRegistrationRepository initializes a new MemoryRegistrationRepository
+func NewMemoryRegistrationRepository() *MemoryRegistrationRepository {
+    return &MemoryRegistrationRepository{registrations: make(map[int]*Registration), nextID: 1}
+}
+
+func (m *MemoryRegistrationRepository) Create(reg Registration) (Registration, error) {
+    m.Lock()
+    defer m.Unlock()
+    reg.ID = m.nextID
+    m.nextID++
+    m.registrations[reg.ID] = &reg
+    return reg, nil
+}
+
+func (m *MemoryRegistrationRepository) find(match func(*Registration) bool) (Registration, error) {
+    m.RLock()
+    defer m.RUnlock()
+    for _, reg := range m.registrations {
+        if match(reg) {
+            return *reg, nil
+        }
+    }
+    return Registration{}, errRegistrationNotFound
+}
+
+func (m *MemoryRegistrationRepository) ByID(tenant string, id int) (Registration, error) {
+    return m.find(func(reg *Registration) bool { return reg.ID == id && reg.Tenant == tenant })
+}
+
+func (m *MemoryRegistrationRepository) ByToken(tokenHash string) (Registration, error) {
+    return m.find(func(reg *Registration) bool { return reg.tokenHash == tokenHash })
+}
+
+func (m *MemoryRegistrationRepository) Open(tenant, email string) (Registration, error) {
+    return m.find(func(reg *Registration) bool {
+        return reg.Tenant == tenant && reg.Email == email && (reg.Status == RegistrationUnverified || reg.Status == RegistrationPending)
+    })
+}
+
+func (m *MemoryRegistrationRepository) List(tenant, status string) ([]Registration, error) {
+    m.RLock()
+    registrations := []Registration{}
+    for _, reg := range m.registrations {
+        if reg.Tenant == tenant && reg.Status == status {
+            registrations = append(registrations, *reg)
+        }
+    }
+    m.RUnlock()
+    sort.Slice(registrations, func(i, j int) bool { return registrations[i].ID < registrations[j].ID })
+    return registrations, nil
+}
+
+func (m *MemoryRegistrationRepository) Update(reg Registration, from string) error {
+    m.Lock()
+    defer m.Unlock()
+    stored, exists := m.registrations[reg.ID]
+    if !exists {
+        return errRegistrationNotFound
+    }
+    if stored.Status != from {
+        return errRegistrationChanged
+    }
+    m.registrations[reg.ID] = &reg
+    return nil
+}
+
+// SQLRegistrationRepository keeps registrations in the registrations table
+type SQLRegistrationRepository struct {
+    db     *sql.DB
+    rebind func(string) string
+    // returning is set for PostgreSQL, whose driver has no LastInsertId
+    returning bool
+}
+
+// NewSQLRegistrationRepository creates a repository; rebind may be nil
+func NewSQLRegistrationRepository(db *sql.DB, rebind func(string) string, returning bool) *SQLRegistrationRepository {
+    if rebind == nil {
+        rebind = func(q string) string { return q }
+    }
+    return &SQLRegistrationRepository{db: db, rebind: rebind, returning: returning}
+}
+
+const registrationColumns = `id, tenant, name, age, email, status, token_hash, token_expires_at, created_at, verified_at, decided_at, decided_by, reason, student_id`
+
+func scanRegistration(row interface{ Scan(...interface{}) error }) (Registration, error) {
+    var reg Registration
+    var expires, created string
+    var verified, decided sql.NullString
+    if err := row.Scan(&reg.ID, &reg.Tenant, &reg.Name, &reg.Age, &reg.Email, &reg.Status, &reg.tokenHash, &expires,
+        &created, &verified, &decided, &reg.DecidedBy, &reg.Reason, &reg.StudentID); err != nil {
+        return Registration{}, err
+    }
+    var err error
+    if reg.tokenExpiresAt, err = time.Parse(time.RFC3339Nano, expires); err != nil {
+        return Registration{}, err
+    }
+    if reg.CreatedAt, err = time.Parse(time.RFC3339Nano, created); err != nil {
+        return Registration{}, err
+    }
+    for _, field := range []struct {
+        value sql.NullString
+        to    **time.Time
+    }{{verified, &reg.VerifiedAt}, {decided, &reg.DecidedAt}} {
+        if !field.value.Valid {
+            continue
+        }
+        at, err := time.Parse(time.RFC3339Nano, field.value.String)
+        if err != nil {
+            return Registration{}, err
+        }
+        *field.to = &at
+    }
+    return reg, nil
+}
+
+func (s *SQLRegistrationRepository) Create(reg Registration) (Registration, error) {
+    query := `INSERT INTO registrations (tenant, name, age, email, status, token_hash, token_expires_at, created_at, verified_at, decided_by, reason, student_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, '', '', 0)`
+    args := []interface{}{reg.Tenant, reg.Name, reg.Age, reg.Email, reg.Status, reg.tokenHash, reg.tokenExpiresAt.Format(time.RFC3339Nano),
+        reg.CreatedAt.Format(time.RFC3339Nano), nullTime(reg.VerifiedAt)}
+    if s.returning {
+        var id int64
+        if err := s.db.QueryRow(s.rebind(query+` RETURNING id`), args...).Scan(&id); err != nil {
+            return Registration{}, err
+        }
+        reg.ID = int(id)
+        return reg, nil
+    }
+    result, err := s.db.Exec(s.rebind(query), args...)
+    if err != nil {
+        return Registration{}, err
+    }
+    id, err := result.LastInsertId()
+    if err != nil {
+        return Registration{}, err
+    }
+    reg.ID = int(id)
+    return reg, nil
+}
+
+func (s *SQLRegistrationRepository) one(where string, args ...interface{}) (Registration, error) {
+    row := s.db.QueryRow(s.rebind(`SELECT `+registrationColumns+` FROM registrations WHERE `+where), args...)
+    reg, err := scanRegistration(row)
+    if errors.Is(err, sql.ErrNoRows) {
+        return Registration{}, errRegistrationNotFound
+    }
+    return reg, err
+}
+
+func (s *SQLRegistrationRepository) ByID(tenant string, id int) (Registration, error) {
+    return s.one(`tenant = ? AND id = ?`, tenant, id)
+}
+
+func (s *SQLRegistrationRepository) ByToken(tokenHash string) (Registration, error) {
+    return s.one(`token_hash = ?`, tokenHash)
+}
+
+func (s *SQLRegistrationRepository) Open(tenant, email string) (Registration, error) {
+    return s.one(`tenant = ? AND email = ? AND status IN (?, ?)`, tenant, email, RegistrationUnverified, RegistrationPending)
+}
+
+func (s *SQLRegistrationRepository) List(tenant, status string) ([]Registration, error) {
+    rows, err := s.db.Query(s.rebind(`SELECT `+registrationColumns+` FROM registrations WHERE tenant = ? AND status = ? ORDER BY id`), tenant, status)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    registrations := []Registration{}
+    for rows.Next() {
+        reg, err := scanRegistration(rows)
+        if err != nil {
+            return nil, err
+        }
+        registrations = append(registrations, reg)
+    }
+    return registrations, rows.Err()
+}
+
+func (s *SQLRegistrationRepository) Update(reg Registration, from string) error {
+    result, err := s.db.Exec(s.rebind(`UPDATE registrations SET name = ?, age = ?, status = ?, token_hash = ?, token_expires_at = ?, verified_at = ?, decided_at = ?, decided_by = ?, reason = ?, student_id = ? WHERE id = ? AND status = ?`),
+        reg.Name, reg.Age, reg.Status, reg.tokenHash, reg.tokenExpiresAt.Format(time.RFC3339Nano), nullTime(reg.VerifiedAt), nullTime(reg.DecidedAt),
+        reg.DecidedBy, reg.Reason, reg.StudentID, reg.ID, from)
+    if err != nil {
+        return err
+    }
+    if n, err := result.RowsAffected(); err == nil && n == 0 {
+        if _, err := s.ByID(reg.Tenant, reg.ID); err != nil {
+            return err
+        }
+        return errRegistrationChanged
+    }
+    return nil
+}
+
+// RegistrationStore runs self-registration: registering, verifying the
+// email address and recording an admin's decision
+type RegistrationStore struct {
+    repo RegistrationRepository
+    // enabled opens POST /register to anyone
+    enabled bool
+    // verify requires the email address to be confirmed before a
+    // registration is queued for approval
+    verify   bool
+    tokenTTL time.Duration
+}
+
+// LoadRegistrationStore reads STUDENT_SELF_REGISTRATION (default false),
+// REGISTRATION_VERIFY_EMAIL (default true) and REGISTRATION_TOKEN_TTL
+// (default 24h)
+func LoadRegistrationStore(repo RegistrationRepository) (*RegistrationStore, error) {
+    s := &RegistrationStore{
+        repo:     repo,
+        enabled:  getEnvBool("STUDENT_SELF_REGISTRATION", false),
+        verify:   getEnvBool("REGISTRATION_VERIFY_EMAIL", true),
+        tokenTTL: getEnvDuration("REGISTRATION_TOKEN_TTL", 24*time.Hour),
+    }
+    if s.tokenTTL <= 0 {
+        return nil, fmt.Errorf("REGISTRATION_TOKEN_TTL must be positive, got %s", s.tokenTTL)
+    }
+    return s, nil
+}
+
+// Register records a registration, or returns the tenant's open one for the
+// same email. An unverified registration gets a fresh token and fields,
+// which is how a registrant asks for the mail again. The token is empty
+// when there is nothing to verify.
+func (s *RegistrationStore) Register(tenant string, req RegistrationRequest, now time.Time) (Registration, string, error) {
+    email := strings.ToLower(strings.TrimSpace(req.Email))
+    existing, err := s.repo.Open(tenant, email)
+    switch {
+    case err == nil && existing.Status == RegistrationPending:
+        return existing, "", nil
+    case err != nil && !errors.Is(err, errRegistrationNotFound):
+        return Registration{}, "", err
+    }
+
+    reg := Registration{Tenant: tenant, Name: strings.TrimSpace(req.Name), Age: req.Age, Email: email, Status: RegistrationPending, CreatedAt: now}
+    var token string
+    if s.verify {
+        buf := make([]byte, 32)
+        if _, err := rand.Read(buf); err != nil {
+            return Registration{}, "", err
+        }
+        token = registrationTokenPrefix + hex.EncodeToString(buf)
+        reg.Status, reg.tokenHash, reg.tokenExpiresAt = RegistrationUnverified, hashResetToken(token), now.Add(s.tokenTTL)
+    } else {
+        reg.VerifiedAt = &now
+    }
+    if err == nil {
+        reg.ID, reg.CreatedAt = existing.ID, existing.CreatedAt
+        return reg, token, s.repo.Update(reg, RegistrationUnverified)
+    }
+    reg, err = s.repo.Create(reg)
+    return reg, token, err
+}
+
+// Verify redeems a verification token, queueing its registration for approval
+func (s *RegistrationStore) Verify(token string, now time.Time) (Registration, error) {
+    reg, err := s.repo.ByToken(hashResetToken(token))
+    if errors.Is(err, errRegistrationNotFound) {
+        return Registration{}, errRegistrationToken
+    }
+    if err != nil {
+        return Registration{}, err
+    }
+    if reg.Status != RegistrationUnverified || !now.Before(reg.tokenExpiresAt) {
+        return Registration{}, errRegistrationToken
+    }
+    reg.Status, reg.VerifiedAt, reg.tokenHash = RegistrationPending, &now, ""
+    if err := s.repo.Update(reg, RegistrationUnverified); errors.Is(err, errRegistrationChanged) {
+        return Registration{}, errRegistrationToken
+    } else if err != nil {
+        return Registration{}, err
+    }
+    return reg, nil
+}
+
+// Decide moves a pending registration to approved or rejected. When admins
+// decide at once, one decision applies and the others fail with
+// errRegistrationChanged and the registration as decided.
+func (s *RegistrationStore) Decide(tenant string, id int, status, by, reason string, now time.Time) (Registration, error) {
+    reg, err := s.repo.ByID(tenant, id)
+    if err != nil {
+        return Registration{}, err
+    }
+    if reg.Status != RegistrationPending {
+        return reg, errRegistrationChanged
+    }
+    decided := reg
+    decided.Status, decided.DecidedAt, decided.DecidedBy, decided.Reason = status, &now, by, reason
+    if err := s.repo.Update(decided, RegistrationPending); errors.Is(err, errRegistrationChanged) {
+        if reg, err = s.repo.ByID(tenant, id); err != nil {
+            return Registration{}, err
+        }
+        return reg, errRegistrationChanged
+    } else if err != nil {
+        return Registration{}, err
+    }
+    return decided, nil
+}
+
+// Approved records the student an approval created, or on failure puts the
+// registration back in the queue
+func (s *RegistrationStore) Approved(reg Registration, studentID int) (Registration, error) {
+    if studentID == 0 {
+        reg.Status, reg.DecidedAt, reg.DecidedBy = RegistrationPending, nil, ""
+        return reg, s.repo.Update(reg, RegistrationApproved)
+    }
+    reg.StudentID = studentID
+    return reg, s.repo.Update(reg, RegistrationApproved)
+}
+
+// emailRegistrationVerification mails a verification token through
+// SMTP_HOST. When REGISTRATION_VERIFY_URL is set the token is appended to it
+// as a link.
+func emailRegistrationVerification(reg Registration, token string, expires time.Time) error {
+    host := getEnv("SMTP_HOST", "")
+    if host == "" {
+        return errors.New("SMTP_HOST is not set")
+    }
+    from := getEnv("SMTP_FROM", "accounts@localhost")
+    instructions := "Your verification token is:\r\n\r\n" + token
+    if link := getEnv("REGISTRATION_VERIFY_URL", ""); link != "" {
+        instructions = "Confirm your email address at:\r\n\r\n" + link + token
+    }
+    msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: Confirm your registration\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n"+
+        "Hello %s,\r\n\r\n%s\r\n\r\nIt expires at %s. Once confirmed, your registration waits for approval. If you did not register, ignore this message.\r\n",
+        from, reg.Email, reg.Name, instructions, expires.Format(time.RFC1123))
+    return sendMail(host, from, []string{reg.Email}, []byte(msg))
+}
+
+// RegisterStudent asks for enrolment when STUDENT_SELF_REGISTRATION is on:
+// POST /register {"name": "...", "age": 20, "email": "..."}. The student is
+// created once the email address is verified and an admin approves. The
+// answer is the same for a new registration and a repeated one, and mail
+// goes out in the background, so neither tells whether the address is
+// already registered.
+func (app *App) RegisterStudent(w http.ResponseWriter, r *http.Request) {
+    if !app.registrations.enabled {
+        httpError(w, r, "Self-registration is disabled; ask an admin to enrol you", http.StatusForbidden)
+        return
+    }
+    var req RegistrationRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        httpError(w, r, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    if verrs := app.validateStudent(Student{Name: req.Name, Age: req.Age, Email: req.Email}); len(verrs) > 0 {
+        writeValidationErrors(w, r, verrs)
+        return
+    }
+    logger := reqctx.Logger(r.Context())
+    now := time.Now().UTC()
+    reg, token, err := app.registrations.Register(reqctx.Tenant(r.Context()), req, now)
+    if err != nil {
+        logger.Error("registering student failed", "error", err)
+        httpError(w, r, "Internal server error", http.StatusInternalServerError)
+        return
+    }
+    // A registration already waiting for approval is left as it was
+    if token != "" || reg.CreatedAt.Equal(now) {
+        app.metrics.Inc("registrations_total", "status", reg.Status)
+    }
+    status := "Your registration is waiting for approval"
+    if token != "" {
+        status = "Check your email to confirm your address"
+        go func() {
+            if err := emailRegistrationVerification(reg, token, reg.tokenExpiresAt); err != nil {
+                logger.Error("mailing registration verification failed", "registration_id", reg.ID, "error", err)
+                return
+            }
+            logger.Info("registration verification mailed", "registration_id", reg.ID)
+        }()
+    }
+    w.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(w).Encode(map[string]string{"status": status})
+}
+
+// VerifyRegistration confirms a registrant's email address:
+// POST /register/verify {"token": "rv_..."}
+func (app *App) VerifyRegistration(w http.ResponseWriter, r *http.Request) {
+    var body struct {
+        Token string `json:"token"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Token == "" {
+        httpError(w, r, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    reg, err := app.registrations.Verify(body.Token, time.Now().UTC())
+    switch {
+    case errors.Is(err, errRegistrationToken):
+        httpError(w, r, "Invalid or expired verification token", http.StatusBadRequest)
+        return
+    case err != nil:
+        reqctx.Logger(r.Context()).Error("verifying registration failed", "error", err)
+        httpError(w, r, "Internal server error", http.StatusInternalServerError)
+        return
+    }
+    app.metrics.Inc("registrations_total", "status", reg.Status)
+    reqctx.Logger(r.Context()).Info("registration verified", "registration_id", reg.ID)
+    json.NewEncoder(w).Encode(map[string]string{"status": "Your registration is waiting for approval"})
+}
+
+// ListPendingRegistrations lists the approval queue: GET /admin/pending,
+// or registrations in another state with ?status=
+func (app *App) ListPendingRegistrations(w http.ResponseWriter, r *http.Request) {
+    status := r.URL.Query().Get("status")
+    if status == "" {
+        status = RegistrationPending
+    }
+    if !registrationStatuses[status] {
+        writeValidationErrors(w, r, []ValidationError{{Field: "status", Code: CodeOutOfRange,
+            Message: fmt.Sprintf("Status must be %s, %s, %s or %s", RegistrationUnverified, RegistrationPending, RegistrationApproved, RegistrationRejected)}})
+        return
+    }
+    registrations, err := app.registrations.repo.List(reqctx.Tenant(r.Context()), status)
+    if err != nil {
+        reqctx.Logger(r.Context()).Error("listing registrations failed", "error", err)
+        httpError(w, r, "Internal server error", http.StatusInternalServerError)
+        return
+    }
+    json.NewEncoder(w).Encode(registrations)
+}
+
+// ApproveRegistration creates the student of a pending registration:
+// POST /admin/pending/{id}/approve
+func (app *App) ApproveRegistration(w http.ResponseWriter, r *http.Request) {
+    reg, ok := app.decideRegistration(w, r, RegistrationApproved, "")
+    if !ok {
+        return
+    }
+    logger := reqctx.Logger(r.Context())
+    // The email policy may have changed since the registration was made
+    if verrs := app.validateStudent(reg.student()); len(verrs) > 0 {
+        app.registrations.Approved(reg, 0)
+        writeValidationErrors(w, r, verrs)
+        return
+    }
+    student, version, err := app.storeFor(r).Create(reg.student())
+    if err != nil {
+        if _, rerr := app.registrations.Approved(reg, 0); rerr != nil {
+            logger.Error("requeueing registration failed", "registration_id", reg.ID, "error", rerr)
+        }
+        writeStoreError(w, r, err)
+        return
+    }
+    app.recordChanges(r, version)
+    if reg, err = app.registrations.Approved(reg, student.ID); err != nil {
+        logger.Error("recording approved registration failed", "registration_id", reg.ID, "student_id", student.ID, "error", err)
+    }
+    app.metrics.Inc("registrations_total", "status", RegistrationApproved)
+    logger.Info("registration approved", "registration_id", reg.ID, "student_id", student.ID)
+    json.NewEncoder(w).Encode(reg)
+}
+
+// RejectRegistration turns down a pending registration:
+// POST /admin/pending/{id}/reject {"reason": "..."}, the body optional
+func (app *App) RejectRegistration(w http.ResponseWriter, r *http.Request) {
+    var body struct {
+        Reason string `json:"reason"`
+    }
+    if r.ContentLength != 0 {
+        if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+            httpError(w, r, "Invalid request body", http.StatusBadRequest)
+            return
+        }
+    }
+    reg, ok := app.decideRegistration(w, r, RegistrationRejected, strings.TrimSpace(body.Reason))
+    if !ok {
+        return
+    }
+    app.metrics.Inc("registrations_total", "status", RegistrationRejected)
+    reqctx.Logger(r.Context()).Info("registration rejected", "registration_id", reg.ID)
+    json.NewEncoder(w).Encode(reg)
+}
+
+// decideRegistration records a decision on the {id} registration, answering
+// the request when it cannot
+func (app *App) decideRegistration(w http.ResponseWriter, r *http.Request, status, reason string) (Registration, bool) {
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        httpError(w, r, "Invalid ID", http.StatusBadRequest)
+        return Registration{}, false
+    }
+    by := reqctx.User(r.Context())
+    if by == "" {
+        by = "admin"
+    }
+    reg, err := app.registrations.Decide(reqctx.Tenant(r.Context()), id, status, by, reason, time.Now().UTC())
+    switch {
+    case errors.Is(err, errRegistrationNotFound):
+        httpError(w, r, "Registration not found", http.StatusNotFound)
+    case errors.Is(err, errRegistrationChanged):
+        httpError(w, r, fmt.Sprintf("Registration is %s, not pending", reg.Status), http.StatusConflict)
+    case err != nil:
+        reqctx.Logger(r.Context()).Error("deciding registration failed", "registration_id", id, "error", err)
+        httpError(w, r, "Internal server error", http.StatusInternalServerError)
+    default:
+        return reg, true
+    }
+    return Registration{}, false
+}
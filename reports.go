@@ -0,0 +1,252 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "encoding/csv"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+    "student-api/reqctx"
+)
+
+// reportKeywords are the statements a report query may start with
+var reportKeywords = map[string]bool{"SELECT": true, "WITH": true, "VALUES": true}
+
+// sqliteWriteOpcodes are the VDBE opcodes of statements that modify the
+// database or its schema; EXPLAIN lists them before anything runs. Insert
+// and Delete are left out because read queries use them on temporary
+// tables; a real table can only be written through an OpenWrite cursor.
+var sqliteWriteOpcodes = map[string]bool{
+    "OpenWrite":   true,
+    "Clear":       true,
+    "Destroy":     true,
+    "CreateBtree": true,
+    "ParseSchema": true,
+    "SetCookie":   true,
+    "VUpdate":     true,
+    "VCreate":     true,
+    "VDestroy":    true,
+}
+
+// errReportRejected wraps reasons a query is refused before it runs
+var errReportRejected = errors.New("query rejected")
+
+// ReportRequest is the body of POST /admin/reports/query
+type ReportRequest struct {
+    SQL     string        `json:"sql"`
+    Params  []interface{} `json:"params,omitempty"`
+    Format  string        `json:"format,omitempty"`
+    MaxRows int           `json:"max_rows,omitempty"`
+}
+
+// ReportResult is a report query's output in JSON format
+type ReportResult struct {
+    Columns   []string        `json:"columns"`
+    Rows      [][]interface{} `json:"rows"`
+    Truncated bool            `json:"truncated"`
+    Elapsed   string          `json:"elapsed"`
+}
+
+// ReportRunner executes ad-hoc read-only SQL on its own query-only SQLite
+// connection, so reports neither share the store's pool nor can write
+type ReportRunner struct {
+    db      *sql.DB
+    maxRows int
+    timeout time.Duration
+}
+
+// OpenReportRunner opens a query-only connection to the database at path,
+// limited by REPORT_MAX_ROWS and REPORT_TIMEOUT
+func OpenReportRunner(path string) (*ReportRunner, error) {
+    db, err := sql.Open("sqlite3", sqliteDSN(path)+"&_query_only=true")
+    if err != nil {
+        return nil, err
+    }
+    db.SetMaxOpenConns(2)
+    return &ReportRunner{
+        db:      db,
+        maxRows: getEnvInt("REPORT_MAX_ROWS", 10000),
+        timeout: getEnvDuration("REPORT_TIMEOUT", 10*time.Second),
+    }, nil
+}
+
+// Close closes the report connection
+func (rr *ReportRunner) Close() error {
+    return rr.db.Close()
+}
+
+// check refuses anything but a single read statement. The keyword check
+// keeps out PRAGMA and ATTACH; EXPLAIN catches writes hidden in a CTE.
+func (rr *ReportRunner) check(ctx context.Context, query string, params []interface{}) error {
+    if strings.Contains(query, ";") {
+        return fmt.Errorf("%w: only a single statement is allowed", errReportRejected)
+    }
+    fields := strings.Fields(query)
+    if len(fields) == 0 {
+        return fmt.Errorf("%w: sql is required", errReportRejected)
+    }
+    if keyword := strings.ToUpper(fields[0]); !reportKeywords[keyword] {
+        return fmt.Errorf("%w: %s statements are not allowed", errReportRejected, keyword)
+    }
+
+    rows, err := rr.db.QueryContext(ctx, "EXPLAIN "+query, params...)
+    if err != nil {
+        return fmt.Errorf("%w: %v", errReportRejected, err)
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var addr, p1, p2 int
+        var opcode string
+        var p3, p4, p5, comment interface{}
+        if err := rows.Scan(&addr, &opcode, &p1, &p2, &p3, &p4, &p5, &comment); err != nil {
+            return err
+        }
+        // Transaction with a non-zero P2 opens a write transaction
+        if sqliteWriteOpcodes[opcode] || (opcode == "Transaction" && p2 != 0) {
+            return fmt.Errorf("%w: statement writes to the database (%s)", errReportRejected, opcode)
+        }
+    }
+    return rows.Err()
+}
+
+// Run checks and executes a report query, returning at most maxRows rows
+func (rr *ReportRunner) Run(ctx context.Context, req ReportRequest) (ReportResult, error) {
+    ctx, cancel := context.WithTimeout(ctx, rr.timeout)
+    defer cancel()
+    started := time.Now()
+    // The driver reports an interrupted query rather than the deadline
+    fail := func(err error) (ReportResult, error) {
+        if ctx.Err() != nil {
+            return ReportResult{}, ctx.Err()
+        }
+        return ReportResult{}, err
+    }
+
+    query := strings.TrimRight(strings.TrimSpace(req.SQL), "; \t\n")
+    if err := rr.check(ctx, query, req.Params); err != nil {
+        return fail(err)
+    }
+    maxRows := rr.maxRows
+    if req.MaxRows > 0 && req.MaxRows < maxRows {
+        maxRows = req.MaxRows
+    }
+
+    rows, err := rr.db.QueryContext(ctx, query, req.Params...)
+    if err != nil {
+        return fail(err)
+    }
+    defer rows.Close()
+    columns, err := rows.Columns()
+    if err != nil {
+        return fail(err)
+    }
+
+    result := ReportResult{Columns: columns, Rows: make([][]interface{}, 0)}
+    for rows.Next() {
+        if len(result.Rows) == maxRows {
+            result.Truncated = true
+            break
+        }
+        values := make([]interface{}, len(columns))
+        ptrs := make([]interface{}, len(columns))
+        for i := range values {
+            ptrs[i] = &values[i]
+        }
+        if err := rows.Scan(ptrs...); err != nil {
+            return fail(err)
+        }
+        for i, v := range values {
+            if b, ok := v.([]byte); ok {
+                values[i] = string(b)
+            }
+        }
+        result.Rows = append(result.Rows, values)
+    }
+    if err := rows.Err(); err != nil {
+        return fail(err)
+    }
+    result.Elapsed = time.Since(started).String()
+    return result, nil
+}
+
+// reportCell renders a scanned value for CSV
+func reportCell(v interface{}) string {
+    switch v := v.(type) {
+    case nil:
+        return ""
+    case time.Time:
+        return v.UTC().Format(time.RFC3339Nano)
+    default:
+        return fmt.Sprint(v)
+    }
+}
+
+// RunReport executes read-only SQL for ad-hoc reporting: POST
+// /admin/reports/query {"sql": "SELECT age, COUNT(*) FROM students GROUP BY age",
+// "format": "csv"}. JSON is the default format.
+func (app *App) RunReport(w http.ResponseWriter, r *http.Request) {
+    if app.reports == nil {
+        httpError(w, r, "Reports are only available with the sqlite backend", http.StatusNotImplemented)
+        return
+    }
+    var req ReportRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        httpError(w, r, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    if req.Format != "" && req.Format != "json" && req.Format != "csv" {
+        httpError(w, r, "Format must be json or csv", http.StatusBadRequest)
+        return
+    }
+
+    result, err := app.reports.Run(r.Context(), req)
+    switch {
+    case errors.Is(err, errReportRejected):
+        httpError(w, r, err.Error(), http.StatusBadRequest)
+        return
+    case errors.Is(err, context.DeadlineExceeded):
+        httpError(w, r, "Report query timed out", http.StatusGatewayTimeout)
+        return
+    case err != nil:
+        reqctx.Logger(r.Context()).Warn("report query failed", "error", err)
+        httpError(w, r, "Query failed: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+    reqctx.Logger(r.Context()).Info("report query", "rows", len(result.Rows), "elapsed", result.Elapsed)
+    result = app.masker.Report(result)
+
+    if req.Format != "csv" {
+        json.NewEncoder(w).Encode(result)
+        return
+    }
+    w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+    w.Header().Set("Content-Disposition", `attachment; filename="report.csv"`)
+    w.Header().Set("X-Report-Truncated", strconv.FormatBool(result.Truncated))
+    if err := writeReportCSV(w, result, app.csvEscapeFormulas); err != nil {
+        reqctx.Logger(r.Context()).Error("writing csv report failed", "error", err)
+    }
+}
+
+// writeReportCSV renders a report as CSV with a header row
+func writeReportCSV(w io.Writer, result ReportResult, escapeFormulas bool) error {
+    cw := csv.NewWriter(w)
+    cw.Write(result.Columns)
+    for _, row := range result.Rows {
+        record := make([]string, len(row))
+        for i, v := range row {
+            record[i] = reportCell(v)
+            if escapeFormulas {
+                record[i] = escapeCSVCell(record[i])
+            }
+        }
+        cw.Write(record)
+    }
+    cw.Flush()
+    return cw.Error()
+}
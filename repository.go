@@ -0,0 +1,173 @@
+package main
+
+import (
+    "database/sql"
+    "fmt"
+    "maps"
+    "sync"
+    "time"
+)
+
+// StudentRepository persists students. StudentStore layers history, change
+// events and locking on top of it, so any implementation can back the API.
+// Missing students are reported as errStudentNotFound.
+type StudentRepository interface {
+    // Create stores a new student. A non-zero ID is kept, which is how
+    // deleted students are restored; otherwise a fresh ID is assigned.
+    Create(student Student) (Student, error)
+    Get(id int) (Student, error)
+    // List returns the students selected by opts, in opts.Sort order
+    List(opts ListOptions) ([]Student, error)
+    // Count returns how many students match the filter
+    Count(f *Filter) (int, error)
+    Update(student Student) (Student, error)
+    Delete(id int) error
+    // Transaction runs fn against a view of the repository whose writes
+    // are committed together when fn succeeds and discarded when it fails
+    Transaction(fn func(tx StudentRepository) error) error
+}
+
+// Store backends selected by STORE_BACKEND; see also BackendPostgres and
+// BackendMySQL
+const (
+    // BackendSQLite keeps students in the DATABASE_PATH SQLite file
+    BackendSQLite = "sqlite"
+    // BackendMemory keeps students in memory only; they are lost on restart
+    BackendMemory = "memory"
+)
+
+// ListOptions selects students from a repository. A nil filter matches
+// everything and students are ordered by Sort, then by ID. A zero Limit
+// returns every match, and Offset only applies together with a Limit.
+type ListOptions struct {
+    Filter *Filter
+    Sort   []SortKey
+    Limit  int
+    Offset int
+    // IncludeDeleted keeps deleted students in StudentStore's results;
+    // repositories see deletion only through Filter
+    IncludeDeleted bool
+}
+
+// StudentUpserter is implemented by repositories that can insert or replace a
+// student by ID in a single statement
+type StudentUpserter interface {
+    Upsert(student Student) (Student, error)
+}
+
+// configurePool applies DB_MAX_OPEN_CONNS, DB_MAX_IDLE_CONNS,
+// DB_CONN_MAX_LIFETIME and DB_CONN_MAX_IDLE_TIME to a server database pool
+func configurePool(db *sql.DB) {
+    db.SetMaxOpenConns(getEnvInt("DB_MAX_OPEN_CONNS", 10))
+    db.SetMaxIdleConns(getEnvInt("DB_MAX_IDLE_CONNS", 5))
+    db.SetConnMaxLifetime(getEnvDuration("DB_CONN_MAX_LIFETIME", 30*time.Minute))
+    db.SetConnMaxIdleTime(getEnvDuration("DB_CONN_MAX_IDLE_TIME", 5*time.Minute))
+}
+
+// MemoryRepository is a StudentRepository held in a map, for demos and
+// test doubles
+type MemoryRepository struct {
+    sync.RWMutex
+    students map[int]Student
+    nextID   int
+}
+
+// NewMemoryRepository initializes an empty MemoryRepository
+func NewMemoryRepository() *MemoryRepository {
+    return &MemoryRepository{students: make(map[int]Student), nextID: 1}
+}
+
+// Create stores a student, under its own ID if it has one
+func (r *MemoryRepository) Create(student Student) (Student, error) {
+    r.Lock()
+    defer r.Unlock()
+    if student.ID == 0 {
+        student.ID = r.nextID
+    } else if _, exists := r.students[student.ID]; exists {
+        return Student{}, fmt.Errorf("student %d already exists", student.ID)
+    }
+    if student.ID >= r.nextID {
+        r.nextID = student.ID + 1
+    }
+    r.students[student.ID] = student
+    return student, nil
+}
+
+// Get returns a student by ID
+func (r *MemoryRepository) Get(id int) (Student, error) {
+    r.RLock()
+    defer r.RUnlock()
+    student, exists := r.students[id]
+    if !exists {
+        return Student{}, errStudentNotFound
+    }
+    return student, nil
+}
+
+// Transaction runs fn against the repository, restoring its previous
+// contents when fn fails
+func (r *MemoryRepository) Transaction(fn func(tx StudentRepository) error) error {
+    r.RLock()
+    saved, nextID := maps.Clone(r.students), r.nextID
+    r.RUnlock()
+    if err := fn(r); err != nil {
+        r.Lock()
+        r.students, r.nextID = saved, nextID
+        r.Unlock()
+        return err
+    }
+    return nil
+}
+
+// List returns the students selected by opts, in opts.Sort order
+func (r *MemoryRepository) List(opts ListOptions) ([]Student, error) {
+    r.RLock()
+    defer r.RUnlock()
+    students := make([]Student, 0, len(r.students))
+    for _, student := range r.students {
+        if opts.Filter.Match(student) {
+            students = append(students, student)
+        }
+    }
+    sortStudents(students, opts.Sort)
+    if opts.Limit > 0 {
+        start := min(opts.Offset, len(students))
+        students = students[start:min(start+opts.Limit, len(students))]
+    }
+    return students, nil
+}
+
+// Count returns how many students match the filter
+func (r *MemoryRepository) Count(f *Filter) (int, error) {
+    r.RLock()
+    defer r.RUnlock()
+    n := 0
+    for _, student := range r.students {
+        if f.Match(student) {
+            n++
+        }
+    }
+    return n, nil
+}
+
+// Update overwrites an existing student
+func (r *MemoryRepository) Update(student Student) (Student, error) {
+    r.Lock()
+    defer r.Unlock()
+    if _, exists := r.students[student.ID]; !exists {
+        return Student{}, errStudentNotFound
+    }
+    r.students[student.ID] = student
+    return student, nil
+}
+
+// Delete removes a student
+func (r *MemoryRepository) Delete(id int) error {
+    r.Lock()
+    defer r.Unlock()
+    if _, exists := r.students[id]; !exists {
+        return errStudentNotFound
+    }
+    delete(r.students, id)
+    return nil
+}
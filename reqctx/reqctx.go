@@ -0,0 +1,107 @@
+// Package reqctx carries per-request identity through a context.Context so
+// handlers, stores, background jobs and LLM calls log and audit with the
+// same request ID, user, tenant and locale.
+package reqctx
+
+import (
+    "context"
+    "log/slog"
+)
+
+// Info is the identity attached to a request
+type Info struct {
+    RequestID string
+    User      string
+    Role      string
+    Tenant    string
+    Locale    string
+}
+
+type infoKey struct{}
+
+// With returns a copy of ctx carrying info
+func With(ctx context.Context, info Info) context.Context {
+    return context.WithValue(ctx, infoKey{}, info)
+}
+
+// From returns the info stored in ctx, or the zero Info
+func From(ctx context.Context) Info {
+    info, _ := ctx.Value(infoKey{}).(Info)
+    return info
+}
+
+// WithRequestID returns a copy of ctx with the request ID set
+func WithRequestID(ctx context.Context, id string) context.Context {
+    info := From(ctx)
+    info.RequestID = id
+    return With(ctx, info)
+}
+
+// WithUser returns a copy of ctx with the authenticated user set
+func WithUser(ctx context.Context, user string) context.Context {
+    info := From(ctx)
+    info.User = user
+    return With(ctx, info)
+}
+
+// WithRole returns a copy of ctx with the authenticated user's role set
+func WithRole(ctx context.Context, role string) context.Context {
+    info := From(ctx)
+    info.Role = role
+    return With(ctx, info)
+}
+
+// WithTenant returns a copy of ctx with the tenant set
+func WithTenant(ctx context.Context, tenant string) context.Context {
+    info := From(ctx)
+    info.Tenant = tenant
+    return With(ctx, info)
+}
+
+// WithLocale returns a copy of ctx with the locale set
+func WithLocale(ctx context.Context, locale string) context.Context {
+    info := From(ctx)
+    info.Locale = locale
+    return With(ctx, info)
+}
+
+// RequestID returns the request ID in ctx
+func RequestID(ctx context.Context) string { return From(ctx).RequestID }
+
+// User returns the authenticated user in ctx
+func User(ctx context.Context) string { return From(ctx).User }
+
+// Role returns the authenticated user's role in ctx
+func Role(ctx context.Context) string { return From(ctx).Role }
+
+// Tenant returns the tenant in ctx
+func Tenant(ctx context.Context) string { return From(ctx).Tenant }
+
+// Locale returns the locale in ctx
+func Locale(ctx context.Context) string { return From(ctx).Locale }
+
+// Attrs returns the non-empty fields as slog attributes
+func (i Info) Attrs() []any {
+    var attrs []any
+    if i.RequestID != "" {
+        attrs = append(attrs, slog.String("request_id", i.RequestID))
+    }
+    if i.User != "" {
+        attrs = append(attrs, slog.String("user", i.User))
+    }
+    if i.Role != "" {
+        attrs = append(attrs, slog.String("role", i.Role))
+    }
+    if i.Tenant != "" {
+        attrs = append(attrs, slog.String("tenant", i.Tenant))
+    }
+    if i.Locale != "" {
+        attrs = append(attrs, slog.String("locale", i.Locale))
+    }
+    return attrs
+}
+
+// Logger returns the default logger annotated with the identity in ctx
+func Logger(ctx context.Context) *slog.Logger {
+    return slog.Default().With(From(ctx).Attrs()...)
+}
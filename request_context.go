@@ -0,0 +1,54 @@
+package main
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "net/http"
+    "regexp"
+    "strings"
+    "student-api/reqctx"
+)
+
+// RequestIDHeader carries the request ID in both directions
+const RequestIDHeader = "X-Request-ID"
+
+// validRequestID limits client-supplied request IDs to safe, log-friendly values
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+func newRequestID() string {
+    b := make([]byte, 8)
+    rand.Read(b)
+    return hex.EncodeToString(b)
+}
+
+// primaryLocale returns the first language tag of an Accept-Language header
+func primaryLocale(header string) string {
+    tag, _, _ := strings.Cut(header, ",")
+    tag, _, _ = strings.Cut(tag, ";")
+    tag = strings.TrimSpace(tag)
+    if tag == "*" {
+        return ""
+    }
+    return tag
+}
+
+// requestContext attaches the request's identity (see package reqctx) to its
+// context: the caller's X-Request-ID or a new one, the X-Tenant-ID header,
+// which authentication checks against the principal's tenant, and the
+// preferred Accept-Language locale. The request ID is echoed back.
+func requestContext(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        id := r.Header.Get(RequestIDHeader)
+        if !validRequestID.MatchString(id) {
+            id = newRequestID()
+        }
+        w.Header().Set(RequestIDHeader, id)
+
+        ctx := reqctx.With(r.Context(), reqctx.Info{
+            RequestID: id,
+            Tenant:    strings.TrimSpace(r.Header.Get("X-Tenant-ID")),
+            Locale:    primaryLocale(r.Header.Get("Accept-Language")),
+        })
+        next.ServeHTTP(w, r.WithContext(ctx))
+    })
+}
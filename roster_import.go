@@ -0,0 +1,127 @@
+package main
+
+import (
+    "errors"
+    "encoding/json"
+    "fmt"
+    "io"
+    "mime"
+    "net/http"
+    "strconv"
+    "time"
+    "student-api/reqctx"
+)
+
+// ImportReport is the response of POST /students/import
+type ImportReport struct {
+    DryRun bool         `json:"dry_run"`
+    Counts ImportCounts `json:"counts"`
+    Rows   []StagedRow  `json:"rows"`
+}
+
+// errNoImportFile is returned when a multipart upload has no "file" part
+var errNoImportFile = errors.New("missing CSV file")
+
+// importUpload returns the uploaded CSV without buffering it: the body itself
+// for text/csv, or the "file" part of a multipart form.
+func importUpload(r *http.Request) (io.Reader, error) {
+    if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "text/csv" {
+        return r.Body, nil
+    }
+    mr, err := r.MultipartReader()
+    if err != nil {
+        return nil, errNoImportFile
+    }
+    for {
+        part, err := mr.NextPart()
+        if err == io.EOF {
+            return nil, errNoImportFile
+        }
+        if err != nil {
+            return nil, err
+        }
+        if part.FormName() == "file" {
+            return part, nil
+        }
+    }
+}
+
+// ImportStudents imports a roster CSV in one step: POST /students/import with
+// a multipart "file" field or a text/csv body. Rows are parsed as they
+// stream in and validated with their spreadsheet line numbers; students are
+// matched by email, so existing ones are updated and new ones created in one
+// transaction. Invalid rows are reported and skipped. ?dry_run=true reports
+// what would change without writing, and ?profile= names a column mapping.
+// Use /imports to stage a roster for review under a conflict policy.
+func (app *App) ImportStudents(w http.ResponseWriter, r *http.Request) {
+    store := app.storeFor(r)
+    var report ImportReport
+    if value := r.URL.Query().Get("dry_run"); value != "" {
+        var err error
+        if report.DryRun, err = strconv.ParseBool(value); err != nil {
+            httpError(w, r, "dry_run must be true or false", http.StatusBadRequest)
+            return
+        }
+    }
+
+    profile := defaultImportProfile
+    if name := r.URL.Query().Get("profile"); name != "" {
+        var exists bool
+        if profile, exists = app.importProfiles.Get(name); !exists {
+            httpError(w, r, "Import profile not found", http.StatusBadRequest)
+            return
+        }
+    }
+
+    r.Body = http.MaxBytesReader(w, r.Body, maxImportUpload)
+    upload, err := importUpload(r)
+    if err != nil {
+        httpError(w, r, "Missing CSV file", http.StatusBadRequest)
+        return
+    }
+    report.Rows = make([]StagedRow, 0)
+    err = scanImportCSV(upload, profile, time.Now(), func(row StagedRow) {
+        report.Rows = append(report.Rows, row)
+    })
+    if err != nil {
+        httpError(w, r, "Invalid CSV: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    store.Lock()
+    report.Counts, err = app.planImport(store, report.Rows)
+    if err == nil && !report.DryRun && report.Counts.Create+report.Counts.Update > 0 {
+        var versions []StudentVersion
+        versions, err = store.transactionLocked(func() error {
+            for i := range report.Rows {
+                row := &report.Rows[i]
+                var err error
+                switch row.Action {
+                case ActionCreate:
+                    var created Student
+                    created, _, err = store.insertLocked(row.Student)
+                    row.CreatedID = created.ID
+                case ActionUpdate:
+                    student := row.Student
+                    student.ID = row.ExistingID
+                    _, _, err = store.replaceLocked(student)
+                }
+                if err != nil {
+                    return fmt.Errorf("import line %d: %w", row.Line, err)
+                }
+            }
+            return nil
+        })
+        app.recordChanges(r, versions...)
+    }
+    store.Unlock()
+    if err != nil {
+        writeStoreError(w, r, err)
+        return
+    }
+
+    reqctx.Logger(r.Context()).Info("roster import", "dry_run", report.DryRun, "rows", len(report.Rows),
+        "create", report.Counts.Create, "update", report.Counts.Update, "invalid", report.Counts.Invalid)
+    writeBulkStatus(w, report.Counts.Invalid, len(report.Rows), http.StatusOK)
+    json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "sort"
+    "strings"
+    "time"
+    "github.com/gorilla/mux"
+    "gopkg.in/yaml.v3"
+)
+
+// Auth requirements a route policy may set
+const (
+    // AuthRequired needs a bearer token, API token or API key
+    AuthRequired = "required"
+    // AuthOptional checks credentials when sent but lets anonymous requests through
+    AuthOptional = "optional"
+)
+
+// defaultRoutesFile is read when ROUTES_FILE is unset, if it exists
+const defaultRoutesFile = "routes.yaml"
+
+// RoutePolicy overrides the built-in handling of one route, for all of its
+// methods or those listed. Zero fields keep the built-in behaviour.
+type RoutePolicy struct {
+    Route   string   `yaml:"route"`
+    Methods []string `yaml:"methods"`
+    // Auth is required or optional; see authRequired for the default
+    Auth string `yaml:"auth"`
+    // Role is the minimum role, or any; see requiredRole for the default
+    Role string `yaml:"role"`
+    // RateLimit is requests per minute per client, in a bucket of the
+    // route's own on top of the RATE_LIMIT classes
+    RateLimit   int    `yaml:"rate_limit"`
+    Timeout     string `yaml:"timeout"`
+    ReadTimeout string `yaml:"read_timeout"`
+    // Feature names a flag that must be on for the route to be served
+    Feature string `yaml:"feature"`
+
+    timeout, readTimeout time.Duration
+}
+
+// routesFile is the layout of routes.yaml
+type routesFile struct {
+    // Features are the flags route policies gate on; FEATURE_<NAME> in the
+    // environment overrides the file
+    Features map[string]bool `yaml:"features"`
+    Routes   []RoutePolicy   `yaml:"routes"`
+}
+
+// RoutePolicies are the route policies and feature flags of routes.yaml
+type RoutePolicies struct {
+    path     string
+    features map[string]bool
+    list     []*RoutePolicy
+    // policies is keyed by method and route template
+    policies map[string]*RoutePolicy
+}
+
+func policyKey(method, route string) string {
+    return method + " " + route
+}
+
+// LoadRoutePolicies reads ROUTES_FILE, or routes.yaml in the working
+// directory when that is unset and the file exists. Without a file there are
+// no policies and every route keeps its built-in handling.
+func LoadRoutePolicies() (*RoutePolicies, error) {
+    p := &RoutePolicies{features: make(map[string]bool), policies: make(map[string]*RoutePolicy)}
+    path := getEnv("ROUTES_FILE", "")
+    if path == "" {
+        if _, err := os.Stat(defaultRoutesFile); err != nil {
+            return p, nil
+        }
+        path = defaultRoutesFile
+    }
+    p.path = path
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("routes file: %w", err)
+    }
+    var file routesFile
+    dec := yaml.NewDecoder(bytes.NewReader(data))
+    dec.KnownFields(true)
+    if err := dec.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+        return nil, fmt.Errorf("routes file %s: %w", path, err)
+    }
+
+    for name, on := range file.Features {
+        p.features[name] = getEnvBool("FEATURE_"+strings.ToUpper(name), on)
+    }
+    for i := range file.Routes {
+        policy := &file.Routes[i]
+        if err := p.add(policy); err != nil {
+            return nil, fmt.Errorf("routes file %s: route %d (%s): %w", path, i+1, policy.Route, err)
+        }
+    }
+    return p, nil
+}
+
+// add validates policy and indexes it by each of its methods
+func (p *RoutePolicies) add(policy *RoutePolicy) error {
+    if policy.Route == "" {
+        return errors.New("route is required")
+    }
+    if policy.Auth != "" && policy.Auth != AuthRequired && policy.Auth != AuthOptional {
+        return fmt.Errorf("auth must be %s or %s, got %q", AuthRequired, AuthOptional, policy.Auth)
+    }
+    if policy.Role != "" && policy.Role != RoleAny {
+        if _, err := parseRole(policy.Role); err != nil {
+            return err
+        }
+    }
+    if policy.RateLimit < 0 {
+        return fmt.Errorf("rate_limit must be a positive number of requests per minute, got %d", policy.RateLimit)
+    }
+    for _, d := range []struct {
+        field string
+        text  string
+        value *time.Duration
+    }{{"timeout", policy.Timeout, &policy.timeout}, {"read_timeout", policy.ReadTimeout, &policy.readTimeout}} {
+        if d.text == "" {
+            continue
+        }
+        parsed, err := time.ParseDuration(d.text)
+        if err != nil || parsed <= 0 {
+            return fmt.Errorf("%s: invalid duration %q", d.field, d.text)
+        }
+        *d.value = parsed
+    }
+    if _, ok := p.features[policy.Feature]; policy.Feature != "" && !ok {
+        return fmt.Errorf("feature %q is not declared under features", policy.Feature)
+    }
+
+    for i, method := range policy.Methods {
+        policy.Methods[i] = strings.ToUpper(method)
+    }
+    methods := policy.Methods
+    if len(methods) == 0 {
+        methods = routedMethods
+    }
+    for _, method := range methods {
+        key := policyKey(method, policy.Route)
+        if _, dup := p.policies[key]; dup {
+            return fmt.Errorf("%s %s has more than one policy", method, policy.Route)
+        }
+        p.policies[key] = policy
+    }
+    p.list = append(p.list, policy)
+    return nil
+}
+
+// CheckRoutes fails for policies naming a route and method that router does
+// not serve, which would otherwise be ignored silently
+func (p *RoutePolicies) CheckRoutes(router *mux.Router) error {
+    served := make(map[string]bool)
+    err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+        template, err := route.GetPathTemplate()
+        if err != nil {
+            return nil
+        }
+        methods, err := route.GetMethods()
+        if err != nil {
+            methods = routedMethods
+        }
+        for _, method := range methods {
+            served[policyKey(method, template)] = true
+        }
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+    var unknown []string
+    for _, policy := range p.list {
+        if len(policy.Methods) > 0 {
+            for _, method := range policy.Methods {
+                if key := policyKey(method, policy.Route); !served[key] {
+                    unknown = append(unknown, key)
+                }
+            }
+            continue
+        }
+        // Policies without methods only need the route to serve one
+        servesAny := false
+        for _, method := range routedMethods {
+            servesAny = servesAny || served[policyKey(method, policy.Route)]
+        }
+        if !servesAny {
+            unknown = append(unknown, policy.Route)
+        }
+    }
+    if len(unknown) > 0 {
+        return fmt.Errorf("routes file %s: no such route: %s", p.path, strings.Join(unknown, ", "))
+    }
+    return nil
+}
+
+// Policies returns the policies in file order
+func (p *RoutePolicies) Policies() []*RoutePolicy {
+    if p == nil {
+        return nil
+    }
+    return p.list
+}
+
+// For returns the policy for a method and route template, or nil
+func (p *RoutePolicies) For(method, route string) *RoutePolicy {
+    if p == nil {
+        return nil
+    }
+    return p.policies[policyKey(method, route)]
+}
+
+// Enabled reports whether a feature flag is on
+func (p *RoutePolicies) Enabled(feature string) bool {
+    return p != nil && p.features[feature]
+}
+
+// Summary describes the loaded file for the doctor and startup log
+func (p *RoutePolicies) Summary() string {
+    if p.path == "" {
+        return "no routes file"
+    }
+    var off []string
+    for name, on := range p.features {
+        if !on {
+            off = append(off, name)
+        }
+    }
+    sort.Strings(off)
+    summary := fmt.Sprintf("%s: %d route policies, %d features", p.path, len(p.list), len(p.features))
+    if len(off) > 0 {
+        summary += " (off: " + strings.Join(off, ", ") + ")"
+    }
+    return summary
+}
+
+// featureGate answers 404 for routes whose feature flag is off, as though
+// they did not exist
+func (app *App) featureGate(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if policy := app.routes.For(r.Method, routeTemplate(r)); policy != nil && policy.Feature != "" && !app.routes.Enabled(policy.Feature) {
+            app.metrics.Inc("http_unmatched_requests_total", "reason", "feature_disabled")
+            writeError(w, r, http.StatusNotFound, "feature_disabled", fmt.Sprintf("%s %s is disabled (feature %s)", r.Method, r.URL.Path, policy.Feature))
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
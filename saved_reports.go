@@ -0,0 +1,759 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/tls"
+    "database/sql"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log/slog"
+    "mime/multipart"
+    "net"
+    "net/http"
+    "net/mail"
+    "net/smtp"
+    "net/textproto"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "github.com/gorilla/mux"
+    "student-api/reqctx"
+)
+
+// maxReportRuns is how many runs of each saved report are kept
+const maxReportRuns = 50
+
+// ReportDelivery says where a saved report's output goes after each run
+type ReportDelivery struct {
+    // Email lists recipients sent the output as an attachment through SMTP_HOST
+    Email []string `json:"email,omitempty"`
+    // File writes the output under REPORT_OUTPUT_DIR
+    File bool `json:"file,omitempty"`
+}
+
+// SavedReport is a named report: sandboxed SQL, or a student filter
+// expression, optionally run on a cron schedule (UTC)
+type SavedReport struct {
+    Name      string         `json:"name"`
+    SQL       string         `json:"sql,omitempty"`
+    Params    []interface{}  `json:"params,omitempty"`
+    Filter    string         `json:"filter,omitempty"`
+    Format    string         `json:"format,omitempty"`
+    Schedule  string         `json:"schedule,omitempty"`
+    Delivery  ReportDelivery `json:"delivery"`
+    NextRunAt *time.Time     `json:"next_run_at,omitempty"`
+    UpdatedAt time.Time      `json:"updated_at"`
+
+    schedule *CronSchedule
+    filter   *Filter
+}
+
+// Validate checks if the saved report is usable, parsing its schedule and filter
+func (sr *SavedReport) Validate() []ValidationError {
+    var errors []ValidationError
+
+    if !profileNamePattern.MatchString(sr.Name) || sr.Name == "query" {
+        errors = append(errors, ValidationError{
+            Field:   "name",
+            Code:    CodeOutOfRange,
+            Message: "Name must be lowercase letters, digits, '-' or '_' and not \"query\"",
+        })
+    }
+
+    if (sr.SQL == "") == (sr.Filter == "") {
+        errors = append(errors, ValidationError{
+            Field:   "sql",
+            Code:    CodeRequired,
+            Message: "Exactly one of sql or filter is required",
+        })
+    }
+    if sr.Filter != "" {
+        f, err := ParseFilter(sr.Filter)
+        if err != nil {
+            errors = append(errors, ValidationError{Field: "filter", Code: CodeInvalidFilter, Message: err.Error()})
+        }
+        sr.filter = f
+    }
+
+    if sr.Format != "" && sr.Format != "json" && sr.Format != "csv" {
+        errors = append(errors, ValidationError{
+            Field:   "format",
+            Code:    CodeOutOfRange,
+            Message: "Format must be json or csv",
+        })
+    }
+
+    if sr.Schedule != "" {
+        schedule, err := ParseCron(sr.Schedule)
+        if err != nil {
+            errors = append(errors, ValidationError{Field: "schedule", Code: CodeOutOfRange, Message: err.Error()})
+        }
+        sr.schedule = schedule
+    }
+
+    for _, addr := range sr.Delivery.Email {
+        if _, err := mail.ParseAddress(addr); err != nil {
+            errors = append(errors, ValidationError{
+                Field:   "delivery.email",
+                Code:    CodeEmailInvalid,
+                Message: "Invalid recipient " + strconv.Quote(addr),
+            })
+        }
+    }
+
+    return errors
+}
+
+// ReportRun is one execution of a saved report
+type ReportRun struct {
+    ID         int       `json:"id"`
+    Trigger    string    `json:"trigger"`
+    StartedAt  time.Time `json:"started_at"`
+    FinishedAt time.Time `json:"finished_at"`
+    Rows       int       `json:"rows"`
+    Truncated  bool      `json:"truncated,omitempty"`
+    Error      string    `json:"error,omitempty"`
+    Deliveries []string  `json:"deliveries,omitempty"`
+}
+
+// errSavedReportNotFound is returned for a report name that is not saved
+var errSavedReportNotFound = errors.New("saved report not found")
+
+// SavedReportRepository persists saved reports and their recent runs
+type SavedReportRepository interface {
+    List() ([]SavedReport, error)
+    Get(name string) (SavedReport, error)
+    // Put creates or replaces a report, reporting whether it is new
+    Put(sr SavedReport) (bool, error)
+    // Delete removes a report and its runs
+    Delete(name string) error
+    SetNextRun(name string, next *time.Time) error
+    // AddRun records a finished run, dropping the oldest beyond maxReportRuns
+    AddRun(name string, run ReportRun) (ReportRun, error)
+    // Runs returns a report's runs, newest first
+    Runs(name string) ([]ReportRun, error)
+}
+
+// MemorySavedReportRepository keeps saved reports in memory, for
+// STORE_BACKEND=memory
+type MemorySavedReportRepository struct {
+    sync.RWMutex
+    reports map[string]SavedReport
+    runs    map[string][]ReportRun
+    nextRun int
+}
+
+// NewMemorySavedReportRepository initializes a new MemorySavedReportRepository
+func NewMemorySavedReportRepository() *MemorySavedReportRepository {
+    return &MemorySavedReportRepository{
+        reports: make(map[string]SavedReport),
+        runs:    make(map[string][]ReportRun),
+        nextRun: 1,
+    }
+}
+
+func (m *MemorySavedReportRepository) List() ([]SavedReport, error) {
+    m.RLock()
+    reports := make([]SavedReport, 0, len(m.reports))
+    for _, sr := range m.reports {
+        reports = append(reports, sr)
+    }
+    m.RUnlock()
+    sort.Slice(reports, func(i, j int) bool { return reports[i].Name < reports[j].Name })
+    return reports, nil
+}
+
+func (m *MemorySavedReportRepository) Get(name string) (SavedReport, error) {
+    m.RLock()
+    defer m.RUnlock()
+    sr, exists := m.reports[name]
+    if !exists {
+        return SavedReport{}, errSavedReportNotFound
+    }
+    return sr, nil
+}
+
+func (m *MemorySavedReportRepository) Put(sr SavedReport) (bool, error) {
+    m.Lock()
+    defer m.Unlock()
+    _, existed := m.reports[sr.Name]
+    m.reports[sr.Name] = sr
+    return !existed, nil
+}
+
+func (m *MemorySavedReportRepository) Delete(name string) error {
+    m.Lock()
+    defer m.Unlock()
+    if _, exists := m.reports[name]; !exists {
+        return errSavedReportNotFound
+    }
+    delete(m.reports, name)
+    delete(m.runs, name)
+    return nil
+}
+
+func (m *MemorySavedReportRepository) SetNextRun(name string, next *time.Time) error {
+    m.Lock()
+    defer m.Unlock()
+    sr, exists := m.reports[name]
+    if !exists {
+        return errSavedReportNotFound
+    }
+    sr.NextRunAt = next
+    m.reports[name] = sr
+    return nil
+}
+
+func (m *MemorySavedReportRepository) AddRun(name string, run ReportRun) (ReportRun, error) {
+    m.Lock()
+    defer m.Unlock()
+    run.ID = m.nextRun
+    m.nextRun++
+    runs := append(m.runs[name], run)
+    if len(runs) > maxReportRuns {
+        runs = runs[len(runs)-maxReportRuns:]
+    }
+    m.runs[name] = runs
+    return run, nil
+}
+
+func (m *MemorySavedReportRepository) Runs(name string) ([]ReportRun, error) {
+    m.RLock()
+    defer m.RUnlock()
+    history := m.runs[name]
+    runs := make([]ReportRun, 0, len(history))
+    for i := len(history) - 1; i >= 0; i-- {
+        runs = append(runs, history[i])
+    }
+    return runs, nil
+}
+
+// SQLSavedReportRepository keeps saved reports in the saved_reports table
+// and their runs in report_runs, so every instance sees the same reports and
+// the leader runs the schedules of those saved on any of them. Params,
+// delivery and deliveries are JSON text.
+type SQLSavedReportRepository struct {
+    db     *sql.DB
+    rebind func(string) string
+    // returning is set for PostgreSQL, whose driver has no LastInsertId
+    returning bool
+}
+
+// NewSQLSavedReportRepository creates a repository; rebind may be nil
+func NewSQLSavedReportRepository(db *sql.DB, rebind func(string) string, returning bool) *SQLSavedReportRepository {
+    if rebind == nil {
+        rebind = func(q string) string { return q }
+    }
+    return &SQLSavedReportRepository{db: db, rebind: rebind, returning: returning}
+}
+
+const savedReportColumns = `name, sql_text, params, filter, format, schedule, delivery, next_run_at, updated_at`
+
+// scanSavedReport reads a report and parses its schedule and filter again
+func scanSavedReport(row interface{ Scan(...interface{}) error }) (SavedReport, error) {
+    var sr SavedReport
+    var params, delivery, updated string
+    var next sql.NullString
+    if err := row.Scan(&sr.Name, &sr.SQL, &params, &sr.Filter, &sr.Format, &sr.Schedule, &delivery, &next, &updated); err != nil {
+        return SavedReport{}, err
+    }
+    if err := json.Unmarshal([]byte(params), &sr.Params); err != nil {
+        return SavedReport{}, err
+    }
+    if err := json.Unmarshal([]byte(delivery), &sr.Delivery); err != nil {
+        return SavedReport{}, err
+    }
+    var err error
+    if sr.UpdatedAt, err = time.Parse(time.RFC3339Nano, updated); err != nil {
+        return SavedReport{}, err
+    }
+    if next.Valid {
+        at, err := time.Parse(time.RFC3339Nano, next.String)
+        if err != nil {
+            return SavedReport{}, err
+        }
+        sr.NextRunAt = &at
+    }
+    sr.Validate()
+    return sr, nil
+}
+
+// formatNextRun formats a next run time, NULL for an unscheduled report
+func formatNextRun(next *time.Time) interface{} {
+    if next == nil {
+        return nil
+    }
+    return next.Format(time.RFC3339Nano)
+}
+
+func (s *SQLSavedReportRepository) List() ([]SavedReport, error) {
+    rows, err := s.db.Query(`SELECT ` + savedReportColumns + ` FROM saved_reports ORDER BY name`)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    reports := []SavedReport{}
+    for rows.Next() {
+        sr, err := scanSavedReport(rows)
+        if err != nil {
+            return nil, err
+        }
+        reports = append(reports, sr)
+    }
+    return reports, rows.Err()
+}
+
+func (s *SQLSavedReportRepository) Get(name string) (SavedReport, error) {
+    sr, err := scanSavedReport(s.db.QueryRow(s.rebind(`SELECT `+savedReportColumns+` FROM saved_reports WHERE name = ?`), name))
+    if errors.Is(err, sql.ErrNoRows) {
+        return SavedReport{}, errSavedReportNotFound
+    }
+    return sr, err
+}
+
+func (s *SQLSavedReportRepository) Put(sr SavedReport) (bool, error) {
+    params, err := json.Marshal(sr.Params)
+    if err != nil {
+        return false, err
+    }
+    delivery, err := json.Marshal(sr.Delivery)
+    if err != nil {
+        return false, err
+    }
+    tx, err := s.db.Begin()
+    if err != nil {
+        return false, err
+    }
+    defer tx.Rollback()
+
+    args := []interface{}{sr.SQL, string(params), sr.Filter, sr.Format, sr.Schedule, string(delivery),
+        formatNextRun(sr.NextRunAt), sr.UpdatedAt.Format(time.RFC3339Nano), sr.Name}
+    result, err := tx.Exec(s.rebind(`UPDATE saved_reports SET sql_text = ?, params = ?, filter = ?, format = ?, schedule = ?, delivery = ?, next_run_at = ?, updated_at = ? WHERE name = ?`), args...)
+    if err != nil {
+        return false, err
+    }
+    n, err := result.RowsAffected()
+    if err != nil {
+        return false, err
+    }
+    if n == 0 {
+        if _, err := tx.Exec(s.rebind(`INSERT INTO saved_reports (sql_text, params, filter, format, schedule, delivery, next_run_at, updated_at, name) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`), args...); err != nil {
+            return false, err
+        }
+    }
+    return n == 0, tx.Commit()
+}
+
+func (s *SQLSavedReportRepository) Delete(name string) error {
+    tx, err := s.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    result, err := tx.Exec(s.rebind(`DELETE FROM saved_reports WHERE name = ?`), name)
+    if err != nil {
+        return err
+    }
+    if n, err := result.RowsAffected(); err == nil && n == 0 {
+        return errSavedReportNotFound
+    }
+    if _, err := tx.Exec(s.rebind(`DELETE FROM report_runs WHERE report = ?`), name); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+func (s *SQLSavedReportRepository) SetNextRun(name string, next *time.Time) error {
+    _, err := s.db.Exec(s.rebind(`UPDATE saved_reports SET next_run_at = ? WHERE name = ?`), formatNextRun(next), name)
+    return err
+}
+
+func (s *SQLSavedReportRepository) AddRun(name string, run ReportRun) (ReportRun, error) {
+    deliveries, err := json.Marshal(run.Deliveries)
+    if err != nil {
+        return ReportRun{}, err
+    }
+    truncated := 0
+    if run.Truncated {
+        truncated = 1
+    }
+    query := `INSERT INTO report_runs (report, triggered_by, started_at, finished_at, row_count, truncated, error, deliveries) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+    args := []interface{}{name, run.Trigger, run.StartedAt.Format(time.RFC3339Nano), run.FinishedAt.Format(time.RFC3339Nano),
+        run.Rows, truncated, run.Error, string(deliveries)}
+    var id int64
+    if s.returning {
+        err = s.db.QueryRow(s.rebind(query+` RETURNING id`), args...).Scan(&id)
+    } else {
+        var result sql.Result
+        if result, err = s.db.Exec(s.rebind(query), args...); err == nil {
+            id, err = result.LastInsertId()
+        }
+    }
+    if err != nil {
+        return ReportRun{}, err
+    }
+    run.ID = int(id)
+
+    // Keep the newest maxReportRuns: drop those at or below the first one
+    // beyond them
+    var oldest int64
+    err = s.db.QueryRow(s.rebind(`SELECT id FROM report_runs WHERE report = ? ORDER BY id DESC LIMIT 1 OFFSET ?`), name, maxReportRuns).Scan(&oldest)
+    if err == nil {
+        _, err = s.db.Exec(s.rebind(`DELETE FROM report_runs WHERE report = ? AND id <= ?`), name, oldest)
+    }
+    if err != nil && !errors.Is(err, sql.ErrNoRows) {
+        return run, err
+    }
+    return run, nil
+}
+
+func (s *SQLSavedReportRepository) Runs(name string) ([]ReportRun, error) {
+    rows, err := s.db.Query(s.rebind(`SELECT id, triggered_by, started_at, finished_at, row_count, truncated, error, deliveries
+        FROM report_runs WHERE report = ? ORDER BY id DESC`), name)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    runs := []ReportRun{}
+    for rows.Next() {
+        var run ReportRun
+        var started, finished, deliveries string
+        var truncated int
+        if err := rows.Scan(&run.ID, &run.Trigger, &started, &finished, &run.Rows, &truncated, &run.Error, &deliveries); err != nil {
+            return nil, err
+        }
+        if run.StartedAt, err = time.Parse(time.RFC3339Nano, started); err != nil {
+            return nil, err
+        }
+        if run.FinishedAt, err = time.Parse(time.RFC3339Nano, finished); err != nil {
+            return nil, err
+        }
+        if err := json.Unmarshal([]byte(deliveries), &run.Deliveries); err != nil {
+            return nil, err
+        }
+        run.Truncated = truncated != 0
+        runs = append(runs, run)
+    }
+    return runs, rows.Err()
+}
+
+// SavedReportStore schedules and records saved reports on top of a
+// SavedReportRepository
+type SavedReportStore struct {
+    repo SavedReportRepository
+}
+
+// NewSavedReportStore initializes a new SavedReportStore
+func NewSavedReportStore(repo SavedReportRepository) *SavedReportStore {
+    return &SavedReportStore{repo: repo}
+}
+
+// due returns the scheduled reports whose next run is at or before now and
+// moves each one's next run forward
+func (s *SavedReportStore) due(now time.Time) ([]SavedReport, error) {
+    reports, err := s.repo.List()
+    if err != nil {
+        return nil, err
+    }
+    var due []SavedReport
+    for _, sr := range reports {
+        if sr.NextRunAt == nil || sr.NextRunAt.After(now) {
+            continue
+        }
+        if err := s.repo.SetNextRun(sr.Name, nextRunAt(sr.schedule, now)); err != nil {
+            return due, err
+        }
+        due = append(due, sr)
+    }
+    return due, nil
+}
+
+func nextRunAt(schedule *CronSchedule, after time.Time) *time.Time {
+    if schedule == nil {
+        return nil
+    }
+    next := schedule.Next(after)
+    if next.IsZero() {
+        return nil
+    }
+    return &next
+}
+
+// executeSavedReport produces a saved report's result
+func (app *App) executeSavedReport(ctx context.Context, sr SavedReport) (ReportResult, error) {
+    if sr.SQL != "" {
+        if app.reports == nil {
+            return ReportResult{}, errors.New("SQL reports are only available with the sqlite backend")
+        }
+        result, err := app.reports.Run(ctx, ReportRequest{SQL: sr.SQL, Params: sr.Params})
+        return app.masker.Report(result), err
+    }
+
+    started := time.Now()
+    students, err := app.store.List(ListOptions{Filter: sr.filter})
+    if err != nil {
+        return ReportResult{}, err
+    }
+    students = app.masker.Students(students)
+    result := ReportResult{Columns: []string{"id", "name", "age", "email", "updated_at"}, Rows: make([][]interface{}, 0, len(students))}
+    for _, s := range students {
+        result.Rows = append(result.Rows, []interface{}{s.ID, s.Name, s.Age, s.Email, s.UpdatedAt})
+    }
+    result.Elapsed = time.Since(started).String()
+    return result, nil
+}
+
+// renderReport encodes a result in the report's format, returning the bytes,
+// file extension and content type
+func (app *App) renderReport(sr SavedReport, result ReportResult) ([]byte, string, string, error) {
+    var buf bytes.Buffer
+    if sr.Format == "csv" {
+        err := writeReportCSV(&buf, result, app.csvEscapeFormulas)
+        return buf.Bytes(), "csv", "text/csv; charset=utf-8", err
+    }
+    err := json.NewEncoder(&buf).Encode(result)
+    return buf.Bytes(), "json", "application/json", err
+}
+
+// runSavedReport executes and delivers a saved report and records the run
+func (app *App) runSavedReport(ctx context.Context, sr SavedReport, trigger string) ReportRun {
+    run := ReportRun{Trigger: trigger, StartedAt: time.Now().UTC()}
+    result, err := app.executeSavedReport(ctx, sr)
+    if err == nil {
+        run.Rows, run.Truncated = len(result.Rows), result.Truncated
+        var body []byte
+        var ext, contentType string
+        body, ext, contentType, err = app.renderReport(sr, result)
+        if err == nil {
+            run.Deliveries, err = deliverReport(sr, run.StartedAt, body, ext, contentType)
+        }
+    }
+    if err != nil {
+        run.Error = err.Error()
+        reqctx.Logger(ctx).Error("saved report failed", "report", sr.Name, "trigger", trigger, "error", err)
+    }
+    run.FinishedAt = time.Now().UTC()
+    recorded, err := app.savedReports.repo.AddRun(sr.Name, run)
+    if err != nil {
+        reqctx.Logger(ctx).Error("recording saved report run failed", "report", sr.Name, "error", err)
+    }
+    return recorded
+}
+
+// deliverReport sends a rendered report to each configured destination
+func deliverReport(sr SavedReport, at time.Time, body []byte, ext, contentType string) ([]string, error) {
+    filename := fmt.Sprintf("%s-%s.%s", sr.Name, at.Format("20060102T150405Z"), ext)
+    var delivered []string
+    if sr.Delivery.File {
+        dir := getEnv("REPORT_OUTPUT_DIR", "./reports")
+        if err := os.MkdirAll(dir, 0755); err != nil {
+            return delivered, err
+        }
+        path := filepath.Join(dir, filename)
+        if err := os.WriteFile(path, body, 0644); err != nil {
+            return delivered, err
+        }
+        delivered = append(delivered, "file:"+path)
+    }
+    if len(sr.Delivery.Email) > 0 {
+        if err := emailReport(sr, filename, body, contentType); err != nil {
+            return delivered, fmt.Errorf("email: %v", err)
+        }
+        for _, to := range sr.Delivery.Email {
+            delivered = append(delivered, "email:"+to)
+        }
+    }
+    return delivered, nil
+}
+
+// emailReport sends the report as an attachment through SMTP_HOST
+func emailReport(sr SavedReport, filename string, body []byte, contentType string) error {
+    host := getEnv("SMTP_HOST", "")
+    if host == "" {
+        return errors.New("SMTP_HOST is not set")
+    }
+    from := getEnv("SMTP_FROM", "reports@localhost")
+
+    var msg bytes.Buffer
+    mw := multipart.NewWriter(&msg)
+    fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: Report %s\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=%s\r\n\r\n",
+        from, strings.Join(sr.Delivery.Email, ", "), sr.Name, mw.Boundary())
+    text, _ := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+    fmt.Fprintf(text, "Attached is the output of report %s.\r\n", sr.Name)
+    attachment, _ := mw.CreatePart(textproto.MIMEHeader{
+        "Content-Type":              {contentType},
+        "Content-Transfer-Encoding": {"base64"},
+        "Content-Disposition":       {fmt.Sprintf("attachment; filename=%q", filename)},
+    })
+    enc := base64.NewEncoder(base64.StdEncoding, attachment)
+    enc.Write(body)
+    enc.Close()
+    mw.Close()
+
+    return sendMail(host, from, sr.Delivery.Email, msg.Bytes())
+}
+
+// sendMail delivers a composed message through host on SMTP_PORT, using
+// STARTTLS when offered and SMTP_USERNAME/SMTP_PASSWORD when set
+func sendMail(host, from string, to []string, msg []byte) error {
+    addr := net.JoinHostPort(host, strconv.Itoa(getEnvInt("SMTP_PORT", 587)))
+    c, err := smtp.Dial(addr)
+    if err != nil {
+        return err
+    }
+    defer c.Close()
+    if ok, _ := c.Extension("STARTTLS"); ok {
+        if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+            return err
+        }
+    }
+    if user := getEnv("SMTP_USERNAME", ""); user != "" {
+        if err := c.Auth(smtp.PlainAuth("", user, getEnv("SMTP_PASSWORD", ""), host)); err != nil {
+            return err
+        }
+    }
+    if err := c.Mail(from); err != nil {
+        return err
+    }
+    for _, rcpt := range to {
+        if err := c.Rcpt(rcpt); err != nil {
+            return err
+        }
+    }
+    w, err := c.Data()
+    if err != nil {
+        return err
+    }
+    if _, err := w.Write(msg); err != nil {
+        return err
+    }
+    if err := w.Close(); err != nil {
+        return err
+    }
+    return c.Quit()
+}
+
+// runReportSchedules starts due saved reports every interval until ctx ends
+func (app *App) runReportSchedules(ctx context.Context, interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    // runs are waited for so a shutdown does not close the database under them
+    var runs sync.WaitGroup
+    defer runs.Wait()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case now := <-ticker.C:
+            due, err := app.savedReports.due(now)
+            if err != nil {
+                slog.Error("reading saved report schedules failed", "error", err)
+            }
+            for _, sr := range due {
+                runs.Add(1)
+                go func(sr SavedReport) {
+                    defer runs.Done()
+                    app.runSavedReport(ctx, sr, "schedule")
+                }(sr)
+            }
+        }
+    }
+}
+
+// writeSavedReportError answers a failed saved report lookup or write
+func writeSavedReportError(w http.ResponseWriter, r *http.Request, err error) {
+    if errors.Is(err, errSavedReportNotFound) {
+        httpError(w, r, "Report not found", http.StatusNotFound)
+        return
+    }
+    reqctx.Logger(r.Context()).Error("saved report storage failed", "error", err)
+    httpError(w, r, "Internal server error", http.StatusInternalServerError)
+}
+
+func (app *App) ListSavedReports(w http.ResponseWriter, r *http.Request) {
+    reports, err := app.savedReports.repo.List()
+    if err != nil {
+        writeSavedReportError(w, r, err)
+        return
+    }
+    json.NewEncoder(w).Encode(reports)
+}
+
+func (app *App) GetSavedReport(w http.ResponseWriter, r *http.Request) {
+    report, err := app.savedReports.repo.Get(mux.Vars(r)["name"])
+    if err != nil {
+        writeSavedReportError(w, r, err)
+        return
+    }
+    json.NewEncoder(w).Encode(report)
+}
+
+// PutSavedReport creates or replaces a saved report: PUT /admin/reports/{name}
+// {"sql": "SELECT ...", "format": "csv", "schedule": "0 6 * * 1",
+// "delivery": {"email": ["ops@example.com"], "file": true}}
+func (app *App) PutSavedReport(w http.ResponseWriter, r *http.Request) {
+    var sr SavedReport
+    if err := json.NewDecoder(r.Body).Decode(&sr); err != nil {
+        httpError(w, r, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    sr.Name = mux.Vars(r)["name"]
+
+    if errors := sr.Validate(); len(errors) > 0 {
+        writeValidationErrors(w, r, errors)
+        return
+    }
+    sr.UpdatedAt = time.Now().UTC()
+    sr.NextRunAt = nextRunAt(sr.schedule, sr.UpdatedAt)
+
+    created, err := app.savedReports.repo.Put(sr)
+    if err != nil {
+        writeSavedReportError(w, r, err)
+        return
+    }
+    if created {
+        w.WriteHeader(http.StatusCreated)
+    }
+    json.NewEncoder(w).Encode(sr)
+}
+
+func (app *App) DeleteSavedReport(w http.ResponseWriter, r *http.Request) {
+    if err := app.savedReports.repo.Delete(mux.Vars(r)["name"]); err != nil {
+        writeSavedReportError(w, r, err)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// RunSavedReport runs a saved report now: POST /admin/reports/{name}/run
+func (app *App) RunSavedReport(w http.ResponseWriter, r *http.Request) {
+    report, err := app.savedReports.repo.Get(mux.Vars(r)["name"])
+    if err != nil {
+        writeSavedReportError(w, r, err)
+        return
+    }
+    json.NewEncoder(w).Encode(app.runSavedReport(r.Context(), report, "manual"))
+}
+
+// ListReportRuns returns a saved report's run history, newest first:
+// GET /admin/reports/{name}/runs
+func (app *App) ListReportRuns(w http.ResponseWriter, r *http.Request) {
+    name := mux.Vars(r)["name"]
+    if _, err := app.savedReports.repo.Get(name); err != nil {
+        writeSavedReportError(w, r, err)
+        return
+    }
+    runs, err := app.savedReports.repo.Runs(name)
+    if err != nil {
+        writeSavedReportError(w, r, err)
+        return
+    }
+    json.NewEncoder(w).Encode(runs)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "html"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "unicode"
+    "unicode/utf8"
+)
+
+const (
+    defaultSearchLimit = 20
+    maxSearchLimit     = 100
+    // maxSearchTerms bounds the words of one query
+    maxSearchTerms = 8
+)
+
+// SearchResult is one match of GET /students/search. Score grows with
+// relevance; Highlights holds the matched fields, HTML-escaped, with each
+// matched term wrapped in <mark>.
+type SearchResult struct {
+    Student    Student           `json:"student"`
+    Score      float64           `json:"score"`
+    Highlights map[string]string `json:"highlights"`
+}
+
+// StudentSearcher is implemented by repositories with a full-text index.
+// Search returns students whose name or email matches every term, most
+// relevant first; highlighting is left to the caller.
+type StudentSearcher interface {
+    Search(terms []string, limit int) ([]SearchResult, error)
+}
+
+// Search finds students by name and email, using the repository's full-text
+// index when it has one and substring matching otherwise
+func (s *StudentStore) Search(terms []string, limit int) ([]SearchResult, error) {
+    s.RLock()
+    defer s.RUnlock()
+    var results []SearchResult
+    var err error
+    if searcher, ok := s.repo.(StudentSearcher); ok {
+        results, err = searcher.Search(terms, limit)
+    } else {
+        results, err = substringSearch(s.repo, terms, limit)
+    }
+    for i := range results {
+        results[i].Highlights = map[string]string{
+            "name":  highlightTerms(results[i].Student.Name, terms),
+            "email": highlightTerms(results[i].Student.Email, terms),
+        }
+    }
+    return results, err
+}
+
+// searchTerms splits a query into lower-cased words, dropping duplicates
+func searchTerms(q string) []string {
+    var terms []string
+    for _, term := range strings.Fields(strings.ToLower(q)) {
+        if !containsString(terms, term) {
+            terms = append(terms, term)
+        }
+    }
+    return terms
+}
+
+// substringSearch is the search fallback. Every term must occur in the name
+// or email, which the repository's List can push down as LIKE conditions;
+// the matches are then scored in Go, name hits above email hits and word
+// starts above other positions.
+func substringSearch(repo StudentRepository, terms []string, limit int) ([]SearchResult, error) {
+    var f *Filter
+    for _, term := range terms {
+        f = f.And(&Filter{root: &logicalNode{
+            op:    "OR",
+            left:  &comparisonNode{field: "name", op: "contains", str: term},
+            right: &comparisonNode{field: "email", op: "contains", str: term},
+        }})
+    }
+    students, err := repo.List(liveOptions(ListOptions{Filter: f}))
+    if err != nil {
+        return nil, err
+    }
+    results := make([]SearchResult, 0, len(students))
+    for _, student := range students {
+        var score float64
+        for _, term := range terms {
+            score += 2*termScore(student.Name, term) + termScore(student.Email, term)
+        }
+        results = append(results, SearchResult{Student: student, Score: score})
+    }
+    sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+    if len(results) > limit {
+        results = results[:limit]
+    }
+    return results, nil
+}
+
+// termScore rates one term's occurrence in a field: 2 at the start of a
+// word, 1 elsewhere and 0 when absent
+func termScore(text, term string) float64 {
+    var score float64
+    for _, at := range termMatches(text, term) {
+        if at == 0 {
+            return 2
+        }
+        r, _ := utf8.DecodeLastRuneInString(text[:at])
+        if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+            return 2
+        }
+        score = 1
+    }
+    return score
+}
+
+// termMatches returns the byte offsets of the non-overlapping,
+// case-insensitive occurrences of term in text
+func termMatches(text, term string) []int {
+    var offsets []int
+    for i := 0; i+len(term) <= len(text); {
+        if strings.EqualFold(text[i:i+len(term)], term) {
+            offsets = append(offsets, i)
+            i += len(term)
+            continue
+        }
+        _, size := utf8.DecodeRuneInString(text[i:])
+        i += size
+    }
+    return offsets
+}
+
+// highlightTerms HTML-escapes text and wraps every occurrence of a term in
+// <mark>, preferring the longer term where two overlap
+func highlightTerms(text string, terms []string) string {
+    marked := make([]bool, len(text))
+    for _, term := range terms {
+        for _, at := range termMatches(text, term) {
+            for i := at; i < at+len(term); i++ {
+                marked[i] = true
+            }
+        }
+    }
+    var b strings.Builder
+    for i := 0; i < len(text); {
+        j := i
+        for j < len(text) && marked[j] == marked[i] {
+            j++
+        }
+        if marked[i] {
+            b.WriteString("<mark>" + html.EscapeString(text[i:j]) + "</mark>")
+        } else {
+            b.WriteString(html.EscapeString(text[i:j]))
+        }
+        i = j
+    }
+    return b.String()
+}
+
+// setupSearchIndex creates the students_fts index if SQLite was built with
+// FTS5 (the sqlite_fts5 build tag) and rebuilds it from the students table,
+// since builds without FTS5 write to the table without maintaining it. It
+// reports false when FTS5 is unavailable.
+func setupSearchIndex(db *sql.DB) (bool, error) {
+    tx, err := db.Begin()
+    if err != nil {
+        return false, err
+    }
+    for _, stmt := range []string{
+        `CREATE VIRTUAL TABLE IF NOT EXISTS students_fts USING fts5(name, email)`,
+        `DELETE FROM students_fts`,
+        `INSERT INTO students_fts (rowid, name, email) SELECT id, name, email FROM students`,
+    } {
+        if _, err := tx.Exec(stmt); err != nil {
+            tx.Rollback()
+            // An existing index is skipped by IF NOT EXISTS and only fails
+            // once it is used
+            if strings.Contains(err.Error(), "no such module") {
+                return false, nil
+            }
+            return false, err
+        }
+    }
+    return true, tx.Commit()
+}
+
+// indexStudent replaces a student's search index entry, or removes it when
+// student is nil
+func (r *SQLiteRepository) indexStudent(id int, student *Student) error {
+    if !r.search {
+        return nil
+    }
+    if _, err := r.conn.Exec(`DELETE FROM students_fts WHERE rowid = ?`, id); err != nil {
+        return err
+    }
+    if student == nil {
+        return nil
+    }
+    _, err := r.conn.Exec(`INSERT INTO students_fts (rowid, name, email) VALUES (?, ?, ?)`, id, student.Name, student.Email)
+    return err
+}
+
+// ftsQuery turns terms into an FTS5 query matching each as a token prefix
+func ftsQuery(terms []string) string {
+    quoted := make([]string, len(terms))
+    for i, term := range terms {
+        quoted[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"*`
+    }
+    return strings.Join(quoted, " ")
+}
+
+// rankedRow scans a student row followed by its rank column
+type rankedRow struct {
+    rows *sql.Rows
+    rank *float64
+}
+
+func (r rankedRow) Scan(dest ...interface{}) error {
+    return r.rows.Scan(append(dest, r.rank)...)
+}
+
+// Search ranks matches with FTS5's bm25, weighting the name above the email
+func (r *SQLiteRepository) Search(terms []string, limit int) ([]SearchResult, error) {
+    if !r.search {
+        return substringSearch(r, terms, limit)
+    }
+    rows, err := r.conn.Query(`SELECT s.`+strings.ReplaceAll(studentColumns, ", ", ", s.")+`, bm25(students_fts, 2.0, 1.0) AS rank
+        FROM students_fts JOIN students s ON s.id = students_fts.rowid
+        WHERE students_fts MATCH ? AND s.deleted_at IS NULL ORDER BY rank, s.id LIMIT ?`, ftsQuery(terms), limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    results := make([]SearchResult, 0)
+    for rows.Next() {
+        var rank float64
+        student, err := scanStudent(rankedRow{rows, &rank})
+        if err != nil {
+            return nil, err
+        }
+        // bm25 is negative, lower being better
+        results = append(results, SearchResult{Student: student, Score: -rank})
+    }
+    return results, rows.Err()
+}
+
+// SearchStudents serves GET /students/search?q=ann+lee&limit=20, matching
+// every word of q against names and emails, most relevant first
+func (app *App) SearchStudents(w http.ResponseWriter, r *http.Request) {
+    store := app.storeFor(r)
+    terms := searchTerms(r.URL.Query().Get("q"))
+    if len(terms) == 0 || len(terms) > maxSearchTerms {
+        writeValidationErrors(w, r, []ValidationError{{
+            Field:   "q",
+            Code:    CodeRequired,
+            Message: fmt.Sprintf("Query must have between 1 and %d words", maxSearchTerms),
+        }})
+        return
+    }
+    limit := defaultSearchLimit
+    if value := r.URL.Query().Get("limit"); value != "" {
+        n, err := strconv.Atoi(value)
+        if err != nil || n < 1 || n > maxSearchLimit {
+            writeValidationErrors(w, r, []ValidationError{{
+                Field:   "limit",
+                Code:    CodeOutOfRange,
+                Message: fmt.Sprintf("Limit must be between 1 and %d", maxSearchLimit),
+            }})
+            return
+        }
+        limit = n
+    }
+
+    results, err := store.Search(terms, limit)
+    if err != nil {
+        writeStoreError(w, r, err)
+        return
+    }
+    if app.masker != nil {
+        // Highlights of the real values would give them away, and the terms
+        // do not occur in the masked ones
+        for i := range results {
+            student := app.masker.Student(results[i].Student)
+            results[i].Student = student
+            results[i].Highlights = map[string]string{"name": html.EscapeString(student.Name), "email": html.EscapeString(student.Email)}
+        }
+    }
+    ids := make([]int, len(results))
+    for i, result := range results {
+        ids[i] = result.Student.ID
+    }
+    app.recordAccess(r, fieldsStudent, ids...)
+    json.NewEncoder(w).Encode(results)
+}
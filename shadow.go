@@ -0,0 +1,689 @@
+package main
+
+import (
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "math/rand"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+    "student-api/reqctx"
+)
+
+// maxShadowDivergences is how many recent divergences are kept for
+// GET /admin/shadow
+const maxShadowDivergences = 100
+
+// shadowCompareWorkers bounds the read comparisons running in the
+// background; reads beyond it are not compared
+const shadowCompareWorkers = 4
+
+// shadowVerifyPage is how many students Verify reads from each side at once
+const shadowVerifyPage = 500
+
+// ShadowRepository serves every call from the primary repository while
+// mirroring it to a shadow, the backend being migrated to. Writes are
+// repeated on the shadow once the primary has them, so both see the same
+// order and IDs. Sampled reads are repeated on the shadow in the background
+// and compared; a comparison that a write may have raced is skipped rather
+// than counted. The shadow's failures are logged and counted, never returned.
+type ShadowRepository struct {
+    primary, shadow StudentRepository
+    backend         string
+    sample          float64
+    metrics         *Metrics
+    compares        chan struct{}
+
+    // generation changes around every mirrored write, and inflight counts
+    // those under way, so a comparison can tell that it raced one
+    generation atomic.Int64
+    inflight   atomic.Int64
+
+    mu          sync.Mutex
+    stats       ShadowStats
+    divergences []ShadowDivergence
+}
+
+// ShadowStats counts the compared operations by outcome
+type ShadowStats struct {
+    ReadsMatched   int64 `json:"reads_matched"`
+    ReadsDiverged  int64 `json:"reads_diverged"`
+    ReadsSkipped   int64 `json:"reads_skipped"`
+    WritesMatched  int64 `json:"writes_matched"`
+    WritesDiverged int64 `json:"writes_diverged"`
+}
+
+// Score is the share of compared operations on which the shadow agreed with
+// the primary, or nil before any was compared
+func (s ShadowStats) Score() *float64 {
+    matched := s.ReadsMatched + s.WritesMatched
+    total := matched + s.ReadsDiverged + s.WritesDiverged
+    if total == 0 {
+        return nil
+    }
+    score := float64(matched) / float64(total)
+    return &score
+}
+
+// ShadowDivergence is one operation on which the shadow disagreed
+type ShadowDivergence struct {
+    At time.Time `json:"at"`
+    Op string    `json:"op"`
+    // Key identifies the call, e.g. a student ID or the list options
+    Key     string      `json:"key"`
+    Primary interface{} `json:"primary,omitempty"`
+    Shadow  interface{} `json:"shadow,omitempty"`
+    Error   string      `json:"error,omitempty"`
+}
+
+// LoadShadowRepository reads SHADOW_BACKEND, the backend to mirror primary
+// to (sqlite, postgres, mysql or memory; unset turns shadowing off), and
+// SHADOW_READ_SAMPLE, the share of reads to compare (default 1). A SQLite
+// shadow lives at SHADOW_DATABASE_PATH; PostgreSQL and MySQL shadows are
+// reached at SHADOW_DB_DSN. The shadow's schema is migrated like the
+// primary's. It returns nil, and no database, when shadowing is off; the
+// caller closes the database.
+func LoadShadowRepository(primary StudentRepository, metrics *Metrics) (*ShadowRepository, *sql.DB, error) {
+    backend, sample, err := shadowSettings()
+    if backend == "" || err != nil {
+        return nil, nil, err
+    }
+    shadow, db, err := openShadowBackend(backend)
+    if err != nil {
+        return nil, nil, fmt.Errorf("shadow backend %s: %w", backend, err)
+    }
+    return &ShadowRepository{
+        primary:  primary,
+        shadow:   shadow,
+        backend:  backend,
+        sample:   sample,
+        metrics:  metrics,
+        compares: make(chan struct{}, shadowCompareWorkers),
+    }, db, nil
+}
+
+// shadowSettings reads and checks SHADOW_BACKEND and SHADOW_READ_SAMPLE
+func shadowSettings() (string, float64, error) {
+    backend := getEnv("SHADOW_BACKEND", "")
+    switch backend {
+    case "", BackendMemory, BackendSQLite, BackendPostgres, BackendMySQL:
+    default:
+        return "", 0, fmt.Errorf("unknown SHADOW_BACKEND %q", backend)
+    }
+    sample := getEnvFloat("SHADOW_READ_SAMPLE", 1)
+    if sample < 0 || sample > 1 {
+        return "", 0, fmt.Errorf("SHADOW_READ_SAMPLE must be between 0 and 1, got %g", sample)
+    }
+    return backend, sample, nil
+}
+
+// openShadowBackend opens and migrates the shadow's database
+func openShadowBackend(backend string) (StudentRepository, *sql.DB, error) {
+    var db *sql.DB
+    var err error
+    switch backend {
+    case BackendMemory:
+        return NewMemoryRepository(), nil, nil
+    case BackendSQLite:
+        path := getEnv("SHADOW_DATABASE_PATH", "")
+        if path == "" {
+            return nil, nil, errors.New("SHADOW_DATABASE_PATH is required for a sqlite shadow")
+        }
+        if db, err = sql.Open("sqlite3", sqliteDSN(path)); err == nil {
+            err = withLock(NewLocker(backend, db, path), lockMigrations, migrationLockTimeout, func() error { return migrateDB(db) })
+        }
+    case BackendPostgres:
+        if db, err = openPostgresFrom("SHADOW_DB_DSN"); err == nil {
+            err = withLock(NewLocker(backend, db, ""), lockMigrations, migrationLockTimeout, func() error { return migratePostgres(db) })
+        }
+    case BackendMySQL:
+        if db, err = openMySQLFrom("SHADOW_DB_DSN"); err == nil {
+            err = withLock(NewLocker(backend, db, ""), lockMigrations, migrationLockTimeout, func() error { return migrateMySQL(db) })
+        }
+    }
+    if err != nil {
+        if db != nil {
+            db.Close()
+        }
+        return nil, nil, err
+    }
+    var repo StudentRepository
+    switch backend {
+    case BackendSQLite:
+        repo, err = NewSQLiteRepository(db)
+    case BackendPostgres:
+        repo, err = NewPostgresRepository(db)
+    case BackendMySQL:
+        repo, err = NewMySQLRepository(db)
+    }
+    if err != nil {
+        db.Close()
+        return nil, nil, err
+    }
+    return repo, db, nil
+}
+
+// Create stores the student in the primary, then under the same ID in the
+// shadow
+func (r *ShadowRepository) Create(student Student) (Student, error) {
+    defer r.writing()()
+    created, err := r.primary.Create(student)
+    if err == nil {
+        r.mirror(r.shadow, shadowWrite{op: "create", student: created})
+    }
+    return created, err
+}
+
+// Update overwrites the student in the primary, then in the shadow
+func (r *ShadowRepository) Update(student Student) (Student, error) {
+    defer r.writing()()
+    updated, err := r.primary.Update(student)
+    if err == nil {
+        r.mirror(r.shadow, shadowWrite{op: "update", student: updated})
+    }
+    return updated, err
+}
+
+// Delete removes the student from the primary, then from the shadow
+func (r *ShadowRepository) Delete(id int) error {
+    defer r.writing()()
+    err := r.primary.Delete(id)
+    if err == nil {
+        r.mirror(r.shadow, shadowWrite{op: "delete", student: Student{ID: id}})
+    }
+    return err
+}
+
+// Transaction runs fn against the primary, then once it commits, repeats its
+// writes on the shadow in a transaction of the shadow's own
+func (r *ShadowRepository) Transaction(fn func(tx StudentRepository) error) error {
+    defer r.writing()()
+    var writes []shadowWrite
+    err := r.primary.Transaction(func(tx StudentRepository) error {
+        recorder := &shadowRecorder{StudentRepository: tx}
+        err := fn(recorder)
+        writes = recorder.writes
+        return err
+    })
+    if err != nil || len(writes) == 0 {
+        return err
+    }
+    serr := r.shadow.Transaction(func(tx StudentRepository) error {
+        for _, w := range writes {
+            r.mirror(tx, w)
+        }
+        return nil
+    })
+    if serr != nil {
+        r.diverged(false, ShadowDivergence{Op: "transaction", Key: fmt.Sprintf("%d writes", len(writes)), Error: serr.Error()})
+    }
+    return nil
+}
+
+// writing marks a mirrored write under way until the returned func is called
+func (r *ShadowRepository) writing() func() {
+    r.inflight.Add(1)
+    r.generation.Add(1)
+    return func() {
+        r.generation.Add(1)
+        r.inflight.Add(-1)
+    }
+}
+
+// shadowWrite is a write the primary has made, to repeat on the shadow
+type shadowWrite struct {
+    op      string
+    student Student
+}
+
+// mirror repeats w on target and compares the outcome. A student missing
+// from the shadow is created there, so it converges on the primary.
+func (r *ShadowRepository) mirror(target StudentRepository, w shadowWrite) {
+    key := "id=" + strconv.Itoa(w.student.ID)
+    var got Student
+    var err error
+    switch w.op {
+    case "create":
+        got, err = target.Create(w.student)
+    case "update":
+        got, err = target.Update(w.student)
+        if errors.Is(err, errStudentNotFound) {
+            r.diverged(false, ShadowDivergence{Op: w.op, Key: key, Primary: w.student, Error: "missing from the shadow; created it"})
+            target.Create(w.student)
+            return
+        }
+    case "delete":
+        err = target.Delete(w.student.ID)
+        got = w.student
+    }
+    switch {
+    case err != nil:
+        r.diverged(false, ShadowDivergence{Op: w.op, Key: key, Primary: w.student, Error: err.Error()})
+    case !sameStudent(got, w.student):
+        r.diverged(false, ShadowDivergence{Op: w.op, Key: key, Primary: w.student, Shadow: got})
+    default:
+        r.matched(false)
+    }
+}
+
+// shadowRecorder notes the writes made in a primary transaction
+type shadowRecorder struct {
+    StudentRepository
+    writes []shadowWrite
+}
+
+func (t *shadowRecorder) Create(student Student) (Student, error) {
+    created, err := t.StudentRepository.Create(student)
+    if err == nil {
+        t.writes = append(t.writes, shadowWrite{op: "create", student: created})
+    }
+    return created, err
+}
+
+func (t *shadowRecorder) Update(student Student) (Student, error) {
+    updated, err := t.StudentRepository.Update(student)
+    if err == nil {
+        t.writes = append(t.writes, shadowWrite{op: "update", student: updated})
+    }
+    return updated, err
+}
+
+func (t *shadowRecorder) Delete(id int) error {
+    err := t.StudentRepository.Delete(id)
+    if err == nil {
+        t.writes = append(t.writes, shadowWrite{op: "delete", student: Student{ID: id}})
+    }
+    return err
+}
+
+// History returns the history of the primary transaction
+func (t *shadowRecorder) History() StudentHistory {
+    return historyOf(t.StudentRepository)
+}
+
+// Outbox returns the outbox of the primary transaction
+func (t *shadowRecorder) Outbox() OutboxRepository {
+    return outboxOf(t.StudentRepository)
+}
+
+// Transaction runs fn inside the transaction already open
+func (t *shadowRecorder) Transaction(fn func(tx StudentRepository) error) error {
+    return fn(t)
+}
+
+// History returns the primary's history; the shadow keeps none
+func (r *ShadowRepository) History() StudentHistory {
+    return historyOf(r.primary)
+}
+
+// Outbox returns the outbox the primary keeps
+func (r *ShadowRepository) Outbox() OutboxRepository {
+    return outboxOf(r.primary)
+}
+
+// Get reads the student from the primary
+func (r *ShadowRepository) Get(id int) (Student, error) {
+    student, err := r.primary.Get(id)
+    r.compareRead("get", "id="+strconv.Itoa(id), student, err, func() (interface{}, error) {
+        return r.shadow.Get(id)
+    })
+    return student, err
+}
+
+// List reads the students from the primary
+func (r *ShadowRepository) List(opts ListOptions) ([]Student, error) {
+    students, err := r.primary.List(opts)
+    r.compareRead("list", listKey(opts), students, err, func() (interface{}, error) {
+        return r.shadow.List(opts)
+    })
+    return students, err
+}
+
+// Count counts the students in the primary
+func (r *ShadowRepository) Count(f *Filter) (int, error) {
+    n, err := r.primary.Count(f)
+    r.compareRead("count", listKey(ListOptions{Filter: f}), n, err, func() (interface{}, error) {
+        return r.shadow.Count(f)
+    })
+    return n, err
+}
+
+// Search uses the primary's full-text index when it has one; searches are
+// not compared, as the backends rank matches differently
+func (r *ShadowRepository) Search(terms []string, limit int) ([]SearchResult, error) {
+    if searcher, ok := r.primary.(StudentSearcher); ok {
+        return searcher.Search(terms, limit)
+    }
+    return substringSearch(r.primary, terms, limit)
+}
+
+// Close closes the primary if it holds resources
+func (r *ShadowRepository) Close() error {
+    if closer, ok := r.primary.(io.Closer); ok {
+        return closer.Close()
+    }
+    return nil
+}
+
+// compareRead repeats a sampled read on the shadow in the background and
+// compares it with the primary's answer
+func (r *ShadowRepository) compareRead(op, key string, want interface{}, wantErr error, read func() (interface{}, error)) {
+    if r.sample < 1 && rand.Float64() >= r.sample {
+        return
+    }
+    generation := r.generation.Load()
+    if r.inflight.Load() > 0 {
+        r.skipped()
+        return
+    }
+    select {
+    case r.compares <- struct{}{}:
+    default:
+        r.skipped()
+        return
+    }
+    go func() {
+        defer func() { <-r.compares }()
+        got, err := read()
+        if r.generation.Load() != generation {
+            r.skipped()
+            return
+        }
+        switch {
+        case wantErr != nil || err != nil:
+            if errors.Is(wantErr, errStudentNotFound) && errors.Is(err, errStudentNotFound) {
+                r.matched(true)
+                return
+            }
+            d := ShadowDivergence{Op: op, Key: key, Primary: errorText(wantErr), Shadow: errorText(err)}
+            r.diverged(true, d)
+        case !sameResult(want, got):
+            r.diverged(true, ShadowDivergence{Op: op, Key: key, Primary: want, Shadow: got})
+        default:
+            r.matched(true)
+        }
+    }()
+}
+
+func errorText(err error) string {
+    if err == nil {
+        return "ok"
+    }
+    return err.Error()
+}
+
+// sameStudent compares students as the backends store them, to the
+// microsecond
+func sameStudent(a, b Student) bool {
+    sameDeletion := a.DeletedAt == nil && b.DeletedAt == nil ||
+        a.DeletedAt != nil && b.DeletedAt != nil && a.DeletedAt.Truncate(time.Microsecond).Equal(b.DeletedAt.Truncate(time.Microsecond))
+    return a.ID == b.ID && a.Name == b.Name && a.Age == b.Age && a.Email == b.Email &&
+        a.UpdatedAt.Truncate(time.Microsecond).Equal(b.UpdatedAt.Truncate(time.Microsecond)) && sameDeletion
+}
+
+func sameResult(want, got interface{}) bool {
+    switch want := want.(type) {
+    case Student:
+        return sameStudent(want, got.(Student))
+    case []Student:
+        got := got.([]Student)
+        if len(want) != len(got) {
+            return false
+        }
+        for i := range want {
+            if !sameStudent(want[i], got[i]) {
+                return false
+            }
+        }
+        return true
+    }
+    return want == got
+}
+
+// listKey describes list options for the divergence log
+func listKey(opts ListOptions) string {
+    var parts []string
+    if opts.Filter != nil && opts.Filter.root != nil {
+        var where strings.Builder
+        var args []interface{}
+        opts.Filter.root.sql(&where, &args)
+        parts = append(parts, fmt.Sprintf("filter=%s %v", where.String(), args))
+    }
+    for _, key := range opts.Sort {
+        sign := ""
+        if key.Desc {
+            sign = "-"
+        }
+        parts = append(parts, "sort="+sign+key.Field)
+    }
+    if opts.Limit > 0 {
+        parts = append(parts, fmt.Sprintf("limit=%d offset=%d", opts.Limit, opts.Offset))
+    }
+    return strings.Join(parts, " ")
+}
+
+func (r *ShadowRepository) matched(read bool) {
+    r.mu.Lock()
+    if read {
+        r.stats.ReadsMatched++
+    } else {
+        r.stats.WritesMatched++
+    }
+    r.record(read, "matched")
+    r.mu.Unlock()
+}
+
+func (r *ShadowRepository) skipped() {
+    r.mu.Lock()
+    r.stats.ReadsSkipped++
+    r.record(true, "skipped")
+    r.mu.Unlock()
+}
+
+func (r *ShadowRepository) diverged(read bool, d ShadowDivergence) {
+    d.At = time.Now().UTC()
+    slog.Warn("shadow backend diverged", "backend", r.backend, "op", d.Op, "key", d.Key, "primary", d.Primary, "shadow", d.Shadow, "error", d.Error)
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if read {
+        r.stats.ReadsDiverged++
+    } else {
+        r.stats.WritesDiverged++
+    }
+    if len(r.divergences) == maxShadowDivergences {
+        r.divergences = r.divergences[1:]
+    }
+    r.divergences = append(r.divergences, d)
+    r.record(read, "diverged")
+}
+
+// record updates the metrics; the caller holds r.mu
+func (r *ShadowRepository) record(read bool, result string) {
+    kind := "write"
+    if read {
+        kind = "read"
+    }
+    r.metrics.Inc("shadow_operations_total", "kind", kind, "result", result)
+    if score := r.stats.Score(); score != nil {
+        r.metrics.Set("shadow_consistency_score", *score)
+    }
+}
+
+// ShadowStatus is the body of GET /admin/shadow
+type ShadowStatus struct {
+    Backend    string  `json:"backend"`
+    ReadSample float64 `json:"read_sample"`
+    ShadowStats
+    // Score is the share of compared reads and writes that matched
+    Score       *float64           `json:"score"`
+    Divergences []ShadowDivergence `json:"divergences"`
+}
+
+// Status reports the comparisons so far and the latest divergences
+func (r *ShadowRepository) Status() ShadowStatus {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    divergences := make([]ShadowDivergence, len(r.divergences))
+    copy(divergences, r.divergences)
+    return ShadowStatus{Backend: r.backend, ReadSample: r.sample, ShadowStats: r.stats, Score: r.stats.Score(), Divergences: divergences}
+}
+
+// ShadowVerification is the result of comparing every student in both
+// backends
+type ShadowVerification struct {
+    Primary   int `json:"primary"`
+    Shadow    int `json:"shadow"`
+    Matched   int `json:"matched"`
+    Missing   int `json:"missing"`
+    Extra     int `json:"extra"`
+    Different int `json:"different"`
+    Repaired  int `json:"repaired"`
+    // Score is the share of students in either backend that match
+    Score float64 `json:"score"`
+    // Examples lists some of the IDs that do not match
+    Examples []int `json:"examples,omitempty"`
+}
+
+// Verify compares every student in the primary with the shadow, in ID order.
+// With repair, it then copies missing and different students to the shadow
+// and deletes those only the shadow has. The caller keeps writes out
+// meanwhile.
+func (r *ShadowRepository) Verify(repair bool) (ShadowVerification, error) {
+    var v ShadowVerification
+    var primary, shadow []Student
+    // Repairs wait for the scan, whose pages they would shift
+    var copies []Student
+    var extras []int
+    var pOffset, sOffset int
+    next := func(repo StudentRepository, page *[]Student, offset *int) (*Student, error) {
+        if len(*page) == 0 {
+            students, err := repo.List(ListOptions{Limit: shadowVerifyPage, Offset: *offset})
+            if err != nil || len(students) == 0 {
+                return nil, err
+            }
+            *page = students
+            *offset += len(students)
+        }
+        return &(*page)[0], nil
+    }
+    example := func(id int) {
+        if len(v.Examples) < 20 {
+            v.Examples = append(v.Examples, id)
+        }
+    }
+    for {
+        p, err := next(r.primary, &primary, &pOffset)
+        if err != nil {
+            return v, fmt.Errorf("reading the primary: %w", err)
+        }
+        s, err := next(r.shadow, &shadow, &sOffset)
+        if err != nil {
+            return v, fmt.Errorf("reading the shadow: %w", err)
+        }
+        switch {
+        case p == nil && s == nil:
+            total := v.Matched + v.Missing + v.Extra + v.Different
+            v.Score = 1
+            if total > 0 {
+                v.Score = float64(v.Matched) / float64(total)
+            }
+            if repair {
+                return v, r.repair(&v, copies, extras)
+            }
+            return v, nil
+        case s == nil || (p != nil && p.ID < s.ID):
+            v.Primary++
+            v.Missing++
+            example(p.ID)
+            copies = append(copies, *p)
+            primary = primary[1:]
+        case p == nil || s.ID < p.ID:
+            v.Shadow++
+            v.Extra++
+            example(s.ID)
+            extras = append(extras, s.ID)
+            shadow = shadow[1:]
+        default:
+            v.Primary++
+            v.Shadow++
+            if sameStudent(*p, *s) {
+                v.Matched++
+            } else {
+                v.Different++
+                example(p.ID)
+                copies = append(copies, *p)
+            }
+            primary, shadow = primary[1:], shadow[1:]
+        }
+    }
+}
+
+// repair writes the primary's copies of students over the shadow's, or
+// creates them, and deletes the extras
+func (r *ShadowRepository) repair(v *ShadowVerification, copies []Student, extras []int) error {
+    for _, student := range copies {
+        _, err := r.shadow.Update(student)
+        if errors.Is(err, errStudentNotFound) {
+            _, err = r.shadow.Create(student)
+        }
+        if err != nil {
+            return fmt.Errorf("repairing student %d: %w", student.ID, err)
+        }
+        v.Repaired++
+    }
+    for _, id := range extras {
+        if err := r.shadow.Delete(id); err != nil && !errors.Is(err, errStudentNotFound) {
+            return fmt.Errorf("deleting student %d: %w", id, err)
+        }
+        v.Repaired++
+    }
+    return nil
+}
+
+// GetShadowStatus reports how the shadow backend compares with the primary
+func (app *App) GetShadowStatus(w http.ResponseWriter, r *http.Request) {
+    if app.shadow == nil {
+        httpError(w, r, "Shadow mode is off; set SHADOW_BACKEND", http.StatusNotFound)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(app.shadow.Status())
+}
+
+// VerifyShadow compares every student in both backends, the check to pass
+// before cutting over. ?repair=true also brings the shadow into line.
+func (app *App) VerifyShadow(w http.ResponseWriter, r *http.Request) {
+    if app.shadow == nil {
+        httpError(w, r, "Shadow mode is off; set SHADOW_BACKEND", http.StatusNotFound)
+        return
+    }
+    repair := false
+    if value := r.URL.Query().Get("repair"); value != "" {
+        var err error
+        if repair, err = strconv.ParseBool(value); err != nil {
+            httpError(w, r, "repair must be true or false", http.StatusBadRequest)
+            return
+        }
+    }
+
+    // The store's read lock keeps mirrored writes out while the backends are
+    // compared
+    app.store.RLock()
+    result, err := app.shadow.Verify(repair)
+    app.store.RUnlock()
+    if err != nil {
+        reqctx.Logger(r.Context()).Error("verifying the shadow backend failed", "error", err)
+        httpError(w, r, "Verification failed: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    app.metrics.Set("shadow_verify_score", result.Score)
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "time"
+)
+
+// ShutdownConfig controls how the server stops on SIGINT or SIGTERM
+type ShutdownConfig struct {
+    // Delay keeps serving with /readyz failing, giving load balancers time
+    // to take the instance out of rotation before connections are refused
+    Delay time.Duration
+    // Timeout bounds how long in-flight requests may take to finish
+    Timeout time.Duration
+}
+
+// LoadShutdownConfig reads SHUTDOWN_DELAY (default 0) and SHUTDOWN_TIMEOUT
+// (default 30s)
+func LoadShutdownConfig() (ShutdownConfig, error) {
+    cfg := ShutdownConfig{
+        Delay:   getEnvDuration("SHUTDOWN_DELAY", 0),
+        Timeout: getEnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
+    }
+    if cfg.Delay < 0 {
+        return cfg, fmt.Errorf("SHUTDOWN_DELAY must not be negative, got %s", cfg.Delay)
+    }
+    if cfg.Timeout <= 0 {
+        return cfg, fmt.Errorf("SHUTDOWN_TIMEOUT must be positive, got %s", cfg.Timeout)
+    }
+    return cfg, nil
+}
+
+// serve runs server, over TLS when it has a TLSConfig, until it fails or ctx
+// is done. On ctx, readiness fails
+// for cfg.Delay, then the server stops accepting connections and waits up to
+// cfg.Timeout for in-flight requests, closing those still open after it. It
+// returns nil once the server has stopped because of ctx.
+func serve(ctx context.Context, server *http.Server, warmer *ModelWarmer, cfg ShutdownConfig) error {
+    errc := make(chan error, 1)
+    go func() {
+        if server.TLSConfig != nil {
+            // The certificate comes from TLSConfig.GetCertificate
+            errc <- server.ListenAndServeTLS("", "")
+            return
+        }
+        errc <- server.ListenAndServe()
+    }()
+
+    select {
+    case err := <-errc:
+        return err
+    case <-ctx.Done():
+    }
+
+    slog.Info("shutting down", "delay", cfg.Delay.String(), "timeout", cfg.Timeout.String())
+    warmer.Drain()
+    if cfg.Delay > 0 {
+        time.Sleep(cfg.Delay)
+    }
+
+    shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+    defer cancel()
+    started := time.Now()
+    if err := server.Shutdown(shutdownCtx); err != nil {
+        slog.Error("requests still in flight at the shutdown timeout; closing their connections", "error", err)
+        server.Close()
+    } else {
+        slog.Info("requests drained", "duration_ms", time.Since(started).Milliseconds())
+    }
+    if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+        return err
+    }
+    return nil
+}
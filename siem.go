@@ -0,0 +1,300 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/tls"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/url"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// HTTPS audit sink body formats
+const (
+    AuditFormatNDJSON  = "ndjson"
+    AuditFormatSplunk  = "splunk"
+    AuditFormatElastic = "elastic"
+)
+
+// syslogFacilityAudit is the RFC 5424 "log audit" facility
+const syslogFacilityAudit = 13
+
+// cefHeaderEscaper and cefValueEscaper escape CEF header fields and
+// extension values
+var (
+    cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ")
+    cefValueEscaper  = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+)
+
+// cefSeverity rates reads 3, writes 5, refused requests 7 and any touch of a
+// honeypot 10 on CEF's 0-10 scale
+func cefSeverity(e AuditEvent) int {
+    switch {
+    case len(e.Honeypot) > 0:
+        return 10
+    case e.Denied():
+        return 7
+    case e.Action == AuditRead:
+        return 3
+    default:
+        return 5
+    }
+}
+
+// formatCEF renders an event in ArcSight Common Event Format
+func formatCEF(e AuditEvent) string {
+    header := []string{"CEF:0", "student-api", "student-api", buildInfo().Version,
+        e.Action, e.Method + " " + e.Route, strconv.Itoa(cefSeverity(e))}
+    for i := 1; i < len(header); i++ {
+        header[i] = cefHeaderEscaper.Replace(header[i])
+    }
+
+    ext := []struct{ key, value string }{
+        {"rt", strconv.FormatInt(e.At.UnixMilli(), 10)},
+        {"act", e.Action},
+        {"suser", e.Actor},
+        {"src", e.Source},
+        {"requestMethod", e.Method},
+        {"request", e.Path},
+        {"outcome", strconv.Itoa(e.Status)},
+    }
+    studentID := ""
+    if e.StudentID != 0 {
+        studentID = strconv.Itoa(e.StudentID)
+    }
+    for i, custom := range []struct{ label, value string }{{"tenant", e.Tenant}, {"requestId", e.RequestID}, {"honeypotIds", joinInts(e.Honeypot)}, {"studentId", studentID}} {
+        if custom.value != "" {
+            n := strconv.Itoa(i + 1)
+            ext = append(ext, struct{ key, value string }{"cs" + n + "Label", custom.label}, struct{ key, value string }{"cs" + n, custom.value})
+        }
+    }
+    var fields []string
+    for _, kv := range ext {
+        if kv.value != "" {
+            fields = append(fields, kv.key+"="+cefValueEscaper.Replace(kv.value))
+        }
+    }
+    return strings.Join(header, "|") + "|" + strings.Join(fields, " ")
+}
+
+// SyslogAuditSink sends events as RFC 5424 syslog messages carrying CEF, over
+// UDP, TCP or TLS. Stream transports use octet-counting framing (RFC 6587).
+type SyslogAuditSink struct {
+    network  string // "udp", "tcp" or "tls"
+    addr     string
+    hostname string
+    tls      *tls.Config
+
+    mu   sync.Mutex
+    conn net.Conn
+}
+
+// NewSyslogAuditSink parses a udp://, tcp:// or tls:// address
+func NewSyslogAuditSink(rawURL string, insecure bool) (*SyslogAuditSink, error) {
+    u, err := url.Parse(rawURL)
+    if err != nil || u.Host == "" {
+        return nil, fmt.Errorf("AUDIT_SYSLOG_ADDR %q: expected udp://, tcp:// or tls://host:port", rawURL)
+    }
+    switch u.Scheme {
+    case "udp", "tcp", "tls":
+    default:
+        return nil, fmt.Errorf("AUDIT_SYSLOG_ADDR %q: unsupported scheme %q", rawURL, u.Scheme)
+    }
+    host := u.Host
+    if u.Port() == "" {
+        port := "514"
+        if u.Scheme == "tls" {
+            port = "6514"
+        }
+        host = net.JoinHostPort(u.Hostname(), port)
+    }
+    hostname, err := os.Hostname()
+    if err != nil || hostname == "" {
+        hostname = "-"
+    }
+    return &SyslogAuditSink{
+        network:  u.Scheme,
+        addr:     host,
+        hostname: hostname,
+        tls:      &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: insecure},
+    }, nil
+}
+
+// LoadSyslogAuditSink reads AUDIT_SYSLOG_ADDR and AUDIT_SYSLOG_INSECURE
+func LoadSyslogAuditSink() (*SyslogAuditSink, error) {
+    addr := getEnv("AUDIT_SYSLOG_ADDR", "")
+    if addr == "" {
+        return nil, fmt.Errorf("audit sink syslog needs AUDIT_SYSLOG_ADDR")
+    }
+    return NewSyslogAuditSink(addr, getEnvBool("AUDIT_SYSLOG_INSECURE", false))
+}
+
+func (s *SyslogAuditSink) Name() string { return AuditSinkSyslog }
+
+func (s *SyslogAuditSink) dial(ctx context.Context) (net.Conn, error) {
+    dialer := &net.Dialer{Timeout: 5 * time.Second}
+    if s.network == "tls" {
+        return (&tls.Dialer{NetDialer: dialer, Config: s.tls}).DialContext(ctx, "tcp", s.addr)
+    }
+    return dialer.DialContext(ctx, s.network, s.addr)
+}
+
+// message renders one RFC 5424 line: alert for honeypot touches, notice for
+// refused requests, info otherwise
+func (s *SyslogAuditSink) message(e AuditEvent) string {
+    severity := 6
+    switch {
+    case len(e.Honeypot) > 0:
+        severity = 1
+    case e.Denied():
+        severity = 5
+    }
+    return fmt.Sprintf("<%d>1 %s %s student-api %d audit - %s",
+        syslogFacilityAudit*8+severity, e.At.Format(time.RFC3339Nano), s.hostname, os.Getpid(), formatCEF(e))
+}
+
+// WriteBatch sends the events, redialling once if the connection has dropped
+func (s *SyslogAuditSink) WriteBatch(ctx context.Context, events []AuditEvent) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var err error
+    for attempt := 0; attempt < 2; attempt++ {
+        if s.conn == nil {
+            if s.conn, err = s.dial(ctx); err != nil {
+                return err
+            }
+        }
+        if err = s.send(ctx, events); err == nil {
+            return nil
+        }
+        s.conn.Close()
+        s.conn = nil
+    }
+    return err
+}
+
+func (s *SyslogAuditSink) send(ctx context.Context, events []AuditEvent) error {
+    if deadline, ok := ctx.Deadline(); ok {
+        s.conn.SetWriteDeadline(deadline)
+    }
+    if s.network == "udp" {
+        for _, e := range events {
+            if _, err := io.WriteString(s.conn, s.message(e)); err != nil {
+                return err
+            }
+        }
+        return nil
+    }
+    var buf bytes.Buffer
+    for _, e := range events {
+        msg := s.message(e)
+        buf.WriteString(strconv.Itoa(len(msg)) + " " + msg)
+    }
+    _, err := s.conn.Write(buf.Bytes())
+    return err
+}
+
+// HTTPAuditSink posts batches to an HTTPS collector such as a Splunk HTTP
+// Event Collector or an Elasticsearch _bulk endpoint
+type HTTPAuditSink struct {
+    url    string
+    token  string
+    format string
+    http   *http.Client
+}
+
+// NewHTTPAuditSink creates a sink posting in format with token as credential
+func NewHTTPAuditSink(endpoint, token, format string) (*HTTPAuditSink, error) {
+    u, err := url.Parse(endpoint)
+    if err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+        return nil, fmt.Errorf("AUDIT_HTTP_URL %q: expected an https:// URL", endpoint)
+    }
+    switch format {
+    case AuditFormatNDJSON, AuditFormatSplunk, AuditFormatElastic:
+    default:
+        return nil, fmt.Errorf("AUDIT_HTTP_FORMAT must be %s, %s or %s, got %q", AuditFormatNDJSON, AuditFormatSplunk, AuditFormatElastic, format)
+    }
+    return &HTTPAuditSink{url: endpoint, token: token, format: format, http: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+// LoadHTTPAuditSink reads AUDIT_HTTP_URL, AUDIT_HTTP_TOKEN and AUDIT_HTTP_FORMAT
+func LoadHTTPAuditSink() (*HTTPAuditSink, error) {
+    endpoint := getEnv("AUDIT_HTTP_URL", "")
+    if endpoint == "" {
+        return nil, fmt.Errorf("audit sink https needs AUDIT_HTTP_URL")
+    }
+    return NewHTTPAuditSink(endpoint, getEnv("AUDIT_HTTP_TOKEN", ""), getEnv("AUDIT_HTTP_FORMAT", AuditFormatNDJSON))
+}
+
+func (s *HTTPAuditSink) Name() string { return AuditSinkHTTPS }
+
+// body renders a batch: one JSON document per line, wrapped in a HEC event
+// or preceded by a _bulk index action as the format requires
+func (s *HTTPAuditSink) body(events []AuditEvent) ([]byte, error) {
+    var buf bytes.Buffer
+    enc := json.NewEncoder(&buf)
+    for _, e := range events {
+        var err error
+        switch s.format {
+        case AuditFormatSplunk:
+            err = enc.Encode(map[string]interface{}{
+                "time":       float64(e.At.UnixMilli()) / 1000,
+                "sourcetype": "student-api:audit",
+                "event":      e,
+            })
+        case AuditFormatElastic:
+            if err = enc.Encode(map[string]interface{}{"create": map[string]interface{}{}}); err == nil {
+                err = enc.Encode(map[string]interface{}{
+                    "@timestamp": e.At,
+                    "event":      map[string]string{"action": e.Action, "outcome": strconv.Itoa(e.Status)},
+                    "audit":      e,
+                })
+            }
+        default:
+            err = enc.Encode(e)
+        }
+        if err != nil {
+            return nil, err
+        }
+    }
+    return buf.Bytes(), nil
+}
+
+// WriteBatch posts the events in one request
+func (s *HTTPAuditSink) WriteBatch(ctx context.Context, events []AuditEvent) error {
+    body, err := s.body(events)
+    if err != nil {
+        return err
+    }
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/x-ndjson")
+    if s.token != "" {
+        scheme := "Bearer "
+        if s.format == AuditFormatSplunk {
+            scheme = "Splunk "
+        }
+        req.Header.Set("Authorization", scheme+s.token)
+    }
+
+    resp, err := s.http.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    io.Copy(io.Discard, resp.Body)
+    if resp.StatusCode >= 300 {
+        return fmt.Errorf("audit https: unexpected status %s", resp.Status)
+    }
+    return nil
+}
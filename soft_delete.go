@@ -0,0 +1,117 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "log/slog"
+    "net/http"
+    "strconv"
+    "time"
+    "github.com/gorilla/mux"
+)
+
+// Restore takes a deleted student out of the trash as it was when deleted
+func (s *StudentStore) Restore(id int) (Student, StudentVersion, error) {
+    s.Lock()
+    defer s.Unlock()
+    student, err := s.repo.Get(id)
+    if err != nil {
+        return Student{}, StudentVersion{}, err
+    }
+    if student.DeletedAt == nil {
+        return Student{}, StudentVersion{}, errStudentNotDeleted
+    }
+    return s.restoreLocked(student)
+}
+
+// Purge removes the students deleted before cutoff for good, returning how
+// many there were. Their deletion is already in the history, so nothing is
+// recorded.
+func (s *StudentStore) Purge(cutoff time.Time) (int, error) {
+    s.Lock()
+    defer s.Unlock()
+    deleted, err := s.repo.List(ListOptions{Filter: deletedStudents})
+    if err != nil {
+        return 0, err
+    }
+    purged := 0
+    for _, student := range deleted {
+        if !student.DeletedAt.Before(cutoff) {
+            continue
+        }
+        if err := s.repo.Delete(student.ID); err != nil && !errors.Is(err, errStudentNotFound) {
+            return purged, err
+        }
+        purged++
+    }
+    return purged, nil
+}
+
+// RestoreStudent serves POST /students/{id}/restore, undeleting a student
+// that has not been purged yet
+func (app *App) RestoreStudent(w http.ResponseWriter, r *http.Request) {
+    store := app.storeFor(r)
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        httpError(w, r, "Invalid ID", http.StatusBadRequest)
+        return
+    }
+
+    student, version, err := store.Restore(id)
+    if errors.Is(err, errStudentNotDeleted) {
+        httpError(w, r, "Student is not deleted", http.StatusConflict)
+        return
+    }
+    if err != nil {
+        writeStoreError(w, r, err)
+        return
+    }
+
+    app.recordChanges(r, version)
+    w.Header().Set("X-Operation-ID", strconv.Itoa(version.Seq))
+    json.NewEncoder(w).Encode(student)
+}
+
+// includeDeletedFromRequest reads include_deleted, which lists deleted
+// students alongside the others
+func includeDeletedFromRequest(r *http.Request) (bool, *ValidationError) {
+    value := r.URL.Query().Get("include_deleted")
+    if value == "" {
+        return false, nil
+    }
+    include, err := strconv.ParseBool(value)
+    if err != nil {
+        return false, &ValidationError{Field: "include_deleted", Code: CodeInvalidFilter, Message: "include_deleted must be true or false"}
+    }
+    return include, nil
+}
+
+// purgeDeletedStudents removes, every interval, the students deleted longer
+// than app.deletedRetention ago from the shared store and the open tenant
+// stores. A tenant whose database is closed is purged once it is open again
+// at a later pass.
+func (app *App) purgeDeletedStudents(ctx context.Context, interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case now := <-ticker.C:
+            open, release := app.tenants.Open()
+            for _, store := range append([]*StudentStore{app.store}, open...) {
+                n, err := store.Purge(now.UTC().Add(-app.deletedRetention))
+                if err != nil {
+                    slog.Error("purging deleted students failed", "tenant", store.tenant, "error", err)
+                    app.metrics.Inc("student_purge_errors_total")
+                }
+                if n > 0 {
+                    slog.Info("purged deleted students", "tenant", store.tenant, "students", n)
+                    app.metrics.Add("students_purged_total", float64(n))
+                }
+            }
+            release()
+        }
+    }
+}
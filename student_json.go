@@ -0,0 +1,136 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "sync"
+    "time"
+    "unicode/utf8"
+)
+
+// maxPooledJSONBuffer is the capacity above which a response buffer is
+// dropped rather than pooled, so one huge record does not pin memory
+const maxPooledJSONBuffer = 64 << 10
+
+// jsonBuffers holds response buffers for writeStudentJSON
+var jsonBuffers = sync.Pool{New: func() any {
+    buf := make([]byte, 0, 512)
+    return &buf
+}}
+
+// writeStudentJSON writes a student as json.NewEncoder(w).Encode would,
+// without reflection or allocation: GET /students/{id} answers with nothing
+// else, so it is encoded by hand into a pooled buffer
+func writeStudentJSON(w http.ResponseWriter, s Student) {
+    if y := s.UpdatedAt.Year(); y < 0 || y > 9999 {
+        // time.Time refuses to marshal these; keep the encoder's behaviour
+        json.NewEncoder(w).Encode(s)
+        return
+    }
+    bufp := jsonBuffers.Get().(*[]byte)
+    buf := append(appendStudentJSON((*bufp)[:0], s), '\n')
+    w.Write(buf)
+    if cap(buf) <= maxPooledJSONBuffer {
+        *bufp = buf
+        jsonBuffers.Put(bufp)
+    }
+}
+
+// appendStudentJSON appends the JSON object of a student, fields in struct
+// order as encoding/json writes them
+func appendStudentJSON(dst []byte, s Student) []byte {
+    dst = append(dst, `{"id":`...)
+    dst = appendInt(dst, s.ID)
+    dst = append(dst, `,"name":`...)
+    dst = appendJSONString(dst, s.Name)
+    dst = append(dst, `,"age":`...)
+    dst = appendInt(dst, s.Age)
+    dst = append(dst, `,"email":`...)
+    dst = appendJSONString(dst, s.Email)
+    dst = append(dst, `,"updated_at":"`...)
+    dst = s.UpdatedAt.AppendFormat(dst, time.RFC3339Nano)
+    if s.DeletedAt != nil {
+        dst = append(dst, `","deleted_at":"`...)
+        dst = s.DeletedAt.AppendFormat(dst, time.RFC3339Nano)
+    }
+    return append(dst, `"}`...)
+}
+
+func appendInt(dst []byte, n int) []byte {
+    if n < 0 {
+        dst = append(dst, '-')
+        // negate as unsigned so the smallest int does not overflow
+        return appendUint(dst, uint64(-(n+1))+1)
+    }
+    return appendUint(dst, uint64(n))
+}
+
+func appendUint(dst []byte, n uint64) []byte {
+    var digits [20]byte
+    i := len(digits)
+    for {
+        i--
+        digits[i] = byte('0' + n%10)
+        if n /= 10; n == 0 {
+            break
+        }
+    }
+    return append(dst, digits[i:]...)
+}
+
+const hexDigits = "0123456789abcdef"
+
+// appendJSONString appends s as a JSON string escaped like encoding/json:
+// HTML-significant characters, U+2028 and U+2029 become \u escapes and
+// invalid UTF-8 becomes U+FFFD
+func appendJSONString(dst []byte, s string) []byte {
+    dst = append(dst, '"')
+    start := 0
+    for i := 0; i < len(s); {
+        b := s[i]
+        if b < utf8.RuneSelf {
+            if b >= 0x20 && b != '"' && b != '\\' && b != '<' && b != '>' && b != '&' {
+                i++
+                continue
+            }
+            dst = append(dst, s[start:i]...)
+            switch b {
+            case '"', '\\':
+                dst = append(dst, '\\', b)
+            case '\b':
+                dst = append(dst, '\\', 'b')
+            case '\f':
+                dst = append(dst, '\\', 'f')
+            case '\n':
+                dst = append(dst, '\\', 'n')
+            case '\r':
+                dst = append(dst, '\\', 'r')
+            case '\t':
+                dst = append(dst, '\\', 't')
+            default:
+                dst = append(dst, '\\', 'u', '0', '0', hexDigits[b>>4], hexDigits[b&0xF])
+            }
+            i++
+            start = i
+            continue
+        }
+        r, size := utf8.DecodeRuneInString(s[i:])
+        if r == utf8.RuneError && size == 1 {
+            dst = append(dst, s[start:i]...)
+            dst = utf8.AppendRune(dst, utf8.RuneError)
+            i += size
+            start = i
+            continue
+        }
+        if r == '\u2028' || r == '\u2029' {
+            dst = append(dst, s[start:i]...)
+            dst = append(dst, '\\', 'u', '2', '0', '2', hexDigits[r&0xF])
+            i += size
+            start = i
+            continue
+        }
+        i += size
+    }
+    dst = append(dst, s[start:]...)
+    return append(dst, '"')
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "student-api/reqctx"
+)
+
+// SummaryCache keeps the last summary generated for each student so requests
+// are answered without waiting on the model. A summary older than ttl, or
+// generated from an earlier version of the student, is stale: it is still
+// served while a refresh runs in the background, until it is maxStale old.
+type SummaryCache struct {
+    sync.Mutex
+    entries  map[string]*summaryEntry
+    ttl      time.Duration
+    maxStale time.Duration
+    size     int
+}
+
+type summaryEntry struct {
+    summary StudentSummary
+    // source is the UpdatedAt of the student the summary was generated from
+    source      time.Time
+    generatedAt time.Time
+    refreshing  bool
+}
+
+// SummaryResponse is a summary with its freshness. Generating is set when a
+// stale summary is being replaced in the background.
+type SummaryResponse struct {
+    StudentSummary
+    GeneratedAt time.Time `json:"generated_at"`
+    Stale       bool      `json:"stale"`
+    Generating  bool      `json:"generating"`
+}
+
+// NewSummaryCache initializes a SummaryCache holding at most size summaries
+func NewSummaryCache(ttl, maxStale time.Duration, size int) *SummaryCache {
+    return &SummaryCache{entries: make(map[string]*summaryEntry), ttl: ttl, maxStale: maxStale, size: size}
+}
+
+// LoadSummaryCache configures the cache from SUMMARY_CACHE_TTL,
+// SUMMARY_CACHE_MAX_STALE and SUMMARY_CACHE_SIZE
+func LoadSummaryCache() *SummaryCache {
+    return NewSummaryCache(
+        getEnvDuration("SUMMARY_CACHE_TTL", 10*time.Minute),
+        getEnvDuration("SUMMARY_CACHE_MAX_STALE", 24*time.Hour),
+        getEnvInt("SUMMARY_CACHE_SIZE", 1000),
+    )
+}
+
+// put stores a summary, evicting the oldest one when the cache is full
+func (c *SummaryCache) put(key string, summary StudentSummary, source, generatedAt time.Time) {
+    c.Lock()
+    defer c.Unlock()
+    if _, exists := c.entries[key]; !exists && len(c.entries) >= c.size {
+        var oldest string
+        for k, entry := range c.entries {
+            if oldest == "" || entry.generatedAt.Before(c.entries[oldest].generatedAt) {
+                oldest = k
+            }
+        }
+        delete(c.entries, oldest)
+    }
+    c.entries[key] = &summaryEntry{summary: summary, source: source, generatedAt: generatedAt}
+}
+
+// cachedSummary answers from the summary cache. A missing or too old
+// summary is generated while the caller waits, as is any summary when
+// refresh is set; a stale one is returned at once and refreshed in the
+// background.
+func (app *App) cachedSummary(ctx context.Context, student Student, refresh bool) (SummaryResponse, error) {
+    // Masked students are summarized, so neither the model nor the summary
+    // sees the real name
+    student = app.masker.Student(student)
+    c := app.summaryCache
+    tenant := reqctx.From(ctx).Tenant
+    tmpl, err := app.summaryTemplates.For(tenant)
+    if err != nil {
+        return SummaryResponse{}, err
+    }
+    key := fmt.Sprintf("%s:%d:%s:%s%s", tenant, student.ID, app.models.Primary(TaskSummary), app.prompts.VariantFor(student.ID).Name, tmpl.key())
+    now := time.Now()
+
+    c.Lock()
+    entry := c.entries[key]
+    if entry == nil || now.Sub(entry.generatedAt) > c.maxStale || refresh {
+        c.Unlock()
+        app.metrics.Inc("summary_cache_requests_total", "result", "miss")
+        summary, err := app.generateSummary(ctx, student, tmpl)
+        if err != nil {
+            return SummaryResponse{}, err
+        }
+        generatedAt := time.Now()
+        c.put(key, summary, student.UpdatedAt, generatedAt)
+        return SummaryResponse{StudentSummary: summary, GeneratedAt: generatedAt}, nil
+    }
+
+    resp := SummaryResponse{StudentSummary: entry.summary, GeneratedAt: entry.generatedAt}
+    resp.Stale = !entry.source.Equal(student.UpdatedAt) || now.Sub(entry.generatedAt) > c.ttl
+    start := resp.Stale && !entry.refreshing
+    if resp.Stale {
+        entry.refreshing = true
+        resp.Generating = true
+    }
+    c.Unlock()
+
+    result := "fresh"
+    if resp.Stale {
+        result = "stale"
+    }
+    app.metrics.Inc("summary_cache_requests_total", "result", result)
+    app.metrics.Add("summary_cache_served_age_seconds_sum", now.Sub(resp.GeneratedAt).Seconds())
+    app.metrics.Inc("summary_cache_served_age_seconds_count")
+    if start {
+        go app.refreshSummary(withLLMPriority(context.WithoutCancel(ctx), PriorityBatch), key, entry, student, tmpl)
+    }
+    return resp, nil
+}
+
+// refreshSummary regenerates a stale summary in the background. On failure
+// the stale summary stays cached and the next request retries.
+func (app *App) refreshSummary(ctx context.Context, key string, entry *summaryEntry, student Student, tmpl *summaryPrompt) {
+    summary, err := app.generateSummary(ctx, student, tmpl)
+    if err != nil {
+        app.metrics.Inc("summary_refreshes_total", "outcome", "error")
+        reqctx.Logger(ctx).Warn("summary refresh failed", "student_id", student.ID, "error", err)
+        app.summaryCache.Lock()
+        entry.refreshing = false
+        app.summaryCache.Unlock()
+        return
+    }
+    app.metrics.Inc("summary_refreshes_total", "outcome", "ok")
+    app.summaryCache.put(key, summary, student.UpdatedAt, time.Now())
+}
+
+// wantsFreshSummary reports whether the client sent Cache-Control: no-cache
+// to wait for a newly generated summary
+func wantsFreshSummary(r *http.Request) bool {
+    for _, directive := range strings.Split(r.Header.Get("Cache-Control"), ",") {
+        if strings.EqualFold(strings.TrimSpace(directive), "no-cache") {
+            return true
+        }
+    }
+    return false
+}
+
+// setSummaryAge reports how old a served summary is in the Age header
+func setSummaryAge(w http.ResponseWriter, resp SummaryResponse) {
+    w.Header().Set("Age", strconv.Itoa(int(time.Since(resp.GeneratedAt).Seconds())))
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "strings"
+)
+
+// summarySchema is the JSON schema sent to Ollama as the structured output format
+var summarySchema = json.RawMessage(`{
+    "type": "object",
+    "properties": {
+        "summary": {"type": "string"},
+        "strengths": {"type": "array", "items": {"type": "string"}},
+        "risks": {"type": "array", "items": {"type": "string"}},
+        "recommendation": {"type": "string"}
+    },
+    "required": ["summary", "strengths", "risks", "recommendation"]
+}`)
+
+// structuredInstructions is appended to every summary prompt so the model knows the expected shape
+const structuredInstructions = "\n\nRespond only with a JSON object with the fields " +
+    `"summary" (string), "strengths" (array of strings), "risks" (array of strings) ` +
+    `and "recommendation" (string).`
+
+// summaryFields are the fields of a StructuredSummary in schema order, with
+// their JSON schema and how the instructions describe them
+var summaryFields = []struct {
+    name, schema, kind string
+}{
+    {"summary", `{"type": "string"}`, "string"},
+    {"strengths", `{"type": "array", "items": {"type": "string"}}`, "array of strings"},
+    {"risks", `{"type": "array", "items": {"type": "string"}}`, "array of strings"},
+    {"recommendation", `{"type": "string"}`, "string"},
+}
+
+// summaryFormat lists the fields a summary asks the model for; fields left
+// out are returned empty. A nil format asks for all of them.
+type summaryFormat []string
+
+// includes reports whether the format asks for a field
+func (f summaryFormat) includes(field string) bool {
+    return f == nil || containsString(f, field)
+}
+
+// schema returns the JSON schema of the format; every field is required
+func (f summaryFormat) schema() json.RawMessage {
+    if f == nil {
+        return summarySchema
+    }
+    var properties []string
+    var required []string
+    for _, field := range summaryFields {
+        if f.includes(field.name) {
+            properties = append(properties, fmt.Sprintf("%q: %s", field.name, field.schema))
+            required = append(required, fmt.Sprintf("%q", field.name))
+        }
+    }
+    return json.RawMessage(fmt.Sprintf(`{"type": "object", "properties": {%s}, "required": [%s]}`,
+        strings.Join(properties, ", "), strings.Join(required, ", ")))
+}
+
+// instructions returns the text appended to a prompt describing the format
+func (f summaryFormat) instructions() string {
+    if f == nil {
+        return structuredInstructions
+    }
+    var described []string
+    for _, field := range summaryFields {
+        if f.includes(field.name) {
+            described = append(described, fmt.Sprintf("%q (%s)", field.name, field.kind))
+        }
+    }
+    list := described[len(described)-1]
+    if len(described) > 1 {
+        list = strings.Join(described[:len(described)-1], ", ") + " and " + list
+    }
+    noun := "fields"
+    if len(described) == 1 {
+        noun = "field"
+    }
+    return fmt.Sprintf("\n\nRespond only with a JSON object with the %s %s.", noun, list)
+}
+
+// StructuredSummary is the typed shape of a generated summary
+type StructuredSummary struct {
+    Summary        string   `json:"summary"`
+    Strengths      []string `json:"strengths"`
+    Risks          []string `json:"risks"`
+    Recommendation string   `json:"recommendation"`
+}
+
+// parseStructuredSummary decodes a model response and validates it against
+// the schema of format
+func parseStructuredSummary(raw string, format summaryFormat) (StructuredSummary, error) {
+    var fields map[string]json.RawMessage
+    if err := json.Unmarshal([]byte(raw), &fields); err != nil {
+        return StructuredSummary{}, fmt.Errorf("response is not a JSON object: %v", err)
+    }
+
+    for _, field := range summaryFields {
+        if _, ok := fields[field.name]; !ok && format.includes(field.name) {
+            return StructuredSummary{}, fmt.Errorf("missing required field %q", field.name)
+        }
+    }
+
+    var summary StructuredSummary
+    dec := json.NewDecoder(bytes.NewReader([]byte(raw)))
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(&summary); err != nil {
+        return StructuredSummary{}, fmt.Errorf("response does not match schema: %v", err)
+    }
+
+    if summary.Summary == "" {
+        return StructuredSummary{}, errors.New(`field "summary" must not be empty`)
+    }
+    if summary.Recommendation == "" && format.includes("recommendation") {
+        return StructuredSummary{}, errors.New(`field "recommendation" must not be empty`)
+    }
+    // Fields the format left out stay empty even if the model added them
+    if !format.includes("strengths") {
+        summary.Strengths = nil
+    }
+    if !format.includes("risks") {
+        summary.Risks = nil
+    }
+    if !format.includes("recommendation") {
+        summary.Recommendation = ""
+    }
+    if summary.Strengths == nil {
+        summary.Strengths = []string{}
+    }
+    if summary.Risks == nil {
+        summary.Risks = []string{}
+    }
+    return summary, nil
+}
+
+// repairPrompt asks the model to fix a response that failed schema validation
+func repairPrompt(prompt, response string, cause error) string {
+    return prompt + "\n\nYour previous response was invalid: " + cause.Error() +
+        "\nPrevious response:\n" + response +
+        "\n\nReturn a corrected JSON object that matches the required fields exactly."
+}
+
+// generateStructured requests a schema-constrained summary in format,
+// retrying with a repair prompt up to maxRepairs times when the output fails
+// validation. onUsage is called for every attempt so token cost includes the
+// retries.
+func generateStructured(ctx context.Context, client textGenerator, prompt string, format summaryFormat, maxRepairs int, onUsage func(*OllamaResponse)) (StructuredSummary, error) {
+    prompt += format.instructions()
+    attemptPrompt := prompt
+    schema := format.schema()
+
+    var lastErr error
+    for attempt := 0; attempt <= maxRepairs; attempt++ {
+        resp, err := client.Generate(ctx, attemptPrompt, schema)
+        if err != nil {
+            return StructuredSummary{}, err
+        }
+        onUsage(resp)
+
+        summary, err := parseStructuredSummary(resp.Response, format)
+        if err == nil {
+            return summary, nil
+        }
+        lastErr = err
+        attemptPrompt = repairPrompt(prompt, resp.Response, err)
+    }
+    return StructuredSummary{}, fmt.Errorf("summary failed schema validation after %d attempts: %w", maxRepairs+1, lastErr)
+}
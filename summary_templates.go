@@ -0,0 +1,466 @@
+package main
+
+import (
+    "bytes"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "regexp"
+    "strings"
+    "sync"
+    "text/template"
+    "time"
+    "student-api/reqctx"
+)
+
+// CodeInvalidTemplate rejects a summary prompt that does not parse or run
+const CodeInvalidTemplate = "invalid_template"
+
+// tenantPromptVariant names the prompt of summaries made from a tenant's own
+// prompt, in place of the experiment's variant
+const tenantPromptVariant = "tenant"
+
+// Limits of a summary template
+const (
+    maxSummaryPromptLength = 4000
+    maxSummaryToneLength   = 64
+)
+
+// validSummaryLanguage accepts language names and tags such as French or pt-BR
+var validSummaryLanguage = regexp.MustCompile(`^\p{L}[\p{L}0-9 ()-]{0,34}$`)
+
+// sampleStudent is what a summary prompt is test-run with when it is saved
+var sampleStudent = Student{ID: 1, Name: "Ada Lovelace", Age: 20, Email: "ada@example.com"}
+
+var errSummaryTemplateNotFound = errors.New("summary template not found")
+
+// SummaryTemplate is a tenant's own summary style. Prompt replaces the
+// experiment's prompt variants with a text/template over the student's
+// fields ({{.Name}}, {{.Age}}, {{.Email}}); Fields limits the output to some
+// of summary, strengths, risks and recommendation; Tone and Language are
+// added to the prompt as instructions. Empty settings keep the defaults.
+type SummaryTemplate struct {
+    Tenant    string    `json:"tenant,omitempty"`
+    Prompt    string    `json:"prompt,omitempty"`
+    Fields    []string  `json:"fields,omitempty"`
+    Tone      string    `json:"tone,omitempty"`
+    Language  string    `json:"language,omitempty"`
+    Version   int       `json:"version"`
+    UpdatedAt time.Time `json:"updated_at"`
+    UpdatedBy string    `json:"updated_by"`
+}
+
+// SummaryTemplateRequest is the body of PUT /admin/summary-template
+type SummaryTemplateRequest struct {
+    Prompt   string   `json:"prompt,omitempty"`
+    Fields   []string `json:"fields,omitempty"`
+    Tone     string   `json:"tone,omitempty"`
+    Language string   `json:"language,omitempty"`
+}
+
+// Validate checks the request and test-runs its prompt on a sample student
+func (req SummaryTemplateRequest) Validate() []ValidationError {
+    var errors []ValidationError
+    if len(req.Prompt) > maxSummaryPromptLength {
+        errors = append(errors, ValidationError{Field: "prompt", Code: CodeOutOfRange,
+            Message: fmt.Sprintf("Prompt must be at most %d characters", maxSummaryPromptLength)})
+    } else if req.Prompt != "" {
+        if _, err := compileSummaryPrompt(req.Prompt); err != nil {
+            errors = append(errors, ValidationError{Field: "prompt", Code: CodeInvalidTemplate, Message: err.Error()})
+        }
+    }
+    if len(req.Fields) > 0 {
+        seen := make(map[string]bool)
+        for _, field := range req.Fields {
+            known := false
+            for _, f := range summaryFields {
+                known = known || f.name == field
+            }
+            if !known || seen[field] {
+                errors = append(errors, ValidationError{Field: "fields", Code: CodeOutOfRange,
+                    Message: "Fields must be distinct names among summary, strengths, risks and recommendation"})
+                break
+            }
+            seen[field] = true
+        }
+        if !seen["summary"] {
+            errors = append(errors, ValidationError{Field: "fields", Code: CodeRequired, Message: "Fields must include summary"})
+        }
+    }
+    if len(req.Tone) > maxSummaryToneLength || strings.ContainsAny(req.Tone, "\r\n") {
+        errors = append(errors, ValidationError{Field: "tone", Code: CodeOutOfRange,
+            Message: fmt.Sprintf("Tone must be one line of at most %d characters", maxSummaryToneLength)})
+    }
+    if req.Language != "" && !validSummaryLanguage.MatchString(req.Language) {
+        errors = append(errors, ValidationError{Field: "language", Code: CodeOutOfRange,
+            Message: "Language must be a language name or tag such as French or pt-BR"})
+    }
+    return errors
+}
+
+// compileSummaryPrompt parses a tenant prompt and runs it on sampleStudent,
+// so prompts naming unknown fields are refused when saved
+func compileSummaryPrompt(source string) (*template.Template, error) {
+    tmpl, err := template.New(tenantPromptVariant).Parse(source)
+    if err != nil {
+        return nil, fmt.Errorf("Prompt does not parse: %v", err)
+    }
+    if err := tmpl.Execute(io.Discard, sampleStudent); err != nil {
+        return nil, fmt.Errorf("Prompt fails on a sample student: %v", err)
+    }
+    return tmpl, nil
+}
+
+// SummaryTemplateRepository persists one summary template per tenant
+type SummaryTemplateRepository interface {
+    Get(tenant string) (SummaryTemplate, error)
+    // Put saves the tenant's template with the next version
+    Put(t SummaryTemplate) (SummaryTemplate, error)
+    Delete(tenant string) error
+}
+
+// MemorySummaryTemplateRepository keeps templates in memory, for
+// STORE_BACKEND=memory
+type MemorySummaryTemplateRepository struct {
+    sync.RWMutex
+    templates map[string]SummaryTemplate
+}
+
+// NewMemorySummaryTemplateRepository initializes a new MemorySummaryTemplateRepository
+func NewMemorySummaryTemplateRepository() *MemorySummaryTemplateRepository {
+    return &MemorySummaryTemplateRepository{templates: make(map[string]SummaryTemplate)}
+}
+
+func (m *MemorySummaryTemplateRepository) Get(tenant string) (SummaryTemplate, error) {
+    m.RLock()
+    defer m.RUnlock()
+    t, ok := m.templates[tenant]
+    if !ok {
+        return SummaryTemplate{}, errSummaryTemplateNotFound
+    }
+    return t, nil
+}
+
+func (m *MemorySummaryTemplateRepository) Put(t SummaryTemplate) (SummaryTemplate, error) {
+    m.Lock()
+    defer m.Unlock()
+    t.Version = m.templates[t.Tenant].Version + 1
+    m.templates[t.Tenant] = t
+    return t, nil
+}
+
+func (m *MemorySummaryTemplateRepository) Delete(tenant string) error {
+    m.Lock()
+    defer m.Unlock()
+    if _, ok := m.templates[tenant]; !ok {
+        return errSummaryTemplateNotFound
+    }
+    delete(m.templates, tenant)
+    return nil
+}
+
+// SQLSummaryTemplateRepository keeps templates in the summary_templates table
+type SQLSummaryTemplateRepository struct {
+    db     *sql.DB
+    rebind func(string) string
+}
+
+// NewSQLSummaryTemplateRepository creates a repository; rebind may be nil
+func NewSQLSummaryTemplateRepository(db *sql.DB, rebind func(string) string) *SQLSummaryTemplateRepository {
+    if rebind == nil {
+        rebind = func(q string) string { return q }
+    }
+    return &SQLSummaryTemplateRepository{db: db, rebind: rebind}
+}
+
+func (s *SQLSummaryTemplateRepository) Get(tenant string) (SummaryTemplate, error) {
+    t := SummaryTemplate{Tenant: tenant}
+    var fields, updated string
+    err := s.db.QueryRow(s.rebind(`SELECT prompt, fields, tone, language, version, updated_at, updated_by FROM summary_templates WHERE tenant = ?`), tenant).
+        Scan(&t.Prompt, &fields, &t.Tone, &t.Language, &t.Version, &updated, &t.UpdatedBy)
+    if errors.Is(err, sql.ErrNoRows) {
+        return SummaryTemplate{}, errSummaryTemplateNotFound
+    }
+    if err != nil {
+        return SummaryTemplate{}, err
+    }
+    if fields != "" {
+        t.Fields = strings.Split(fields, ",")
+    }
+    if t.UpdatedAt, err = time.Parse(time.RFC3339Nano, updated); err != nil {
+        return SummaryTemplate{}, err
+    }
+    return t, nil
+}
+
+func (s *SQLSummaryTemplateRepository) Put(t SummaryTemplate) (SummaryTemplate, error) {
+    tx, err := s.db.Begin()
+    if err != nil {
+        return SummaryTemplate{}, err
+    }
+    defer tx.Rollback()
+
+    fields, updated := strings.Join(t.Fields, ","), t.UpdatedAt.Format(time.RFC3339Nano)
+    result, err := tx.Exec(s.rebind(`UPDATE summary_templates SET prompt = ?, fields = ?, tone = ?, language = ?, version = version + 1, updated_at = ?, updated_by = ? WHERE tenant = ?`),
+        t.Prompt, fields, t.Tone, t.Language, updated, t.UpdatedBy, t.Tenant)
+    if err != nil {
+        return SummaryTemplate{}, err
+    }
+    if n, err := result.RowsAffected(); err != nil {
+        return SummaryTemplate{}, err
+    } else if n == 0 {
+        if _, err := tx.Exec(s.rebind(`INSERT INTO summary_templates (tenant, prompt, fields, tone, language, version, updated_at, updated_by) VALUES (?, ?, ?, ?, ?, 1, ?, ?)`),
+            t.Tenant, t.Prompt, fields, t.Tone, t.Language, updated, t.UpdatedBy); err != nil {
+            return SummaryTemplate{}, err
+        }
+    }
+    if err := tx.QueryRow(s.rebind(`SELECT version FROM summary_templates WHERE tenant = ?`), t.Tenant).Scan(&t.Version); err != nil {
+        return SummaryTemplate{}, err
+    }
+    return t, tx.Commit()
+}
+
+func (s *SQLSummaryTemplateRepository) Delete(tenant string) error {
+    result, err := s.db.Exec(s.rebind(`DELETE FROM summary_templates WHERE tenant = ?`), tenant)
+    if err != nil {
+        return err
+    }
+    if n, err := result.RowsAffected(); err == nil && n == 0 {
+        return errSummaryTemplateNotFound
+    }
+    return nil
+}
+
+// summaryPrompt is a tenant's template ready to use. A nil *summaryPrompt is
+// the default: the experiment's variant and every output field.
+type summaryPrompt struct {
+    SummaryTemplate
+    prompt *template.Template
+}
+
+// key tells summaries made from different revisions of a template apart in
+// caches; versions restart when a template is deleted, so it includes the
+// time of the change too
+func (p *summaryPrompt) key() string {
+    if p == nil {
+        return ""
+    }
+    return fmt.Sprintf(":t%d@%d", p.Version, p.UpdatedAt.UnixNano())
+}
+
+// format returns the output fields the template asks for
+func (p *summaryPrompt) format() summaryFormat {
+    if p == nil || len(p.Fields) == 0 {
+        return nil
+    }
+    return summaryFormat(p.Fields)
+}
+
+// render builds the summary prompt for a student, before the format
+// instructions, and names the prompt it came from
+func (p *summaryPrompt) render(variant *PromptVariant, student Student) (string, string, error) {
+    if p == nil || p.prompt == nil {
+        prompt, err := variant.Render(student)
+        if err != nil || p == nil {
+            return prompt, variant.Name, err
+        }
+        return prompt + p.instructions(), variant.Name, nil
+    }
+    var buf bytes.Buffer
+    if err := p.prompt.Execute(&buf, student); err != nil {
+        return "", "", err
+    }
+    return buf.String() + p.instructions(), tenantPromptVariant, nil
+}
+
+// instructions returns the tone and language the prompt asks for
+func (p *summaryPrompt) instructions() string {
+    var b strings.Builder
+    if p.Tone != "" {
+        fmt.Fprintf(&b, "\n\nWrite in a %s tone.", p.Tone)
+    }
+    if p.Language != "" {
+        if b.Len() == 0 {
+            b.WriteString("\n")
+        }
+        fmt.Fprintf(&b, "\nWrite every field in %s, keeping the JSON field names in English.", p.Language)
+    }
+    return b.String()
+}
+
+// SummaryTemplates resolves tenants to their summary template. Templates
+// are read on every summary, so a change applies at once on every
+// instance; compiled prompts are kept while the template is unchanged.
+type SummaryTemplates struct {
+    repo SummaryTemplateRepository
+
+    mu       sync.Mutex
+    compiled map[string]*summaryPrompt
+}
+
+// NewSummaryTemplates initializes a new SummaryTemplates
+func NewSummaryTemplates(repo SummaryTemplateRepository) *SummaryTemplates {
+    return &SummaryTemplates{repo: repo, compiled: make(map[string]*summaryPrompt)}
+}
+
+// For returns the tenant's template, or nil when it has none
+func (s *SummaryTemplates) For(tenant string) (*summaryPrompt, error) {
+    t, err := s.repo.Get(tenant)
+    if errors.Is(err, errSummaryTemplateNotFound) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    return s.compile(t)
+}
+
+func (s *SummaryTemplates) compile(t SummaryTemplate) (*summaryPrompt, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if p, ok := s.compiled[t.Tenant]; ok && p.Version == t.Version && p.UpdatedAt.Equal(t.UpdatedAt) {
+        return p, nil
+    }
+    p := &summaryPrompt{SummaryTemplate: t}
+    if t.Prompt != "" {
+        var err error
+        if p.prompt, err = compileSummaryPrompt(t.Prompt); err != nil {
+            return nil, fmt.Errorf("tenant %q summary template: %v", t.Tenant, err)
+        }
+    }
+    s.compiled[t.Tenant] = p
+    return p, nil
+}
+
+// GetSummaryTemplate returns the tenant's summary template:
+// GET /admin/summary-template
+func (app *App) GetSummaryTemplate(w http.ResponseWriter, r *http.Request) {
+    t, err := app.summaryTemplates.repo.Get(reqctx.Tenant(r.Context()))
+    if errors.Is(err, errSummaryTemplateNotFound) {
+        httpError(w, r, "No summary template; summaries use the default prompt", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        reqctx.Logger(r.Context()).Error("reading summary template failed", "error", err)
+        httpError(w, r, "Internal server error", http.StatusInternalServerError)
+        return
+    }
+    json.NewEncoder(w).Encode(t)
+}
+
+// PutSummaryTemplate sets the tenant's summary template:
+// PUT /admin/summary-template {"prompt": "...", "fields": ["summary"],
+// "tone": "warm", "language": "French"}. Summaries generated before are
+// not served again.
+func (app *App) PutSummaryTemplate(w http.ResponseWriter, r *http.Request) {
+    var req SummaryTemplateRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        httpError(w, r, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    req.Tone, req.Language = strings.TrimSpace(req.Tone), strings.TrimSpace(req.Language)
+    if errors := req.Validate(); len(errors) > 0 {
+        writeValidationErrors(w, r, errors)
+        return
+    }
+    by := reqctx.User(r.Context())
+    if by == "" {
+        by = "admin"
+    }
+    t, err := app.summaryTemplates.repo.Put(SummaryTemplate{
+        Tenant:    reqctx.Tenant(r.Context()),
+        Prompt:    req.Prompt,
+        Fields:    req.Fields,
+        Tone:      req.Tone,
+        Language:  req.Language,
+        UpdatedAt: time.Now().UTC(),
+        UpdatedBy: by,
+    })
+    if err != nil {
+        reqctx.Logger(r.Context()).Error("saving summary template failed", "error", err)
+        httpError(w, r, "Internal server error", http.StatusInternalServerError)
+        return
+    }
+    reqctx.Logger(r.Context()).Info("summary template saved", "version", t.Version)
+    json.NewEncoder(w).Encode(t)
+}
+
+// DeleteSummaryTemplate returns the tenant to the default summaries:
+// DELETE /admin/summary-template
+func (app *App) DeleteSummaryTemplate(w http.ResponseWriter, r *http.Request) {
+    err := app.summaryTemplates.repo.Delete(reqctx.Tenant(r.Context()))
+    if errors.Is(err, errSummaryTemplateNotFound) {
+        httpError(w, r, "No summary template; summaries use the default prompt", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        reqctx.Logger(r.Context()).Error("deleting summary template failed", "error", err)
+        httpError(w, r, "Internal server error", http.StatusInternalServerError)
+        return
+    }
+    reqctx.Logger(r.Context()).Info("summary template deleted")
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// SummaryTemplatePreview is the prompt and schema a summary would be
+// requested with
+type SummaryTemplatePreview struct {
+    Prompt  string          `json:"prompt"`
+    Variant string          `json:"variant"`
+    Schema  json.RawMessage `json:"schema"`
+}
+
+// PreviewSummaryTemplate renders the summary prompt for a student without
+// calling the model: POST /admin/summary-template/preview {"student_id": 1,
+// "template": {...}}, with the stored template when none is given
+func (app *App) PreviewSummaryTemplate(w http.ResponseWriter, r *http.Request) {
+    var body struct {
+        StudentID int                     `json:"student_id"`
+        Template  *SummaryTemplateRequest `json:"template"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+        httpError(w, r, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    student := sampleStudent
+    if body.StudentID != 0 {
+        var err error
+        if student, err = app.storeFor(r).Get(body.StudentID); err != nil {
+            writeStoreError(w, r, err)
+            return
+        }
+    }
+
+    var p *summaryPrompt
+    var err error
+    if body.Template != nil {
+        if errors := body.Template.Validate(); len(errors) > 0 {
+            writeValidationErrors(w, r, errors)
+            return
+        }
+        t := SummaryTemplate{Prompt: body.Template.Prompt, Fields: body.Template.Fields,
+            Tone: strings.TrimSpace(body.Template.Tone), Language: strings.TrimSpace(body.Template.Language)}
+        p = &summaryPrompt{SummaryTemplate: t}
+        if t.Prompt != "" {
+            p.prompt, _ = compileSummaryPrompt(t.Prompt)
+        }
+    } else if p, err = app.summaryTemplates.For(reqctx.Tenant(r.Context())); err != nil {
+        reqctx.Logger(r.Context()).Error("reading summary template failed", "error", err)
+        httpError(w, r, "Internal server error", http.StatusInternalServerError)
+        return
+    }
+
+    prompt, variant, err := p.render(app.prompts.VariantFor(student.ID), student)
+    if err != nil {
+        writeValidationErrors(w, r, []ValidationError{{Field: "prompt", Code: CodeInvalidTemplate, Message: err.Error()}})
+        return
+    }
+    json.NewEncoder(w).Encode(SummaryTemplatePreview{
+        Prompt:  prompt + p.format().instructions(),
+        Variant: variant,
+        Schema:  p.format().schema(),
+    })
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+    "archive/tar"
+    "bytes"
+    "compress/gzip"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "strconv"
+    "time"
+    "github.com/gorilla/mux"
+    "student-api/reqctx"
+)
+
+// snapshotFormatVersion is bumped whenever the snapshot layout changes
+const snapshotFormatVersion = 1
+
+// SnapshotFile describes one NDJSON file inside a snapshot archive
+type SnapshotFile struct {
+    Name    string `json:"name"`
+    Entity  string `json:"entity"`
+    Records int    `json:"records"`
+    Bytes   int    `json:"bytes"`
+    SHA256  string `json:"sha256"`
+}
+
+// SnapshotManifest is the first entry of a snapshot archive. Seq is the last
+// history sequence number included, so a client can continue from the change
+// feed after seq once the snapshot is loaded.
+type SnapshotManifest struct {
+    FormatVersion int            `json:"format_version"`
+    GeneratedAt   time.Time      `json:"generated_at"`
+    Seq           int            `json:"seq"`
+    Files         []SnapshotFile `json:"files"`
+}
+
+// Snapshot returns every student ordered by ID together with the history
+// sequence number they are consistent with
+func (s *StudentStore) Snapshot() ([]Student, int, error) {
+    s.RLock()
+    defer s.RUnlock()
+    seq, err := s.historyLocked().Last()
+    if err != nil {
+        return nil, 0, err
+    }
+    students, err := s.repo.List(liveOptions(ListOptions{}))
+    return students, seq, err
+}
+
+// encodeNDJSON writes one JSON document per line
+func encodeNDJSON(records []Student) ([]byte, error) {
+    var buf bytes.Buffer
+    enc := json.NewEncoder(&buf)
+    for _, record := range records {
+        if err := enc.Encode(record); err != nil {
+            return nil, err
+        }
+    }
+    return buf.Bytes(), nil
+}
+
+// buildSnapshot encodes students as NDJSON and describes them in a manifest
+func buildSnapshot(students []Student, seq int) (SnapshotManifest, []byte, error) {
+    data, err := encodeNDJSON(students)
+    if err != nil {
+        return SnapshotManifest{}, nil, err
+    }
+    sum := sha256.Sum256(data)
+    manifest := SnapshotManifest{
+        FormatVersion: snapshotFormatVersion,
+        GeneratedAt:   time.Now().UTC(),
+        Seq:           seq,
+        Files: []SnapshotFile{{
+            Name:    "students.ndjson",
+            Entity:  "students",
+            Records: len(students),
+            Bytes:   len(data),
+            SHA256:  hex.EncodeToString(sum[:]),
+        }},
+    }
+    return manifest, data, nil
+}
+
+// writeSnapshotArchive writes a gzip-compressed tar holding manifest.json
+// followed by students.ndjson
+func writeSnapshotArchive(w io.Writer, manifest SnapshotManifest, data []byte) error {
+    manifestData, err := json.MarshalIndent(manifest, "", "  ")
+    if err != nil {
+        return err
+    }
+
+    gz := gzip.NewWriter(w)
+    tw := tar.NewWriter(gz)
+    entries := []struct {
+        name string
+        data []byte
+    }{
+        {"manifest.json", manifestData},
+        {"students.ndjson", data},
+    }
+    for _, entry := range entries {
+        header := &tar.Header{
+            Name:    entry.name,
+            Mode:    0644,
+            Size:    int64(len(entry.data)),
+            ModTime: manifest.GeneratedAt,
+        }
+        if err := tw.WriteHeader(header); err != nil {
+            return err
+        }
+        if _, err := tw.Write(entry.data); err != nil {
+            return err
+        }
+    }
+    if err := tw.Close(); err != nil {
+        return err
+    }
+    return gz.Close()
+}
+
+// readSnapshotArchive reads an archive written by writeSnapshotArchive,
+// verifying every file against the manifest's size and checksum
+func readSnapshotArchive(r io.Reader) (SnapshotManifest, []Student, error) {
+    var manifest SnapshotManifest
+    gz, err := gzip.NewReader(r)
+    if err != nil {
+        return manifest, nil, err
+    }
+    defer gz.Close()
+
+    files := make(map[string][]byte)
+    tr := tar.NewReader(gz)
+    for {
+        header, err := tr.Next()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return manifest, nil, err
+        }
+        data, err := io.ReadAll(tr)
+        if err != nil {
+            return manifest, nil, err
+        }
+        files[header.Name] = data
+    }
+
+    manifestData, ok := files["manifest.json"]
+    if !ok {
+        return manifest, nil, errors.New("archive has no manifest.json")
+    }
+    if err := json.Unmarshal(manifestData, &manifest); err != nil {
+        return manifest, nil, fmt.Errorf("manifest.json: %v", err)
+    }
+    if manifest.FormatVersion != snapshotFormatVersion {
+        return manifest, nil, fmt.Errorf("unsupported snapshot format version %d", manifest.FormatVersion)
+    }
+
+    var students []Student
+    for _, file := range manifest.Files {
+        data, ok := files[file.Name]
+        if !ok {
+            return manifest, nil, fmt.Errorf("archive is missing %s", file.Name)
+        }
+        sum := sha256.Sum256(data)
+        if len(data) != file.Bytes || hex.EncodeToString(sum[:]) != file.SHA256 {
+            return manifest, nil, fmt.Errorf("%s does not match its manifest checksum", file.Name)
+        }
+        if file.Entity != "students" {
+            return manifest, nil, fmt.Errorf("unknown entity %q", file.Entity)
+        }
+        dec := json.NewDecoder(bytes.NewReader(data))
+        for dec.More() {
+            var student Student
+            if err := dec.Decode(&student); err != nil {
+                return manifest, nil, fmt.Errorf("%s: %v", file.Name, err)
+            }
+            students = append(students, student)
+        }
+        if len(students) != file.Records {
+            return manifest, nil, fmt.Errorf("%s has %d records, manifest says %d", file.Name, len(students), file.Records)
+        }
+    }
+    return manifest, students, nil
+}
+
+// GetSyncSnapshot serves a gzip-compressed tar archive holding manifest.json
+// followed by students.ndjson. Clients verify the file against the manifest
+// checksum before loading it.
+func (app *App) GetSyncSnapshot(w http.ResponseWriter, r *http.Request) {
+    store := app.storeFor(r)
+    students, seq, err := store.Snapshot()
+    if err != nil {
+        writeStoreError(w, r, err)
+        return
+    }
+    students = app.masker.Students(students)
+    manifest, data, err := buildSnapshot(students, seq)
+    if err != nil {
+        httpError(w, r, "Failed to encode snapshot", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/gzip")
+    w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="snapshot-%d.tar.gz"`, seq))
+    w.Header().Set("X-Snapshot-Seq", strconv.Itoa(seq))
+    if err := writeSnapshotArchive(w, manifest, data); err != nil {
+        reqctx.Logger(r.Context()).Error("writing sync snapshot failed", "error", err)
+    }
+}
+
+// Bounds for the number of checksum buckets a client may request
+const (
+    defaultChecksumBuckets = 256
+    maxChecksumBuckets     = 4096
+)
+
+// BucketChecksum is the hash of the records that fall into one bucket
+type BucketChecksum struct {
+    Bucket  int    `json:"bucket"`
+    Records int    `json:"records"`
+    SHA256  string `json:"sha256"`
+}
+
+// ChecksumReport lists per-bucket hashes and a root hash over all of them, so
+// a client first compares the root and only walks the buckets on a mismatch
+type ChecksumReport struct {
+    Seq     int              `json:"seq"`
+    Buckets int              `json:"buckets"`
+    Root    string           `json:"root"`
+    Items   []BucketChecksum `json:"items"`
+}
+
+// studentBucket assigns a student to a checksum bucket
+func studentBucket(id, buckets int) int {
+    return id % buckets
+}
+
+// bucketsFromRequest parses ?buckets=, defaulting to defaultChecksumBuckets
+func bucketsFromRequest(r *http.Request) (int, *ValidationError) {
+    value := r.URL.Query().Get("buckets")
+    if value == "" {
+        return defaultChecksumBuckets, nil
+    }
+    n, err := strconv.Atoi(value)
+    if err != nil || n < 1 || n > maxChecksumBuckets {
+        return 0, &ValidationError{
+            Field:   "buckets",
+            Code:    CodeOutOfRange,
+            Message: fmt.Sprintf("Buckets must be between 1 and %d", maxChecksumBuckets),
+        }
+    }
+    return n, nil
+}
+
+// checksumStudents hashes the students' NDJSON encoding; students must be ordered by ID
+func checksumStudents(students []Student) (string, error) {
+    data, err := encodeNDJSON(students)
+    if err != nil {
+        return "", err
+    }
+    sum := sha256.Sum256(data)
+    return hex.EncodeToString(sum[:]), nil
+}
+
+// GetSyncChecksums serves GET /sync/checksums?buckets=256. Every bucket is
+// listed, empty ones included, so clients can compare them index by index.
+func (app *App) GetSyncChecksums(w http.ResponseWriter, r *http.Request) {
+    store := app.storeFor(r)
+    buckets, verr := bucketsFromRequest(r)
+    if verr != nil {
+        writeValidationErrors(w, r, []ValidationError{*verr})
+        return
+    }
+
+    students, seq, err := store.Snapshot()
+    if err != nil {
+        writeStoreError(w, r, err)
+        return
+    }
+    students = app.masker.Students(students)
+    grouped := make([][]Student, buckets)
+    for _, student := range students {
+        b := studentBucket(student.ID, buckets)
+        grouped[b] = append(grouped[b], student)
+    }
+
+    report := ChecksumReport{Seq: seq, Buckets: buckets, Items: make([]BucketChecksum, buckets)}
+    root := sha256.New()
+    for b, members := range grouped {
+        sum, err := checksumStudents(members)
+        if err != nil {
+            httpError(w, r, "Failed to compute checksums", http.StatusInternalServerError)
+            return
+        }
+        report.Items[b] = BucketChecksum{Bucket: b, Records: len(members), SHA256: sum}
+        root.Write([]byte(sum))
+    }
+    report.Root = hex.EncodeToString(root.Sum(nil))
+
+    json.NewEncoder(w).Encode(report)
+}
+
+// GetSyncBucket returns the records in one bucket so a client can repair just
+// the buckets whose checksum differs: /sync/buckets/{bucket}?buckets=256
+func (app *App) GetSyncBucket(w http.ResponseWriter, r *http.Request) {
+    store := app.storeFor(r)
+    buckets, verr := bucketsFromRequest(r)
+    if verr != nil {
+        writeValidationErrors(w, r, []ValidationError{*verr})
+        return
+    }
+    bucket, err := strconv.Atoi(mux.Vars(r)["bucket"])
+    if err != nil || bucket < 0 || bucket >= buckets {
+        httpError(w, r, "Invalid bucket", http.StatusBadRequest)
+        return
+    }
+
+    students, seq, err := store.Snapshot()
+    if err != nil {
+        writeStoreError(w, r, err)
+        return
+    }
+    students = app.masker.Students(students)
+    members := make([]Student, 0)
+    for _, student := range students {
+        if studentBucket(student.ID, buckets) == bucket {
+            members = append(members, student)
+        }
+    }
+    sum, err := checksumStudents(members)
+    if err != nil {
+        httpError(w, r, "Failed to compute checksums", http.StatusInternalServerError)
+        return
+    }
+
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "seq":      seq,
+        "bucket":   bucket,
+        "buckets":  buckets,
+        "sha256":   sum,
+        "students": members,
+    })
+}
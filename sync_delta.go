@@ -0,0 +1,186 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+)
+
+// studentFields are the fields a sparse fieldset may select, in output order
+var studentFields = []string{"name", "age", "email"}
+
+// fieldValue returns one of a student's studentFields
+func fieldValue(s Student, field string) interface{} {
+    switch field {
+    case "name":
+        return s.Name
+    case "age":
+        return s.Age
+    default:
+        return s.Email
+    }
+}
+
+// DeltaResponse is the body of GET /sync/delta. Patch is a JSON merge patch
+// (RFC 7386) over a client's students keyed by ID: changed records carry only
+// their changed fields and deleted records are null. Versions holds, for
+// every patched field, the sequence number of its last change.
+type DeltaResponse struct {
+    Since    int                       `json:"since"`
+    Seq      int                       `json:"seq"`
+    Patch    map[string]interface{}    `json:"patch"`
+    Versions map[string]map[string]int `json:"versions"`
+}
+
+// studentDelta accumulates the changes to one student after a sequence number
+type studentDelta struct {
+    student Student
+    deleted bool
+    fields  map[string]int
+}
+
+// Delta returns the per-student changes recorded after since, and the
+// sequence number they are consistent with. ok is false when since lies
+// beyond the store's history, e.g. that of a memory store before a restart.
+func (s *StudentStore) Delta(since int) (deltas map[int]*studentDelta, seq int, ok bool, err error) {
+    s.RLock()
+    defer s.RUnlock()
+    history := s.historyLocked()
+    if seq, err = history.Last(); err != nil || since < 0 || since > seq {
+        return nil, seq, false, err
+    }
+    versions, err := history.Since(since)
+    if err != nil {
+        return nil, seq, false, err
+    }
+    deltas = make(map[int]*studentDelta)
+    for _, v := range versions {
+        seq = max(seq, v.Seq)
+        d := deltas[v.StudentID]
+        if d == nil {
+            d = &studentDelta{fields: make(map[string]int)}
+            deltas[v.StudentID] = d
+        }
+        d.student = v.Student
+        d.deleted = v.Operation == OpDelete
+        switch v.Operation {
+        case OpCreate, OpRestore:
+            for _, field := range studentFields {
+                d.fields[field] = v.Seq
+            }
+        case OpUpdate:
+            for field := range v.Changes {
+                d.fields[field] = v.Seq
+            }
+        case OpDelete:
+            d.fields = make(map[string]int)
+        }
+    }
+    return deltas, seq, true, nil
+}
+
+// fieldsFromRequest parses the ?fields= sparse fieldset, defaulting to every
+// field in studentFields
+func fieldsFromRequest(r *http.Request) ([]string, *ValidationError) {
+    input := r.URL.Query().Get("fields")
+    if strings.TrimSpace(input) == "" {
+        return studentFields, nil
+    }
+    var fields []string
+    for _, field := range strings.Split(input, ",") {
+        field = strings.TrimSpace(field)
+        if !containsString(studentFields, field) {
+            return nil, &ValidationError{
+                Field:   "fields",
+                Code:    CodeOutOfRange,
+                Message: fmt.Sprintf("Unknown field %q; use %s", field, strings.Join(studentFields, ", ")),
+            }
+        }
+        if !containsString(fields, field) {
+            fields = append(fields, field)
+        }
+    }
+    return fields, nil
+}
+
+// deltaETag is the entity tag of the delta state at seq
+func deltaETag(seq int) string {
+    return `"` + strconv.Itoa(seq) + `"`
+}
+
+// sinceFromRequest reads ?since=, falling back to the sequence number in an
+// If-None-Match header so clients can simply replay the last ETag
+func sinceFromRequest(r *http.Request) (int, bool) {
+    value := r.URL.Query().Get("since")
+    if value == "" {
+        value = strings.Trim(strings.TrimPrefix(r.Header.Get("If-None-Match"), "W/"), `"`)
+    }
+    if value == "" {
+        return 0, true
+    }
+    n, err := strconv.Atoi(value)
+    return n, err == nil && n >= 0
+}
+
+// GetSyncDelta serves GET /sync/delta?since=42&fields=name,email, returning
+// only the fields changed since the client's last sync. It answers 304 when
+// If-None-Match names the current sequence number and 410 when since is
+// unknown, in which case the client reloads /sync/snapshot.
+func (app *App) GetSyncDelta(w http.ResponseWriter, r *http.Request) {
+    store := app.storeFor(r)
+    fields, verr := fieldsFromRequest(r)
+    if verr != nil {
+        writeValidationErrors(w, r, []ValidationError{*verr})
+        return
+    }
+    since, valid := sinceFromRequest(r)
+    if !valid {
+        httpError(w, r, "Invalid since sequence number", http.StatusBadRequest)
+        return
+    }
+
+    deltas, seq, ok, err := store.Delta(since)
+    if err != nil {
+        writeStoreError(w, r, err)
+        return
+    }
+    if !ok {
+        httpError(w, r, "Sequence number is not in the change history; reload /sync/snapshot", http.StatusGone)
+        return
+    }
+    etag := deltaETag(seq)
+    w.Header().Set("ETag", etag)
+    if match := r.Header.Get("If-None-Match"); match == etag || match == "W/"+etag {
+        w.WriteHeader(http.StatusNotModified)
+        return
+    }
+
+    resp := DeltaResponse{
+        Since:    since,
+        Seq:      seq,
+        Patch:    make(map[string]interface{}),
+        Versions: make(map[string]map[string]int),
+    }
+    for id, d := range deltas {
+        key := strconv.Itoa(id)
+        if d.deleted {
+            resp.Patch[key] = nil
+            continue
+        }
+        patch := make(map[string]interface{})
+        versions := make(map[string]int)
+        for _, field := range fields {
+            if changed, ok := d.fields[field]; ok {
+                patch[field] = fieldValue(d.student, field)
+                versions[field] = changed
+            }
+        }
+        if len(patch) > 0 {
+            resp.Patch[key] = patch
+            resp.Versions[key] = versions
+        }
+    }
+    json.NewEncoder(w).Encode(resp)
+}
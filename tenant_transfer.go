@@ -0,0 +1,189 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strconv"
+    "time"
+    "github.com/gorilla/mux"
+    "student-api/reqctx"
+)
+
+// defaultTenant names the shared store when tenants do not have their own databases
+const defaultTenant = "default"
+
+// maxTenantArchive caps the size of an uploaded tenant archive
+const maxTenantArchive = 256 << 20
+
+// TenantImportReport describes the outcome of a tenant import. IDMap maps
+// the source deployment's IDs to the IDs assigned here; Mismatches lists
+// records whose stored values differ from the archive after import.
+type TenantImportReport struct {
+    Tenant          string                 `json:"tenant"`
+    SourceSeq       int                    `json:"source_seq"`
+    SourceCreatedAt string                 `json:"source_generated_at"`
+    ChecksumsOK     bool                   `json:"checksums_ok"`
+    Expected        int                    `json:"expected"`
+    Imported        int                    `json:"imported"`
+    IDMap           map[int]int            `json:"id_map"`
+    Mismatches      []TenantRecordMismatch `json:"mismatches"`
+    Verified        bool                   `json:"verified"`
+}
+
+// TenantRecordMismatch is a record that did not round-trip
+type TenantRecordMismatch struct {
+    SourceID int                    `json:"source_id"`
+    ID       int                    `json:"id"`
+    Changes  map[string]FieldChange `json:"changes,omitempty"`
+    Missing  bool                   `json:"missing,omitempty"`
+}
+
+// tenantStore returns the store holding a tenant's data, with the release
+// func of TenantStores.Store. Without per-tenant databases only the default
+// tenant exists.
+func (app *App) tenantStore(tenant string) (*StudentStore, func(), error) {
+    if app.tenants == nil {
+        if tenant != defaultTenant {
+            return nil, nil, fmt.Errorf("tenant %q not found; only %q exists in shared mode", tenant, defaultTenant)
+        }
+        return app.store, func() {}, nil
+    }
+    if !validTenantID.MatchString(tenant) {
+        return nil, nil, fmt.Errorf("invalid tenant ID %q", tenant)
+    }
+    return app.tenants.Store(tenant)
+}
+
+// ImportStudents inserts students under new IDs and returns the mapping
+// from their original IDs, with the versions recorded for them
+func (s *StudentStore) ImportStudents(students []Student) (map[int]int, []StudentVersion, error) {
+    s.Lock()
+    defer s.Unlock()
+    ids := make(map[int]int, len(students))
+    versions := make([]StudentVersion, 0, len(students))
+    for _, student := range students {
+        sourceID := student.ID
+        stored, version, err := s.insertLocked(student)
+        if err != nil {
+            return ids, versions, err
+        }
+        ids[sourceID] = stored.ID
+        versions = append(versions, version)
+    }
+    return ids, versions, nil
+}
+
+// ProvisionTenant creates a tenant's database in database mode: PUT
+// /admin/tenants/{tenant}. It answers 201 when the tenant was created and
+// 200 when it existed; requests for other tenants get 404.
+func (app *App) ProvisionTenant(w http.ResponseWriter, r *http.Request) {
+    tenant := mux.Vars(r)["tenant"]
+    if app.tenants == nil {
+        httpError(w, r, "Tenants only get their own databases with TENANT_MODE=database", http.StatusNotImplemented)
+        return
+    }
+    if !validTenantID.MatchString(tenant) {
+        httpError(w, r, fmt.Sprintf("Invalid tenant ID %q", tenant), http.StatusBadRequest)
+        return
+    }
+    created, err := app.tenants.Provision(tenant)
+    if err != nil {
+        reqctx.Logger(r.Context()).Error("provisioning tenant failed", "tenant", tenant, "error", err)
+        httpError(w, r, "Tenant database unavailable", http.StatusServiceUnavailable)
+        return
+    }
+    if created {
+        reqctx.Logger(r.Context()).Info("tenant provisioned", "tenant", tenant)
+        w.WriteHeader(http.StatusCreated)
+    }
+    json.NewEncoder(w).Encode(tenantProvision{Tenant: tenant, Created: created})
+}
+
+// tenantProvision is the response of PUT /admin/tenants/{tenant}
+type tenantProvision struct {
+    Tenant  string `json:"tenant"`
+    Created bool   `json:"created"`
+}
+
+// ExportTenant serves the tenant's full data set in the snapshot archive
+// format: GET /admin/tenants/{tenant}/export
+func (app *App) ExportTenant(w http.ResponseWriter, r *http.Request) {
+    tenant := mux.Vars(r)["tenant"]
+    store, release, err := app.tenantStore(tenant)
+    if err != nil {
+        httpError(w, r, err.Error(), http.StatusNotFound)
+        return
+    }
+    defer release()
+
+    students, seq, err := store.Snapshot()
+    if err != nil {
+        writeStoreError(w, r, err)
+        return
+    }
+    students = app.masker.Students(students)
+    manifest, data, err := buildSnapshot(students, seq)
+    if err != nil {
+        httpError(w, r, "Failed to encode tenant export", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/gzip")
+    w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="tenant-%s-%d.tar.gz"`, tenant, seq))
+    if err := writeSnapshotArchive(w, manifest, data); err != nil {
+        reqctx.Logger(r.Context()).Error("tenant export failed", "tenant", tenant, "error", err)
+    }
+}
+
+// ImportTenant loads an archive produced by ExportTenant into a tenant,
+// assigning fresh IDs, and returns a verification report:
+// POST /admin/tenants/{tenant}/import with the archive as the body
+func (app *App) ImportTenant(w http.ResponseWriter, r *http.Request) {
+    tenant := mux.Vars(r)["tenant"]
+    store, release, err := app.tenantStore(tenant)
+    if err != nil {
+        httpError(w, r, err.Error(), http.StatusNotFound)
+        return
+    }
+    defer release()
+
+    manifest, students, err := readSnapshotArchive(http.MaxBytesReader(w, r.Body, maxTenantArchive))
+    if err != nil {
+        httpError(w, r, "Invalid tenant archive: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    ids, versions, err := store.ImportStudents(students)
+    app.recordTenantChanges(r, tenant, versions...)
+    if err != nil {
+        writeStoreError(w, r, err)
+        return
+    }
+
+    report := TenantImportReport{
+        Tenant:          tenant,
+        SourceSeq:       manifest.Seq,
+        SourceCreatedAt: manifest.GeneratedAt.Format(time.RFC3339),
+        ChecksumsOK:     true,
+        Expected:        len(students),
+        IDMap:           ids,
+        Mismatches:      []TenantRecordMismatch{},
+    }
+    for _, source := range students {
+        id := ids[source.ID]
+        stored, err := store.Get(id)
+        if err != nil {
+            report.Mismatches = append(report.Mismatches, TenantRecordMismatch{SourceID: source.ID, ID: id, Missing: true})
+            continue
+        }
+        report.Imported++
+        if changes := diffStudents(source, stored); len(changes) > 0 {
+            report.Mismatches = append(report.Mismatches, TenantRecordMismatch{SourceID: source.ID, ID: id, Changes: changes})
+        }
+    }
+    report.Verified = report.Imported == report.Expected && len(report.Mismatches) == 0
+
+    w.Header().Set("X-Import-Verified", strconv.FormatBool(report.Verified))
+    json.NewEncoder(w).Encode(report)
+}
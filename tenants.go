@@ -0,0 +1,393 @@
+package main
+
+import (
+    "container/list"
+    "context"
+    "database/sql"
+    "errors"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strings"
+    "sync"
+    "github.com/gorilla/mux"
+    "student-api/reqctx"
+)
+
+// Tenant modes selected by TENANT_MODE
+const (
+    // TenantShared keeps every tenant in the one shared database
+    TenantShared = "shared"
+    // TenantDatabase gives each tenant its own SQLite file
+    TenantDatabase = "database"
+)
+
+// validTenantID keeps tenant IDs safe to use in file names
+var validTenantID = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// errTenantNotFound is returned for a tenant that is neither registered nor
+// provisioned
+var errTenantNotFound = errors.New("tenant not found")
+
+// tenantEntry is an open tenant store and its database. refs counts the
+// callers holding the store; an entry is only closed once it drops to zero.
+type tenantEntry struct {
+    tenant string
+    store  *StudentStore
+    db     *sql.DB
+    lru    *list.Element
+    refs   int
+}
+
+// TenantStores resolves tenants to their own store and SQLite database. DSNs
+// come from an explicit registry or a path template containing "{tenant}".
+// Only registered tenants and those whose database file exists are served;
+// others are created by Provision, so requests cannot create databases.
+// Databases are opened lazily, migrated on open and closed again in
+// least-recently-used order once more than maxOpen are open and no request
+// holds them, so more may stay open while all are in use. A closed tenant's
+// data and history stay on disk.
+type TenantStores struct {
+    mu       sync.Mutex
+    registry map[string]string
+    template string
+    maxOpen  int
+    events   *EventBus
+    // outbox is attached to each store as it is opened, when set
+    outbox  *EventOutbox
+    entries map[string]*tenantEntry
+    open    *list.List // of *tenantEntry, most recently used first
+}
+
+// NewTenantStores initializes a new TenantStores
+func NewTenantStores(registry map[string]string, template string, maxOpen int, events *EventBus) *TenantStores {
+    if maxOpen < 1 {
+        maxOpen = 1
+    }
+    return &TenantStores{
+        registry: registry,
+        template: template,
+        maxOpen:  maxOpen,
+        events:   events,
+        entries:  make(map[string]*tenantEntry),
+        open:     list.New(),
+    }
+}
+
+// LoadTenantStores reads TENANT_MODE, TENANT_DSNS ("a=./a.db,b=./b.db"),
+// TENANT_DB_PATH and TENANT_MAX_OPEN; it returns nil in shared mode
+func LoadTenantStores(events *EventBus) (*TenantStores, error) {
+    switch mode := getEnv("TENANT_MODE", TenantShared); mode {
+    case TenantShared:
+        return nil, nil
+    case TenantDatabase:
+    default:
+        return nil, fmt.Errorf("unknown tenant mode %q", mode)
+    }
+
+    registry := make(map[string]string)
+    for _, item := range getEnvList("TENANT_DSNS") {
+        tenant, dsn, ok := strings.Cut(item, "=")
+        if !ok || !validTenantID.MatchString(tenant) || dsn == "" {
+            return nil, fmt.Errorf("tenant DSN %q: expected tenant=dsn", item)
+        }
+        registry[tenant] = dsn
+    }
+    template := getEnv("TENANT_DB_PATH", "./tenants/{tenant}.db")
+    if !strings.Contains(template, "{tenant}") {
+        return nil, fmt.Errorf("TENANT_DB_PATH %q must contain {tenant}", template)
+    }
+    return NewTenantStores(registry, template, getEnvInt("TENANT_MAX_OPEN", 16), events), nil
+}
+
+// dsnFor returns the registered DSN for a tenant or fills in the path template
+func (t *TenantStores) dsnFor(tenant string) string {
+    if dsn, ok := t.registry[tenant]; ok {
+        return dsn
+    }
+    return strings.ReplaceAll(t.template, "{tenant}", tenant)
+}
+
+// existsLocked reports whether a tenant is registered, open or has a
+// database file at its templated path. The caller must hold t.mu.
+func (t *TenantStores) existsLocked(tenant string) (bool, error) {
+    if _, ok := t.registry[tenant]; ok {
+        return true, nil
+    }
+    if _, ok := t.entries[tenant]; ok {
+        return true, nil
+    }
+    _, err := os.Stat(t.dsnFor(tenant))
+    if errors.Is(err, os.ErrNotExist) {
+        return false, nil
+    }
+    return err == nil, err
+}
+
+// openDB opens and migrates a tenant database, creating its directory if needed
+func (t *TenantStores) openDB(tenant string) (*sql.DB, error) {
+    dsn := t.dsnFor(tenant)
+    if dir := filepath.Dir(dsn); dir != "." {
+        if err := os.MkdirAll(dir, 0755); err != nil {
+            return nil, err
+        }
+    }
+    db, err := sql.Open("sqlite3", sqliteDSN(dsn))
+    if err != nil {
+        return nil, err
+    }
+    if err := migrateDB(db); err != nil {
+        db.Close()
+        return nil, fmt.Errorf("tenant %s: %v", tenant, err)
+    }
+    return db, nil
+}
+
+// Store returns the tenant's store, opening its database if it is not open,
+// or errTenantNotFound. The store stays open until release is called, which
+// must happen once the caller is done with it.
+func (t *TenantStores) Store(tenant string) (store *StudentStore, release func(), err error) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if exists, err := t.existsLocked(tenant); err != nil || !exists {
+        if err == nil {
+            err = errTenantNotFound
+        }
+        return nil, nil, err
+    }
+    return t.storeLocked(tenant)
+}
+
+// Provision creates and migrates a tenant's database unless the tenant
+// exists already, reporting whether it was created
+func (t *TenantStores) Provision(tenant string) (created bool, err error) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    exists, err := t.existsLocked(tenant)
+    if err != nil || exists {
+        return false, err
+    }
+    if _, _, err := t.storeLocked(tenant); err != nil {
+        return false, err
+    }
+    // Left open but idle, as if released
+    t.entries[tenant].refs--
+    t.trimLocked()
+    return true, nil
+}
+
+// storeLocked is Store for a tenant known to exist. The caller must hold
+// t.mu.
+func (t *TenantStores) storeLocked(tenant string) (store *StudentStore, release func(), err error) {
+    entry, exists := t.entries[tenant]
+    if exists {
+        t.open.MoveToFront(entry.lru)
+    } else {
+        db, err := t.openDB(tenant)
+        if err != nil {
+            return nil, nil, err
+        }
+        repo, err := NewSQLiteRepository(db)
+        if err != nil {
+            db.Close()
+            return nil, nil, fmt.Errorf("tenant %s: %v", tenant, err)
+        }
+        store := NewStudentStore(repo, t.events)
+        store.tenant, store.outbox = tenant, t.outbox
+        entry = &tenantEntry{tenant: tenant, store: store, db: db}
+        entry.lru = t.open.PushFront(entry)
+        t.entries[tenant] = entry
+    }
+    entry.refs++
+    t.trimLocked()
+    return entry.store, t.releaser(entry), nil
+}
+
+// releaser returns the release func of one reference to entry
+func (t *TenantStores) releaser(entry *tenantEntry) func() {
+    var once sync.Once
+    return func() {
+        once.Do(func() {
+            t.mu.Lock()
+            defer t.mu.Unlock()
+            entry.refs--
+            t.trimLocked()
+        })
+    }
+}
+
+// trimLocked closes the least recently used idle tenants while more than
+// maxOpen are open. The caller must hold t.mu.
+func (t *TenantStores) trimLocked() {
+    for e := t.open.Back(); e != nil && t.open.Len() > t.maxOpen; {
+        entry := e.Value.(*tenantEntry)
+        e = e.Prev()
+        if entry.refs == 0 {
+            t.evictLocked(entry)
+        }
+    }
+}
+
+// evictLocked closes a tenant's store and database; they are reopened on
+// next use. The caller must hold t.mu and, but for Close, the entry must be
+// idle.
+func (t *TenantStores) evictLocked(entry *tenantEntry) {
+    t.open.Remove(entry.lru)
+    delete(t.entries, entry.tenant)
+
+    // Wait for in-flight writes before closing the database under them
+    entry.store.Lock()
+    entry.store.Close()
+    entry.store.Unlock()
+    if err := entry.db.Close(); err != nil {
+        slog.Error("closing tenant database failed", "tenant", entry.tenant, "error", err)
+    }
+}
+
+// Open returns the stores of the tenants whose databases are open, held
+// open until release is called; it is safe on a nil TenantStores
+func (t *TenantStores) Open() (stores []*StudentStore, release func()) {
+    if t == nil {
+        return nil, func() {}
+    }
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    releases := make([]func(), 0, t.open.Len())
+    for e := t.open.Front(); e != nil; e = e.Next() {
+        entry := e.Value.(*tenantEntry)
+        entry.refs++
+        stores = append(stores, entry.store)
+        releases = append(releases, t.releaser(entry))
+    }
+    return stores, func() {
+        for _, release := range releases {
+            release()
+        }
+    }
+}
+
+// Close closes every open tenant database, in use or not; it runs at
+// shutdown once requests have drained
+func (t *TenantStores) Close() {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    for t.open.Len() > 0 {
+        t.evictLocked(t.open.Front().Value.(*tenantEntry))
+    }
+}
+
+// routeTemplate returns the path template of the matched route, or ""
+func routeTemplate(r *http.Request) string {
+    if route := mux.CurrentRoute(r); route != nil {
+        if template, err := route.GetPathTemplate(); err == nil {
+            return template
+        }
+    }
+    return ""
+}
+
+type tenantStoreKey struct{}
+
+// storeFor returns the store serving the request: the tenant's own store in
+// database mode, otherwise the shared store
+func (app *App) storeFor(r *http.Request) *StudentStore {
+    if store, ok := r.Context().Value(tenantStoreKey{}).(*StudentStore); ok {
+        return store
+    }
+    return app.store
+}
+
+// tenantFreeRoutes are operational routes served without a tenant
+var tenantFreeRoutes = map[string]bool{
+    "/healthz":        true,
+    "/readyz":         true,
+    "/metrics":        true,
+    "/version":        true,
+    "/openapi.json":   true,
+    "/docs":           true,
+    "/docs/{file}":    true,
+    "/admin/loglevel": true,
+    "/auth/login":     true,
+    "/auth/refresh":   true,
+    "/llm/quota":      true,
+
+    "/auth/register":                         true,
+    "/auth/password":                         true,
+    "/auth/password-reset":                   true,
+    "/auth/password-reset/confirm":           true,
+    "/invitations/lookup":                    true,
+    "/invitations/redeem":                    true,
+    "/admin/users":                           true,
+    "/admin/users/{username}/unlock":         true,
+    "/admin/users/{username}/password-reset": true,
+
+    "/admin/tenants/{tenant}":        true,
+    "/admin/tenants/{tenant}/export": true,
+    "/admin/tenants/{tenant}/import": true,
+    "/admin/api-keys":                true,
+    "/admin/api-keys/{id}":           true,
+    "/admin/reports/query":           true,
+    "/admin/reports":                 true,
+    "/admin/reports/{name}":          true,
+    "/admin/reports/{name}/run":      true,
+    "/admin/reports/{name}/runs":     true,
+}
+
+// bindTenant serves a request as a principal bound to tenant, the empty
+// default tenant included: an X-Tenant-ID header naming another tenant is
+// refused with 403, and without the header the request takes the
+// principal's tenant. Admins bound to no tenant act for whichever tenant
+// the header names. It reports false once it has answered the request.
+func bindTenant(w http.ResponseWriter, r *http.Request, role, tenant string) (*http.Request, bool) {
+    if tenant == "" && role == RoleAdmin {
+        return r, true
+    }
+    if requested := reqctx.Tenant(r.Context()); requested != "" && requested != tenant {
+        reqctx.Logger(r.Context()).Warn("tenant denied", "principal_tenant", tenant)
+        httpError(w, r, fmt.Sprintf("Credentials are not valid for tenant %s", requested), http.StatusForbidden)
+        return nil, false
+    }
+    ctx := context.WithValue(reqctx.WithTenant(r.Context(), tenant), boundTenantKey{}, tenant)
+    return r.WithContext(ctx), true
+}
+
+type boundTenantKey struct{}
+
+// boundTenant returns the tenant bindTenant bound the request's principal
+// to, and false for unbound admins and anonymous requests
+func boundTenant(ctx context.Context) (string, bool) {
+    tenant, ok := ctx.Value(boundTenantKey{}).(string)
+    return tenant, ok
+}
+
+// tenancy resolves the request's tenant, the authenticated principal's or
+// else the X-Tenant-ID header, to its store in database mode. Requests
+// without a valid tenant are rejected there.
+func (app *App) tenancy(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if app.tenants == nil || tenantFreeRoutes[routeTemplate(r)] {
+            next.ServeHTTP(w, r)
+            return
+        }
+        tenant := reqctx.Tenant(r.Context())
+        if !validTenantID.MatchString(tenant) {
+            httpError(w, r, "A valid X-Tenant-ID header or credentials bound to a tenant are required", http.StatusBadRequest)
+            return
+        }
+        store, release, err := app.tenants.Store(tenant)
+        if errors.Is(err, errTenantNotFound) {
+            httpError(w, r, "Tenant not found", http.StatusNotFound)
+            return
+        }
+        if err != nil {
+            reqctx.Logger(r.Context()).Error("opening tenant database failed", "error", err)
+            httpError(w, r, "Tenant database unavailable", http.StatusServiceUnavailable)
+            return
+        }
+        defer release()
+        next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantStoreKey{}, store)))
+    })
+}
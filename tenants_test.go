@@ -0,0 +1,65 @@
+package main
+
+import (
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "testing"
+    "student-api/reqctx"
+)
+
+func TestTenantStoresRefuseUnknownTenants(t *testing.T) {
+    dir := t.TempDir()
+    tenants := NewTenantStores(nil, filepath.Join(dir, "{tenant}.db"), 4, NewEventBus())
+    t.Cleanup(tenants.Close)
+
+    if _, _, err := tenants.Store("acme"); !errors.Is(err, errTenantNotFound) {
+        t.Fatalf("Store of an unknown tenant: %v, want errTenantNotFound", err)
+    }
+    if entries, _ := os.ReadDir(dir); len(entries) > 0 {
+        t.Fatalf("Store created %s for an unknown tenant", entries[0].Name())
+    }
+
+    for _, want := range []bool{true, false} {
+        created, err := tenants.Provision("acme")
+        if err != nil || created != want {
+            t.Fatalf("Provision = %t, %v, want %t", created, err, want)
+        }
+    }
+    _, release, err := tenants.Store("acme")
+    if err != nil {
+        t.Fatalf("Store of a provisioned tenant: %v", err)
+    }
+    release()
+}
+
+func TestBindTenant(t *testing.T) {
+    tests := []struct {
+        name, role, principal, header string
+        status                        int
+        tenant                        string
+    }{
+        {"bound, no header", RoleTeacher, "acme", "", http.StatusOK, "acme"},
+        {"bound, same header", RoleTeacher, "acme", "acme", http.StatusOK, "acme"},
+        {"bound, other header", RoleTeacher, "acme", "other", http.StatusForbidden, ""},
+        {"bound admin, other header", RoleAdmin, "acme", "other", http.StatusForbidden, ""},
+        {"unbound, no header", RoleReadonly, "", "", http.StatusOK, ""},
+        {"unbound, header", RoleReadonly, "", "acme", http.StatusForbidden, ""},
+        {"unbound admin, header", RoleAdmin, "", "acme", http.StatusOK, "acme"},
+    }
+    for _, tt := range tests {
+        r := httptest.NewRequest(http.MethodGet, "/students", nil)
+        r = r.WithContext(reqctx.WithTenant(r.Context(), tt.header))
+        rec := httptest.NewRecorder()
+        bound, ok := bindTenant(rec, r, tt.role, tt.principal)
+        if ok != (tt.status == http.StatusOK) || rec.Code != tt.status {
+            t.Errorf("%s: ok %t, status %d, want %d", tt.name, ok, rec.Code, tt.status)
+            continue
+        }
+        if ok && reqctx.Tenant(bound.Context()) != tt.tenant {
+            t.Errorf("%s: tenant %q, want %q", tt.name, reqctx.Tenant(bound.Context()), tt.tenant)
+        }
+    }
+}
@@ -0,0 +1,136 @@
+package testkit
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+// GoldenDir holds golden files, relative to the package under test
+var GoldenDir = filepath.Join("testdata", "golden")
+
+// Scrubbed replaces the values of scrubbed JSON keys in golden output
+const Scrubbed = "<scrubbed>"
+
+// DefaultScrub lists the keys whose values change from run to run
+var DefaultScrub = []string{"updated_at", "at", "elapsed", "generated_at", "applied_at"}
+
+// updateGolden reports whether the tests run with UPDATE_GOLDEN=1, which
+// rewrites golden files instead of comparing against them
+func updateGolden() bool {
+    return os.Getenv("UPDATE_GOLDEN") == "1"
+}
+
+// Do serves one request through handler and returns the recorded response.
+// A non-nil body is sent as JSON.
+func Do(t testing.TB, handler http.Handler, method, path string, body []byte) *httptest.ResponseRecorder {
+    t.Helper()
+    req := httptest.NewRequest(method, path, bytes.NewReader(body))
+    if body != nil {
+        req.Header.Set("Content-Type", "application/json")
+    }
+    rec := httptest.NewRecorder()
+    handler.ServeHTTP(rec, req)
+    return rec
+}
+
+// AssertGolden compares a response with the golden file GoldenDir/name.golden,
+// which records its status line and normalized body. JSON bodies are
+// indented with sorted keys, and the values of scrub keys are replaced with
+// Scrubbed at any depth; DefaultScrub applies when no keys are given.
+func AssertGolden(t testing.TB, name string, rec *httptest.ResponseRecorder, scrub ...string) {
+    t.Helper()
+    if len(scrub) == 0 {
+        scrub = DefaultScrub
+    }
+    got := fmt.Sprintf("%d %s\n\n", rec.Code, http.StatusText(rec.Code))
+    AssertGoldenBytes(t, name, append([]byte(got), NormalizeJSON(rec.Body.Bytes(), scrub...)...))
+}
+
+// AssertGoldenBytes compares output with the golden file GoldenDir/name.golden
+func AssertGoldenBytes(t testing.TB, name string, got []byte) {
+    t.Helper()
+    path := filepath.Join(GoldenDir, name+".golden")
+    if updateGolden() {
+        if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+            t.Fatal(err)
+        }
+        if err := os.WriteFile(path, got, 0644); err != nil {
+            t.Fatal(err)
+        }
+        return
+    }
+    want, err := os.ReadFile(path)
+    if os.IsNotExist(err) {
+        t.Fatalf("golden file %s does not exist; run the tests with UPDATE_GOLDEN=1 to create it", path)
+    }
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(got, want) {
+        t.Errorf("output differs from %s (run with UPDATE_GOLDEN=1 to accept it):\n%s", path, lineDiff(string(want), string(got)))
+    }
+}
+
+// NormalizeJSON indents a JSON document with sorted keys and scrubs the
+// given keys. Anything that is not JSON is returned unchanged.
+func NormalizeJSON(data []byte, scrub ...string) []byte {
+    var doc interface{}
+    if err := json.Unmarshal(data, &doc); err != nil {
+        return data
+    }
+    scrubbed := make(map[string]bool, len(scrub))
+    for _, key := range scrub {
+        scrubbed[key] = true
+    }
+    var out bytes.Buffer
+    enc := json.NewEncoder(&out)
+    enc.SetEscapeHTML(false)
+    enc.SetIndent("", "  ")
+    if err := enc.Encode(scrubValue(doc, scrubbed)); err != nil {
+        return data
+    }
+    return out.Bytes()
+}
+
+func scrubValue(v interface{}, scrubbed map[string]bool) interface{} {
+    switch v := v.(type) {
+    case map[string]interface{}:
+        for key, value := range v {
+            if scrubbed[key] && value != nil {
+                v[key] = Scrubbed
+            } else {
+                v[key] = scrubValue(value, scrubbed)
+            }
+        }
+    case []interface{}:
+        for i, value := range v {
+            v[i] = scrubValue(value, scrubbed)
+        }
+    }
+    return v
+}
+
+// lineDiff lists the lines of want and got from the first one that differs
+func lineDiff(want, got string) string {
+    wantLines, gotLines := strings.Split(want, "\n"), strings.Split(got, "\n")
+    first := 0
+    for first < len(wantLines) && first < len(gotLines) && wantLines[first] == gotLines[first] {
+        first++
+    }
+    var b strings.Builder
+    fmt.Fprintf(&b, "first difference at line %d\n", first+1)
+    for _, line := range wantLines[first:] {
+        b.WriteString("- " + line + "\n")
+    }
+    for _, line := range gotLines[first:] {
+        b.WriteString("+ " + line + "\n")
+    }
+    return b.String()
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+    "student-api/reqctx"
+)
+
+// defaultRouteTimeouts gives routes that call the model more time than CRUD
+// endpoints; summaries wait up to summaryTimeout for Ollama
+var defaultRouteTimeouts = map[string]time.Duration{
+    "/students/{id}/summary":       summaryTimeout + time.Minute,
+    "/students/{id}/summary/audio": summaryTimeout + time.Minute,
+    "/students/ingest/roster":      2 * time.Minute,
+}
+
+// streamingRoutes answer with a stream that lasts as long as the client
+// stays; they are neither buffered nor given a handler timeout
+var streamingRoutes = map[string]bool{
+    "/events":     true,
+    "/ws":         true,
+    "/graphql/ws": true,
+}
+
+// RouteTimeouts holds per-route read and handler timeouts keyed by route
+// template, with defaults for routes that are not listed, and the server's
+// own connection timeouts
+type RouteTimeouts struct {
+    read, handler               map[string]time.Duration
+    defaultRead, defaultHandler time.Duration
+    routes                      *RoutePolicies
+    // write is the time allowed to send a response once its handler is done
+    write, readHeader, idle time.Duration
+}
+
+// parseRouteDurations parses "/students/{id}/summary=3m,/imports=1m"
+func parseRouteDurations(items []string) (map[string]time.Duration, error) {
+    durations := make(map[string]time.Duration)
+    for _, item := range items {
+        route, value, ok := strings.Cut(item, "=")
+        if !ok {
+            return nil, fmt.Errorf("route timeout %q: expected route=duration", item)
+        }
+        d, err := time.ParseDuration(strings.TrimSpace(value))
+        if err != nil || d <= 0 {
+            return nil, fmt.Errorf("route timeout %q: invalid duration", item)
+        }
+        durations[strings.TrimSpace(route)] = d
+    }
+    return durations, nil
+}
+
+// LoadRouteTimeouts reads READ_TIMEOUT, HANDLER_TIMEOUT and the per-route
+// overrides in ROUTE_READ_TIMEOUTS and ROUTE_HANDLER_TIMEOUTS, and
+// WRITE_TIMEOUT, READ_HEADER_TIMEOUT and IDLE_TIMEOUT for connections. The
+// environment's overrides take precedence over route policies, and both over
+// defaultRouteTimeouts.
+func LoadRouteTimeouts(routes *RoutePolicies) (*RouteTimeouts, error) {
+    read, err := parseRouteDurations(getEnvList("ROUTE_READ_TIMEOUTS"))
+    if err != nil {
+        return nil, err
+    }
+    handler, err := parseRouteDurations(getEnvList("ROUTE_HANDLER_TIMEOUTS"))
+    if err != nil {
+        return nil, err
+    }
+    return &RouteTimeouts{
+        read:           read,
+        handler:        handler,
+        routes:         routes,
+        defaultRead:    getEnvDuration("READ_TIMEOUT", 30*time.Second),
+        defaultHandler: getEnvDuration("HANDLER_TIMEOUT", 30*time.Second),
+        write:          getEnvDuration("WRITE_TIMEOUT", 30*time.Second),
+        readHeader:     getEnvDuration("READ_HEADER_TIMEOUT", 10*time.Second),
+        idle:           getEnvDuration("IDLE_TIMEOUT", 2*time.Minute),
+    }, nil
+}
+
+// Apply sets the server's connection timeouts. Middleware moves the read and
+// write deadlines of each request to suit its route.
+func (t *RouteTimeouts) Apply(server *http.Server) {
+    server.ReadHeaderTimeout = t.readHeader
+    server.ReadTimeout = t.defaultRead
+    server.WriteTimeout = t.defaultHandler + t.write
+    server.IdleTimeout = t.idle
+}
+
+func (t *RouteTimeouts) forRoute(r *http.Request) (read, handler time.Duration) {
+    read, handler = t.defaultRead, t.defaultHandler
+    template := routeTemplate(r)
+    if d, ok := defaultRouteTimeouts[template]; ok {
+        handler = d
+    }
+    if policy := t.routes.For(r.Method, template); policy != nil {
+        if policy.readTimeout > 0 {
+            read = policy.readTimeout
+        }
+        if policy.timeout > 0 {
+            handler = policy.timeout
+        }
+    }
+    if d, ok := t.read[template]; ok {
+        read = d
+    }
+    if d, ok := t.handler[template]; ok {
+        handler = d
+    }
+    return read, handler
+}
+
+// Middleware sets the request's read and write deadlines and answers 504
+// when the handler runs past its timeout. Deadlines are cleared for
+// streaming routes.
+func (t *RouteTimeouts) Middleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        rc := http.NewResponseController(w)
+        if streamingRoutes[routeTemplate(r)] {
+            // A read deadline passing would cancel the request's context too
+            if err := rc.SetReadDeadline(time.Time{}); err != nil {
+                reqctx.Logger(r.Context()).Warn("clearing read deadline failed", "error", err)
+            }
+            if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+                reqctx.Logger(r.Context()).Warn("clearing write deadline failed", "error", err)
+            }
+            next.ServeHTTP(w, r)
+            return
+        }
+        read, handler := t.forRoute(r)
+        now := time.Now()
+        if err := rc.SetReadDeadline(now.Add(read)); err != nil {
+            reqctx.Logger(r.Context()).Warn("setting read deadline failed", "error", err)
+        }
+        if err := rc.SetWriteDeadline(now.Add(handler + t.write)); err != nil {
+            reqctx.Logger(r.Context()).Warn("setting write deadline failed", "error", err)
+        }
+        serveWithTimeout(w, r, next, handler)
+    })
+}
+
+// serveWithTimeout runs next with a context that ends after timeout,
+// buffering its response like http.TimeoutHandler, but answering 504 with
+// the error envelope if it is still running then. A handler ignoring its
+// context keeps running in the background; its response is discarded.
+func serveWithTimeout(w http.ResponseWriter, r *http.Request, next http.Handler, timeout time.Duration) {
+    ctx, cancel := context.WithTimeout(r.Context(), timeout)
+    defer cancel()
+    r = r.WithContext(ctx)
+    tw := &timeoutWriter{header: make(http.Header)}
+    done := make(chan struct{})
+    panicked := make(chan interface{}, 1)
+    go func() {
+        defer func() {
+            if p := recover(); p != nil {
+                panicked <- p
+            }
+        }()
+        next.ServeHTTP(tw, r)
+        close(done)
+    }()
+    select {
+    case p := <-panicked:
+        panic(p)
+    case <-done:
+        tw.mu.Lock()
+        defer tw.mu.Unlock()
+        for key, values := range tw.header {
+            w.Header()[key] = values
+        }
+        if tw.status == 0 {
+            tw.status = http.StatusOK
+        }
+        w.WriteHeader(tw.status)
+        w.Write(tw.body.Bytes())
+    case <-ctx.Done():
+        tw.mu.Lock()
+        defer tw.mu.Unlock()
+        tw.timedOut = true
+        if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+            reqctx.Logger(r.Context()).Warn("handler timed out", "timeout", timeout)
+            writeError(w, r, http.StatusGatewayTimeout, CodeTimeout, "Request timed out")
+        }
+    }
+}
+
+// timeoutWriter buffers a response until its handler is done
+type timeoutWriter struct {
+    mu       sync.Mutex
+    header   http.Header
+    body     bytes.Buffer
+    status   int
+    timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header { return tw.header }
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+    tw.mu.Lock()
+    defer tw.mu.Unlock()
+    if tw.timedOut {
+        return 0, http.ErrHandlerTimeout
+    }
+    if tw.status == 0 {
+        tw.status = http.StatusOK
+    }
+    return tw.body.Write(b)
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+    tw.mu.Lock()
+    defer tw.mu.Unlock()
+    if tw.timedOut || tw.status != 0 {
+        return
+    }
+    tw.status = status
+}
+
+// MethodOverrideHeader lets clients behind proxies that only pass GET and
+// POST tunnel other methods through a POST
+const MethodOverrideHeader = "X-HTTP-Method-Override"
+
+// overridableMethods are the methods a POST may be overridden to
+var overridableMethods = map[string]bool{
+    http.MethodPut:    true,
+    http.MethodPatch:  true,
+    http.MethodDelete: true,
+}
+
+// methodOverride rewrites the method of POST requests carrying
+// X-HTTP-Method-Override. It wraps the router because routes match on method.
+func methodOverride(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if override := r.Header.Get(MethodOverrideHeader); override != "" && r.Method == http.MethodPost {
+            method := strings.ToUpper(override)
+            if !overridableMethods[method] {
+                httpError(w, r, "Unsupported method override", http.StatusBadRequest)
+                return
+            }
+            r.Method = method
+            r.Header.Del(MethodOverrideHeader)
+        }
+        next.ServeHTTP(w, r)
+    })
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "os"
+    "os/signal"
+    "sync/atomic"
+    "syscall"
+    "time"
+    "golang.org/x/crypto/acme"
+    "golang.org/x/crypto/acme/autocert"
+)
+
+// TLSConfig controls HTTPS. The server speaks plain HTTP unless it is given
+// a certificate and key, or domains to obtain certificates for from Let's
+// Encrypt.
+type TLSConfig struct {
+    // CertFile and KeyFile hold a PEM certificate chain and its key:
+    // TLS_CERT_FILE, TLS_KEY_FILE. SIGHUP reloads them.
+    CertFile string
+    KeyFile  string
+    // AutocertDomains are the host names certificates are requested and
+    // renewed for automatically: TLS_AUTOCERT_DOMAINS
+    AutocertDomains []string
+    // AutocertCache is the directory certificates are kept in between
+    // restarts: TLS_AUTOCERT_CACHE
+    AutocertCache string
+    // AutocertEmail is the ACME account contact: TLS_AUTOCERT_EMAIL
+    AutocertEmail string
+    // HTTPAddr, in autocert mode, serves HTTP-01 challenges and redirects
+    // everything else to HTTPS: TLS_HTTP_ADDR. Without it only the TLS-ALPN-01
+    // challenge, answered on the HTTPS port itself, is used.
+    HTTPAddr string
+}
+
+// LoadTLSConfig reads the TLS_ settings
+func LoadTLSConfig() (TLSConfig, error) {
+    cfg := TLSConfig{
+        CertFile:        getEnv("TLS_CERT_FILE", ""),
+        KeyFile:         getEnv("TLS_KEY_FILE", ""),
+        AutocertDomains: getEnvList("TLS_AUTOCERT_DOMAINS"),
+        AutocertCache:   getEnv("TLS_AUTOCERT_CACHE", "./autocert"),
+        AutocertEmail:   getEnv("TLS_AUTOCERT_EMAIL", ""),
+        HTTPAddr:        getEnv("TLS_HTTP_ADDR", ""),
+    }
+    switch {
+    case (cfg.CertFile == "") != (cfg.KeyFile == ""):
+        return cfg, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+    case cfg.CertFile != "" && len(cfg.AutocertDomains) > 0:
+        return cfg, errors.New("TLS_CERT_FILE and TLS_AUTOCERT_DOMAINS are mutually exclusive")
+    case cfg.HTTPAddr != "" && len(cfg.AutocertDomains) == 0:
+        return cfg, errors.New("TLS_HTTP_ADDR is only used with TLS_AUTOCERT_DOMAINS")
+    }
+    return cfg, nil
+}
+
+// Mode describes how the server is reached: http, https or autocert
+func (cfg TLSConfig) Mode() string {
+    switch {
+    case len(cfg.AutocertDomains) > 0:
+        return "autocert"
+    case cfg.CertFile != "":
+        return "https"
+    }
+    return "http"
+}
+
+// Apply sets server up for HTTPS. It returns the reloader of a certificate
+// given as files, and in autocert mode with HTTPAddr the plain HTTP server
+// to run alongside; both are nil when they do not apply.
+func (cfg TLSConfig) Apply(server *http.Server) (*CertReloader, *http.Server, error) {
+    switch cfg.Mode() {
+    case "https":
+        certs := &CertReloader{certFile: cfg.CertFile, keyFile: cfg.KeyFile}
+        if err := certs.Reload(); err != nil {
+            return nil, nil, err
+        }
+        server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: certs.GetCertificate}
+        return certs, nil, nil
+    case "autocert":
+        manager := &autocert.Manager{
+            Prompt:     autocert.AcceptTOS,
+            HostPolicy: autocert.HostWhitelist(cfg.AutocertDomains...),
+            Cache:      autocert.DirCache(cfg.AutocertCache),
+            Email:      cfg.AutocertEmail,
+        }
+        server.TLSConfig = &tls.Config{
+            MinVersion:     tls.VersionTLS12,
+            GetCertificate: manager.GetCertificate,
+            NextProtos:     []string{"h2", "http/1.1", acme.ALPNProto},
+        }
+        if cfg.HTTPAddr == "" {
+            return nil, nil, nil
+        }
+        return nil, &http.Server{Addr: cfg.HTTPAddr, Handler: manager.HTTPHandler(nil), ReadHeaderTimeout: 10 * time.Second}, nil
+    }
+    return nil, nil, nil
+}
+
+// CertReloader serves a certificate loaded from files, swapping in a new
+// one on Reload. Handshakes pick up the current certificate, so open
+// connections carry on with the one they started with.
+type CertReloader struct {
+    certFile string
+    keyFile  string
+    cert     atomic.Pointer[tls.Certificate]
+}
+
+// Reload reads the certificate and key again, keeping the previous pair
+// when they do not load
+func (c *CertReloader) Reload() error {
+    cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+    if err != nil {
+        return fmt.Errorf("loading TLS certificate: %w", err)
+    }
+    if cert.Leaf == nil {
+        if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+            return fmt.Errorf("parsing TLS certificate: %w", err)
+        }
+    }
+    c.cert.Store(&cert)
+    return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+    return c.cert.Load(), nil
+}
+
+// NotAfter returns when the current certificate expires
+func (c *CertReloader) NotAfter() time.Time {
+    return c.cert.Load().Leaf.NotAfter
+}
+
+// reloadOnSignal reloads the certificate on every SIGHUP
+func (c *CertReloader) reloadOnSignal() {
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGHUP)
+    for range signals {
+        if err := c.Reload(); err != nil {
+            slog.Error("TLS certificate reload failed; keeping the previous one", "error", err)
+            continue
+        }
+        slog.Warn("TLS certificate reloaded by SIGHUP", "not_after", c.NotAfter().Format(time.RFC3339))
+    }
+}
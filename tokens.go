@@ -0,0 +1,88 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "strings"
+    "student-api/reqctx"
+)
+
+// Scopes an API key can be limited to. A key with scopes is a read-only
+// token for reporting tools: GET requests to the routes of its scopes only.
+const (
+    ScopeStudentsRead  = "students:read"
+    ScopeAnalyticsRead = "analytics:read"
+)
+
+// tokenSecretPrefix marks the secrets of scoped keys so they are not confused with
+// other bearer credentials
+const tokenSecretPrefix = "sr_"
+
+// scopeRoutes maps each scope to the route templates it grants
+var scopeRoutes = map[string]map[string]bool{
+    ScopeStudentsRead: {
+        "/students":               true,
+        "/students/export":        true,
+        "/students/search":        true,
+        "/students/{id}":          true,
+        "/students/{id}/versions": true,
+        "/students/{id}/diff":     true,
+        "/sync/snapshot":          true,
+        "/sync/checksums":         true,
+        "/sync/buckets/{bucket}":  true,
+        "/sync/delta":             true,
+    },
+    ScopeAnalyticsRead: {
+        "/summary/feedback/metrics": true,
+        "/summary/variants/report":  true,
+        "/metrics":                  true,
+    },
+}
+
+// bearerToken returns the credential of an "Authorization: Bearer" header
+func bearerToken(r *http.Request) string {
+    scheme, credential, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+    if !ok || !strings.EqualFold(scheme, "Bearer") {
+        return ""
+    }
+    return strings.TrimSpace(credential)
+}
+
+// apiTokens authenticates read-only tokens for reporting tools, API keys
+// with scopes presented as "Authorization: Bearer sr_...". Requests without
+// one are passed through unchanged.
+func (app *App) apiTokens(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        secret := bearerToken(r)
+        if !strings.HasPrefix(secret, tokenSecretPrefix) {
+            next.ServeHTTP(w, r)
+            return
+        }
+        app.serveAPIKey(w, r, next, secret)
+    })
+}
+
+// requireAdmin guards the admin routes. They serve admin principals: an
+// admin-role user, OIDC token or API key, or the ADMIN_TOKEN secret, which
+// jwtAuth turns into the admin. rbac already requires the admin role of
+// /admin/*, but lets anonymous requests through while authentication is
+// off. Admins bound to a tenant are refused on the routes that span
+// tenants.
+func (app *App) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        switch role := reqctx.Role(r.Context()); {
+        case role == "":
+            w.Header().Set("WWW-Authenticate", "Bearer")
+            httpError(w, r, "Admin credentials required", http.StatusUnauthorized)
+            return
+        case role != RoleAdmin:
+            httpError(w, r, fmt.Sprintf("Role %s may not %s %s; %s required", role, r.Method, routeTemplate(r), RoleAdmin), http.StatusForbidden)
+            return
+        }
+        if tenant, ok := boundTenant(r.Context()); ok && tenant != "" && tenantFreeRoutes[routeTemplate(r)] {
+            httpError(w, r, fmt.Sprintf("Admins of tenant %s may not %s %s", tenant, r.Method, routeTemplate(r)), http.StatusForbidden)
+            return
+        }
+        next(w, r)
+    }
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "strconv"
+    "github.com/gorilla/mux"
+    "student-api/reqctx"
+)
+
+// audioContentTypes maps supported output formats to their MIME types
+var audioContentTypes = map[string]string{
+    "mp3": "audio/mpeg",
+    "ogg": "audio/ogg",
+}
+
+// TTSProvider converts text into an audio stream in the requested format
+type TTSProvider interface {
+    Synthesize(ctx context.Context, text, format string) (io.ReadCloser, error)
+}
+
+// HTTPTTSProvider talks to an OpenAI-compatible /v1/audio/speech endpoint
+type HTTPTTSProvider struct {
+    baseURL string
+    apiKey  string
+    model   string
+    voice   string
+    http    *http.Client
+}
+
+// NewHTTPTTSProvider creates a provider for an OpenAI-compatible speech API
+func NewHTTPTTSProvider(baseURL, apiKey, model, voice string) *HTTPTTSProvider {
+    return &HTTPTTSProvider{
+        baseURL: baseURL,
+        apiKey:  apiKey,
+        model:   model,
+        voice:   voice,
+        http:    &http.Client{},
+    }
+}
+
+type speechRequest struct {
+    Model          string `json:"model"`
+    Input          string `json:"input"`
+    Voice          string `json:"voice"`
+    ResponseFormat string `json:"response_format"`
+}
+
+func (p *HTTPTTSProvider) Synthesize(ctx context.Context, text, format string) (io.ReadCloser, error) {
+    // The speech API calls Ogg/Opus "opus"
+    responseFormat := format
+    if format == "ogg" {
+        responseFormat = "opus"
+    }
+
+    jsonBody, err := json.Marshal(speechRequest{
+        Model:          p.model,
+        Input:          text,
+        Voice:          p.voice,
+        ResponseFormat: responseFormat,
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/v1/audio/speech", bytes.NewBuffer(jsonBody))
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    if p.apiKey != "" {
+        req.Header.Set("Authorization", "Bearer "+p.apiKey)
+    }
+
+    resp, err := p.http.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    if resp.StatusCode != http.StatusOK {
+        resp.Body.Close()
+        return nil, fmt.Errorf("tts: unexpected status %s", resp.Status)
+    }
+    return resp.Body, nil
+}
+
+// LoadTTSProvider returns the provider configured by TTS_URL, or nil when TTS is disabled
+func LoadTTSProvider() TTSProvider {
+    baseURL := getEnv("TTS_URL", "")
+    if baseURL == "" {
+        return nil
+    }
+    return NewHTTPTTSProvider(
+        baseURL,
+        getEnv("TTS_API_KEY", ""),
+        getEnv("TTS_MODEL", "tts-1"),
+        getEnv("TTS_VOICE", "alloy"),
+    )
+}
+
+// spokenSummary renders a structured summary as text suitable for reading aloud
+func spokenSummary(student Student, summary StudentSummary) string {
+    var buf bytes.Buffer
+    fmt.Fprintf(&buf, "Summary for %s. %s", student.Name, summary.Summary)
+    if len(summary.Strengths) > 0 {
+        buf.WriteString(" Strengths:")
+        for _, s := range summary.Strengths {
+            buf.WriteString(" " + s + ".")
+        }
+    }
+    if len(summary.Risks) > 0 {
+        buf.WriteString(" Risks:")
+        for _, r := range summary.Risks {
+            buf.WriteString(" " + r + ".")
+        }
+    }
+    buf.WriteString(" Recommendation: " + summary.Recommendation)
+    return buf.String()
+}
+
+func (app *App) GetStudentSummaryAudio(w http.ResponseWriter, r *http.Request) {
+    store := app.storeFor(r)
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        httpError(w, r, "Invalid ID", http.StatusBadRequest)
+        return
+    }
+
+    format := r.URL.Query().Get("format")
+    if format == "" {
+        format = "mp3"
+    }
+    contentType, ok := audioContentTypes[format]
+    if !ok {
+        httpError(w, r, "Unsupported audio format", http.StatusBadRequest)
+        return
+    }
+
+    if app.tts == nil {
+        httpError(w, r, "Text-to-speech is not configured", http.StatusServiceUnavailable)
+        return
+    }
+
+    student, err := store.Get(id)
+    if err != nil {
+        writeStoreError(w, r, err)
+        return
+    }
+
+    summary, err := app.cachedSummary(r.Context(), student, wantsFreshSummary(r))
+    if writeLLMBusy(w, r, err) {
+        return
+    }
+    if err != nil {
+        reqctx.Logger(r.Context()).Error("summary generation failed", "student_id", id, "error", err)
+        httpError(w, r, "Failed to generate summary", http.StatusBadGateway)
+        return
+    }
+
+    audio, err := app.tts.Synthesize(r.Context(), spokenSummary(student, summary.StudentSummary), format)
+    if err != nil {
+        reqctx.Logger(r.Context()).Error("speech synthesis failed", "student_id", id, "error", err)
+        httpError(w, r, "Failed to synthesize audio", http.StatusBadGateway)
+        return
+    }
+    defer audio.Close()
+
+    app.recordAccess(r, fieldsSummary, id)
+    w.Header().Set("Content-Type", contentType)
+    w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"student-%d-summary.%s\"", id, format))
+    if _, err := io.Copy(w, audio); err != nil {
+        reqctx.Logger(r.Context()).Error("streaming audio failed", "student_id", id, "error", err)
+    }
+}
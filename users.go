@@ -0,0 +1,928 @@
+package main
+
+import (
+    "crypto/rand"
+    "crypto/sha256"
+    "database/sql"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/mail"
+    "net/http"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "github.com/gorilla/mux"
+    "golang.org/x/crypto/bcrypt"
+    "student-api/reqctx"
+)
+
+// Password length limits; bcrypt ignores everything past 72 bytes
+const (
+    minPasswordLength = 10
+    maxPasswordLength = 72
+)
+
+// passwordResetPrefix marks password reset tokens in mail and logs
+const passwordResetPrefix = "pr_"
+
+// validUsername limits usernames to log- and URL-friendly values
+var validUsername = regexp.MustCompile(`^[A-Za-z0-9._-]{3,64}$`)
+
+var (
+    errUserNotFound   = errors.New("user not found")
+    errUserExists     = errors.New("username or email already registered")
+    errBadCredentials = errors.New("invalid username or password")
+    errResetInvalid   = errors.New("password reset token is invalid or expired")
+)
+
+// accountLockedError refuses a login to a locked account. Locked is set on
+// the failed login that locked it.
+type accountLockedError struct {
+    until  time.Time
+    locked bool
+}
+
+func (e *accountLockedError) Error() string {
+    return "account locked until " + e.until.Format(time.RFC3339)
+}
+
+// User is an account that logs in with a password, in addition to the
+// static AUTH_USERS. Only a bcrypt hash of the password is stored.
+type User struct {
+    ID                int        `json:"id"`
+    Username          string     `json:"username"`
+    Email             string     `json:"email"`
+    Role              string     `json:"role"`
+    Tenant            string     `json:"tenant,omitempty"`
+    FailedLogins      int        `json:"failed_logins"`
+    LockedUntil       *time.Time `json:"locked_until,omitempty"`
+    PasswordChangedAt time.Time  `json:"password_changed_at"`
+    CreatedAt         time.Time  `json:"created_at"`
+    passwordHash      []byte
+}
+
+// locked reports whether the account refuses logins at now
+func (u User) locked(now time.Time) bool {
+    return u.LockedUntil != nil && now.Before(*u.LockedUntil)
+}
+
+// UserRequest is the body of POST /auth/register and POST /admin/users.
+// Only admins may choose the role and bind the account to a tenant.
+type UserRequest struct {
+    Username string `json:"username"`
+    Email    string `json:"email"`
+    Password string `json:"password"`
+    Role     string `json:"role"`
+    Tenant   string `json:"tenant"`
+}
+
+// Validate checks if the user request is usable
+func (u UserRequest) Validate() []ValidationError {
+    var errors []ValidationError
+
+    if !validUsername.MatchString(u.Username) {
+        errors = append(errors, ValidationError{
+            Field:   "username",
+            Code:    CodeOutOfRange,
+            Message: "Username must be 3 to 64 letters, digits, dots, dashes or underscores",
+        })
+    }
+
+    if _, err := mail.ParseAddress(u.Email); err != nil || !strings.Contains(u.Email, "@") {
+        errors = append(errors, ValidationError{
+            Field:   "email",
+            Code:    CodeEmailInvalid,
+            Message: "Email must be a valid address",
+        })
+    }
+
+    if err := validatePassword("password", u.Password, u.Username); err != nil {
+        errors = append(errors, *err)
+    }
+
+    if _, err := parseRole(u.Role); err != nil {
+        errors = append(errors, ValidationError{
+            Field:   "role",
+            Code:    CodeOutOfRange,
+            Message: "Role must be admin, teacher or readonly",
+        })
+    }
+
+    if u.Tenant != "" && !validTenantID.MatchString(u.Tenant) {
+        errors = append(errors, ValidationError{
+            Field:   "tenant",
+            Code:    CodeOutOfRange,
+            Message: "Tenant must be a tenant ID",
+        })
+    }
+
+    return errors
+}
+
+// validatePassword checks a new password against the length rules
+func validatePassword(field, password, username string) *ValidationError {
+    switch {
+    case len(password) < minPasswordLength || len(password) > maxPasswordLength:
+        return &ValidationError{
+            Field:   field,
+            Code:    CodeOutOfRange,
+            Message: fmt.Sprintf("Password must be %d to %d characters", minPasswordLength, maxPasswordLength),
+        }
+    case strings.EqualFold(password, username):
+        return &ValidationError{
+            Field:   field,
+            Code:    CodeOutOfRange,
+            Message: "Password must differ from the username",
+        }
+    }
+    return nil
+}
+
+// UserRepository persists accounts and password reset tokens, which are
+// stored as the SHA-256 hex of their secret
+type UserRepository interface {
+    Create(u User) (User, error)
+    ByID(id int) (User, error)
+    ByUsername(username string) (User, error)
+    ByEmail(email string) (User, error)
+    List() ([]User, error)
+    // Update saves a user's password hash, role and lockout state
+    Update(u User) error
+    CreateReset(tokenHash string, userID int, expires time.Time) error
+    // TakeReset marks a live reset token used and returns its user's ID, or
+    // errResetInvalid
+    TakeReset(tokenHash string, now time.Time) (int, error)
+}
+
+// MemoryUserRepository keeps accounts in memory, for STORE_BACKEND=memory
+type MemoryUserRepository struct {
+    sync.RWMutex
+    users  map[int]*User
+    resets map[string]*passwordReset
+    nextID int
+}
+
+type passwordReset struct {
+    userID  int
+    expires time.Time
+    used    bool
+}
+
+// NewMemoryUserRepository initializes a new MemoryUserRepository
+func NewMemoryUserRepository() *MemoryUserRepository {
+    return &MemoryUserRepository{users: make(map[int]*User), resets: make(map[string]*passwordReset), nextID: 1}
+}
+
+func (m *MemoryUserRepository) Create(u User) (User, error) {
+    m.Lock()
+    defer m.Unlock()
+    for _, existing := range m.users {
+        if existing.Username == u.Username || existing.Email == u.Email {
+            return User{}, errUserExists
+        }
+    }
+    u.ID = m.nextID
+    m.nextID++
+    m.users[u.ID] = &u
+    return u, nil
+}
+
+func (m *MemoryUserRepository) ByID(id int) (User, error) {
+    m.RLock()
+    defer m.RUnlock()
+    if u, exists := m.users[id]; exists {
+        return *u, nil
+    }
+    return User{}, errUserNotFound
+}
+
+func (m *MemoryUserRepository) find(match func(*User) bool) (User, error) {
+    m.RLock()
+    defer m.RUnlock()
+    for _, u := range m.users {
+        if match(u) {
+            return *u, nil
+        }
+    }
+    return User{}, errUserNotFound
+}
+
+func (m *MemoryUserRepository) ByUsername(username string) (User, error) {
+    return m.find(func(u *User) bool { return u.Username == username })
+}
+
+func (m *MemoryUserRepository) ByEmail(email string) (User, error) {
+    return m.find(func(u *User) bool { return u.Email == email })
+}
+
+func (m *MemoryUserRepository) List() ([]User, error) {
+    m.RLock()
+    users := make([]User, 0, len(m.users))
+    for _, u := range m.users {
+        users = append(users, *u)
+    }
+    m.RUnlock()
+    sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+    return users, nil
+}
+
+func (m *MemoryUserRepository) Update(u User) error {
+    m.Lock()
+    defer m.Unlock()
+    if _, exists := m.users[u.ID]; !exists {
+        return errUserNotFound
+    }
+    m.users[u.ID] = &u
+    return nil
+}
+
+func (m *MemoryUserRepository) CreateReset(tokenHash string, userID int, expires time.Time) error {
+    m.Lock()
+    defer m.Unlock()
+    m.resets[tokenHash] = &passwordReset{userID: userID, expires: expires}
+    return nil
+}
+
+func (m *MemoryUserRepository) TakeReset(tokenHash string, now time.Time) (int, error) {
+    m.Lock()
+    defer m.Unlock()
+    reset, exists := m.resets[tokenHash]
+    if !exists || reset.used || !now.Before(reset.expires) {
+        return 0, errResetInvalid
+    }
+    reset.used = true
+    return reset.userID, nil
+}
+
+// SQLUserRepository keeps accounts in the users and password_resets tables
+type SQLUserRepository struct {
+    db     *sql.DB
+    rebind func(string) string
+    // returning is set for PostgreSQL, whose driver has no LastInsertId
+    returning bool
+}
+
+// NewSQLUserRepository creates a repository; rebind may be nil
+func NewSQLUserRepository(db *sql.DB, rebind func(string) string, returning bool) *SQLUserRepository {
+    if rebind == nil {
+        rebind = func(q string) string { return q }
+    }
+    return &SQLUserRepository{db: db, rebind: rebind, returning: returning}
+}
+
+const userColumns = `id, username, email, password_hash, role, tenant, failed_logins, locked_until, password_changed_at, created_at`
+
+func scanUser(row interface{ Scan(...interface{}) error }) (User, error) {
+    var u User
+    var hash, changed, created string
+    var locked sql.NullString
+    if err := row.Scan(&u.ID, &u.Username, &u.Email, &hash, &u.Role, &u.Tenant, &u.FailedLogins, &locked, &changed, &created); err != nil {
+        return User{}, err
+    }
+    u.passwordHash = []byte(hash)
+    var err error
+    if u.PasswordChangedAt, err = time.Parse(time.RFC3339Nano, changed); err != nil {
+        return User{}, err
+    }
+    if u.CreatedAt, err = time.Parse(time.RFC3339Nano, created); err != nil {
+        return User{}, err
+    }
+    if locked.Valid {
+        until, err := time.Parse(time.RFC3339Nano, locked.String)
+        if err != nil {
+            return User{}, err
+        }
+        u.LockedUntil = &until
+    }
+    return u, nil
+}
+
+// nullTime formats an optional timestamp for a nullable text column
+func nullTime(t *time.Time) interface{} {
+    if t == nil {
+        return nil
+    }
+    return t.Format(time.RFC3339Nano)
+}
+
+func (s *SQLUserRepository) Create(u User) (User, error) {
+    if _, err := s.ByUsername(u.Username); err == nil {
+        return User{}, errUserExists
+    }
+    if _, err := s.ByEmail(u.Email); err == nil {
+        return User{}, errUserExists
+    }
+    query := `INSERT INTO users (username, email, password_hash, role, tenant, failed_logins, password_changed_at, created_at) VALUES (?, ?, ?, ?, ?, 0, ?, ?)`
+    args := []interface{}{u.Username, u.Email, string(u.passwordHash), u.Role, u.Tenant, u.PasswordChangedAt.Format(time.RFC3339Nano), u.CreatedAt.Format(time.RFC3339Nano)}
+    if s.returning {
+        var id int64
+        if err := s.db.QueryRow(s.rebind(query+` RETURNING id`), args...).Scan(&id); err != nil {
+            return User{}, err
+        }
+        u.ID = int(id)
+        return u, nil
+    }
+    result, err := s.db.Exec(s.rebind(query), args...)
+    if err != nil {
+        return User{}, err
+    }
+    id, err := result.LastInsertId()
+    if err != nil {
+        return User{}, err
+    }
+    u.ID = int(id)
+    return u, nil
+}
+
+func (s *SQLUserRepository) by(column string, value interface{}) (User, error) {
+    row := s.db.QueryRow(s.rebind(`SELECT `+userColumns+` FROM users WHERE `+column+` = ?`), value)
+    u, err := scanUser(row)
+    if errors.Is(err, sql.ErrNoRows) {
+        return User{}, errUserNotFound
+    }
+    return u, err
+}
+
+func (s *SQLUserRepository) ByID(id int) (User, error) { return s.by("id", id) }
+
+func (s *SQLUserRepository) ByUsername(username string) (User, error) {
+    return s.by("username", username)
+}
+
+func (s *SQLUserRepository) ByEmail(email string) (User, error) { return s.by("email", email) }
+
+func (s *SQLUserRepository) List() ([]User, error) {
+    rows, err := s.db.Query(`SELECT ` + userColumns + ` FROM users ORDER BY id`)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    users := []User{}
+    for rows.Next() {
+        u, err := scanUser(rows)
+        if err != nil {
+            return nil, err
+        }
+        users = append(users, u)
+    }
+    return users, rows.Err()
+}
+
+func (s *SQLUserRepository) Update(u User) error {
+    result, err := s.db.Exec(s.rebind(`UPDATE users SET password_hash = ?, role = ?, failed_logins = ?, locked_until = ?, password_changed_at = ? WHERE id = ?`),
+        string(u.passwordHash), u.Role, u.FailedLogins, nullTime(u.LockedUntil), u.PasswordChangedAt.Format(time.RFC3339Nano), u.ID)
+    if err != nil {
+        return err
+    }
+    if n, err := result.RowsAffected(); err == nil && n == 0 {
+        return errUserNotFound
+    }
+    return nil
+}
+
+func (s *SQLUserRepository) CreateReset(tokenHash string, userID int, expires time.Time) error {
+    _, err := s.db.Exec(s.rebind(`INSERT INTO password_resets (token_hash, user_id, expires_at) VALUES (?, ?, ?)`),
+        tokenHash, userID, expires.Format(time.RFC3339Nano))
+    return err
+}
+
+func (s *SQLUserRepository) TakeReset(tokenHash string, now time.Time) (int, error) {
+    var userID int
+    var expires string
+    err := s.db.QueryRow(s.rebind(`SELECT user_id, expires_at FROM password_resets WHERE token_hash = ? AND used_at IS NULL`), tokenHash).Scan(&userID, &expires)
+    if errors.Is(err, sql.ErrNoRows) {
+        return 0, errResetInvalid
+    }
+    if err != nil {
+        return 0, err
+    }
+    if at, err := time.Parse(time.RFC3339Nano, expires); err != nil || !now.Before(at) {
+        return 0, errResetInvalid
+    }
+    // The used_at condition makes concurrent redemptions of one token race
+    // for a single row update
+    result, err := s.db.Exec(s.rebind(`UPDATE password_resets SET used_at = ? WHERE token_hash = ? AND used_at IS NULL`),
+        now.Format(time.RFC3339Nano), tokenHash)
+    if err != nil {
+        return 0, err
+    }
+    if n, err := result.RowsAffected(); err != nil || n == 0 {
+        return 0, errResetInvalid
+    }
+    return userID, nil
+}
+
+// UserStore manages accounts: registration, bcrypt password checks that
+// lock an account after repeated failures, and password resets
+type UserStore struct {
+    repo          UserRepository
+    cost          int
+    lockThreshold int
+    lockDuration  time.Duration
+    resetTTL      time.Duration
+    // selfRegister opens POST /auth/register to anyone
+    selfRegister bool
+    // mu serializes read-modify-write updates of a user's lockout state
+    mu sync.Mutex
+    // dummyHash is compared for unknown usernames, so they take as long to
+    // reject as wrong passwords
+    dummyHash []byte
+}
+
+// LoadUserStore reads BCRYPT_COST, AUTH_LOCKOUT_THRESHOLD (failed logins,
+// 0 disables lockout), AUTH_LOCKOUT_DURATION, PASSWORD_RESET_TTL and
+// AUTH_SELF_REGISTRATION
+func LoadUserStore(repo UserRepository) (*UserStore, error) {
+    cost := getEnvInt("BCRYPT_COST", bcrypt.DefaultCost)
+    if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+        return nil, fmt.Errorf("BCRYPT_COST must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+    }
+    threshold := getEnvInt("AUTH_LOCKOUT_THRESHOLD", 5)
+    if threshold < 0 {
+        return nil, errors.New("AUTH_LOCKOUT_THRESHOLD must not be negative")
+    }
+    dummy, err := bcrypt.GenerateFromPassword([]byte("not a real password"), cost)
+    if err != nil {
+        return nil, err
+    }
+    return &UserStore{
+        repo:          repo,
+        cost:          cost,
+        lockThreshold: threshold,
+        lockDuration:  getEnvDuration("AUTH_LOCKOUT_DURATION", 15*time.Minute),
+        resetTTL:      getEnvDuration("PASSWORD_RESET_TTL", 30*time.Minute),
+        selfRegister:  getEnvBool("AUTH_SELF_REGISTRATION", false),
+        dummyHash:     dummy,
+    }, nil
+}
+
+// Register creates an account
+func (s *UserStore) Register(req UserRequest, now time.Time) (User, error) {
+    hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), s.cost)
+    if err != nil {
+        return User{}, err
+    }
+    role, _ := parseRole(req.Role)
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.repo.Create(User{
+        Username:          req.Username,
+        Email:             strings.ToLower(strings.TrimSpace(req.Email)),
+        Role:              role,
+        Tenant:            req.Tenant,
+        PasswordChangedAt: now,
+        CreatedAt:         now,
+        passwordHash:      hash,
+    })
+}
+
+// Get returns an account by username
+func (s *UserStore) Get(username string) (User, error) {
+    return s.repo.ByUsername(username)
+}
+
+// List returns every account
+func (s *UserStore) List() ([]User, error) {
+    return s.repo.List()
+}
+
+// Authenticate checks a password. Each failure counts towards the lockout
+// threshold; reaching it locks the account for the lockout duration, during
+// which even the right password is refused with an *accountLockedError.
+func (s *UserStore) Authenticate(username, password string, now time.Time) (User, error) {
+    u, err := s.repo.ByUsername(username)
+    if errors.Is(err, errUserNotFound) {
+        bcrypt.CompareHashAndPassword(s.dummyHash, []byte(password))
+        return User{}, errBadCredentials
+    }
+    if err != nil {
+        return User{}, err
+    }
+    if u.locked(now) {
+        return User{}, &accountLockedError{until: *u.LockedUntil}
+    }
+    match := bcrypt.CompareHashAndPassword(u.passwordHash, []byte(password)) == nil
+
+    // Reload under the lock so concurrent failures all count
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if u, err = s.repo.ByID(u.ID); err != nil {
+        return User{}, err
+    }
+    if match {
+        if u.FailedLogins > 0 || u.LockedUntil != nil {
+            u.FailedLogins, u.LockedUntil = 0, nil
+            if err := s.repo.Update(u); err != nil {
+                return User{}, err
+            }
+        }
+        return u, nil
+    }
+    u.FailedLogins++
+    var lockErr error = errBadCredentials
+    if s.lockThreshold > 0 && u.FailedLogins >= s.lockThreshold {
+        until := now.Add(s.lockDuration)
+        u.FailedLogins, u.LockedUntil = 0, &until
+        lockErr = &accountLockedError{until: until, locked: true}
+    }
+    if err := s.repo.Update(u); err != nil {
+        return User{}, err
+    }
+    return u, lockErr
+}
+
+// setPassword replaces a user's password and lifts any lockout; tokens
+// issued before now stop refreshing
+func (s *UserStore) setPassword(u User, password string, now time.Time) error {
+    hash, err := bcrypt.GenerateFromPassword([]byte(password), s.cost)
+    if err != nil {
+        return err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if u, err = s.repo.ByID(u.ID); err != nil {
+        return err
+    }
+    u.passwordHash, u.PasswordChangedAt = hash, now
+    u.FailedLogins, u.LockedUntil = 0, nil
+    return s.repo.Update(u)
+}
+
+// ChangePassword sets a new password after checking the current one
+func (s *UserStore) ChangePassword(username, current, password string, now time.Time) error {
+    u, err := s.Authenticate(username, current, now)
+    if err != nil {
+        return err
+    }
+    return s.setPassword(u, password, now)
+}
+
+// StartReset issues a single-use reset token for the account with the
+// given username or email
+func (s *UserStore) StartReset(login string, now time.Time) (User, string, time.Time, error) {
+    u, err := s.repo.ByUsername(login)
+    if errors.Is(err, errUserNotFound) {
+        u, err = s.repo.ByEmail(strings.ToLower(strings.TrimSpace(login)))
+    }
+    if err != nil {
+        return User{}, "", time.Time{}, err
+    }
+    buf := make([]byte, 32)
+    if _, err := rand.Read(buf); err != nil {
+        return User{}, "", time.Time{}, err
+    }
+    token := passwordResetPrefix + hex.EncodeToString(buf)
+    expires := now.Add(s.resetTTL)
+    if err := s.repo.CreateReset(hashResetToken(token), u.ID, expires); err != nil {
+        return User{}, "", time.Time{}, err
+    }
+    return u, token, expires, nil
+}
+
+// ConfirmReset redeems a reset token, setting the user's new password,
+// which the caller has validated
+func (s *UserStore) ConfirmReset(token, password string, now time.Time) (User, error) {
+    id, err := s.repo.TakeReset(hashResetToken(token), now)
+    if err != nil {
+        return User{}, err
+    }
+    u, err := s.repo.ByID(id)
+    if err != nil {
+        return User{}, err
+    }
+    return u, s.setPassword(u, password, now)
+}
+
+// Unlock lifts a lockout before it expires
+func (s *UserStore) Unlock(username string) (User, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    u, err := s.repo.ByUsername(username)
+    if err != nil {
+        return User{}, err
+    }
+    u.FailedLogins, u.LockedUntil = 0, nil
+    return u, s.repo.Update(u)
+}
+
+func hashResetToken(token string) string {
+    sum := sha256.Sum256([]byte(token))
+    return hex.EncodeToString(sum[:])
+}
+
+// authenticate checks a login against AUTH_USERS first and then the
+// accounts, returning the user's role and tenant
+func (app *App) authenticate(username, password string, now time.Time) (role, tenant string, err error) {
+    if user, static := app.auth.users[username]; static {
+        if !app.auth.checkPassword(username, password) {
+            return "", "", errBadCredentials
+        }
+        return user.role, user.tenant, nil
+    }
+    u, err := app.users.Authenticate(username, password, now)
+    if err != nil {
+        return "", "", err
+    }
+    return u.Role, u.Tenant, nil
+}
+
+// userRole returns the current role and tenant of a token subject, failing
+// for users that no longer exist and for accounts whose password changed
+// after the token was issued
+func (app *App) userRole(claims Claims) (role, tenant string, err error) {
+    if user, static := app.auth.users[claims.Subject]; static {
+        return user.role, user.tenant, nil
+    }
+    u, err := app.users.Get(claims.Subject)
+    if errors.Is(err, errUserNotFound) {
+        return "", "", fmt.Errorf("%w: unknown user", errInvalidJWT)
+    }
+    if err != nil {
+        return "", "", err
+    }
+    if claims.IssuedAt < u.PasswordChangedAt.Unix() {
+        return "", "", fmt.Errorf("%w: password changed", errInvalidJWT)
+    }
+    return u.Role, u.Tenant, nil
+}
+
+// writeLoginError answers a failed login, alerting when it locked an account
+func (app *App) writeLoginError(w http.ResponseWriter, r *http.Request, username string, err error) {
+    var locked *accountLockedError
+    switch {
+    case errors.As(err, &locked):
+        if locked.locked {
+            app.alerts.Raise(Alert{
+                Kind:     "account_locked",
+                Severity: AlertWarning,
+                Summary:  fmt.Sprintf("Account %s locked after %d failed logins", username, app.users.lockThreshold),
+                Fields: map[string]string{
+                    "username":     username,
+                    "locked_until": locked.until.Format(time.RFC3339),
+                    "remote":       r.RemoteAddr,
+                    "request_id":   reqctx.RequestID(r.Context()),
+                },
+                Key: "account_locked:" + username,
+            })
+        }
+        reqctx.Logger(r.Context()).Warn("login to locked account", "username", username, "locked_until", locked.until)
+        w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(locked.until).Seconds())+1))
+        httpError(w, r, "Account is locked after too many failed logins; try again later", http.StatusLocked)
+    case errors.Is(err, errBadCredentials):
+        reqctx.Logger(r.Context()).Warn("login failed", "username", username)
+        httpError(w, r, "Invalid username or password", http.StatusUnauthorized)
+    default:
+        reqctx.Logger(r.Context()).Error("login failed", "username", username, "error", err)
+        httpError(w, r, "Internal server error", http.StatusInternalServerError)
+    }
+}
+
+// createUser validates and registers an account, answering the request
+func (app *App) createUser(w http.ResponseWriter, r *http.Request, req UserRequest) {
+    if verrs := req.Validate(); len(verrs) > 0 {
+        writeValidationErrors(w, r, verrs)
+        return
+    }
+    if _, static := app.auth.users[req.Username]; static {
+        httpError(w, r, "Username or email is already registered", http.StatusConflict)
+        return
+    }
+    u, err := app.users.Register(req, time.Now().UTC())
+    if errors.Is(err, errUserExists) {
+        httpError(w, r, "Username or email is already registered", http.StatusConflict)
+        return
+    }
+    if err != nil {
+        reqctx.Logger(r.Context()).Error("registering user failed", "username", req.Username, "error", err)
+        httpError(w, r, "Internal server error", http.StatusInternalServerError)
+        return
+    }
+    reqctx.Logger(r.Context()).Info("user registered", "username", u.Username, "role", u.Role)
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(u)
+}
+
+// Register creates a readonly account when AUTH_SELF_REGISTRATION is on:
+// POST /auth/register {"username": "...", "email": "...", "password": "..."}.
+// The account is bound to no tenant; an admin binds accounts to one.
+func (app *App) Register(w http.ResponseWriter, r *http.Request) {
+    if app.auth == nil {
+        httpError(w, r, "Authentication is disabled; set JWT_SECRET", http.StatusNotFound)
+        return
+    }
+    if !app.users.selfRegister {
+        httpError(w, r, "Self-registration is disabled; ask an admin for an account", http.StatusForbidden)
+        return
+    }
+    var req UserRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        httpError(w, r, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    if req.Role != "" && req.Role != RoleReadonly {
+        writeValidationErrors(w, r, []ValidationError{{
+            Field:   "role",
+            Code:    CodeOutOfRange,
+            Message: "Self-registered accounts are readonly; an admin assigns other roles",
+        }})
+        return
+    }
+    if req.Tenant != "" {
+        writeValidationErrors(w, r, []ValidationError{{
+            Field:   "tenant",
+            Code:    CodeOutOfRange,
+            Message: "Self-registered accounts belong to no tenant; an admin binds accounts to one",
+        }})
+        return
+    }
+    req.Role = RoleReadonly
+    app.createUser(w, r, req)
+}
+
+// CreateUser creates an account with any role: POST /admin/users
+func (app *App) CreateUser(w http.ResponseWriter, r *http.Request) {
+    if app.auth == nil {
+        httpError(w, r, "Authentication is disabled; set JWT_SECRET", http.StatusNotFound)
+        return
+    }
+    var req UserRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        httpError(w, r, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    app.createUser(w, r, req)
+}
+
+func (app *App) ListUsers(w http.ResponseWriter, r *http.Request) {
+    users, err := app.users.List()
+    if err != nil {
+        reqctx.Logger(r.Context()).Error("listing users failed", "error", err)
+        httpError(w, r, "Internal server error", http.StatusInternalServerError)
+        return
+    }
+    json.NewEncoder(w).Encode(users)
+}
+
+// UnlockUser lifts a lockout: POST /admin/users/{username}/unlock
+func (app *App) UnlockUser(w http.ResponseWriter, r *http.Request) {
+    u, err := app.users.Unlock(mux.Vars(r)["username"])
+    if errors.Is(err, errUserNotFound) {
+        httpError(w, r, "User not found", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        reqctx.Logger(r.Context()).Error("unlocking user failed", "error", err)
+        httpError(w, r, "Internal server error", http.StatusInternalServerError)
+        return
+    }
+    reqctx.Logger(r.Context()).Info("user unlocked", "username", u.Username)
+    json.NewEncoder(w).Encode(u)
+}
+
+// IssuePasswordReset returns a reset token for an admin to hand over out of
+// band, for deployments without SMTP_HOST:
+// POST /admin/users/{username}/password-reset
+func (app *App) IssuePasswordReset(w http.ResponseWriter, r *http.Request) {
+    u, token, expires, err := app.users.StartReset(mux.Vars(r)["username"], time.Now().UTC())
+    if errors.Is(err, errUserNotFound) {
+        httpError(w, r, "User not found", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        reqctx.Logger(r.Context()).Error("issuing password reset failed", "error", err)
+        httpError(w, r, "Internal server error", http.StatusInternalServerError)
+        return
+    }
+    reqctx.Logger(r.Context()).Info("password reset issued", "username", u.Username)
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(map[string]interface{}{"token": token, "expires_at": expires})
+}
+
+// RequestPasswordReset mails a reset link: POST /auth/password-reset
+// {"login": "<username or email>"}. The answer is the same whether or not
+// the account exists, and mail goes out in the background so response
+// times do not tell either.
+func (app *App) RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+    if app.auth == nil {
+        httpError(w, r, "Authentication is disabled; set JWT_SECRET", http.StatusNotFound)
+        return
+    }
+    var body struct {
+        Login string `json:"login"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil || strings.TrimSpace(body.Login) == "" {
+        httpError(w, r, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    logger := reqctx.Logger(r.Context())
+    u, token, expires, err := app.users.StartReset(body.Login, time.Now().UTC())
+    switch {
+    case errors.Is(err, errUserNotFound):
+        logger.Info("password reset for unknown account")
+    case err != nil:
+        logger.Error("starting password reset failed", "error", err)
+    default:
+        go func() {
+            if err := emailPasswordReset(u, token, expires); err != nil {
+                logger.Error("mailing password reset failed", "username", u.Username, "error", err)
+                return
+            }
+            logger.Info("password reset mailed", "username", u.Username)
+        }()
+    }
+    w.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(w).Encode(map[string]string{"status": "If the account exists, a reset link has been sent to its email"})
+}
+
+// emailPasswordReset mails a reset token through SMTP_HOST. When
+// PASSWORD_RESET_URL is set the token is appended to it as a link.
+func emailPasswordReset(u User, token string, expires time.Time) error {
+    host := getEnv("SMTP_HOST", "")
+    if host == "" {
+        return errors.New("SMTP_HOST is not set")
+    }
+    from := getEnv("SMTP_FROM", "accounts@localhost")
+    instructions := "Your password reset token is:\r\n\r\n" + token
+    if link := getEnv("PASSWORD_RESET_URL", ""); link != "" {
+        instructions = "Reset your password at:\r\n\r\n" + link + token
+    }
+    msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: Password reset for %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n"+
+        "%s\r\n\r\nIt expires at %s and works once. If you did not ask for it, ignore this message.\r\n",
+        from, u.Email, u.Username, instructions, expires.Format(time.RFC1123))
+    return sendMail(host, from, []string{u.Email}, []byte(msg))
+}
+
+// ConfirmPasswordReset sets a new password with a reset token:
+// POST /auth/password-reset/confirm {"token": "pr_...", "password": "..."}
+func (app *App) ConfirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+    if app.auth == nil {
+        httpError(w, r, "Authentication is disabled; set JWT_SECRET", http.StatusNotFound)
+        return
+    }
+    var body struct {
+        Token    string `json:"token"`
+        Password string `json:"password"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+        httpError(w, r, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    if verr := validatePassword("password", body.Password, ""); verr != nil {
+        writeValidationErrors(w, r, []ValidationError{*verr})
+        return
+    }
+    u, err := app.users.ConfirmReset(body.Token, body.Password, time.Now().UTC())
+    switch {
+    case errors.Is(err, errResetInvalid), errors.Is(err, errUserNotFound):
+        httpError(w, r, "Invalid or expired reset token", http.StatusBadRequest)
+        return
+    case err != nil:
+        reqctx.Logger(r.Context()).Error("password reset failed", "error", err)
+        httpError(w, r, "Internal server error", http.StatusInternalServerError)
+        return
+    }
+    reqctx.Logger(r.Context()).Info("password reset", "username", u.Username)
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// ChangePassword changes the caller's own password: PUT /auth/password
+// {"current_password": "...", "new_password": "..."} with their access token
+func (app *App) ChangePassword(w http.ResponseWriter, r *http.Request) {
+    if app.auth == nil {
+        httpError(w, r, "Authentication is disabled; set JWT_SECRET", http.StatusNotFound)
+        return
+    }
+    claims, ok := claimsFrom(r.Context())
+    if !ok || claims.Issuer != app.auth.issuer {
+        w.Header().Set("WWW-Authenticate", "Bearer")
+        httpError(w, r, "A valid bearer token is required", http.StatusUnauthorized)
+        return
+    }
+    if _, static := app.auth.users[claims.Subject]; static {
+        httpError(w, r, "Users configured in AUTH_USERS change passwords in the configuration", http.StatusConflict)
+        return
+    }
+    var body struct {
+        CurrentPassword string `json:"current_password"`
+        NewPassword     string `json:"new_password"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+        httpError(w, r, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    if verr := validatePassword("new_password", body.NewPassword, claims.Subject); verr != nil {
+        writeValidationErrors(w, r, []ValidationError{*verr})
+        return
+    }
+    if err := app.users.ChangePassword(claims.Subject, body.CurrentPassword, body.NewPassword, time.Now().UTC()); err != nil {
+        app.writeLoginError(w, r, claims.Subject, err)
+        return
+    }
+    reqctx.Logger(r.Context()).Info("password changed", "username", claims.Subject)
+    w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "runtime"
+    "runtime/debug"
+)
+
+// Build information, set at link time:
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+//
+// The Makefile's build target does this.
+var (
+    version   = "dev"
+    commit    = ""
+    buildDate = ""
+)
+
+// BuildInfo describes the running binary
+type BuildInfo struct {
+    Version   string `json:"version"`
+    Commit    string `json:"commit"`
+    BuildDate string `json:"build_date"`
+    GoVersion string `json:"go_version"`
+}
+
+// buildInfo returns the linked build information, falling back to the VCS
+// details Go records for builds made inside a git checkout
+func buildInfo() BuildInfo {
+    info := BuildInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+    if bi, ok := debug.ReadBuildInfo(); ok {
+        for _, setting := range bi.Settings {
+            switch {
+            case setting.Key == "vcs.revision" && info.Commit == "":
+                info.Commit = setting.Value
+            case setting.Key == "vcs.time" && info.BuildDate == "":
+                info.BuildDate = setting.Value
+            }
+        }
+    }
+    if info.Commit == "" {
+        info.Commit = "unknown"
+    }
+    if info.BuildDate == "" {
+        info.BuildDate = "unknown"
+    }
+    return info
+}
+
+// String formats the build information for logs
+func (b BuildInfo) String() string {
+    short := b.Commit
+    if len(short) > 12 {
+        short = short[:12]
+    }
+    return "student-api " + b.Version + " (commit " + short + ", built " + b.BuildDate + ", " + b.GoVersion + ")"
+}
+
+// GetVersion serves GET /version
+func GetVersion(w http.ResponseWriter, r *http.Request) {
+    json.NewEncoder(w).Encode(buildInfo())
+}
+
+// versionHeader stamps every response with X-API-Version
+func versionHeader(next http.Handler) http.Handler {
+    value := buildInfo().Version
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("X-API-Version", value)
+        next.ServeHTTP(w, r)
+    })
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "log/slog"
+    "net/http"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// warmupTimeout bounds a single warm-up pass, which may include a model pull
+const warmupTimeout = 10 * time.Minute
+
+// ModelStatus reports what the last warm-up pass learned about Ollama
+type ModelStatus struct {
+    Model     string    `json:"model"`
+    Reachable bool      `json:"reachable"`
+    Available bool      `json:"available"`
+    Loaded    bool      `json:"loaded"`
+    CheckedAt time.Time `json:"checked_at,omitempty"`
+    Error     string    `json:"error,omitempty"`
+    // Draining is set once the server is shutting down
+    Draining bool `json:"draining,omitempty"`
+}
+
+// ModelWarmer pings Ollama, pulls the configured model when missing and loads
+// it into memory so the first summary request does not pay the load latency
+type ModelWarmer struct {
+    client *OllamaClient
+    pull   bool
+
+    mu     sync.RWMutex
+    status ModelStatus
+    // draining fails readiness while the server shuts down
+    draining atomic.Bool
+}
+
+// NewModelWarmer creates a warmer; pull controls whether missing models are downloaded
+func NewModelWarmer(client *OllamaClient, pull bool) *ModelWarmer {
+    return &ModelWarmer{
+        client: client,
+        pull:   pull,
+        status: ModelStatus{Model: client.Model()},
+    }
+}
+
+// Status returns a copy of the latest model status
+func (w *ModelWarmer) Status() ModelStatus {
+    w.mu.RLock()
+    defer w.mu.RUnlock()
+    return w.status
+}
+
+// Run warms up immediately and then again every interval until ctx is done.
+// A zero interval performs only the startup warm-up.
+func (w *ModelWarmer) Run(ctx context.Context, interval time.Duration) {
+    w.WarmUp(ctx)
+    if interval <= 0 {
+        return
+    }
+
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            w.WarmUp(ctx)
+        }
+    }
+}
+
+// WarmUp performs a single ping/pull/load pass and records the outcome
+func (w *ModelWarmer) WarmUp(ctx context.Context) ModelStatus {
+    ctx, cancel := context.WithTimeout(ctx, warmupTimeout)
+    defer cancel()
+
+    status := ModelStatus{Model: w.client.Model(), CheckedAt: time.Now().UTC()}
+    defer func() {
+        w.mu.Lock()
+        w.status = status
+        w.mu.Unlock()
+    }()
+
+    models, err := w.client.ListModels(ctx)
+    if err != nil {
+        status.Error = err.Error()
+        slog.Warn("ollama warm-up: server unreachable", "error", err)
+        return status
+    }
+    status.Reachable = true
+
+    for _, name := range models {
+        if sameModel(name, status.Model) {
+            status.Available = true
+            break
+        }
+    }
+
+    if !status.Available {
+        if !w.pull {
+            status.Error = "model not available and pulling is disabled"
+            slog.Warn("ollama warm-up: model not available", "model", status.Model)
+            return status
+        }
+        slog.Info("ollama warm-up: pulling model", "model", status.Model)
+        if err := w.client.PullModel(ctx); err != nil {
+            status.Error = err.Error()
+            slog.Warn("ollama warm-up: pull failed", "model", status.Model, "error", err)
+            return status
+        }
+        status.Available = true
+    }
+
+    if err := w.client.LoadModel(ctx); err != nil {
+        status.Error = err.Error()
+        slog.Warn("ollama warm-up: load failed", "model", status.Model, "error", err)
+        return status
+    }
+    status.Loaded = true
+
+    slog.Info("ollama warm-up: model ready", "model", status.Model)
+    return status
+}
+
+// Drain makes Readyz fail from now on, so load balancers stop sending
+// requests to a server that is shutting down
+func (w *ModelWarmer) Drain() {
+    w.draining.Store(true)
+}
+
+// Readyz reports 200 once the model is loaded and 503 otherwise, or once
+// the server has started draining
+func (w *ModelWarmer) Readyz(rw http.ResponseWriter, r *http.Request) {
+    status := w.Status()
+    status.Draining = w.draining.Load()
+    rw.Header().Set("Content-Type", "application/json")
+    if !status.Loaded || status.Draining {
+        rw.WriteHeader(http.StatusServiceUnavailable)
+    }
+    json.NewEncoder(rw).Encode(status)
+}
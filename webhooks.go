@@ -0,0 +1,1220 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "database/sql"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "net/http"
+    "net/url"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "github.com/gorilla/mux"
+    "student-api/reqctx"
+)
+
+// Webhook delivery statuses. A dead delivery failed every attempt, or was
+// abandoned by an instance that stopped, and stays in the dead-letter list
+// until it is replayed.
+const (
+    DeliveryPending   = "pending"
+    DeliveryDelivered = "delivered"
+    DeliveryDead      = "dead"
+)
+
+// webhookSecretPrefix marks generated signing secrets
+const webhookSecretPrefix = "whsec_"
+
+// minWebhookSecretLength is the shortest secret an operator may choose
+const minWebhookSecretLength = 16
+
+// sortableTimeLayout stores times at a fixed width, so they sort and compare
+// as text in every database
+const sortableTimeLayout = "2006-01-02T15:04:05.000000000Z07:00"
+
+var (
+    errWebhookNotFound  = errors.New("webhook not found")
+    errDeliveryNotFound = errors.New("webhook delivery not found")
+    errDeliveryChanged  = errors.New("webhook delivery has changed")
+)
+
+// Webhook is an operator's URL receiving a POST for every student change of
+// its tenant that passes its filter. Each request carries the event as JSON
+// and an X-Webhook-Signature of "sha256=" and the hex HMAC-SHA256, keyed
+// with the secret, of X-Webhook-Timestamp, a dot and the body.
+type Webhook struct {
+    ID        int       `json:"id"`
+    Tenant    string    `json:"tenant,omitempty"`
+    URL       string    `json:"url"`
+    Types     []string  `json:"types,omitempty"`
+    Fields    []string  `json:"fields,omitempty"`
+    CreatedBy string    `json:"created_by"`
+    CreatedAt time.Time `json:"created_at"`
+
+    secret string
+}
+
+func (h Webhook) filter() EventFilter {
+    return EventFilter{Types: h.Types, Fields: h.Fields}
+}
+
+// WebhookRequest is the body of POST /admin/webhooks. Types and Fields
+// filter events as on GET /events; Secret is generated when empty.
+type WebhookRequest struct {
+    URL    string   `json:"url"`
+    Types  []string `json:"types,omitempty"`
+    Fields []string `json:"fields,omitempty"`
+    Secret string   `json:"secret,omitempty"`
+}
+
+func (req WebhookRequest) Validate() []ValidationError {
+    var errors []ValidationError
+    if u, err := url.Parse(req.URL); req.URL == "" {
+        errors = append(errors, ValidationError{Field: "url", Code: CodeRequired, Message: "URL is required"})
+    } else if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+        errors = append(errors, ValidationError{Field: "url", Code: CodeOutOfRange, Message: "URL must be an absolute http or https URL"})
+    }
+    if _, err := ParseEventFilter(strings.Join(req.Types, ","), ""); err != nil {
+        errors = append(errors, ValidationError{Field: "types", Code: CodeInvalidFilter, Message: err.Error()})
+    }
+    if _, err := ParseEventFilter("", strings.Join(req.Fields, ",")); err != nil {
+        errors = append(errors, ValidationError{Field: "fields", Code: CodeInvalidFilter, Message: err.Error()})
+    }
+    if req.Secret != "" && len(req.Secret) < minWebhookSecretLength {
+        errors = append(errors, ValidationError{Field: "secret", Code: CodeOutOfRange,
+            Message: fmt.Sprintf("Secret must be at least %d characters", minWebhookSecretLength)})
+    }
+    return errors
+}
+
+// WebhookDelivery tracks one event sent to one webhook. Replaying a dead
+// delivery sends it again under the same ID, which receivers can use to
+// discard duplicates. A replay carries the event as it was first sent, so
+// it may arrive after newer events of the same student: receivers keep the
+// highest version they have seen of each student and ignore lower ones.
+type WebhookDelivery struct {
+    ID        int    `json:"id"`
+    Tenant    string `json:"tenant,omitempty"`
+    WebhookID int    `json:"webhook_id"`
+    Event     Event  `json:"event"`
+    Status    string `json:"status"`
+    Attempts  int    `json:"attempts"`
+    // LastStatus is the HTTP status of the last attempt, 0 when it got no answer
+    LastStatus  int        `json:"last_status,omitempty"`
+    LastError   string     `json:"last_error,omitempty"`
+    CreatedAt   time.Time  `json:"created_at"`
+    UpdatedAt   time.Time  `json:"updated_at"`
+    DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+}
+
+// DeliveryQuery selects a tenant's deliveries. Zero values match all;
+// From and To bound CreatedAt, To exclusive.
+type DeliveryQuery struct {
+    Tenant    string
+    WebhookID int
+    Status    string
+    From, To  time.Time
+    Limit     int
+    // Oldest lists the oldest deliveries first instead of the newest
+    Oldest bool
+}
+
+func (q DeliveryQuery) match(d WebhookDelivery) bool {
+    return d.Tenant == q.Tenant &&
+        (q.WebhookID == 0 || d.WebhookID == q.WebhookID) &&
+        (q.Status == "" || d.Status == q.Status) &&
+        (q.From.IsZero() || !d.CreatedAt.Before(q.From)) &&
+        (q.To.IsZero() || d.CreatedAt.Before(q.To))
+}
+
+// WebhookRepository persists webhooks and their deliveries
+type WebhookRepository interface {
+    Create(h Webhook) (Webhook, error)
+    // All returns the webhooks of every tenant, oldest first
+    All() ([]Webhook, error)
+    // Delete removes a webhook with its deliveries
+    Delete(tenant string, id int) error
+    CreateDelivery(d WebhookDelivery) (WebhookDelivery, error)
+    Delivery(tenant string, id int) (WebhookDelivery, error)
+    Deliveries(q DeliveryQuery) ([]WebhookDelivery, error)
+    // UpdateDelivery saves d if its stored status is still from, and
+    // otherwise fails with errDeliveryChanged
+    UpdateDelivery(d WebhookDelivery, from string) error
+    // Stale returns the pending deliveries of every tenant last updated
+    // before the given time
+    Stale(before time.Time) ([]WebhookDelivery, error)
+    // Prune deletes delivered deliveries created before the given time
+    Prune(before time.Time) (int, error)
+}
+
+// MemoryWebhookRepository keeps webhooks in memory, for STORE_BACKEND=memory
+type MemoryWebhookRepository struct {
+    sync.RWMutex
+    webhooks     map[int]Webhook
+    deliveries   map[int]WebhookDelivery
+    nextID       int
+    nextDelivery int
+}
+
+// NewMemoryWebhookRepository initializes a new MemoryWebhookRepository
+func NewMemoryWebhookRepository() *MemoryWebhookRepository {
+    return &MemoryWebhookRepository{
+        webhooks:     make(map[int]Webhook),
+        deliveries:   make(map[int]WebhookDelivery),
+        nextID:       1,
+        nextDelivery: 1,
+    }
+}
+
+func (m *MemoryWebhookRepository) Create(h Webhook) (Webhook, error) {
+    m.Lock()
+    defer m.Unlock()
+    h.ID = m.nextID
+    m.nextID++
+    m.webhooks[h.ID] = h
+    return h, nil
+}
+
+func (m *MemoryWebhookRepository) All() ([]Webhook, error) {
+    m.RLock()
+    webhooks := make([]Webhook, 0, len(m.webhooks))
+    for _, h := range m.webhooks {
+        webhooks = append(webhooks, h)
+    }
+    m.RUnlock()
+    sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].ID < webhooks[j].ID })
+    return webhooks, nil
+}
+
+func (m *MemoryWebhookRepository) Delete(tenant string, id int) error {
+    m.Lock()
+    defer m.Unlock()
+    if h, exists := m.webhooks[id]; !exists || h.Tenant != tenant {
+        return errWebhookNotFound
+    }
+    delete(m.webhooks, id)
+    for deliveryID, d := range m.deliveries {
+        if d.WebhookID == id {
+            delete(m.deliveries, deliveryID)
+        }
+    }
+    return nil
+}
+
+func (m *MemoryWebhookRepository) CreateDelivery(d WebhookDelivery) (WebhookDelivery, error) {
+    m.Lock()
+    defer m.Unlock()
+    d.ID = m.nextDelivery
+    m.nextDelivery++
+    m.deliveries[d.ID] = d
+    return d, nil
+}
+
+func (m *MemoryWebhookRepository) Delivery(tenant string, id int) (WebhookDelivery, error) {
+    m.RLock()
+    defer m.RUnlock()
+    if d, exists := m.deliveries[id]; exists && d.Tenant == tenant {
+        return d, nil
+    }
+    return WebhookDelivery{}, errDeliveryNotFound
+}
+
+func (m *MemoryWebhookRepository) Deliveries(q DeliveryQuery) ([]WebhookDelivery, error) {
+    m.RLock()
+    deliveries := []WebhookDelivery{}
+    for _, d := range m.deliveries {
+        if q.match(d) {
+            deliveries = append(deliveries, d)
+        }
+    }
+    m.RUnlock()
+    sort.Slice(deliveries, func(i, j int) bool {
+        return (deliveries[i].ID < deliveries[j].ID) == q.Oldest
+    })
+    if q.Limit > 0 && len(deliveries) > q.Limit {
+        deliveries = deliveries[:q.Limit]
+    }
+    return deliveries, nil
+}
+
+func (m *MemoryWebhookRepository) UpdateDelivery(d WebhookDelivery, from string) error {
+    m.Lock()
+    defer m.Unlock()
+    stored, exists := m.deliveries[d.ID]
+    if !exists {
+        return errDeliveryNotFound
+    }
+    if stored.Status != from {
+        return errDeliveryChanged
+    }
+    m.deliveries[d.ID] = d
+    return nil
+}
+
+func (m *MemoryWebhookRepository) Stale(before time.Time) ([]WebhookDelivery, error) {
+    m.RLock()
+    stale := []WebhookDelivery{}
+    for _, d := range m.deliveries {
+        if d.Status == DeliveryPending && d.UpdatedAt.Before(before) {
+            stale = append(stale, d)
+        }
+    }
+    m.RUnlock()
+    sort.Slice(stale, func(i, j int) bool { return stale[i].ID < stale[j].ID })
+    return stale, nil
+}
+
+func (m *MemoryWebhookRepository) Prune(before time.Time) (int, error) {
+    m.Lock()
+    defer m.Unlock()
+    pruned := 0
+    for id, d := range m.deliveries {
+        if d.Status == DeliveryDelivered && d.CreatedAt.Before(before) {
+            delete(m.deliveries, id)
+            pruned++
+        }
+    }
+    return pruned, nil
+}
+
+// SQLWebhookRepository keeps webhooks in the webhooks and
+// webhook_deliveries tables
+type SQLWebhookRepository struct {
+    db     *sql.DB
+    rebind func(string) string
+    // returning is set for PostgreSQL, whose driver has no LastInsertId
+    returning bool
+}
+
+// NewSQLWebhookRepository creates a repository; rebind may be nil
+func NewSQLWebhookRepository(db *sql.DB, rebind func(string) string, returning bool) *SQLWebhookRepository {
+    if rebind == nil {
+        rebind = func(q string) string { return q }
+    }
+    return &SQLWebhookRepository{db: db, rebind: rebind, returning: returning}
+}
+
+// insert runs an INSERT and returns the new row's ID
+func (s *SQLWebhookRepository) insert(query string, args ...interface{}) (int, error) {
+    if s.returning {
+        var id int64
+        err := s.db.QueryRow(s.rebind(query+` RETURNING id`), args...).Scan(&id)
+        return int(id), err
+    }
+    result, err := s.db.Exec(s.rebind(query), args...)
+    if err != nil {
+        return 0, err
+    }
+    id, err := result.LastInsertId()
+    return int(id), err
+}
+
+func (s *SQLWebhookRepository) Create(h Webhook) (Webhook, error) {
+    var err error
+    h.ID, err = s.insert(`INSERT INTO webhooks (tenant, url, secret, types, fields, created_by, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+        h.Tenant, h.URL, h.secret, strings.Join(h.Types, ","), strings.Join(h.Fields, ","), h.CreatedBy, h.CreatedAt.Format(sortableTimeLayout))
+    if err != nil {
+        return Webhook{}, err
+    }
+    return h, nil
+}
+
+func (s *SQLWebhookRepository) All() ([]Webhook, error) {
+    rows, err := s.db.Query(`SELECT id, tenant, url, secret, types, fields, created_by, created_at FROM webhooks ORDER BY id`)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    webhooks := []Webhook{}
+    for rows.Next() {
+        var h Webhook
+        var types, fields, created string
+        if err := rows.Scan(&h.ID, &h.Tenant, &h.URL, &h.secret, &types, &fields, &h.CreatedBy, &created); err != nil {
+            return nil, err
+        }
+        if types != "" {
+            h.Types = strings.Split(types, ",")
+        }
+        if fields != "" {
+            h.Fields = strings.Split(fields, ",")
+        }
+        if h.CreatedAt, err = time.Parse(time.RFC3339Nano, created); err != nil {
+            return nil, err
+        }
+        webhooks = append(webhooks, h)
+    }
+    return webhooks, rows.Err()
+}
+
+func (s *SQLWebhookRepository) Delete(tenant string, id int) error {
+    tx, err := s.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    result, err := tx.Exec(s.rebind(`DELETE FROM webhooks WHERE tenant = ? AND id = ?`), tenant, id)
+    if err != nil {
+        return err
+    }
+    if n, err := result.RowsAffected(); err == nil && n == 0 {
+        return errWebhookNotFound
+    }
+    if _, err := tx.Exec(s.rebind(`DELETE FROM webhook_deliveries WHERE webhook_id = ?`), id); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+const deliveryColumns = `id, tenant, webhook_id, payload, status, attempts, last_status, last_error, created_at, updated_at, delivered_at`
+
+func scanDelivery(row interface{ Scan(...interface{}) error }) (WebhookDelivery, error) {
+    var d WebhookDelivery
+    var payload, created, updated string
+    var delivered sql.NullString
+    if err := row.Scan(&d.ID, &d.Tenant, &d.WebhookID, &payload, &d.Status, &d.Attempts, &d.LastStatus, &d.LastError,
+        &created, &updated, &delivered); err != nil {
+        return WebhookDelivery{}, err
+    }
+    if err := json.Unmarshal([]byte(payload), &d.Event); err != nil {
+        return WebhookDelivery{}, err
+    }
+    var err error
+    if d.CreatedAt, err = time.Parse(time.RFC3339Nano, created); err != nil {
+        return WebhookDelivery{}, err
+    }
+    if d.UpdatedAt, err = time.Parse(time.RFC3339Nano, updated); err != nil {
+        return WebhookDelivery{}, err
+    }
+    if delivered.Valid {
+        at, err := time.Parse(time.RFC3339Nano, delivered.String)
+        if err != nil {
+            return WebhookDelivery{}, err
+        }
+        d.DeliveredAt = &at
+    }
+    return d, nil
+}
+
+func (s *SQLWebhookRepository) list(query string, args ...interface{}) ([]WebhookDelivery, error) {
+    rows, err := s.db.Query(s.rebind(`SELECT `+deliveryColumns+` FROM webhook_deliveries WHERE `+query), args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    deliveries := []WebhookDelivery{}
+    for rows.Next() {
+        d, err := scanDelivery(rows)
+        if err != nil {
+            return nil, err
+        }
+        deliveries = append(deliveries, d)
+    }
+    return deliveries, rows.Err()
+}
+
+func (s *SQLWebhookRepository) CreateDelivery(d WebhookDelivery) (WebhookDelivery, error) {
+    payload, err := json.Marshal(d.Event)
+    if err != nil {
+        return WebhookDelivery{}, err
+    }
+    d.ID, err = s.insert(`INSERT INTO webhook_deliveries (tenant, webhook_id, payload, status, attempts, last_status, last_error, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+        d.Tenant, d.WebhookID, string(payload), d.Status, d.Attempts, d.LastStatus, d.LastError,
+        d.CreatedAt.Format(sortableTimeLayout), d.UpdatedAt.Format(sortableTimeLayout))
+    if err != nil {
+        return WebhookDelivery{}, err
+    }
+    return d, nil
+}
+
+func (s *SQLWebhookRepository) Delivery(tenant string, id int) (WebhookDelivery, error) {
+    row := s.db.QueryRow(s.rebind(`SELECT `+deliveryColumns+` FROM webhook_deliveries WHERE tenant = ? AND id = ?`), tenant, id)
+    d, err := scanDelivery(row)
+    if errors.Is(err, sql.ErrNoRows) {
+        return WebhookDelivery{}, errDeliveryNotFound
+    }
+    return d, err
+}
+
+func (s *SQLWebhookRepository) Deliveries(q DeliveryQuery) ([]WebhookDelivery, error) {
+    where, args := []string{"tenant = ?"}, []interface{}{q.Tenant}
+    if q.WebhookID != 0 {
+        where, args = append(where, "webhook_id = ?"), append(args, q.WebhookID)
+    }
+    if q.Status != "" {
+        where, args = append(where, "status = ?"), append(args, q.Status)
+    }
+    if !q.From.IsZero() {
+        where, args = append(where, "created_at >= ?"), append(args, q.From.UTC().Format(sortableTimeLayout))
+    }
+    if !q.To.IsZero() {
+        where, args = append(where, "created_at < ?"), append(args, q.To.UTC().Format(sortableTimeLayout))
+    }
+    query := strings.Join(where, " AND ") + " ORDER BY id DESC"
+    if q.Oldest {
+        query = strings.Join(where, " AND ") + " ORDER BY id"
+    }
+    if q.Limit > 0 {
+        query += " LIMIT " + strconv.Itoa(q.Limit)
+    }
+    return s.list(query, args...)
+}
+
+func (s *SQLWebhookRepository) UpdateDelivery(d WebhookDelivery, from string) error {
+    var delivered interface{}
+    if d.DeliveredAt != nil {
+        delivered = d.DeliveredAt.Format(sortableTimeLayout)
+    }
+    result, err := s.db.Exec(s.rebind(`UPDATE webhook_deliveries SET status = ?, attempts = ?, last_status = ?, last_error = ?, updated_at = ?, delivered_at = ? WHERE id = ? AND status = ?`),
+        d.Status, d.Attempts, d.LastStatus, d.LastError, d.UpdatedAt.Format(sortableTimeLayout), delivered, d.ID, from)
+    if err != nil {
+        return err
+    }
+    if n, err := result.RowsAffected(); err == nil && n == 0 {
+        if _, err := s.Delivery(d.Tenant, d.ID); err != nil {
+            return err
+        }
+        return errDeliveryChanged
+    }
+    return nil
+}
+
+func (s *SQLWebhookRepository) Stale(before time.Time) ([]WebhookDelivery, error) {
+    return s.list(`status = ? AND updated_at < ? ORDER BY id`, DeliveryPending, before.UTC().Format(sortableTimeLayout))
+}
+
+func (s *SQLWebhookRepository) Prune(before time.Time) (int, error) {
+    result, err := s.db.Exec(s.rebind(`DELETE FROM webhook_deliveries WHERE status = ? AND created_at < ?`),
+        DeliveryDelivered, before.UTC().Format(sortableTimeLayout))
+    if err != nil {
+        return 0, err
+    }
+    n, err := result.RowsAffected()
+    return int(n), err
+}
+
+// Webhooks delivers student changes to the registered webhooks. Each
+// webhook has its own EventDispatcher, so a failing endpoint is retried
+// with backoff without holding up the others, and its events still arrive
+// in order per student. Every instance delivers the changes it made itself;
+// the leader prunes old deliveries and dead-letters the ones an instance
+// left pending when it stopped.
+type Webhooks struct {
+    repo      WebhookRepository
+    client    *http.Client
+    options   EventDispatcherOptions
+    timeout   time.Duration
+    retention time.Duration
+    refresh   time.Duration
+    alerts    *Alerter
+    metrics   *Metrics
+
+    mu      sync.RWMutex
+    runners map[int]*webhookRunner
+}
+
+// LoadWebhooks reads WEBHOOK_TIMEOUT (default 10s) for each POST,
+// WEBHOOK_MAX_ATTEMPTS (default 5), WEBHOOK_BACKOFF (default 1s) doubling up
+// to WEBHOOK_MAX_BACKOFF (default 5m), WEBHOOK_WORKERS (default 4), the
+// concurrent POSTs per webhook, WEBHOOK_RETENTION (default 7 days), how long
+// delivered deliveries are kept, and WEBHOOK_REFRESH (default 30s), how
+// often webhooks registered on other instances are picked up
+func LoadWebhooks(repo WebhookRepository, alerts *Alerter, metrics *Metrics) (*Webhooks, error) {
+    w := &Webhooks{
+        repo: repo,
+        options: EventDispatcherOptions{
+            MaxAttempts: getEnvInt("WEBHOOK_MAX_ATTEMPTS", 5),
+            Backoff:     getEnvDuration("WEBHOOK_BACKOFF", time.Second),
+            MaxBackoff:  getEnvDuration("WEBHOOK_MAX_BACKOFF", 5*time.Minute),
+            Workers:     getEnvInt("WEBHOOK_WORKERS", 4),
+        },
+        timeout:   getEnvDuration("WEBHOOK_TIMEOUT", 10*time.Second),
+        retention: getEnvDuration("WEBHOOK_RETENTION", 7*24*time.Hour),
+        refresh:   getEnvDuration("WEBHOOK_REFRESH", 30*time.Second),
+        alerts:    alerts,
+        metrics:   metrics,
+        runners:   make(map[int]*webhookRunner),
+    }
+    for _, setting := range []struct {
+        name  string
+        value time.Duration
+    }{
+        {"WEBHOOK_TIMEOUT", w.timeout},
+        {"WEBHOOK_BACKOFF", w.options.Backoff},
+        {"WEBHOOK_MAX_BACKOFF", w.options.MaxBackoff},
+        {"WEBHOOK_RETENTION", w.retention},
+        {"WEBHOOK_REFRESH", w.refresh},
+    } {
+        if setting.value <= 0 {
+            return nil, fmt.Errorf("%s must be positive, got %s", setting.name, setting.value)
+        }
+    }
+    if w.options.MaxAttempts < 1 {
+        return nil, fmt.Errorf("WEBHOOK_MAX_ATTEMPTS must be positive, got %d", w.options.MaxAttempts)
+    }
+    if w.options.Workers < 1 {
+        return nil, fmt.Errorf("WEBHOOK_WORKERS must be positive, got %d", w.options.Workers)
+    }
+    w.client = &http.Client{Timeout: w.timeout}
+    return w, nil
+}
+
+// abandonAfter is how long a pending delivery goes without an attempt
+// before the sweep decides its instance stopped: twice the longest a
+// delivery can take
+func (w *Webhooks) abandonAfter() time.Duration {
+    return 2 * time.Duration(w.options.MaxAttempts) * (w.timeout + w.options.MaxBackoff)
+}
+
+// Attach starts delivering the events published on bus
+func (w *Webhooks) Attach(bus *EventBus) error {
+    bus.Hook(w.publish)
+    return w.reload()
+}
+
+// publish queues an event for every webhook of its tenant it passes. It
+// runs under the publishing store's lock, so it only queues.
+func (w *Webhooks) publish(e Event) {
+    w.mu.RLock()
+    defer w.mu.RUnlock()
+    for _, runner := range w.runners {
+        if runner.hook.Tenant == e.Tenant && runner.hook.filter().Match(e) {
+            runner.dispatcher.Enqueue(e)
+        }
+    }
+}
+
+// reload starts delivering to new webhooks and stops delivering to deleted
+// ones; the deleted ones' pending events are abandoned
+func (w *Webhooks) reload() error {
+    hooks, err := w.repo.All()
+    if err != nil {
+        return err
+    }
+    registered := make(map[int]bool, len(hooks))
+    var removed []*webhookRunner
+    w.mu.Lock()
+    for _, h := range hooks {
+        registered[h.ID] = true
+        if _, running := w.runners[h.ID]; !running {
+            w.runners[h.ID] = w.newRunner(h)
+        }
+    }
+    for id, runner := range w.runners {
+        if !registered[id] {
+            removed = append(removed, runner)
+            delete(w.runners, id)
+        }
+    }
+    w.mu.Unlock()
+    for _, runner := range removed {
+        runner.dispatcher.Close()
+    }
+    w.metrics.Set("webhooks_registered", float64(len(hooks)))
+    return nil
+}
+
+// runner returns the delivery of a webhook, reloading once when this
+// instance does not know it yet
+func (w *Webhooks) runner(tenant string, id int) (*webhookRunner, error) {
+    for reloaded := false; ; reloaded = true {
+        w.mu.RLock()
+        runner, ok := w.runners[id]
+        w.mu.RUnlock()
+        if ok && runner.hook.Tenant == tenant {
+            return runner, nil
+        }
+        if reloaded {
+            return nil, errWebhookNotFound
+        }
+        if err := w.reload(); err != nil {
+            return nil, err
+        }
+    }
+}
+
+// Run picks up webhooks registered or deleted on other instances until ctx ends
+func (w *Webhooks) Run(ctx context.Context) {
+    ticker := time.NewTicker(w.refresh)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            if err := w.reload(); err != nil {
+                slog.Error("reloading webhooks failed", "error", err)
+            }
+        }
+    }
+}
+
+// Close stops delivery; deliveries in progress stay pending until the
+// sweep dead-letters them
+func (w *Webhooks) Close() {
+    w.mu.Lock()
+    runners := w.runners
+    w.runners = make(map[int]*webhookRunner)
+    w.mu.Unlock()
+    for _, runner := range runners {
+        runner.dispatcher.Close()
+    }
+}
+
+// sweep runs on the leader: every interval it dead-letters abandoned
+// deliveries and prunes delivered ones past WEBHOOK_RETENTION
+func (w *Webhooks) sweep(ctx context.Context, interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case now := <-ticker.C:
+            w.sweepOnce(now.UTC())
+        }
+    }
+}
+
+func (w *Webhooks) sweepOnce(now time.Time) {
+    stale, err := w.repo.Stale(now.Add(-w.abandonAfter()))
+    if err != nil {
+        slog.Error("listing abandoned webhook deliveries failed", "error", err)
+    }
+    for _, d := range stale {
+        d.Status, d.UpdatedAt = DeliveryDead, now
+        if d.LastError == "" {
+            d.LastError = "abandoned before it was attempted"
+        }
+        if err := w.repo.UpdateDelivery(d, DeliveryPending); err != nil {
+            if !errors.Is(err, errDeliveryChanged) {
+                slog.Error("dead-lettering abandoned webhook delivery failed", "delivery_id", d.ID, "error", err)
+            }
+            continue
+        }
+        w.deadLettered(d, "abandoned")
+    }
+    pruned, err := w.repo.Prune(now.Add(-w.retention))
+    if err != nil {
+        slog.Error("pruning webhook deliveries failed", "error", err)
+        return
+    }
+    if pruned > 0 {
+        slog.Info("pruned webhook deliveries", "deliveries", pruned)
+    }
+}
+
+// deadLettered counts a delivery moved to the dead-letter list and alerts
+// operators, throttled per webhook
+func (w *Webhooks) deadLettered(d WebhookDelivery, reason string) {
+    w.metrics.Inc("webhook_dead_letters_total", "reason", reason)
+    w.alerts.Raise(Alert{
+        Kind:     "webhook_dead_letter",
+        Severity: AlertWarning,
+        Summary:  fmt.Sprintf("Webhook %d delivery %d of %s for student %d dead-lettered: %s", d.WebhookID, d.ID, d.Event.Type, d.Event.StudentID, d.LastError),
+        Fields: map[string]string{
+            "tenant":      d.Tenant,
+            "webhook_id":  strconv.Itoa(d.WebhookID),
+            "delivery_id": strconv.Itoa(d.ID),
+            "reason":      reason,
+            "attempts":    strconv.Itoa(d.Attempts),
+            "last_status": strconv.Itoa(d.LastStatus),
+        },
+        Key: fmt.Sprintf("webhook_dead_letter:%s:%d", d.Tenant, d.WebhookID),
+    })
+}
+
+// Replay sends a dead delivery again. The event goes behind the ones
+// already queued for the webhook, its student's newer events included, and
+// is not rewritten to the student's current version. Replaying a delivery
+// that is not dead fails with errDeliveryChanged.
+func (w *Webhooks) Replay(d WebhookDelivery, now time.Time) (WebhookDelivery, error) {
+    runner, err := w.runner(d.Tenant, d.WebhookID)
+    if err != nil {
+        return WebhookDelivery{}, err
+    }
+    if d.Status != DeliveryDead {
+        return d, errDeliveryChanged
+    }
+    d.Status, d.UpdatedAt = DeliveryPending, now
+    if err := w.repo.UpdateDelivery(d, DeliveryDead); errors.Is(err, errDeliveryChanged) {
+        current, err := w.repo.Delivery(d.Tenant, d.ID)
+        if err != nil {
+            return WebhookDelivery{}, err
+        }
+        return current, errDeliveryChanged
+    } else if err != nil {
+        return WebhookDelivery{}, err
+    }
+    runner.track(d)
+    runner.dispatcher.Enqueue(d.Event)
+    w.metrics.Inc("webhook_replays_total")
+    return d, nil
+}
+
+// webhookEventKey identifies an event among a webhook's deliveries
+type webhookEventKey struct {
+    seq, studentID, version int
+}
+
+func keyOfEvent(e Event) webhookEventKey {
+    return webhookEventKey{e.Seq, e.StudentID, e.Version}
+}
+
+// webhookRunner delivers events to a single webhook
+type webhookRunner struct {
+    webhooks   *Webhooks
+    hook       Webhook
+    dispatcher *EventDispatcher
+
+    mu sync.Mutex
+    // deliveries holds the records of events queued or being retried
+    deliveries map[webhookEventKey]WebhookDelivery
+}
+
+func (w *Webhooks) newRunner(h Webhook) *webhookRunner {
+    runner := &webhookRunner{webhooks: w, hook: h, deliveries: make(map[webhookEventKey]WebhookDelivery)}
+    options := w.options
+    options.GiveUp = runner.giveUp
+    runner.dispatcher = NewEventDispatcher(fmt.Sprintf("webhook-%d", h.ID), runner.deliver, options, w.metrics)
+    return runner
+}
+
+// track remembers the record of a replayed event, so its attempts update it
+func (r *webhookRunner) track(d WebhookDelivery) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.deliveries[keyOfEvent(d.Event)] = d
+}
+
+// record returns the delivery of an event, creating it on the first attempt
+func (r *webhookRunner) record(e Event) (WebhookDelivery, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if d, ok := r.deliveries[keyOfEvent(e)]; ok {
+        return d, nil
+    }
+    now := time.Now().UTC()
+    d, err := r.webhooks.repo.CreateDelivery(WebhookDelivery{
+        Tenant:    r.hook.Tenant,
+        WebhookID: r.hook.ID,
+        Event:     e,
+        Status:    DeliveryPending,
+        CreatedAt: now,
+        UpdatedAt: now,
+    })
+    if err != nil {
+        return WebhookDelivery{}, err
+    }
+    r.deliveries[keyOfEvent(e)] = d
+    return d, nil
+}
+
+// finish saves the outcome of an event's last attempt and forgets it
+func (r *webhookRunner) finish(d WebhookDelivery, done bool) error {
+    r.mu.Lock()
+    if done {
+        delete(r.deliveries, keyOfEvent(d.Event))
+    } else {
+        r.deliveries[keyOfEvent(d.Event)] = d
+    }
+    r.mu.Unlock()
+    return r.webhooks.repo.UpdateDelivery(d, DeliveryPending)
+}
+
+// deliver makes one attempt at an event for the dispatcher
+func (r *webhookRunner) deliver(ctx context.Context, e Event) error {
+    d, err := r.record(e)
+    if err != nil {
+        return fmt.Errorf("recording delivery: %w", err)
+    }
+    status, err := r.post(ctx, d)
+    if ctx.Err() != nil {
+        // Shutting down: the delivery stays pending for the sweep
+        return err
+    }
+    now := time.Now().UTC()
+    d.Attempts++
+    d.LastStatus, d.LastError, d.UpdatedAt = status, "", now
+    if err != nil {
+        d.LastError = err.Error()
+    } else {
+        d.Status, d.DeliveredAt = DeliveryDelivered, &now
+    }
+    if uerr := r.finish(d, err == nil); uerr != nil {
+        slog.Error("saving webhook delivery failed", "webhook_id", r.hook.ID, "delivery_id", d.ID, "error", uerr)
+    }
+    return err
+}
+
+// giveUp dead-letters an event that failed every attempt
+func (r *webhookRunner) giveUp(e Event, err error) {
+    d, rerr := r.record(e)
+    if rerr != nil {
+        slog.Error("dead-lettering webhook delivery failed", "webhook_id", r.hook.ID, "error", rerr)
+        return
+    }
+    d.Status, d.UpdatedAt = DeliveryDead, time.Now().UTC()
+    if d.LastError == "" {
+        d.LastError = err.Error()
+    }
+    if err := r.finish(d, true); err != nil {
+        slog.Error("dead-lettering webhook delivery failed", "webhook_id", r.hook.ID, "delivery_id", d.ID, "error", err)
+        return
+    }
+    r.webhooks.deadLettered(d, "failed")
+}
+
+// post sends a delivery and returns the HTTP status; any status outside
+// 2xx is a failure
+func (r *webhookRunner) post(ctx context.Context, d WebhookDelivery) (int, error) {
+    body, err := json.Marshal(d.Event)
+    if err != nil {
+        return 0, err
+    }
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.hook.URL, bytes.NewReader(body))
+    if err != nil {
+        return 0, err
+    }
+    timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("User-Agent", "student-api-webhooks/"+version)
+    req.Header.Set("X-Webhook-ID", strconv.Itoa(r.hook.ID))
+    req.Header.Set("X-Webhook-Delivery", strconv.Itoa(d.ID))
+    req.Header.Set("X-Webhook-Event", d.Event.Type)
+    req.Header.Set("X-Webhook-Timestamp", timestamp)
+    req.Header.Set("X-Webhook-Signature", "sha256="+signWebhook(r.hook.secret, timestamp, body))
+    resp, err := r.webhooks.client.Do(req)
+    if err != nil {
+        return 0, err
+    }
+    defer resp.Body.Close()
+    io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+    }
+    return resp.StatusCode, nil
+}
+
+// signWebhook returns the hex HMAC-SHA256 of "timestamp.body" keyed with secret
+func signWebhook(secret, timestamp string, body []byte) string {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write([]byte(timestamp + "."))
+    mac.Write(body)
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// tenantWebhook returns one of the tenant's webhooks
+func (w *Webhooks) tenantWebhook(tenant string, id int) (Webhook, error) {
+    hooks, err := w.repo.All()
+    if err != nil {
+        return Webhook{}, err
+    }
+    for _, h := range hooks {
+        if h.ID == id && h.Tenant == tenant {
+            return h, nil
+        }
+    }
+    return Webhook{}, errWebhookNotFound
+}
+
+// CreateWebhook registers a webhook: POST /admin/webhooks {"url": "...",
+// "types": ["student.updated"], "fields": ["email"]}. The secret is in the
+// answer only.
+func (app *App) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+    var req WebhookRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        httpError(w, r, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    req.URL = strings.TrimSpace(req.URL)
+    if errors := req.Validate(); len(errors) > 0 {
+        writeValidationErrors(w, r, errors)
+        return
+    }
+    logger := reqctx.Logger(r.Context())
+    secret := req.Secret
+    if secret == "" {
+        buf := make([]byte, 24)
+        if _, err := rand.Read(buf); err != nil {
+            logger.Error("generating webhook secret failed", "error", err)
+            httpError(w, r, "Internal server error", http.StatusInternalServerError)
+            return
+        }
+        secret = webhookSecretPrefix + hex.EncodeToString(buf)
+    }
+    by := reqctx.User(r.Context())
+    if by == "" {
+        by = "admin"
+    }
+    h, err := app.webhooks.repo.Create(Webhook{
+        Tenant:    reqctx.Tenant(r.Context()),
+        URL:       req.URL,
+        Types:     req.Types,
+        Fields:    req.Fields,
+        CreatedBy: by,
+        CreatedAt: time.Now().UTC(),
+        secret:    secret,
+    })
+    if err != nil {
+        logger.Error("registering webhook failed", "error", err)
+        httpError(w, r, "Internal server error", http.StatusInternalServerError)
+        return
+    }
+    if err := app.webhooks.reload(); err != nil {
+        logger.Error("reloading webhooks failed", "error", err)
+    }
+    logger.Info("webhook registered", "webhook_id", h.ID, "url", h.URL)
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "webhook": h,
+        "secret":  secret,
+    })
+}
+
+// ListWebhooks lists the tenant's webhooks: GET /admin/webhooks
+func (app *App) ListWebhooks(w http.ResponseWriter, r *http.Request) {
+    hooks, err := app.webhooks.repo.All()
+    if err != nil {
+        reqctx.Logger(r.Context()).Error("listing webhooks failed", "error", err)
+        httpError(w, r, "Internal server error", http.StatusInternalServerError)
+        return
+    }
+    tenant := reqctx.Tenant(r.Context())
+    matched := []Webhook{}
+    for _, h := range hooks {
+        if h.Tenant == tenant {
+            matched = append(matched, h)
+        }
+    }
+    json.NewEncoder(w).Encode(matched)
+}
+
+// DeleteWebhook stops deliveries to a webhook and deletes its delivery
+// records: DELETE /admin/webhooks/{id}
+func (app *App) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        httpError(w, r, "Invalid ID", http.StatusBadRequest)
+        return
+    }
+    logger := reqctx.Logger(r.Context())
+    if err := app.webhooks.repo.Delete(reqctx.Tenant(r.Context()), id); errors.Is(err, errWebhookNotFound) {
+        httpError(w, r, "Webhook not found", http.StatusNotFound)
+        return
+    } else if err != nil {
+        logger.Error("deleting webhook failed", "webhook_id", id, "error", err)
+        httpError(w, r, "Internal server error", http.StatusInternalServerError)
+        return
+    }
+    if err := app.webhooks.reload(); err != nil {
+        logger.Error("reloading webhooks failed", "error", err)
+    }
+    logger.Info("webhook deleted", "webhook_id", id)
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// deliveryQuery reads ?status, ?from, ?to (RFC 3339) and ?limit (default
+// 100, at most 1000) into a query of the request's tenant
+func deliveryQuery(r *http.Request) (DeliveryQuery, []ValidationError) {
+    values := r.URL.Query()
+    q := DeliveryQuery{Tenant: reqctx.Tenant(r.Context()), Status: values.Get("status"), Limit: 100}
+    var errors []ValidationError
+    switch q.Status {
+    case "", DeliveryPending, DeliveryDelivered, DeliveryDead:
+    default:
+        errors = append(errors, ValidationError{Field: "status", Code: CodeOutOfRange,
+            Message: fmt.Sprintf("Status must be %s, %s or %s", DeliveryPending, DeliveryDelivered, DeliveryDead)})
+    }
+    for _, bound := range []struct {
+        name, label string
+        to          *time.Time
+    }{{"from", "From", &q.From}, {"to", "To", &q.To}} {
+        if value := values.Get(bound.name); value != "" {
+            at, err := time.Parse(time.RFC3339, value)
+            if err != nil {
+                errors = append(errors, ValidationError{Field: bound.name, Code: CodeOutOfRange,
+                    Message: bound.label + " must be an RFC 3339 time"})
+            }
+            *bound.to = at
+        }
+    }
+    if value := values.Get("limit"); value != "" {
+        limit, err := strconv.Atoi(value)
+        if err != nil || limit < 1 || limit > 1000 {
+            errors = append(errors, ValidationError{Field: "limit", Code: CodeOutOfRange, Message: "Limit must be between 1 and 1000"})
+        }
+        q.Limit = limit
+    }
+    return q, errors
+}
+
+// ListWebhookDeliveries tracks a webhook's deliveries, newest first: GET
+// /admin/webhooks/{id}/deliveries?status=dead&from=...&to=...&limit=100
+func (app *App) ListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        httpError(w, r, "Invalid ID", http.StatusBadRequest)
+        return
+    }
+    q, verrs := deliveryQuery(r)
+    if len(verrs) > 0 {
+        writeValidationErrors(w, r, verrs)
+        return
+    }
+    if _, err := app.webhooks.tenantWebhook(q.Tenant, id); errors.Is(err, errWebhookNotFound) {
+        httpError(w, r, "Webhook not found", http.StatusNotFound)
+        return
+    } else if err != nil {
+        reqctx.Logger(r.Context()).Error("reading webhook failed", "webhook_id", id, "error", err)
+        httpError(w, r, "Internal server error", http.StatusInternalServerError)
+        return
+    }
+    q.WebhookID = id
+    app.writeDeliveries(w, r, q)
+}
+
+// ListDeadLetters lists the tenant's dead deliveries, oldest first: GET
+// /admin/webhooks/dead-letters?webhook_id=1&from=...&to=...&limit=100
+func (app *App) ListDeadLetters(w http.ResponseWriter, r *http.Request) {
+    q, verrs := deliveryQuery(r)
+    if value := r.URL.Query().Get("webhook_id"); value != "" {
+        var err error
+        if q.WebhookID, err = strconv.Atoi(value); err != nil || q.WebhookID < 1 {
+            verrs = append(verrs, ValidationError{Field: "webhook_id", Code: CodeOutOfRange, Message: "Webhook ID must be a positive integer"})
+        }
+    }
+    if len(verrs) > 0 {
+        writeValidationErrors(w, r, verrs)
+        return
+    }
+    q.Status, q.Oldest = DeliveryDead, true
+    app.writeDeliveries(w, r, q)
+}
+
+func (app *App) writeDeliveries(w http.ResponseWriter, r *http.Request, q DeliveryQuery) {
+    deliveries, err := app.webhooks.repo.Deliveries(q)
+    if err != nil {
+        reqctx.Logger(r.Context()).Error("listing webhook deliveries failed", "error", err)
+        httpError(w, r, "Internal server error", http.StatusInternalServerError)
+        return
+    }
+    json.NewEncoder(w).Encode(deliveries)
+}
+
+// ReplayDelivery sends a dead delivery again: POST
+// /admin/webhooks/deliveries/{id}/replay, also served as POST
+// /webhooks/deliveries/{id}/replay
+func (app *App) ReplayDelivery(w http.ResponseWriter, r *http.Request) {
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        httpError(w, r, "Invalid ID", http.StatusBadRequest)
+        return
+    }
+    logger := reqctx.Logger(r.Context())
+    d, err := app.webhooks.repo.Delivery(reqctx.Tenant(r.Context()), id)
+    if err == nil {
+        d, err = app.webhooks.Replay(d, time.Now().UTC())
+    }
+    switch {
+    case errors.Is(err, errDeliveryNotFound):
+        httpError(w, r, "Delivery not found", http.StatusNotFound)
+        return
+    case errors.Is(err, errWebhookNotFound):
+        httpError(w, r, "Webhook not found", http.StatusNotFound)
+        return
+    case errors.Is(err, errDeliveryChanged):
+        httpError(w, r, fmt.Sprintf("Delivery is %s, not %s", d.Status, DeliveryDead), http.StatusConflict)
+        return
+    case err != nil:
+        logger.Error("replaying webhook delivery failed", "delivery_id", id, "error", err)
+        httpError(w, r, "Internal server error", http.StatusInternalServerError)
+        return
+    }
+    logger.Info("webhook delivery replayed", "webhook_id", d.WebhookID, "delivery_id", d.ID)
+    w.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(w).Encode(d)
+}
+
+// deadLetterReplay is the body of POST /admin/webhooks/dead-letters/replay
+type deadLetterReplay struct {
+    WebhookID int       `json:"webhook_id,omitempty"`
+    From      time.Time `json:"from"`
+    To        time.Time `json:"to"`
+    Limit     int       `json:"limit,omitempty"`
+}
+
+// ReplayDeadLetters sends again the dead deliveries created in a time
+// range, oldest first: POST /admin/webhooks/dead-letters/replay {"from":
+// "...", "to": "...", "webhook_id": 1, "limit": 1000}. More is set when
+// the limit left some behind.
+func (app *App) ReplayDeadLetters(w http.ResponseWriter, r *http.Request) {
+    var req deadLetterReplay
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        httpError(w, r, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    if req.Limit == 0 {
+        req.Limit = 1000
+    }
+    var verrs []ValidationError
+    if req.From.IsZero() || req.To.IsZero() || !req.From.Before(req.To) {
+        verrs = append(verrs, ValidationError{Field: "from", Code: CodeOutOfRange, Message: "From and to must be RFC 3339 times, from before to"})
+    }
+    if req.Limit < 1 || req.Limit > 1000 {
+        verrs = append(verrs, ValidationError{Field: "limit", Code: CodeOutOfRange, Message: "Limit must be between 1 and 1000"})
+    }
+    if len(verrs) > 0 {
+        writeValidationErrors(w, r, verrs)
+        return
+    }
+    logger := reqctx.Logger(r.Context())
+    deliveries, err := app.webhooks.repo.Deliveries(DeliveryQuery{
+        Tenant:    reqctx.Tenant(r.Context()),
+        WebhookID: req.WebhookID,
+        Status:    DeliveryDead,
+        From:      req.From,
+        To:        req.To,
+        Limit:     req.Limit + 1,
+        Oldest:    true,
+    })
+    if err != nil {
+        logger.Error("listing dead webhook deliveries failed", "error", err)
+        httpError(w, r, "Internal server error", http.StatusInternalServerError)
+        return
+    }
+    more := len(deliveries) > req.Limit
+    if more {
+        deliveries = deliveries[:req.Limit]
+    }
+    replayed, skipped := 0, 0
+    now := time.Now().UTC()
+    for _, d := range deliveries {
+        // Deliveries replayed meanwhile, or of deleted webhooks, are skipped
+        if _, err := app.webhooks.Replay(d, now); err != nil {
+            if !errors.Is(err, errDeliveryChanged) && !errors.Is(err, errWebhookNotFound) {
+                logger.Error("replaying webhook delivery failed", "delivery_id", d.ID, "error", err)
+            }
+            skipped++
+            continue
+        }
+        replayed++
+    }
+    logger.Info("dead webhook deliveries replayed", "replayed", replayed, "skipped", skipped)
+    w.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "replayed": replayed,
+        "skipped":  skipped,
+        "more":     more,
+    })
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+    "archive/zip"
+    "encoding/xml"
+    "fmt"
+    "io"
+    "strconv"
+    "strings"
+)
+
+// xlsxContentType is the media type of an Office Open XML workbook
+const xlsxContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// xlsxParts are the fixed parts of a single-sheet workbook, written before
+// the sheet itself
+var xlsxParts = []struct{ name, body string }{
+    {"[Content_Types].xml", `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+        `<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+        `<Default Extension="xml" ContentType="application/xml"/>` +
+        `<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+        `<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+        `</Types>`},
+    {"_rels/.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+        `<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+        `</Relationships>`},
+    {"xl/_rels/workbook.xml.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+        `<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+        `</Relationships>`},
+}
+
+// xlsxWriter streams rows into a single-sheet workbook. The sheet is the
+// last zip entry, so rows go out as they are written instead of being held
+// until the file is complete. Strings are stored inline and never evaluated
+// as formulas.
+type xlsxWriter struct {
+    zw    *zip.Writer
+    sheet io.Writer
+    rows  int
+}
+
+// newXLSXWriter writes the workbook parts and opens the sheet named sheetName
+func newXLSXWriter(w io.Writer, sheetName string) (*xlsxWriter, error) {
+    workbook := `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" ` +
+        `xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+        `<sheets><sheet name="` + xlsxEscape(sheetName) + `" sheetId="1" r:id="rId1"/></sheets></workbook>`
+    zw := zip.NewWriter(w)
+    for _, part := range xlsxParts {
+        if err := writeZipPart(zw, part.name, part.body); err != nil {
+            return nil, err
+        }
+    }
+    if err := writeZipPart(zw, "xl/workbook.xml", workbook); err != nil {
+        return nil, err
+    }
+
+    sheet, err := zw.Create("xl/worksheets/sheet1.xml")
+    if err != nil {
+        return nil, err
+    }
+    _, err = io.WriteString(sheet, xml.Header+`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+    return &xlsxWriter{zw: zw, sheet: sheet}, err
+}
+
+func writeZipPart(zw *zip.Writer, name, body string) error {
+    f, err := zw.Create(name)
+    if err != nil {
+        return err
+    }
+    _, err = io.WriteString(f, xml.Header+body)
+    return err
+}
+
+// WriteRow appends a row; ints become numeric cells and anything else text
+func (x *xlsxWriter) WriteRow(cells ...interface{}) error {
+    x.rows++
+    row := `<row r="` + strconv.Itoa(x.rows) + `">`
+    for _, cell := range cells {
+        switch v := cell.(type) {
+        case int:
+            row += `<c><v>` + strconv.Itoa(v) + `</v></c>`
+        default:
+            row += `<c t="inlineStr"><is><t xml:space="preserve">` + xlsxEscape(fmt.Sprint(v)) + `</t></is></c>`
+        }
+    }
+    _, err := io.WriteString(x.sheet, row+`</row>`)
+    return err
+}
+
+// Close finishes the sheet and the zip archive
+func (x *xlsxWriter) Close() error {
+    if _, err := io.WriteString(x.sheet, `</sheetData></worksheet>`); err != nil {
+        return err
+    }
+    return x.zw.Close()
+}
+
+// xlsxEscape escapes text for XML, replacing characters XML cannot hold
+func xlsxEscape(s string) string {
+    var b strings.Builder
+    xml.EscapeText(&b, []byte(s))
+    return b.String()
+}